@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Role is what a user may do with a project or sheet, from no access up to
+// owner. A user's role on a sheet is the first that applies of:
+//   - owner, for the sheet owner
+//   - the project role when it is owner or admin
+//   - the role the sheet lists them with (editor, commenter, viewer, none)
+//   - their project member role
+//   - the project's default role, viewer unless set
+//
+// Server admins can always read.
+type Role string
+
+const (
+	RoleNone      Role = "none"
+	RoleViewer    Role = "viewer"
+	RoleCommenter Role = "commenter"
+	RoleEditor    Role = "editor"
+	RoleAdmin     Role = "admin"
+	RoleOwner     Role = "owner"
+)
+
+var roleRanks = map[Role]int{RoleNone: 0, RoleViewer: 1, RoleCommenter: 2, RoleEditor: 3, RoleAdmin: 4, RoleOwner: 5}
+
+// AtLeast reports whether r allows everything min does.
+func (r Role) AtLeast(min Role) bool {
+	return roleRanks[r] >= roleRanks[min]
+}
+
+// memberRole reports whether r can be given to a project or sheet member.
+// Owners and admins are set through the owner and admin lists instead.
+func memberRole(r Role) bool {
+	switch r {
+	case RoleNone, RoleViewer, RoleCommenter, RoleEditor:
+		return true
+	}
+	return false
+}
+
+// topProjectOf returns the top-level project of a project or folder path.
+func topProjectOf(project string) string {
+	return strings.SplitN(project, "/", 2)[0]
+}
+
+// RoleOf returns the role of user on the sheet.
+func (s *Sheet) RoleOf(user string) Role {
+	if user == "" {
+		return RoleNone
+	}
+	s.mu.RLock()
+	owner, project := s.Owner, s.ProjectName
+	listed := s.Permissions.roleOf(user)
+	s.mu.RUnlock()
+	if user == owner {
+		return RoleOwner
+	}
+	role := globalProjectMeta.ProjectRole(topProjectOf(project), user)
+	if !role.AtLeast(RoleAdmin) && listed != "" {
+		role = listed
+	}
+	if !role.AtLeast(RoleViewer) && globalUserManager.IsAdminUser(user) {
+		return RoleViewer
+	}
+	return role
+}
+
+// CanRead reports whether user may open the sheet.
+func (s *Sheet) CanRead(user string) bool {
+	return s.RoleOf(user).AtLeast(RoleViewer)
+}
+
+// CanComment reports whether user may comment on the sheet's cells.
+func (s *Sheet) CanComment(user string) bool {
+	return s.RoleOf(user).AtLeast(RoleCommenter)
+}
+
+// CanManage reports whether user may manage the sheet's protected ranges
+// and anyone's comments: the sheet owner, project admins and server admins.
+func (s *Sheet) CanManage(user string) bool {
+	s.mu.RLock()
+	owner, project := s.Owner, s.ProjectName
+	s.mu.RUnlock()
+	return user == owner || globalProjectMeta.IsProjectAdmin(topProjectOf(project), user) || globalUserManager.IsAdminUser(user)
+}
+
+// canReadProject reports whether user may see project, a project or folder
+// path: through their project role or through a sheet shared with them.
+func canReadProject(project, user string) bool {
+	if project == "" || globalUserManager.IsAdminUser(user) {
+		return true
+	}
+	if globalProjectMeta.ProjectRole(topProjectOf(project), user).AtLeast(RoleViewer) {
+		return true
+	}
+	for _, s := range globalSheetManager.ListSheets() {
+		if s == nil {
+			continue
+		}
+		if (s.ProjectName == project || strings.HasPrefix(s.ProjectName, project+"/")) && s.CanRead(user) {
+			return true
+		}
+	}
+	return false
+}
+
+// readableSheet returns the sheet for an HTTP handler, or answers 404 or
+// 403 itself and returns nil.
+func readableSheet(w http.ResponseWriter, name, project, user string) *Sheet {
+	sheet := globalSheetManager.GetSheetBy(name, project)
+	if sheet == nil {
+		http.Error(w, "Sheet not found", http.StatusNotFound)
+		return nil
+	}
+	if !sheet.CanRead(user) {
+		http.Error(w, "Forbidden: no access to this sheet", http.StatusForbidden)
+		return nil
+	}
+	return sheet
+}
+
+// sheetReader returns a check of whether user may read the sheet of a
+// project, caching the answer per sheet. Missing sheets are not readable.
+func sheetReader(user string) func(project, sheet string) bool {
+	cache := make(map[string]bool)
+	return func(project, sheet string) bool {
+		k := project + "/" + sheet
+		ok, seen := cache[k]
+		if !seen {
+			s := globalSheetManager.GetSheetBy(sheet, project)
+			ok = s != nil && s.CanRead(user)
+			cache[k] = ok
+		}
+		return ok
+	}
+}
+
+// notifyAccessChanged has the hub disconnect clients of project that can no
+// longer read their sheet. Not for use from the hub goroutine.
+func notifyAccessChanged(project string) {
+	if globalHub == nil {
+		return
+	}
+	globalHub.broadcast <- &Message{Type: "ACCESS_CHANGED", Project: project, User: "system"}
+}
+
+// without returns users minus user, as a new slice.
+func without(users []string, user string) []string {
+	var out []string
+	for _, u := range users {
+		if u != user {
+			out = append(out, u)
+		}
+	}
+	return out
+}
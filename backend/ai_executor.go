@@ -3,12 +3,12 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -25,17 +25,17 @@ type LLMSettings struct {
 }
 
 var (
-	llmSettings     LLMSettings
-	llmSettingsMu   sync.RWMutex
-	llmSettingsFile = filepath.Join(dataDir, "llm_settings.json")
+	llmSettings         LLMSettings
+	llmSettingsMu       sync.RWMutex
+	llmSettingsDocument = "llm_settings.json"
 )
 
 func loadLLMSettings() {
 	llmSettingsMu.Lock()
 	defer llmSettingsMu.Unlock()
-	data, err := os.ReadFile(llmSettingsFile)
+	data, err := globalStore.ReadDocument(llmSettingsDocument)
 	if err != nil {
-		if !os.IsNotExist(err) {
+		if !errors.Is(err, os.ErrNotExist) {
 			log.Printf("Error reading LLM settings: %v", err)
 		}
 		return
@@ -54,7 +54,7 @@ func saveLLMSettings() error {
 		return err
 	}
 	data = append(data, '\n')
-	return os.WriteFile(llmSettingsFile, data, 0644)
+	return globalStore.WriteDocument(llmSettingsDocument, data)
 }
 
 func GetLLMURL() string {
@@ -416,23 +416,12 @@ func ExecuteAICell(projectName, sheetName, row, col string) {
 		return
 	}
 	prompt := cur.AIPrompt
-	cellID := cur.CellID
 	s.mu.RUnlock()
 
 	if strings.TrimSpace(prompt) == "" {
 		return
 	}
 
-	// Prevent duplicate execution (reuse ScriptsExecuted list)
-	ident := projectName + "/" + sheetName + "/" + cellID
-	globalSheetManager.ScriptsExecutedMu.Lock()
-	if idx := indexOf(globalSheetManager.ScriptsExecuted, ident); idx > -1 {
-		globalSheetManager.ScriptsExecutedMu.Unlock()
-		return
-	}
-	globalSheetManager.ScriptsExecuted = append(globalSheetManager.ScriptsExecuted, ident)
-	globalSheetManager.ScriptsExecutedMu.Unlock()
-
 	// If LLM URL is not configured, clear value
 	/*
 		llmURL := GetLLMURL()
@@ -483,36 +472,24 @@ func ExecuteAICell(projectName, sheetName, row, col string) {
 	}
 	s.mu.Unlock()
 
-	globalSheetManager.SaveSheet(s)
+	globalSheetManager.SaveCells(s, cellRef{row, col})
 	globalSheetManager.QueueRowColUpdate(s.ProjectName, s.Name)
-
-	// Trigger dependents
-	globalSheetManager.CellsModifiedByScriptQueueMu.Lock()
-	globalSheetManager.CellsModifiedByScriptQueue = append(
-		globalSheetManager.CellsModifiedByScriptQueue,
-		CellIdentifier{projectName, sheetName, row, col},
-	)
-	globalSheetManager.CellsModifiedByScriptQueueMu.Unlock()
-}
-
-// indexOf returns index of needle in slice or -1
-func indexOf(slice []string, needle string) int {
-	for i, v := range slice {
-		if v == needle {
-			return i
-		}
-	}
-	return -1
 }
 
 // SetCellAIPrompt updates the AI prompt for an AI-generated cell.
 // Only the sheet owner may modify prompts.
 func (s *Sheet) SetCellAIPrompt(row, col, prompt, user string) {
 	s.mu.Lock()
+	done := s.setCellAIPromptLocked(row, col, prompt, user)
+	s.mu.Unlock()
+	done()
+}
+
+// setCellAIPromptLocked is SetCellAIPrompt with s.mu held.
+func (s *Sheet) setCellAIPromptLocked(row, col, prompt, user string) editDone {
 	// Only sheet owner may modify AI prompts
 	if user != s.Owner {
-		s.mu.Unlock()
-		return
+		return editNothing
 	}
 
 	if s.Data[row] == nil {
@@ -522,8 +499,7 @@ func (s *Sheet) SetCellAIPrompt(row, col, prompt, user string) {
 
 	// Prevent edits to locked cells
 	if current.Locked {
-		s.mu.Unlock()
-		return
+		return editNothing
 	}
 
 	// Audit
@@ -554,16 +530,16 @@ func (s *Sheet) SetCellAIPrompt(row, col, prompt, user string) {
 	s.Data[row][col] = current
 	cellID := current.CellID
 	//fmt.Printf("prompt %s %s %s\n", prompt, row, col)
-	s.mu.Unlock()
+	return func() {
+		// Update dependencies (AI prompts use same {{}} reference syntax as scripts)
+		globalSheetManager.UpdateScriptDependencies(s.ProjectName, s.Name, cellID, prompt, row, col)
 
-	// Update dependencies (AI prompts use same {{}} reference syntax as scripts)
-	globalSheetManager.UpdateScriptDependencies(s.ProjectName, s.Name, cellID, prompt, row, col)
+		globalSheetManager.SaveCells(s, cellRef{row, col})
 
-	globalSheetManager.SaveSheet(s)
-
-	// Trigger initial execution
-	if strings.TrimSpace(prompt) != "" {
-		ExecuteAICellOnChange(s.ProjectName, s.Name, row, col)
+		// Trigger initial execution
+		if strings.TrimSpace(prompt) != "" {
+			ExecuteAICellOnChange(s.ProjectName, s.Name, row, col)
+		}
 	}
 }
 
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ────────────────────────────────────────────────
+// Personal access tokens
+// ────────────────────────────────────────────────
+//
+// Users create long-lived tokens for scripts and CI. A token acts as its
+// owner, narrowed by its scopes: read-only or read/write, and optionally a
+// list of top-level projects. Scopes are enforced by apiTokenMiddleware
+// before the request reaches a handler; handlers then accept the token
+// through ValidateToken like a login token. Tokens are stored hashed in
+// DATA/api_tokens.json.
+
+const (
+	apiTokenPrefix = "sst_"
+
+	apiTokenRead  = "read"
+	apiTokenWrite = "write"
+
+	apiTokenDefaultDays = 90
+	apiTokenMaxDays     = 365
+)
+
+type APIToken struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Username   string    `json:"username"`
+	TokenHash  string    `json:"token_hash"`
+	Access     string    `json:"access"`             // "read" or "write"
+	Projects   []string  `json:"projects,omitempty"` // top-level projects; empty means all
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string    `json:"last_used_ip,omitempty"`
+}
+
+// APITokenInfo is a token as listed to its owner (never the secret or hash).
+type APITokenInfo struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Access     string     `json:"access"`
+	Projects   []string   `json:"projects"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+}
+
+type APITokenManager struct {
+	mu     sync.RWMutex
+	tokens map[string]*APIToken // token hash -> token
+}
+
+var globalAPITokens = &APITokenManager{tokens: make(map[string]*APIToken)}
+
+func (tm *APITokenManager) document() string {
+	return "api_tokens.json"
+}
+
+// isAPIToken reports whether a bearer value is a personal access token
+// rather than a login session token.
+func isAPIToken(token string) bool {
+	return strings.HasPrefix(token, apiTokenPrefix)
+}
+
+// bearerToken strips an optional "Bearer " prefix from an Authorization header.
+func bearerToken(header string) string {
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+}
+
+// clientIP returns the caller's address without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (t *APIToken) info() APITokenInfo {
+	info := APITokenInfo{
+		ID:         t.ID,
+		Name:       t.Name,
+		Access:     t.Access,
+		Projects:   append([]string{}, t.Projects...),
+		CreatedAt:  t.CreatedAt,
+		ExpiresAt:  t.ExpiresAt,
+		LastUsedIP: t.LastUsedIP,
+	}
+	if !t.LastUsedAt.IsZero() {
+		lastUsed := t.LastUsedAt
+		info.LastUsedAt = &lastUsed
+	}
+	return info
+}
+
+func (tm *APITokenManager) Load() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	data, err := globalStore.ReadDocument(tm.document())
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("api tokens: read: %v", err)
+		}
+		return
+	}
+	var list []*APIToken
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Printf("api tokens: decode: %v", err)
+		return
+	}
+	for _, t := range list {
+		tm.tokens[t.TokenHash] = t
+	}
+}
+
+// saveLocked persists all tokens. Must be called with the lock held.
+func (tm *APITokenManager) saveLocked() {
+	list := make([]*APIToken, 0, len(tm.tokens))
+	for _, t := range tm.tokens {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		log.Printf("api tokens: encode: %v", err)
+		return
+	}
+	if err := globalStore.WriteDocument(tm.document(), append(data, '\n')); err != nil {
+		log.Printf("api tokens: save: %v", err)
+	}
+}
+
+// Create issues a new token for username. The secret is only returned here.
+func (tm *APITokenManager) Create(username, name, access string, projects []string, expiresInDays int) (string, APITokenInfo, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", APITokenInfo{}, errors.New("name is required")
+	}
+	if access != apiTokenRead && access != apiTokenWrite {
+		return "", APITokenInfo{}, errors.New(`access must be "read" or "write"`)
+	}
+	if expiresInDays == 0 {
+		expiresInDays = apiTokenDefaultDays
+	}
+	if expiresInDays < 1 || expiresInDays > apiTokenMaxDays {
+		return "", APITokenInfo{}, errors.New("expires_in_days must be between 1 and 365")
+	}
+	var scoped []string
+	for _, p := range projects {
+		p = strings.SplitN(strings.TrimSpace(p), "/", 2)[0]
+		if p == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dataDir, p)); err != nil {
+			return "", APITokenInfo{}, errors.New("project not found: " + p)
+		}
+		scoped = append(scoped, p)
+	}
+
+	secret, err := generateToken()
+	if err != nil {
+		return "", APITokenInfo{}, errors.New("failed to generate token")
+	}
+	id, err := generateToken()
+	if err != nil {
+		return "", APITokenInfo{}, errors.New("failed to generate token")
+	}
+	secret = apiTokenPrefix + secret
+	now := time.Now()
+	t := &APIToken{
+		ID:        id[:16],
+		Name:      name,
+		Username:  username,
+		TokenHash: hashToken(secret),
+		Access:    access,
+		Projects:  scoped,
+		CreatedAt: now,
+		ExpiresAt: now.AddDate(0, 0, expiresInDays),
+	}
+	tm.mu.Lock()
+	tm.tokens[t.TokenHash] = t
+	tm.saveLocked()
+	tm.mu.Unlock()
+	return secret, t.info(), nil
+}
+
+// List returns the user's tokens, newest first, including expired ones so
+// they can be cleaned up.
+func (tm *APITokenManager) List(username string) []APITokenInfo {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	list := make([]APITokenInfo, 0)
+	for _, t := range tm.tokens {
+		if t.Username == username {
+			list = append(list, t.info())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Revoke deletes one of the user's tokens by id.
+func (tm *APITokenManager) Revoke(username, id string) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	for hash, t := range tm.tokens {
+		if t.Username == username && t.ID == id {
+			delete(tm.tokens, hash)
+			tm.saveLocked()
+			return nil
+		}
+	}
+	return errors.New("token not found")
+}
+
+// lookup returns a copy of the token for a secret, or an error when it is
+// unknown or expired.
+func (tm *APITokenManager) lookup(secret string) (APIToken, error) {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	t, ok := tm.tokens[hashToken(secret)]
+	if !ok {
+		return APIToken{}, errors.New("invalid token")
+	}
+	if time.Now().After(t.ExpiresAt) {
+		return APIToken{}, errors.New("token expired")
+	}
+	return *t, nil
+}
+
+// Validate returns the owner of a token.
+func (tm *APITokenManager) Validate(secret string) (string, error) {
+	t, err := tm.lookup(secret)
+	if err != nil {
+		return "", err
+	}
+	if !globalUserManager.Exists(t.Username) {
+		return "", errors.New("user not found")
+	}
+	return t.Username, nil
+}
+
+// touch records a token's use. Like session expiry, it is only written back
+// once a minute or when the caller's address changes.
+func (tm *APITokenManager) touch(hash, remoteAddr string) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	t, ok := tm.tokens[hash]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	if now.Sub(t.LastUsedAt) < time.Minute && t.LastUsedIP == remoteAddr {
+		return
+	}
+	t.LastUsedAt = now
+	t.LastUsedIP = remoteAddr
+	tm.saveLocked()
+}
+
+// apiTokenForbiddenPaths are account endpoints a token may never call, so a
+// leaked token cannot mint more tokens, see sessions or change passwords.
+var apiTokenForbiddenPaths = []string{"/api/tokens", "/api/sessions", "/api/logout", "/api/refresh", "/api/user/password", "/api/admin/"}
+
+// maxScopedBodyBytes is the largest JSON body checked for project names. A
+// project-scoped token may not send a larger one.
+const maxScopedBodyBytes = 8 << 20
+
+// tokenRoute names where a route's handler reads the projects it acts on:
+// query parameters and top-level JSON body fields that hold a project or a
+// path inside one.
+type tokenRoute struct {
+	query []string
+	body  []string
+}
+
+// apiTokenRoutes are the routes a project-scoped token may call. Each lists
+// every field its handler takes a project from, so a request cannot name an
+// allowed project in one field and act on another through a different one.
+// Routes that act on no project, or are missing here, are refused.
+var apiTokenRoutes = map[string]tokenRoute{
+	"/api/export":                    {query: []string{"project"}},
+	"/api/export_project":            {query: []string{"project"}},
+	"/api/import_project_xlsx":       {query: []string{"project"}},
+	"/api/sheet/copy":                {body: []string{"source_project", "target_project"}},
+	"/api/sheets/corrupted":          {query: []string{"project"}, body: []string{"project"}},
+	"/api/sheets":                    {query: []string{"project"}, body: []string{"project_name"}},
+	"/api/projects":                  {query: []string{"name"}, body: []string{"name", "OldName", "NewName"}},
+	"/api/projects/admins":           {query: []string{"project"}, body: []string{"project"}},
+	"/api/projects/script-limits":    {query: []string{"project"}, body: []string{"project"}},
+	"/api/projects/members":          {query: []string{"project"}, body: []string{"project"}},
+	"/api/projects/public":           {query: []string{"project"}, body: []string{"project"}},
+	"/api/projects/audit-retention":  {query: []string{"project"}, body: []string{"project"}},
+	"/api/folders":                   {query: []string{"project"}, body: []string{"parent"}},
+	"/api/projects/paste":            {body: []string{"source_path", "dest_path"}},
+	"/api/projects/audit":            {query: []string{"project"}},
+	"/api/sheet":                     {query: []string{"project"}},
+	"/api/sheet/dependency-graph":    {query: []string{"project"}},
+	"/api/sheet/dependencies":        {query: []string{"project"}},
+	"/api/sheet/values":              {query: []string{"project"}},
+	"/api/sheet/cells":               {query: []string{"project"}},
+	"/api/projects/dependency-graph": {query: []string{"project"}},
+	"/api/sheet/permissions":         {query: []string{"project"}},
+	"/api/sheet/protected":           {query: []string{"project"}, body: []string{"project"}},
+	"/api/sheet/comments":            {query: []string{"project"}},
+	"/api/notifications/watches":     {query: []string{"project"}, body: []string{"project"}},
+	"/api/sheet/transfer_owner":      {body: []string{"project_name"}},
+	"/api/sheet/audit":               {query: []string{"project"}},
+	"/api/sheet/history":             {query: []string{"project"}},
+	"/api/sheet/history/diff":        {query: []string{"project"}},
+	"/api/sheet/history/restore":     {body: []string{"project"}},
+	"/api/sheet/versions":            {query: []string{"project"}, body: []string{"project"}},
+	"/api/sheet/branches":            {body: []string{"project"}},
+	"/api/sheet/merge":               {query: []string{"project"}, body: []string{"project"}},
+	"/api/timeline":                  {query: []string{"project"}, body: []string{"project"}},
+	"/api/assets":                    {query: []string{"project"}},
+	"/api/assets/serve":              {query: []string{"project"}},
+	"/api/preview/ai-prompt":         {query: []string{"project"}},
+	"/api/preview/script":            {query: []string{"project"}},
+	"/api/public/sheet/audit":        {query: []string{"project"}},
+	"/api/public/sheet/csv":          {query: []string{"project"}},
+	"/api/public/sheet/markdown":     {query: []string{"project"}},
+}
+
+// requestProjects returns the top-level projects a request to a route in
+// apiTokenRoutes acts on, from the fields its handler reads. ok is false
+// for any other route. Handlers decode JSON bodies whatever the
+// Content-Type says, so a route with body fields has its body read like a
+// handler would; bodies that are not JSON (file uploads) are passed on
+// unread beyond the first maxScopedBodyBytes.
+func requestProjects(r *http.Request) (names []string, ok bool, err error) {
+	route, ok := apiTokenRoutes[r.URL.Path]
+	if !ok {
+		return nil, false, nil
+	}
+	q := r.URL.Query()
+	for _, key := range route.query {
+		for _, v := range q[key] {
+			names = append(names, v)
+		}
+	}
+	if len(route.body) > 0 && r.Body != nil && r.Body != http.NoBody {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxScopedBodyBytes+1))
+		if err != nil {
+			return nil, true, err
+		}
+		rest := r.Body
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), rest), rest}
+		trimmed := bytes.TrimLeft(body, " \t\r\n")
+		if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+			if len(body) > maxScopedBodyBytes {
+				return nil, true, errors.New("request body too large for a project-scoped token")
+			}
+			// Decode like the handlers do: the first value only, and keys
+			// matched to fields without regard to case.
+			var fields map[string]interface{}
+			if json.NewDecoder(bytes.NewReader(body)).Decode(&fields) == nil {
+				for k, v := range fields {
+					for _, key := range route.body {
+						if strings.EqualFold(k, key) {
+							if s, isString := v.(string); isString {
+								names = append(names, s)
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	kept := names[:0]
+	for _, n := range names {
+		if n != "" {
+			kept = append(kept, scopedProjectOf(n))
+		}
+	}
+	return kept, true, nil
+}
+
+// scopedProjectOf returns the top-level project of a project path as it
+// resolves under dataDir, so ".." cannot step into another project.
+func scopedProjectOf(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(p)), "/")
+	return strings.SplitN(p, "/", 2)[0]
+}
+
+// authorize checks a token's scopes against a request. The returned status
+// is 401 for an unusable token and 403 for a request outside its scopes.
+func (t APIToken) authorize(r *http.Request) (int, error) {
+	for _, p := range apiTokenForbiddenPaths {
+		if r.URL.Path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(r.URL.Path, p)) {
+			return http.StatusForbidden, errors.New("endpoint requires a login session")
+		}
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && t.Access != apiTokenWrite {
+		return http.StatusForbidden, errors.New("token is read-only")
+	}
+	if len(t.Projects) == 0 {
+		return 0, nil
+	}
+	names, ok, err := requestProjects(r)
+	if err != nil {
+		return http.StatusForbidden, err
+	}
+	if !ok {
+		return http.StatusForbidden, errors.New("token is limited to projects " + strings.Join(t.Projects, ", ") + " and this endpoint is not project-scoped")
+	}
+	if len(names) == 0 {
+		return http.StatusForbidden, errors.New("token is limited to projects " + strings.Join(t.Projects, ", ") + " and the request names none")
+	}
+	for _, n := range names {
+		allowed := false
+		for _, p := range t.Projects {
+			if n == p {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return http.StatusForbidden, errors.New("token has no access to project " + n)
+		}
+	}
+	return 0, nil
+}
+
+// apiTokenMiddleware enforces personal access token scopes. Requests with a
+// login token or no token pass through unchanged.
+func apiTokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r.Header.Get("Authorization"))
+		if r.Method == http.MethodOptions || !isAPIToken(token) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		t, err := globalAPITokens.lookup(token)
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if status, err := t.authorize(r); err != nil {
+			http.Error(w, "Forbidden: "+err.Error(), status)
+			return
+		}
+		globalAPITokens.touch(t.TokenHash, clientIP(r))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// browserRequestUser returns the user of a request the browser may make on
+// its own, like loading an <img>, which cannot set headers: the session
+// token comes in the Authorization header or else the token query parameter.
+// Personal access tokens are only taken from the header, where their scopes
+// are enforced.
+func browserRequestUser(r *http.Request) (string, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		return globalUserManager.ValidateToken(header)
+	}
+	token := r.URL.Query().Get("token")
+	if isAPIToken(bearerToken(token)) {
+		return "", errors.New("personal access tokens must be sent in the Authorization header")
+	}
+	return globalUserManager.ValidateToken(token)
+}
+
+// allowPublicAccess guards the /api/public/sheet endpoints. They are open to
+// anyone only when the project has public endpoints switched on; otherwise
+// the request needs a login or API token of a user who may read the sheet.
+func allowPublicAccess(w http.ResponseWriter, r *http.Request, project, sheetName string) bool {
+	topProject := strings.SplitN(project, "/", 2)[0]
+	if globalProjectMeta.GetPublicEndpoints(topProject) {
+		return true
+	}
+	if r.Header.Get("Authorization") == "" {
+		http.Error(w, "Public access is disabled for this project; use an API token", http.StatusUnauthorized)
+		return false
+	}
+	username, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	if sheet := globalSheetManager.GetSheetBy(sheetName, project); sheet != nil && !sheet.CanRead(username) {
+		http.Error(w, "Forbidden: no access to this sheet", http.StatusForbidden)
+		return false
+	}
+	return true
+}
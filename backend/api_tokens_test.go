@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRequestProjects(t *testing.T) {
+	tests := []struct {
+		name, target, contentType, body string
+		want                            []string
+	}{
+		{"query", "/api/sheet?project=A/sub", "", "", []string{"A"}},
+		{"json", "/api/sheet/history/restore", "application/json", `{"project":"B"}`, []string{"B"}},
+		{"json without content type", "/api/sheets", "text/plain", `{"project_name":"C"}`, []string{"C"}},
+		{"field case", "/api/sheet/protected", "", `{"Project":"D"}`, []string{"D"}},
+		{"query and body", "/api/sheet/merge?project=E", "", `{"project":"F"}`, []string{"E", "F"}},
+		{"project create", "/api/projects", "application/json", `{"name":"G"}`, []string{"G"}},
+		{"project rename", "/api/projects", "application/json", `{"OldName":"G","NewName":"H"}`, []string{"G", "H"}},
+		{"paste", "/api/projects/paste", "", `{"project":"A","source_path":"B/x","dest_path":"C/y"}`, []string{"B", "C"}},
+		{"folder", "/api/folders", "", `{"project":"A","parent":"B/sub","name":"n"}`, []string{"B"}},
+		{"folder rename", "/api/folders", "", `{"parent":"A","old_name":"x","new_name":"y"}`, []string{"A"}},
+		{"dot dot", "/api/folders", "", `{"parent":"A/../B"}`, []string{"B"}},
+		{"trailing data", "/api/sheet/branches", "", `{"project":"B"} {"project":"A"}`, []string{"B"}},
+		{"not json", "/api/assets?project=H", "multipart/form-data; boundary=x", "--x\r\n\r\n{\"project\":\"I\"}", []string{"H"}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", tt.target, strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		got, ok, err := requestProjects(r)
+		if err != nil || !ok {
+			t.Errorf("%s: requestProjects = %v, %v", tt.name, ok, err)
+			continue
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: requestProjects = %v, want %v", tt.name, got, tt.want)
+		}
+		if body, _ := io.ReadAll(r.Body); string(body) != tt.body {
+			t.Errorf("%s: body after requestProjects = %q, want %q", tt.name, body, tt.body)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/api/notifications?project=A", nil)
+	if _, ok, _ := requestProjects(r); ok {
+		t.Error("requestProjects accepted a route that acts on no project")
+	}
+}
+
+func TestRequestProjectsLargeBody(t *testing.T) {
+	large := strings.Repeat(" ", maxScopedBodyBytes)
+	r := httptest.NewRequest("POST", "/api/sheet/history/restore", strings.NewReader(`{"project":"A","pad":"`+large+`"}`))
+	if _, _, err := requestProjects(r); err == nil {
+		t.Error("requestProjects accepted a JSON body larger than maxScopedBodyBytes")
+	}
+
+	upload := "--x\r\n" + large + "tail"
+	r = httptest.NewRequest("POST", "/api/sheets?project=A", strings.NewReader(upload))
+	if _, _, err := requestProjects(r); err != nil {
+		t.Fatalf("requestProjects on a large upload: %v", err)
+	}
+	if body, _ := io.ReadAll(r.Body); string(body) != upload {
+		t.Errorf("large upload body changed: got %d bytes, want %d", len(body), len(upload))
+	}
+}
+
+func TestAuthorizeProjectScope(t *testing.T) {
+	token := APIToken{Access: apiTokenWrite, Projects: []string{"A"}}
+	tests := []struct {
+		name, method, target, body string
+		allowed                    bool
+	}{
+		{"own sheet", "GET", "/api/sheet?project=A&id=s", "", true},
+		{"other sheet", "GET", "/api/sheet?project=B&id=s", "", false},
+		{"paste with decoy", "POST", "/api/projects/paste", `{"project":"A","source_path":"A","dest_path":"B/copy"}`, false},
+		{"paste sheet with decoy", "POST", "/api/projects/paste", `{"project":"A","source_type":"sheet","source_path":"B","source_sheet_id":"s","dest_path":"A"}`, false},
+		{"paste inside project", "POST", "/api/projects/paste", `{"source_path":"A/x","dest_path":"A/y"}`, true},
+		{"folder with decoy", "POST", "/api/folders", `{"project":"A","parent":"B","name":"x"}`, false},
+		{"folder escaping project", "POST", "/api/folders", `{"parent":"A/../B","name":"x"}`, false},
+		{"folder rename", "PUT", "/api/folders", `{"parent":"A","old_name":"x","new_name":"y"}`, true},
+		{"no project", "POST", "/api/folders", `{"name":"x"}`, false},
+		{"unscoped route", "GET", "/api/notifications?project=A", "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		status, err := token.authorize(r)
+		if allowed := err == nil; allowed != tt.allowed {
+			t.Errorf("%s: authorize = %d, %v; want allowed %v", tt.name, status, err, tt.allowed)
+		}
+	}
+}
+
+func TestBrowserRequestUser(t *testing.T) {
+	for _, target := range []string{
+		"/api/assets/serve?project=P&name=a.png",
+		"/api/assets/serve?project=P&name=a.png&token=" + apiTokenPrefix + "secret",
+		"/api/assets/serve?project=P&name=a.png&token=Bearer%20" + apiTokenPrefix + "secret",
+	} {
+		if user, err := browserRequestUser(httptest.NewRequest("GET", target, nil)); err == nil {
+			t.Errorf("%s: user %q, want the request refused", target, user)
+		}
+	}
+}
@@ -0,0 +1,756 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ────────────────────────────────────────────────
+// Sheet audit logs
+// ────────────────────────────────────────────────
+//
+// Every sheet has an append-only audit log stored beside it by globalStore
+// (<sheet>.audit.jsonl with the json store, the audit_log table with sqlite)
+// rather than inside the sheet. Records are never changed once written:
+//
+//   - a structural edit (row or column insert, delete or move) carries a
+//     Shift that moves the cell of every earlier record; shifts are applied
+//     in memory when the log is next read instead of rewriting the log
+//   - an edit merged into the previous one names the record it Replaces
+//   - a revert is a marker record naming the entry it Reverts, with the
+//     cell and the value it went back to
+//
+// A sheet's log is loaded on first use and indexed by user, action and cell.
+// Records are buffered until the sheet is saved. Compaction (pruning before
+// a timeline event, project retention) rewrites the log without the removed
+// records; the rest keep their original cells so that sheet history
+// (history.go) can still replay them.
+
+// AuditShift describes how a structural edit moved rows or columns. Op is
+// "insert" (a row or column at At), "delete" (Count rows from At; entries on
+// deleted rows keep their row) or "move" (Count rows or columns from At to
+// start at To).
+type AuditShift struct {
+	Axis  string `json:"axis"` // "row" or "col"
+	Op    string `json:"op"`
+	At    int    `json:"at"`
+	Count int    `json:"count,omitempty"`
+	To    int    `json:"to,omitempty"`
+}
+
+// apply maps a 1-based row or column index from before the edit to after it.
+func (sh *AuditShift) apply(v int) int {
+	if v <= 0 {
+		return v
+	}
+	count := sh.Count
+	if count < 1 {
+		count = 1
+	}
+	end := sh.At + count - 1
+	switch sh.Op {
+	case "insert":
+		if v >= sh.At {
+			return v + count
+		}
+	case "delete":
+		if v > end {
+			return v - count
+		}
+	case "move":
+		switch {
+		case v >= sh.At && v <= end:
+			return sh.To + (v - sh.At)
+		case sh.At < sh.To && v > end && v < sh.To+count:
+			return v - count
+		case sh.At > sh.To && v >= sh.To && v < sh.At:
+			return v + count
+		}
+	}
+	return v
+}
+
+// applyTo moves the first cell of e.
+func (sh *AuditShift) applyTo(e *AuditEntry) {
+	if sh.Axis == "col" {
+		if idx := colLabelToIndex(e.Col1); idx > 0 {
+			e.Col1 = indexToColLabel(sh.apply(idx))
+		}
+		return
+	}
+	e.Row1 = sh.apply(e.Row1)
+}
+
+// AuditRecord is one line of a sheet's audit log.
+type AuditRecord struct {
+	Seq int64 `json:"seq"`
+	AuditEntry
+	Shift    *AuditShift `json:"shift,omitempty"`
+	Replaces int64       `json:"replaces,omitempty"`
+	Reverts  int64       `json:"reverts,omitempty"`
+}
+
+// legacyAuditRecords numbers the audit_log of a sheet written before the
+// logs were stored separately. Its coordinates are already current.
+func legacyAuditRecords(entries []AuditEntry) []AuditRecord {
+	recs := make([]AuditRecord, 0, len(entries))
+	for i, e := range entries {
+		ensureEntryCoords(&e)
+		recs = append(recs, AuditRecord{Seq: int64(i + 1), AuditEntry: e})
+	}
+	return recs
+}
+
+// AuditQuery filters GET /api/sheet/audit. Zero fields match everything.
+type AuditQuery struct {
+	User        string
+	ExcludeUser string
+	Action      string
+	Row         int // with Col, entries whose cell is now Col/Row
+	Col         string
+	From        time.Time // inclusive
+	To          time.Time // exclusive
+	Text        string    // case-insensitive, in details, values, user and action
+	Before      int64     // page cursor: only entries with a smaller seq
+	Limit       int
+}
+
+// AuditPage is one page of query results, newest first. NextBefore is the
+// cursor for the following page, 0 on the last one.
+type AuditPage struct {
+	Entries    []AuditRecord `json:"entries"`
+	Total      int           `json:"total"`
+	NextBefore int64         `json:"next_before,omitempty"`
+}
+
+type pendingShift struct {
+	seq   int64
+	shift *AuditShift
+}
+
+// sheetAudit is the in-memory state of one sheet's log.
+type sheetAudit struct {
+	mu        sync.Mutex
+	project   string
+	name      string
+	loaded    bool
+	loadErr   error
+	dropped   bool
+	nextSeq   int64
+	entries   []AuditRecord // live entries by seq, cells as of the last settle
+	pending   []pendingShift
+	unflushed []AuditRecord
+	byUser    map[string][]int64
+	byAction  map[string][]int64
+	byCell    map[string][]int64 // nil until needed after a shift
+}
+
+type AuditLogManager struct {
+	mu   sync.RWMutex
+	logs map[string]*sheetAudit // sheetKey -> log
+}
+
+var globalAuditLog = &AuditLogManager{logs: make(map[string]*sheetAudit)}
+
+func auditCellKey(row int, col string) string {
+	return itoa(row) + "," + col
+}
+
+// get returns the log of a sheet, locked and loaded. The caller unlocks it.
+func (m *AuditLogManager) get(project, name string) *sheetAudit {
+	key := sheetKey(project, name)
+	m.mu.RLock()
+	sa := m.logs[key]
+	m.mu.RUnlock()
+	if sa == nil {
+		m.mu.Lock()
+		if sa = m.logs[key]; sa == nil {
+			sa = &sheetAudit{project: project, name: name}
+			m.logs[key] = sa
+		}
+		m.mu.Unlock()
+	}
+	sa.mu.Lock()
+	if !sa.loaded {
+		sa.loadLocked()
+	}
+	return sa
+}
+
+func (sa *sheetAudit) loadLocked() {
+	sa.loaded = true
+	sa.nextSeq = 1
+	recs, err := globalStore.LoadAudit(sa.project, sa.name)
+	if err != nil {
+		// Appending stays safe; compaction would drop what could not be read
+		sa.loadErr = err
+		log.Printf("audit: load %s: %v", sheetArchivePath(sa.project, sa.name), err)
+	}
+	sa.resetLocked()
+	for _, rec := range recs {
+		sa.applyLocked(rec)
+	}
+}
+
+func (sa *sheetAudit) resetLocked() {
+	sa.entries = nil
+	sa.pending = nil
+	sa.byUser = make(map[string][]int64)
+	sa.byAction = make(map[string][]int64)
+	sa.byCell = nil
+}
+
+func (sa *sheetAudit) indexOf(seq int64) int {
+	i := sort.Search(len(sa.entries), func(i int) bool { return sa.entries[i].Seq >= seq })
+	if i < len(sa.entries) && sa.entries[i].Seq == seq {
+		return i
+	}
+	return -1
+}
+
+// applyLocked adds a record to the in-memory state.
+func (sa *sheetAudit) applyLocked(rec AuditRecord) {
+	if rec.Seq >= sa.nextSeq {
+		sa.nextSeq = rec.Seq + 1
+	}
+	if rec.Reverts != 0 {
+		if i := sa.indexOf(rec.Reverts); i >= 0 {
+			sa.entries[i].ChangeReversed = true
+		}
+		return
+	}
+	if rec.Replaces != 0 {
+		if i := sa.indexOf(rec.Replaces); i >= 0 {
+			sa.entries = append(sa.entries[:i], sa.entries[i+1:]...)
+		}
+	}
+	if rec.Shift != nil {
+		sa.pending = append(sa.pending, pendingShift{seq: rec.Seq, shift: rec.Shift})
+		sa.byCell = nil
+	}
+	sa.entries = append(sa.entries, rec)
+	sa.byUser[rec.User] = append(sa.byUser[rec.User], rec.Seq)
+	sa.byAction[rec.Action] = append(sa.byAction[rec.Action], rec.Seq)
+	if sa.byCell != nil && rec.Row1 > 0 && rec.Col1 != "" {
+		key := auditCellKey(rec.Row1, rec.Col1)
+		sa.byCell[key] = append(sa.byCell[key], rec.Seq)
+	}
+}
+
+// settleLocked applies the pending shifts to the entries logged before them
+// and rebuilds the cell index.
+func (sa *sheetAudit) settleLocked() {
+	for _, p := range sa.pending {
+		n := sort.Search(len(sa.entries), func(i int) bool { return sa.entries[i].Seq >= p.seq })
+		for i := 0; i < n; i++ {
+			p.shift.applyTo(&sa.entries[i].AuditEntry)
+		}
+	}
+	sa.pending = nil
+	if sa.byCell == nil {
+		sa.byCell = make(map[string][]int64)
+		for _, e := range sa.entries {
+			if e.Row1 > 0 && e.Col1 != "" {
+				key := auditCellKey(e.Row1, e.Col1)
+				sa.byCell[key] = append(sa.byCell[key], e.Seq)
+			}
+		}
+	}
+}
+
+// appendLocked numbers rec and queues it for the store.
+func (sa *sheetAudit) appendLocked(rec AuditRecord) AuditRecord {
+	rec.Seq = sa.nextSeq
+	if rec.Timestamp.IsZero() {
+		rec.Timestamp = time.Now()
+	}
+	sa.applyLocked(rec)
+	sa.unflushed = append(sa.unflushed, rec)
+	return rec
+}
+
+// Append logs rec for a sheet and returns its sequence number.
+func (m *AuditLogManager) Append(project, name string, rec AuditRecord) int64 {
+	ensureEntryCoords(&rec.AuditEntry)
+	globalNotifications.observeEdit(project, name, rec.AuditEntry)
+	sa := m.get(project, name)
+	defer sa.mu.Unlock()
+	return sa.appendLocked(rec).Seq
+}
+
+// Latest returns the newest entry for a cell with the given action.
+func (m *AuditLogManager) Latest(project, name, action string, row int, col string) (AuditRecord, bool) {
+	sa := m.get(project, name)
+	defer sa.mu.Unlock()
+	sa.settleLocked()
+	seqs := sa.byCell[auditCellKey(row, col)]
+	for i := len(seqs) - 1; i >= 0; i-- {
+		j := sa.indexOf(seqs[i])
+		if j < 0 {
+			continue
+		}
+		e := sa.entries[j]
+		if e.Action == action && e.Row1 == row && e.Col1 == col {
+			return e, true
+		}
+	}
+	return AuditRecord{}, false
+}
+
+// Revert marks the newest unreverted entry for a cell with the given action
+// and new value as reverted.
+func (m *AuditLogManager) Revert(project, name, action string, row int, col, newValue string) bool {
+	sa := m.get(project, name)
+	defer sa.mu.Unlock()
+	sa.settleLocked()
+	seqs := sa.byCell[auditCellKey(row, col)]
+	for i := len(seqs) - 1; i >= 0; i-- {
+		j := sa.indexOf(seqs[i])
+		if j < 0 {
+			continue
+		}
+		e := sa.entries[j]
+		if e.Action == action && e.Row1 == row && e.Col1 == col && e.NewValue == newValue && !e.ChangeReversed {
+			sa.appendLocked(AuditRecord{Reverts: e.Seq, AuditEntry: AuditEntry{
+				Action: action, Row1: row, Col1: col, OldValue: newValue, NewValue: e.OldValue,
+			}})
+			return true
+		}
+	}
+	return false
+}
+
+// Entries returns the live entries of a sheet, oldest first, with their
+// current cells.
+func (m *AuditLogManager) Entries(project, name string) []AuditRecord {
+	sa := m.get(project, name)
+	defer sa.mu.Unlock()
+	sa.settleLocked()
+	return append([]AuditRecord(nil), sa.entries...)
+}
+
+// Records returns every stored record of a sheet, oldest first, with the
+// cells they were written with.
+func (m *AuditLogManager) Records(project, name string) ([]AuditRecord, error) {
+	sa := m.get(project, name)
+	defer sa.mu.Unlock()
+	if sa.loadErr != nil {
+		return nil, fmt.Errorf("audit log could not be read: %w", sa.loadErr)
+	}
+	if err := sa.flushLocked(); err != nil {
+		return nil, err
+	}
+	return globalStore.LoadAudit(sa.project, sa.name)
+}
+
+// Query returns the page of entries matching q. details, when set, fills in
+// the Details of the returned entries and is searched by q.Text.
+func (m *AuditLogManager) Query(project, name string, q AuditQuery, details func(AuditEntry) string) AuditPage {
+	sa := m.get(project, name)
+	defer sa.mu.Unlock()
+	sa.settleLocked()
+
+	// Walk the smallest index that applies, newest first
+	var seqs []int64
+	indexed := false
+	pick := func(list []int64) {
+		if !indexed || len(list) < len(seqs) {
+			seqs, indexed = list, true
+		}
+	}
+	if q.User != "" {
+		pick(sa.byUser[q.User])
+	}
+	if q.Action != "" {
+		pick(sa.byAction[q.Action])
+	}
+	if q.Row > 0 && q.Col != "" {
+		pick(sa.byCell[auditCellKey(q.Row, q.Col)])
+	}
+	n := len(sa.entries)
+	if indexed {
+		n = len(seqs)
+	}
+	text := strings.ToLower(q.Text)
+	page := AuditPage{Entries: make([]AuditRecord, 0)}
+	for i := n - 1; i >= 0; i-- {
+		j := i
+		if indexed {
+			if j = sa.indexOf(seqs[i]); j < 0 {
+				continue
+			}
+		}
+		e := sa.entries[j]
+		if (q.User != "" && e.User != q.User) ||
+			(q.ExcludeUser != "" && e.User == q.ExcludeUser) ||
+			(q.Action != "" && e.Action != q.Action) ||
+			(q.Row > 0 && q.Col != "" && (e.Row1 != q.Row || e.Col1 != q.Col)) ||
+			(!q.From.IsZero() && e.Timestamp.Before(q.From)) ||
+			(!q.To.IsZero() && !e.Timestamp.Before(q.To)) {
+			continue
+		}
+		if details != nil {
+			e.Details = details(e.AuditEntry)
+		}
+		if text != "" && !strings.Contains(strings.ToLower(strings.Join([]string{e.Details, e.OldValue, e.NewValue, e.User, e.Action}, "\n")), text) {
+			continue
+		}
+		page.Total++
+		if q.Before > 0 && e.Seq >= q.Before {
+			continue
+		}
+		if q.Limit > 0 && len(page.Entries) >= q.Limit {
+			if page.NextBefore == 0 {
+				page.NextBefore = page.Entries[len(page.Entries)-1].Seq
+			}
+			continue
+		}
+		e.Shift, e.Replaces = nil, 0
+		page.Entries = append(page.Entries, e)
+	}
+	return page
+}
+
+// flushLocked writes the buffered records.
+func (sa *sheetAudit) flushLocked() error {
+	if len(sa.unflushed) == 0 || sa.dropped {
+		return nil
+	}
+	if err := globalStore.AppendAudit(sa.project, sa.name, sa.unflushed); err != nil {
+		return err
+	}
+	sa.unflushed = nil
+	return nil
+}
+
+// Flush writes the buffered records of a sheet. Failures are logged and
+// retried by the next flush.
+func (m *AuditLogManager) Flush(project, name string) {
+	m.mu.RLock()
+	sa := m.logs[sheetKey(project, name)]
+	m.mu.RUnlock()
+	if sa == nil {
+		return
+	}
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	if err := sa.flushLocked(); err != nil {
+		log.Printf("audit: append to %s: %v", sheetArchivePath(sa.project, sa.name), err)
+	}
+}
+
+// FlushAll writes the buffered records of every sheet.
+func (m *AuditLogManager) FlushAll() {
+	m.mu.RLock()
+	logs := make([]*sheetAudit, 0, len(m.logs))
+	for _, sa := range m.logs {
+		logs = append(logs, sa)
+	}
+	m.mu.RUnlock()
+	for _, sa := range logs {
+		sa.mu.Lock()
+		if err := sa.flushLocked(); err != nil {
+			log.Printf("audit: append to %s: %v", sheetArchivePath(sa.project, sa.name), err)
+		}
+		sa.mu.Unlock()
+	}
+}
+
+// materializedLocked returns the live entries as records that need no
+// earlier shift, replacement or revert marker.
+func (sa *sheetAudit) materializedLocked(keep func(*AuditRecord) bool) []AuditRecord {
+	sa.settleLocked()
+	recs := make([]AuditRecord, 0, len(sa.entries))
+	for _, e := range sa.entries {
+		if keep != nil && !keep(&e) {
+			continue
+		}
+		e.Shift, e.Replaces = nil, 0
+		recs = append(recs, e)
+	}
+	return recs
+}
+
+// Compact removes the records drop selects, passing the entries among them to
+// archive first when it is set, and rewrites the log. Returns the number of
+// entries removed.
+func (m *AuditLogManager) Compact(project, name string, drop func(*AuditRecord) bool, archive func(project, name string, recs []AuditRecord) error) (int, error) {
+	sa := m.get(project, name)
+	defer sa.mu.Unlock()
+	if sa.loadErr != nil {
+		return 0, fmt.Errorf("audit log could not be read: %w", sa.loadErr)
+	}
+	if err := sa.flushLocked(); err != nil {
+		return 0, err
+	}
+	recs, err := globalStore.LoadAudit(sa.project, sa.name)
+	if err != nil {
+		return 0, err
+	}
+	kept := make([]AuditRecord, 0, len(recs))
+	for i := range recs {
+		if !drop(&recs[i]) {
+			kept = append(kept, recs[i])
+		}
+	}
+	if len(kept) == len(recs) {
+		return 0, nil
+	}
+	removed := len(sa.materializedLocked(drop))
+	if archive != nil {
+		dropped := sa.materializedLocked(drop)
+		if err := archive(sa.project, sa.name, dropped); err != nil {
+			return 0, fmt.Errorf("archive: %w", err)
+		}
+	}
+	if err := globalStore.RewriteAudit(sa.project, sa.name, kept); err != nil {
+		return 0, err
+	}
+	sa.unflushed = nil
+	sa.resetLocked()
+	for _, rec := range kept {
+		sa.applyLocked(rec)
+	}
+	return removed, nil
+}
+
+// Copy gives a new sheet the audit log of the sheet it was copied from.
+func (m *AuditLogManager) Copy(srcProject, srcName, dstProject, dstName string) {
+	sa := m.get(srcProject, srcName)
+	recs := sa.materializedLocked(nil)
+	sa.mu.Unlock()
+	m.Drop(dstProject, dstName)
+	if err := globalStore.RewriteAudit(dstProject, dstName, recs); err != nil {
+		log.Printf("audit: copy to %s: %v", sheetArchivePath(dstProject, dstName), err)
+	}
+}
+
+// ImportLegacy moves the audit_log of a sheet file written before the logs
+// were stored separately into the sheet's log, unless it has one already.
+func (m *AuditLogManager) ImportLegacy(project, name string, entries []AuditEntry) error {
+	sa := m.get(project, name)
+	defer sa.mu.Unlock()
+	if sa.loadErr != nil {
+		return sa.loadErr
+	}
+	if sa.nextSeq > 1 || len(entries) == 0 {
+		return nil
+	}
+	recs := legacyAuditRecords(entries)
+	if err := globalStore.AppendAudit(project, name, recs); err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		sa.applyLocked(rec)
+	}
+	return nil
+}
+
+// RenameSheet moves the cached log of a renamed sheet. The store renames the
+// stored log with the sheet.
+func (m *AuditLogManager) RenameSheet(project, oldName, newName string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sa := m.logs[sheetKey(project, oldName)]; sa != nil {
+		delete(m.logs, sheetKey(project, oldName))
+		sa.mu.Lock()
+		sa.name = newName
+		sa.mu.Unlock()
+		m.logs[sheetKey(project, newName)] = sa
+	}
+}
+
+// RenameProject moves the cached logs of a renamed project or folder.
+func (m *AuditLogManager) RenameProject(oldPath, newPath string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, sa := range m.logs {
+		sa.mu.Lock()
+		if sa.project == oldPath || strings.HasPrefix(sa.project, oldPath+"/") {
+			delete(m.logs, key)
+			sa.project = newPath + sa.project[len(oldPath):]
+			m.logs[sheetKey(sa.project, sa.name)] = sa
+		}
+		sa.mu.Unlock()
+	}
+}
+
+// Drop forgets the log of a deleted sheet, including unwritten records.
+func (m *AuditLogManager) Drop(project, name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sa := m.logs[sheetKey(project, name)]; sa != nil {
+		delete(m.logs, sheetKey(project, name))
+		sa.mu.Lock()
+		sa.dropped = true
+		sa.mu.Unlock()
+	}
+}
+
+// DropProject forgets the logs of every sheet in a deleted project or folder.
+func (m *AuditLogManager) DropProject(project string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, sa := range m.logs {
+		sa.mu.Lock()
+		if sa.project == project || strings.HasPrefix(sa.project, project+"/") {
+			delete(m.logs, key)
+			sa.dropped = true
+		}
+		sa.mu.Unlock()
+	}
+}
+
+// Reset forgets every cached log, for when the store was replaced by a
+// restore.
+func (m *AuditLogManager) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, sa := range m.logs {
+		sa.mu.Lock()
+		sa.dropped = true
+		sa.mu.Unlock()
+	}
+	m.logs = make(map[string]*sheetAudit)
+}
+
+// logAudit appends e to the sheet's audit log. Caller holds s.mu.
+func (s *Sheet) logAudit(e AuditEntry) {
+	globalAuditLog.Append(s.ProjectName, s.Name, AuditRecord{AuditEntry: e})
+}
+
+// logAuditShift appends e for a structural edit that moved rows or columns.
+// Caller holds s.mu.
+func (s *Sheet) logAuditShift(e AuditEntry, shift *AuditShift) {
+	globalAuditLog.Append(s.ProjectName, s.Name, AuditRecord{AuditEntry: e, Shift: shift})
+	globalUndo.observeShift(s.ProjectName, s.Name, e.User, shift)
+	globalRevisions.observeShift(s.ProjectName, s.Name, shift)
+	globalNotifications.observeShift(s.ProjectName, s.Name, shift)
+	s.shiftProtectedRangesLocked(shift)
+}
+
+// importLegacyAudit moves the audit_log read from an old sheet file into the
+// sheet's audit log. Reports whether the sheet should be rewritten without it.
+func importLegacyAudit(s *Sheet) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.legacyAudit == nil {
+		return false
+	}
+	if err := globalAuditLog.ImportLegacy(s.ProjectName, s.Name, s.legacyAudit); err != nil {
+		log.Printf("audit: import audit_log of %s: %v", sheetArchivePath(s.ProjectName, s.Name), err)
+		return false
+	}
+	s.legacyAudit = nil
+	return true
+}
+
+// ── Retention ────────────────────────────────────
+
+// auditArchiveDir receives the entries removed by retention for projects
+// that archive them, as gzipped JSON lines per sheet and run.
+var auditArchiveDir = filepath.Join(dataDir, "..", "AUDIT_ARCHIVE")
+
+// writeAuditArchive writes recs to
+// <auditArchiveDir>/<project>/<sheet>_<first seq>-<last seq>.jsonl.gz.
+func writeAuditArchive(project, name string, recs []AuditRecord) error {
+	if len(recs) == 0 {
+		return nil
+	}
+	dir := filepath.Join(auditArchiveDir, filepath.FromSlash(project))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	target := filepath.Join(dir, fmt.Sprintf("%s_%d-%d.jsonl.gz", name, recs[0].Seq, recs[len(recs)-1].Seq))
+	tmp := target + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	enc := json.NewEncoder(zw)
+	for _, rec := range recs {
+		if err = enc.Encode(rec); err != nil {
+			break
+		}
+	}
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, target)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// applyAuditRetention removes the audit entries of a project's sheets that
+// are older than its retention period. Returns the number removed.
+func applyAuditRetention(project string) int {
+	retention := globalProjectMeta.GetAuditRetention(project)
+	if retention == nil || retention.Days <= 0 {
+		return 0
+	}
+	cutoff := time.Now().AddDate(0, 0, -retention.Days)
+	var archive func(string, string, []AuditRecord) error
+	if retention.Archive {
+		archive = writeAuditArchive
+	}
+	total := 0
+	for _, s := range globalSheetManager.ListSheets() {
+		s.mu.RLock()
+		sheetProject, name := s.ProjectName, s.Name
+		s.mu.RUnlock()
+		if sheetProject != project && !strings.HasPrefix(sheetProject, project+"/") {
+			continue
+		}
+		if err := trimHistory(sheetProject, name, cutoff); err != nil {
+			log.Printf("audit retention: history of %s: %v", sheetArchivePath(sheetProject, name), err)
+			continue
+		}
+		removed, err := globalAuditLog.Compact(sheetProject, name, func(r *AuditRecord) bool {
+			return r.Timestamp.Before(cutoff)
+		}, archive)
+		if err != nil {
+			log.Printf("audit retention: %s: %v", sheetArchivePath(sheetProject, name), err)
+			continue
+		}
+		total += removed
+	}
+	if total > 0 {
+		log.Printf("audit retention: removed %d entries older than %d days from project %s", total, retention.Days, project)
+	}
+	return total
+}
+
+// startAuditRetention applies every project's audit retention now and then
+// every interval. A non-positive interval leaves it to the settings endpoint.
+func startAuditRetention(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			for project := range globalProjectMeta.AuditRetentionProjects() {
+				applyAuditRetention(project)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
@@ -0,0 +1,848 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ────────────────────────────────────────────────
+// Backups and restore
+// ────────────────────────────────────────────────
+//
+// A backup is a zip of DATA with forward-slash paths, as streamed by
+// /api/admin/backup. The scheduler writes the same archive to backupDir every
+// interval and keeps the newest backupKeep files. Restore verifies the
+// archive's .shasum companions before touching DATA, flushes pending saves,
+// swaps the files in and reloads the in-memory managers.
+
+var (
+	backupDir  = filepath.Join(dataDir, "..", "BACKUPS")
+	backupKeep = 7
+)
+
+// Restore scopes accepted by /api/admin/restore.
+const (
+	RestoreScopeAll     = "all"
+	RestoreScopeProject = "project"
+	RestoreScopeSheet   = "sheet"
+)
+
+// restoreKeepFiles are top-level DATA entries a full restore leaves alone:
+// credentials revoked since the backup must stay revoked, and the Python
+// working directory is not data.
+var restoreKeepFiles = map[string]bool{
+	"sessions.json":   true,
+	"api_tokens.json": true,
+	"pythonDirectory": true,
+}
+
+// isStoreDBFile reports whether a path relative to DATA belongs to the live
+// SQLite database, which is never copied as a file.
+func isStoreDBFile(rel string) bool {
+	return strings.HasPrefix(rel, sqliteStoreFile) || strings.HasPrefix(rel, "store-snapshot-")
+}
+
+// restoreMu serialises restores and scheduled backups.
+var restoreMu sync.Mutex
+
+// BackupInfo describes a backup file in backupDir.
+type BackupInfo struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// writeBackupZip writes every file under DATA into zw. The SQLite database
+// is added as a consistent snapshot instead of the live file, with a
+// .shasum like the JSON files.
+func writeBackupZip(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	absDataDir, absErr := filepath.Abs(dataDir)
+	if absErr != nil {
+		absDataDir = dataDir
+	}
+	walkErr := filepath.Walk(absDataDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, relErr := filepath.Rel(absDataDir, p)
+		if relErr != nil {
+			rel = info.Name()
+		}
+		if isStoreDBFile(rel) {
+			return nil
+		}
+		// Use forward slashes inside the zip
+		f, createErr := zw.Create(filepath.ToSlash(rel))
+		if createErr != nil {
+			return createErr
+		}
+		data, readErr := os.ReadFile(p)
+		if readErr != nil {
+			return readErr
+		}
+		_, writeErr := f.Write(data)
+		return writeErr
+	})
+	if walkErr == nil {
+		walkErr = globalStore.Use(func(st Store) error {
+			sqliteStore, ok := st.(*SQLiteStore)
+			if !ok {
+				return nil
+			}
+			f, err := zw.Create(sqliteStoreFile)
+			if err != nil {
+				return err
+			}
+			h := newChecksumHash()
+			if err := sqliteStore.WriteSnapshot(io.MultiWriter(f, h)); err != nil {
+				return err
+			}
+			if f, err = zw.Create(shasumPath(sqliteStoreFile)); err != nil {
+				return err
+			}
+			_, err = io.WriteString(f, hex.EncodeToString(h.Sum(nil)))
+			return err
+		})
+	}
+	if closeErr := zw.Close(); walkErr == nil {
+		walkErr = closeErr
+	}
+	return walkErr
+}
+
+// CreateLocalBackup flushes pending saves and writes a backup named
+// "<prefix>_<timestamp>.zip" into backupDir, then applies retention.
+func CreateLocalBackup(prefix string) (BackupInfo, error) {
+	if err := os.MkdirAll(backupDir, 0755); err != nil {
+		return BackupInfo{}, err
+	}
+	globalSheetManager.Save()
+
+	stamp := time.Now().Format("2006-01-02_15-04-05")
+	name := fmt.Sprintf("%s_%s.zip", prefix, stamp)
+	target := filepath.Join(backupDir, name)
+	for n := 2; ; n++ {
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			break
+		}
+		name = fmt.Sprintf("%s_%s_%d.zip", prefix, stamp, n)
+		target = filepath.Join(backupDir, name)
+	}
+	tmp := target + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	if err := writeBackupZip(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return BackupInfo{}, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return BackupInfo{}, err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return BackupInfo{}, err
+	}
+	pruneBackups()
+	info, err := os.Stat(target)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	return BackupInfo{Name: name, Size: info.Size(), CreatedAt: info.ModTime()}, nil
+}
+
+// ListBackups returns the backups in backupDir, newest first.
+func ListBackups() []BackupInfo {
+	list := make([]BackupInfo, 0)
+	entries, err := os.ReadDir(backupDir)
+	if err != nil {
+		return list
+	}
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".zip" {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		list = append(list, BackupInfo{Name: e.Name(), Size: info.Size(), CreatedAt: info.ModTime()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// pruneBackups deletes all but the newest backupKeep backups.
+func pruneBackups() {
+	if backupKeep <= 0 {
+		return
+	}
+	list := ListBackups()
+	for _, b := range list[min(backupKeep, len(list)):] {
+		if err := os.Remove(filepath.Join(backupDir, b.Name)); err != nil {
+			log.Printf("backup: prune %s: %v", b.Name, err)
+		}
+	}
+}
+
+// backupPath resolves a backup name from ListBackups to its file, refusing
+// anything that is not a plain file name.
+func backupPath(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || filepath.Ext(name) != ".zip" {
+		return "", errors.New("invalid backup name")
+	}
+	p := filepath.Join(backupDir, name)
+	if _, err := os.Stat(p); err != nil {
+		return "", errors.New("backup not found")
+	}
+	return p, nil
+}
+
+// startBackupScheduler writes a backup every interval until the process exits.
+func startBackupScheduler(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	log.Printf("Scheduled backups every %v into %s (keeping %d)", interval, backupDir, backupKeep)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			restoreMu.Lock()
+			info, err := CreateLocalBackup("backup")
+			restoreMu.Unlock()
+			if err != nil {
+				log.Printf("backup: scheduled backup failed: %v", err)
+				continue
+			}
+			log.Printf("backup: wrote %s (%d bytes)", info.Name, info.Size)
+		}
+	}()
+}
+
+// ── Restore ──────────────────────────────────────
+
+// RestoreRequest selects what part of an archive to restore.
+type RestoreRequest struct {
+	Scope   string
+	Project string
+	Sheet   string
+}
+
+// RestoreResult summarises a completed restore.
+type RestoreResult struct {
+	Scope        string   `json:"scope"`
+	Project      string   `json:"project,omitempty"`
+	Sheet        string   `json:"sheet,omitempty"`
+	Files        int      `json:"files"`
+	SafetyBackup string   `json:"safety_backup"`
+	Sheets       int      `json:"sheets"`
+	Skipped      []string `json:"skipped,omitempty"`
+}
+
+// BackupValidationError lists archive entries that failed verification.
+type BackupValidationError struct {
+	Files []string `json:"files"`
+}
+
+func (e *BackupValidationError) Error() string {
+	return "backup failed integrity verification: " + strings.Join(e.Files, ", ")
+}
+
+// checksummedEntry reports whether the server writes a .shasum for this
+// archive path: the SQLite database, the common JSON files and sheet files
+// inside projects.
+func checksummedEntry(name string) bool {
+	switch name {
+	case sqliteStoreFile, "users.json", "projects.json", "project_audit.json":
+		return true
+	}
+	if path.Ext(name) != ".json" {
+		return false
+	}
+	if !strings.Contains(name, "/") || strings.HasPrefix(name, "pythonDirectory/") {
+		return false
+	}
+	return path.Base(name) != "timeline.json"
+}
+
+// selectEntries returns the archive files the request covers, keyed by path.
+// A project or sheet restore takes its sheets from the archived SQLite
+// database when there is one, so that is selected too.
+func selectEntries(zr *zip.Reader, req RestoreRequest) (map[string]*zip.File, error) {
+	selected := make(map[string]*zip.File)
+	sheetFile := req.Sheet + ".json"
+	auditFile := req.Sheet + auditLogSuffix
+	if req.Project != "" {
+		sheetFile = req.Project + "/" + sheetFile
+		auditFile = req.Project + "/" + auditFile
+	}
+	for _, f := range zr.File {
+		name := f.Name
+		if strings.HasSuffix(name, "/") {
+			continue
+		}
+		if strings.Contains(name, "\\") || path.IsAbs(name) || path.Clean(name) != name || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("unsafe path in archive: %s", name)
+		}
+		switch req.Scope {
+		case RestoreScopeAll:
+			if restoreKeepFiles[strings.SplitN(name, "/", 2)[0]] {
+				continue
+			}
+		case RestoreScopeProject:
+			if !strings.HasPrefix(name, req.Project+"/") && !isStoreDBFile(name) {
+				continue
+			}
+		case RestoreScopeSheet:
+			if name != sheetFile && name != shasumPath(sheetFile) && name != auditFile && !isStoreDBFile(name) {
+				continue
+			}
+		}
+		selected[name] = f
+	}
+	if len(selected) == 0 {
+		return nil, errors.New("nothing to restore: the archive has no matching files")
+	}
+	if req.Scope == RestoreScopeSheet && selected[sheetFile] == nil && selected[sqliteStoreFile] == nil {
+		return nil, errors.New("sheet not found in archive")
+	}
+	return selected, nil
+}
+
+// archiveEntries returns the named archive files that exist, keyed by path.
+func archiveEntries(zr *zip.Reader, names ...string) map[string]*zip.File {
+	entries := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		if slices.Contains(names, f.Name) {
+			entries[f.Name] = f
+		}
+	}
+	return entries
+}
+
+// notifyRestoring has the hub refuse edits from clients while a restore
+// runs. Messages the hub already took are handled before it returns.
+func notifyRestoring(on bool) {
+	if globalHub == nil {
+		return
+	}
+	typ := "RESTORE_FINISHED"
+	if on {
+		typ = "RESTORE_STARTED"
+	}
+	globalHub.broadcast <- &Message{Type: typ, User: "system"}
+}
+
+// editGate keeps HTTP writes and restores apart. Requests that change data
+// hold it for reading; RestoreBackup holds it for writing, so it waits for
+// writes already running and refuses new ones until it is done.
+var editGate sync.RWMutex
+
+// beginEdit admits a request that changes data, or answers 503 while a
+// restore runs. The caller calls done once the request is handled.
+func beginEdit(w http.ResponseWriter) (done func(), ok bool) {
+	if !editGate.TryRLock() {
+		http.Error(w, "A backup restore is in progress; try again when it has finished", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return editGate.RUnlock, true
+}
+
+// restoreExemptPaths change nothing a restore replaces (sessions, tokens,
+// script previews), or are serialised with restores through restoreMu.
+var restoreExemptPaths = map[string]bool{
+	"/api/login": true, "/api/logout": true, "/api/refresh": true, "/api/sessions": true, "/api/tokens": true,
+	"/api/admin/user/logout": true, "/api/admin/backups": true, "/api/admin/restore": true, "/api/admin/repair": true,
+	"/api/preview/ai-prompt": true, "/api/preview/script": true, "/api/notifications/test": true,
+}
+
+// restoreGuardMiddleware passes every request that may change data through
+// beginEdit, so HTTP writes cannot interleave with a restore.
+func restoreGuardMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if restoreExemptPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		done, ok := beginEdit(w)
+		if !ok {
+			return
+		}
+		defer done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// verifyEntries checks every selected JSON file against its .shasum, using the
+// same salt as integrity.go. Files the server checksums must have one.
+func verifyEntries(entries map[string]*zip.File) error {
+	var bad []string
+	for name, f := range entries {
+		if strings.HasSuffix(name, ".shasum") {
+			continue
+		}
+		sum, hasSum := entries[shasumPath(name)]
+		if !hasSum {
+			if checksummedEntry(name) {
+				bad = append(bad, name+" (no checksum)")
+			}
+			continue
+		}
+		h := newChecksumHash()
+		rc, err := f.Open()
+		if err == nil {
+			_, err = io.Copy(h, rc)
+			rc.Close()
+		}
+		if err != nil {
+			bad = append(bad, name+" ("+err.Error()+")")
+			continue
+		}
+		stored, err := readZipFile(sum)
+		if err != nil || strings.TrimSpace(string(stored)) != hex.EncodeToString(h.Sum(nil)) {
+			bad = append(bad, name+" (checksum mismatch)")
+		}
+	}
+	if len(bad) > 0 {
+		sort.Strings(bad)
+		return &BackupValidationError{Files: bad}
+	}
+	return nil
+}
+
+// extractEntries writes the selected files below dir.
+func extractEntries(entries map[string]*zip.File, dir string) error {
+	for name, f := range entries {
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := extractFile(f, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractFile(f *zip.File, target string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, rc); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// moveEntries renames every top-level entry of src into dst, skipping the
+// names in keep.
+func moveEntries(src, dst string, keep map[string]bool) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if keep[e.Name()] {
+			continue
+		}
+		if err := os.Rename(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreBackup validates the archive and restores the requested scope into
+// DATA. A safety backup of the current state is taken first.
+func RestoreBackup(zr *zip.Reader, req RestoreRequest, user string) (RestoreResult, error) {
+	result := RestoreResult{Scope: req.Scope, Project: req.Project, Sheet: req.Sheet}
+	entries, err := selectEntries(zr, req)
+	if err != nil {
+		return result, err
+	}
+	if err := verifyEntries(entries); err != nil {
+		return result, err
+	}
+	result.Files = len(entries)
+	// Sheets live inside store.db with the sqlite store, so they can only
+	// come back from a backup taken with it
+	_, isSQLite := globalStore.Backend().(*SQLiteStore)
+	fromStore := entries[sqliteStoreFile] != nil
+	if isSQLite && !fromStore {
+		return result, errors.New("the archive has no " + sqliteStoreFile + "; it was taken with the json store")
+	}
+
+	// The owner and settings of a top-level project come from projects.json,
+	// which must pass verification too
+	var metaEntries map[string]*zip.File
+	if req.Scope == RestoreScopeProject && !strings.Contains(req.Project, "/") && !fromStore {
+		metaEntries = archiveEntries(zr, "projects.json", shasumPath("projects.json"))
+		if err := verifyEntries(metaEntries); err != nil {
+			return result, err
+		}
+	}
+
+	// Edits made now would be lost or land on the wrong data. The gate is
+	// taken before restoreMu, which repairs and backups take on their own.
+	editGate.Lock()
+	defer editGate.Unlock()
+	restoreMu.Lock()
+	defer restoreMu.Unlock()
+	notifyRestoring(true)
+	defer notifyRestoring(false)
+
+	staging := dataDir + ".restore"
+	previous := dataDir + ".previous"
+	os.RemoveAll(staging)
+	os.RemoveAll(previous)
+	defer os.RemoveAll(staging)
+	if err := extractEntries(entries, staging); err != nil {
+		return result, err
+	}
+	// A project or sheet restore from store.db copies sheets out of it
+	var src *SQLiteStore
+	var sheets []*Sheet
+	if fromStore && req.Scope != RestoreScopeAll {
+		if src, sheets, err = openArchivedStore(staging, req); err != nil {
+			return result, err
+		}
+		defer src.Close()
+		if req.Scope == RestoreScopeSheet && len(sheets) == 0 {
+			return result, errors.New("sheet not found in archive")
+		}
+		if _, err := os.Stat(filepath.Join(staging, filepath.FromSlash(req.Project))); req.Scope == RestoreScopeProject && len(sheets) == 0 && err != nil {
+			return result, errors.New("project not found in archive")
+		}
+	}
+
+	safety, err := CreateLocalBackup("pre-restore")
+	if err != nil {
+		return result, fmt.Errorf("safety backup failed: %v", err)
+	}
+	result.SafetyBackup = safety.Name
+
+	// previous holds the replaced files until the swap succeeded; after a
+	// failure it is left in place next to DATA alongside the safety backup.
+	if err := os.MkdirAll(previous, 0755); err != nil {
+		return result, err
+	}
+
+	switch req.Scope {
+	case RestoreScopeAll:
+		if isSQLite {
+			err := globalStore.Replace(func(st Store) (Store, error) {
+				return swapSQLiteStore(st.(*SQLiteStore), staging, previous)
+			})
+			if err != nil {
+				return result, err
+			}
+			break
+		}
+		if err := moveEntries(dataDir, previous, restoreKeepFiles); err != nil {
+			return result, err
+		}
+		if err := moveEntries(staging, dataDir, nil); err != nil {
+			return result, err
+		}
+	case RestoreScopeProject:
+		live := filepath.Join(dataDir, filepath.FromSlash(req.Project))
+		archived := filepath.Join(staging, filepath.FromSlash(req.Project))
+		if _, err := os.Stat(live); err == nil {
+			if err := os.Rename(live, filepath.Join(previous, "project")); err != nil {
+				return result, err
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(live), 0755); err != nil {
+			return result, err
+		}
+		var moveErr error
+		if _, err := os.Stat(archived); os.IsNotExist(err) && fromStore {
+			// Only sheets and timelines, which are in store.db
+			moveErr = os.Mkdir(live, 0755)
+		} else {
+			moveErr = os.Rename(archived, live)
+		}
+		if moveErr != nil {
+			return result, moveErr
+		}
+		if fromStore {
+			if err := restoreSheets(src, sheets, req); err != nil {
+				return result, err
+			}
+			data, err := src.ReadDocument("projects.json")
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return result, err
+			}
+			result.Skipped = restoreProjectMeta(data, req.Project)
+		} else {
+			result.Skipped = restoreProjectMeta(archivedFile(metaEntries, "projects.json"), req.Project)
+		}
+	case RestoreScopeSheet:
+		if fromStore {
+			if err := restoreSheets(src, sheets, req); err != nil {
+				return result, err
+			}
+			break
+		}
+		for name := range entries {
+			target := filepath.Join(dataDir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return result, err
+			}
+			if err := os.Rename(filepath.Join(staging, filepath.FromSlash(name)), target); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	os.RemoveAll(previous)
+
+	result.Sheets = reloadAfterRestore(req)
+	details := fmt.Sprintf("restored %s from backup (%d files, safety backup %s)", req.Scope, result.Files, safety.Name)
+	if req.Scope == RestoreScopeSheet {
+		details = fmt.Sprintf("restored sheet %s from backup (safety backup %s)", req.Sheet, safety.Name)
+	}
+	if req.Project != "" {
+		globalProjectAuditManager.Append(strings.SplitN(req.Project, "/", 2)[0], user, "RESTORE", details)
+	}
+	log.Printf("restore: %s by %s: %s", req.Scope, user, details)
+	return result, nil
+}
+
+// openArchivedStore opens the store.db extracted into staging and returns
+// the sheets in it that a project or sheet restore covers.
+func openArchivedStore(staging string, req RestoreRequest) (*SQLiteStore, []*Sheet, error) {
+	src, err := OpenSQLiteStore(filepath.Join(staging, sqliteStoreFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	if src.corrupt {
+		src.Close()
+		return nil, nil, errors.New("the archived " + sqliteStoreFile + " failed its integrity check")
+	}
+	all, err := src.LoadSheets()
+	if err != nil {
+		src.Close()
+		return nil, nil, err
+	}
+	var sheets []*Sheet
+	for _, s := range all {
+		if restoreCovers(req, s.ProjectName, s.Name) {
+			sheets = append(sheets, s)
+		}
+	}
+	return src, sheets, nil
+}
+
+// restoreCovers reports whether a project or sheet restore covers a sheet.
+func restoreCovers(req RestoreRequest, project, name string) bool {
+	if req.Scope == RestoreScopeSheet {
+		return project == req.Project && name == req.Sheet
+	}
+	return project == req.Project || strings.HasPrefix(project, req.Project+"/")
+}
+
+// restoreSheets replaces the live sheets a project or sheet restore covers
+// with sheets, loaded from src, through globalStore. A project's live sheets
+// that src does not have are deleted and its timelines copied.
+func restoreSheets(src Store, sheets []*Sheet, req RestoreRequest) error {
+	restored := make(map[string]bool, len(sheets))
+	for _, s := range sheets {
+		restored[sheetKey(s.ProjectName, s.Name)] = true
+	}
+	for _, s := range globalSheetManager.ListSheets() {
+		if restored[sheetKey(s.ProjectName, s.Name)] || !restoreCovers(req, s.ProjectName, s.Name) {
+			continue
+		}
+		if err := globalStore.DeleteSheet(s.ProjectName, s.Name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	for _, s := range sheets {
+		// Start empty so no cell, audit record or snapshot of the live sheet is left
+		if err := globalStore.DeleteSheet(s.ProjectName, s.Name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := copySheet(src, globalStore, s); err != nil {
+			return err
+		}
+	}
+	if req.Scope != RestoreScopeProject {
+		return nil
+	}
+	names, err := src.Documents()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, req.Project+"/") {
+			continue
+		}
+		data, err := src.ReadDocument(name)
+		if err == nil {
+			err = globalStore.WriteDocument(name, data)
+		}
+		if err != nil {
+			return fmt.Errorf("restore %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// swapSQLiteStore does the file swap of a full restore with the sqlite store
+// open: sessions and API tokens are carried over into the restored database
+// as restoreKeepFiles does for the json store. Returns the store to use from
+// now on, which is reopened even when the swap failed.
+func swapSQLiteStore(st *SQLiteStore, staging, previous string) (Store, error) {
+	kept := make(map[string][]byte)
+	for name := range privateDocuments {
+		if data, err := st.ReadDocument(name); err == nil {
+			kept[name] = data
+		}
+	}
+	if err := st.Close(); err != nil {
+		return st, err
+	}
+	dbPath := filepath.Join(dataDir, sqliteStoreFile)
+	swapErr := moveEntries(dataDir, previous, restoreKeepFiles)
+	if swapErr == nil {
+		swapErr = moveEntries(staging, dataDir, nil)
+	}
+	if _, err := os.Stat(dbPath); swapErr != nil && os.IsNotExist(err) {
+		os.Rename(filepath.Join(previous, sqliteStoreFile), dbPath)
+	}
+	reopened, err := OpenSQLiteStore(dbPath)
+	if err != nil {
+		// Put the old database back so the server keeps working
+		os.Rename(filepath.Join(previous, sqliteStoreFile), dbPath)
+		if reopened, err = OpenSQLiteStore(dbPath); err != nil {
+			log.Fatalf("restore: cannot reopen %s: %v", dbPath, err)
+		}
+		if swapErr == nil {
+			swapErr = errors.New("the restored " + sqliteStoreFile + " cannot be opened")
+		}
+		return reopened, swapErr
+	}
+	for name, data := range kept {
+		if err := reopened.WriteDocument(name, data); err != nil {
+			log.Printf("restore: keep %s: %v", name, err)
+		}
+	}
+	return reopened, swapErr
+}
+
+// archivedFile returns the content of a verified archive entry, or nil.
+func archivedFile(entries map[string]*zip.File, name string) []byte {
+	f := entries[name]
+	if f == nil {
+		return nil
+	}
+	data, err := readZipFile(f)
+	if err != nil {
+		log.Printf("restore: read %s: %v", name, err)
+		return nil
+	}
+	return data
+}
+
+// restoreProjectMeta copies a top-level project's owner, admins and settings
+// from the archive's verified projects.json, nil when it has none. Returns a
+// note when it could not.
+func restoreProjectMeta(data []byte, project string) []string {
+	if strings.Contains(project, "/") {
+		return nil
+	}
+	if data == nil {
+		return []string{"projects.json: not in archive, project settings unchanged"}
+	}
+	var m map[string]ProjectMeta
+	if err := json.Unmarshal(data, &m); err != nil {
+		return []string{"projects.json: " + err.Error()}
+	}
+	if meta, ok := m[project]; ok {
+		globalProjectMeta.SetMeta(project, meta)
+	}
+	return nil
+}
+
+// reloadAfterRestore re-reads the managers from disk and pushes fresh sheet
+// data to connected clients. A project or sheet restore reloads only the
+// sheets it covers. Returns the number of sheets loaded.
+func reloadAfterRestore(req RestoreRequest) int {
+	covers := func(project, name string) bool { return restoreCovers(req, project, name) }
+	switch req.Scope {
+	case RestoreScopeAll:
+		globalIntegrity.Reset()
+		globalAuditLog.Reset()
+		covers = func(project, name string) bool { return true }
+	case RestoreScopeProject:
+		abs, _ := filepath.Abs(filepath.Join(dataDir, filepath.FromSlash(req.Project)))
+		globalIntegrity.Forget(abs)
+		globalAuditLog.DropProject(req.Project)
+	case RestoreScopeSheet:
+		globalIntegrity.Forget(sheetAbsPath(req.Project, req.Sheet))
+		globalAuditLog.Drop(req.Project, req.Sheet)
+	}
+	globalProjectAuditManager.Load()
+	globalProjectMeta.Load()
+	if req.Scope == RestoreScopeAll {
+		globalSheetManager.Reload()
+	} else {
+		globalSheetManager.ReloadSheets(covers)
+	}
+	globalUserManager.Load()
+	globalGroups.Load()
+	globalChatManager.Load()
+
+	restored := 0
+	for _, s := range globalSheetManager.ListSheets() {
+		if covers(s.ProjectName, s.Name) {
+			globalSheetManager.QueueRowColUpdate(s.ProjectName, s.Name)
+			restored++
+		}
+	}
+	return restored
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// reloadTestSheets stores the sheets P/S1, P/S2 and Q/S3, each with A1 set to
+// "stored", in a scratch data directory and registers them with a new
+// manager. The global write-ahead log is replaced for the test.
+func reloadTestSheets(t *testing.T) (*SheetManager, map[string]*Sheet) {
+	t.Helper()
+	walTestDir(t)
+	prev := globalWAL
+	globalWAL = walTestLog()
+	t.Cleanup(func() {
+		globalWAL.Reset()
+		globalWAL = prev
+	})
+	sm := &SheetManager{sheets: make(map[string]*Sheet), pending: make(map[string]*pendingSave)}
+	sheets := make(map[string]*Sheet)
+	for _, key := range [][2]string{{"P", "S1"}, {"P", "S2"}, {"Q", "S3"}} {
+		s := &Sheet{ProjectName: key[0], Name: key[1], Owner: "alice", Data: map[string]map[string]Cell{"1": {"A": {Value: "stored"}}}}
+		if err := globalStore.SaveSheet(s); err != nil {
+			t.Fatal(err)
+		}
+		sm.sheets[sheetKey(key[0], key[1])] = s
+		sheets[key[1]] = s
+	}
+	return sm, sheets
+}
+
+func TestRestoreGuardRefusesWrites(t *testing.T) {
+	reached := false
+	h := restoreGuardMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	serve := func(method, target string) int {
+		reached = false
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec.Code
+	}
+
+	if code := serve("PATCH", "/api/sheet/cells?project=P&sheet_name=S"); code != http.StatusOK || !reached {
+		t.Fatalf("PATCH /api/sheet/cells with no restore = %d, reached %v", code, reached)
+	}
+
+	editGate.Lock()
+	if code := serve("PATCH", "/api/sheet/cells?project=P&sheet_name=S"); code != http.StatusServiceUnavailable || reached {
+		t.Errorf("PATCH /api/sheet/cells during a restore = %d, reached %v; want 503", code, reached)
+	}
+	if code := serve("POST", "/api/sheet/history/restore"); code != http.StatusServiceUnavailable || reached {
+		t.Errorf("POST /api/sheet/history/restore during a restore = %d, reached %v; want 503", code, reached)
+	}
+	if code := serve("GET", "/api/sheet?project=P&id=S"); code != http.StatusOK || !reached {
+		t.Errorf("GET /api/sheet during a restore = %d, reached %v; want passed on", code, reached)
+	}
+	if code := serve("POST", "/api/logout"); code != http.StatusOK || !reached {
+		t.Errorf("POST /api/logout during a restore = %d, reached %v; want passed on", code, reached)
+	}
+	editGate.Unlock()
+}
+
+func TestBeginEditHoldsOffRestore(t *testing.T) {
+	done, ok := beginEdit(httptest.NewRecorder())
+	if !ok {
+		t.Fatal("beginEdit refused with no restore running")
+	}
+	locked := make(chan struct{})
+	go func() {
+		editGate.Lock()
+		close(locked)
+	}()
+	// A restore waiting for the gate already refuses new writes
+	for editGate.TryRLock() {
+		editGate.RUnlock()
+	}
+	select {
+	case <-locked:
+		t.Fatal("restore took the gate while a write was running")
+	default:
+	}
+	rec := httptest.NewRecorder()
+	if _, ok := beginEdit(rec); ok || rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("beginEdit with a restore waiting = %v, %d; want 503", ok, rec.Code)
+	}
+	done()
+	<-locked
+	editGate.Unlock()
+}
+
+func TestReloadSheetsKeepsOtherSheets(t *testing.T) {
+	sm, sheets := reloadTestSheets(t)
+	// Unflushed edits on the restored sheet and on one the restore leaves
+	for _, name := range []string{"S1", "S2"} {
+		s := sheets[name]
+		s.Data["1"]["B"] = Cell{Value: "unflushed"}
+		globalWAL.LogCells(sm, s, []cellRef{{"1", "B"}})
+	}
+	// Records held back for a sheet that failed its integrity check
+	sheets["S3"].ReadOnly = true
+	held := []walRecord{{Seq: 1, Project: "Q", Sheet: "S3"}}
+	globalWAL.held[sheetKey("Q", "S3")] = held
+
+	sm.ReloadSheets(func(project, name string) bool { return project == "P" && name == "S1" })
+
+	restored := sm.sheets[sheetKey("P", "S1")]
+	if restored == sheets["S1"] {
+		t.Fatal("restored sheet was not reloaded")
+	}
+	if _, ok := restored.Data["1"]["B"]; ok {
+		t.Error("restored sheet kept an edit of the sheet it replaced")
+	}
+	if _, ok := sm.pending[sheetKey("P", "S1")]; ok {
+		t.Error("restored sheet still has the pending save of the sheet it replaced")
+	}
+	if sm.sheets[sheetKey("P", "S2")] != sheets["S2"] || sheets["S2"].Data["1"]["B"].Value != "unflushed" {
+		t.Error("a sheet outside the restore was replaced")
+	}
+	if _, ok := sm.pending[sheetKey("P", "S2")]; !ok {
+		t.Error("pending save of a sheet outside the restore was dropped")
+	}
+	if got := globalWAL.HeldRecords("Q", "S3"); len(got) != len(held) {
+		t.Errorf("held records of a sheet outside the restore = %v, want %v", got, held)
+	}
+
+	// After a restart the log replays onto S2 only
+	globalWAL.file.Close()
+	globalWAL.file = nil
+	stored, err := globalStore.LoadSheets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := &SheetManager{sheets: make(map[string]*Sheet), pending: make(map[string]*pendingSave)}
+	for _, s := range stored {
+		after.sheets[sheetKey(s.ProjectName, s.Name)] = s
+	}
+	w := walTestLog()
+	w.Recover(after)
+	if _, ok := after.sheets[sheetKey("P", "S1")].Data["1"]["B"]; ok {
+		t.Error("a logged edit of the replaced sheet was replayed onto the restored one")
+	}
+	if got := after.sheets[sheetKey("P", "S2")].Data["1"]["B"].Value; got != "unflushed" {
+		t.Errorf("S2 B1 after restart = %q, want the logged edit", got)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// ────────────────────────────────────────────────
+// Batch cell edits over HTTP
+// ────────────────────────────────────────────────
+//
+// PATCH /api/sheet/cells applies a list of edits through the same Sheet
+// methods as the websocket UPDATE_CELL, UPDATE_CELL_SCRIPT and
+// UPDATE_CELL_STYLE messages, so audit entries, dependency recalculation and
+// the ROW_COL_UPDATED broadcast behave exactly as for a live edit. A batch is
+// recorded on the user's undo stack as one group.
+
+// maxCellEdits caps the size of one batch.
+const maxCellEdits = 1000
+
+// CellEdit is one entry of a batch. Cell is a label ("B4") or a cell name.
+// Exactly one of Value and Script may be set; Style may accompany either or
+// stand alone. Style fields left out keep their current value.
+type CellEdit struct {
+	Cell               string         `json:"cell"`
+	Value              *string        `json:"value,omitempty"`
+	Script             *string        `json:"script,omitempty"`
+	RowSpan            int            `json:"row_span,omitempty"`
+	ColSpan            int            `json:"col_span,omitempty"`
+	ShowScriptAsOutput bool           `json:"show_script_as_output,omitempty"`
+	Style              *CellEditStyle `json:"style,omitempty"`
+}
+
+type CellEditStyle struct {
+	Background *string `json:"background,omitempty"`
+	Bold       *bool   `json:"bold,omitempty"`
+	Italic     *bool   `json:"italic,omitempty"`
+}
+
+// CellEditResult reports what happened to one edit: "applied" or "skipped"
+// with the reason ("locked", "protected", "owner-only").
+type CellEditResult struct {
+	Cell   string `json:"cell"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+var cellLabelPattern = regexp.MustCompile(`^[A-Z]+[1-9][0-9]*$`)
+
+// resolveEditCell returns the row and column an edit targets.
+func (s *Sheet) resolveEditCell(cell string) (row, col string, err error) {
+	if cellLabelPattern.MatchString(cell) {
+		col, row = parseCellLabel(cell)
+		return row, col, nil
+	}
+	if row, col, found := s.FindCellByName(cell); found {
+		return row, col, nil
+	}
+	return "", "", fmt.Errorf("unknown cell %q", cell)
+}
+
+// validateCellEdits checks a batch before anything is written, so a
+// malformed request changes nothing.
+func (s *Sheet) validateCellEdits(edits []CellEdit) error {
+	if len(edits) == 0 {
+		return errors.New("edits required")
+	}
+	if len(edits) > maxCellEdits {
+		return fmt.Errorf("at most %d edits per request", maxCellEdits)
+	}
+	for i, e := range edits {
+		if _, _, err := s.resolveEditCell(e.Cell); err != nil {
+			return fmt.Errorf("edit %d: %v", i, err)
+		}
+		if e.Value != nil && e.Script != nil {
+			return fmt.Errorf("edit %d: value and script are exclusive", i)
+		}
+		if e.Value == nil && e.Script == nil && e.Style == nil {
+			return fmt.Errorf("edit %d: one of value, script or style required", i)
+		}
+	}
+	return nil
+}
+
+// ApplyCellEdits validates and applies a batch of edits as user, returning
+// one result per edit. Edits to locked cells and protected ranges, and script
+// edits by anyone but the sheet owner, are skipped rather than failing the batch.
+func (s *Sheet) ApplyCellEdits(edits []CellEdit, user string) ([]CellEditResult, error) {
+	if err := s.validateCellEdits(edits); err != nil {
+		return nil, err
+	}
+	// Each cell and kind of edit is recorded once, from its state before the
+	// batch to its state after it
+	group := "batch-" + newVersionID()
+	var recs []*undoRecording
+	recorded := make(map[string]bool)
+	record := func(typ, row, col string) {
+		if key := typ + " " + col + row; !recorded[key] {
+			recorded[key] = true
+			recs = append(recs, globalUndo.BeginCell(s, user, typ, group, row, col))
+		}
+	}
+	results := make([]CellEditResult, 0, len(edits))
+	for _, e := range edits {
+		row, col, _ := s.resolveEditCell(e.Cell)
+		result := CellEditResult{Cell: col + row, Status: "applied"}
+
+		s.mu.RLock()
+		current := s.Data[row][col]
+		owner := s.Owner
+		protected := s.protectedCellLocked(row, col, user)
+		s.mu.RUnlock()
+
+		switch {
+		case current.Locked:
+			result.Status, result.Reason = "skipped", "locked"
+		case protected != nil:
+			result.Status, result.Reason = "skipped", "protected"
+		case e.Script != nil && user != owner:
+			result.Status, result.Reason = "skipped", "owner-only"
+		default:
+			if e.Value != nil {
+				record("UPDATE_CELL", row, col)
+				s.SetCell(row, col, *e.Value, user, false)
+			}
+			if e.Script != nil {
+				record("UPDATE_CELL_SCRIPT", row, col)
+				s.SetCellScript(row, col, *e.Script, user, false, e.RowSpan, e.ColSpan, e.ShowScriptAsOutput)
+			}
+			if e.Style != nil {
+				record("UPDATE_CELL_STYLE", row, col)
+				background, bold, italic := current.Background, current.Bold, current.Italic
+				if e.Style.Background != nil {
+					background = *e.Style.Background
+				}
+				if e.Style.Bold != nil {
+					bold = *e.Style.Bold
+				}
+				if e.Style.Italic != nil {
+					italic = *e.Style.Italic
+				}
+				s.SetCellStyle(row, col, background, bold, italic, user)
+			}
+		}
+		results = append(results, result)
+	}
+	for _, rec := range recs {
+		globalUndo.Commit(rec)
+	}
+	globalSheetManager.QueueRowColUpdate(s.ProjectName, s.Name)
+	return results, nil
+}
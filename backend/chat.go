@@ -2,9 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"os"
-	"path/filepath"
 	"sync"
 	"time"
 )
@@ -13,7 +13,7 @@ type ChatMessage struct {
 	Timestamp   time.Time       `json:"timestamp"`
 	User        string          `json:"user"`
 	Text        string          `json:"text"`
-	To          string          `json:"to,omitempty"` // "all" or specific username
+	To          string          `json:"to,omitempty"` // "all", a username or "@group"
 	SheetName   string          `json:"sheet_name,omitempty"`
 	ProjectName string          `json:"project_name,omitempty"`
 	SheetType   string          `json:"sheet_type,omitempty"` // "datasheet" or "document"
@@ -27,30 +27,22 @@ type ChatManager struct {
 
 var globalChatManager = &ChatManager{}
 
-func chatFilePath() string {
-	return filepath.Join(dataDir, "chat.json")
-}
+const chatDocument = "chat.json"
 
 func (cm *ChatManager) Load() {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
-	if err := ensureDataDir(); err != nil {
-		log.Printf("chat: ensure data dir: %v", err)
-		return
-	}
-	f, err := os.Open(chatFilePath())
+	data, err := globalStore.ReadDocument(chatDocument)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, os.ErrNotExist) {
 			cm.messages = []ChatMessage{}
 			return
 		}
-		log.Printf("chat: open file: %v", err)
+		log.Printf("chat: read: %v", err)
 		return
 	}
-	defer f.Close()
-	dec := json.NewDecoder(f)
 	var msgs []ChatMessage
-	if err := dec.Decode(&msgs); err != nil {
+	if err := json.Unmarshal(data, &msgs); err != nil {
 		log.Printf("chat: decode: %v", err)
 		cm.messages = []ChatMessage{}
 		return
@@ -61,20 +53,13 @@ func (cm *ChatManager) Load() {
 func (cm *ChatManager) Save() {
 	cm.mu.RLock()
 	defer cm.mu.RUnlock()
-	if err := ensureDataDir(); err != nil {
-		log.Printf("chat: ensure data dir: %v", err)
-		return
-	}
-	f, err := os.Create(chatFilePath())
+	data, err := json.MarshalIndent(cm.messages, "", "  ")
 	if err != nil {
-		log.Printf("chat: create file: %v", err)
+		log.Printf("chat: encode: %v", err)
 		return
 	}
-	defer f.Close()
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
-	if err := enc.Encode(cm.messages); err != nil {
-		log.Printf("chat: encode: %v", err)
+	if err := globalStore.WriteDocument(chatDocument, append(data, '\n')); err != nil {
+		log.Printf("chat: save: %v", err)
 	}
 }
 
@@ -112,14 +97,14 @@ func (cm *ChatManager) History() []ChatMessage {
 // HistoryFor returns messages visible to a specific user:
 // - broadcast messages (to=="all" or empty)
 // - messages sent by the user
-// - messages sent to the user
+// - messages sent to the user or to a group the user is in
 func (cm *ChatManager) HistoryFor(user string) []ChatMessage {
 	cm.mu.RLock()
 	defer cm.mu.RUnlock()
 	out := make([]ChatMessage, 0, len(cm.messages))
 	for _, m := range cm.messages {
 		to := m.To
-		if to == "" || to == "all" || m.User == user || to == user {
+		if to == "" || to == "all" || m.User == user || matchesUser(to, user) {
 			out = append(out, m)
 		}
 	}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -21,11 +22,17 @@ const (
 
 	// Maximum message size allowed from peer.
 	maxMessageSize = 51200
+
+	// Close codes telling the browser why the server closed the connection.
+	closeUnauthorized = 4401
+	closeNoAccess     = 4403
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	// Negotiate permessage-deflate; large sheets compress well
+	EnableCompression: true,
 	// ALLOW ALL ORIGINS FOR DEMO
 	CheckOrigin: func(r *http.Request) bool {
 		return true
@@ -50,6 +57,18 @@ type Client struct {
 
 	// Project Name
 	projectName string
+
+	// Login session the connection was opened with
+	sessionID string
+
+	// Revision the client had before reconnecting, to catch up from
+	since int64
+
+	// Rows of the sheet sent on joining; 0 sends all of them
+	pageRows int
+
+	// Close code the hub sets before closing send, or 0
+	closeCode int
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -84,6 +103,7 @@ func (c *Client) readPump() {
 		msg.User = c.userID
 		msg.SheetName = c.sheetName // Ensure the message is routed to the client's current room
 		msg.Project = c.projectName
+		msg.from = c
 
 		c.hub.broadcast <- &msg
 	}
@@ -105,7 +125,13 @@ func (c *Client) writePump() {
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				if c.closeCode == closeUnauthorized {
+					c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, "session ended"))
+				} else if c.closeCode != 0 {
+					c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, "no access"))
+				} else {
+					c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				}
 				return
 			}
 
@@ -140,11 +166,24 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		log.Println(err)
 		return
 	}
+	// closeWs refuses the connection with a close code the browser can read,
+	// which it could not do for an HTTP error before the upgrade
+	closeWs := func(code int, reason string) {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+		conn.Close()
+	}
 
-	// Basic extraction of user and sheet_name
-	user := r.URL.Query().Get("user")
-	if user == "" {
-		user = "Anonymous"
+	// Browsers cannot set headers on WebSocket requests, so the session
+	// token comes as a query parameter. Personal access tokens are refused:
+	// their scopes are only enforced on HTTP requests.
+	if isAPIToken(bearerToken(r.URL.Query().Get("token"))) {
+		closeWs(closeUnauthorized, "personal access tokens cannot open a websocket")
+		return
+	}
+	user, err := globalUserManager.ValidateToken(r.URL.Query().Get("token"))
+	if err != nil {
+		closeWs(closeUnauthorized, err.Error())
+		return
 	}
 
 	sheetName := r.URL.Query().Get("id")
@@ -161,9 +200,15 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	// Validate existence
 	if s := globalSheetManager.GetSheetBy(sheetName, project); s == nil {
 		log.Printf("WS connect: sheet not found id=%s project=%s", sheetName, project)
+	} else if !s.CanRead(user) {
+		closeWs(closeNoAccess, "no access")
+		return
 	}
 
 	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), userID: user, sheetName: sheetName, projectName: project}
+	client.sessionID = globalUserManager.SessionID(r.URL.Query().Get("token"))
+	client.since, _ = strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	client.pageRows, _ = strconv.Atoi(r.URL.Query().Get("page_rows"))
 	client.hub.register <- client
 
 	// Allow collection of memory referenced by the caller by doing all work in
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// ────────────────────────────────────────────────
+// Cell comments
+// ────────────────────────────────────────────────
+//
+// A comment thread is a discussion attached to one cell. It is anchored by
+// the cell's CellID rather than its label, so it stays with the cell when
+// rows and columns are inserted, deleted or moved; Cell holds the label the
+// cell has now and is filled in whenever threads are read. Threads are kept
+// with the sheet. Commenters and above may comment and resolve threads;
+// authors, the sheet owner and project admins may delete comments.
+
+const maxCommentLength = 10000
+
+// CellComment is one message in a comment thread.
+type CellComment struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	Text      string    `json:"text"`
+	Mentions  []string  `json:"mentions,omitempty"` // users and "@groups" mentioned in Text
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// CommentThread is the discussion on one cell.
+type CommentThread struct {
+	ID         string        `json:"id"`
+	CellID     string        `json:"cell_id"`
+	Cell       string        `json:"cell,omitempty"` // current label; empty once the cell is deleted
+	Resolved   bool          `json:"resolved,omitempty"`
+	ResolvedBy string        `json:"resolved_by,omitempty"`
+	ResolvedAt *time.Time    `json:"resolved_at,omitempty"`
+	CreatedBy  string        `json:"created_by"`
+	CreatedAt  time.Time     `json:"created_at"`
+	Comments   []CellComment `json:"comments"`
+}
+
+var mentionPattern = regexp.MustCompile(`(^|[^\w@])@([\w.\-]+)`)
+
+// parseMentions returns the users and groups "@name" mentions in text name,
+// a user before a group of the same name.
+func parseMentions(text string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, m := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		name := strings.TrimRight(m[2], ".-")
+		switch {
+		case globalUserManager.Exists(name):
+		case globalGroups.Exists(name):
+			name = groupPrefix + name
+		default:
+			continue
+		}
+		if !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+func (t *CommentThread) clone() CommentThread {
+	c := *t
+	c.Comments = make([]CellComment, len(t.Comments))
+	for i, m := range t.Comments {
+		m.Mentions = append([]string(nil), m.Mentions...)
+		c.Comments[i] = m
+	}
+	return c
+}
+
+// cellLabelsByIDLocked maps the CellID of every cell that has one to its
+// label. Caller holds s.mu.
+func (s *Sheet) cellLabelsByIDLocked() map[string]string {
+	labels := make(map[string]string)
+	for r, cols := range s.Data {
+		for c, cell := range cols {
+			if cell.CellID != "" {
+				labels[cell.CellID] = c + r
+			}
+		}
+	}
+	return labels
+}
+
+// CommentThreads returns copies of the sheet's comment threads with their
+// current cell labels, oldest first.
+func (s *Sheet) CommentThreads() []CommentThread {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	labels := s.cellLabelsByIDLocked()
+	out := make([]CommentThread, 0, len(s.Comments))
+	for i := range s.Comments {
+		t := s.Comments[i].clone()
+		t.Cell = labels[t.CellID]
+		out = append(out, t)
+	}
+	return out
+}
+
+func (s *Sheet) threadIndexLocked(id string) int {
+	for i := range s.Comments {
+		if s.Comments[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// threadViewLocked returns a copy of thread i with its cell label and that
+// label's row and column. Caller holds s.mu.
+func (s *Sheet) threadViewLocked(i int) (CommentThread, int, string) {
+	t := s.Comments[i].clone()
+	t.Cell = s.cellLabelsByIDLocked()[t.CellID]
+	col, row := parseCellLabel(t.Cell)
+	return t, atoiSafe(row), col
+}
+
+// AddComment adds a comment by user to thread threadID, or starts a thread
+// on the cell at row and col when threadID is empty. Replying to a resolved
+// thread reopens it.
+func (s *Sheet) AddComment(row, col, threadID, text, user string) (CommentThread, error) {
+	text = strings.TrimSpace(text)
+	switch {
+	case text == "":
+		return CommentThread{}, errors.New("comment text is required")
+	case len(text) > maxCommentLength:
+		return CommentThread{}, errors.New("comment is too long")
+	}
+	now := time.Now()
+	comment := CellComment{ID: newVersionID(), User: user, Text: text, Mentions: parseMentions(text), Timestamp: now}
+
+	s.mu.Lock()
+	if s.ReadOnly {
+		s.mu.Unlock()
+		return CommentThread{}, errors.New("sheet is read-only (integrity check failed)")
+	}
+	var i int
+	var cells []cellRef // the anchor cell, when it gets a CellID
+	if threadID == "" {
+		if atoiSafe(row) <= 0 || colLabelToIndex(col) <= 0 {
+			s.mu.Unlock()
+			return CommentThread{}, errors.New("row and col are required")
+		}
+		// Anchor the thread to the cell's CellID, giving it one if needed
+		if s.Data[row] == nil {
+			s.Data[row] = make(map[string]Cell)
+		}
+		cell := s.Data[row][col]
+		if cell.CellID == "" {
+			cell.CellID = freshCellIDLocked(s, generateID(), row, col)
+			s.Data[row][col] = cell
+			cells = append(cells, cellRef{row, col})
+		}
+		s.Comments = append(s.Comments, CommentThread{ID: newVersionID(), CellID: cell.CellID, CreatedBy: user, CreatedAt: now})
+		i = len(s.Comments) - 1
+	} else if i = s.threadIndexLocked(threadID); i < 0 {
+		s.mu.Unlock()
+		return CommentThread{}, errors.New("comment thread not found")
+	}
+	t := &s.Comments[i]
+	t.Comments = append(t.Comments, comment)
+	if t.Resolved {
+		t.Resolved, t.ResolvedBy, t.ResolvedAt = false, "", nil
+	}
+	view, r, c := s.threadViewLocked(i)
+	s.logAudit(AuditEntry{Timestamp: now, User: user, Action: "COMMENT", Row1: r, Col1: c, NewValue: text})
+	s.mu.Unlock()
+	globalSheetManager.SaveCells(s, cells...)
+	return view, nil
+}
+
+// SetThreadResolved resolves or reopens thread id as user.
+func (s *Sheet) SetThreadResolved(id string, resolved bool, user string) (CommentThread, error) {
+	s.mu.Lock()
+	i := s.threadIndexLocked(id)
+	if i < 0 {
+		s.mu.Unlock()
+		return CommentThread{}, errors.New("comment thread not found")
+	}
+	t := &s.Comments[i]
+	if t.Resolved == resolved {
+		view, _, _ := s.threadViewLocked(i)
+		s.mu.Unlock()
+		return view, nil
+	}
+	now := time.Now()
+	action := "REOPEN_COMMENT"
+	t.Resolved, t.ResolvedBy, t.ResolvedAt = false, "", nil
+	if resolved {
+		action = "RESOLVE_COMMENT"
+		t.Resolved, t.ResolvedBy, t.ResolvedAt = true, user, &now
+	}
+	view, r, c := s.threadViewLocked(i)
+	s.logAudit(AuditEntry{Timestamp: now, User: user, Action: action, Row1: r, Col1: c})
+	s.mu.Unlock()
+	globalSheetManager.SaveCells(s)
+	return view, nil
+}
+
+// DeleteComment removes comment commentID from thread threadID as user, who
+// must have written it or manage the sheet. Removing the last comment
+// removes the thread, reported by removed.
+func (s *Sheet) DeleteComment(threadID, commentID, user string) (thread CommentThread, removed bool, err error) {
+	manager := s.CanManage(user)
+	s.mu.Lock()
+	i := s.threadIndexLocked(threadID)
+	if i < 0 {
+		s.mu.Unlock()
+		return CommentThread{}, false, errors.New("comment thread not found")
+	}
+	t := &s.Comments[i]
+	j := -1
+	for k := range t.Comments {
+		if t.Comments[k].ID == commentID {
+			j = k
+		}
+	}
+	if j < 0 {
+		s.mu.Unlock()
+		return CommentThread{}, false, errors.New("comment not found")
+	}
+	if t.Comments[j].User != user && !manager {
+		s.mu.Unlock()
+		return CommentThread{}, false, errors.New("only its author, the sheet owner or a project admin can delete a comment")
+	}
+	old := t.Comments[j].Text
+	t.Comments = append(t.Comments[:j], t.Comments[j+1:]...)
+	thread, r, c := s.threadViewLocked(i)
+	if len(t.Comments) == 0 {
+		s.Comments = append(s.Comments[:i], s.Comments[i+1:]...)
+		removed = true
+	}
+	s.logAudit(AuditEntry{Timestamp: time.Now(), User: user, Action: "DELETE_COMMENT", Row1: r, Col1: c, OldValue: old})
+	s.mu.Unlock()
+	globalSheetManager.SaveCells(s)
+	return thread, removed, nil
+}
+
+// addXLSXCommentsLocked writes the comment threads of s as notes on the
+// cells of xlsxSheet, where cols lists the columns in the order they were
+// exported. Caller holds s.mu.
+func (s *Sheet) addXLSXCommentsLocked(f *excelize.File, xlsxSheet string, cols []string) {
+	if len(s.Comments) == 0 {
+		return
+	}
+	colIndex := make(map[string]int, len(cols))
+	for i, c := range cols {
+		colIndex[c] = i + 1
+	}
+	labels := s.cellLabelsByIDLocked()
+	// Excel shows one note per cell: threads on the same cell share it
+	notes := make(map[string][]string)
+	authors := make(map[string]string)
+	var order []string
+	for _, t := range s.Comments {
+		col, row := parseCellLabel(labels[t.CellID])
+		if colIndex[col] == 0 || atoiSafe(row) <= 0 {
+			continue
+		}
+		ref, err := excelize.CoordinatesToCellName(colIndex[col], atoiSafe(row))
+		if err != nil {
+			continue
+		}
+		if _, ok := notes[ref]; !ok {
+			order = append(order, ref)
+			authors[ref] = t.CreatedBy
+		}
+		for _, m := range t.Comments {
+			notes[ref] = append(notes[ref], m.User+": "+m.Text)
+		}
+		if t.Resolved {
+			notes[ref] = append(notes[ref], "(resolved by "+t.ResolvedBy+")")
+		}
+	}
+	for _, ref := range order {
+		_ = f.AddComment(xlsxSheet, excelize.Comment{Cell: ref, Author: authors[ref], Text: strings.Join(notes[ref], "\n")})
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ────────────────────────────────────────────────
+// Dependency inspection
+// ────────────────────────────────────────────────
+//
+// Read-only views over the recalculation graph: the transitive precedents
+// and dependents of one cell, and the graph of a whole project as JSON or
+// Graphviz DOT.
+
+// DependencyRef is one entry of a precedent/dependent trace. Kind is set
+// when the reference is a computed cell; Depth is the number of hops from
+// the traced cell.
+type DependencyRef struct {
+	Project string `json:"project"`
+	Sheet   string `json:"sheet"`
+	Range   string `json:"range"`
+	Kind    string `json:"kind,omitempty"`
+	Depth   int    `json:"depth"`
+}
+
+// CellDependencies is the trace returned for a single cell.
+type CellDependencies struct {
+	Project    string          `json:"project"`
+	Sheet      string          `json:"sheet"`
+	Cell       string          `json:"cell"`
+	Kind       string          `json:"kind,omitempty"`
+	Precedents []DependencyRef `json:"precedents"`
+	Dependents []DependencyRef `json:"dependents"`
+	Cycles     [][]string      `json:"cycles"`
+}
+
+// precedentRefs returns the cells and ranges a computed cell reads.
+func (sm *SheetManager) precedentRefs(n *recalcNode) []DependencyInfo {
+	s := sm.GetSheetBy(n.Cell.sheetName, n.Cell.ProjectName)
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	cell := s.Data[n.Cell.row][n.Cell.col]
+	s.mu.RUnlock()
+	if n.Kind == recalcOptions {
+		return parseOptionsRangeDependency(cell.OptionsRange, n.Cell.ProjectName, n.Cell.sheetName)
+	}
+	return ExtractScriptDependencies(cellDepText(cell), n.Cell.ProjectName, n.Cell.sheetName)
+}
+
+// nodesWritingRange returns the computed cells whose output lands inside the
+// referenced range, including script spans that start outside it.
+func (sm *SheetManager) nodesWritingRange(ref DependencyInfo) []*recalcNode {
+	s := sm.GetSheetBy(ref.Sheet, ref.Project)
+	if s == nil {
+		return nil
+	}
+	var result []*recalcNode
+	for _, n := range computedNodes(s) {
+		for _, out := range sm.outputCells(n) {
+			if rangeContainsCell(ref.Range, out.row, out.col) {
+				result = append(result, n)
+				break
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].key() < result[j].key() })
+	return result
+}
+
+// CellDependencies traces everything the cell reads (precedents) and
+// everything recalculated when it changes (dependents), across sheets and
+// projects.
+func (sm *SheetManager) CellDependencies(projectName, sheetName, row, col string) CellDependencies {
+	cell := CellIdentifier{projectName, sheetName, row, col}
+	result := CellDependencies{
+		Project:    projectName,
+		Sheet:      sheetName,
+		Cell:       col + row,
+		Precedents: []DependencyRef{},
+		Dependents: []DependencyRef{},
+		Cycles:     [][]string{},
+	}
+
+	// Precedents: start at the computed cells writing this cell (the cell
+	// itself, or the script whose span covers it) and walk their references.
+	type queued struct {
+		node  *recalcNode
+		depth int
+	}
+	var queue []queued
+	seenNodes := make(map[string]bool)
+	seenRefs := make(map[string]bool)
+	for _, n := range sm.nodesWritingRange(DependencyInfo{projectName, sheetName, col + row}) {
+		seenNodes[n.key()] = true
+		if n.key() == cellKey(cell) {
+			result.Kind = n.Kind
+			queue = append(queue, queued{n, 0})
+			continue
+		}
+		result.Precedents = append(result.Precedents, DependencyRef{n.Cell.ProjectName, n.Cell.sheetName, n.Cell.col + n.Cell.row, n.Kind, 1})
+		queue = append(queue, queued{n, 1})
+	}
+	for len(queue) > 0 {
+		q := queue[0]
+		queue = queue[1:]
+		for _, ref := range sm.precedentRefs(q.node) {
+			refKey := ref.Project + "/" + ref.Sheet + "/" + ref.Range
+			if seenRefs[refKey] {
+				continue
+			}
+			seenRefs[refKey] = true
+			if refKey == cellKey(q.node.Cell) {
+				// Self reference of a script reading its own cell
+				continue
+			}
+			result.Precedents = append(result.Precedents, DependencyRef{ref.Project, ref.Sheet, ref.Range, "", q.depth + 1})
+			for _, n := range sm.nodesWritingRange(ref) {
+				if seenNodes[n.key()] {
+					continue
+				}
+				seenNodes[n.key()] = true
+				result.Precedents = append(result.Precedents, DependencyRef{n.Cell.ProjectName, n.Cell.sheetName, n.Cell.col + n.Cell.row, n.Kind, q.depth + 1})
+				queue = append(queue, queued{n, q.depth + 1})
+			}
+		}
+	}
+
+	// Dependents: breadth-first over the recalculation graph of this cell.
+	g := sm.buildRecalcGraph([]CellIdentifier{cell})
+	depth := make(map[string]int)
+	var frontier []string
+	for _, n := range sm.dependentNodes(cell) {
+		if _, ok := depth[n.key()]; !ok {
+			depth[n.key()] = 1
+			frontier = append(frontier, n.key())
+		}
+	}
+	for len(frontier) > 0 {
+		k := frontier[0]
+		frontier = frontier[1:]
+		for _, to := range g.deps[k] {
+			if _, ok := depth[to]; !ok {
+				depth[to] = depth[k] + 1
+				frontier = append(frontier, to)
+			}
+		}
+	}
+	for _, k := range g.sortedKeys() {
+		n := g.nodes[k]
+		result.Dependents = append(result.Dependents, DependencyRef{n.Cell.ProjectName, n.Cell.sheetName, n.Cell.col + n.Cell.row, n.Kind, depth[k]})
+	}
+	sort.SliceStable(result.Dependents, func(i, j int) bool { return result.Dependents[i].Depth < result.Dependents[j].Depth })
+	result.Cycles = append(result.Cycles, g.cycles()...)
+	return result
+}
+
+// splitRefKey splits a "project/sheet/range" key, as used for graph node IDs,
+// references and cycles, into its project and sheet. Projects may contain
+// slashes; sheets and ranges do not.
+func splitRefKey(key string) (project, sheet string) {
+	i := strings.LastIndex(key, "/")
+	if i < 0 {
+		return "", ""
+	}
+	j := strings.LastIndex(key[:i], "/")
+	if j < 0 {
+		return "", key[:i]
+	}
+	return key[:j], key[j+1 : i]
+}
+
+// filterCycles keeps the members of each loop that canRead allows, dropping
+// loops with no member left.
+func filterCycles(cycles [][]string, canRead func(project, sheet string) bool) [][]string {
+	out := [][]string{}
+	for _, loop := range cycles {
+		var kept []string
+		for _, k := range loop {
+			if canRead(splitRefKey(k)) {
+				kept = append(kept, k)
+			}
+		}
+		if len(kept) > 0 {
+			out = append(out, kept)
+		}
+	}
+	return out
+}
+
+// VisibleTo returns the trace without the cells and ranges on sheets user
+// may not read.
+func (cd CellDependencies) VisibleTo(user string) CellDependencies {
+	canRead := sheetReader(user)
+	keep := func(refs []DependencyRef) []DependencyRef {
+		out := []DependencyRef{}
+		for _, ref := range refs {
+			if canRead(ref.Project, ref.Sheet) {
+				out = append(out, ref)
+			}
+		}
+		return out
+	}
+	cd.Precedents = keep(cd.Precedents)
+	cd.Dependents = keep(cd.Dependents)
+	cd.Cycles = filterCycles(cd.Cycles, canRead)
+	return cd
+}
+
+// VisibleTo returns the graph without the nodes, edges and references on
+// sheets user may not read.
+func (dg DependencyGraph) VisibleTo(user string) DependencyGraph {
+	canRead := sheetReader(user)
+	out := DependencyGraph{Nodes: []DependencyGraphNode{}, Edges: []DependencyGraphEdge{}}
+	kept := make(map[string]bool)
+	for _, n := range dg.Nodes {
+		if !canRead(n.Project, n.Sheet) {
+			continue
+		}
+		kept[n.ID] = true
+		var refs []string
+		for _, ref := range n.References {
+			if canRead(splitRefKey(ref)) {
+				refs = append(refs, ref)
+			}
+		}
+		n.References = refs
+		out.Nodes = append(out.Nodes, n)
+	}
+	for _, e := range dg.Edges {
+		if kept[e.From] && kept[e.To] {
+			out.Edges = append(out.Edges, e)
+		}
+	}
+	out.Cycles = filterCycles(dg.Cycles, canRead)
+	return out
+}
+
+// inProject reports whether a sheet's project is project or one of its subfolders.
+func inProject(sheetProject, project string) bool {
+	return sheetProject == project || strings.HasPrefix(sheetProject, project+"/")
+}
+
+// ProjectDependencyGraph returns the graph of every computed cell in the
+// project (including subfolders), the cells in other projects they read
+// from, and everything downstream of them.
+func (sm *SheetManager) ProjectDependencyGraph(project string) DependencyGraph {
+	var roots []*recalcNode
+	for _, s := range sm.ListSheets() {
+		s.mu.RLock()
+		sheetProject := s.ProjectName
+		s.mu.RUnlock()
+		if inProject(sheetProject, project) {
+			roots = append(roots, computedNodes(s)...)
+		}
+	}
+
+	g := newRecalcGraph()
+	var pending []*recalcNode
+	for _, n := range roots {
+		if g.addNode(n) {
+			pending = append(pending, n)
+		}
+	}
+	// Pull in the computed cells the project reads from, so edges coming
+	// from other projects show up as well.
+	for _, n := range roots {
+		for _, ref := range sm.precedentRefs(n) {
+			for _, p := range sm.nodesWritingRange(ref) {
+				if g.addNode(p) {
+					pending = append(pending, p)
+				}
+			}
+		}
+	}
+	sm.expandRecalcGraph(g, pending)
+	return sm.exportRecalcGraph(g)
+}
+
+// dotQuote quotes s as a Graphviz ID.
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// DOT renders the graph in Graphviz format. Computed cells are ellipses
+// grouped by sheet, plain referenced ranges are boxes and cells on a
+// reference cycle are drawn in red.
+func (dg DependencyGraph) DOT(name string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %s {\n", dotQuote(name))
+	b.WriteString("  rankdir=LR;\n")
+
+	inCycle := make(map[string]bool)
+	for _, loop := range dg.Cycles {
+		for _, k := range loop {
+			inCycle[k] = true
+		}
+	}
+
+	bySheet := make(map[string][]DependencyGraphNode)
+	var sheetKeys []string
+	isNode := make(map[string]bool)
+	for _, n := range dg.Nodes {
+		sk := n.Project + "/" + n.Sheet
+		if _, ok := bySheet[sk]; !ok {
+			sheetKeys = append(sheetKeys, sk)
+		}
+		bySheet[sk] = append(bySheet[sk], n)
+		isNode[n.ID] = true
+	}
+	sort.Strings(sheetKeys)
+	for i, sk := range sheetKeys {
+		fmt.Fprintf(&b, "  subgraph %s {\n", dotQuote(fmt.Sprintf("cluster_%d", i)))
+		fmt.Fprintf(&b, "    label=%s;\n", dotQuote(sk))
+		for _, n := range bySheet[sk] {
+			attrs := fmt.Sprintf("label=%s", dotQuote(n.Cell+" ("+n.Kind+")"))
+			if inCycle[n.ID] {
+				attrs += ", color=red, fontcolor=red"
+			}
+			fmt.Fprintf(&b, "    %s [%s];\n", dotQuote(n.ID), attrs)
+		}
+		b.WriteString("  }\n")
+	}
+
+	// Ranges that are not themselves computed cells are drawn once each.
+	drawnRefs := make(map[string]bool)
+	for _, n := range dg.Nodes {
+		for _, ref := range n.References {
+			if isNode[ref] || ref == n.ID {
+				continue
+			}
+			if !drawnRefs[ref] {
+				drawnRefs[ref] = true
+				fmt.Fprintf(&b, "  %s [shape=box];\n", dotQuote(ref))
+			}
+			fmt.Fprintf(&b, "  %s -> %s [style=dashed];\n", dotQuote(ref), dotQuote(n.ID))
+		}
+	}
+	for _, e := range dg.Edges {
+		attrs := ""
+		if inCycle[e.From] && inCycle[e.To] {
+			attrs = " [color=red]"
+		}
+		fmt.Fprintf(&b, "  %s -> %s%s;\n", dotQuote(e.From), dotQuote(e.To), attrs)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
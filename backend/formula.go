@@ -0,0 +1,1842 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ────────────────────────────────────────────────
+// Native formulas
+// ────────────────────────────────────────────────
+//
+// A value typed into a cell that starts with "=" turns the cell into a
+// FormulaCell. The formula text is kept in Cell.Script (references are
+// normalised to {{A1}} / {{A1:B3}} tags when the formula is entered), so
+// dependency tracking, cross-sheet references, cell names and the
+// row/column adjust logic all work exactly as they do for Python scripts.
+// The formula is evaluated in-process; no interpreter is spawned.
+
+// Formula error values, shown in the cell the same way a spreadsheet would.
+const (
+	formulaErrDiv0  = "#DIV/0!"
+	formulaErrName  = "#NAME?"
+	formulaErrValue = "#VALUE!"
+	formulaErrRef   = "#REF!"
+	formulaErrNA    = "#N/A"
+	formulaErrNum   = "#NUM!"
+)
+
+// maxFormulaRangeCells caps the cells one range reference may read, so a
+// reference like {{A1:XFD1048576}} cannot exhaust memory or hold the sheet
+// lock for long. Larger ranges evaluate to #REF!.
+const maxFormulaRangeCells = 100000
+
+// formulaError is an error value flowing through formula evaluation.
+type formulaError string
+
+// formulaRange is a 2-D block of values produced by a range reference.
+type formulaRange [][]interface{}
+
+// isFormulaText reports whether a value typed into a cell is a formula.
+func isFormulaText(value string) bool {
+	return len(value) > 1 && value[0] == '='
+}
+
+// bareRefPattern matches A1 style references written without {{ }} tags.
+var bareRefPattern = regexp.MustCompile(`^\$?([A-Za-z]{1,3})\$?(\d+)(?::\$?([A-Za-z]{1,3})\$?(\d+))?`)
+
+// normalizeFormulaRefs rewrites bare references (A1, $B$2, a1:c3) in a
+// formula into {{A1}} tags. String literals and existing {{...}} tags are
+// left untouched. Tokens followed by "(" are function names, not references.
+func normalizeFormulaRefs(formula string) string {
+	var b strings.Builder
+	i := 0
+	for i < len(formula) {
+		ch := formula[i]
+		switch {
+		case ch == '"':
+			j := i + 1
+			for j < len(formula) {
+				if formula[j] == '"' {
+					if j+1 < len(formula) && formula[j+1] == '"' {
+						j += 2
+						continue
+					}
+					break
+				}
+				j++
+			}
+			if j < len(formula) {
+				j++
+			}
+			b.WriteString(formula[i:j])
+			i = j
+		case strings.HasPrefix(formula[i:], "{{"):
+			end := strings.Index(formula[i:], "}}")
+			if end < 0 {
+				b.WriteString(formula[i:])
+				return b.String()
+			}
+			b.WriteString(formula[i : i+end+2])
+			i += end + 2
+		case ch == '$' || isASCIILetter(ch):
+			if i > 0 && (isIdentChar(formula[i-1]) || formula[i-1] == '.') {
+				b.WriteByte(ch)
+				i++
+				continue
+			}
+			m := bareRefPattern.FindStringSubmatch(formula[i:])
+			if m != nil {
+				next := i + len(m[0])
+				if next >= len(formula) || (!isIdentChar(formula[next]) && formula[next] != '(') {
+					ref := strings.ToUpper(m[1]) + m[2]
+					if m[3] != "" {
+						ref += ":" + strings.ToUpper(m[3]) + m[4]
+					}
+					b.WriteString("{{" + ref + "}}")
+					i = next
+					continue
+				}
+			}
+			// Copy the whole identifier so a reference-looking suffix is not matched.
+			j := i
+			for j < len(formula) && (isIdentChar(formula[j]) || formula[j] == '.' || formula[j] == '$') {
+				j++
+			}
+			if j == i {
+				j = i + 1
+			}
+			b.WriteString(formula[i:j])
+			i = j
+		default:
+			b.WriteByte(ch)
+			i++
+		}
+	}
+	return b.String()
+}
+
+func isASCIILetter(ch byte) bool {
+	return (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z')
+}
+
+func isIdentChar(ch byte) bool {
+	return isASCIILetter(ch) || (ch >= '0' && ch <= '9') || ch == '_'
+}
+
+// setCellFormulaLocked stores a formula on a cell; once the sheet is
+// unlocked, the returned func registers its references in scriptDeps and
+// evaluates it. Called from SetCell with s.mu held.
+func (s *Sheet) setCellFormulaLocked(row, col, formula, user string, reverted bool) editDone {
+	formula = normalizeFormulaRefs(formula)
+
+	if s.Data[row] == nil {
+		s.Data[row] = make(map[string]Cell)
+	}
+	current, exists := s.Data[row][col]
+	if exists && current.CellType == FormulaCell && current.Script == formula {
+		return editNothing
+	}
+
+	updated := current
+	updated.User = user
+	updated.CellType = FormulaCell
+	updated.Script = formula
+	if strings.TrimSpace(updated.CellID) == "" {
+		updated.CellID = generateID()
+	}
+	s.Data[row][col] = updated
+	cellID := updated.CellID
+
+	var oldText string
+	if exists {
+		oldText = current.Value
+		if current.CellType == FormulaCell {
+			oldText = current.Script
+		}
+	}
+	if reverted {
+		globalAuditLog.Revert(s.ProjectName, s.Name, "EDIT_FORMULA", atoiSafe(row), col, oldText)
+	} else {
+		cellChanges := make(map[string]cellChangesstruct)
+		cellChanges[row+"-"+col] = cellChangesstruct{
+			rowNum: atoiSafe(row),
+			colStr: col,
+			oldVal: oldText,
+			newVal: formula,
+			action: "EDIT_FORMULA",
+			user:   user,
+		}
+		addMergedAuditEntries(s, cellChanges)
+	}
+
+	return func() {
+		globalSheetManager.UpdateScriptDependencies(s.ProjectName, s.Name, cellID, formula, row, col)
+		globalSheetManager.SaveCells(s, cellRef{row, col})
+
+		evaluateFormulaCell(s.ProjectName, s.Name, row, col, true)
+	}
+}
+
+// ExecuteFormulaCell re-evaluates a formula cell as part of a dependency
+// cascade. Recalculate schedules its dependents, so none are queued here.
+func ExecuteFormulaCell(projectName, sheetName, row, col string) {
+	evaluateFormulaCell(projectName, sheetName, row, col, false)
+}
+
+// evaluateFormulaCell computes a formula cell and writes the result to its
+// Value. With triggerNext, dependents are queued when the displayed value
+// changes.
+func evaluateFormulaCell(projectName, sheetName, row, col string, triggerNext bool) {
+	s := globalSheetManager.GetSheetBy(sheetName, projectName)
+	if s == nil {
+		return
+	}
+	s.mu.RLock()
+	cur, exists := s.Data[row][col]
+	s.mu.RUnlock()
+	if !exists || cur.CellType != FormulaCell {
+		return
+	}
+	formula := cur.Script
+
+	result := EvaluateFormula(formula, s, row, col)
+
+	s.mu.Lock()
+	c, ok := s.Data[row][col]
+	if !ok || c.CellType != FormulaCell || c.Script != formula {
+		// The cell changed while we were evaluating; the newer edit wins.
+		s.mu.Unlock()
+		return
+	}
+	oldVal := c.Value
+	c.Value = result
+	c.ScriptOutput = result
+	s.Data[row][col] = c
+	if oldVal != result {
+		cellChanges := make(map[string]cellChangesstruct)
+		cellChanges[row+"-"+col] = cellChangesstruct{
+			rowNum: atoiSafe(row),
+			colStr: col,
+			oldVal: oldVal,
+			newVal: result,
+			action: "EDIT_CELL",
+			user:   "system",
+		}
+		addMergedAuditEntries(s, cellChanges)
+	}
+	s.mu.Unlock()
+
+	if oldVal == result {
+		return
+	}
+	globalSheetManager.SaveCells(s, cellRef{row, col})
+	globalSheetManager.QueueRowColUpdate(s.ProjectName, s.Name)
+	if !triggerNext {
+		return
+	}
+
+	globalSheetManager.CellsModifiedByScriptQueueMu.Lock()
+	globalSheetManager.CellsModifiedByScriptQueue = append(
+		globalSheetManager.CellsModifiedByScriptQueue,
+		CellIdentifier{projectName, sheetName, row, col},
+	)
+	globalSheetManager.CellsModifiedByScriptQueueMu.Unlock()
+}
+
+// EvaluateFormula evaluates formula (with or without the leading "=") in
+// the context of cell (row, col) of sheet s and returns the display text.
+// The sheet must not be locked by the caller.
+func EvaluateFormula(formula string, s *Sheet, row, col string) string {
+	text := strings.TrimSpace(formula)
+	text = strings.TrimPrefix(text, "=")
+	tokens, err := tokenizeFormula(text)
+	if err != nil {
+		return formulaErrName
+	}
+	p := &formulaParser{tokens: tokens}
+	node, err := p.parseExpression()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return formulaErrName
+	}
+	// References to other sheets read them as whoever wrote the formula
+	s.mu.RLock()
+	user := s.Data[row][col].User
+	if user == "" {
+		user = s.Owner
+	}
+	s.mu.RUnlock()
+	ctx := &formulaContext{sheet: s, row: row, col: col, user: user}
+	return formatFormulaValue(ctx.eval(node))
+}
+
+// ---- tokenizer ----
+
+const (
+	ftNumber = iota
+	ftString
+	ftRef
+	ftIdent
+	ftOp
+	ftLParen
+	ftRParen
+	ftComma
+)
+
+type formulaToken struct {
+	kind int
+	text string
+}
+
+func tokenizeFormula(text string) ([]formulaToken, error) {
+	var tokens []formulaToken
+	i := 0
+	for i < len(text) {
+		ch := text[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case strings.HasPrefix(text[i:], "{{"):
+			end := strings.Index(text[i:], "}}")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated reference")
+			}
+			tokens = append(tokens, formulaToken{ftRef, text[i+2 : i+end]})
+			i += end + 2
+		case ch == '"':
+			var sb strings.Builder
+			j := i + 1
+			closed := false
+			for j < len(text) {
+				if text[j] == '"' {
+					if j+1 < len(text) && text[j+1] == '"' {
+						sb.WriteByte('"')
+						j += 2
+						continue
+					}
+					closed = true
+					j++
+					break
+				}
+				sb.WriteByte(text[j])
+				j++
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, formulaToken{ftString, sb.String()})
+			i = j
+		case (ch >= '0' && ch <= '9') || (ch == '.' && i+1 < len(text) && text[i+1] >= '0' && text[i+1] <= '9'):
+			j := i
+			for j < len(text) && ((text[j] >= '0' && text[j] <= '9') || text[j] == '.') {
+				j++
+			}
+			if j < len(text) && (text[j] == 'e' || text[j] == 'E') {
+				k := j + 1
+				if k < len(text) && (text[k] == '+' || text[k] == '-') {
+					k++
+				}
+				if k < len(text) && text[k] >= '0' && text[k] <= '9' {
+					for k < len(text) && text[k] >= '0' && text[k] <= '9' {
+						k++
+					}
+					j = k
+				}
+			}
+			tokens = append(tokens, formulaToken{ftNumber, text[i:j]})
+			i = j
+		case isASCIILetter(ch) || ch == '_' || ch == '$':
+			if m := bareRefPattern.FindString(text[i:]); m != "" {
+				next := i + len(m)
+				if next >= len(text) || (!isIdentChar(text[next]) && text[next] != '(' && text[next] != '.') {
+					tokens = append(tokens, formulaToken{ftRef, strings.ToUpper(strings.ReplaceAll(m, "$", ""))})
+					i = next
+					continue
+				}
+			}
+			j := i
+			for j < len(text) && (isIdentChar(text[j]) || text[j] == '.') {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("unexpected %q", string(ch))
+			}
+			tokens = append(tokens, formulaToken{ftIdent, text[i:j]})
+			i = j
+		case ch == '(':
+			tokens = append(tokens, formulaToken{ftLParen, "("})
+			i++
+		case ch == ')':
+			tokens = append(tokens, formulaToken{ftRParen, ")"})
+			i++
+		case ch == ',' || ch == ';':
+			tokens = append(tokens, formulaToken{ftComma, ","})
+			i++
+		case strings.HasPrefix(text[i:], "<=") || strings.HasPrefix(text[i:], ">=") || strings.HasPrefix(text[i:], "<>"):
+			tokens = append(tokens, formulaToken{ftOp, text[i : i+2]})
+			i += 2
+		case strings.ContainsRune("+-*/^&=<>%", rune(ch)):
+			tokens = append(tokens, formulaToken{ftOp, string(ch)})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected %q", string(ch))
+		}
+	}
+	return tokens, nil
+}
+
+// ---- parser ----
+
+const (
+	fnLiteral = iota
+	fnRef
+	fnUnary
+	fnBinary
+	fnPercent
+	fnCall
+)
+
+type formulaNode struct {
+	kind  int
+	op    string
+	value interface{}
+	args  []*formulaNode
+}
+
+type formulaParser struct {
+	tokens []formulaToken
+	pos    int
+}
+
+func (p *formulaParser) peek() *formulaToken {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *formulaParser) peekOp(ops ...string) string {
+	t := p.peek()
+	if t == nil || t.kind != ftOp {
+		return ""
+	}
+	for _, op := range ops {
+		if t.text == op {
+			return op
+		}
+	}
+	return ""
+}
+
+// Precedence, lowest first: comparison, &, + -, * /, ^, unary, %.
+func (p *formulaParser) parseExpression() (*formulaNode, error) {
+	left, err := p.parseConcat()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peekOp("=", "<>", "<", ">", "<=", ">=")
+		if op == "" {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseConcat()
+		if err != nil {
+			return nil, err
+		}
+		left = &formulaNode{kind: fnBinary, op: op, args: []*formulaNode{left, right}}
+	}
+}
+
+func (p *formulaParser) parseConcat() (*formulaNode, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekOp("&") != "" {
+		p.pos++
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		left = &formulaNode{kind: fnBinary, op: "&", args: []*formulaNode{left, right}}
+	}
+	return left, nil
+}
+
+func (p *formulaParser) parseAdditive() (*formulaNode, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peekOp("+", "-")
+		if op == "" {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = &formulaNode{kind: fnBinary, op: op, args: []*formulaNode{left, right}}
+	}
+}
+
+func (p *formulaParser) parseMultiplicative() (*formulaNode, error) {
+	left, err := p.parsePower()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peekOp("*", "/")
+		if op == "" {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parsePower()
+		if err != nil {
+			return nil, err
+		}
+		left = &formulaNode{kind: fnBinary, op: op, args: []*formulaNode{left, right}}
+	}
+}
+
+func (p *formulaParser) parsePower() (*formulaNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekOp("^") != "" {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &formulaNode{kind: fnBinary, op: "^", args: []*formulaNode{left, right}}
+	}
+	return left, nil
+}
+
+func (p *formulaParser) parseUnary() (*formulaNode, error) {
+	if op := p.peekOp("-", "+"); op != "" {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &formulaNode{kind: fnUnary, op: op, args: []*formulaNode{operand}}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *formulaParser) parsePostfix() (*formulaNode, error) {
+	node, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekOp("%") != "" {
+		p.pos++
+		node = &formulaNode{kind: fnPercent, args: []*formulaNode{node}}
+	}
+	return node, nil
+}
+
+func (p *formulaParser) parsePrimary() (*formulaNode, error) {
+	t := p.peek()
+	if t == nil {
+		return nil, fmt.Errorf("unexpected end of formula")
+	}
+	p.pos++
+	switch t.kind {
+	case ftNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, err
+		}
+		return &formulaNode{kind: fnLiteral, value: f}, nil
+	case ftString:
+		return &formulaNode{kind: fnLiteral, value: t.text}, nil
+	case ftRef:
+		return &formulaNode{kind: fnRef, value: t.text}, nil
+	case ftLParen:
+		node, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if n := p.peek(); n == nil || n.kind != ftRParen {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return node, nil
+	case ftIdent:
+		name := strings.ToUpper(t.text)
+		if n := p.peek(); n != nil && n.kind == ftLParen {
+			p.pos++
+			call := &formulaNode{kind: fnCall, op: name}
+			if n := p.peek(); n != nil && n.kind == ftRParen {
+				p.pos++
+				return call, nil
+			}
+			for {
+				arg, err := p.parseExpression()
+				if err != nil {
+					return nil, err
+				}
+				call.args = append(call.args, arg)
+				n := p.peek()
+				if n == nil {
+					return nil, fmt.Errorf("missing )")
+				}
+				p.pos++
+				if n.kind == ftRParen {
+					return call, nil
+				}
+				if n.kind != ftComma {
+					return nil, fmt.Errorf("unexpected %q", n.text)
+				}
+			}
+		}
+		switch name {
+		case "TRUE":
+			return &formulaNode{kind: fnLiteral, value: true}, nil
+		case "FALSE":
+			return &formulaNode{kind: fnLiteral, value: false}, nil
+		}
+		// Unknown bare identifiers evaluate to #NAME? like in other spreadsheets.
+		return &formulaNode{kind: fnLiteral, value: formulaError(formulaErrName)}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+// ---- evaluation ----
+
+type formulaContext struct {
+	sheet    *Sheet
+	row, col string
+	user     string // whose access other sheets are read with
+}
+
+var (
+	formulaCrossRefPattern  = regexp.MustCompile(`^((?:[^/\{\}]+/)+)([^/\{\}]+)/([A-Z]+)(\d+)(?::([A-Z]+)(\d+))?$`)
+	formulaCrossNamePattern = regexp.MustCompile(`^((?:[^/\{\}]+/)+)([^/\{\}]+)/([A-Za-z_]\w*)$`)
+	formulaRefPattern       = regexp.MustCompile(`^([A-Z]+)(\d+)(?::([A-Z]+)(\d+))?$`)
+	formulaNamePattern      = regexp.MustCompile(`^[A-Za-z_]\w*$`)
+)
+
+// otherSheet returns the sheet name of project if the formula's user may
+// read it.
+func (ctx *formulaContext) otherSheet(project, name string) *Sheet {
+	s := globalSheetManager.GetSheetBy(name, strings.TrimSuffix(project, "/"))
+	if s == nil || s != ctx.sheet && !s.CanRead(ctx.user) {
+		return nil
+	}
+	return s
+}
+
+// resolveRef turns the inside of a {{...}} tag into a scalar (single cell)
+// or a formulaRange, reading cell values under the owning sheet's RLock.
+// Sheets the formula's user may not read resolve to #REF!.
+func (ctx *formulaContext) resolveRef(ref string) interface{} {
+	target := ctx.sheet
+	coords := ref
+	if m := formulaCrossRefPattern.FindStringSubmatch(ref); m != nil {
+		target = ctx.otherSheet(m[1], m[2])
+		coords = m[3] + m[4]
+		if m[5] != "" {
+			coords += ":" + m[5] + m[6]
+		}
+	} else if m := formulaCrossNamePattern.FindStringSubmatch(ref); m != nil {
+		target = ctx.otherSheet(m[1], m[2])
+		if target == nil {
+			return formulaError(formulaErrRef)
+		}
+		r, c, found := target.FindCellByName(m[3])
+		if !found {
+			return formulaError(formulaErrName)
+		}
+		coords = c + r
+	} else if !formulaRefPattern.MatchString(ref) && formulaNamePattern.MatchString(ref) {
+		r, c, found := ctx.sheet.FindCellByName(ref)
+		if !found {
+			return formulaError(formulaErrName)
+		}
+		coords = c + r
+	}
+	if target == nil {
+		return formulaError(formulaErrRef)
+	}
+	m := formulaRefPattern.FindStringSubmatch(coords)
+	if m == nil {
+		return formulaError(formulaErrRef)
+	}
+	self := target == ctx.sheet
+
+	startCol, startRow := colLabelToIndex(m[1]), atoiSafe(m[2])
+	if m[3] == "" {
+		if self && m[1] == ctx.col && m[2] == ctx.row {
+			return formulaError(formulaErrRef)
+		}
+		target.mu.RLock()
+		defer target.mu.RUnlock()
+		return cellFormulaValue(target.Data[m[2]][m[1]].Value)
+	}
+	endCol, endRow := colLabelToIndex(m[3]), atoiSafe(m[4])
+	if startRow > endRow {
+		startRow, endRow = endRow, startRow
+	}
+	if startCol > endCol {
+		startCol, endCol = endCol, startCol
+	}
+	if (endRow-startRow+1)*(endCol-startCol+1) > maxFormulaRangeCells {
+		return formulaError(formulaErrRef)
+	}
+	target.mu.RLock()
+	defer target.mu.RUnlock()
+	var out formulaRange
+	for r := startRow; r <= endRow; r++ {
+		rowKey := itoa(r)
+		var line []interface{}
+		for c := startCol; c <= endCol; c++ {
+			colLabel := indexToColLabel(c)
+			if self && rowKey == ctx.row && colLabel == ctx.col {
+				return formulaError(formulaErrRef)
+			}
+			line = append(line, cellFormulaValue(target.Data[rowKey][colLabel].Value))
+		}
+		out = append(out, line)
+	}
+	return out
+}
+
+// cellFormulaValue converts stored cell text into a formula value. Error
+// codes produced by other formulas propagate as errors.
+func cellFormulaValue(text string) interface{} {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return nil
+	}
+	if f, err := strconv.ParseFloat(trimmed, 64); err == nil {
+		return f
+	}
+	switch strings.ToUpper(trimmed) {
+	case "TRUE":
+		return true
+	case "FALSE":
+		return false
+	case formulaErrDiv0, formulaErrName, formulaErrValue, formulaErrRef, formulaErrNA, formulaErrNum:
+		return formulaError(strings.ToUpper(trimmed))
+	}
+	return text
+}
+
+func (ctx *formulaContext) eval(n *formulaNode) interface{} {
+	switch n.kind {
+	case fnLiteral:
+		return n.value
+	case fnRef:
+		return ctx.resolveRef(n.value.(string))
+	case fnUnary:
+		v, e := toNumber(ctx.scalar(n.args[0]))
+		if e != "" {
+			return formulaError(e)
+		}
+		if n.op == "-" {
+			return -v
+		}
+		return v
+	case fnPercent:
+		v, e := toNumber(ctx.scalar(n.args[0]))
+		if e != "" {
+			return formulaError(e)
+		}
+		return v / 100
+	case fnBinary:
+		return ctx.evalBinary(n.op, ctx.scalar(n.args[0]), ctx.scalar(n.args[1]))
+	case fnCall:
+		fn, ok := formulaFunctions[n.op]
+		if !ok {
+			return formulaError(formulaErrName)
+		}
+		return fn(ctx, n.args)
+	}
+	return formulaError(formulaErrValue)
+}
+
+// scalar evaluates a node that must produce a single value. A 1x1 range is
+// unwrapped; larger ranges are a #VALUE! error.
+func (ctx *formulaContext) scalar(n *formulaNode) interface{} {
+	v := ctx.eval(n)
+	if rng, ok := v.(formulaRange); ok {
+		if len(rng) == 1 && len(rng[0]) == 1 {
+			return rng[0][0]
+		}
+		return formulaError(formulaErrValue)
+	}
+	return v
+}
+
+func (ctx *formulaContext) evalBinary(op string, a, b interface{}) interface{} {
+	if e, ok := a.(formulaError); ok {
+		return e
+	}
+	if e, ok := b.(formulaError); ok {
+		return e
+	}
+	switch op {
+	case "&":
+		return toText(a) + toText(b)
+	case "=", "<>", "<", ">", "<=", ">=":
+		c := compareFormulaValues(a, b)
+		switch op {
+		case "=":
+			return c == 0
+		case "<>":
+			return c != 0
+		case "<":
+			return c < 0
+		case ">":
+			return c > 0
+		case "<=":
+			return c <= 0
+		default:
+			return c >= 0
+		}
+	}
+	x, e := toNumber(a)
+	if e != "" {
+		return formulaError(e)
+	}
+	y, e := toNumber(b)
+	if e != "" {
+		return formulaError(e)
+	}
+	switch op {
+	case "+":
+		return x + y
+	case "-":
+		return x - y
+	case "*":
+		return x * y
+	case "/":
+		if y == 0 {
+			return formulaError(formulaErrDiv0)
+		}
+		return x / y
+	case "^":
+		r := math.Pow(x, y)
+		if math.IsNaN(r) || math.IsInf(r, 0) {
+			return formulaError(formulaErrNum)
+		}
+		return r
+	}
+	return formulaError(formulaErrValue)
+}
+
+// toNumber coerces a scalar to a number; blanks are 0, booleans 1/0 and
+// numeric text is parsed.
+func toNumber(v interface{}) (float64, string) {
+	switch x := v.(type) {
+	case nil:
+		return 0, ""
+	case float64:
+		return x, ""
+	case bool:
+		if x {
+			return 1, ""
+		}
+		return 0, ""
+	case string:
+		if strings.TrimSpace(x) == "" {
+			return 0, ""
+		}
+		if f, err := strconv.ParseFloat(strings.TrimSpace(x), 64); err == nil {
+			return f, ""
+		}
+		return 0, formulaErrValue
+	case formulaError:
+		return 0, string(x)
+	}
+	return 0, formulaErrValue
+}
+
+func toText(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return formatFormulaNumber(x)
+	case bool:
+		if x {
+			return "TRUE"
+		}
+		return "FALSE"
+	case string:
+		return x
+	case formulaError:
+		return string(x)
+	}
+	return ""
+}
+
+func toBool(v interface{}) (bool, string) {
+	switch x := v.(type) {
+	case nil:
+		return false, ""
+	case bool:
+		return x, ""
+	case float64:
+		return x != 0, ""
+	case string:
+		switch strings.ToUpper(strings.TrimSpace(x)) {
+		case "TRUE":
+			return true, ""
+		case "FALSE":
+			return false, ""
+		}
+		return false, formulaErrValue
+	case formulaError:
+		return false, string(x)
+	}
+	return false, formulaErrValue
+}
+
+// compareFormulaValues orders numbers before text before booleans, and
+// compares text case-insensitively. Blank compares equal to 0 and "".
+func compareFormulaValues(a, b interface{}) int {
+	rank := func(v interface{}) int {
+		switch v.(type) {
+		case float64:
+			return 0
+		case string:
+			return 1
+		case bool:
+			return 2
+		}
+		return -1
+	}
+	if a == nil {
+		switch b.(type) {
+		case string:
+			a = ""
+		case bool:
+			a = false
+		default:
+			a = 0.0
+		}
+	}
+	if b == nil {
+		switch a.(type) {
+		case string:
+			b = ""
+		case bool:
+			b = false
+		default:
+			b = 0.0
+		}
+	}
+	ra, rb := rank(a), rank(b)
+	if ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+	switch x := a.(type) {
+	case float64:
+		y := b.(float64)
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(strings.ToLower(x), strings.ToLower(b.(string)))
+	case bool:
+		y := b.(bool)
+		if x == y {
+			return 0
+		} else if !x {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// formatFormulaNumber renders a number with at most 15 significant digits,
+// which hides binary floating point noise such as 0.1+0.2.
+func formatFormulaNumber(f float64) string {
+	if f == 0 {
+		return "0"
+	}
+	rounded, err := strconv.ParseFloat(strconv.FormatFloat(f, 'g', 15, 64), 64)
+	if err != nil {
+		rounded = f
+	}
+	if math.Abs(rounded) >= 1e21 || math.Abs(rounded) < 1e-9 {
+		return strconv.FormatFloat(rounded, 'g', -1, 64)
+	}
+	return strconv.FormatFloat(rounded, 'f', -1, 64)
+}
+
+func formatFormulaValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		// A formula pointing at an empty cell shows 0.
+		return "0"
+	case formulaRange:
+		if len(x) == 1 && len(x[0]) == 1 {
+			return formatFormulaValue(x[0][0])
+		}
+		return formulaErrValue
+	case float64:
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return formulaErrNum
+		}
+	}
+	return toText(v)
+}
+
+// ---- built-in functions ----
+
+type formulaFunc func(ctx *formulaContext, args []*formulaNode) interface{}
+
+var formulaFunctions map[string]formulaFunc
+
+func init() {
+	formulaFunctions = map[string]formulaFunc{
+		"SUM":         fnSum,
+		"PRODUCT":     fnProduct,
+		"AVERAGE":     fnAverage,
+		"MIN":         fnMin,
+		"MAX":         fnMax,
+		"COUNT":       fnCount,
+		"COUNTA":      fnCountA,
+		"COUNTBLANK":  fnCountBlank,
+		"SUMIF":       fnSumIf,
+		"COUNTIF":     fnCountIf,
+		"AVERAGEIF":   fnAverageIf,
+		"IF":          fnIf,
+		"IFERROR":     fnIfError,
+		"AND":         fnAnd,
+		"OR":          fnOr,
+		"NOT":         fnNot,
+		"ISBLANK":     fnIsBlank,
+		"ISNUMBER":    fnIsNumber,
+		"ISTEXT":      fnIsText,
+		"ISERROR":     fnIsError,
+		"ROUND":       fnRound(math.Round),
+		"ROUNDUP":     fnRound(func(f float64) float64 { return math.Copysign(math.Ceil(math.Abs(f)), f) }),
+		"ROUNDDOWN":   fnRound(math.Trunc),
+		"INT":         fnMath1(math.Floor),
+		"ABS":         fnMath1(math.Abs),
+		"SQRT":        fnSqrt,
+		"POWER":       fnPower,
+		"MOD":         fnMod,
+		"CONCATENATE": fnConcat,
+		"CONCAT":      fnConcat,
+		"LEN":         fnText1(func(s string) interface{} { return float64(len([]rune(s))) }),
+		"UPPER":       fnText1(func(s string) interface{} { return strings.ToUpper(s) }),
+		"LOWER":       fnText1(func(s string) interface{} { return strings.ToLower(s) }),
+		"TRIM":        fnText1(func(s string) interface{} { return strings.Join(strings.Fields(s), " ") }),
+		"LEFT":        fnLeft,
+		"RIGHT":       fnRight,
+		"MID":         fnMid,
+		"VLOOKUP":     fnVLookup,
+		"HLOOKUP":     fnHLookup,
+		"INDEX":       fnIndex,
+		"MATCH":       fnMatch,
+		"TODAY":       fnToday,
+		"NOW":         fnNow,
+	}
+}
+
+// collectValues flattens arguments into scalars. Values coming from ranges
+// are returned with fromRange set so aggregate functions can skip text the
+// way spreadsheets do.
+func (ctx *formulaContext) collectValues(args []*formulaNode, visit func(v interface{}, fromRange bool) string) string {
+	for _, a := range args {
+		v := ctx.eval(a)
+		if rng, ok := v.(formulaRange); ok {
+			for _, line := range rng {
+				for _, cell := range line {
+					if e := visit(cell, true); e != "" {
+						return e
+					}
+				}
+			}
+			continue
+		}
+		if e := visit(v, a.kind == fnRef); e != "" {
+			return e
+		}
+	}
+	return ""
+}
+
+// numbersOf returns the numeric values among args, propagating errors.
+func (ctx *formulaContext) numbersOf(args []*formulaNode) ([]float64, string) {
+	var nums []float64
+	e := ctx.collectValues(args, func(v interface{}, fromRange bool) string {
+		if err, ok := v.(formulaError); ok {
+			return string(err)
+		}
+		if fromRange {
+			if f, ok := v.(float64); ok {
+				nums = append(nums, f)
+			}
+			return ""
+		}
+		f, e := toNumber(v)
+		if e != "" {
+			return e
+		}
+		nums = append(nums, f)
+		return ""
+	})
+	return nums, e
+}
+
+func fnSum(ctx *formulaContext, args []*formulaNode) interface{} {
+	nums, e := ctx.numbersOf(args)
+	if e != "" {
+		return formulaError(e)
+	}
+	total := 0.0
+	for _, n := range nums {
+		total += n
+	}
+	return total
+}
+
+func fnProduct(ctx *formulaContext, args []*formulaNode) interface{} {
+	nums, e := ctx.numbersOf(args)
+	if e != "" {
+		return formulaError(e)
+	}
+	if len(nums) == 0 {
+		return 0.0
+	}
+	total := 1.0
+	for _, n := range nums {
+		total *= n
+	}
+	return total
+}
+
+func fnAverage(ctx *formulaContext, args []*formulaNode) interface{} {
+	nums, e := ctx.numbersOf(args)
+	if e != "" {
+		return formulaError(e)
+	}
+	if len(nums) == 0 {
+		return formulaError(formulaErrDiv0)
+	}
+	total := 0.0
+	for _, n := range nums {
+		total += n
+	}
+	return total / float64(len(nums))
+}
+
+func fnMin(ctx *formulaContext, args []*formulaNode) interface{} {
+	nums, e := ctx.numbersOf(args)
+	if e != "" {
+		return formulaError(e)
+	}
+	if len(nums) == 0 {
+		return 0.0
+	}
+	m := nums[0]
+	for _, n := range nums[1:] {
+		m = math.Min(m, n)
+	}
+	return m
+}
+
+func fnMax(ctx *formulaContext, args []*formulaNode) interface{} {
+	nums, e := ctx.numbersOf(args)
+	if e != "" {
+		return formulaError(e)
+	}
+	if len(nums) == 0 {
+		return 0.0
+	}
+	m := nums[0]
+	for _, n := range nums[1:] {
+		m = math.Max(m, n)
+	}
+	return m
+}
+
+func fnCount(ctx *formulaContext, args []*formulaNode) interface{} {
+	count := 0
+	ctx.collectValues(args, func(v interface{}, fromRange bool) string {
+		if _, ok := v.(float64); ok {
+			count++
+		} else if s, ok := v.(string); ok && !fromRange {
+			if _, e := toNumber(s); e == "" {
+				count++
+			}
+		}
+		return ""
+	})
+	return float64(count)
+}
+
+func fnCountA(ctx *formulaContext, args []*formulaNode) interface{} {
+	count := 0
+	ctx.collectValues(args, func(v interface{}, fromRange bool) string {
+		if v != nil {
+			count++
+		}
+		return ""
+	})
+	return float64(count)
+}
+
+func fnCountBlank(ctx *formulaContext, args []*formulaNode) interface{} {
+	count := 0
+	ctx.collectValues(args, func(v interface{}, fromRange bool) string {
+		if v == nil || v == "" {
+			count++
+		}
+		return ""
+	})
+	return float64(count)
+}
+
+// formulaCriteria builds a predicate from a SUMIF/COUNTIF criteria such as
+// 5, ">10", "<>done" or "app*".
+func formulaCriteria(crit interface{}) func(v interface{}) bool {
+	s, isText := crit.(string)
+	if !isText {
+		return func(v interface{}) bool { return v != nil && compareFormulaValues(v, crit) == 0 }
+	}
+	op := "="
+	for _, candidate := range []string{"<=", ">=", "<>", "<", ">", "="} {
+		if strings.HasPrefix(s, candidate) {
+			op = candidate
+			s = s[len(candidate):]
+			break
+		}
+	}
+	var target interface{} = s
+	if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+		target = f
+	}
+	var pattern *regexp.Regexp
+	if _, isStr := target.(string); isStr && strings.ContainsAny(s, "*?") {
+		quoted := regexp.QuoteMeta(s)
+		quoted = strings.ReplaceAll(quoted, `\*`, ".*")
+		quoted = strings.ReplaceAll(quoted, `\?`, ".")
+		pattern = regexp.MustCompile("(?i)^" + quoted + "$")
+	}
+	return func(v interface{}) bool {
+		if pattern != nil {
+			matched := pattern.MatchString(toText(v))
+			if op == "<>" {
+				return !matched
+			}
+			return op == "=" && matched
+		}
+		if v == nil {
+			v = ""
+			if _, isNum := target.(float64); isNum {
+				return op == "<>"
+			}
+		}
+		if _, isNum := target.(float64); isNum {
+			if _, vNum := v.(float64); !vNum {
+				return op == "<>"
+			}
+		}
+		c := compareFormulaValues(v, target)
+		switch op {
+		case "<":
+			return c < 0
+		case ">":
+			return c > 0
+		case "<=":
+			return c <= 0
+		case ">=":
+			return c >= 0
+		case "<>":
+			return c != 0
+		}
+		return c == 0
+	}
+}
+
+// conditionalRange implements the shared part of SUMIF/COUNTIF/AVERAGEIF:
+// it returns the values selected by the criteria.
+func (ctx *formulaContext) conditionalRange(args []*formulaNode, withValues bool) ([]interface{}, string) {
+	if len(args) < 2 || (!withValues && len(args) != 2) || len(args) > 3 {
+		return nil, formulaErrValue
+	}
+	rng := asRange(ctx.eval(args[0]))
+	if rng == nil {
+		return nil, formulaErrValue
+	}
+	crit := ctx.scalar(args[1])
+	if e, ok := crit.(formulaError); ok {
+		return nil, string(e)
+	}
+	values := rng
+	if withValues && len(args) == 3 {
+		values = asRange(ctx.eval(args[2]))
+		if values == nil {
+			return nil, formulaErrValue
+		}
+	}
+	match := formulaCriteria(crit)
+	var out []interface{}
+	for r, line := range rng {
+		for c, v := range line {
+			if !match(v) {
+				continue
+			}
+			if r < len(values) && c < len(values[r]) {
+				out = append(out, values[r][c])
+			}
+		}
+	}
+	return out, ""
+}
+
+func fnSumIf(ctx *formulaContext, args []*formulaNode) interface{} {
+	vals, e := ctx.conditionalRange(args, true)
+	if e != "" {
+		return formulaError(e)
+	}
+	total := 0.0
+	for _, v := range vals {
+		if f, ok := v.(float64); ok {
+			total += f
+		}
+	}
+	return total
+}
+
+func fnCountIf(ctx *formulaContext, args []*formulaNode) interface{} {
+	vals, e := ctx.conditionalRange(args, false)
+	if e != "" {
+		return formulaError(e)
+	}
+	return float64(len(vals))
+}
+
+func fnAverageIf(ctx *formulaContext, args []*formulaNode) interface{} {
+	vals, e := ctx.conditionalRange(args, true)
+	if e != "" {
+		return formulaError(e)
+	}
+	total, n := 0.0, 0
+	for _, v := range vals {
+		if f, ok := v.(float64); ok {
+			total += f
+			n++
+		}
+	}
+	if n == 0 {
+		return formulaError(formulaErrDiv0)
+	}
+	return total / float64(n)
+}
+
+func fnIf(ctx *formulaContext, args []*formulaNode) interface{} {
+	if len(args) < 2 || len(args) > 3 {
+		return formulaError(formulaErrValue)
+	}
+	cond, e := toBool(ctx.scalar(args[0]))
+	if e != "" {
+		return formulaError(e)
+	}
+	if cond {
+		return ctx.eval(args[1])
+	}
+	if len(args) == 3 {
+		return ctx.eval(args[2])
+	}
+	return false
+}
+
+func fnIfError(ctx *formulaContext, args []*formulaNode) interface{} {
+	if len(args) != 2 {
+		return formulaError(formulaErrValue)
+	}
+	v := ctx.eval(args[0])
+	if _, ok := v.(formulaError); ok {
+		return ctx.eval(args[1])
+	}
+	return v
+}
+
+func fnAnd(ctx *formulaContext, args []*formulaNode) interface{} {
+	if len(args) == 0 {
+		return formulaError(formulaErrValue)
+	}
+	result := true
+	e := ctx.collectValues(args, func(v interface{}, fromRange bool) string {
+		if v == nil || (fromRange && isTextValue(v)) {
+			return ""
+		}
+		b, e := toBool(v)
+		if e != "" {
+			return e
+		}
+		result = result && b
+		return ""
+	})
+	if e != "" {
+		return formulaError(e)
+	}
+	return result
+}
+
+func fnOr(ctx *formulaContext, args []*formulaNode) interface{} {
+	if len(args) == 0 {
+		return formulaError(formulaErrValue)
+	}
+	result := false
+	e := ctx.collectValues(args, func(v interface{}, fromRange bool) string {
+		if v == nil || (fromRange && isTextValue(v)) {
+			return ""
+		}
+		b, e := toBool(v)
+		if e != "" {
+			return e
+		}
+		result = result || b
+		return ""
+	})
+	if e != "" {
+		return formulaError(e)
+	}
+	return result
+}
+
+func isTextValue(v interface{}) bool {
+	_, ok := v.(string)
+	return ok
+}
+
+func fnNot(ctx *formulaContext, args []*formulaNode) interface{} {
+	if len(args) != 1 {
+		return formulaError(formulaErrValue)
+	}
+	b, e := toBool(ctx.scalar(args[0]))
+	if e != "" {
+		return formulaError(e)
+	}
+	return !b
+}
+
+func fnIsBlank(ctx *formulaContext, args []*formulaNode) interface{} {
+	if len(args) != 1 {
+		return formulaError(formulaErrValue)
+	}
+	return ctx.scalar(args[0]) == nil
+}
+
+func fnIsNumber(ctx *formulaContext, args []*formulaNode) interface{} {
+	if len(args) != 1 {
+		return formulaError(formulaErrValue)
+	}
+	_, ok := ctx.scalar(args[0]).(float64)
+	return ok
+}
+
+func fnIsText(ctx *formulaContext, args []*formulaNode) interface{} {
+	if len(args) != 1 {
+		return formulaError(formulaErrValue)
+	}
+	return isTextValue(ctx.scalar(args[0]))
+}
+
+func fnIsError(ctx *formulaContext, args []*formulaNode) interface{} {
+	if len(args) != 1 {
+		return formulaError(formulaErrValue)
+	}
+	_, ok := ctx.eval(args[0]).(formulaError)
+	return ok
+}
+
+// numberArgs evaluates every argument as a scalar number.
+func (ctx *formulaContext) numberArgs(args []*formulaNode) ([]float64, string) {
+	out := make([]float64, len(args))
+	for i, a := range args {
+		f, e := toNumber(ctx.scalar(a))
+		if e != "" {
+			return nil, e
+		}
+		out[i] = f
+	}
+	return out, ""
+}
+
+func fnRound(round func(float64) float64) formulaFunc {
+	return func(ctx *formulaContext, args []*formulaNode) interface{} {
+		if len(args) < 1 || len(args) > 2 {
+			return formulaError(formulaErrValue)
+		}
+		nums, e := ctx.numberArgs(args)
+		if e != "" {
+			return formulaError(e)
+		}
+		digits := 0.0
+		if len(nums) == 2 {
+			digits = math.Trunc(nums[1])
+		}
+		scale := math.Pow(10, digits)
+		return round(nums[0]*scale) / scale
+	}
+}
+
+func fnMath1(op func(float64) float64) formulaFunc {
+	return func(ctx *formulaContext, args []*formulaNode) interface{} {
+		if len(args) != 1 {
+			return formulaError(formulaErrValue)
+		}
+		nums, e := ctx.numberArgs(args)
+		if e != "" {
+			return formulaError(e)
+		}
+		return op(nums[0])
+	}
+}
+
+func fnSqrt(ctx *formulaContext, args []*formulaNode) interface{} {
+	if len(args) != 1 {
+		return formulaError(formulaErrValue)
+	}
+	nums, e := ctx.numberArgs(args)
+	if e != "" {
+		return formulaError(e)
+	}
+	if nums[0] < 0 {
+		return formulaError(formulaErrNum)
+	}
+	return math.Sqrt(nums[0])
+}
+
+func fnPower(ctx *formulaContext, args []*formulaNode) interface{} {
+	if len(args) != 2 {
+		return formulaError(formulaErrValue)
+	}
+	nums, e := ctx.numberArgs(args)
+	if e != "" {
+		return formulaError(e)
+	}
+	return ctx.evalBinary("^", nums[0], nums[1])
+}
+
+func fnMod(ctx *formulaContext, args []*formulaNode) interface{} {
+	if len(args) != 2 {
+		return formulaError(formulaErrValue)
+	}
+	nums, e := ctx.numberArgs(args)
+	if e != "" {
+		return formulaError(e)
+	}
+	if nums[1] == 0 {
+		return formulaError(formulaErrDiv0)
+	}
+	// Result takes the sign of the divisor, as in other spreadsheets.
+	return nums[0] - nums[1]*math.Floor(nums[0]/nums[1])
+}
+
+func fnConcat(ctx *formulaContext, args []*formulaNode) interface{} {
+	var sb strings.Builder
+	e := ctx.collectValues(args, func(v interface{}, fromRange bool) string {
+		if err, ok := v.(formulaError); ok {
+			return string(err)
+		}
+		sb.WriteString(toText(v))
+		return ""
+	})
+	if e != "" {
+		return formulaError(e)
+	}
+	return sb.String()
+}
+
+func fnText1(op func(string) interface{}) formulaFunc {
+	return func(ctx *formulaContext, args []*formulaNode) interface{} {
+		if len(args) != 1 {
+			return formulaError(formulaErrValue)
+		}
+		v := ctx.scalar(args[0])
+		if e, ok := v.(formulaError); ok {
+			return e
+		}
+		return op(toText(v))
+	}
+}
+
+// textAndCount reads the (text, [count]) arguments of LEFT and RIGHT.
+func (ctx *formulaContext) textAndCount(args []*formulaNode) ([]rune, int, string) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, 0, formulaErrValue
+	}
+	v := ctx.scalar(args[0])
+	if e, ok := v.(formulaError); ok {
+		return nil, 0, string(e)
+	}
+	n := 1
+	if len(args) == 2 {
+		f, e := toNumber(ctx.scalar(args[1]))
+		if e != "" {
+			return nil, 0, e
+		}
+		if f < 0 {
+			return nil, 0, formulaErrValue
+		}
+		n = int(f)
+	}
+	runes := []rune(toText(v))
+	if n > len(runes) {
+		n = len(runes)
+	}
+	return runes, n, ""
+}
+
+func fnLeft(ctx *formulaContext, args []*formulaNode) interface{} {
+	runes, n, e := ctx.textAndCount(args)
+	if e != "" {
+		return formulaError(e)
+	}
+	return string(runes[:n])
+}
+
+func fnRight(ctx *formulaContext, args []*formulaNode) interface{} {
+	runes, n, e := ctx.textAndCount(args)
+	if e != "" {
+		return formulaError(e)
+	}
+	return string(runes[len(runes)-n:])
+}
+
+func fnMid(ctx *formulaContext, args []*formulaNode) interface{} {
+	if len(args) != 3 {
+		return formulaError(formulaErrValue)
+	}
+	v := ctx.scalar(args[0])
+	if e, ok := v.(formulaError); ok {
+		return e
+	}
+	nums, e := ctx.numberArgs(args[1:])
+	if e != "" {
+		return formulaError(e)
+	}
+	start, length := int(nums[0]), int(nums[1])
+	if start < 1 || length < 0 {
+		return formulaError(formulaErrValue)
+	}
+	runes := []rune(toText(v))
+	if start > len(runes) {
+		return ""
+	}
+	end := start - 1 + length
+	if end > len(runes) {
+		end = len(runes)
+	}
+	return string(runes[start-1 : end])
+}
+
+// asRange returns v as a range; a scalar becomes a 1x1 range.
+func asRange(v interface{}) formulaRange {
+	switch x := v.(type) {
+	case formulaRange:
+		return x
+	case formulaError:
+		return nil
+	}
+	return formulaRange{{v}}
+}
+
+// lookupIndex finds lookup in values. Exact mode matches case-insensitively
+// (with * and ? wildcards for text); approximate mode assumes ascending
+// order and returns the last value not greater than lookup.
+func lookupIndex(lookup interface{}, values []interface{}, exact bool) int {
+	if exact {
+		match := func(v interface{}) bool { return compareFormulaValues(v, lookup) == 0 }
+		if s, ok := lookup.(string); ok && strings.ContainsAny(s, "*?") {
+			match = formulaCriteria(s)
+		}
+		for i, v := range values {
+			if v != nil && match(v) {
+				return i
+			}
+		}
+		return -1
+	}
+	found := -1
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		if compareFormulaValues(v, lookup) > 0 {
+			break
+		}
+		found = i
+	}
+	return found
+}
+
+func (ctx *formulaContext) lookup(args []*formulaNode, vertical bool) interface{} {
+	if len(args) < 3 || len(args) > 4 {
+		return formulaError(formulaErrValue)
+	}
+	key := ctx.scalar(args[0])
+	if e, ok := key.(formulaError); ok {
+		return e
+	}
+	table := asRange(ctx.eval(args[1]))
+	if table == nil || len(table) == 0 {
+		return formulaError(formulaErrValue)
+	}
+	idx, e := toNumber(ctx.scalar(args[2]))
+	if e != "" {
+		return formulaError(e)
+	}
+	exact := false
+	if len(args) == 4 {
+		approx, e := toBool(ctx.scalar(args[3]))
+		if e != "" {
+			return formulaError(e)
+		}
+		exact = !approx
+	}
+	n := int(idx)
+	if n < 1 {
+		return formulaError(formulaErrValue)
+	}
+	var keys []interface{}
+	if vertical {
+		if n > len(table[0]) {
+			return formulaError(formulaErrRef)
+		}
+		for _, line := range table {
+			keys = append(keys, line[0])
+		}
+	} else {
+		if n > len(table) {
+			return formulaError(formulaErrRef)
+		}
+		keys = table[0]
+	}
+	pos := lookupIndex(key, keys, exact)
+	if pos < 0 {
+		return formulaError(formulaErrNA)
+	}
+	if vertical {
+		return table[pos][n-1]
+	}
+	return table[n-1][pos]
+}
+
+func fnVLookup(ctx *formulaContext, args []*formulaNode) interface{} {
+	return ctx.lookup(args, true)
+}
+
+func fnHLookup(ctx *formulaContext, args []*formulaNode) interface{} {
+	return ctx.lookup(args, false)
+}
+
+func fnIndex(ctx *formulaContext, args []*formulaNode) interface{} {
+	if len(args) < 2 || len(args) > 3 {
+		return formulaError(formulaErrValue)
+	}
+	table := asRange(ctx.eval(args[0]))
+	if table == nil || len(table) == 0 {
+		return formulaError(formulaErrValue)
+	}
+	nums, e := ctx.numberArgs(args[1:])
+	if e != "" {
+		return formulaError(e)
+	}
+	r, c := int(nums[0]), 1
+	if len(nums) == 2 {
+		c = int(nums[1])
+	} else if len(table) == 1 {
+		// A single-row range is indexed by column.
+		r, c = 1, int(nums[0])
+	}
+	if r < 1 || c < 1 || r > len(table) || c > len(table[r-1]) {
+		return formulaError(formulaErrRef)
+	}
+	return table[r-1][c-1]
+}
+
+func fnMatch(ctx *formulaContext, args []*formulaNode) interface{} {
+	if len(args) < 2 || len(args) > 3 {
+		return formulaError(formulaErrValue)
+	}
+	key := ctx.scalar(args[0])
+	if e, ok := key.(formulaError); ok {
+		return e
+	}
+	table := asRange(ctx.eval(args[1]))
+	if table == nil {
+		return formulaError(formulaErrValue)
+	}
+	var values []interface{}
+	switch {
+	case len(table) == 1:
+		values = table[0]
+	case len(table[0]) == 1:
+		for _, line := range table {
+			values = append(values, line[0])
+		}
+	default:
+		return formulaError(formulaErrNA)
+	}
+	matchType := 1.0
+	if len(args) == 3 {
+		f, e := toNumber(ctx.scalar(args[2]))
+		if e != "" {
+			return formulaError(e)
+		}
+		matchType = f
+	}
+	pos := -1
+	switch {
+	case matchType == 0:
+		pos = lookupIndex(key, values, true)
+	case matchType > 0:
+		pos = lookupIndex(key, values, false)
+	default:
+		// Descending order: last value not smaller than the key.
+		for i, v := range values {
+			if v == nil {
+				continue
+			}
+			if compareFormulaValues(v, key) < 0 {
+				break
+			}
+			pos = i
+		}
+	}
+	if pos < 0 {
+		return formulaError(formulaErrNA)
+	}
+	return float64(pos + 1)
+}
+
+func fnToday(ctx *formulaContext, args []*formulaNode) interface{} {
+	return time.Now().Format("2006-01-02")
+}
+
+func fnNow(ctx *formulaContext, args []*formulaNode) interface{} {
+	return time.Now().Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,119 @@
+package main
+
+import "testing"
+
+// formulaTestSheet returns a sheet holding the given "A1" -> value cells.
+func formulaTestSheet(cells map[string]string) *Sheet {
+	s := &Sheet{Name: "S", ProjectName: "P", Data: make(map[string]map[string]Cell)}
+	for label, value := range cells {
+		col, row := parseCellLabel(label)
+		if s.Data[row] == nil {
+			s.Data[row] = make(map[string]Cell)
+		}
+		s.Data[row][col] = Cell{Value: value}
+	}
+	return s
+}
+
+func TestNormalizeFormulaRefs(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"=A1+b2", "={{A1}}+{{B2}}"},
+		{"=SUM(a1:c3)", "=SUM({{A1:C3}})"},
+		{"=$A$1*2", "={{A1}}*2"},
+		{`="A1"&A1`, `="A1"&{{A1}}`},
+		{"={{B2}}+C3", "={{B2}}+{{C3}}"},
+		{"=LOG10(4)", "=LOG10(4)"},
+		{"=TotalBudget*2", "=TotalBudget*2"},
+	}
+	for _, tt := range tests {
+		if got := normalizeFormulaRefs(tt.in); got != tt.want {
+			t.Errorf("normalizeFormulaRefs(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEvaluateFormula(t *testing.T) {
+	s := formulaTestSheet(map[string]string{
+		"A1": "1", "A2": "2", "A3": "3",
+		"B1": "apple", "B2": "#DIV/0!",
+	})
+	s.Data["3"]["A"] = Cell{Value: "3", CellName: "Three"}
+	tests := []struct{ formula, want string }{
+		{"=1+2*3^2", "19"},
+		{"=-2^2", "4"},
+		{"=(1+2)*3", "9"},
+		{"=10%", "0.1"},
+		{`="a"&"b"&1`, "ab1"},
+		{"=1<2", "TRUE"},
+		{"=SUM({{A1:A3}})", "6"},
+		{"=AVERAGE({{A1:A3}})", "2"},
+		{"=COUNT({{A1:B3}})", "3"},
+		{"={{Three}}*2", "6"},
+		{`=IF({{A1}}>0,"pos","neg")`, "pos"},
+		{"=1/0", formulaErrDiv0},
+		{"={{B2}}+1", formulaErrDiv0},
+		{"=IFERROR({{B2}},0)", "0"},
+		{"={{B1}}+1", formulaErrValue},
+		{"=NOSUCHFUNC(1)", formulaErrName},
+		{"={{Missing}}", formulaErrName},
+		{"=1+", formulaErrName},
+		{"=(1", formulaErrName},
+	}
+	for _, tt := range tests {
+		if got := EvaluateFormula(tt.formula, s, "9", "Z"); got != tt.want {
+			t.Errorf("EvaluateFormula(%q) = %q, want %q", tt.formula, got, tt.want)
+		}
+	}
+}
+
+func TestEvaluateFormulaRefErrors(t *testing.T) {
+	s := formulaTestSheet(map[string]string{"A1": "1", "A2": "2"})
+	tests := []struct {
+		name, formula, want string
+	}{
+		{"self reference", "={{C1}}+1", formulaErrRef},
+		{"range covering itself", "=SUM({{A1:C3}})", formulaErrRef},
+		{"missing sheet", "={{P/Nowhere/A1}}", formulaErrRef},
+		{"range too large", "=SUM({{A1:XFD1048576}})", formulaErrRef},
+		{"largest allowed range", "=SUM({{D1:D100000}})", "0"},
+	}
+	for _, tt := range tests {
+		if got := EvaluateFormula(tt.formula, s, "1", "C"); got != tt.want {
+			t.Errorf("%s: EvaluateFormula(%q) = %q, want %q", tt.name, tt.formula, got, tt.want)
+		}
+	}
+}
+
+func TestEvaluateFormulaCrossSheetAccess(t *testing.T) {
+	s := formulaTestSheet(nil)
+	s.Owner = "alice"
+	s.Data["1"] = map[string]Cell{"C": {CellType: FormulaCell, User: "carol"}}
+	secret := &Sheet{ProjectName: "Q", Name: "Secret", Owner: "bob", Data: map[string]map[string]Cell{"1": {"A": {Value: "42"}}},
+		Permissions: Permissions{NoAccess: []string{"carol"}}}
+	shared := &Sheet{ProjectName: "Q", Name: "Shared", Owner: "bob", Data: map[string]map[string]Cell{"1": {"A": {Value: "7"}}}}
+	globalSheetManager.mu.Lock()
+	for _, o := range []*Sheet{secret, shared} {
+		globalSheetManager.sheets[sheetKey(o.ProjectName, o.Name)] = o
+	}
+	globalSheetManager.mu.Unlock()
+	t.Cleanup(func() {
+		globalSheetManager.mu.Lock()
+		delete(globalSheetManager.sheets, sheetKey("Q", "Secret"))
+		delete(globalSheetManager.sheets, sheetKey("Q", "Shared"))
+		globalSheetManager.mu.Unlock()
+	})
+
+	// The formula's author may read Shared but not Secret, whoever owns the
+	// sheet the formula is on.
+	tests := []struct{ formula, want string }{
+		{"={{Q/Shared/A1}}*2", "14"},
+		{"={{Q/Secret/A1}}", formulaErrRef},
+		{"=SUM({{Q/Secret/A1:A3}})", formulaErrRef},
+		{"={{Q/Secret/Total}}", formulaErrRef},
+	}
+	for _, tt := range tests {
+		if got := EvaluateFormula(tt.formula, s, "1", "C"); got != tt.want {
+			t.Errorf("EvaluateFormula(%q) = %q, want %q", tt.formula, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ────────────────────────────────────────────────
+// User groups
+// ────────────────────────────────────────────────
+//
+// A group is a named set of users. Wherever a username is accepted in a
+// list — sheet permissions, project admins and member roles, the chat "to"
+// field — "@name" stands for every member of group name. Membership is
+// resolved on every check, so a change applies at once. Server admins and
+// the group's owners manage a group. Stored in DATA/groups.json.
+
+const groupPrefix = "@"
+
+type Group struct {
+	Name      string    `json:"name"`
+	Owners    []string  `json:"owners"`
+	Members   []string  `json:"members"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type GroupManager struct {
+	mu     sync.RWMutex
+	groups map[string]*Group // name -> group
+}
+
+var globalGroups = &GroupManager{groups: make(map[string]*Group)}
+
+func (gm *GroupManager) document() string {
+	return "groups.json"
+}
+
+// isGroupRef reports whether a name in a user list refers to a group.
+func isGroupRef(name string) bool {
+	return strings.HasPrefix(name, groupPrefix)
+}
+
+// validGroupName rejects names that could not be written as "@name" in a
+// user list or that contain path separators.
+func validGroupName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("name is required")
+	case len(name) > 64:
+		return errors.New("name is too long")
+	case strings.ContainsAny(name, "@/\\ \t,"):
+		return errors.New("name may not contain spaces, commas, slashes or @")
+	}
+	return nil
+}
+
+func (gm *GroupManager) Load() {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	gm.groups = make(map[string]*Group)
+	data, err := globalStore.ReadDocument(gm.document())
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("groups: read: %v", err)
+		}
+		return
+	}
+	var list []*Group
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Printf("groups: decode: %v", err)
+		globalIntegrity.Record(documentPath(gm.document()), false, false, "json decode error: "+err.Error())
+		return
+	}
+	for _, g := range list {
+		gm.groups[g.Name] = g
+	}
+}
+
+// saveLocked persists all groups. Must be called with the lock held.
+func (gm *GroupManager) saveLocked() {
+	list := make([]*Group, 0, len(gm.groups))
+	for _, g := range gm.groups {
+		list = append(list, g)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		log.Printf("groups: encode: %v", err)
+		return
+	}
+	if err := globalStore.WriteDocument(gm.document(), append(data, '\n')); err != nil {
+		log.Printf("groups: save: %v", err)
+	}
+}
+
+func (g *Group) clone() Group {
+	c := *g
+	c.Owners = append([]string{}, g.Owners...)
+	c.Members = append([]string{}, g.Members...)
+	return c
+}
+
+// List returns all groups sorted by name.
+func (gm *GroupManager) List() []Group {
+	gm.mu.RLock()
+	defer gm.mu.RUnlock()
+	out := make([]Group, 0, len(gm.groups))
+	for _, g := range gm.groups {
+		out = append(out, g.clone())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Get returns a copy of the group called name.
+func (gm *GroupManager) Get(name string) (Group, bool) {
+	gm.mu.RLock()
+	defer gm.mu.RUnlock()
+	g, ok := gm.groups[name]
+	if !ok {
+		return Group{}, false
+	}
+	return g.clone(), true
+}
+
+// Exists reports whether a group called name exists.
+func (gm *GroupManager) Exists(name string) bool {
+	gm.mu.RLock()
+	defer gm.mu.RUnlock()
+	_, ok := gm.groups[name]
+	return ok
+}
+
+// CanManage reports whether user may change or delete the group.
+func (gm *GroupManager) CanManage(name, user string) bool {
+	if globalUserManager.IsAdminUser(user) {
+		return true
+	}
+	gm.mu.RLock()
+	defer gm.mu.RUnlock()
+	g, ok := gm.groups[name]
+	if !ok {
+		return false
+	}
+	for _, o := range g.Owners {
+		if o == user {
+			return true
+		}
+	}
+	return false
+}
+
+// HasMember reports whether user is a member of the group called name.
+func (gm *GroupManager) HasMember(name, user string) bool {
+	gm.mu.RLock()
+	defer gm.mu.RUnlock()
+	g, ok := gm.groups[name]
+	if !ok {
+		return false
+	}
+	for _, m := range g.Members {
+		if m == user {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanUsers trims and dedupes a user list and checks that every user exists.
+func cleanUsers(users []string) ([]string, error) {
+	out := make([]string, 0, len(users))
+	seen := make(map[string]bool)
+	for _, u := range users {
+		u = strings.TrimSpace(u)
+		if u == "" || seen[u] {
+			continue
+		}
+		if !globalUserManager.Exists(u) {
+			return nil, errors.New("user does not exist: " + u)
+		}
+		seen[u] = true
+		out = append(out, u)
+	}
+	return out, nil
+}
+
+// Create adds a group owned by creator, who is also made a member.
+func (gm *GroupManager) Create(name, creator string, members []string) (Group, error) {
+	name = strings.TrimSpace(name)
+	if err := validGroupName(name); err != nil {
+		return Group{}, err
+	}
+	members, err := cleanUsers(append([]string{creator}, members...))
+	if err != nil {
+		return Group{}, err
+	}
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	if _, ok := gm.groups[name]; ok {
+		return Group{}, errors.New("a group with that name already exists")
+	}
+	g := &Group{Name: name, Owners: []string{creator}, Members: members, CreatedBy: creator, CreatedAt: time.Now()}
+	gm.groups[name] = g
+	gm.saveLocked()
+	return g.clone(), nil
+}
+
+// Update replaces the owners and members of a group; a nil list keeps the
+// current one. A group always keeps at least one owner.
+func (gm *GroupManager) Update(name string, owners, members []string) (Group, error) {
+	var err error
+	if owners != nil {
+		if owners, err = cleanUsers(owners); err != nil {
+			return Group{}, err
+		}
+		if len(owners) == 0 {
+			return Group{}, errors.New("a group needs at least one owner")
+		}
+	}
+	if members != nil {
+		if members, err = cleanUsers(members); err != nil {
+			return Group{}, err
+		}
+	}
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	g, ok := gm.groups[name]
+	if !ok {
+		return Group{}, errors.New("group not found")
+	}
+	if owners != nil {
+		g.Owners = owners
+	}
+	if members != nil {
+		g.Members = members
+	}
+	gm.saveLocked()
+	return g.clone(), nil
+}
+
+// Delete removes a group. Lists that name it then match nobody.
+func (gm *GroupManager) Delete(name string) error {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	if _, ok := gm.groups[name]; !ok {
+		return errors.New("group not found")
+	}
+	delete(gm.groups, name)
+	gm.saveLocked()
+	return nil
+}
+
+// matchesUser reports whether a name from a user list stands for user,
+// either as the user itself or as a group user belongs to.
+func matchesUser(name, user string) bool {
+	if name == user {
+		return true
+	}
+	return isGroupRef(name) && globalGroups.HasMember(strings.TrimPrefix(name, groupPrefix), user)
+}
+
+// listedUser reports whether names includes user, directly or through a group.
+func listedUser(names []string, user string) bool {
+	for _, n := range names {
+		if matchesUser(n, user) {
+			return true
+		}
+	}
+	return false
+}
+
+// knownUserOrGroup reports whether name is an existing user or "@group".
+func knownUserOrGroup(name string) bool {
+	if isGroupRef(name) {
+		return globalGroups.Exists(strings.TrimPrefix(name, groupPrefix))
+	}
+	return globalUserManager.Exists(name)
+}
+
+// notifyGroupsChanged has the hub recheck every open sheet and tell clients
+// to reload their groups. Not for use from the hub goroutine.
+func notifyGroupsChanged() {
+	if globalHub == nil {
+		return
+	}
+	globalHub.broadcast <- &Message{Type: "GROUPS_CHANGED", User: "system"}
+}
@@ -0,0 +1,697 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ────────────────────────────────────────────────
+// Point-in-time sheet history
+// ────────────────────────────────────────────────
+//
+// Every sheet that changed is snapshotted periodically by globalStore
+// (<folder>/.history/<sheet>/ with the json store, the sheet_history table
+// with sqlite). The state at any time is the newest snapshot taken before it
+// with the audit log records written since replayed over it: cell values,
+// scripts, formulas and AI prompts, and row and column shifts. Formatting and
+// other cell settings are as of the snapshot.
+//
+// Snapshots of the last week are all kept, older ones thinned to one a day.
+// Audit retention and pruning trim history to the same cutoff, replacing the
+// snapshots before it by one taken at it.
+
+// historyKeepAll is how long every snapshot is kept before thinning.
+const historyKeepAll = 7 * 24 * time.Hour
+
+var (
+	errNoHistory      = errors.New("no history is recorded that far back")
+	errBadHistoryTime = errors.New("not an RFC 3339 time")
+)
+
+// historyState is the content of a sheet at a point in time.
+type historyState struct {
+	Data          map[string]map[string]Cell `json:"data"`
+	ColWidths     map[string]int             `json:"col_widths,omitempty"`
+	RowHeights    map[string]int             `json:"row_heights,omitempty"`
+	RowParents    map[string]int             `json:"row_parents,omitempty"`
+	SectionScheme string                     `json:"section_scheme,omitempty"`
+}
+
+// SheetHistoryView is GET /api/sheet/history for one point in time.
+type SheetHistoryView struct {
+	Project    string    `json:"project"`
+	Sheet      string    `json:"sheet"`
+	At         time.Time `json:"at"`
+	SnapshotAt time.Time `json:"snapshot_at"`
+	Replayed   int       `json:"replayed"`
+	Version    string    `json:"version,omitempty"`
+	historyState
+}
+
+// HistoryCellDiff is one cell that differs between two points in time.
+type HistoryCellDiff struct {
+	Cell   string `json:"cell"`
+	Change string `json:"change"` // "added", "removed" or "changed"
+	From   *Cell  `json:"from,omitempty"`
+	To     *Cell  `json:"to,omitempty"`
+}
+
+func copyIntMap(m map[string]int) map[string]int {
+	out := make(map[string]int, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// historyStateLocked copies the content of s. Caller holds s.mu.
+func historyStateLocked(s *Sheet) *historyState {
+	data := make(map[string]map[string]Cell, len(s.Data))
+	for r, cols := range s.Data {
+		if len(cols) == 0 {
+			continue
+		}
+		inner := make(map[string]Cell, len(cols))
+		for c, cell := range cols {
+			inner[c] = cell
+		}
+		data[r] = inner
+	}
+	return &historyState{
+		Data:          data,
+		ColWidths:     copyIntMap(s.ColWidths),
+		RowHeights:    copyIntMap(s.RowHeights),
+		RowParents:    copyIntMap(s.RowParents),
+		SectionScheme: s.SectionScheme,
+	}
+}
+
+func encodeHistoryState(st *historyState) ([]byte, error) {
+	raw, err := json.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeHistoryState(data []byte) (*historyState, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	st := &historyState{}
+	if err := json.Unmarshal(raw, st); err != nil {
+		return nil, err
+	}
+	if st.Data == nil {
+		st.Data = make(map[string]map[string]Cell)
+	}
+	return st, nil
+}
+
+// ── Snapshots ────────────────────────────────────
+
+// historyHashes remembers the content hash of each sheet's newest snapshot
+// so unchanged sheets are not snapshotted again.
+var historyHashes = struct {
+	sync.Mutex
+	m map[string][sha256.Size]byte
+}{m: make(map[string][sha256.Size]byte)}
+
+// snapshotSheet stores the current content of s unless it matches the newest
+// snapshot. Reports whether a snapshot was written.
+func snapshotSheet(s *Sheet) (bool, error) {
+	s.mu.RLock()
+	project, name, readOnly := s.ProjectName, s.Name, s.ReadOnly
+	at := time.Now()
+	st := historyStateLocked(s)
+	s.mu.RUnlock()
+	if readOnly {
+		return false, nil
+	}
+	raw, err := json.Marshal(st)
+	if err != nil {
+		return false, err
+	}
+	hash := sha256.Sum256(raw)
+	key := sheetKey(project, name)
+
+	historyHashes.Lock()
+	defer historyHashes.Unlock()
+	last, ok := historyHashes.m[key]
+	if !ok {
+		if times, err := globalStore.Snapshots(project, name); err == nil && len(times) > 0 {
+			if prev, err := loadHistorySnapshot(project, name, times[len(times)-1]); err == nil {
+				prevRaw, _ := json.Marshal(prev)
+				last, ok = sha256.Sum256(prevRaw), true
+			}
+		}
+	}
+	if ok && last == hash {
+		historyHashes.m[key] = hash
+		return false, nil
+	}
+	data, err := encodeHistoryState(st)
+	if err != nil {
+		return false, err
+	}
+	if err := globalStore.SaveSnapshot(project, name, at, data); err != nil {
+		return false, err
+	}
+	historyHashes.m[key] = hash
+	return true, nil
+}
+
+func loadHistorySnapshot(project, name string, at time.Time) (*historyState, error) {
+	data, err := globalStore.LoadSnapshot(project, name, at)
+	if err != nil {
+		return nil, err
+	}
+	return decodeHistoryState(data)
+}
+
+// thinSnapshots keeps one snapshot a day of those older than historyKeepAll.
+func thinSnapshots(project, name string, times []time.Time) {
+	cutoff := time.Now().Add(-historyKeepAll)
+	lastDay := ""
+	for _, t := range times {
+		if !t.Before(cutoff) {
+			break
+		}
+		day := t.Local().Format("2006-01-02")
+		if day != lastDay {
+			lastDay = day
+			continue
+		}
+		if err := globalStore.DeleteSnapshot(project, name, t); err != nil {
+			log.Printf("history: thin %s: %v", sheetArchivePath(project, name), err)
+		}
+	}
+}
+
+// snapshotChangedSheets snapshots every sheet that changed since its newest
+// snapshot and thins the old ones.
+func snapshotChangedSheets() {
+	written := 0
+	for _, s := range globalSheetManager.ListSheets() {
+		ok, err := snapshotSheet(s)
+		s.mu.RLock()
+		project, name := s.ProjectName, s.Name
+		s.mu.RUnlock()
+		if err != nil {
+			log.Printf("history: snapshot %s: %v", sheetArchivePath(project, name), err)
+			continue
+		}
+		if ok {
+			written++
+		}
+		if times, err := globalStore.Snapshots(project, name); err == nil {
+			thinSnapshots(project, name, times)
+		}
+	}
+	if written > 0 {
+		log.Printf("history: snapshotted %d sheets", written)
+	}
+}
+
+// startHistorySnapshots snapshots changed sheets now and then every
+// interval. A non-positive interval turns snapshots off.
+func startHistorySnapshots(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			snapshotChangedSheets()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// trimHistory drops the snapshots of a sheet taken before cutoff, which the
+// audit records they would need are about to be removed for, and stores the
+// state at cutoff in their place.
+func trimHistory(project, name string, cutoff time.Time) error {
+	times, err := globalStore.Snapshots(project, name)
+	if err != nil {
+		return err
+	}
+	if len(times) == 0 || !times[0].Before(cutoff) {
+		return nil
+	}
+	if i := sort.Search(len(times), func(i int) bool { return !times[i].Before(cutoff) }); i == len(times) || !times[i].Equal(cutoff) {
+		st, _, _, err := historyAt(project, name, cutoff)
+		if err != nil {
+			return err
+		}
+		data, err := encodeHistoryState(st)
+		if err != nil {
+			return err
+		}
+		if err := globalStore.SaveSnapshot(project, name, cutoff, data); err != nil {
+			return err
+		}
+	}
+	for _, t := range times {
+		if !t.Before(cutoff) {
+			break
+		}
+		if err := globalStore.DeleteSnapshot(project, name, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ── Replay ───────────────────────────────────────
+
+// applyShift moves the rows or columns of st like the structural edit sh.
+func (st *historyState) applyShift(sh *AuditShift) {
+	count := sh.Count
+	if count < 1 {
+		count = 1
+	}
+	gone := func(v int) bool { return sh.Op == "delete" && v >= sh.At && v < sh.At+count }
+	remap := func(m map[string]int, index func(string) int, label func(int) string) map[string]int {
+		out := make(map[string]int, len(m))
+		for k, v := range m {
+			idx := index(k)
+			if idx <= 0 {
+				out[k] = v
+			} else if !gone(idx) {
+				out[label(sh.apply(idx))] = v
+			}
+		}
+		return out
+	}
+
+	if sh.Axis == "col" {
+		for row, cols := range st.Data {
+			moved := make(map[string]Cell, len(cols))
+			for col, c := range cols {
+				idx := colLabelToIndex(col)
+				if idx <= 0 {
+					moved[col] = c
+				} else if !gone(idx) {
+					moved[indexToColLabel(sh.apply(idx))] = c
+				}
+			}
+			st.Data[row] = moved
+		}
+		st.ColWidths = remap(st.ColWidths, colLabelToIndex, indexToColLabel)
+		return
+	}
+
+	data := make(map[string]map[string]Cell, len(st.Data))
+	for row, cols := range st.Data {
+		idx := atoiSafe(row)
+		if idx <= 0 {
+			data[row] = cols
+		} else if !gone(idx) {
+			data[itoa(sh.apply(idx))] = cols
+		}
+	}
+	st.Data = data
+	st.RowHeights = remap(st.RowHeights, atoiSafe, itoa)
+	st.RowParents = remap(st.RowParents, atoiSafe, itoa)
+	for row, parent := range st.RowParents {
+		st.RowParents[row] = sh.apply(parent)
+	}
+}
+
+// applyRecord replays one audit record over st. Reports whether it changed
+// anything the replay tracks.
+func (st *historyState) applyRecord(rec *AuditRecord) bool {
+	if rec.Shift != nil {
+		st.applyShift(rec.Shift)
+		return true
+	}
+	if rec.Row1 <= 0 || rec.Col1 == "" {
+		return false
+	}
+	row := itoa(rec.Row1)
+	c := st.Data[row][rec.Col1]
+	switch rec.Action {
+	case "EDIT_CELL":
+		if c.CellType == FormulaCell {
+			c.CellType, c.Script, c.ScriptOutput = ValueCell, "", ""
+		}
+		c.Value = rec.NewValue
+	case "EDIT_SCRIPT":
+		c.Script = rec.NewValue
+		if rec.NewValue != "" {
+			c.CellType = ScriptCell
+		} else if c.CellType == ScriptCell {
+			c.CellType = ValueCell
+		}
+	case "EDIT_FORMULA":
+		// A reverted formula may go back to a plain value
+		if isFormulaText(rec.NewValue) {
+			c.CellType, c.Script = FormulaCell, rec.NewValue
+		} else {
+			c.CellType, c.Script, c.Value = ValueCell, "", rec.NewValue
+		}
+	case "EDIT_AI_PROMPT":
+		c.CellType, c.AIPrompt = AIGeneratedCell, rec.NewValue
+	default:
+		return false
+	}
+	if st.Data[row] == nil {
+		st.Data[row] = make(map[string]Cell)
+	}
+	st.Data[row][rec.Col1] = c
+	return true
+}
+
+// historyAt returns the content of a sheet at the given time and the time of
+// the snapshot it was replayed from.
+func historyAt(project, name string, at time.Time) (st *historyState, snapshotAt time.Time, replayed int, err error) {
+	times, err := globalStore.Snapshots(project, name)
+	if err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	i := sort.Search(len(times), func(i int) bool { return times[i].After(at) })
+	if i == 0 {
+		return nil, time.Time{}, 0, errNoHistory
+	}
+	snapshotAt = times[i-1]
+	if st, err = loadHistorySnapshot(project, name, snapshotAt); err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	recs, err := globalAuditLog.Records(project, name)
+	if err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	for i := range recs {
+		if recs[i].Timestamp.After(snapshotAt) && !recs[i].Timestamp.After(at) && st.applyRecord(&recs[i]) {
+			replayed++
+		}
+	}
+	return st, snapshotAt, replayed, nil
+}
+
+// HistoryView returns a sheet as it was at a point in its history: a named
+// version, else a timeline event, else an RFC 3339 time.
+func HistoryView(sheet *Sheet, version, eventID, at string) (*SheetHistoryView, error) {
+	sheet.mu.RLock()
+	project, name := sheet.ProjectName, sheet.Name
+	sheet.mu.RUnlock()
+	if version != "" {
+		v, ok := sheet.findVersion(version)
+		if !ok {
+			return nil, errVersionNotFound
+		}
+		st, err := loadVersionContent(project, name, v.ID)
+		if err != nil {
+			return nil, err
+		}
+		return &SheetHistoryView{
+			Project:      project,
+			Sheet:        name,
+			At:           v.Created,
+			SnapshotAt:   v.Created,
+			Version:      v.Name,
+			historyState: *st,
+		}, nil
+	}
+	t, err := historyTime(project, at, eventID)
+	if err != nil {
+		return nil, err
+	}
+	st, snapshotAt, replayed, err := historyAt(project, name, t)
+	if err != nil {
+		return nil, err
+	}
+	return &SheetHistoryView{
+		Project:      project,
+		Sheet:        name,
+		At:           t,
+		SnapshotAt:   snapshotAt,
+		Replayed:     replayed,
+		historyState: *st,
+	}, nil
+}
+
+// historyErrorStatus is the HTTP status and message for an error from
+// HistoryView.
+func historyErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, errVersionNotFound), errors.Is(err, errNoHistory):
+		return http.StatusNotFound, err.Error()
+	case errors.Is(err, errTimelineEventNotFound), errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound, "Timeline event not found"
+	case errors.Is(err, errBadHistoryTime):
+		return http.StatusBadRequest, err.Error()
+	}
+	return http.StatusInternalServerError, "Failed to rebuild sheet history: " + err.Error()
+}
+
+// historyContent is a cell without who last edited it, which replay does not
+// track, and without its lock and internal id, which a restore keeps.
+func historyContent(c Cell) Cell {
+	c.User, c.Locked, c.LockedBy, c.CellID = "", false, "", ""
+	return c
+}
+
+// diffHistory lists the cells that differ between from and to, by row and
+// column.
+func diffHistory(from, to map[string]map[string]Cell) []HistoryCellDiff {
+	cells := make([]HistoryCellDiff, 0)
+	add := func(row, col string) {
+		f, inFrom := from[row][col]
+		t, inTo := to[row][col]
+		f, t = historyContent(f), historyContent(t)
+		d := HistoryCellDiff{Cell: col + row}
+		switch {
+		case inFrom && inTo:
+			if reflect.DeepEqual(f, t) {
+				return
+			}
+			d.Change, d.From, d.To = "changed", &f, &t
+		case inTo:
+			d.Change, d.To = "added", &t
+		default:
+			d.Change, d.From = "removed", &f
+		}
+		cells = append(cells, d)
+	}
+	for row, cols := range to {
+		for col := range cols {
+			add(row, col)
+		}
+	}
+	for row, cols := range from {
+		for col := range cols {
+			if _, ok := to[row][col]; !ok {
+				add(row, col)
+			}
+		}
+	}
+	sortCellDiffs(cells)
+	return cells
+}
+
+// cellLabelLess orders cell labels by row, then column.
+func cellLabelLess(a, b string) bool {
+	ca, ra := parseCellLabel(a)
+	cb, rb := parseCellLabel(b)
+	if atoiSafe(ra) != atoiSafe(rb) {
+		return atoiSafe(ra) < atoiSafe(rb)
+	}
+	return colLabelToIndex(ca) < colLabelToIndex(cb)
+}
+
+func sortCellDiffs(cells []HistoryCellDiff) {
+	sort.Slice(cells, func(i, j int) bool { return cellLabelLess(cells[i].Cell, cells[j].Cell) })
+}
+
+// ── Restore ──────────────────────────────────────
+
+// formulaText is what EDIT_FORMULA entries record for a cell.
+func formulaText(c Cell) string {
+	if c.CellType == FormulaCell {
+		return c.Script
+	}
+	return c.Value
+}
+
+// cellEditAuditEntries lists the entries recording a change of cur to c.
+// Restores mark them reversed so they are not merged into or reverted.
+func cellEditAuditEntries(row int, col string, cur, c Cell, user string, reversed bool) []AuditEntry {
+	now := time.Now()
+	entry := func(action, oldValue, newValue string) AuditEntry {
+		return AuditEntry{Timestamp: now, User: user, Action: action, Row1: row, Col1: col,
+			OldValue: oldValue, NewValue: newValue, ChangeReversed: reversed}
+	}
+	var entries []AuditEntry
+	if cur.CellType == FormulaCell || c.CellType == FormulaCell {
+		if formulaText(cur) != formulaText(c) {
+			entries = append(entries, entry("EDIT_FORMULA", formulaText(cur), formulaText(c)))
+		}
+	} else {
+		if cur.Script != c.Script {
+			entries = append(entries, entry("EDIT_SCRIPT", cur.Script, c.Script))
+		}
+		if cur.Value != c.Value {
+			entries = append(entries, entry("EDIT_CELL", cur.Value, c.Value))
+		}
+	}
+	if cur.AIPrompt != c.AIPrompt {
+		entries = append(entries, entry("EDIT_AI_PROMPT", cur.AIPrompt, c.AIPrompt))
+	}
+	return entries
+}
+
+// RestoreHistory sets the cells of s inside the bounds back to their content
+// in st, as user. With c1 0 every cell and the row and column layout are
+// restored. Locked cells and protected ranges user may not edit are skipped,
+// and cells whose script or AI prompt would change unless user owns the sheet.
+func (s *Sheet) RestoreHistory(st *historyState, c1, r1, c2, r2 int, user string) []CellEditResult {
+	s.mu.Lock()
+	if s.ReadOnly {
+		s.mu.Unlock()
+		return nil
+	}
+	results := make([]CellEditResult, 0)
+	for _, d := range diffHistory(s.Data, st.Data) {
+		col, row := parseCellLabel(d.Cell)
+		ri, ci := atoiSafe(row), colLabelToIndex(col)
+		if c1 > 0 && (ri < r1 || ri > r2 || ci < c1 || ci > c2) {
+			continue
+		}
+		cur, exists := s.Data[row][col]
+		var target Cell
+		if d.To != nil {
+			target = *d.To
+		}
+		result := CellEditResult{Cell: d.Cell, Status: "applied"}
+		switch {
+		case exists && cur.Locked:
+			result.Status, result.Reason = "skipped", "locked"
+		case s.protectedCellLocked(row, col, user) != nil:
+			result.Status, result.Reason = "skipped", "protected"
+		case (cur.Script != target.Script || cur.AIPrompt != target.AIPrompt) && user != s.Owner:
+			result.Status, result.Reason = "skipped", "owner-only"
+		}
+		if result.Status != "applied" {
+			results = append(results, result)
+			continue
+		}
+
+		for _, e := range cellEditAuditEntries(ri, col, cur, target, user, true) {
+			s.logAudit(e)
+		}
+		if d.To == nil {
+			delete(s.Data[row], col)
+			if len(s.Data[row]) == 0 {
+				delete(s.Data, row)
+			}
+		} else {
+			if exists && cur.CellID != "" {
+				target.CellID = cur.CellID
+			}
+			target.User, target.Locked, target.LockedBy = user, false, ""
+			if s.Data[row] == nil {
+				s.Data[row] = make(map[string]Cell)
+			}
+			s.Data[row][col] = target
+		}
+		globalSheetManager.CellsModifiedManuallyQueueMu.Lock()
+		globalSheetManager.CellsModifiedManuallyQueue = append(globalSheetManager.CellsModifiedManuallyQueue, CellIdentifier{
+			ProjectName: s.ProjectName,
+			sheetName:   s.Name,
+			row:         row,
+			col:         col,
+		})
+		globalSheetManager.CellsModifiedManuallyQueueMu.Unlock()
+		results = append(results, result)
+	}
+	if c1 == 0 {
+		s.ColWidths = copyIntMap(st.ColWidths)
+		s.RowHeights = copyIntMap(st.RowHeights)
+		s.RowParents = copyIntMap(st.RowParents)
+		s.SectionScheme = st.SectionScheme
+		// Rows may have come back or gone; edits made before cannot follow
+		globalRevisions.Reset(s.ProjectName, s.Name)
+	}
+	s.mu.Unlock()
+	return results
+}
+
+// RestoreSheetHistory restores rangeStr of sheet ("A1:C5", "B4", a cell
+// name, or "" for the whole sheet) to its content in view.
+func RestoreSheetHistory(sheet *Sheet, view *SheetHistoryView, rangeStr, user string) ([]CellEditResult, error) {
+	var c1, r1, c2, r2 int
+	if strings.TrimSpace(rangeStr) != "" {
+		var err error
+		if c1, r1, c2, r2, err = sheet.resolveValuesRange(rangeStr); err != nil {
+			return nil, err
+		}
+	}
+	sheet.mu.RLock()
+	project, name := sheet.ProjectName, sheet.Name
+	sheet.mu.RUnlock()
+	// Keep the state being replaced as a snapshot of its own
+	if _, err := snapshotSheet(sheet); err != nil {
+		log.Printf("history: snapshot %s: %v", sheetArchivePath(project, name), err)
+	}
+
+	results := sheet.RestoreHistory(&view.historyState, c1, r1, c2, r2, user)
+	point := view.At.Format(time.RFC3339)
+	if view.Version != "" {
+		point = "version " + view.Version
+	}
+	sheet.mu.Lock()
+	sheet.logAudit(AuditEntry{
+		Timestamp: time.Now(),
+		User:      user,
+		Action:    "RESTORE_HISTORY",
+		OldValue:  strings.ToUpper(strings.TrimSpace(rangeStr)),
+		NewValue:  point,
+	})
+	sheet.mu.Unlock()
+
+	globalSheetManager.rebuildScriptDependencies()
+	globalSheetManager.rebuildOptionsRangeDependencies()
+	globalSheetManager.SaveSheet(sheet)
+	globalSheetManager.QueueRowColUpdate(project, name)
+	return results, nil
+}
+
+// historyTime resolves an RFC 3339 time or, when eventID is set, the time of
+// that event on the timeline of the sheet's project.
+func historyTime(project, at, eventID string) (time.Time, error) {
+	if eventID != "" {
+		return timelineEventTime(strings.SplitN(project, "/", 2)[0], eventID)
+	}
+	t, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q: %w", at, errBadHistoryTime)
+	}
+	return t, nil
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 )
 
@@ -14,6 +15,12 @@ type Message struct {
 	Project   string          `json:"project,omitempty"`
 	Payload   json.RawMessage `json:"payload"`
 	User      string          `json:"user,omitempty"` // Username of the sender
+	// Revision of the sheet a broadcast shows, set by the hub
+	Revision int64 `json:"revision,omitempty"`
+	// BaseRevision is the revision the sender's edit was based on
+	BaseRevision int64 `json:"base_revision,omitempty"`
+
+	from *Client // the client that sent the message; nil for the server's own
 }
 
 // Hub maintains the set of active clients and broadcasts messages to the clients.
@@ -30,6 +37,17 @@ type Hub struct {
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// restoring is set while a backup restore runs (backup.go).
+	restoring bool
+}
+
+// restoreAllowedTypes are the client messages the hub still handles while
+// a backup is being restored; they change nothing.
+var restoreAllowedTypes = map[string]bool{
+	"PING":             true,
+	"LOAD_ROWS":        true,
+	"SELECTION_COPIED": true,
 }
 
 func newHub() *Hub {
@@ -46,6 +64,17 @@ func (h *Hub) run() {
 		select {
 		case client := <-h.register:
 			roomID := sheetKey(client.projectName, client.sheetName)
+			if sheet := globalSheetManager.GetSheetBy(client.sheetName, client.projectName); sheet != nil && !sheet.CanRead(client.userID) {
+				client.closeCode = closeNoAccess
+				close(client.send)
+				continue
+			}
+			if client.sessionID != "" && !globalUserManager.SessionActive(client.sessionID) {
+				// Revoked between the token check and now
+				client.closeCode = closeUnauthorized
+				close(client.send)
+				continue
+			}
 			if h.rooms[roomID] == nil {
 				h.rooms[roomID] = make(map[*Client]bool)
 			}
@@ -59,18 +88,31 @@ func (h *Hub) run() {
 				// Clean up zombie script locks before sending sheet to client
 				removeLocksWithMissingCellID(sheet)
 
-				payload, _ := json.Marshal(sheet.SnapshotForClient())
-
-				msg := &Message{
-					Type:    "INIT",
-					Payload: payload,
-					User:    "system",
+				// Bring the clients already on the sheet up to date first, so
+				// the new one starts from the revision they are at
+				update, snap := sheetUpdate(sheet, client.sheetName, "system")
+				if update != nil {
+					h.sendToRoom(roomID, update, client)
+				}
+				rev := globalRevisions.Current(client.projectName, client.sheetName)
+				if patches, ok := globalRevisions.Since(client.projectName, client.sheetName, client.since); client.since > 0 && ok {
+					// A reconnecting client only needs what changed since it left
+					for _, p := range patches {
+						payload, _ := json.Marshal(p)
+						client.send <- msgToBytes(&Message{Type: "SHEET_PATCH", SheetName: client.sheetName, Payload: payload, User: "system", Revision: p.Revision})
+					}
+				} else {
+					payload, _ := json.Marshal(pageOf(snap, client.pageRows))
+					client.send <- msgToBytes(&Message{Type: "INIT", Payload: payload, User: "system", Revision: rev})
 				}
-				client.send <- msgToBytes(msg)
 				// Also send global chat history independent of sheet
 				history := globalChatManager.HistoryFor(client.userID)
 				chatPayload, _ := json.Marshal(history)
 				client.send <- msgToBytes(&Message{Type: "CHAT_HISTORY", SheetName: "", Payload: chatPayload, User: "system"})
+				threadsPayload, _ := json.Marshal(sheet.CommentThreads())
+				client.send <- msgToBytes(&Message{Type: "COMMENT_THREADS", SheetName: client.sheetName, Payload: threadsPayload, User: "system"})
+				undoPayload, _ := json.Marshal(globalUndo.State(client.projectName, client.sheetName, client.userID))
+				client.send <- msgToBytes(&Message{Type: "UNDO_STATE", SheetName: client.sheetName, Payload: undoPayload, User: "system"})
 
 			}
 
@@ -93,6 +135,70 @@ func (h *Hub) run() {
 			// Determine final message to send (may differ from inbound command)
 			toSend := message
 
+			if message.Type == "ACCESS_CHANGED" && message.from == nil {
+				h.recheckAccess(message.Project)
+				continue
+			}
+			if message.Type == "SESSIONS_REVOKED" && message.from == nil {
+				h.dropRevokedSessions(message.User)
+				continue
+			}
+			if (message.Type == "RESTORE_STARTED" || message.Type == "RESTORE_FINISHED") && message.from == nil {
+				h.restoring = message.Type == "RESTORE_STARTED"
+				continue
+			}
+			if h.restoring && message.from != nil && !restoreAllowedTypes[message.Type] {
+				// The restore pushes every sheet to its clients when done
+				roomID := sheetKey(message.Project, message.SheetName)
+				if h.rooms[roomID][message.from] {
+					deniedPayload, _ := json.Marshal(map[string]string{
+						"reason": "restoring",
+						"type":   message.Type,
+					})
+					select {
+					case message.from.send <- msgToBytes(&Message{Type: "EDIT_DENIED", SheetName: message.SheetName, Payload: deniedPayload, User: message.User}):
+					default:
+						h.dropClient(roomID, message.from, 0)
+					}
+				}
+				continue
+			}
+			if message.Type == "GROUPS_CHANGED" && message.from == nil {
+				// Any sheet may name a group: recheck them all, then let
+				// clients reload which groups they are in
+				h.recheckAccess("")
+				for roomID := range h.rooms {
+					h.sendToRoom(roomID, message, nil)
+				}
+				continue
+			}
+			if message.Type == "NOTIFICATION" {
+				// Server-sent, for one user: reach them on every open sheet
+				if message.from == nil {
+					for _, clients := range h.rooms {
+						for client := range clients {
+							if client.userID != message.User {
+								continue
+							}
+							select {
+							case client.send <- msgToBytes(message):
+							default:
+								close(client.send)
+								delete(clients, client)
+							}
+						}
+					}
+				}
+				continue
+			}
+			// Only users who may read a sheet talk to its room
+			if message.from != nil {
+				if sheet := globalSheetManager.GetSheetBy(message.SheetName, message.Project); sheet != nil && !sheet.CanRead(message.User) {
+					h.dropClient(sheetKey(message.Project, message.SheetName), message.from, closeNoAccess)
+					continue
+				}
+			}
+
 			// Helper: deny non-editors for mutating operations
 			denyIfNotEditor := func() bool {
 				sheet := globalSheetManager.GetSheetBy(message.SheetName, message.Project)
@@ -123,6 +229,88 @@ func (h *Hub) run() {
 				}
 				return false
 			}
+			// denyReferenced tells the sender that a row/column delete was refused
+			// because other sheets reference the cells, listing the references so
+			// the client can retry with mode "force" or "rewrite".
+			denyReferenced := func(refs []ExternalReference) {
+				deniedPayload, _ := json.Marshal(map[string]interface{}{
+					"reason":     "referenced",
+					"type":       message.Type,
+					"references": refs,
+				})
+				denied := &Message{Type: "EDIT_DENIED", SheetName: message.SheetName, Payload: deniedPayload, User: message.User}
+				if clients, ok := h.rooms[sheetKey(message.Project, message.SheetName)]; ok {
+					for client := range clients {
+						if client.userID != message.User {
+							continue
+						}
+						select {
+						case client.send <- msgToBytes(denied):
+						default:
+							close(client.send)
+							delete(clients, client)
+						}
+					}
+				}
+			}
+
+			// sendToSender sends msg only to the sender's clients on this sheet.
+			sendToSender := func(msg *Message) {
+				if clients, ok := h.rooms[sheetKey(message.Project, message.SheetName)]; ok {
+					for client := range clients {
+						if client.userID != message.User {
+							continue
+						}
+						select {
+						case client.send <- msgToBytes(msg):
+						default:
+							close(client.send)
+							delete(clients, client)
+						}
+					}
+				}
+			}
+			// sendUndoState tells the sender's clients what they can undo and redo now.
+			sendUndoState := func() {
+				payload, _ := json.Marshal(globalUndo.State(message.Project, message.SheetName, message.User))
+				sendToSender(&Message{Type: "UNDO_STATE", SheetName: message.SheetName, Payload: payload, User: message.User})
+			}
+			// Move a stale edit past the rows and columns shifted since it
+			// was made, or send the sheet again when that is not possible
+			if undoCellTypes[message.Type] || undoLayoutTypes[message.Type] || undoShiftTypes[message.Type] || message.Type == "ADD_COMMENT" {
+				if !rebaseMessage(message) {
+					if sheet := globalSheetManager.GetSheetBy(message.SheetName, message.Project); sheet != nil {
+						deniedPayload, _ := json.Marshal(map[string]string{
+							"reason": "stale",
+							"type":   message.Type,
+						})
+						sendToSender(&Message{Type: "EDIT_DENIED", SheetName: message.SheetName, Payload: deniedPayload, User: message.User})
+						update, snap := sheetUpdate(sheet, message.SheetName, "system")
+						if update != nil {
+							h.sendToRoom(sheetKey(message.Project, message.SheetName), update, nil)
+						}
+						payload, _ := json.Marshal(snap)
+						sendToSender(&Message{Type: "INIT", SheetName: message.SheetName, Payload: payload, User: "system",
+							Revision: globalRevisions.Current(message.Project, message.SheetName)})
+					}
+					continue
+				}
+			}
+			// Refuse edits of protected ranges the sender may not edit
+			if message.from != nil && (undoCellTypes[message.Type] || undoShiftTypes[message.Type]) {
+				if sheet := globalSheetManager.GetSheetBy(message.SheetName, message.Project); sheet != nil && sheet.IsEditor(message.User) {
+					if p := sheet.ProtectionFor(message.Type, message.Payload, message.User); p != nil {
+						sendToSender(&Message{Type: "EDIT_DENIED", SheetName: message.SheetName, Payload: protectedDenial(message.Type, p), User: message.User})
+						continue
+					}
+				}
+			}
+			// Capture what an undoable edit changes; committed below once it
+			// ran. Edits the sender may not make are not captured
+			var undoRec *undoRecording
+			if sheet := globalSheetManager.GetSheetBy(message.SheetName, message.Project); sheet != nil && sheet.IsEditor(message.User) {
+				undoRec = globalUndo.Begin(message)
+			}
 
 			// Persist changes if it's an update
 			if message.Type == "UPDATE_CELL" {
@@ -141,12 +329,10 @@ func (h *Hub) run() {
 					sheet := globalSheetManager.GetSheetBy(message.SheetName, message.Project)
 					if sheet != nil {
 						sheet.SetCell(update.Row, update.Col, update.Value, message.User, update.Revert)
-						// Broadcast updated sheet snapshot with constructed details
-						payload, _ := json.Marshal(sheet.SnapshotForClient())
+						// Broadcast the updated sheet
 						toSend = &Message{
 							Type:      "ROW_COL_UPDATED",
 							SheetName: message.SheetName,
-							Payload:   payload,
 							User:      message.User,
 						}
 					}
@@ -169,12 +355,10 @@ func (h *Hub) run() {
 					sheet := globalSheetManager.GetSheetBy(message.SheetName, message.Project)
 					if sheet != nil {
 						sheet.SetCellStyle(st.Row, st.Col, st.Background, st.Bold, st.Italic, message.User)
-						// Broadcast updated sheet snapshot with constructed details
-						payload, _ := json.Marshal(sheet.SnapshotForClient())
+						// Broadcast the updated sheet
 						toSend = &Message{
 							Type:      "ROW_COL_UPDATED",
 							SheetName: message.SheetName,
-							Payload:   payload,
 							User:      message.User,
 						}
 					}
@@ -225,12 +409,10 @@ func (h *Hub) run() {
 				}
 				if err := json.Unmarshal(message.Payload, &ct); err == nil {
 					if sheet.SetCellType(ct.Row, ct.Col, ct.CellType, ct.Options, ct.OptionsRange, message.User) {
-						// Broadcast updated sheet snapshot with constructed details
-						payload, _ := json.Marshal(sheet.SnapshotForClient())
+						// Broadcast the updated sheet
 						toSend = &Message{
 							Type:      "ROW_COL_UPDATED",
 							SheetName: message.SheetName,
-							Payload:   payload,
 							User:      message.User,
 						}
 					} else {
@@ -277,7 +459,8 @@ func (h *Hub) run() {
 						sheet.SetCellOptionSelected(opts.Row, opts.Col, opts.OptionSelected)
 
 						// Log to audit
-						sheet.AuditLog = append(sheet.AuditLog, AuditEntry{
+						sheet.mu.Lock()
+						sheet.logAudit(AuditEntry{
 							Timestamp: time.Now(),
 							User:      message.User,
 							Action:    "OPTION_SELECT",
@@ -287,13 +470,13 @@ func (h *Hub) run() {
 							OldValue:  oldValue,
 							NewValue:  opts.Value,
 						})
+						sheet.mu.Unlock()
+						globalAuditLog.Flush(sheet.ProjectName, sheet.Name)
 
 						// Broadcast the update
-						payload, _ := json.Marshal(sheet.SnapshotForClient())
 						toSend = &Message{
 							Type:      "ROW_COL_UPDATED",
 							SheetName: message.SheetName,
-							Payload:   payload,
 							User:      message.User,
 						}
 					}
@@ -323,11 +506,9 @@ func (h *Hub) run() {
 						//println("Updated cell script to:")
 						//println(string(update.Script))
 						//println("for cell", update.Row, update.Col)
-						payload, _ := json.Marshal(sheet.SnapshotForClient())
 						toSend = &Message{
 							Type:      "ROW_COL_UPDATED",
 							SheetName: message.SheetName,
-							Payload:   payload,
 							User:      message.User,
 						}
 
@@ -375,11 +556,9 @@ func (h *Hub) run() {
 				}
 				if err := json.Unmarshal(message.Payload, &update); err == nil {
 					sheet.SetCellAIPrompt(update.Row, update.Col, update.Prompt, message.User)
-					payload, _ := json.Marshal(sheet.SnapshotForClient())
 					toSend = &Message{
 						Type:      "ROW_COL_UPDATED",
 						SheetName: message.SheetName,
-						Payload:   payload,
 						User:      message.User,
 					}
 				} else {
@@ -426,12 +605,10 @@ func (h *Hub) run() {
 							}
 							continue
 						}
-						// Broadcast updated sheet snapshot to all clients in the room
-						payload, _ := json.Marshal(sheet.SnapshotForClient())
+						// Broadcast the updated sheet to all clients in the room
 						toSend = &Message{
 							Type:      "ROW_COL_UPDATED",
 							SheetName: message.SheetName,
-							Payload:   payload,
 							User:      message.User,
 						}
 					}
@@ -448,12 +625,10 @@ func (h *Hub) run() {
 					sheet := globalSheetManager.GetSheetBy(message.SheetName, message.Project)
 					if sheet != nil {
 						if sheet.LockCell(req.Row, req.Col, message.User) {
-							// Broadcast full sheet state with constructed details
-							payload, _ := json.Marshal(sheet.SnapshotForClient())
+							// Broadcast the updated sheet
 							toSend = &Message{
 								Type:      "ROW_COL_UPDATED",
 								SheetName: message.SheetName,
-								Payload:   payload,
 								User:      message.User,
 							}
 						} else {
@@ -483,11 +658,9 @@ func (h *Hub) run() {
 					sheet := globalSheetManager.GetSheetBy(message.SheetName, message.Project)
 					if sheet != nil {
 						if sheet.UnlockCell(req.Row, req.Col, message.User) {
-							payload, _ := json.Marshal(sheet.SnapshotForClient())
 							toSend = &Message{
 								Type:      "ROW_COL_UPDATED",
 								SheetName: message.SheetName,
-								Payload:   payload,
 								User:      message.User,
 							}
 						} else {
@@ -520,12 +693,10 @@ func (h *Hub) run() {
 					sheet := globalSheetManager.GetSheetBy(message.SheetName, message.Project)
 					if sheet != nil {
 						sheet.SetColWidth(update.Col, update.Width, message.User)
-						// Broadcast updated sheet snapshot with constructed details
-						payload, _ := json.Marshal(sheet.SnapshotForClient())
+						// Broadcast the updated sheet
 						toSend = &Message{
 							Type:      "ROW_COL_UPDATED",
 							SheetName: message.SheetName,
-							Payload:   payload,
 							User:      message.User,
 						}
 					}
@@ -545,12 +716,10 @@ func (h *Hub) run() {
 					sheet := globalSheetManager.GetSheetBy(message.SheetName, message.Project)
 					if sheet != nil {
 						sheet.SetRowHeight(update.Row, update.Height, message.User)
-						// Broadcast updated sheet snapshot with constructed details
-						payload, _ := json.Marshal(sheet.SnapshotForClient())
+						// Broadcast the updated sheet
 						toSend = &Message{
 							Type:      "ROW_COL_UPDATED",
 							SheetName: message.SheetName,
-							Payload:   payload,
 							User:      message.User,
 						}
 					}
@@ -572,12 +741,10 @@ func (h *Hub) run() {
 					if sheet != nil {
 						moved := sheet.MoveRowBelow(mv.FromRow, mv.TargetRow, message.User)
 						if moved {
-							// Broadcast updated sheet snapshot with constructed details
-							payload, _ := json.Marshal(sheet.SnapshotForClient())
+							// Broadcast the updated sheet
 							toSend = &Message{
 								Type:      "ROW_MOVED",
 								SheetName: message.SheetName,
-								Payload:   payload,
 								User:      message.User,
 							}
 						}
@@ -600,11 +767,9 @@ func (h *Hub) run() {
 					if sheet != nil {
 						moved := sheet.MoveRowAsChild(mv.FromRow, mv.TargetRow, message.User)
 						if moved {
-							payload, _ := json.Marshal(sheet.SnapshotForClient())
 							toSend = &Message{
 								Type:      "ROW_MOVED",
 								SheetName: message.SheetName,
-								Payload:   payload,
 								User:      message.User,
 							}
 						}
@@ -626,11 +791,9 @@ func (h *Hub) run() {
 					if sheet != nil {
 						moved := sheet.MoveColumnRight(mv.FromCol, mv.TargetCol, message.User)
 						if moved {
-							payload, _ := json.Marshal(sheet.SnapshotForClient())
 							toSend = &Message{
 								Type:      "COL_MOVED",
 								SheetName: message.SheetName,
-								Payload:   payload,
 								User:      message.User,
 							}
 						}
@@ -651,11 +814,9 @@ func (h *Hub) run() {
 					if sheet != nil {
 						inserted := sheet.InsertRowBelow(ins.TargetRow, message.User)
 						if inserted {
-							payload, _ := json.Marshal(sheet.SnapshotForClient())
 							toSend = &Message{
 								Type:      "ROW_COL_UPDATED",
 								SheetName: message.SheetName,
-								Payload:   payload,
 								User:      message.User,
 							}
 						}
@@ -676,11 +837,9 @@ func (h *Hub) run() {
 					if sheet != nil {
 						inserted := sheet.InsertRowAbove(ins.TargetRow, message.User)
 						if inserted {
-							payload, _ := json.Marshal(sheet.SnapshotForClient())
 							toSend = &Message{
 								Type:      "ROW_COL_UPDATED",
 								SheetName: message.SheetName,
-								Payload:   payload,
 								User:      message.User,
 							}
 						}
@@ -701,11 +860,9 @@ func (h *Hub) run() {
 					if sheet != nil {
 						inserted := sheet.InsertColumnRight(ins.TargetCol, message.User)
 						if inserted {
-							payload, _ := json.Marshal(sheet.SnapshotForClient())
 							toSend = &Message{
 								Type:      "ROW_COL_UPDATED",
 								SheetName: message.SheetName,
-								Payload:   payload,
 								User:      message.User,
 							}
 						}
@@ -726,11 +883,9 @@ func (h *Hub) run() {
 					if sheet != nil {
 						insertedRow := sheet.InsertChildRow(ins.TargetRow, message.User)
 						if insertedRow > 0 {
-							payload, _ := json.Marshal(sheet.SnapshotForClient())
 							toSend = &Message{
 								Type:      "ROW_COL_UPDATED",
 								SheetName: message.SheetName,
-								Payload:   payload,
 								User:      message.User,
 							}
 						}
@@ -751,11 +906,9 @@ func (h *Hub) run() {
 					sheet := globalSheetManager.GetSheetBy(message.SheetName, message.Project)
 					if sheet != nil {
 						sheet.SetRowParent(req.Row, req.ParentRow, message.User)
-						payload, _ := json.Marshal(sheet.SnapshotForClient())
 						toSend = &Message{
 							Type:      "ROW_COL_UPDATED",
 							SheetName: message.SheetName,
-							Payload:   payload,
 							User:      message.User,
 						}
 					}
@@ -769,17 +922,20 @@ func (h *Hub) run() {
 				var req struct {
 					Row  string `json:"row"`
 					User string `json:"user"`
+					Mode string `json:"mode"`
 				}
 				if err := json.Unmarshal(message.Payload, &req); err == nil {
 					sheet := globalSheetManager.GetSheetBy(message.SheetName, message.Project)
 					if sheet != nil {
+						if refs, ok := sheet.CheckRowDelete(req.Row, req.Mode, message.User); !ok {
+							denyReferenced(refs)
+							continue
+						}
 						deleted := sheet.DeleteRowAt(req.Row, message.User)
 						if deleted {
-							payload, _ := json.Marshal(sheet.SnapshotForClient())
 							toSend = &Message{
 								Type:      "ROW_COL_UPDATED",
 								SheetName: message.SheetName,
-								Payload:   payload,
 								User:      message.User,
 							}
 						}
@@ -794,17 +950,20 @@ func (h *Hub) run() {
 				var req struct {
 					Col  string `json:"col"`
 					User string `json:"user"`
+					Mode string `json:"mode"`
 				}
 				if err := json.Unmarshal(message.Payload, &req); err == nil {
 					sheet := globalSheetManager.GetSheetBy(message.SheetName, message.Project)
 					if sheet != nil {
+						if refs, ok := sheet.CheckColumnDelete(req.Col, req.Mode, message.User); !ok {
+							denyReferenced(refs)
+							continue
+						}
 						deleted := sheet.DeleteColumnAt(req.Col, message.User)
 						if deleted {
-							payload, _ := json.Marshal(sheet.SnapshotForClient())
 							toSend = &Message{
 								Type:      "ROW_COL_UPDATED",
 								SheetName: message.SheetName,
-								Payload:   payload,
 								User:      message.User,
 							}
 						}
@@ -859,6 +1018,12 @@ func (h *Hub) run() {
 						s.mu.RUnlock()
 					}
 					appended := globalChatManager.Append(message.User, chat.Text, chat.To, sheetName, projectName, sheetType)
+					globalNotifications.NotifyMentions(Notification{
+						Project: projectName, Sheet: sheetName, Actor: appended.User,
+						Text: appended.User + " mentioned you in chat: " + firstNChar(appended.Text, 300),
+					}, parseMentions(appended.Text), func(user string) bool {
+						return appended.To == "" || appended.To == "all" || matchesUser(appended.To, user)
+					})
 					payload, _ := json.Marshal(appended)
 					toSend = &Message{Type: "CHAT_APPENDED", SheetName: "", Payload: payload, User: message.User}
 					// Broadcast
@@ -875,10 +1040,11 @@ func (h *Hub) run() {
 							}
 						}
 					} else {
-						// direct message: send to sender and recipient only
+						// direct message: send to sender and recipient (or the
+						// recipient group's members) only
 						for _, clients := range h.rooms {
 							for client := range clients {
-								if client.userID != appended.User && client.userID != appended.To {
+								if client.userID != appended.User && !matchesUser(appended.To, client.userID) {
 									continue
 								}
 								select {
@@ -947,6 +1113,70 @@ func (h *Hub) run() {
 					}
 				}
 				continue
+			} else if message.Type == "ADD_COMMENT" || message.Type == "RESOLVE_COMMENT" || message.Type == "DELETE_COMMENT" {
+				sheet := globalSheetManager.GetSheetBy(message.SheetName, message.Project)
+				if sheet == nil {
+					continue
+				}
+				denyComment := func(reason, detail string) {
+					deniedPayload, _ := json.Marshal(map[string]string{
+						"reason": reason,
+						"type":   message.Type,
+						"error":  detail,
+					})
+					sendToSender(&Message{Type: "EDIT_DENIED", SheetName: message.SheetName, Payload: deniedPayload, User: message.User})
+				}
+				if !sheet.CanComment(message.User) {
+					denyComment("not-commenter", "")
+					continue
+				}
+				var req struct {
+					Row       string `json:"row"`
+					Col       string `json:"col"`
+					ThreadID  string `json:"thread_id"`
+					CommentID string `json:"comment_id"`
+					Text      string `json:"text"`
+					Resolved  bool   `json:"resolved"`
+				}
+				if err := json.Unmarshal(message.Payload, &req); err != nil {
+					log.Printf("Error unmarshalling %s payload: %v", message.Type, err)
+					continue
+				}
+				var thread CommentThread
+				var removed bool
+				var err error
+				switch message.Type {
+				case "ADD_COMMENT":
+					thread, err = sheet.AddComment(req.Row, req.Col, req.ThreadID, req.Text, message.User)
+				case "RESOLVE_COMMENT":
+					thread, err = sheet.SetThreadResolved(req.ThreadID, req.Resolved, message.User)
+				default:
+					thread, removed, err = sheet.DeleteComment(req.ThreadID, req.CommentID, message.User)
+				}
+				if err != nil {
+					denyComment("comment", err.Error())
+					continue
+				}
+				if message.Type == "ADD_COMMENT" {
+					added := thread.Comments[len(thread.Comments)-1]
+					globalNotifications.NotifyMentions(Notification{
+						Project: message.Project, Sheet: message.SheetName, Cell: thread.Cell, Actor: added.User,
+						Text: fmt.Sprintf("%s mentioned you in a comment on %s of %s: %s", added.User, thread.Cell, message.SheetName, firstNChar(added.Text, 300)),
+					}, added.Mentions, sheet.CanRead)
+				}
+				if message.Type == "ADD_COMMENT" && req.ThreadID == "" {
+					// Starting a thread may have given the cell its CellID
+					if update, _ := sheetUpdate(sheet, message.SheetName, message.User, cellRef{row: req.Row, col: req.Col}); update != nil {
+						h.sendToRoom(sheetKey(message.Project, message.SheetName), update, nil)
+					}
+				}
+				if removed {
+					payload, _ := json.Marshal(map[string]string{"id": thread.ID})
+					toSend = &Message{Type: "COMMENT_THREAD_REMOVED", SheetName: message.SheetName, Payload: payload, User: message.User}
+				} else {
+					payload, _ := json.Marshal(thread)
+					toSend = &Message{Type: "COMMENT_THREAD", SheetName: message.SheetName, Payload: payload, User: message.User}
+				}
 			} else if message.Type == "UPDATE_SECTION_SCHEME" {
 				if denyIfNotEditor() {
 					continue
@@ -959,17 +1189,76 @@ func (h *Hub) run() {
 					sheet := globalSheetManager.GetSheetBy(message.SheetName, message.Project)
 					if sheet != nil {
 						sheet.SetSectionScheme(update.Scheme)
-						payload, _ := json.Marshal(sheet.SnapshotForClient())
 						toSend = &Message{
 							Type:      "ROW_COL_UPDATED",
 							SheetName: message.SheetName,
-							Payload:   payload,
 							User:      message.User,
 						}
 					}
 				} else {
 					log.Printf("Error unmarshalling UPDATE_SECTION_SCHEME payload: %v", err)
 				}
+			} else if message.Type == "UNDO" || message.Type == "REDO" {
+				if denyIfNotEditor() {
+					continue
+				}
+				var req struct {
+					Force bool `json:"force,omitempty"`
+				}
+				if len(message.Payload) > 0 {
+					if err := json.Unmarshal(message.Payload, &req); err != nil {
+						log.Printf("Error unmarshalling %s payload: %v", message.Type, err)
+					}
+				}
+				sheet := globalSheetManager.GetSheetBy(message.SheetName, message.Project)
+				if sheet == nil {
+					continue
+				}
+				changed, conflict := globalUndo.Apply(sheet, message.User, message.Type == "REDO", req.Force)
+				if conflict != nil {
+					payload, _ := json.Marshal(map[string]interface{}{
+						"type":     message.Type,
+						"conflict": conflict,
+					})
+					sendToSender(&Message{Type: "UNDO_CONFLICT", SheetName: message.SheetName, Payload: payload, User: message.User})
+				}
+				sendUndoState()
+				if !changed {
+					continue
+				}
+				toSend = &Message{
+					Type:      "ROW_COL_UPDATED",
+					SheetName: message.SheetName,
+					User:      message.User,
+				}
+			} else if message.Type == "LOAD_ROWS" {
+				// More rows of a sheet the client got paged
+				var req struct {
+					From int `json:"from"`
+					To   int `json:"to"`
+				}
+				if err := json.Unmarshal(message.Payload, &req); err != nil {
+					log.Printf("Error unmarshalling LOAD_ROWS payload: %v", err)
+					continue
+				}
+				sheet := globalSheetManager.GetSheetBy(message.SheetName, message.Project)
+				if sheet == nil {
+					continue
+				}
+				update, snap := sheetUpdate(sheet, message.SheetName, "system")
+				if update != nil {
+					h.sendToRoom(sheetKey(message.Project, message.SheetName), update, nil)
+				}
+				rev := globalRevisions.Current(message.Project, message.SheetName)
+				if message.BaseRevision != rev {
+					// The sheet changed since the client's page; send all of it
+					payload, _ := json.Marshal(snap)
+					sendToSender(&Message{Type: "INIT", SheetName: message.SheetName, Payload: payload, User: "system", Revision: rev})
+					continue
+				}
+				payload, _ := json.Marshal(sheetRowsOf(snap, req.From, req.To))
+				sendToSender(&Message{Type: "SHEET_ROWS", SheetName: message.SheetName, Payload: payload, User: "system", Revision: rev})
+				continue
 			} else if message.Type == "PING" {
 				// Optional: reply with a PONG only to sender to confirm connectivity
 				toSend = &Message{
@@ -980,6 +1269,27 @@ func (h *Hub) run() {
 				}
 			}
 
+			if globalUndo.Commit(undoRec) {
+				sendUndoState()
+			}
+
+			// A changed sheet is sent as a patch from the revision clients
+			// have; everything else carries the current revision
+			switch toSend.Type {
+			case "ROW_COL_UPDATED", "ROW_MOVED", "COL_MOVED":
+				sheet := globalSheetManager.GetSheetBy(message.SheetName, message.Project)
+				if sheet == nil {
+					continue
+				}
+				update, _ := sheetUpdate(sheet, message.SheetName, toSend.User, touchedCells(message)...)
+				if update == nil {
+					continue
+				}
+				toSend = update
+			default:
+				toSend.Revision = globalRevisions.Current(message.Project, message.SheetName)
+			}
+
 			if clients, ok := h.rooms[sheetKey(message.Project, message.SheetName)]; ok {
 				for client := range clients {
 					// Don't send back to sender? Or do? usually do for confirmation,
@@ -1025,3 +1335,109 @@ func (h *Hub) HasActiveConnectionsForProject(projectPath string) bool {
 	}
 	return false
 }
+
+// dropClient disconnects client from room roomID with close code
+// closeNoAccess when its user may no longer read the sheet, or
+// closeUnauthorized when its login session ended.
+func (h *Hub) dropClient(roomID string, client *Client, code int) {
+	clients := h.rooms[roomID]
+	if !clients[client] {
+		return
+	}
+	client.closeCode = code
+	close(client.send)
+	delete(clients, client)
+}
+
+// dropRevokedSessions disconnects the clients of user whose login session
+// was revoked.
+func (h *Hub) dropRevokedSessions(user string) {
+	for roomID, clients := range h.rooms {
+		for client := range clients {
+			if client.userID == user && client.sessionID != "" && !globalUserManager.SessionActive(client.sessionID) {
+				h.dropClient(roomID, client, closeUnauthorized)
+			}
+		}
+	}
+}
+
+// recheckAccess disconnects the clients on sheets of project, a project or
+// folder path ("" for all), whose user may no longer read the sheet, and brings the other
+// clients up to date with the sheet's permissions.
+func (h *Hub) recheckAccess(project string) {
+	for roomID, clients := range h.rooms {
+		var sheet *Sheet
+		var sheetName string
+		for client := range clients {
+			if project == "" || client.projectName == project || strings.HasPrefix(client.projectName, project+"/") {
+				sheet = globalSheetManager.GetSheetBy(client.sheetName, client.projectName)
+				sheetName = client.sheetName
+			}
+			break
+		}
+		if sheet == nil {
+			continue
+		}
+		for client := range clients {
+			if !sheet.CanRead(client.userID) {
+				h.dropClient(roomID, client, closeNoAccess)
+			}
+		}
+		if update, _ := sheetUpdate(sheet, sheetName, "system"); update != nil {
+			h.sendToRoom(roomID, update, nil)
+		}
+	}
+}
+
+// sendToRoom sends msg to every client on the sheet of room roomID but except.
+func (h *Hub) sendToRoom(roomID string, msg *Message, except *Client) {
+	clients, ok := h.rooms[roomID]
+	if !ok {
+		return
+	}
+	for client := range clients {
+		if client == except {
+			continue
+		}
+		select {
+		case client.send <- msgToBytes(msg):
+		default:
+			close(client.send)
+			delete(clients, client)
+		}
+	}
+}
+
+// sheetUpdate publishes the current state of sheet and returns the message
+// that brings clients from the last revision to it: a SHEET_PATCH, or
+// ROW_COL_UPDATED with the whole sheet when there is nothing to patch. The
+// message is nil when nothing changed. touched cells are sent even when
+// unchanged.
+func sheetUpdate(sheet *Sheet, sheetName, user string, touched ...cellRef) (*Message, *Sheet) {
+	patch, snap := globalRevisions.Publish(sheet, touched...)
+	if patch == nil {
+		payload, _ := json.Marshal(snap)
+		return &Message{Type: "ROW_COL_UPDATED", SheetName: sheetName, Payload: payload, User: user,
+			Revision: globalRevisions.Current(snap.ProjectName, snap.Name)}, snap
+	}
+	if patch.Base == patch.Revision {
+		return nil, snap
+	}
+	payload, _ := json.Marshal(patch)
+	return &Message{Type: "SHEET_PATCH", SheetName: sheetName, Payload: payload, User: user, Revision: patch.Revision}, snap
+}
+
+// touchedCells returns the cell a cell edit message is about.
+func touchedCells(message *Message) []cellRef {
+	if !undoCellTypes[message.Type] {
+		return nil
+	}
+	var p struct {
+		Row string `json:"row"`
+		Col string `json:"col"`
+	}
+	if json.Unmarshal(message.Payload, &p) != nil || p.Row == "" || p.Col == "" {
+		return nil
+	}
+	return []cellRef{{row: p.Row, col: p.Col}}
+}
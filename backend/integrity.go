@@ -10,7 +10,9 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"log"
 	"os"
 	"path/filepath"
@@ -33,25 +35,91 @@ func shasumPath(jsonPath string) string {
 
 // computeChecksum returns the hex SHA-256 of (salt + data).
 func computeChecksum(data []byte) string {
-	h := sha256.New()
-	h.Write([]byte(checksumSalt))
+	h := newChecksumHash()
 	h.Write(data)
 	return hex.EncodeToString(h.Sum(nil))
 }
 
+// newChecksumHash returns a hash whose hex sum is the computeChecksum of
+// what is written to it, for data streamed rather than held in memory.
+func newChecksumHash() hash.Hash {
+	h := sha256.New()
+	h.Write([]byte(checksumSalt))
+	return h
+}
+
+// writeFileAtomic writes data to a temp file next to path, fsyncs it and
+// renames it into place, so a crash leaves either the old or the new file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := writeFileSynced(tmp, data, perm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// writeFileSynced writes data to path and fsyncs it before returning.
+func writeFileSynced(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir fsyncs a directory so renames inside it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
+
 // WriteFileWithChecksum atomically writes data to jsonPath and saves its
-// checksum to the companion .shasum file.
+// checksum to the companion .shasum file. Both are fully written to temp
+// files before either is renamed; if a crash lands between the two renames,
+// VerifyChecksum finds the new checksum still in "<file>.shasum.tmp".
 func WriteFileWithChecksum(jsonPath string, data []byte) error {
-	// Write the main file
-	if err := os.WriteFile(jsonPath, data, 0644); err != nil {
+	csPath := shasumPath(jsonPath)
+	if err := writeFileSynced(jsonPath+".tmp", data, 0644); err != nil {
+		os.Remove(jsonPath + ".tmp")
+		return fmt.Errorf("write %s: %w", jsonPath, err)
+	}
+	if err := writeFileSynced(csPath+".tmp", []byte(computeChecksum(data)), 0644); err != nil {
+		os.Remove(jsonPath + ".tmp")
+		os.Remove(csPath + ".tmp")
+		return fmt.Errorf("write checksum for %s: %w", jsonPath, err)
+	}
+	if err := os.Rename(jsonPath+".tmp", jsonPath); err != nil {
+		os.Remove(jsonPath + ".tmp")
+		os.Remove(csPath + ".tmp")
 		return fmt.Errorf("write %s: %w", jsonPath, err)
 	}
-	// Write checksum file
-	checksum := computeChecksum(data)
-	if err := os.WriteFile(shasumPath(jsonPath), []byte(checksum), 0644); err != nil {
-		// Non-fatal: log but don't fail the whole save
+	if err := os.Rename(csPath+".tmp", csPath); err != nil {
+		// Non-fatal: VerifyChecksum recovers from the leftover temp file
 		log.Printf("integrity: failed to write checksum for %s: %v", jsonPath, err)
 	}
+	if err := syncDir(filepath.Dir(jsonPath)); err != nil {
+		log.Printf("integrity: failed to sync directory of %s: %v", jsonPath, err)
+	}
 	return nil
 }
 
@@ -61,6 +129,15 @@ func WriteFileWithChecksum(jsonPath string, data []byte) error {
 // and (false, err) when the checksum file cannot be read for a non-missing reason.
 func VerifyChecksum(jsonPath string, data []byte) (intact bool, err error) {
 	csPath := shasumPath(jsonPath)
+	expected := computeChecksum(data)
+	// A save interrupted between renaming the file and its checksum leaves
+	// the matching checksum in the temp file; finish that save.
+	if pending, err := os.ReadFile(csPath + ".tmp"); err == nil && string(pending) == expected {
+		if err := os.Rename(csPath+".tmp", csPath); err != nil {
+			log.Printf("integrity: recovering checksum for %s: %v", jsonPath, err)
+		}
+		return true, nil
+	}
 	stored, readErr := os.ReadFile(csPath)
 	if readErr != nil {
 		if os.IsNotExist(readErr) {
@@ -69,7 +146,6 @@ func VerifyChecksum(jsonPath string, data []byte) (intact bool, err error) {
 		}
 		return false, fmt.Errorf("read checksum file %s: %w", csPath, readErr)
 	}
-	expected := computeChecksum(data)
 	return string(stored) == expected, nil
 }
 
@@ -111,6 +187,25 @@ func (ir *IntegrityRegistry) Record(absPath string, intact bool, missing bool, e
 	ir.mu.Unlock()
 }
 
+// Reset forgets all recorded results, before everything is reloaded.
+func (ir *IntegrityRegistry) Reset() {
+	ir.mu.Lock()
+	ir.results = make(map[string]FileIntegrity)
+	ir.mu.Unlock()
+}
+
+// Forget drops the results of a file and of everything under it, before
+// the files a restore replaced are loaded again.
+func (ir *IntegrityRegistry) Forget(absPath string) {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	for p := range ir.results {
+		if p == absPath || strings.HasPrefix(p, absPath+string(filepath.Separator)) {
+			delete(ir.results, p)
+		}
+	}
+}
+
 // AllResults returns a copy of all recorded integrity results.
 func (ir *IntegrityRegistry) AllResults() []FileIntegrity {
 	ir.mu.RLock()
@@ -122,6 +217,19 @@ func (ir *IntegrityRegistry) AllResults() []FileIntegrity {
 	return out
 }
 
+// CorruptFiles returns the results that failed, keyed by absolute path.
+func (ir *IntegrityRegistry) CorruptFiles() map[string]FileIntegrity {
+	ir.mu.RLock()
+	defer ir.mu.RUnlock()
+	out := make(map[string]FileIntegrity)
+	for absPath, fi := range ir.results {
+		if !fi.Intact {
+			out[absPath] = fi
+		}
+	}
+	return out
+}
+
 // IsCorrupt returns true if the given absolute path is known to be corrupt
 // (includes files whose .shasum is missing).
 func (ir *IntegrityRegistry) IsCorrupt(absPath string) bool {
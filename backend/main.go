@@ -4,8 +4,10 @@ import (
 	"archive/zip"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -20,13 +22,51 @@ import (
 var addr = flag.String("addr", ":8082", "http service address")
 var pythonExecPath = flag.String("python", "python3", "path to Python executable")
 var pythonRunAsFlag = flag.String("python-user", "", "OS username to run Python scripts as (via sudo -u); defaults to the current process user")
+var pythonWorkersFlag = flag.Int("python-workers", 4, "number of warm Python worker processes for script cells (0 = start a new interpreter per script)")
+var scriptTimeoutFlag = flag.Int("script-timeout", 30, "wall-clock limit in seconds for one script cell execution (0 = the 30s default)")
+var scriptCPUFlag = flag.Int("script-cpu", 20, "CPU time limit in seconds for one script cell execution (0 = unlimited)")
+var scriptMemoryFlag = flag.Int("script-memory-mb", 1024, "address-space limit in MB for one script cell execution (0 = unlimited)")
+var scriptOutputFlag = flag.Int("script-max-output-kb", 1024, "maximum stdout size in KB for one script cell execution (0 = unlimited)")
+var scriptNetworkFlag = flag.Bool("script-allow-network", false, "allow script cells to open network sockets")
+var scriptNetNSFlag = flag.Bool("script-netns", true, "run Python workers without network access in their own network namespace (unshare -rn); when false, network is only blocked inside the interpreter")
+var backupDirFlag = flag.String("backup-dir", backupDir, "directory for scheduled backups and pre-restore safety backups")
+var backupIntervalFlag = flag.Int("backup-interval-hours", 24, "write a backup into -backup-dir every N hours (0 = disabled)")
+var backupKeepFlag = flag.Int("backup-keep", backupKeep, "number of backups to keep in -backup-dir (0 = keep all)")
+var auditArchiveDirFlag = flag.String("audit-archive-dir", auditArchiveDir, "directory that receives sheet audit entries removed by a project's audit retention")
+var auditRetentionIntervalFlag = flag.Int("audit-retention-interval-hours", 1, "apply project audit retention every N hours (0 = only when the setting changes)")
+var historyIntervalFlag = flag.Int("history-interval-minutes", 60, "snapshot sheets changed since their last snapshot every N minutes, for point-in-time history (0 = disabled)")
+var storeFlag = flag.String("store", StoreJSON, "storage backend: json (files under DATA) or sqlite (DATA/store.db)")
 
 // Global hub instance for WebSocket connections
 var globalHub *Hub
 
 func main() {
+	// `shared-spreadsheet migrate -from json -to sqlite` copies the data
+	// between storage backends and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+		return
+	}
+	// `shared-spreadsheet script-exec ...` is run by pythonCmd to apply script
+	// rlimits before executing python
+	if len(os.Args) > 1 && os.Args[1] == "script-exec" {
+		if err := runScriptExec(os.Args[2:]); err != nil {
+			log.Fatalf("script-exec: %v", err)
+		}
+		return
+	}
 	flag.Parse()
 	initPython(*pythonExecPath, *pythonRunAsFlag)
+	pythonNetNS = *scriptNetNSFlag
+	if pythonNetNS {
+		if err := checkPythonNetNS(); err != nil {
+			log.Fatalf("Cannot create a network namespace for Python scripts (%v); start with -script-netns=false to only block network inside the interpreter", err)
+		}
+	} else {
+		log.Printf("Warning: -script-netns=false; script network access is only blocked inside the interpreter")
+	}
 
 	// Ensure pythonDirectory exists as the working directory for all script executions.
 	pythonDir := filepath.Join(dataDir, "pythonDirectory")
@@ -34,8 +74,22 @@ func main() {
 		log.Fatalf("Failed to create pythonDirectory: %v", err)
 	}
 	log.Printf("Python working directory: %s", pythonDir)
+	initScriptLimits(ScriptLimits{
+		TimeoutSeconds: *scriptTimeoutFlag,
+		CPUSeconds:     *scriptCPUFlag,
+		MemoryMB:       *scriptMemoryFlag,
+		MaxOutputKB:    *scriptOutputFlag,
+		AllowNetwork:   scriptNetworkFlag,
+	})
+	initPythonPool(*pythonWorkersFlag)
 	globalHub = newHub()
 	go globalHub.run()
+	store, storeErr := openStore(*storeFlag)
+	if storeErr != nil {
+		log.Fatalf("Failed to open %s store: %v", *storeFlag, storeErr)
+	}
+	globalStore.Set(store)
+	log.Printf("Using %s store", *storeFlag)
 	log.Printf("Server starting..1")
 	globalProjectAuditManager.Load()
 	log.Printf("Server starting..2")
@@ -45,14 +99,24 @@ func main() {
 	globalSheetManager.Load()
 	log.Printf("Server starting..4")
 	globalUserManager.Load()
+	globalAPITokens.Load()
+	globalGroups.Load()
 	log.Printf("Server starting..5")
 	globalChatManager.Load()
 	log.Printf("Server starting..6")
 	loadLLMSettings()
 	log.Printf("Server starting..6b (LLM settings loaded)")
+	globalNotifications.Load()
+	loadNotificationSettings()
+	go globalNotifications.run()
 	// Start SheetManager async saver & flusher after Hub is ready
 	// Ensures any broadcasts during script processing see a non-nil globalHub
 	globalSheetManager.initAsyncSaver()
+	backupDir, backupKeep = *backupDirFlag, *backupKeepFlag
+	startBackupScheduler(time.Duration(*backupIntervalFlag) * time.Hour)
+	auditArchiveDir = *auditArchiveDirFlag
+	startAuditRetention(time.Duration(*auditRetentionIntervalFlag) * time.Hour)
+	startHistorySnapshots(time.Duration(*historyIntervalFlag) * time.Minute)
 	log.Printf("Server starting..7")
 	http.HandleFunc("/api/export", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -82,9 +146,8 @@ func main() {
 			return
 		}
 		project := r.URL.Query().Get("project")
-		sheet := globalSheetManager.GetSheetBy(sheetName, project)
+		sheet := readableSheet(w, sheetName, project, username)
 		if sheet == nil {
-			http.Error(w, "Sheet not found", http.StatusNotFound)
 			return
 		}
 
@@ -154,6 +217,8 @@ func main() {
 				_ = f.SetCellValue(xlsxSheetName, cellRef, cell.Value)
 			}
 		}
+		// Comment threads become cell notes
+		sheet.addXLSXCommentsLocked(f, xlsxSheetName, colLabels)
 		sheet.mu.RUnlock()
 
 		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
@@ -194,11 +259,12 @@ func main() {
 			http.Error(w, "project is required", http.StatusBadRequest)
 			return
 		}
-		// Filter sheets by project (no ListSheetsByProject helper available)
+		// Filter sheets by project (no ListSheetsByProject helper available),
+		// leaving out those the user may not read
 		allSheets := globalSheetManager.ListSheets()
 		sheets := make([]*Sheet, 0)
 		for _, s := range allSheets {
-			if s != nil && s.ProjectName == project {
+			if s != nil && s.ProjectName == project && s.CanRead(username) {
 				sheets = append(sheets, s)
 			}
 		}
@@ -262,6 +328,7 @@ func main() {
 					_ = f.SetCellValue(sheetName, cellRef, cell.Value)
 				}
 			}
+			sheet.addXLSXCommentsLocked(f, sheetName, colLabels)
 			sheet.mu.RUnlock()
 		}
 		// Remove default sheet if present and unused
@@ -430,6 +497,15 @@ func main() {
 			http.Error(w, "source_id and target_project required", http.StatusBadRequest)
 			return
 		}
+		if readableSheet(w, req.SourceID, req.SourceProject, username) == nil {
+			return
+		}
+		// Copying creates a sheet, so the same people may do it
+		targetTop := strings.SplitN(req.TargetProject, "/", 2)[0]
+		if owner := globalProjectMeta.GetOwner(targetTop); owner != "" && !globalProjectMeta.IsProjectAdmin(targetTop, username) {
+			http.Error(w, "Forbidden: only the project owner or admin can create sheets here", http.StatusForbidden)
+			return
+		}
 
 		newSheet := globalSheetManager.CopySheetToProject(req.SourceID, req.SourceProject, req.TargetProject, req.Name, username)
 		if newSheet == nil {
@@ -509,6 +585,7 @@ func main() {
 		var req struct {
 			Username string `json:"username"`
 			Password string `json:"password"`
+			Remember bool   `json:"remember"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -520,7 +597,7 @@ func main() {
 			return
 		}
 
-		token, err := globalUserManager.Login(req.Username, req.Password)
+		tokens, err := globalUserManager.Login(req.Username, req.Password, req.Remember, r.UserAgent(), clientIP(r))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
@@ -528,7 +605,10 @@ func main() {
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"token":              token,
+			"token":              tokens.Token,
+			"refresh_token":      tokens.RefreshToken,
+			"expires_at":         tokens.ExpiresAt,
+			"refresh_expires_at": tokens.RefreshExpiresAt,
 			"username":           req.Username,
 			"is_admin":           globalUserManager.IsAdminUser(req.Username),
 			"can_create_project": globalUserManager.CanUserCreateProject(req.Username),
@@ -560,6 +640,239 @@ func main() {
 		json.NewEncoder(w).Encode(map[string]string{"message": "Logged out successfully"})
 	})
 
+	// Exchange a refresh token for a new token pair
+	http.HandleFunc("/api/refresh", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		username, tokens, err := globalUserManager.Refresh(req.RefreshToken)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":              tokens.Token,
+			"refresh_token":      tokens.RefreshToken,
+			"expires_at":         tokens.ExpiresAt,
+			"refresh_expires_at": tokens.RefreshExpiresAt,
+			"username":           username,
+		})
+	})
+
+	// List (GET) or revoke (DELETE ?id=) the current user's sessions
+	http.HandleFunc("/api/sessions", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		token := r.Header.Get("Authorization")
+		username, err := globalUserManager.ValidateToken(token)
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(globalUserManager.ListSessions(username, token))
+		case http.MethodDelete:
+			id := r.URL.Query().Get("id")
+			if id == "" {
+				http.Error(w, "Session id required", http.StatusBadRequest)
+				return
+			}
+			if err := globalUserManager.RevokeSession(username, id); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"message": "Session revoked"})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Personal access tokens: GET lists, POST { name, access, projects, expires_in_days }
+	// creates (the secret is only returned once), DELETE ?id= revokes.
+	http.HandleFunc("/api/tokens", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		username, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(globalAPITokens.List(username))
+		case http.MethodPost:
+			var req struct {
+				Name          string   `json:"name"`
+				Access        string   `json:"access"`
+				Projects      []string `json:"projects"`
+				ExpiresInDays int      `json:"expires_in_days"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			secret, info, err := globalAPITokens.Create(username, req.Name, req.Access, req.Projects, req.ExpiresInDays)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("API token %q (%s) created by %s", info.Name, info.Access, username)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]interface{}{"token": secret, "info": info})
+		case http.MethodDelete:
+			id := r.URL.Query().Get("id")
+			if id == "" {
+				http.Error(w, "Token id required", http.StatusBadRequest)
+				return
+			}
+			if err := globalAPITokens.Revoke(username, id); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"message": "Token revoked"})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Groups: GET lists every group; POST { name, members } creates one owned
+	// by the caller; PUT { name, owners, members } replaces either list;
+	// DELETE ?name= removes one. Only server admins and group owners may
+	// change a group.
+	http.HandleFunc("/api/groups", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		username, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(globalGroups.List())
+		case http.MethodPost:
+			var req struct {
+				Name    string   `json:"name"`
+				Members []string `json:"members"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !globalUserManager.IsAdminUser(username) && !globalUserManager.CanUserCreateProject(username) {
+				http.Error(w, "Forbidden: you are not allowed to create groups", http.StatusForbidden)
+				return
+			}
+			group, err := globalGroups.Create(req.Name, username, req.Members)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("Group %q created by %s", group.Name, username)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(group)
+		case http.MethodPut:
+			var req struct {
+				Name    string   `json:"name"`
+				Owners  []string `json:"owners"`
+				Members []string `json:"members"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !globalGroups.Exists(req.Name) {
+				http.Error(w, "group not found", http.StatusNotFound)
+				return
+			}
+			if !globalGroups.CanManage(req.Name, username) {
+				http.Error(w, "Forbidden: only group owners can change a group", http.StatusForbidden)
+				return
+			}
+			group, err := globalGroups.Update(req.Name, req.Owners, req.Members)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("Group %q changed by %s: owners %v, members %v", group.Name, username, group.Owners, group.Members)
+			notifyGroupsChanged()
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(group)
+		case http.MethodDelete:
+			name := r.URL.Query().Get("name")
+			if !globalGroups.Exists(name) {
+				http.Error(w, "group not found", http.StatusNotFound)
+				return
+			}
+			if !globalGroups.CanManage(name, username) {
+				http.Error(w, "Forbidden: only group owners can delete a group", http.StatusForbidden)
+				return
+			}
+			if err := globalGroups.Delete(name); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			log.Printf("Group %q deleted by %s", name, username)
+			notifyGroupsChanged()
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"message": "Group deleted"})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
 	http.HandleFunc("/api/validate", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
@@ -628,6 +941,8 @@ func main() {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		// Sessions opened with the old password end; this one stays
+		globalUserManager.RevokeUserSessions(username, token)
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"message": "password updated"})
@@ -696,6 +1011,7 @@ func main() {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		globalUserManager.RevokeUserSessions(req.Username, "")
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"message": "password updated"})
 	})
@@ -743,6 +1059,46 @@ func main() {
 		json.NewEncoder(w).Encode(map[string]string{"message": "permission updated"})
 	})
 
+	// ── Admin: POST /api/admin/user/logout  (end all sessions of a user)
+	http.HandleFunc("/api/admin/user/logout", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token := r.Header.Get("Authorization")
+		caller, err := globalUserManager.ValidateToken(token)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !globalUserManager.IsAdminUser(caller) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		var req struct {
+			Username string `json:"username"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !globalUserManager.Exists(req.Username) {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		}
+		n := globalUserManager.RevokeUserSessions(req.Username, "")
+		log.Printf("Admin %s logged out %s (%d sessions)", caller, req.Username, n)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "user logged out", "sessions": n})
+	})
+
 	// ── Admin: POST /api/admin/project/transfer  (change owner of a project)
 	http.HandleFunc("/api/admin/project/transfer", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -882,83 +1238,346 @@ func main() {
 		w.Header().Set("Content-Type", "application/zip")
 		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, zipName))
 
-		zw := zip.NewWriter(w)
-		defer zw.Close()
-
-		absDataDir, absErr := filepath.Abs(dataDir)
-		if absErr != nil {
-			absDataDir = dataDir
-		}
-
-		walkErr := filepath.Walk(absDataDir, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				return nil
-			}
-			rel, relErr := filepath.Rel(absDataDir, path)
-			if relErr != nil {
-				rel = info.Name()
-			}
-			// Use forward slashes inside the zip
-			rel = filepath.ToSlash(rel)
-
-			f, createErr := zw.Create(rel)
-			if createErr != nil {
-				return createErr
-			}
-			data, readErr := os.ReadFile(path)
-			if readErr != nil {
-				return readErr
-			}
-			_, writeErr := f.Write(data)
-			return writeErr
-		})
-		if walkErr != nil {
-			log.Printf("backup: walk error: %v", walkErr)
+		if err := writeBackupZip(w); err != nil {
+			log.Printf("backup: walk error: %v", err)
 		}
 	})
 
-	// ── Admin: GET/PUT /api/admin/llm  (LLM URL configuration)
-	http.HandleFunc("/api/admin/llm", func(w http.ResponseWriter, r *http.Request) {
+	// Admin: scheduled backups kept on the server.
+	// GET lists them (or downloads one with ?name=), POST takes one now.
+	http.HandleFunc("/api/admin/backups", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		token := r.Header.Get("Authorization")
-		username, err := globalUserManager.ValidateToken(token)
+		caller, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
 		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-		if !globalUserManager.IsAdminUser(username) {
+		if !globalUserManager.IsAdminUser(caller) {
 			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
 		}
-		if r.Method == http.MethodGet {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]string{"url": GetLLMURL()})
-			return
-		}
-		if r.Method == http.MethodPut {
-			var body struct {
-				URL string `json:"url"`
-			}
-			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-				http.Error(w, "Invalid request body", http.StatusBadRequest)
+
+		switch r.Method {
+		case http.MethodGet:
+			if name := r.URL.Query().Get("name"); name != "" {
+				p, err := backupPath(name)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				}
+				w.Header().Set("Content-Type", "application/zip")
+				w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+				http.ServeFile(w, r, p)
 				return
 			}
-			if err := SetLLMURL(body.URL); err != nil {
-				http.Error(w, "Failed to save LLM settings: "+err.Error(), http.StatusInternalServerError)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(ListBackups())
+		case http.MethodPost:
+			restoreMu.Lock()
+			info, err := CreateLocalBackup("backup")
+			restoreMu.Unlock()
+			if err != nil {
+				http.Error(w, "Backup failed: "+err.Error(), http.StatusInternalServerError)
 				return
 			}
 			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]string{"url": GetLLMURL()})
-			return
+			json.NewEncoder(w).Encode(info)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Admin: restore from a backup zip, uploaded as multipart field "file" or
+	// named with ?backup= from /api/admin/backups.
+	// ?scope=all|project|sheet with project= and sheet_name= as needed.
+	http.HandleFunc("/api/admin/restore", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		caller, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !globalUserManager.IsAdminUser(caller) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		q := r.URL.Query()
+		req := RestoreRequest{Scope: q.Get("scope"), Project: q.Get("project"), Sheet: q.Get("sheet_name")}
+		if req.Scope == "" {
+			req.Scope = RestoreScopeAll
+		}
+		switch req.Scope {
+		case RestoreScopeAll:
+			req.Project, req.Sheet = "", ""
+		case RestoreScopeProject:
+			if req.Project == "" {
+				http.Error(w, "project is required", http.StatusBadRequest)
+				return
+			}
+			req.Sheet = ""
+		case RestoreScopeSheet:
+			if req.Sheet == "" {
+				http.Error(w, "sheet_name is required", http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "scope must be all, project or sheet", http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(req.Project, "..") || strings.HasPrefix(req.Project, "/") || strings.Contains(req.Sheet, "..") || strings.Contains(req.Sheet, "/") {
+			http.Error(w, "Invalid project or sheet name", http.StatusBadRequest)
+			return
+		}
+
+		// Open the archive from the backup directory or the upload
+		var archivePath string
+		if name := q.Get("backup"); name != "" {
+			if archivePath, err = backupPath(name); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		} else {
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				http.Error(w, "backup file is required", http.StatusBadRequest)
+				return
+			}
+			defer file.Close()
+			tmp, err := os.CreateTemp("", "restore-*.zip")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer os.Remove(tmp.Name())
+			_, err = io.Copy(tmp, file)
+			tmp.Close()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			archivePath = tmp.Name()
+		}
+		zr, err := zip.OpenReader(archivePath)
+		if err != nil {
+			http.Error(w, "Invalid backup archive: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer zr.Close()
+
+		result, err := RestoreBackup(&zr.Reader, req, caller)
+		if err != nil {
+			var invalid *BackupValidationError
+			if errors.As(err, &invalid) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "files": invalid.Files})
+				return
+			}
+			if result.SafetyBackup == "" {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "Restore failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+
+	// Admin: list sheets flagged by the integrity check, diff one against a
+	// snapshot (GET) or repair it (POST)
+	http.HandleFunc("/api/admin/repair", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		caller, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !globalUserManager.IsAdminUser(caller) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		var req RepairRequest
+		switch r.Method {
+		case http.MethodGet:
+			q := r.URL.Query()
+			req = RepairRequest{Project: q.Get("project"), Sheet: q.Get("sheet_name"), Source: q.Get("source"), Backup: q.Get("backup")}
+			if req.Sheet == "" {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(FlaggedSheets())
+				return
+			}
+		case http.MethodPost:
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.Sheet == "" {
+				http.Error(w, "sheet_name is required", http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if strings.Contains(req.Project, "..") || strings.HasPrefix(req.Project, "/") || strings.Contains(req.Sheet, "..") || strings.Contains(req.Sheet, "/") {
+			http.Error(w, "Invalid project or sheet name", http.StatusBadRequest)
+			return
+		}
+
+		var resp interface{}
+		if r.Method == http.MethodGet {
+			resp, err = RepairReportFor(req.Project, req.Sheet, req.Source, req.Backup)
+		} else {
+			var result RepairResult
+			result, err = RepairSheet(req, caller)
+			if err != nil && result.SafetyBackup != "" {
+				http.Error(w, "Repair failed: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			resp = result
+		}
+		if err != nil {
+			var invalid *BackupValidationError
+			switch {
+			case errors.Is(err, errNotFlagged):
+				http.Error(w, err.Error(), http.StatusNotFound)
+			case errors.As(err, &invalid):
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "files": invalid.Files})
+			default:
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+
+	// ── Admin: GET/PUT /api/admin/llm  (LLM URL configuration)
+	http.HandleFunc("/api/admin/llm", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		token := r.Header.Get("Authorization")
+		username, err := globalUserManager.ValidateToken(token)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !globalUserManager.IsAdminUser(username) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"url": GetLLMURL()})
+			return
+		}
+		if r.Method == http.MethodPut {
+			var body struct {
+				URL string `json:"url"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			if err := SetLLMURL(body.URL); err != nil {
+				http.Error(w, "Failed to save LLM settings: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"url": GetLLMURL()})
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	})
+
+	// Admin: email and webhook delivery of notifications
+	http.HandleFunc("/api/admin/notifications", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		token := r.Header.Get("Authorization")
+		username, err := globalUserManager.ValidateToken(token)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !globalUserManager.IsAdminUser(username) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		// The password is never sent back, only whether one is set
+		view := func() map[string]interface{} {
+			s := GetNotificationSettings()
+			return map[string]interface{}{
+				"smtp_host":         s.SMTPHost,
+				"smtp_port":         s.SMTPPort,
+				"smtp_username":     s.SMTPUsername,
+				"smtp_password_set": s.SMTPPassword != "",
+				"smtp_from":         s.SMTPFrom,
+				"allow_webhooks":    s.AllowWebhooks,
+			}
+		}
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(view())
+			return
+		}
+		if r.Method == http.MethodPut {
+			var body struct {
+				NotificationSettings
+				ClearPassword bool `json:"clear_password"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			// An empty password keeps the stored one
+			if body.SMTPPassword == "" && !body.ClearPassword {
+				body.SMTPPassword = GetNotificationSettings().SMTPPassword
+			}
+			if err := SetNotificationSettings(body.NotificationSettings); err != nil {
+				http.Error(w, "Failed to save notification settings: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(view())
+			return
 		}
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	})
@@ -1023,7 +1642,8 @@ func main() {
 			return
 		}
 		token := r.Header.Get("Authorization")
-		if _, err := globalUserManager.ValidateToken(token); err != nil {
+		username, err := globalUserManager.ValidateToken(token)
+		if err != nil {
 			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
 			return
 		}
@@ -1033,6 +1653,10 @@ func main() {
 			json.NewEncoder(w).Encode([]struct{}{})
 			return
 		}
+		if !canReadProject(project, username) {
+			http.Error(w, "Forbidden: no access to this project", http.StatusForbidden)
+			return
+		}
 
 		type CorruptedFile struct {
 			Name    string `json:"name"`
@@ -1114,15 +1738,11 @@ func main() {
 
 		if r.Method == "GET" {
 			// Optional project filter via query parameter (e.g. /api/sheets?project=ProjectA)
+			// Sheets the user may not read are left out
 			project := r.URL.Query().Get("project")
-			all := globalSheetManager.ListSheets()
-			if project == "" {
-				json.NewEncoder(w).Encode(all)
-				return
-			}
 			filtered := make([]*Sheet, 0)
-			for _, s := range all {
-				if s != nil && s.ProjectName == project {
+			for _, s := range globalSheetManager.ListSheets() {
+				if s != nil && (project == "" || s.ProjectName == project) && s.CanRead(username) {
 					filtered = append(filtered, s)
 				}
 			}
@@ -1155,7 +1775,7 @@ func main() {
 				} else {
 					dir = dataDir
 				}
-				if _, statErr := os.Stat(filepath.Join(dir, req.Name+".json")); statErr == nil {
+				if _, statErr := os.Stat(filepath.Join(dir, req.Name+".json")); statErr == nil || globalSheetManager.GetSheetBy(req.Name, req.ProjectName) != nil {
 					http.Error(w, "A sheet with that name already exists", http.StatusConflict)
 					return
 				}
@@ -1172,6 +1792,10 @@ func main() {
 					http.Error(w, "Forbidden: only the project owner or admin can create sheets here", http.StatusForbidden)
 					return
 				}
+				if !canReadProject(req.ProjectName, username) {
+					http.Error(w, "Forbidden: no access to this project", http.StatusForbidden)
+					return
+				}
 			}
 			// Use authenticated username instead of client-provided user
 			sheet := globalSheetManager.CreateSheet(req.Name, username, req.ProjectName, req.SheetType)
@@ -1222,7 +1846,7 @@ func main() {
 				} else {
 					dir = dataDir
 				}
-				if _, statErr := os.Stat(filepath.Join(dir, req.Name+".json")); statErr == nil {
+				if _, statErr := os.Stat(filepath.Join(dir, req.Name+".json")); statErr == nil || globalSheetManager.GetSheetBy(req.Name, req.ProjectName) != nil {
 					http.Error(w, "A sheet with that name already exists", http.StatusConflict)
 					return
 				}
@@ -1261,6 +1885,16 @@ func main() {
 					return
 				}
 			}
+			// Cells in other sheets that still reference this one block the
+			// delete unless mode=force or mode=rewrite is given.
+			if s != nil {
+				if refs, ok := globalSheetManager.CheckSheetDelete(id, project, r.URL.Query().Get("mode"), username); !ok {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusConflict)
+					json.NewEncoder(w).Encode(map[string]interface{}{"error": "Sheet is referenced by other sheets", "references": refs})
+					return
+				}
+			}
 			// Project-aware delete
 			if !globalSheetManager.DeleteSheetBy(id, project) {
 				http.Error(w, "Sheet not found", http.StatusNotFound)
@@ -1310,10 +1944,13 @@ func main() {
 				Owner    string   `json:"owner,omitempty"`
 				Admins   []string `json:"admins,omitempty"`
 				ReadOnly bool     `json:"read_only,omitempty"` // true when common files or a sheet in this project is corrupt
+				Public   bool     `json:"public_endpoints,omitempty"`
+				Role     Role     `json:"role"` // the user's project role
 			}
 			projects := make([]Project, 0)
 			for _, e := range entries {
-				if e.IsDir() {
+				// Projects the user has no access to are left out
+				if e.IsDir() && canReadProject(e.Name(), username) {
 					owner := globalProjectMeta.GetOwner(e.Name())
 					admins := globalProjectMeta.GetAdmins(e.Name())
 					if admins == nil {
@@ -1321,7 +1958,8 @@ func main() {
 					}
 					// Mark project read-only only when files inside it are corrupt
 					projectReadOnly := globalIntegrity.ProjectHasCorruption(e.Name())
-					projects = append(projects, Project{Name: e.Name(), Owner: owner, Admins: admins, ReadOnly: projectReadOnly})
+					projects = append(projects, Project{Name: e.Name(), Owner: owner, Admins: admins, ReadOnly: projectReadOnly, Public: globalProjectMeta.GetPublicEndpoints(e.Name()),
+						Role: globalProjectMeta.ProjectRole(e.Name(), username)})
 				}
 			}
 			w.Header().Set("Content-Type", "application/json")
@@ -1379,10 +2017,19 @@ func main() {
 				http.Error(w, "A project or folder with that name already exists", http.StatusConflict)
 				return
 			}
+			// Write pending audit records under the old path before it moves.
+			globalAuditLog.FlushAll()
 			if err := os.Rename(oldPath, newPath); err != nil {
 				http.Error(w, "Failed to rename project", http.StatusInternalServerError)
 				return
 			}
+			if err := globalStore.RenameProject(req.OldName, req.NewName); err != nil {
+				log.Printf("Error renaming project %s to %s in the store: %v", req.OldName, req.NewName, err)
+			}
+			globalAuditLog.RenameProject(req.OldName, req.NewName)
+			globalUndo.RenameProject(req.OldName, req.NewName)
+			globalRevisions.RenameProject(req.OldName, req.NewName)
+			globalNotifications.RenameProject(req.OldName, req.NewName)
 			// Preserve project owner mapping on rename
 			globalProjectMeta.Rename(req.OldName, req.NewName)
 			// Update in-memory sheets' ProjectName (including sheets in subfolders)
@@ -1423,13 +2070,28 @@ func main() {
 				http.Error(w, "Forbidden: owner or admin only", http.StatusForbidden)
 				return
 			}
+			// Cells in other projects that still reference this one block the
+			// delete unless mode=force or mode=rewrite is given.
+			if refs, ok := globalSheetManager.CheckProjectDelete(name, r.URL.Query().Get("mode"), username); !ok {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(map[string]interface{}{"error": "Project is referenced by other projects", "references": refs})
+				return
+			}
 			// Delete sheets in memory and files
 			globalSheetManager.DeleteSheetsByProject(name)
+			globalAuditLog.DropProject(name)
+			globalUndo.DropProject(name)
+			globalRevisions.DropProject(name)
+			globalNotifications.DropProject(name)
 			// Remove directory
 			if err := os.RemoveAll(filepath.Join(dataDir, name)); err != nil {
 				http.Error(w, "Failed to delete project", http.StatusInternalServerError)
 				return
 			}
+			if err := globalStore.DeleteProject(name); err != nil {
+				log.Printf("Error deleting project %s from the store: %v", name, err)
+			}
 			// Remove project ownership meta
 			globalProjectMeta.Delete(name)
 			w.Header().Set("Content-Type", "application/json")
@@ -1466,6 +2128,10 @@ func main() {
 				http.Error(w, "project is required", http.StatusBadRequest)
 				return
 			}
+			if !canReadProject(project, username) {
+				http.Error(w, "Forbidden: no access to this project", http.StatusForbidden)
+				return
+			}
 			admins := globalProjectMeta.GetAdmins(project)
 			if admins == nil {
 				admins = []string{}
@@ -1497,8 +2163,8 @@ func main() {
 				http.Error(w, "Forbidden: only the project owner can manage admins", http.StatusForbidden)
 				return
 			}
-			if !globalUserManager.Exists(req.Admin) {
-				http.Error(w, "User does not exist", http.StatusBadRequest)
+			if !knownUserOrGroup(req.Admin) {
+				http.Error(w, "User or group does not exist", http.StatusBadRequest)
 				return
 			}
 			if req.Admin == owner {
@@ -1506,6 +2172,7 @@ func main() {
 				return
 			}
 			globalProjectMeta.AddAdmin(req.Project, req.Admin)
+			notifyAccessChanged(req.Project)
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]string{"message": "Admin added"})
 			return
@@ -1525,6 +2192,7 @@ func main() {
 				return
 			}
 			globalProjectMeta.RemoveAdmin(project, admin)
+			notifyAccessChanged(project)
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]string{"message": "Admin removed"})
 			return
@@ -1533,12 +2201,19 @@ func main() {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	})
 
-	// Folders API: list/create subfolders under a project path
-	http.HandleFunc("/api/folders", func(w http.ResponseWriter, r *http.Request) {
+	// Script limits API: per-project override of the server script limits.
+	// GET returns server defaults, the project override and the effective limits;
+	// POST { project, limits } sets the override; DELETE ?project= clears it.
+	http.HandleFunc("/api/projects/script-limits", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
 		token := r.Header.Get("Authorization")
 		username, err := globalUserManager.ValidateToken(token)
 		if err != nil {
@@ -1546,44 +2221,373 @@ func main() {
 			return
 		}
 
-		switch r.Method {
-		case http.MethodGet:
-			// Query immediate subfolders of the given project path
-			projectPath := r.URL.Query().Get("project")
-			if projectPath == "" {
+		if r.Method == http.MethodGet {
+			project := r.URL.Query().Get("project")
+			if project == "" {
 				http.Error(w, "project is required", http.StatusBadRequest)
 				return
 			}
-			abs := filepath.Join(dataDir, projectPath)
-			entries, err := os.ReadDir(abs)
-			if err != nil {
-				http.Error(w, "Failed to read folders", http.StatusInternalServerError)
+			if !canReadProject(project, username) {
+				http.Error(w, "Forbidden: no access to this project", http.StatusForbidden)
 				return
 			}
-			type Folder struct {
-				Name string `json:"name"`
-			}
-			folders := make([]Folder, 0)
-			for _, e := range entries {
-				if e.IsDir() && e.Name() != "assets" {
-					folders = append(folders, Folder{Name: e.Name()})
-				}
-			}
+			topProject := strings.SplitN(project, "/", 2)[0]
 			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(folders)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"server":    serverScriptLimits,
+				"project":   globalProjectMeta.GetScriptLimits(topProject),
+				"effective": EffectiveScriptLimits(topProject),
+			})
 			return
+		}
 
-		case http.MethodPost:
-			// Create a subfolder under the given parent project path
+		if r.Method == http.MethodPost || r.Method == http.MethodDelete {
 			var req struct {
-				Parent string `json:"parent"`
-				Name   string `json:"name"`
-			}
-			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Parent == "" || req.Name == "" {
-				http.Error(w, "parent and name required", http.StatusBadRequest)
-				return
+				Project string        `json:"project"`
+				Limits  *ScriptLimits `json:"limits"`
 			}
-			// Only allow creation under an existing top-level project owned/administered by user
+			if r.Method == http.MethodPost {
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if req.Limits == nil {
+					http.Error(w, "limits required", http.StatusBadRequest)
+					return
+				}
+				if req.Limits.TimeoutSeconds < 0 || req.Limits.CPUSeconds < 0 || req.Limits.MemoryMB < 0 || req.Limits.MaxOutputKB < 0 {
+					http.Error(w, "limits must not be negative", http.StatusBadRequest)
+					return
+				}
+			} else {
+				req.Project = r.URL.Query().Get("project")
+			}
+			if req.Project == "" {
+				http.Error(w, "project is required", http.StatusBadRequest)
+				return
+			}
+			topProject := strings.SplitN(req.Project, "/", 2)[0]
+			if !globalUserManager.IsAdminUser(username) && !globalProjectMeta.IsProjectAdmin(topProject, username) {
+				http.Error(w, "Forbidden: only project admins can change script limits", http.StatusForbidden)
+				return
+			}
+			globalProjectMeta.SetScriptLimits(topProject, req.Limits)
+			effective := EffectiveScriptLimits(topProject)
+			details := "Cleared script limit override"
+			if req.Limits != nil {
+				details = fmt.Sprintf("Set script limits: timeout=%ds cpu=%ds memory=%dMB output=%dKB network=%t",
+					effective.TimeoutSeconds, effective.CPUSeconds, effective.MemoryMB, effective.MaxOutputKB, effective.networkAllowed())
+			}
+			globalProjectAuditManager.Append(topProject, username, "SCRIPT_LIMITS", details)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"effective": effective})
+			return
+		}
+
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	})
+
+	// Project members: GET ?project= returns the owner, admins, member roles,
+	// the default role and the caller's role; PUT { project, user, role } sets
+	// a member's role ("" removes them) and PUT { project, default_role } sets
+	// the role of everyone else.
+	http.HandleFunc("/api/projects/members", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		username, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			project := r.URL.Query().Get("project")
+			if project == "" {
+				http.Error(w, "project is required", http.StatusBadRequest)
+				return
+			}
+			if !canReadProject(project, username) {
+				http.Error(w, "Forbidden: no access to this project", http.StatusForbidden)
+				return
+			}
+			topProject := strings.SplitN(project, "/", 2)[0]
+			members, defaultRole := globalProjectMeta.GetMembers(topProject)
+			admins := globalProjectMeta.GetAdmins(topProject)
+			if admins == nil {
+				admins = []string{}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"project":      topProject,
+				"owner":        globalProjectMeta.GetOwner(topProject),
+				"admins":       admins,
+				"members":      members,
+				"default_role": defaultRole,
+				"role":         globalProjectMeta.ProjectRole(topProject, username),
+			})
+		case http.MethodPut:
+			var req struct {
+				Project     string `json:"project"`
+				User        string `json:"user"`
+				Role        Role   `json:"role"`
+				DefaultRole Role   `json:"default_role"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.Project == "" || (req.User == "") == (req.DefaultRole == "") {
+				http.Error(w, "project and either user or default_role are required", http.StatusBadRequest)
+				return
+			}
+			topProject := strings.SplitN(req.Project, "/", 2)[0]
+			if !globalUserManager.IsAdminUser(username) && !globalProjectMeta.IsProjectAdmin(topProject, username) {
+				http.Error(w, "Forbidden: only project admins can change members", http.StatusForbidden)
+				return
+			}
+			var details string
+			if req.User != "" {
+				if req.Role != "" && !memberRole(req.Role) {
+					http.Error(w, "role must be editor, commenter, viewer or none", http.StatusBadRequest)
+					return
+				}
+				if !knownUserOrGroup(req.User) {
+					http.Error(w, "User or group does not exist", http.StatusBadRequest)
+					return
+				}
+				if req.User == globalProjectMeta.GetOwner(topProject) || globalProjectMeta.IsProjectAdmin(topProject, req.User) {
+					http.Error(w, "The owner and admins always have full access", http.StatusConflict)
+					return
+				}
+				globalProjectMeta.SetMemberRole(topProject, req.User, req.Role)
+				details = fmt.Sprintf("Set role of %s to %s", req.User, req.Role)
+				if req.Role == "" {
+					details = fmt.Sprintf("Removed member %s", req.User)
+				}
+			} else {
+				if !memberRole(req.DefaultRole) {
+					http.Error(w, "default_role must be editor, commenter, viewer or none", http.StatusBadRequest)
+					return
+				}
+				globalProjectMeta.SetDefaultRole(topProject, req.DefaultRole)
+				details = fmt.Sprintf("Set default role to %s", req.DefaultRole)
+			}
+			globalProjectAuditManager.Append(topProject, username, "MEMBERS", details)
+			notifyAccessChanged(topProject)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"message": details})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Public endpoints switch: GET ?project= returns whether /api/public/sheet/*
+	// serve the project without a token; PUT { project, enabled } changes it.
+	http.HandleFunc("/api/projects/public", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		username, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			project := r.URL.Query().Get("project")
+			if project == "" {
+				http.Error(w, "project is required", http.StatusBadRequest)
+				return
+			}
+			if !canReadProject(project, username) {
+				http.Error(w, "Forbidden: no access to this project", http.StatusForbidden)
+				return
+			}
+			topProject := strings.SplitN(project, "/", 2)[0]
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"project": topProject, "enabled": globalProjectMeta.GetPublicEndpoints(topProject)})
+		case http.MethodPut:
+			var req struct {
+				Project string `json:"project"`
+				Enabled bool   `json:"enabled"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.Project == "" {
+				http.Error(w, "project is required", http.StatusBadRequest)
+				return
+			}
+			topProject := strings.SplitN(req.Project, "/", 2)[0]
+			if !globalUserManager.IsAdminUser(username) && !globalProjectMeta.IsProjectAdmin(topProject, username) {
+				http.Error(w, "Forbidden: only project admins can change public access", http.StatusForbidden)
+				return
+			}
+			globalProjectMeta.SetPublicEndpoints(topProject, req.Enabled)
+			details := "Disabled public endpoints"
+			if req.Enabled {
+				details = "Enabled public endpoints"
+			}
+			globalProjectAuditManager.Append(topProject, username, "PUBLIC_ENDPOINTS", details)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"project": topProject, "enabled": req.Enabled})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Audit retention: GET ?project= returns how many days the project's sheet
+	// audit logs keep their entries (0 = forever) and whether removed entries
+	// are archived; PUT { project, days, archive } changes it and applies it.
+	http.HandleFunc("/api/projects/audit-retention", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		username, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			project := r.URL.Query().Get("project")
+			if project == "" {
+				http.Error(w, "project is required", http.StatusBadRequest)
+				return
+			}
+			if !canReadProject(project, username) {
+				http.Error(w, "Forbidden: no access to this project", http.StatusForbidden)
+				return
+			}
+			topProject := strings.SplitN(project, "/", 2)[0]
+			retention := AuditRetention{}
+			if cur := globalProjectMeta.GetAuditRetention(topProject); cur != nil {
+				retention = *cur
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"project": topProject, "days": retention.Days, "archive": retention.Archive})
+		case http.MethodPut:
+			var req struct {
+				Project string `json:"project"`
+				Days    int    `json:"days"`
+				Archive bool   `json:"archive"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.Project == "" {
+				http.Error(w, "project is required", http.StatusBadRequest)
+				return
+			}
+			if req.Days < 0 {
+				http.Error(w, "days must not be negative", http.StatusBadRequest)
+				return
+			}
+			topProject := strings.SplitN(req.Project, "/", 2)[0]
+			if !globalUserManager.IsAdminUser(username) && !globalProjectMeta.IsProjectAdmin(topProject, username) {
+				http.Error(w, "Forbidden: only project admins can change audit retention", http.StatusForbidden)
+				return
+			}
+			var retention *AuditRetention
+			details := "Audit log entries are kept forever"
+			if req.Days > 0 || req.Archive {
+				retention = &AuditRetention{Days: req.Days, Archive: req.Archive}
+			}
+			if req.Days > 0 {
+				details = fmt.Sprintf("Audit log entries are kept for %d days", req.Days)
+				if req.Archive {
+					details += " and archived afterwards"
+				}
+			}
+			globalProjectMeta.SetAuditRetention(topProject, retention)
+			globalProjectAuditManager.Append(topProject, username, "AUDIT_RETENTION", details)
+			go applyAuditRetention(topProject)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"project": topProject, "days": req.Days, "archive": req.Archive})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Folders API: list/create subfolders under a project path
+	http.HandleFunc("/api/folders", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		token := r.Header.Get("Authorization")
+		username, err := globalUserManager.ValidateToken(token)
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			// Query immediate subfolders of the given project path
+			projectPath := r.URL.Query().Get("project")
+			if projectPath == "" {
+				http.Error(w, "project is required", http.StatusBadRequest)
+				return
+			}
+			if !canReadProject(projectPath, username) {
+				http.Error(w, "Forbidden: no access to this project", http.StatusForbidden)
+				return
+			}
+			abs := filepath.Join(dataDir, projectPath)
+			entries, err := os.ReadDir(abs)
+			if err != nil {
+				http.Error(w, "Failed to read folders", http.StatusInternalServerError)
+				return
+			}
+			type Folder struct {
+				Name string `json:"name"`
+			}
+			folders := make([]Folder, 0)
+			for _, e := range entries {
+				if e.IsDir() && e.Name() != "assets" && e.Name() != historyDirName {
+					folders = append(folders, Folder{Name: e.Name()})
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(folders)
+			return
+
+		case http.MethodPost:
+			// Create a subfolder under the given parent project path
+			var req struct {
+				Parent string `json:"parent"`
+				Name   string `json:"name"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Parent == "" || req.Name == "" {
+				http.Error(w, "parent and name required", http.StatusBadRequest)
+				return
+			}
+			// Only allow creation under an existing top-level project owned/administered by user
 			top := strings.Split(req.Parent, string(os.PathSeparator))[0]
 			owner := globalProjectMeta.GetOwner(top)
 			if owner != "" && !globalProjectMeta.IsProjectAdmin(top, username) {
@@ -1595,7 +2599,7 @@ func main() {
 				http.Error(w, "A folder or sheet with that name already exists", http.StatusConflict)
 				return
 			}
-			if _, statErr := os.Stat(filepath.Join(dataDir, req.Parent, req.Name+".json")); statErr == nil {
+			if _, statErr := os.Stat(filepath.Join(dataDir, req.Parent, req.Name+".json")); statErr == nil || globalSheetManager.GetSheetBy(req.Name, req.Parent) != nil {
 				http.Error(w, "A sheet with that name already exists", http.StatusConflict)
 				return
 			}
@@ -1642,10 +2646,12 @@ func main() {
 				http.Error(w, "A folder or sheet with that name already exists", http.StatusConflict)
 				return
 			}
-			if _, statErr := os.Stat(filepath.Join(dataDir, req.Parent, req.NewName+".json")); statErr == nil {
+			if _, statErr := os.Stat(filepath.Join(dataDir, req.Parent, req.NewName+".json")); statErr == nil || globalSheetManager.GetSheetBy(req.NewName, req.Parent) != nil {
 				http.Error(w, "A sheet with that name already exists", http.StatusConflict)
 				return
 			}
+			// Write pending audit records under the old path before it moves.
+			globalAuditLog.FlushAll()
 			if err := os.Rename(oldPath, newPath); err != nil {
 				http.Error(w, "Failed to rename folder", http.StatusInternalServerError)
 				return
@@ -1657,6 +2663,13 @@ func main() {
 			} else {
 				fullNewPath = req.NewName
 			}
+			if err := globalStore.RenameProject(fullOldPath, fullNewPath); err != nil {
+				log.Printf("Error renaming folder %s to %s in the store: %v", fullOldPath, fullNewPath, err)
+			}
+			globalAuditLog.RenameProject(fullOldPath, fullNewPath)
+			globalUndo.RenameProject(fullOldPath, fullNewPath)
+			globalRevisions.RenameProject(fullOldPath, fullNewPath)
+			globalNotifications.RenameProject(fullOldPath, fullNewPath)
 			for _, s := range globalSheetManager.ListSheets() {
 				if s.ProjectName == fullOldPath || strings.HasPrefix(s.ProjectName, fullOldPath+"/") {
 					s.mu.Lock()
@@ -1725,6 +2738,9 @@ func main() {
 				http.Error(w, "source_sheet_id and dest_path required for sheet paste", http.StatusBadRequest)
 				return
 			}
+			if readableSheet(w, req.SourceSheetID, req.SourcePath, username) == nil {
+				return
+			}
 			newName := req.DestName
 			if newName == "" {
 				newName = req.SourceSheetID
@@ -1785,6 +2801,13 @@ func main() {
 			http.Error(w, "Source path not found", http.StatusNotFound)
 			return
 		}
+		// Every sheet copied must be one the user may read
+		for _, s := range globalSheetManager.ListSheets() {
+			if (s.ProjectName == req.SourcePath || strings.HasPrefix(s.ProjectName, req.SourcePath+"/")) && !s.CanRead(username) {
+				http.Error(w, "Forbidden: some sheets in the source are not shared with you", http.StatusForbidden)
+				return
+			}
+		}
 		// Ensure destination doesn't exist
 		if _, err := os.Stat(filepath.Join(dataDir, req.DestPath)); err == nil {
 			http.Error(w, "Destination already exists", http.StatusConflict)
@@ -1833,7 +2856,7 @@ func main() {
 			return
 		}
 		token := r.Header.Get("Authorization")
-		_, err := globalUserManager.ValidateToken(token)
+		username, err := globalUserManager.ValidateToken(token)
 		if err != nil {
 			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
 			return
@@ -1843,6 +2866,10 @@ func main() {
 			http.Error(w, "project is required", http.StatusBadRequest)
 			return
 		}
+		if !canReadProject(project, username) {
+			http.Error(w, "Forbidden: no access to this project", http.StatusForbidden)
+			return
+		}
 		entries := globalProjectAuditManager.List(project)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(entries)
@@ -1865,7 +2892,7 @@ func main() {
 		}
 
 		token := r.Header.Get("Authorization")
-		_, err := globalUserManager.ValidateToken(token)
+		username, err := globalUserManager.ValidateToken(token)
 		if err != nil {
 			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
 			return
@@ -1877,54 +2904,1206 @@ func main() {
 			return
 		}
 		project := r.URL.Query().Get("project")
-		sheet := globalSheetManager.GetSheetBy(id, project)
+		sheet := readableSheet(w, id, project, username)
 		if sheet == nil {
-			http.Error(w, "Sheet not found", http.StatusNotFound)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
+		// rows=FROM-TO (or FROM-) returns only those rows, for paging large sheets
+		if rows := r.URL.Query().Get("rows"); rows != "" {
+			from, to, ok := strings.Cut(rows, "-")
+			fromRow, err := strconv.Atoi(from)
+			if !ok || err != nil || fromRow < 1 {
+				http.Error(w, "rows must be FROM-TO", http.StatusBadRequest)
+				return
+			}
+			toRow, _ := strconv.Atoi(to)
+			json.NewEncoder(w).Encode(sheetPageOf(sheet.SnapshotForClient(), fromRow, toRow))
+			return
+		}
 		json.NewEncoder(w).Encode(sheet.SnapshotForClient())
 	})
 
-	// List all usernames (for selection)
-	http.HandleFunc("/api/users", func(w http.ResponseWriter, r *http.Request) {
+	// Dependency graph of a sheet: the script, formula, AI and options cells of
+	// the sheet plus everything downstream of them, with any reference cycles.
+	http.HandleFunc("/api/sheet/dependency-graph", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
-		if r.Method == "OPTIONS" {
+		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		token := r.Header.Get("Authorization")
+		username, err := globalUserManager.ValidateToken(token)
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		sheetName := r.URL.Query().Get("sheet_name")
+		project := r.URL.Query().Get("project")
+		if sheetName == "" {
+			http.Error(w, "sheet_name is required", http.StatusBadRequest)
+			return
+		}
+		sheet := readableSheet(w, sheetName, project, username)
+		if sheet == nil {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(globalSheetManager.SheetDependencyGraph(sheet).VisibleTo(username))
+	})
+
+	// Trace a cell: transitive precedents (what it reads) and dependents (what
+	// is recalculated when it changes), across sheets and projects.
+	http.HandleFunc("/api/sheet/dependencies", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		token := r.Header.Get("Authorization")
+		username, err := globalUserManager.ValidateToken(token)
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		sheetName := r.URL.Query().Get("sheet_name")
+		project := r.URL.Query().Get("project")
+		cell := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("cell")))
+		if sheetName == "" || cell == "" {
+			http.Error(w, "sheet_name and cell are required", http.StatusBadRequest)
+			return
+		}
+		col, row := parseCellLabel(cell)
+		if colLabelToIndex(col) == 0 || atoiSafe(row) <= 0 {
+			http.Error(w, "cell must be a reference like A1", http.StatusBadRequest)
+			return
+		}
+		if readableSheet(w, sheetName, project, username) == nil {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(globalSheetManager.CellDependencies(project, sheetName, row, col).VisibleTo(username))
+	})
+
+	// Read a range as JSON: GET /api/sheet/values?project=&sheet_name=&range=A1:D20
+	// (or a cell name) with optional offset/limit paging by row.
+	http.HandleFunc("/api/sheet/values", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		token := r.Header.Get("Authorization")
+		username, err := globalUserManager.ValidateToken(token)
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		q := r.URL.Query()
+		sheetName := q.Get("sheet_name")
+		project := q.Get("project")
+		if sheetName == "" {
+			http.Error(w, "sheet_name is required", http.StatusBadRequest)
+			return
+		}
+		offset, limit := 0, 0
+		if v := q.Get("offset"); v != "" {
+			if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+				http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("limit"); v != "" {
+			if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+				http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+				return
+			}
+		}
+		sheet := readableSheet(w, sheetName, project, username)
+		if sheet == nil {
+			return
+		}
+
+		values, err := sheet.ReadValues(q.Get("range"), offset, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(values)
+	})
+
+	// Batch cell write: PATCH /api/sheet/cells?project=&sheet_name= with
+	// { "edits": [ { "cell": "B4", "value": "42" }, { "cell": "C1", "script": "...", "style": {...} } ] }
+	http.HandleFunc("/api/sheet/cells", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "PATCH, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if r.Method != http.MethodPatch {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		username, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		sheetName := r.URL.Query().Get("sheet_name")
+		project := r.URL.Query().Get("project")
+		if sheetName == "" {
+			http.Error(w, "sheet_name is required", http.StatusBadRequest)
+			return
+		}
+		sheet := globalSheetManager.GetSheetBy(sheetName, project)
+		if sheet == nil {
+			http.Error(w, "Sheet not found", http.StatusNotFound)
+			return
+		}
+		if !sheet.IsEditor(username) {
+			http.Error(w, "Forbidden: not an editor of this sheet", http.StatusForbidden)
+			return
+		}
+		if sheet.ReadOnly {
+			http.Error(w, "Sheet is read-only (integrity check failed)", http.StatusConflict)
+			return
+		}
+
+		var req struct {
+			Edits []CellEdit `json:"edits"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		results, err := sheet.ApplyCellEdits(req.Edits, username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		applied := 0
+		for _, res := range results {
+			if res.Status == "applied" {
+				applied++
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"applied": applied,
+			"skipped": len(results) - applied,
+			"results": results,
+		})
+	})
+
+	// Whole-project dependency graph export. format=json (default) or dot.
+	http.HandleFunc("/api/projects/dependency-graph", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		token := r.Header.Get("Authorization")
+		username, err := globalUserManager.ValidateToken(token)
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		project := r.URL.Query().Get("project")
+		if project == "" {
+			http.Error(w, "project is required", http.StatusBadRequest)
+			return
+		}
+		if !canReadProject(project, username) {
+			http.Error(w, "Forbidden: no access to this project", http.StatusForbidden)
+			return
+		}
+		graph := globalSheetManager.ProjectDependencyGraph(project).VisibleTo(username)
+
+		switch r.URL.Query().Get("format") {
+		case "", "json":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(graph)
+		case "dot":
+			filename := strings.ReplaceAll(project, "/", "_") + "_dependencies.dot"
+			w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+			w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+			w.Write([]byte(graph.DOT(project)))
+		default:
+			http.Error(w, "format must be json or dot", http.StatusBadRequest)
+		}
+	})
+
+	// List all usernames (for selection)
+	http.HandleFunc("/api/users", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token := r.Header.Get("Authorization")
+		_, err := globalUserManager.ValidateToken(token)
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		users := globalUserManager.ListUsernames()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(users)
+	})
+
+	// User preferences: visible rows/cols (common across sheets/projects)
+	http.HandleFunc("/api/user/preferences", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		token := r.Header.Get("Authorization")
+		username, err := globalUserManager.ValidateToken(token)
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			prefs, err := globalUserManager.GetPreferences(username)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(prefs)
+		case http.MethodPut:
+			// Fields left out keep their current value
+			var req struct {
+				VisibleRows   *int               `json:"visible_rows"`
+				VisibleCols   *int               `json:"visible_cols"`
+				Notifications *NotificationPrefs `json:"notifications"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			prefs, err := globalUserManager.GetPreferences(username)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.VisibleRows != nil {
+				prefs.VisibleRows = *req.VisibleRows
+			}
+			if req.VisibleCols != nil {
+				prefs.VisibleCols = *req.VisibleCols
+			}
+			if req.Notifications != nil {
+				if err := req.Notifications.validate(); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				prefs.Notifications = *req.Notifications
+			}
+			if err := globalUserManager.UpdatePreferences(username, prefs); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"message": "preferences updated"})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Get/Update permissions for a sheet
+	http.HandleFunc("/api/sheet/permissions", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		token := r.Header.Get("Authorization")
+		username, err := globalUserManager.ValidateToken(token)
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		sheetName := r.URL.Query().Get("sheet_name")
+		if sheetName == "" {
+			http.Error(w, "sheet_name is required", http.StatusBadRequest)
+			return
+		}
+		project := r.URL.Query().Get("project")
+		sheet := readableSheet(w, sheetName, project, username)
+		if sheet == nil {
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			topProject := strings.SplitN(project, "/", 2)[0]
+			admins := globalProjectMeta.GetAdmins(topProject)
+			if admins == nil {
+				admins = []string{}
+			}
+			resp := map[string]interface{}{
+				"owner":          sheet.Owner,
+				"permissions":    sheet.Permissions,
+				"project_admins": admins,
+				"role":           sheet.RoleOf(username),
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			// Lists left out of the request are kept
+			var req Permissions
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			for _, list := range [][]string{req.Editors, req.Commenters, req.Viewers, req.NoAccess} {
+				for _, name := range list {
+					if isGroupRef(name) && !knownUserOrGroup(name) {
+						http.Error(w, "Group does not exist: "+name, http.StatusBadRequest)
+						return
+					}
+				}
+			}
+			topProject := strings.SplitN(project, "/", 2)[0]
+			isAdmin := globalUserManager.IsAdminUser(username) || globalProjectMeta.IsProjectAdmin(topProject, username)
+			if !sheet.UpdatePermissions(req, username, isAdmin) {
+				http.Error(w, "Forbidden: owner or admin only", http.StatusForbidden)
+				return
+			}
+			notifyAccessChanged(project)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"message": "Permissions updated"})
+			return
+		}
+
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	})
+
+	// Protected ranges: GET /api/sheet/protected?project=&sheet_name= lists
+	// them; POST {project, sheet_name, name, range, editors, warn_only} adds
+	// one, PUT the same with id changes one; DELETE ?project=&sheet_name=&id=
+	// removes one. Only the sheet owner and project admins change them.
+	http.HandleFunc("/api/sheet/protected", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		username, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			q := r.URL.Query()
+			sheet := readableSheet(w, q.Get("sheet_name"), q.Get("project"), username)
+			if sheet == nil {
+				return
+			}
+			ranges := sheet.ProtectedRanges()
+			if ranges == nil {
+				ranges = []ProtectedRange{}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"protected_ranges": ranges,
+				"can_manage":       sheet.CanManage(username),
+			})
+
+		case http.MethodPost, http.MethodPut:
+			var req struct {
+				Project   string `json:"project"`
+				SheetName string `json:"sheet_name"`
+				ProtectedRange
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			sheet := readableSheet(w, req.SheetName, req.Project, username)
+			if sheet == nil {
+				return
+			}
+			if !sheet.CanManage(username) {
+				http.Error(w, "Forbidden: only the sheet owner or a project admin can protect ranges", http.StatusForbidden)
+				return
+			}
+			if r.Method == http.MethodPost {
+				req.ID = ""
+			} else if req.ID == "" {
+				http.Error(w, "id is required", http.StatusBadRequest)
+				return
+			}
+			p, err := sheet.SetProtectedRange(req.ProtectedRange, username)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			globalSheetManager.QueueRowColUpdate(req.Project, req.SheetName)
+			w.Header().Set("Content-Type", "application/json")
+			if r.Method == http.MethodPost {
+				w.WriteHeader(http.StatusCreated)
+			}
+			json.NewEncoder(w).Encode(p)
+
+		case http.MethodDelete:
+			q := r.URL.Query()
+			project, sheetName := q.Get("project"), q.Get("sheet_name")
+			sheet := readableSheet(w, sheetName, project, username)
+			if sheet == nil {
+				return
+			}
+			if !sheet.CanManage(username) {
+				http.Error(w, "Forbidden: only the sheet owner or a project admin can protect ranges", http.StatusForbidden)
+				return
+			}
+			if err := sheet.RemoveProtectedRange(q.Get("id"), username); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			globalSheetManager.QueueRowColUpdate(project, sheetName)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Comment threads of a sheet: GET /api/sheet/comments?project=&sheet_name=
+	// lists them oldest first, &status=open or &status=resolved only those.
+	// Threads are added, resolved and deleted over the WebSocket.
+	http.HandleFunc("/api/sheet/comments", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		username, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		q := r.URL.Query()
+		sheet := readableSheet(w, q.Get("sheet_name"), q.Get("project"), username)
+		if sheet == nil {
+			return
+		}
+		status := q.Get("status")
+		if status != "" && status != "open" && status != "resolved" {
+			http.Error(w, "status must be open or resolved", http.StatusBadRequest)
+			return
+		}
+		threads := []CommentThread{}
+		for _, t := range sheet.CommentThreads() {
+			if status == "" || t.Resolved == (status == "resolved") {
+				threads = append(threads, t)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"comments":    threads,
+			"can_comment": sheet.CanComment(username),
+			"can_manage":  sheet.CanManage(username),
+		})
+	})
+
+	// Notifications: the caller's inbox
+	http.HandleFunc("/api/notifications", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		username, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		q := r.URL.Query()
+		switch r.Method {
+		case http.MethodGet:
+			list, unread := globalNotifications.Inbox(username, q.Get("unread") == "1")
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"notifications": list, "unread": unread})
+		case http.MethodDelete:
+			// ?id= deletes one notification, ?all=1 every read one
+			id := q.Get("id")
+			if id == "" && q.Get("all") != "1" {
+				http.Error(w, "id or all=1 is required", http.StatusBadRequest)
+				return
+			}
+			if err := globalNotifications.Remove(username, id); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"message": "notifications deleted"})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Notifications: mark some or all as read
+	http.HandleFunc("/api/notifications/read", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		username, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			IDs []string `json:"ids"`
+			All bool     `json:"all"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		unread := globalNotifications.MarkRead(username, req.IDs, req.All)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"unread": unread})
+	})
+
+	// Notifications: the cells, ranges and sheets the caller watches
+	http.HandleFunc("/api/notifications/watches", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		username, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		q := r.URL.Query()
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"watches": globalNotifications.Watches(username, q.Get("project"), q.Get("sheet_name")),
+			})
+		case http.MethodPost:
+			var req struct {
+				Project   string `json:"project"`
+				SheetName string `json:"sheet_name"`
+				Range     string `json:"range"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if readableSheet(w, req.SheetName, req.Project, username) == nil {
+				return
+			}
+			watch, err := globalNotifications.AddWatch(username, req.Project, req.SheetName, req.Range)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(watch)
+		case http.MethodDelete:
+			if err := globalNotifications.RemoveWatch(username, q.Get("id")); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"message": "watch removed"})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Notifications: send a test to the caller's email address and webhook
+	http.HandleFunc("/api/notifications/test", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		username, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		prefs, err := globalUserManager.GetPreferences(username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n := Notification{ID: newVersionID(), Kind: "test", Actor: username, Text: "This is a test notification.", Timestamp: time.Now()}
+		// Each channel reports "ok", its error, or that it is not set up
+		result := map[string]string{"email": "no address set", "webhook": "no URL set"}
+		if addr := prefs.Notifications.Email; addr != "" {
+			result["email"] = "ok"
+			if err := sendNotificationEmail(addr, n); err != nil {
+				result["email"] = err.Error()
+			}
+		}
+		if target := prefs.Notifications.WebhookURL; target != "" {
+			result["webhook"] = "ok"
+			if err := postNotificationWebhook(target, username, n); err != nil {
+				result["webhook"] = err.Error()
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+
+	// Transfer ownership of a sheet
+	http.HandleFunc("/api/sheet/transfer_owner", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "PUT, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if r.Method != http.MethodPut {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token := r.Header.Get("Authorization")
+		username, err := globalUserManager.ValidateToken(token)
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			SheetName   string `json:"sheet_name"`
+			NewOwner    string `json:"new_owner"`
+			ProjectName string `json:"project_name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.SheetName == "" || req.NewOwner == "" {
+			http.Error(w, "sheet_name and new_owner required", http.StatusBadRequest)
+			return
+		}
+		isAdmin := globalUserManager.IsAdminUser(username)
+		sheet := globalSheetManager.GetSheetBy(req.SheetName, req.ProjectName)
+
+		if sheet == nil {
+			http.Error(w, "Sheet not found", http.StatusNotFound)
+			return
+		}
+		// Project admins can also transfer ownership
+		topProject := strings.SplitN(req.ProjectName, "/", 2)[0]
+		isProjectAdmin := globalProjectMeta.IsProjectAdmin(topProject, username)
+		if !globalUserManager.Exists(req.NewOwner) {
+			http.Error(w, "new_owner does not exist", http.StatusBadRequest)
+			return
+		}
+		if !sheet.TransferOwnership(req.NewOwner, username, isAdmin || isProjectAdmin) {
+			http.Error(w, "Forbidden: owner only", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Ownership transferred"})
+	})
+
+	// Sheet audit log.
+	// GET /api/sheet/audit?sheet_name=&project= returns entries newest first,
+	// filtered by user, exclude_user, action, cell (e.g. "B4" or a cell name),
+	// from/to (RFC 3339, to exclusive) and q (text), limit per page (default
+	// 100, max 1000) and before=<next_before of the previous page>.
+	// DELETE /api/sheet/audit?sheet_name=<name>&project=<proj>&before_event_id=<timeline-event-id>
+	// deletes the entries before a timeline event. Only the sheet owner or a
+	// project admin can perform this action.
+	http.HandleFunc("/api/sheet/audit", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		token := r.Header.Get("Authorization")
+		username, err := globalUserManager.ValidateToken(token)
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		sheetName := r.URL.Query().Get("sheet_name")
+		project := r.URL.Query().Get("project")
+
+		if r.Method == http.MethodGet {
+			q := r.URL.Query()
+			if sheetName == "" {
+				http.Error(w, "sheet_name is required", http.StatusBadRequest)
+				return
+			}
+			sheet := readableSheet(w, sheetName, project, username)
+			if sheet == nil {
+				return
+			}
+			query := AuditQuery{
+				User:        q.Get("user"),
+				ExcludeUser: q.Get("exclude_user"),
+				Action:      q.Get("action"),
+				Text:        q.Get("q"),
+				Limit:       100,
+			}
+			if cell := strings.TrimSpace(q.Get("cell")); cell != "" {
+				row, col, err := sheet.resolveEditCell(cell)
+				if err != nil {
+					if row, col, err = sheet.resolveEditCell(strings.ToUpper(cell)); err != nil {
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+				}
+				query.Row, query.Col = atoiSafe(row), col
+			}
+			for _, t := range []struct {
+				name string
+				dst  *time.Time
+			}{{"from", &query.From}, {"to", &query.To}} {
+				if v := q.Get(t.name); v != "" {
+					if *t.dst, err = time.Parse(time.RFC3339, v); err != nil {
+						http.Error(w, t.name+" must be an RFC 3339 time", http.StatusBadRequest)
+						return
+					}
+				}
+			}
+			if v := q.Get("before"); v != "" {
+				if query.Before, err = strconv.ParseInt(v, 10, 64); err != nil || query.Before <= 0 {
+					http.Error(w, "before must be a positive integer", http.StatusBadRequest)
+					return
+				}
+			}
+			if v := q.Get("limit"); v != "" {
+				if query.Limit, err = strconv.Atoi(v); err != nil || query.Limit <= 0 {
+					http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+					return
+				}
+				if query.Limit > 1000 {
+					query.Limit = 1000
+				}
+			}
+			sheet.mu.RLock()
+			page := globalAuditLog.Query(sheet.ProjectName, sheet.Name, query, func(e AuditEntry) string {
+				return computeAuditDetails(sheet, e)
+			})
+			sheet.mu.RUnlock()
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(page)
+			return
+		}
+
+		beforeEventID := r.URL.Query().Get("before_event_id")
+
+		if sheetName == "" || beforeEventID == "" {
+			http.Error(w, "sheet_name and before_event_id are required", http.StatusBadRequest)
+			return
+		}
+
+		sheet := globalSheetManager.GetSheetBy(sheetName, project)
+		if sheet == nil {
+			http.Error(w, "Sheet not found", http.StatusNotFound)
+			return
+		}
+
+		// Permission check: sheet owner or project admin only
+		topProject := strings.SplitN(project, "/", 2)[0]
+		isAdmin := globalUserManager.IsAdminUser(username) || globalProjectMeta.IsProjectAdmin(topProject, username)
+		sheet.mu.RLock()
+		isSheetOwner := sheet.Owner == username
+		sheet.mu.RUnlock()
+		if !isSheetOwner && !isAdmin {
+			http.Error(w, "Forbidden: sheet owner or project admin only", http.StatusForbidden)
+			return
+		}
+
+		// Load the project timeline to find the event's timestamp
+		cutoff, tlErr := timelineEventTime(topProject, beforeEventID)
+		if tlErr != nil {
+			switch {
+			case errors.Is(tlErr, os.ErrNotExist):
+				http.Error(w, "Timeline not found for this project", http.StatusNotFound)
+			case errors.Is(tlErr, errTimelineEventNotFound):
+				http.Error(w, "Timeline event not found", http.StatusNotFound)
+			default:
+				http.Error(w, "Failed to read timeline: "+tlErr.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		// History before the cutoff can no longer be replayed once the
+		// entries are gone
+		if err := trimHistory(project, sheetName, cutoff); err != nil {
+			http.Error(w, "Failed to trim sheet history: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Delete all audit entries with timestamp strictly before the cutoff
+		deleted, err := globalAuditLog.Compact(project, sheetName, func(r *AuditRecord) bool {
+			return r.Timestamp.Before(cutoff)
+		}, nil)
+		if err != nil {
+			http.Error(w, "Failed to delete audit log entries: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("User %s deleted %d audit log entries before event %s on sheet %s/%s", username, deleted, beforeEventID, project, sheetName)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": fmt.Sprintf("Deleted %d audit log entries before the selected event", deleted),
+			"deleted": deleted,
+		})
+	})
+
+	// Sheet history: GET /api/sheet/history?project=&sheet_name= lists the
+	// snapshots; with at=<RFC 3339> or event_id=<timeline event> it returns
+	// the sheet as it was then, read-only
+	http.HandleFunc("/api/sheet/history", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		username, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		q := r.URL.Query()
+		sheetName, project := q.Get("sheet_name"), q.Get("project")
+		if sheetName == "" {
+			http.Error(w, "sheet_name is required", http.StatusBadRequest)
+			return
+		}
+		sheet := readableSheet(w, sheetName, project, username)
+		if sheet == nil {
+			return
+		}
+
+		if q.Get("at") == "" && q.Get("event_id") == "" && q.Get("version") == "" {
+			times, err := globalStore.Snapshots(project, sheetName)
+			if err != nil {
+				http.Error(w, "Failed to list snapshots: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			resp := map[string]interface{}{"snapshots": times}
+			if len(times) > 0 {
+				resp["earliest"] = times[0]
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+
+		view, err := HistoryView(sheet, q.Get("version"), q.Get("event_id"), q.Get("at"))
+		if err != nil {
+			status, msg := historyErrorStatus(err)
+			http.Error(w, msg, status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(view)
+	})
+
+	// Sheet history diff: GET /api/sheet/history/diff?project=&sheet_name=
+	// &from=|from_event_id=|from_version= [&to=|to_event_id=|to_version=];
+	// without a to, the sheet as it is now
+	http.HandleFunc("/api/sheet/history/diff", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		username, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		q := r.URL.Query()
+		sheetName, project := q.Get("sheet_name"), q.Get("project")
+		if sheetName == "" || (q.Get("from") == "" && q.Get("from_event_id") == "" && q.Get("from_version") == "") {
+			http.Error(w, "sheet_name and from, from_event_id or from_version are required", http.StatusBadRequest)
+			return
+		}
+		sheet := readableSheet(w, sheetName, project, username)
+		if sheet == nil {
+			return
+		}
+
+		// state resolves one end of the diff; the live sheet when none is given
+		state := func(version, at, eventID string) (*historyState, *time.Time, int, string) {
+			if version == "" && at == "" && eventID == "" {
+				sheet.mu.RLock()
+				defer sheet.mu.RUnlock()
+				return historyStateLocked(sheet), nil, 0, ""
+			}
+			view, err := HistoryView(sheet, version, eventID, at)
+			if err != nil {
+				status, msg := historyErrorStatus(err)
+				return nil, nil, status, msg
+			}
+			return &view.historyState, &view.At, 0, ""
+		}
+		from, fromAt, status, msg := state(q.Get("from_version"), q.Get("from"), q.Get("from_event_id"))
+		if status != 0 {
+			http.Error(w, msg, status)
+			return
+		}
+		to, toAt, status, msg := state(q.Get("to_version"), q.Get("to"), q.Get("to_event_id"))
+		if status != 0 {
+			http.Error(w, msg, status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"from":  fromAt,
+			"to":    toAt,
+			"cells": diffHistory(from.Data, to.Data),
+		})
+	})
+
+	// Sheet history restore: POST /api/sheet/history/restore with
+	// {project, sheet_name, at | event_id | version, range}. range is
+	// "A1:C5", a cell or a cell name; empty restores the whole sheet
+	http.HandleFunc("/api/sheet/history/restore", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		username, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			Project   string `json:"project"`
+			SheetName string `json:"sheet_name"`
+			At        string `json:"at"`
+			EventID   string `json:"event_id"`
+			Version   string `json:"version"`
+			Range     string `json:"range"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.SheetName == "" || (req.At == "" && req.EventID == "" && req.Version == "") {
+			http.Error(w, "sheet_name and at, event_id or version are required", http.StatusBadRequest)
+			return
+		}
+		sheet := globalSheetManager.GetSheetBy(req.SheetName, req.Project)
+		if sheet == nil {
+			http.Error(w, "Sheet not found", http.StatusNotFound)
+			return
+		}
+		if !sheet.IsEditor(username) {
+			http.Error(w, "Forbidden: not an editor of this sheet", http.StatusForbidden)
+			return
+		}
+		if sheet.ReadOnly {
+			http.Error(w, "Sheet is read-only (integrity check failed)", http.StatusConflict)
+			return
+		}
+		if strings.TrimSpace(req.Range) != "" {
+			if _, _, _, _, err := sheet.resolveValuesRange(req.Range); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		view, err := HistoryView(sheet, req.Version, req.EventID, req.At)
+		if err != nil {
+			status, msg := historyErrorStatus(err)
+			http.Error(w, msg, status)
 			return
 		}
-		token := r.Header.Get("Authorization")
-		_, err := globalUserManager.ValidateToken(token)
+
+		results, err := RestoreSheetHistory(sheet, view, req.Range, username)
 		if err != nil {
-			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			http.Error(w, "Failed to restore sheet history: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
-		users := globalUserManager.ListUsernames()
+		applied := 0
+		for _, res := range results {
+			if res.Status == "applied" {
+				applied++
+			}
+		}
+		log.Printf("User %s restored sheet %s/%s (range %q) as of %s: %d cells", username, req.Project, req.SheetName, req.Range, view.At.Format(time.RFC3339), applied)
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(users)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"at":      view.At,
+			"version": view.Version,
+			"applied": applied,
+			"skipped": len(results) - applied,
+			"results": results,
+		})
 	})
 
-	// User preferences: visible rows/cols (common across sheets/projects)
-	http.HandleFunc("/api/user/preferences", func(w http.ResponseWriter, r *http.Request) {
+	// Sheet versions: GET /api/sheet/versions?project=&sheet_name= lists the
+	// named versions; POST {project, sheet_name, name, note} tags the current
+	// content; DELETE ?project=&sheet_name=&version= removes one
+	http.HandleFunc("/api/sheet/versions", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
-		if r.Method == "OPTIONS" {
+		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
 
-		token := r.Header.Get("Authorization")
-		username, err := globalUserManager.ValidateToken(token)
+		username, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
 		if err != nil {
 			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
 			return
@@ -1932,162 +4111,158 @@ func main() {
 
 		switch r.Method {
 		case http.MethodGet:
-			prefs, err := globalUserManager.GetPreferences(username)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+			q := r.URL.Query()
+			sheet := readableSheet(w, q.Get("sheet_name"), q.Get("project"), username)
+			if sheet == nil {
 				return
 			}
+			sheet.mu.RLock()
+			versions := append([]SheetVersion{}, sheet.Versions...)
+			branch := sheet.Branch
+			sheet.mu.RUnlock()
 			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(prefs)
-		case http.MethodPut:
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"versions": versions,
+				"branch":   branch,
+			})
+
+		case http.MethodPost:
 			var req struct {
-				VisibleRows int `json:"visible_rows"`
-				VisibleCols int `json:"visible_cols"`
+				Project   string `json:"project"`
+				SheetName string `json:"sheet_name"`
+				Name      string `json:"name"`
+				Note      string `json:"note"`
 			}
 			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-			if err := globalUserManager.UpdatePreferences(username, Preferences{VisibleRows: req.VisibleRows, VisibleCols: req.VisibleCols}); err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+			sheet := globalSheetManager.GetSheetBy(req.SheetName, req.Project)
+			if sheet == nil {
+				http.Error(w, "Sheet not found", http.StatusNotFound)
 				return
 			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]string{"message": "preferences updated"})
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		}
-	})
-
-	// Get/Update permissions for a sheet
-	http.HandleFunc("/api/sheet/permissions", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-
-		token := r.Header.Get("Authorization")
-		username, err := globalUserManager.ValidateToken(token)
-		if err != nil {
-			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
-			return
-		}
-
-		sheetName := r.URL.Query().Get("sheet_name")
-		if sheetName == "" {
-			http.Error(w, "sheet_name is required", http.StatusBadRequest)
-			return
-		}
-		project := r.URL.Query().Get("project")
-		sheet := globalSheetManager.GetSheetBy(sheetName, project)
-		if sheet == nil {
-			http.Error(w, "Sheet not found", http.StatusNotFound)
-			return
-		}
-
-		if r.Method == http.MethodGet {
-			topProject := strings.SplitN(project, "/", 2)[0]
-			admins := globalProjectMeta.GetAdmins(topProject)
-			if admins == nil {
-				admins = []string{}
+			if !sheet.IsEditor(username) {
+				http.Error(w, "Forbidden: not an editor of this sheet", http.StatusForbidden)
+				return
 			}
-			resp := map[string]interface{}{
-				"owner":          sheet.Owner,
-				"permissions":    sheet.Permissions,
-				"project_admins": admins,
+			if strings.TrimSpace(req.Name) == "" {
+				http.Error(w, "name is required", http.StatusBadRequest)
+				return
 			}
+			if _, ok := sheet.findVersion(strings.TrimSpace(req.Name)); ok {
+				http.Error(w, "A version with that name already exists", http.StatusConflict)
+				return
+			}
+			v, err := CreateVersion(sheet, req.Name, req.Note, username)
+			if err != nil {
+				http.Error(w, "Failed to create version: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Printf("User %s tagged sheet %s/%s as version %q", username, req.Project, req.SheetName, v.Name)
 			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(resp)
-			return
-		}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(v)
 
-		if r.Method == http.MethodPut {
-			var req struct {
-				Editors []string `json:"editors"`
+		case http.MethodDelete:
+			q := r.URL.Query()
+			project := q.Get("project")
+			sheet := readableSheet(w, q.Get("sheet_name"), project, username)
+			if sheet == nil {
+				return
 			}
-			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+			v, ok := sheet.findVersion(q.Get("version"))
+			if !ok {
+				http.Error(w, "Version not found", http.StatusNotFound)
 				return
 			}
-			topProject := strings.SplitN(project, "/", 2)[0]
-			isAdmin := globalUserManager.IsAdminUser(username) || globalProjectMeta.IsProjectAdmin(topProject, username)
-			if !sheet.UpdatePermissions(req.Editors, username, isAdmin) {
-				http.Error(w, "Forbidden: owner or admin only", http.StatusForbidden)
+			sheet.mu.RLock()
+			owner := sheet.Owner
+			sheet.mu.RUnlock()
+			if username != owner && username != v.User && !globalProjectMeta.IsProjectAdmin(strings.SplitN(project, "/", 2)[0], username) {
+				http.Error(w, "Forbidden: only the sheet owner, a project admin or whoever created the version can delete it", http.StatusForbidden)
 				return
 			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]string{"message": "Permissions updated"})
-			return
-		}
+			if _, err := DeleteVersion(sheet, v.ID, username); err != nil {
+				http.Error(w, "Failed to delete version: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Printf("User %s deleted version %q of sheet %s/%s", username, v.Name, project, q.Get("sheet_name"))
+			w.WriteHeader(http.StatusNoContent)
 
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
 	})
 
-	// Transfer ownership of a sheet
-	http.HandleFunc("/api/sheet/transfer_owner", func(w http.ResponseWriter, r *http.Request) {
+	// Sheet branches: POST /api/sheet/branches with {project, sheet_name, name}
+	// creates a branch of the sheet named name in the same project
+	http.HandleFunc("/api/sheet/branches", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "PUT, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
-		if r.Method == "OPTIONS" {
+		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		if r.Method != http.MethodPut {
+
+		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		token := r.Header.Get("Authorization")
-		username, err := globalUserManager.ValidateToken(token)
+
+		username, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
 		if err != nil {
 			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
 			return
 		}
+
 		var req struct {
-			SheetName   string `json:"sheet_name"`
-			NewOwner    string `json:"new_owner"`
-			ProjectName string `json:"project_name"`
+			Project   string `json:"project"`
+			SheetName string `json:"sheet_name"`
+			Name      string `json:"name"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if req.SheetName == "" || req.NewOwner == "" {
-			http.Error(w, "sheet_name and new_owner required", http.StatusBadRequest)
-			return
-		}
-		isAdmin := globalUserManager.IsAdminUser(username)
-		sheet := globalSheetManager.GetSheetBy(req.SheetName, req.ProjectName)
-
+		sheet := globalSheetManager.GetSheetBy(req.SheetName, req.Project)
 		if sheet == nil {
 			http.Error(w, "Sheet not found", http.StatusNotFound)
 			return
 		}
-		// Project admins can also transfer ownership
-		topProject := strings.SplitN(req.ProjectName, "/", 2)[0]
-		isProjectAdmin := globalProjectMeta.IsProjectAdmin(topProject, username)
-		if !globalUserManager.Exists(req.NewOwner) {
-			http.Error(w, "new_owner does not exist", http.StatusBadRequest)
+		if !sheet.IsEditor(username) {
+			http.Error(w, "Forbidden: not an editor of this sheet", http.StatusForbidden)
 			return
 		}
-		if !sheet.TransferOwnership(req.NewOwner, username, isAdmin || isProjectAdmin) {
-			http.Error(w, "Forbidden: owner only", http.StatusForbidden)
+		dir := dataDir
+		if req.Project != "" {
+			dir = filepath.Join(dataDir, req.Project)
+		}
+		if _, statErr := os.Stat(filepath.Join(dir, req.Name)); statErr == nil {
+			http.Error(w, "A folder with that name already exists", http.StatusConflict)
+			return
+		}
+		branch, err := CreateBranch(sheet, req.Name, username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
 			return
 		}
+		globalProjectAuditManager.Append(req.Project, username, "CREATE_BRANCH", "Branched sheet '"+req.SheetName+"' as '"+branch.Name+"'")
+		log.Printf("User %s branched sheet %s/%s as %s", username, req.Project, req.SheetName, branch.Name)
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"message": "Ownership transferred"})
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(branch)
 	})
 
-	// Delete audit log entries before a specific timeline event.
-	// Only the sheet owner or a project admin can perform this action.
-	// Usage: DELETE /api/sheet/audit?sheet_name=<name>&project=<proj>&before_event_id=<timeline-event-id>
-	http.HandleFunc("/api/sheet/audit", func(w http.ResponseWriter, r *http.Request) {
+	// Branch merge: GET /api/sheet/merge?project=&sheet_name= previews merging
+	// the branch into its parent; POST {project, sheet_name, resolutions,
+	// dry_run} merges it. resolutions maps conflicting cells to "main" or
+	// "branch"; unresolved conflicts fail the merge with 409 and the plan
+	http.HandleFunc("/api/sheet/merge", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
 		if r.Method == http.MethodOptions {
@@ -2095,101 +4270,78 @@ func main() {
 			return
 		}
 
-		if r.Method != http.MethodDelete {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		token := r.Header.Get("Authorization")
-		username, err := globalUserManager.ValidateToken(token)
+		username, err := globalUserManager.ValidateToken(r.Header.Get("Authorization"))
 		if err != nil {
 			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
 			return
 		}
 
-		sheetName := r.URL.Query().Get("sheet_name")
-		project := r.URL.Query().Get("project")
-		beforeEventID := r.URL.Query().Get("before_event_id")
-
-		if sheetName == "" || beforeEventID == "" {
-			http.Error(w, "sheet_name and before_event_id are required", http.StatusBadRequest)
-			return
+		var req struct {
+			Project     string            `json:"project"`
+			SheetName   string            `json:"sheet_name"`
+			Resolutions map[string]string `json:"resolutions"`
+			DryRun      bool              `json:"dry_run"`
 		}
-
-		sheet := globalSheetManager.GetSheetBy(sheetName, project)
-		if sheet == nil {
-			http.Error(w, "Sheet not found", http.StatusNotFound)
+		switch r.Method {
+		case http.MethodGet:
+			req.Project, req.SheetName, req.DryRun = r.URL.Query().Get("project"), r.URL.Query().Get("sheet_name"), true
+		case http.MethodPost:
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-
-		// Permission check: sheet owner or project admin only
-		topProject := strings.SplitN(project, "/", 2)[0]
-		isAdmin := globalUserManager.IsAdminUser(username) || globalProjectMeta.IsProjectAdmin(topProject, username)
-		sheet.mu.RLock()
-		isSheetOwner := sheet.Owner == username
-		sheet.mu.RUnlock()
-		if !isSheetOwner && !isAdmin {
-			http.Error(w, "Forbidden: sheet owner or project admin only", http.StatusForbidden)
+		branch := readableSheet(w, req.SheetName, req.Project, username)
+		if branch == nil {
 			return
 		}
-
-		// Load the project timeline to find the event's timestamp
-		timelinePath := filepath.Join(dataDir, topProject, "timeline.json")
-		timelineData, readErr := os.ReadFile(timelinePath)
-		if readErr != nil {
-			if os.IsNotExist(readErr) {
-				http.Error(w, "Timeline not found for this project", http.StatusNotFound)
-				return
-			}
-			http.Error(w, "Failed to read timeline: "+readErr.Error(), http.StatusInternalServerError)
-			return
+		branch.mu.RLock()
+		var parentName string
+		if branch.Branch != nil {
+			parentName = branch.Branch.Parent
 		}
-		type tlEntry struct {
-			ID        string    `json:"id"`
-			Timestamp time.Time `json:"timestamp"`
+		branch.mu.RUnlock()
+		if parentName == "" {
+			http.Error(w, "Sheet is not a branch", http.StatusBadRequest)
+			return
 		}
-		var tlEntries []tlEntry
-		if jsonErr := json.Unmarshal(timelineData, &tlEntries); jsonErr != nil {
-			http.Error(w, "Failed to parse timeline: "+jsonErr.Error(), http.StatusInternalServerError)
+		parent := globalSheetManager.GetSheetBy(parentName, req.Project)
+		if parent == nil {
+			http.Error(w, "Parent sheet '"+parentName+"' not found", http.StatusNotFound)
 			return
 		}
-		var cutoff time.Time
-		foundEvent := false
-		for _, e := range tlEntries {
-			if e.ID == beforeEventID {
-				cutoff = e.Timestamp
-				foundEvent = true
-				break
-			}
+		if !parent.CanRead(username) {
+			http.Error(w, "Forbidden: no access to the parent sheet", http.StatusForbidden)
+			return
 		}
-		if !foundEvent {
-			http.Error(w, "Timeline event not found", http.StatusNotFound)
+		if !req.DryRun && !parent.IsEditor(username) {
+			http.Error(w, "Forbidden: not an editor of the parent sheet", http.StatusForbidden)
 			return
 		}
-
-		// Delete all audit entries with timestamp strictly before the cutoff
-		sheet.mu.Lock()
-		kept := sheet.AuditLog[:0]
-		deleted := 0
-		for _, entry := range sheet.AuditLog {
-			if entry.Timestamp.Before(cutoff) {
-				deleted++
-			} else {
-				kept = append(kept, entry)
-			}
+		if !req.DryRun && parent.ReadOnly {
+			http.Error(w, "Parent sheet is read-only (integrity check failed)", http.StatusConflict)
+			return
 		}
-		sheet.AuditLog = kept
-		sheet.mu.Unlock()
-
-		// Persist the sheet
-		globalSheetManager.SaveSheet(sheet)
 
-		log.Printf("User %s deleted %d audit log entries before event %s on sheet %s/%s", username, deleted, beforeEventID, project, sheetName)
+		res, err := MergeBranch(branch, req.Resolutions, username, req.DryRun)
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"message": fmt.Sprintf("Deleted %d audit log entries before the selected event", deleted),
-			"deleted": deleted,
-		})
+		if errors.Is(err, errMergeConflicts) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to merge branch: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !req.DryRun {
+			globalProjectAuditManager.Append(req.Project, username, "MERGE_BRANCH", fmt.Sprintf("Merged branch '%s' into '%s' (%d cells)", req.SheetName, parentName, res.Applied))
+			log.Printf("User %s merged branch %s/%s into %s: %d cells", username, req.Project, req.SheetName, parentName, res.Applied)
+		}
+		json.NewEncoder(w).Encode(res)
 	})
 
 	// Timeline API: GET/POST/PUT/DELETE for project timeline entries
@@ -2227,15 +4379,10 @@ func main() {
 			UpdatedAt   time.Time `json:"updated_at"`
 		}
 
-		getTimelinePath := func(project string) string {
-			return filepath.Join(dataDir, project, "timeline.json")
-		}
-
 		loadTimeline := func(project string) ([]TimelineEntry, error) {
-			path := getTimelinePath(project)
-			data, err := os.ReadFile(path)
+			data, err := globalStore.ReadDocument(timelineDocument(project))
 			if err != nil {
-				if os.IsNotExist(err) {
+				if errors.Is(err, os.ErrNotExist) {
 					return []TimelineEntry{}, nil
 				}
 				return nil, err
@@ -2248,12 +4395,11 @@ func main() {
 		}
 
 		saveTimeline := func(project string, entries []TimelineEntry) error {
-			path := getTimelinePath(project)
 			data, err := json.MarshalIndent(entries, "", "  ")
 			if err != nil {
 				return err
 			}
-			return os.WriteFile(path, data, 0644)
+			return globalStore.WriteDocument(timelineDocument(project), data)
 		}
 
 		if r.Method == http.MethodGet {
@@ -2262,6 +4408,10 @@ func main() {
 				http.Error(w, "project is required", http.StatusBadRequest)
 				return
 			}
+			if !canReadProject(project, username) {
+				http.Error(w, "Forbidden: no access to this project", http.StatusForbidden)
+				return
+			}
 			entries, err := loadTimeline(project)
 			if err != nil {
 				http.Error(w, "Failed to load timeline: "+err.Error(), http.StatusInternalServerError)
@@ -2425,7 +4575,7 @@ func main() {
 	// GET    /api/assets?project=<p>              → list assets
 	// POST   /api/assets?project=<p>              → upload (multipart form field "file")
 	// DELETE /api/assets?project=<p>&name=<n>    → delete a named asset
-	// GET    /api/assets/serve?project=<p>&name=<n> → stream asset bytes
+	// GET    /api/assets/serve?project=<p>&name=<n> → stream asset bytes (token may be a query parameter)
 	http.HandleFunc("/api/assets", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
@@ -2453,6 +4603,10 @@ func main() {
 			http.Error(w, "invalid project", http.StatusBadRequest)
 			return
 		}
+		if !canReadProject(project, username) {
+			http.Error(w, "Forbidden: no access to this project", http.StatusForbidden)
+			return
+		}
 		assetsDir := filepath.Join(dataDir, project, "assets")
 
 		switch r.Method {
@@ -2587,7 +4741,7 @@ func main() {
 	// GET    /api/python-files              → list files in pythonDirectory
 	// POST   /api/python-files              → upload a file (multipart form field "file")
 	// DELETE /api/python-files?name=<n>    → delete a named file
-	// GET    /api/python-files/serve?name=<n> → stream file bytes
+	// GET    /api/python-files/serve?name=<n> → stream file bytes (token may be a query parameter)
 	http.HandleFunc("/api/python-files", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
@@ -2736,8 +4890,10 @@ func main() {
 			return
 		}
 
-		// Serving is public – no token required so that images embedded in
-		// markdown previews (via plain <img> tags) load without authentication.
+		if _, err := browserRequestUser(r); err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
 		fileName := r.URL.Query().Get("name")
 		if fileName == "" {
 			http.Error(w, "name is required", http.StatusBadRequest)
@@ -2767,14 +4923,21 @@ func main() {
 			return
 		}
 
-		// Asset serving is public – no token required so that images embedded
-		// in markdown previews (via plain <img> tags) load without authentication.
+		username, err := browserRequestUser(r)
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
 		project := r.URL.Query().Get("project")
 		assetName := r.URL.Query().Get("name")
 		if project == "" || assetName == "" {
 			http.Error(w, "project and name are required", http.StatusBadRequest)
 			return
 		}
+		if !canReadProject(project, username) {
+			http.Error(w, "Forbidden: no access to this project", http.StatusForbidden)
+			return
+		}
 		if strings.Contains(project, "..") || strings.Contains(assetName, "..") || strings.Contains(assetName, "/") {
 			http.Error(w, "invalid parameters", http.StatusBadRequest)
 			return
@@ -2801,7 +4964,8 @@ func main() {
 			return
 		}
 		token := r.Header.Get("Authorization")
-		if _, err := globalUserManager.ValidateToken(token); err != nil {
+		username, err := globalUserManager.ValidateToken(token)
+		if err != nil {
 			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
 			return
 		}
@@ -2811,6 +4975,9 @@ func main() {
 			http.Error(w, "project and sheet are required", http.StatusBadRequest)
 			return
 		}
+		if readableSheet(w, sheet, project, username) == nil {
+			return
+		}
 		var body struct {
 			Prompt string `json:"prompt"`
 		}
@@ -2840,7 +5007,8 @@ func main() {
 			return
 		}
 		token := r.Header.Get("Authorization")
-		if _, err := globalUserManager.ValidateToken(token); err != nil {
+		username, err := globalUserManager.ValidateToken(token)
+		if err != nil {
 			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
 			return
 		}
@@ -2859,9 +5027,8 @@ func main() {
 			http.Error(w, "invalid JSON body", http.StatusBadRequest)
 			return
 		}
-		s := globalSheetManager.GetSheetBy(sheet, project)
+		s := readableSheet(w, sheet, project, username)
 		if s == nil {
-			http.Error(w, "sheet not found", http.StatusNotFound)
 			return
 		}
 		// Derive cellID from row+col (same as script executor does at runtime)
@@ -2872,7 +5039,8 @@ func main() {
 	})
 
 	// ── Public API: download activity log (audit log) of a sheet as CSV ─────
-	// No authentication required – usable with plain wget/curl.
+	// No authentication required when the project has public endpoints switched on
+	// (otherwise send a login or API token) – usable with plain wget/curl.
 	//
 	// GET /api/public/sheet/audit?project=<project>&sheet_name=<name>
 	//
@@ -2898,6 +5066,9 @@ func main() {
 			http.Error(w, "sheet_name is required", http.StatusBadRequest)
 			return
 		}
+		if !allowPublicAccess(w, r, project, sheetName) {
+			return
+		}
 
 		sheet := globalSheetManager.GetSheetBy(sheetName, project)
 		if sheet == nil {
@@ -2906,7 +5077,7 @@ func main() {
 		}
 
 		// ── Find the last timeline event timestamp for this project ──────────
-		// Timeline is stored at <dataDir>/<topProject>/timeline.json.
+		// Timeline is stored as the <topProject>/timeline.json document.
 		// We only need the timestamp field, so use a minimal struct.
 		var cutoff time.Time // zero → no cutoff (return all entries)
 		topProject := strings.SplitN(project, "/", 2)[0]
@@ -2914,8 +5085,7 @@ func main() {
 			type tlEntry struct {
 				Timestamp time.Time `json:"timestamp"`
 			}
-			tlPath := filepath.Join(dataDir, topProject, "timeline.json")
-			if tlData, err := os.ReadFile(tlPath); err == nil {
+			if tlData, err := globalStore.ReadDocument(timelineDocument(topProject)); err == nil {
 				var tlEntries []tlEntry
 				if json.Unmarshal(tlData, &tlEntries) == nil && len(tlEntries) > 0 {
 					// Find the latest timestamp among all timeline entries
@@ -2930,15 +5100,13 @@ func main() {
 		}
 
 		// ── Collect audit entries (optionally filtered) ──────────────────────
-		sheet.mu.RLock()
-		all := sheet.AuditLog
-		entries := make([]AuditEntry, 0, len(all))
+		all := globalAuditLog.Entries(project, sheetName)
+		entries := make([]AuditRecord, 0, len(all))
 		for _, e := range all {
 			if cutoff.IsZero() || e.Timestamp.After(cutoff) {
 				entries = append(entries, e)
 			}
 		}
-		sheet.mu.RUnlock()
 
 		// ── Build response ───────────────────────────────────────────────────
 		projectPart := project
@@ -2984,7 +5152,8 @@ func main() {
 	})
 
 	// ── Public API: download sheet data as CSV ────────────────────────────────
-	// No authentication required – usable with plain wget/curl.
+	// No authentication required when the project has public endpoints switched on
+	// (otherwise send a login or API token) – usable with plain wget/curl.
 	//
 	// GET /api/public/sheet/csv?project=<project>&sheet_name=<name>
 	//
@@ -3006,6 +5175,9 @@ func main() {
 			http.Error(w, "sheet_name is required", http.StatusBadRequest)
 			return
 		}
+		if !allowPublicAccess(w, r, project, sheetName) {
+			return
+		}
 
 		sheet := globalSheetManager.GetSheetBy(sheetName, project)
 		if sheet == nil {
@@ -3075,7 +5247,8 @@ func main() {
 	})
 
 	// ── Public API: export a Document sheet as Markdown ─────────────────────
-	// No authentication required – usable with plain wget/curl.
+	// No authentication required when the project has public endpoints switched on
+	// (otherwise send a login or API token) – usable with plain wget/curl.
 	//
 	// GET /api/public/sheet/markdown?project=<project>&sheet_name=<name>
 	//
@@ -3102,6 +5275,9 @@ func main() {
 			http.Error(w, "sheet_name is required", http.StatusBadRequest)
 			return
 		}
+		if !allowPublicAccess(w, r, project, sheetName) {
+			return
+		}
 
 		sheet := globalSheetManager.GetSheetBy(sheetName, project)
 		if sheet == nil {
@@ -3340,7 +5516,7 @@ func main() {
 	// Wrap DefaultServeMux with a global CORS middleware so that even 404/405 responses
 	// include the appropriate CORS headers. This prevents CORS failures on project
 	// duplication and sheet copy requests when paths/methods mismatch or errors occur.
-	err := http.ListenAndServe(*addr, corsMiddleware(http.DefaultServeMux))
+	err := http.ListenAndServe(*addr, corsMiddleware(apiTokenMiddleware(restoreGuardMiddleware(http.DefaultServeMux))))
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
 	}
@@ -3356,6 +5532,9 @@ func copyDirStructure(src, dst string) error {
 		if !info.IsDir() {
 			return nil // skip files, only create directories
 		}
+		if info.Name() == historyDirName {
+			return filepath.SkipDir // sheet history stays with the original
+		}
 		rel, err := filepath.Rel(src, path)
 		if err != nil {
 			return err
@@ -3370,7 +5549,7 @@ func copyDirStructure(src, dst string) error {
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
 		if r.Method == http.MethodOptions {
@@ -0,0 +1,849 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/netip"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ────────────────────────────────────────────────
+// Notifications
+// ────────────────────────────────────────────────
+//
+// A user is notified when someone @mentions them in chat or in a comment,
+// when someone else changes a cell, range or sheet they watch, and when a
+// script fails in a sheet they own. Every notification goes to the user's
+// inbox and is pushed to their open sheets as NOTIFICATION; their
+// preferences may also send it by email, through the SMTP server an admin
+// configures, or to a webhook. Events are queued and handled by a single
+// goroutine, so the hub and the sheets never wait for a delivery.
+
+const (
+	notificationsDocument        = "notifications.json"
+	notificationSettingsDocument = "notification_settings.json"
+	maxInboxSize                 = 500 // notifications kept per user, newest
+	maxWatches                   = 200 // watches per user
+)
+
+// Kinds of notification
+const (
+	NotifyMention     = "mention"
+	NotifyWatch       = "watch"
+	NotifyScriptError = "script_error"
+)
+
+// Notification is one entry of a user's inbox.
+type Notification struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"` // NotifyMention, NotifyWatch or NotifyScriptError
+	Project   string    `json:"project,omitempty"`
+	Sheet     string    `json:"sheet,omitempty"`
+	SheetType string    `json:"sheet_type,omitempty"` // "datasheet" or "document"
+	Cell      string    `json:"cell,omitempty"`
+	Actor     string    `json:"actor,omitempty"` // who caused it
+	Text      string    `json:"text"`
+	Count     int       `json:"count,omitempty"` // events folded into it, when more than one
+	Key       string    `json:"key,omitempty"`   // unread notifications with the same key fold into one
+	Timestamp time.Time `json:"timestamp"`
+	Read      bool      `json:"read,omitempty"`
+}
+
+// Watch subscribes a user to the changes of a sheet, or of a range of it
+// when Range is set. Ranges follow their cells like protected ranges.
+type Watch struct {
+	ID      string `json:"id"`
+	Project string `json:"project"`
+	Sheet   string `json:"sheet"`
+	CellRange
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NotifyChannels says how a user hears of one kind of notification. The
+// inbox gets every kind that is not Off.
+type NotifyChannels struct {
+	Off     bool `json:"off,omitempty"`
+	Email   bool `json:"email,omitempty"`
+	Webhook bool `json:"webhook,omitempty"`
+}
+
+// NotificationPrefs are a user's notification settings, kept in Preferences.
+type NotificationPrefs struct {
+	Email        string         `json:"email,omitempty"`
+	WebhookURL   string         `json:"webhook_url,omitempty"`
+	Mentions     NotifyChannels `json:"mentions"`
+	Watches      NotifyChannels `json:"watches"`
+	ScriptErrors NotifyChannels `json:"script_errors"`
+}
+
+func (p *NotificationPrefs) channels(kind string) NotifyChannels {
+	switch kind {
+	case NotifyMention:
+		return p.Mentions
+	case NotifyWatch:
+		return p.Watches
+	case NotifyScriptError:
+		return p.ScriptErrors
+	}
+	return NotifyChannels{}
+}
+
+// validate trims the addresses and checks that they can be delivered to.
+func (p *NotificationPrefs) validate() error {
+	p.Email = strings.TrimSpace(p.Email)
+	if p.Email != "" {
+		addr, err := mail.ParseAddress(p.Email)
+		if err != nil || addr.Address != p.Email {
+			return errors.New("invalid email address")
+		}
+	}
+	p.WebhookURL = strings.TrimSpace(p.WebhookURL)
+	if p.WebhookURL != "" {
+		u, err := url.Parse(p.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("webhook URL must be an http or https URL")
+		}
+		// Names are checked again when they resolve; see webhookClient
+		ip, err := netip.ParseAddr(u.Hostname())
+		if strings.EqualFold(u.Hostname(), "localhost") || (err == nil && !publicAddr(ip)) {
+			return errWebhookAddress
+		}
+	}
+	return nil
+}
+
+// watchedCellActions are the audited cell changes watchers of the cell hear
+// about; watchers of the whole sheet also hear of watchedSheetActions.
+var (
+	watchedCellActions = map[string]bool{
+		"EDIT_CELL": true, "EDIT_SCRIPT": true, "STYLE_CELL": true, "RENAME_CELL": true,
+		"CHANGE_CELL_TYPE": true, "OPTION_SELECT": true, "LOCK_CELL": true, "UNLOCK_CELL": true,
+		"COMMENT": true,
+	}
+	watchedSheetActions = map[string]bool{
+		"INSERT_ROW": true, "INSERT_ROW_ABOVE": true, "INSERT_CHILD_ROW": true, "INSERT_COL": true,
+		"DELETE_ROW": true, "DELETE_COL": true, "MOVE_ROW": true, "MOVE_ROW_AS_CHILD": true, "MOVE_COL": true,
+		"RESTORE_HISTORY": true, "MERGE_BRANCH": true, "UNDO": true, "REDO": true,
+	}
+)
+
+type NotificationManager struct {
+	mu      sync.Mutex
+	inbox   map[string][]Notification // user -> notifications, oldest first
+	watches map[string][]Watch        // user -> watches
+	events  chan func()
+}
+
+var globalNotifications = &NotificationManager{
+	inbox:   make(map[string][]Notification),
+	watches: make(map[string][]Watch),
+	events:  make(chan func(), 1024),
+}
+
+type notificationsFile struct {
+	Inbox   map[string][]Notification `json:"inbox"`
+	Watches map[string][]Watch        `json:"watches"`
+}
+
+func (nm *NotificationManager) Load() {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	data, err := globalStore.ReadDocument(notificationsDocument)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("notifications: read: %v", err)
+		}
+		return
+	}
+	var f notificationsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		log.Printf("notifications: decode: %v", err)
+		return
+	}
+	if f.Inbox != nil {
+		nm.inbox = f.Inbox
+	}
+	if f.Watches != nil {
+		nm.watches = f.Watches
+	}
+}
+
+func (nm *NotificationManager) saveLocked() {
+	data, err := json.MarshalIndent(notificationsFile{Inbox: nm.inbox, Watches: nm.watches}, "", "  ")
+	if err != nil {
+		log.Printf("notifications: encode: %v", err)
+		return
+	}
+	if err := globalStore.WriteDocument(notificationsDocument, append(data, '\n')); err != nil {
+		log.Printf("notifications: save: %v", err)
+	}
+}
+
+// run handles queued events until the process exits.
+func (nm *NotificationManager) run() {
+	for ev := range nm.events {
+		ev()
+	}
+}
+
+// enqueue queues ev for run without ever blocking the caller, which may be
+// the hub or hold a sheet lock.
+func (nm *NotificationManager) enqueue(ev func()) {
+	select {
+	case nm.events <- ev:
+	default:
+		log.Printf("notifications: queue full, dropping an event")
+	}
+}
+
+// ── Events ───────────────────────────────────────
+
+// NotifyMentions notifies the users in mentions, named directly or through
+// "@groups", of n: all but n.Actor and those canSee turns away.
+func (nm *NotificationManager) NotifyMentions(n Notification, mentions []string, canSee func(user string) bool) {
+	if len(mentions) == 0 {
+		return
+	}
+	nm.enqueue(func() {
+		seen := map[string]bool{n.Actor: true}
+		for _, name := range mentions {
+			users := []string{name}
+			if isGroupRef(name) {
+				g, ok := globalGroups.Get(strings.TrimPrefix(name, groupPrefix))
+				if !ok {
+					continue
+				}
+				users = g.Members
+			}
+			for _, u := range users {
+				if seen[u] {
+					continue
+				}
+				seen[u] = true
+				if canSee(u) {
+					m := n
+					m.Kind = NotifyMention
+					nm.deliver(u, m)
+				}
+			}
+		}
+	})
+}
+
+// observeEdit notifies the watchers of a change the audit log recorded.
+func (nm *NotificationManager) observeEdit(project, sheet string, e AuditEntry) {
+	if !watchedCellActions[e.Action] && !watchedSheetActions[e.Action] {
+		return
+	}
+	nm.enqueue(func() {
+		row1, row2 := e.Row1, max(e.Row2, e.Row1)
+		col1 := colLabelToIndex(e.Col1)
+		col2 := max(colLabelToIndex(e.Col2), col1)
+		onCell := watchedCellActions[e.Action] && row1 > 0 && col1 > 0
+		// The first watch of each user that covers the change
+		matched := make(map[string]Watch)
+		nm.mu.Lock()
+		for user, ws := range nm.watches {
+			if user == e.User {
+				continue
+			}
+			for _, w := range ws {
+				if w.Project != project || w.Sheet != sheet {
+					continue
+				}
+				if w.Range == "" || (onCell && w.spans("row", row1, row2) && w.spans("col", col1, col2)) {
+					matched[user] = w
+					break
+				}
+			}
+		}
+		nm.mu.Unlock()
+		if len(matched) == 0 {
+			return
+		}
+		s := globalSheetManager.GetSheetBy(sheet, project)
+		if s == nil {
+			return
+		}
+		cell := ""
+		if onCell {
+			cell = e.Col1 + itoa(e.Row1)
+		}
+		for user, w := range matched {
+			if !s.CanRead(user) {
+				continue
+			}
+			watched := sheet
+			if w.Range != "" {
+				watched = w.Range + " of " + sheet
+			}
+			nm.deliver(user, Notification{
+				Kind: NotifyWatch, Project: project, Sheet: sheet, Cell: cell, Actor: e.User,
+				Text: fmt.Sprintf("%s changed %s: %s", e.User, watched, computeAuditDetails(nil, e)),
+				Key:  "watch/" + w.ID,
+			})
+		}
+	})
+}
+
+// ScriptFailed notifies the owner of a sheet that the script of a cell
+// failed with output.
+func (nm *NotificationManager) ScriptFailed(project, sheet, row, col, output string) {
+	nm.enqueue(func() {
+		s := globalSheetManager.GetSheetBy(sheet, project)
+		if s == nil {
+			return
+		}
+		s.mu.RLock()
+		owner := s.Owner
+		s.mu.RUnlock()
+		if owner == "" {
+			return
+		}
+		cell := col + row
+		nm.deliver(owner, Notification{
+			Kind: NotifyScriptError, Project: project, Sheet: sheet, Cell: cell, Actor: "system",
+			Text: fmt.Sprintf("The script in %s of %s failed: %s", cell, sheet, firstNChar(output, 300)),
+			Key:  "script/" + sheetKey(project, sheet) + "/" + cell,
+		})
+	})
+}
+
+// deliver adds n to user's inbox, folding it into an unread notification
+// with the same key, and sends it on as the user's preferences say. Folded
+// notifications are not emailed or posted again.
+func (nm *NotificationManager) deliver(user string, n Notification) {
+	prefs, err := globalUserManager.GetPreferences(user)
+	if err != nil {
+		return
+	}
+	ch := prefs.Notifications.channels(n.Kind)
+	if ch.Off {
+		return
+	}
+	n.Timestamp = time.Now()
+	if s := globalSheetManager.GetSheetBy(n.Sheet, n.Project); s != nil && n.Sheet != "" {
+		s.mu.RLock()
+		n.SheetType = s.SheetType
+		s.mu.RUnlock()
+	}
+	folded := false
+	nm.mu.Lock()
+	inbox := nm.inbox[user]
+	if n.Key != "" {
+		for i := len(inbox) - 1; i >= 0; i-- {
+			if inbox[i].Key == n.Key && !inbox[i].Read {
+				n.ID, n.Count = inbox[i].ID, max(inbox[i].Count, 1)+1
+				inbox = append(inbox[:i], inbox[i+1:]...)
+				folded = true
+				break
+			}
+		}
+	}
+	if n.ID == "" {
+		n.ID = newVersionID()
+	}
+	inbox = append(inbox, n)
+	if len(inbox) > maxInboxSize {
+		inbox = append([]Notification(nil), inbox[len(inbox)-maxInboxSize:]...)
+	}
+	nm.inbox[user] = inbox
+	unread := unreadCount(inbox)
+	nm.saveLocked()
+	nm.mu.Unlock()
+
+	pushNotification(user, &n, unread)
+	if folded {
+		return
+	}
+	if ch.Email && prefs.Notifications.Email != "" {
+		go func() {
+			if err := sendNotificationEmail(prefs.Notifications.Email, n); err != nil {
+				log.Printf("notifications: email to %s: %v", user, err)
+			}
+		}()
+	}
+	if ch.Webhook && prefs.Notifications.WebhookURL != "" {
+		go func() {
+			if err := postNotificationWebhook(prefs.Notifications.WebhookURL, user, n); err != nil {
+				log.Printf("notifications: webhook of %s: %v", user, err)
+			}
+		}()
+	}
+}
+
+func unreadCount(inbox []Notification) int {
+	n := 0
+	for _, m := range inbox {
+		if !m.Read {
+			n++
+		}
+	}
+	return n
+}
+
+// pushNotification sends n, or only the unread count when n is nil, to
+// user's open sheets. Not for use from the hub goroutine.
+func pushNotification(user string, n *Notification, unread int) {
+	if globalHub == nil {
+		return
+	}
+	payload, _ := json.Marshal(map[string]interface{}{"notification": n, "unread": unread})
+	globalHub.broadcast <- &Message{Type: "NOTIFICATION", Payload: payload, User: user}
+}
+
+// ── Inbox ────────────────────────────────────────
+
+// Inbox returns user's notifications, newest first, only the unread ones
+// with unreadOnly, and how many are unread.
+func (nm *NotificationManager) Inbox(user string, unreadOnly bool) ([]Notification, int) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	inbox := nm.inbox[user]
+	out := make([]Notification, 0, len(inbox))
+	for i := len(inbox) - 1; i >= 0; i-- {
+		if !unreadOnly || !inbox[i].Read {
+			out = append(out, inbox[i])
+		}
+	}
+	return out, unreadCount(inbox)
+}
+
+// MarkRead marks user's notifications ids, or all of them, as read and
+// returns how many are still unread.
+func (nm *NotificationManager) MarkRead(user string, ids []string, all bool) int {
+	want := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	nm.mu.Lock()
+	inbox := nm.inbox[user]
+	for i := range inbox {
+		if all || want[inbox[i].ID] {
+			inbox[i].Read = true
+		}
+	}
+	unread := unreadCount(inbox)
+	nm.saveLocked()
+	nm.mu.Unlock()
+	pushNotification(user, nil, unread)
+	return unread
+}
+
+// Remove deletes user's notification id, or all their read ones when id
+// is empty.
+func (nm *NotificationManager) Remove(user, id string) error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	inbox := nm.inbox[user]
+	kept := make([]Notification, 0, len(inbox))
+	for _, n := range inbox {
+		if (id == "" && !n.Read) || (id != "" && n.ID != id) {
+			kept = append(kept, n)
+		}
+	}
+	if id != "" && len(kept) == len(inbox) {
+		return errors.New("notification not found")
+	}
+	nm.inbox[user] = kept
+	nm.saveLocked()
+	return nil
+}
+
+// ── Watches ──────────────────────────────────────
+
+// Watches returns user's watches, only those of one sheet when sheet is set.
+func (nm *NotificationManager) Watches(user, project, sheet string) []Watch {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	out := []Watch{}
+	for _, w := range nm.watches[user] {
+		if sheet == "" || (w.Project == project && w.Sheet == sheet) {
+			out = append(out, w)
+		}
+	}
+	return out
+}
+
+// AddWatch has user watch rangeText of a sheet, or the whole sheet when it
+// is empty. Watching what is already watched returns the existing watch.
+func (nm *NotificationManager) AddWatch(user, project, sheet, rangeText string) (Watch, error) {
+	w := Watch{Project: project, Sheet: sheet, CreatedAt: time.Now()}
+	if strings.TrimSpace(rangeText) != "" {
+		var err error
+		if w.Row1, w.Row2, w.Col1, w.Col2, err = parseCellRange(rangeText); err != nil {
+			return Watch{}, err
+		}
+		w.Range = w.label()
+	}
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	for _, old := range nm.watches[user] {
+		if old.Project == project && old.Sheet == sheet && old.Range == w.Range {
+			return old, nil
+		}
+	}
+	if len(nm.watches[user]) >= maxWatches {
+		return Watch{}, fmt.Errorf("at most %d watches per user", maxWatches)
+	}
+	w.ID = newVersionID()
+	nm.watches[user] = append(nm.watches[user], w)
+	nm.saveLocked()
+	return w, nil
+}
+
+// RemoveWatch deletes user's watch id.
+func (nm *NotificationManager) RemoveWatch(user, id string) error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	ws := nm.watches[user]
+	for i := range ws {
+		if ws[i].ID == id {
+			nm.watches[user] = append(ws[:i], ws[i+1:]...)
+			nm.saveLocked()
+			return nil
+		}
+	}
+	return errors.New("watch not found")
+}
+
+// observeShift moves the watched ranges of a sheet with their cells; a range
+// whose rows or columns were all deleted stops being watched.
+func (nm *NotificationManager) observeShift(project, sheet string, sh *AuditShift) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	changed := false
+	for user, ws := range nm.watches {
+		kept := ws[:0]
+		for _, w := range ws {
+			if w.Project == project && w.Sheet == sheet && w.Range != "" {
+				changed = true
+				if !w.shift(sh) {
+					continue
+				}
+			}
+			kept = append(kept, w)
+		}
+		nm.watches[user] = kept
+	}
+	if changed {
+		nm.saveLocked()
+	}
+}
+
+// RenameSheet moves the watches of a renamed sheet.
+func (nm *NotificationManager) RenameSheet(project, oldName, newName string) {
+	nm.renameWatches(func(w *Watch) bool {
+		if w.Project != project || w.Sheet != oldName {
+			return false
+		}
+		w.Sheet = newName
+		return true
+	})
+}
+
+// RenameProject moves the watches of the sheets of a renamed project or folder.
+func (nm *NotificationManager) RenameProject(oldPath, newPath string) {
+	nm.renameWatches(func(w *Watch) bool {
+		if w.Project != oldPath && !strings.HasPrefix(w.Project, oldPath+"/") {
+			return false
+		}
+		w.Project = newPath + w.Project[len(oldPath):]
+		return true
+	})
+}
+
+func (nm *NotificationManager) renameWatches(rename func(w *Watch) bool) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	changed := false
+	for _, ws := range nm.watches {
+		for i := range ws {
+			if rename(&ws[i]) {
+				changed = true
+			}
+		}
+	}
+	if changed {
+		nm.saveLocked()
+	}
+}
+
+// Drop forgets the watches of a deleted sheet.
+func (nm *NotificationManager) Drop(project, name string) {
+	nm.dropWatches(func(w *Watch) bool { return w.Project == project && w.Sheet == name })
+}
+
+// DropProject forgets the watches of the sheets of a deleted project.
+func (nm *NotificationManager) DropProject(project string) {
+	nm.dropWatches(func(w *Watch) bool { return w.Project == project || strings.HasPrefix(w.Project, project+"/") })
+}
+
+func (nm *NotificationManager) dropWatches(drop func(w *Watch) bool) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	changed := false
+	for user, ws := range nm.watches {
+		kept := ws[:0]
+		for i := range ws {
+			if drop(&ws[i]) {
+				changed = true
+				continue
+			}
+			kept = append(kept, ws[i])
+		}
+		nm.watches[user] = kept
+	}
+	if changed {
+		nm.saveLocked()
+	}
+}
+
+// ────────────────────────────────────────────────
+// Admin-managed delivery settings
+// ────────────────────────────────────────────────
+
+// NotificationSettings configure email and webhook delivery for everyone.
+type NotificationSettings struct {
+	SMTPHost      string `json:"smtp_host,omitempty"`
+	SMTPPort      int    `json:"smtp_port,omitempty"` // 25 when unset; 465 speaks TLS from the start
+	SMTPUsername  string `json:"smtp_username,omitempty"`
+	SMTPPassword  string `json:"smtp_password,omitempty"`
+	SMTPFrom      string `json:"smtp_from,omitempty"`
+	AllowWebhooks bool   `json:"allow_webhooks,omitempty"`
+}
+
+var (
+	notificationSettings   NotificationSettings
+	notificationSettingsMu sync.RWMutex
+)
+
+func loadNotificationSettings() {
+	notificationSettingsMu.Lock()
+	defer notificationSettingsMu.Unlock()
+	data, err := globalStore.ReadDocument(notificationSettingsDocument)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error reading notification settings: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &notificationSettings); err != nil {
+		log.Printf("Error decoding notification settings: %v", err)
+	}
+}
+
+// GetNotificationSettings returns the delivery settings.
+func GetNotificationSettings() NotificationSettings {
+	notificationSettingsMu.RLock()
+	defer notificationSettingsMu.RUnlock()
+	return notificationSettings
+}
+
+// SetNotificationSettings validates and stores the delivery settings.
+func SetNotificationSettings(s NotificationSettings) error {
+	s.SMTPHost = strings.TrimSpace(s.SMTPHost)
+	s.SMTPFrom = strings.TrimSpace(s.SMTPFrom)
+	if s.SMTPPort < 0 || s.SMTPPort > 65535 {
+		return errors.New("invalid SMTP port")
+	}
+	if s.SMTPHost != "" {
+		if _, err := mail.ParseAddress(s.SMTPFrom); err != nil {
+			return errors.New("a valid sender address is required")
+		}
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	notificationSettingsMu.Lock()
+	defer notificationSettingsMu.Unlock()
+	if err := globalStore.WriteDocument(notificationSettingsDocument, append(data, '\n')); err != nil {
+		return err
+	}
+	notificationSettings = s
+	return nil
+}
+
+var notificationSubjects = map[string]string{
+	NotifyMention:     "You were mentioned",
+	NotifyWatch:       "A watched sheet changed",
+	NotifyScriptError: "A script failed",
+}
+
+// sendNotificationEmail emails n to the address to.
+func sendNotificationEmail(to string, n Notification) error {
+	cfg := GetNotificationSettings()
+	if cfg.SMTPHost == "" {
+		return errors.New("no SMTP server is configured")
+	}
+	subject := notificationSubjects[n.Kind]
+	if subject == "" {
+		subject = "Notification"
+	}
+	if n.Sheet != "" {
+		subject += " in " + n.Sheet
+	}
+	var body strings.Builder
+	body.WriteString(n.Text + "\r\n\r\n")
+	for _, f := range [][2]string{{"Project", n.Project}, {"Sheet", n.Sheet}, {"Cell", n.Cell}} {
+		if f[1] != "" {
+			body.WriteString(f[0] + ": " + f[1] + "\r\n")
+		}
+	}
+	oneLine := strings.NewReplacer("\r", " ", "\n", " ")
+	msg := "From: " + cfg.SMTPFrom + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", oneLine.Replace(subject)) + "\r\n" +
+		"Date: " + n.Timestamp.Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + body.String()
+	return sendMail(cfg, to, []byte(msg))
+}
+
+// sendMail delivers msg to one recipient through the configured server,
+// using STARTTLS when the server offers it.
+func sendMail(cfg NotificationSettings, to string, msg []byte) error {
+	port := cfg.SMTPPort
+	if port == 0 {
+		port = 25
+	}
+	addr := net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(port))
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if port == 465 {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: cfg.SMTPHost})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	c, err := smtp.NewClient(conn, cfg.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok && port != 465 {
+		if err := c.StartTLS(&tls.Config{ServerName: cfg.SMTPHost}); err != nil {
+			return err
+		}
+	}
+	if cfg.SMTPUsername != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(cfg.SMTPFrom); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// errWebhookAddress refuses webhooks to the server itself, the internal
+// network or a cloud metadata service.
+var errWebhookAddress = errors.New("webhook URL must point to a public address")
+
+// webhookClient only connects to public addresses. The dialer checks the
+// address a host name resolved to, so a name cannot be pointed at an
+// internal one after it was saved. Redirects are answered, not followed.
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: webhookDialControl}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+func webhookDialControl(_, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil || !publicAddr(ap.Addr()) {
+		return fmt.Errorf("%w (%s)", errWebhookAddress, address)
+	}
+	return nil
+}
+
+// nonPublicPrefixes are ranges netip has no predicate for: shared address
+// space (also used for metadata services), IETF and benchmark ranges,
+// reserved space and NAT64, which can reach any IPv4 address.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+}
+
+// publicAddr reports whether ip is a public unicast address: not loopback,
+// private (RFC 1918, fc00::/7), link-local (169.254.169.254 metadata),
+// multicast, unspecified or another non-public range.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, p := range nonPublicPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// postNotificationWebhook posts {user, notification} as JSON to target.
+func postNotificationWebhook(target, user string, n Notification) error {
+	if !GetNotificationSettings().AllowWebhooks {
+		return errors.New("webhooks are switched off by the administrator")
+	}
+	body, _ := json.Marshal(map[string]interface{}{"user": user, "notification": n})
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Notification-Kind", n.Kind)
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.100.100.200", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"fd00:ec2::254", false},
+		{"fe80::1", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+	}
+	for _, tt := range tests {
+		if got := publicAddr(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("publicAddr(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestNotificationPrefsValidateWebhook(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://hooks.example.com/x", true},
+		{"ftp://hooks.example.com/x", false},
+		{"http://localhost:8082/api", false},
+		{"http://127.0.0.1/", false},
+		{"http://[::1]:80/", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://10.0.0.5/hook", false},
+	}
+	for _, tt := range tests {
+		p := NotificationPrefs{WebhookURL: tt.url}
+		if err := p.validate(); (err == nil) != tt.ok {
+			t.Errorf("validate(%q) = %v, want ok %v", tt.url, err, tt.ok)
+		}
+	}
+}
+
+func TestWebhookClientRefusesInternalAddress(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	resp, err := webhookClient.Post(srv.URL, "application/json", nil)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("posted to a loopback address")
+	}
+	if !errors.Is(err, errWebhookAddress) {
+		t.Errorf("error = %v, want errWebhookAddress", err)
+	}
+}
+
+func TestWebhookClientDoesNotFollowRedirects(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPost, "https://hooks.example.com/x", nil)
+	if err := webhookClient.CheckRedirect(req, []*http.Request{req}); !errors.Is(err, http.ErrUseLastResponse) {
+		t.Errorf("CheckRedirect = %v, want http.ErrUseLastResponse", err)
+	}
+}
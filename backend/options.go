@@ -127,13 +127,27 @@ func (s *Sheet) extractOptionsFromRange(rangeStr string) []string {
 
 // SetCellType updates cell type for a cell. Only owner can change cell type.
 func (s *Sheet) SetCellType(row, col string, cellType int, options []string, optionsRange string, user string) bool {
-	s.mu.Lock()
-	//defer s.mu.Unlock()
 	//fmt.Printf("SetCellType %s %s %d %v %s %s\n", row, col, cellType, options, optionsRange, user)
+	// If optionsRange is provided, extract options from the specified range
+	if optionsRange != "" {
+		extractedOptions := s.extractOptionsFromRange(optionsRange)
+		if len(extractedOptions) > 0 {
+			options = extractedOptions
+		}
+	}
+	s.mu.Lock()
+	ok, done := s.setCellTypeLocked(row, col, cellType, options, optionsRange, user)
+	s.mu.Unlock()
+	done()
+	return ok
+}
+
+// setCellTypeLocked is SetCellType with s.mu held and the options of
+// optionsRange already read.
+func (s *Sheet) setCellTypeLocked(row, col string, cellType int, options []string, optionsRange string, user string) (bool, editDone) {
 	// Only owner can change cell type
 	if user != s.Owner {
-		s.mu.Unlock()
-		return false
+		return false, editNothing
 	}
 
 	if s.Data[row] == nil {
@@ -143,15 +157,6 @@ func (s *Sheet) SetCellType(row, col string, cellType int, options []string, opt
 	current := s.Data[row][col]
 	oldOptions := append([]string(nil), current.Options...)
 
-	s.mu.Unlock()
-	// If optionsRange is provided, extract options from the specified range
-	if optionsRange != "" {
-		extractedOptions := s.extractOptionsFromRange(optionsRange)
-		if len(extractedOptions) > 0 {
-			options = extractedOptions
-		}
-	}
-	s.mu.Lock()
 	// Update cell type and options
 	current.CellType = cellType
 	current.Options = options
@@ -164,7 +169,7 @@ func (s *Sheet) SetCellType(row, col string, cellType int, options []string, opt
 		current.Options = nil
 		current.OptionsRange = ""
 	}
-	if cellType != ScriptCell {
+	if cellType != ScriptCell && cellType != FormulaCell {
 		current.Script = ""
 	}
 	if cellType != AIGeneratedCell {
@@ -190,7 +195,6 @@ func (s *Sheet) SetCellType(row, col string, cellType int, options []string, opt
 					continue
 				}
 				if s.Data[targetRow] == nil {
-					s.mu.Unlock()
 					continue
 				}
 				cell := s.Data[targetRow][col]
@@ -256,7 +260,7 @@ func (s *Sheet) SetCellType(row, col string, cellType int, options []string, opt
 		}
 	}
 
-	s.AuditLog = append(s.AuditLog, AuditEntry{
+	s.logAudit(AuditEntry{
 		Timestamp:      time.Now(),
 		User:           user,
 		Action:         "CHANGE_CELL_TYPE",
@@ -264,20 +268,24 @@ func (s *Sheet) SetCellType(row, col string, cellType int, options []string, opt
 		Col1:           col,
 		ChangeReversed: false,
 	})
-	s.mu.Unlock()
 
-	// Update OptionsRange dependencies
-	globalSheetManager.UpdateOptionsRangeDependencies(s.ProjectName, s.Name, row, col, optionsRange)
+	return true, func() {
+		// Update OptionsRange dependencies
+		globalSheetManager.UpdateOptionsRangeDependencies(s.ProjectName, s.Name, row, col, optionsRange)
 
-	globalSheetManager.SaveSheet(s)
-	return true
+		globalSheetManager.SaveSheet(s)
+	}
 }
 
 // SetCellOptionSelected updates the selected options for a ComboBox or MultipleSelection cell
 func (s *Sheet) SetCellOptionSelected(row, col string, optionSelected []int) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	done := s.setCellOptionSelectedLocked(row, col, optionSelected)
+	s.mu.Unlock()
+	done()
+}
 
+func (s *Sheet) setCellOptionSelectedLocked(row, col string, optionSelected []int) editDone {
 	if s.Data[row] == nil {
 		s.Data[row] = make(map[string]Cell)
 	}
@@ -285,6 +293,7 @@ func (s *Sheet) SetCellOptionSelected(row, col string, optionSelected []int) {
 	current := s.Data[row][col]
 	current.OptionsSelected = optionSelected
 	s.Data[row][col] = current
+	return func() { globalSheetManager.SaveCells(s, cellRef{row, col}) }
 }
 
 func (sm *SheetManager) rebuildOptionsRangeDependencies() {
@@ -1698,7 +1707,6 @@ func (sm *SheetManager) CopyPasteProject(sourcePath, destPath, newOwner string)
 			ColWidths:   make(map[string]int),
 			RowHeights:  make(map[string]int),
 			Permissions: perms,
-			AuditLog:    append([]AuditEntry{}, s.AuditLog...),
 		}
 
 		// Deep copy cell data, rewriting any cross-sheet references from source to dest
@@ -1730,199 +1738,120 @@ func (sm *SheetManager) CopyPasteProject(sourcePath, destPath, newOwner string)
 		s.mu.RUnlock()
 
 		// Register in memory and persist to disk
+		globalAuditLog.Copy(s.ProjectName, s.Name, cloneProjectName, clone.Name)
 		sm.sheets[sheetKey(cloneProjectName, clone.Name)] = clone
 		sm.saveSheetLocked(clone)
 	}
 	return nil
 }
 
-// updateOptionsForDependentCells updates options for combo box/multiple selection cells
-// that depend on the modified cell's sheet via OptionsRange
-func updateOptionsForDependentCells(projectName, sheetName, row, col string) {
-	sheetKey := projectName + "/" + sheetName
-
-	// Get cells that depend on this sheet for their options
-	globalSheetManager.OptionsRangeDepsMu.RLock()
-	deps, hasDeps := globalSheetManager.OptionsRangeDeps[sheetKey]
-	globalSheetManager.OptionsRangeDepsMu.RUnlock()
-
-	if !hasDeps {
-		return
-	}
-
-	// Group dependent cells by sheet to minimize sheet lookups
-	type sheetCells struct {
-		sheet *Sheet
-		cells []CellIdentifier
+// refreshOptionsCell re-reads the OptionsRange of one combo box / multiple
+// selection cell and updates its options and value. It returns the cells it
+// modified. Cells that read this one are scheduled by Recalculate.
+func refreshOptionsCell(sheet *Sheet, dep CellIdentifier) []cellRef {
+	var modified []cellRef
+	sheet.mu.Lock()
+	if sheet.Data[dep.row] == nil || sheet.Data[dep.row][dep.col].OptionsRange == "" {
+		sheet.mu.Unlock()
+		return nil
 	}
 
-	sheetMap := make(map[string]*sheetCells)
+	cell := sheet.Data[dep.row][dep.col]
 
-	for _, dep := range deps {
-		sk := dep.ProjectName + "::" + dep.sheetName
-		if sheetMap[sk] == nil {
-			depSheet := globalSheetManager.GetSheetBy(dep.sheetName, dep.ProjectName)
-			if depSheet == nil {
-				continue
-			}
-			sheetMap[sk] = &sheetCells{
-				sheet: depSheet,
-				cells: []CellIdentifier{},
-			}
-		}
-		sheetMap[sk].cells = append(sheetMap[sk].cells, dep)
+	// Skip if cell is not a combo box or multiple selection
+	if cell.CellType != ComboBoxCell && cell.CellType != MultipleSelectionCell {
+		sheet.mu.Unlock()
+		return nil
 	}
 
-	// Update each dependent sheet
-	for _, sc := range sheetMap {
-		sheet := sc.sheet
-		modified := false
+	optionsRange := cell.OptionsRange
+	sheet.mu.Unlock()
 
-		for _, dep := range sc.cells {
-			sheet.mu.Lock()
-			if sheet.Data[dep.row] == nil || sheet.Data[dep.row][dep.col].OptionsRange == "" {
-				sheet.mu.Unlock()
-				continue
-			}
+	// Extract new options from the range
+	extractedOptions := sheet.extractOptionsFromRange(optionsRange)
 
-			cell := sheet.Data[dep.row][dep.col]
-
-			// Skip if cell is not a combo box or multiple selection
-			if cell.CellType != ComboBoxCell && cell.CellType != MultipleSelectionCell {
-				sheet.mu.Unlock()
-				continue
-			}
-
-			optionsRange := cell.OptionsRange
-			sheet.mu.Unlock()
-
-			// Extract new options from the range
-			extractedOptions := sheet.extractOptionsFromRange(optionsRange)
+	if len(extractedOptions) > 0 {
+		depRowInt := -1
+		if dr, err := strconv.Atoi(dep.row); err == nil {
+			depRowInt = dr
+		}
+		if sheet.SheetType == "document" && depRowInt == 2 {
+			// Document sheet: propagate new options to all  the rows in the same column on the basis options in row 2.
 
-			if len(extractedOptions) > 0 {
-				depRowInt := -1
-				if dr, err := strconv.Atoi(dep.row); err == nil {
-					depRowInt = dr
+			for targetRow := range sheet.Data {
+				if targetRow == "1" {
+					continue
 				}
-				if sheet.SheetType == "document" && depRowInt == 2 {
-					// Document sheet: propagate new options to all  the rows in the same column on the basis options in row 2.
-
-					for targetRow := range sheet.Data {
-						if targetRow == "1" {
-							continue
-						}
-						sheet.mu.Lock()
-						if sheet.Data[targetRow] == nil {
-							sheet.mu.Unlock()
-							continue
-						}
-						row2Cell := sheet.Data["2"][dep.col]
-						targetCell := sheet.Data[targetRow][dep.col]
-						oldOptions := targetCell.Options
-						targetCell.Options = extractedOptions
-
-						// Update value based on OptionsSelected
-						if row2Cell.CellType == ComboBoxCell {
-							if len(targetCell.OptionsSelected) > 0 && targetCell.OptionsSelected[0] < len(row2Cell.Options) {
-								targetCell.Value = row2Cell.Options[targetCell.OptionsSelected[0]]
-							} else {
-								targetCell.Value = ""
-								targetCell.OptionsSelected = nil
-							}
-						} else if row2Cell.CellType == MultipleSelectionCell {
-							var selectedValues []string
-							validIndices := []int{}
-							for _, idx := range targetCell.OptionsSelected {
-								if idx < len(row2Cell.Options) {
-									selectedValues = append(selectedValues, row2Cell.Options[idx])
-									validIndices = append(validIndices, idx)
-								}
-							}
-							targetCell.Value = strings.Join(selectedValues, "; ")
-							targetCell.OptionsSelected = validIndices
-						}
-
-						sheet.Data[targetRow][dep.col] = targetCell
-						sheet.mu.Unlock()
-
-						modified = true
-
-						optionsChanged := len(oldOptions) != len(extractedOptions)
-						if !optionsChanged {
-							for i := range oldOptions {
-								if oldOptions[i] != extractedOptions[i] {
-									optionsChanged = true
-									break
-								}
-							}
-						}
-						if optionsChanged {
-							globalSheetManager.CellsModifiedByScriptQueueMu.Lock()
-							globalSheetManager.CellsModifiedByScriptQueue = append(globalSheetManager.CellsModifiedByScriptQueue, CellIdentifier{dep.ProjectName, dep.sheetName, targetRow, dep.col})
-							globalSheetManager.CellsModifiedByScriptQueueMu.Unlock()
-						}
+				sheet.mu.Lock()
+				if sheet.Data[targetRow] == nil {
+					sheet.mu.Unlock()
+					continue
+				}
+				row2Cell := sheet.Data["2"][dep.col]
+				targetCell := sheet.Data[targetRow][dep.col]
+				targetCell.Options = extractedOptions
+
+				// Update value based on OptionsSelected
+				if row2Cell.CellType == ComboBoxCell {
+					if len(targetCell.OptionsSelected) > 0 && targetCell.OptionsSelected[0] < len(row2Cell.Options) {
+						targetCell.Value = row2Cell.Options[targetCell.OptionsSelected[0]]
+					} else {
+						targetCell.Value = ""
+						targetCell.OptionsSelected = nil
 					}
-				} else {
-					// Original behaviour for non-document sheets (or document rows other than 2).
-					sheet.mu.Lock()
-					cell = sheet.Data[dep.row][dep.col]
-					oldOptions := cell.Options
-					cell.Options = extractedOptions
-
-					// Update value based on OptionsSelected
-					if cell.CellType == ComboBoxCell {
-						// For combo box, set value from the selected option
-						if len(cell.OptionsSelected) > 0 && cell.OptionsSelected[0] < len(cell.Options) {
-							cell.Value = cell.Options[cell.OptionsSelected[0]]
-						} else {
-							// If OptionsSelected is invalid or empty, clear the value
-							cell.Value = ""
-							cell.OptionsSelected = nil
-						}
-					} else if cell.CellType == MultipleSelectionCell {
-						// For multiple selection, concatenate selected values with semicolon
-						var selectedValues []string
-						validIndices := []int{}
-						for _, idx := range cell.OptionsSelected {
-							if idx < len(cell.Options) {
-								selectedValues = append(selectedValues, cell.Options[idx])
-								validIndices = append(validIndices, idx)
-							}
+				} else if row2Cell.CellType == MultipleSelectionCell {
+					var selectedValues []string
+					validIndices := []int{}
+					for _, idx := range targetCell.OptionsSelected {
+						if idx < len(row2Cell.Options) {
+							selectedValues = append(selectedValues, row2Cell.Options[idx])
+							validIndices = append(validIndices, idx)
 						}
-						cell.Value = strings.Join(selectedValues, "; ")
-						cell.OptionsSelected = validIndices
 					}
+					targetCell.Value = strings.Join(selectedValues, "; ")
+					targetCell.OptionsSelected = validIndices
+				}
 
-					sheet.Data[dep.row][dep.col] = cell
-					sheet.mu.Unlock()
-
-					modified = true
+				sheet.Data[targetRow][dep.col] = targetCell
+				sheet.mu.Unlock()
 
-					// Check if options actually changed
-					optionsChanged := len(oldOptions) != len(extractedOptions)
-					if !optionsChanged {
-						for i := range oldOptions {
-							if oldOptions[i] != extractedOptions[i] {
-								optionsChanged = true
-								break
-							}
-						}
-					}
+				modified = append(modified, cellRef{targetRow, dep.col})
+			}
+		} else {
+			// Original behaviour for non-document sheets (or document rows other than 2).
+			sheet.mu.Lock()
+			cell = sheet.Data[dep.row][dep.col]
+			cell.Options = extractedOptions
 
-					// If options changed, we may need to re-execute dependent scripts
-					if optionsChanged {
-						// Queue this cell for script execution if it has dependent scripts
-						globalSheetManager.CellsModifiedByScriptQueueMu.Lock()
-						globalSheetManager.CellsModifiedByScriptQueue = append(globalSheetManager.CellsModifiedByScriptQueue, CellIdentifier{dep.ProjectName, dep.sheetName, dep.row, dep.col})
-						globalSheetManager.CellsModifiedByScriptQueueMu.Unlock()
+			// Update value based on OptionsSelected
+			if cell.CellType == ComboBoxCell {
+				// For combo box, set value from the selected option
+				if len(cell.OptionsSelected) > 0 && cell.OptionsSelected[0] < len(cell.Options) {
+					cell.Value = cell.Options[cell.OptionsSelected[0]]
+				} else {
+					// If OptionsSelected is invalid or empty, clear the value
+					cell.Value = ""
+					cell.OptionsSelected = nil
+				}
+			} else if cell.CellType == MultipleSelectionCell {
+				// For multiple selection, concatenate selected values with semicolon
+				var selectedValues []string
+				validIndices := []int{}
+				for _, idx := range cell.OptionsSelected {
+					if idx < len(cell.Options) {
+						selectedValues = append(selectedValues, cell.Options[idx])
+						validIndices = append(validIndices, idx)
 					}
 				}
+				cell.Value = strings.Join(selectedValues, "; ")
+				cell.OptionsSelected = validIndices
 			}
-		}
 
-		if modified {
-			globalSheetManager.SaveSheet(sheet)
-			globalSheetManager.QueueRowColUpdate(sheet.ProjectName, sheet.Name)
+			sheet.Data[dep.row][dep.col] = cell
+			sheet.mu.Unlock()
+
+			modified = append(modified, cellRef{dep.row, dep.col})
 		}
 	}
+	return modified
 }
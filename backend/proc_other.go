@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// setProcessGroup is a no-op where process groups are not available.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills cmd.
+func killProcessGroup(cmd *exec.Cmd, runAsUser string) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package main
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// setProcessGroup starts cmd in its own process group.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills cmd and everything it spawned. When runAsUser is
+// set, the processes below sudo belong to that user and cannot be signalled
+// from here, so the group is first killed as that user through sudo.
+func killProcessGroup(cmd *exec.Cmd, runAsUser string) {
+	if cmd.Process == nil {
+		return
+	}
+	if runAsUser != "" {
+		exec.Command("sudo", "-n", "-u", runAsUser, "kill", "-KILL", "--", "-"+strconv.Itoa(cmd.Process.Pid)).Run()
+	}
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	cmd.Process.Kill()
+}
@@ -2,9 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"os"
-	"path/filepath"
 	"sync"
 	"time"
 )
@@ -28,33 +28,26 @@ var globalProjectAuditManager = &ProjectAuditManager{
 	logs: make(map[string][]ProjectAuditEntry),
 }
 
-func (pm *ProjectAuditManager) filePath() string {
-	return filepath.Join(dataDir, "project_audit.json")
+func (pm *ProjectAuditManager) document() string {
+	return "project_audit.json"
 }
 
 func (pm *ProjectAuditManager) Load() {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
-	// Ensure data dir exists
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
-		log.Printf("project audit: ensure data dir: %v", err)
-	}
-	absPath, _ := filepath.Abs(pm.filePath())
-	data, err := os.ReadFile(pm.filePath())
+	data, err := globalStore.ReadDocument(pm.document())
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, os.ErrNotExist) {
 			pm.logs = make(map[string][]ProjectAuditEntry)
 			return
 		}
 		log.Printf("project audit: read: %v", err)
 		return
 	}
-	// Integrity check
-	CheckAndRecord(absPath, data)
 	var m map[string][]ProjectAuditEntry
 	if err := json.Unmarshal(data, &m); err != nil {
 		log.Printf("project audit: decode: %v", err)
-		globalIntegrity.Record(absPath, false, false, "json decode error: "+err.Error())
+		globalIntegrity.Record(documentPath(pm.document()), false, false, "json decode error: "+err.Error())
 		return
 	}
 	pm.logs = m
@@ -63,23 +56,15 @@ func (pm *ProjectAuditManager) Load() {
 func (pm *ProjectAuditManager) Save() {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
-	// Ensure data dir exists
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
-		log.Printf("project audit: ensure data dir: %v", err)
-		return
-	}
 	data, err := json.MarshalIndent(pm.logs, "", "  ")
 	if err != nil {
 		log.Printf("project audit: encode: %v", err)
 		return
 	}
 	data = append(data, '\n')
-	absPath, _ := filepath.Abs(pm.filePath())
-	if err := WriteFileWithChecksum(absPath, data); err != nil {
+	if err := globalStore.WriteDocument(pm.document(), data); err != nil {
 		log.Printf("project audit: save: %v", err)
-		return
 	}
-	globalIntegrity.Record(absPath, true, false, "")
 }
 
 func (pm *ProjectAuditManager) Append(project, user, action, details string) {
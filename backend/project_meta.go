@@ -2,18 +2,35 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"os"
-	"path/filepath"
 	"sync"
 )
 
-// ProjectMetaManager persists simple metadata for projects, currently just the owner.
+// ProjectMetaManager persists simple metadata for projects: the owner, admins,
+// member roles and settings.
 // Stored at DATA/projects.json as { "projectName": { "owner": "username" }, ... }
 
 type ProjectMeta struct {
 	Owner  string   `json:"owner"`
-	Admins []string `json:"admins,omitempty"` // additional project admins (besides the owner)
+	Admins []string `json:"admins,omitempty"` // additional project admins (besides the owner); users or "@groups"
+
+	Members     map[string]Role `json:"members,omitempty"`      // editor, commenter, viewer or none per user or "@group"
+	DefaultRole Role            `json:"default_role,omitempty"` // role of everyone else; "" is viewer
+
+	ScriptLimits *ScriptLimits `json:"script_limits,omitempty"` // per-project override of the server script limits
+
+	PublicEndpoints bool `json:"public_endpoints,omitempty"` // /api/public/sheet/* serve this project without a token
+
+	AuditRetention *AuditRetention `json:"audit_retention,omitempty"` // how long sheet audit entries are kept
+}
+
+// AuditRetention limits how long the sheet audit logs of a project keep
+// their entries. Days 0 keeps everything.
+type AuditRetention struct {
+	Days    int  `json:"days"`
+	Archive bool `json:"archive,omitempty"` // write removed entries to the audit archive first
 }
 
 type ProjectMetaManager struct {
@@ -23,33 +40,26 @@ type ProjectMetaManager struct {
 
 var globalProjectMeta = &ProjectMetaManager{data: make(map[string]ProjectMeta)}
 
-func (pm *ProjectMetaManager) filePath() string {
-	return filepath.Join(dataDir, "projects.json")
+func (pm *ProjectMetaManager) document() string {
+	return "projects.json"
 }
 
 func (pm *ProjectMetaManager) Load() {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
-	// Ensure data dir exists
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
-		log.Printf("project meta: ensure data dir: %v", err)
-	}
-	absPath, _ := filepath.Abs(pm.filePath())
-	data, err := os.ReadFile(pm.filePath())
+	data, err := globalStore.ReadDocument(pm.document())
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, os.ErrNotExist) {
 			pm.data = make(map[string]ProjectMeta)
 			return
 		}
 		log.Printf("project meta: read: %v", err)
 		return
 	}
-	// Integrity check
-	CheckAndRecord(absPath, data)
 	var m map[string]ProjectMeta
 	if err := json.Unmarshal(data, &m); err != nil {
 		log.Printf("project meta: decode: %v", err)
-		globalIntegrity.Record(absPath, false, false, "json decode error: "+err.Error())
+		globalIntegrity.Record(documentPath(pm.document()), false, false, "json decode error: "+err.Error())
 		return
 	}
 	pm.data = m
@@ -58,22 +68,26 @@ func (pm *ProjectMetaManager) Load() {
 func (pm *ProjectMetaManager) Save() {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
-		log.Printf("project meta: ensure data dir: %v", err)
-		return
-	}
 	data, err := json.MarshalIndent(pm.data, "", "  ")
 	if err != nil {
 		log.Printf("project meta: encode: %v", err)
 		return
 	}
 	data = append(data, '\n')
-	absPath, _ := filepath.Abs(pm.filePath())
-	if err := WriteFileWithChecksum(absPath, data); err != nil {
+	if err := globalStore.WriteDocument(pm.document(), data); err != nil {
 		log.Printf("project meta: save: %v", err)
+	}
+}
+
+// SetMeta replaces all settings of a project, e.g. when restoring it.
+func (pm *ProjectMetaManager) SetMeta(project string, meta ProjectMeta) {
+	if project == "" {
 		return
 	}
-	globalIntegrity.Record(absPath, true, false, "")
+	pm.mu.Lock()
+	pm.data[project] = meta
+	pm.mu.Unlock()
+	pm.Save()
 }
 
 func (pm *ProjectMetaManager) GetOwner(project string) string {
@@ -146,7 +160,8 @@ func (pm *ProjectMetaManager) RemoveAdmin(project, admin string) {
 	pm.Save()
 }
 
-// IsProjectAdmin returns true if the user is the project owner or one of the admins.
+// IsProjectAdmin returns true if the user is the project owner or one of
+// the admins, directly or through a group.
 func (pm *ProjectMetaManager) IsProjectAdmin(project, user string) bool {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
@@ -154,12 +169,159 @@ func (pm *ProjectMetaManager) IsProjectAdmin(project, user string) bool {
 	if meta.Owner == user {
 		return true
 	}
-	for _, a := range meta.Admins {
-		if a == user {
-			return true
+	return user != "" && listedUser(meta.Admins, user)
+}
+
+// ProjectRole returns the role of user in project: owner, admin, their
+// member role or the project's default role. A user's own member role wins
+// over those of their groups; among groups the highest applies.
+func (pm *ProjectMetaManager) ProjectRole(project, user string) Role {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	meta := pm.data[project]
+	if user == "" {
+		return RoleNone
+	}
+	if meta.Owner == user {
+		return RoleOwner
+	}
+	if listedUser(meta.Admins, user) {
+		return RoleAdmin
+	}
+	if role, ok := meta.Members[user]; ok {
+		return role
+	}
+	var groupRole Role
+	for name, role := range meta.Members {
+		if isGroupRef(name) && matchesUser(name, user) && (groupRole == "" || role.AtLeast(groupRole)) {
+			groupRole = role
+		}
+	}
+	if groupRole != "" {
+		return groupRole
+	}
+	if meta.DefaultRole != "" {
+		return meta.DefaultRole
+	}
+	return RoleViewer
+}
+
+// GetMembers returns the member roles and the default role of a project.
+func (pm *ProjectMetaManager) GetMembers(project string) (map[string]Role, Role) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	meta := pm.data[project]
+	members := make(map[string]Role, len(meta.Members))
+	for u, r := range meta.Members {
+		members[u] = r
+	}
+	def := meta.DefaultRole
+	if def == "" {
+		def = RoleViewer
+	}
+	return members, def
+}
+
+// SetMemberRole gives user a role in project; "" removes them, leaving
+// them the default role.
+func (pm *ProjectMetaManager) SetMemberRole(project, user string, role Role) {
+	if project == "" || user == "" {
+		return
+	}
+	pm.mu.Lock()
+	meta := pm.data[project]
+	if role == "" {
+		delete(meta.Members, user)
+	} else {
+		if meta.Members == nil {
+			meta.Members = make(map[string]Role)
+		}
+		meta.Members[user] = role
+	}
+	pm.data[project] = meta
+	pm.mu.Unlock()
+	pm.Save()
+}
+
+// SetDefaultRole sets the role of users who are not members of project.
+func (pm *ProjectMetaManager) SetDefaultRole(project string, role Role) {
+	if project == "" {
+		return
+	}
+	pm.mu.Lock()
+	meta := pm.data[project]
+	if role == RoleViewer {
+		role = ""
+	}
+	meta.DefaultRole = role
+	pm.data[project] = meta
+	pm.mu.Unlock()
+	pm.Save()
+}
+
+// GetScriptLimits returns the project's script limit override, or nil.
+func (pm *ProjectMetaManager) GetScriptLimits(project string) *ScriptLimits {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return pm.data[project].ScriptLimits
+}
+
+// SetScriptLimits replaces the project's script limit override; nil clears it.
+func (pm *ProjectMetaManager) SetScriptLimits(project string, limits *ScriptLimits) {
+	pm.mu.Lock()
+	meta := pm.data[project]
+	meta.ScriptLimits = limits
+	pm.data[project] = meta
+	pm.mu.Unlock()
+	pm.Save()
+}
+
+// GetPublicEndpoints reports whether the project's sheets may be read through
+// the unauthenticated /api/public/sheet endpoints.
+func (pm *ProjectMetaManager) GetPublicEndpoints(project string) bool {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return pm.data[project].PublicEndpoints
+}
+
+// SetPublicEndpoints switches the public endpoints on or off for a project.
+func (pm *ProjectMetaManager) SetPublicEndpoints(project string, enabled bool) {
+	pm.mu.Lock()
+	meta := pm.data[project]
+	meta.PublicEndpoints = enabled
+	pm.data[project] = meta
+	pm.mu.Unlock()
+	pm.Save()
+}
+
+// GetAuditRetention returns the project's audit retention, or nil.
+func (pm *ProjectMetaManager) GetAuditRetention(project string) *AuditRetention {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return pm.data[project].AuditRetention
+}
+
+// SetAuditRetention replaces the project's audit retention; nil clears it.
+func (pm *ProjectMetaManager) SetAuditRetention(project string, retention *AuditRetention) {
+	pm.mu.Lock()
+	meta := pm.data[project]
+	meta.AuditRetention = retention
+	pm.data[project] = meta
+	pm.mu.Unlock()
+	pm.Save()
+}
+
+// AuditRetentionProjects returns the projects that limit audit retention.
+func (pm *ProjectMetaManager) AuditRetentionProjects() map[string]AuditRetention {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	out := make(map[string]AuditRetention)
+	for project, meta := range pm.data {
+		if meta.AuditRetention != nil && meta.AuditRetention.Days > 0 {
+			out[project] = *meta.AuditRetention
 		}
 	}
-	return false
+	return out
 }
 
 func (pm *ProjectMetaManager) Delete(project string) {
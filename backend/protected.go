@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ────────────────────────────────────────────────
+// Protected ranges
+// ────────────────────────────────────────────────
+//
+// A protected range keeps everyone but the sheet owner, project admins and
+// its own editors from changing a block of cells: their values, scripts,
+// styles and names, and the rows and columns under them (deleting or moving
+// them). Inserting rows or columns is always allowed; a range that the
+// insert falls inside grows with it. Ranges follow their cells through
+// every row and column shift, the same ones the audit log records.
+//
+// A warn-only range blocks nothing; clients ask before editing it.
+
+// CellRange is a block of cells of a sheet. A bound of 0 leaves that axis
+// open, so "A:B" is whole columns and "3:4" whole rows.
+type CellRange struct {
+	Range string `json:"range"` // A1 notation of the bounds below
+	Row1  int    `json:"row1,omitempty"`
+	Row2  int    `json:"row2,omitempty"`
+	Col1  int    `json:"col1,omitempty"`
+	Col2  int    `json:"col2,omitempty"`
+}
+
+// ProtectedRange is one protected block of a sheet.
+type ProtectedRange struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	CellRange
+	Editors   []string  `json:"editors,omitempty"` // users or "@groups" who may edit it
+	WarnOnly  bool      `json:"warn_only,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// parseCellRange reads "B2", "A1:D10", "A:C" or "3:5" into bounds.
+func parseCellRange(text string) (row1, row2, col1, col2 int, err error) {
+	text = strings.ToUpper(strings.ReplaceAll(text, "$", ""))
+	from, to, found := strings.Cut(strings.TrimSpace(text), ":")
+	if !found {
+		to = from
+	}
+	parse := func(ref string) (row, col int, ok bool) {
+		colPart, rowPart := parseCellLabel(strings.TrimSpace(ref))
+		if colPart != "" {
+			if col = colLabelToIndex(colPart); col <= 0 {
+				return 0, 0, false
+			}
+		}
+		if rowPart != "" {
+			n, err := strconv.Atoi(rowPart)
+			if err != nil || n <= 0 {
+				return 0, 0, false
+			}
+			row = n
+		}
+		return row, col, row > 0 || col > 0
+	}
+	r1, c1, ok1 := parse(from)
+	r2, c2, ok2 := parse(to)
+	// Both ends must name the same axes: "A1:B2", "A:B" or "1:2"
+	if !ok1 || !ok2 || (r1 == 0) != (r2 == 0) || (c1 == 0) != (c2 == 0) {
+		return 0, 0, 0, 0, errors.New(`range must look like "A1:D10", "A:C" or "3:5"`)
+	}
+	if r1 > r2 {
+		r1, r2 = r2, r1
+	}
+	if c1 > c2 {
+		c1, c2 = c2, c1
+	}
+	return r1, r2, c1, c2, nil
+}
+
+// label returns the A1 notation of the bounds.
+func (r *CellRange) label() string {
+	from := indexToColLabel(r.Col1)
+	to := indexToColLabel(r.Col2)
+	if r.Row1 > 0 {
+		from += itoa(r.Row1)
+		to += itoa(r.Row2)
+	}
+	if from == to {
+		return from
+	}
+	return from + ":" + to
+}
+
+// bounds returns the first and last row or column the range covers on axis;
+// 0, 0 when it is open on that axis.
+func (r *CellRange) bounds(axis string) (int, int) {
+	if axis == "col" {
+		return r.Col1, r.Col2
+	}
+	return r.Row1, r.Row2
+}
+
+// spans reports whether the range covers any of lines from..to on axis.
+func (r *CellRange) spans(axis string, from, to int) bool {
+	lo, hi := r.bounds(axis)
+	return lo == 0 || (from <= hi && to >= lo)
+}
+
+// covers reports whether the range covers the cell.
+func (r *CellRange) covers(row, col int) bool {
+	return r.spans("row", row, row) && r.spans("col", col, col)
+}
+
+// shift moves the range with its cells; false when its rows or columns
+// were all deleted. Lines moved out of the range leave it, unless the
+// whole range moved.
+func (r *CellRange) shift(sh *AuditShift) bool {
+	lo, hi := r.bounds(sh.Axis)
+	if lo == 0 {
+		return true
+	}
+	// The new bounds are the first and last line left of the range
+	count := max(sh.Count, 1)
+	movedOut := sh.Op == "move" && (lo < sh.At || hi > sh.At+count-1)
+	newLo, newHi := 0, 0
+	for v := lo; v <= hi; v++ {
+		if movedOut && v >= sh.At && v < sh.At+count {
+			continue
+		}
+		moved, ok := shiftIndex(sh, v)
+		if !ok {
+			continue
+		}
+		if newLo == 0 || moved < newLo {
+			newLo = moved
+		}
+		if moved > newHi {
+			newHi = moved
+		}
+	}
+	if newLo == 0 {
+		return false
+	}
+	if sh.Axis == "col" {
+		r.Col1, r.Col2 = newLo, newHi
+	} else {
+		r.Row1, r.Row2 = newLo, newHi
+	}
+	r.Range = r.label()
+	return true
+}
+
+// protectionAllowsLocked reports whether user may edit inside p.
+// Caller holds s.mu.
+func (s *Sheet) protectionAllowsLocked(p *ProtectedRange, user string) bool {
+	if p.WarnOnly || user == "" || user == "system" || user == s.Owner {
+		return true
+	}
+	if globalProjectMeta.IsProjectAdmin(topProjectOf(s.ProjectName), user) {
+		return true
+	}
+	return listedUser(p.Editors, user)
+}
+
+// protectedCellLocked returns the range that keeps user from editing the
+// cell, or nil. Caller holds s.mu.
+func (s *Sheet) protectedCellLocked(row, col string, user string) *ProtectedRange {
+	r, c := atoiSafe(row), colLabelToIndex(col)
+	for i := range s.Protected {
+		p := &s.Protected[i]
+		if p.covers(r, c) && !s.protectionAllowsLocked(p, user) {
+			return p
+		}
+	}
+	return nil
+}
+
+// protectedLinesLocked returns the range that keeps user from deleting or
+// moving count rows or columns from at, or nil. Caller holds s.mu.
+func (s *Sheet) protectedLinesLocked(axis string, at, count int, user string) *ProtectedRange {
+	if count < 1 {
+		count = 1
+	}
+	for i := range s.Protected {
+		p := &s.Protected[i]
+		if p.spans(axis, at, at+count-1) && !s.protectionAllowsLocked(p, user) {
+			return p
+		}
+	}
+	return nil
+}
+
+// protectedRowBlockLocked is protectedLinesLocked for a row and the rows
+// nested under it, which row edits delete and move together. Caller holds s.mu.
+func (s *Sheet) protectedRowBlockLocked(row int, user string) *ProtectedRange {
+	if len(s.Protected) == 0 {
+		return nil
+	}
+	last := row
+	for _, d := range s.getDescendants(row) {
+		if d > last {
+			last = d
+		}
+	}
+	return s.protectedLinesLocked("row", row, last-row+1, user)
+}
+
+// ProtectionFor returns the range that keeps user from applying the hub
+// message of type typ with payload, or nil. Inserts are never blocked.
+func (s *Sheet) ProtectionFor(typ string, payload json.RawMessage, user string) *ProtectedRange {
+	var req struct {
+		Row     string `json:"row"`
+		Col     string `json:"col"`
+		FromRow string `json:"fromRow"`
+		FromCol string `json:"fromCol"`
+	}
+	if json.Unmarshal(payload, &req) != nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.Protected) == 0 {
+		return nil
+	}
+	switch {
+	case undoCellTypes[typ]:
+		return s.protectedCellLocked(req.Row, req.Col, user)
+	case typ == "DELETE_ROW":
+		return s.protectedRowBlockLocked(atoiSafe(req.Row), user)
+	case typ == "MOVE_ROW" || typ == "MOVE_ROW_AS_CHILD":
+		return s.protectedRowBlockLocked(atoiSafe(req.FromRow), user)
+	case typ == "DELETE_COL":
+		return s.protectedLinesLocked("col", colLabelToIndex(req.Col), 1, user)
+	case typ == "MOVE_COL":
+		return s.protectedLinesLocked("col", colLabelToIndex(req.FromCol), 1, user)
+	}
+	return nil
+}
+
+// ProtectedCell returns the range that keeps user from editing the cell, or nil.
+func (s *Sheet) ProtectedCell(row, col, user string) *ProtectedRange {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.protectedCellLocked(row, col, user)
+}
+
+// shiftProtectedRangesLocked moves the ranges with their cells. A range whose
+// rows or columns were all deleted is dropped. Caller holds s.mu.
+func (s *Sheet) shiftProtectedRangesLocked(sh *AuditShift) {
+	if len(s.Protected) == 0 {
+		return
+	}
+	kept := s.Protected[:0]
+	for _, p := range s.Protected {
+		if p.shift(sh) {
+			kept = append(kept, p)
+		}
+	}
+	s.Protected = kept
+}
+
+// cloneProtected copies ranges so that the copy shares no slices with them.
+func cloneProtected(ranges []ProtectedRange) []ProtectedRange {
+	if ranges == nil {
+		return nil
+	}
+	out := make([]ProtectedRange, len(ranges))
+	for i, p := range ranges {
+		p.Editors = append([]string(nil), p.Editors...)
+		out[i] = p
+	}
+	return out
+}
+
+// ProtectedRanges returns a copy of the sheet's protected ranges.
+func (s *Sheet) ProtectedRanges() []ProtectedRange {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return cloneProtected(s.Protected)
+}
+
+// SetProtectedRange adds p, or replaces the range with p's ID, as user.
+// p.Range is parsed into the bounds.
+func (s *Sheet) SetProtectedRange(p ProtectedRange, user string) (ProtectedRange, error) {
+	var err error
+	if p.Row1, p.Row2, p.Col1, p.Col2, err = parseCellRange(p.Range); err != nil {
+		return ProtectedRange{}, err
+	}
+	p.Name = strings.TrimSpace(p.Name)
+	for _, e := range p.Editors {
+		if !knownUserOrGroup(e) {
+			return ProtectedRange{}, errors.New("user or group does not exist: " + e)
+		}
+	}
+	p.Range = p.label()
+	s.mu.Lock()
+	if s.ReadOnly {
+		s.mu.Unlock()
+		return ProtectedRange{}, errors.New("sheet is read-only (integrity check failed)")
+	}
+	action := "PROTECT_RANGE"
+	if p.ID == "" {
+		p.ID = newVersionID()
+		p.CreatedBy, p.CreatedAt = user, time.Now()
+		s.Protected = append(s.Protected, p)
+	} else {
+		i := s.protectedIndexLocked(p.ID)
+		if i < 0 {
+			s.mu.Unlock()
+			return ProtectedRange{}, errors.New("protected range not found")
+		}
+		p.CreatedBy, p.CreatedAt = s.Protected[i].CreatedBy, s.Protected[i].CreatedAt
+		s.Protected[i] = p
+		action = "UPDATE_PROTECTED_RANGE"
+	}
+	s.logAudit(AuditEntry{Timestamp: time.Now(), User: user, Action: action, NewValue: protectedDetails(&p),
+		Row1: p.Row1, Col1: indexToColLabel(p.Col1), Row2: p.Row2, Col2: indexToColLabel(p.Col2)})
+	s.mu.Unlock()
+	globalSheetManager.SaveCells(s)
+	p.Editors = append([]string(nil), p.Editors...)
+	return p, nil
+}
+
+// RemoveProtectedRange removes the range with id as user.
+func (s *Sheet) RemoveProtectedRange(id, user string) error {
+	s.mu.Lock()
+	i := s.protectedIndexLocked(id)
+	if i < 0 {
+		s.mu.Unlock()
+		return errors.New("protected range not found")
+	}
+	p := s.Protected[i]
+	s.Protected = append(s.Protected[:i], s.Protected[i+1:]...)
+	s.logAudit(AuditEntry{Timestamp: time.Now(), User: user, Action: "UNPROTECT_RANGE", OldValue: protectedDetails(&p),
+		Row1: p.Row1, Col1: indexToColLabel(p.Col1), Row2: p.Row2, Col2: indexToColLabel(p.Col2)})
+	s.mu.Unlock()
+	globalSheetManager.SaveCells(s)
+	return nil
+}
+
+func (s *Sheet) protectedIndexLocked(id string) int {
+	for i := range s.Protected {
+		if s.Protected[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// protectedDetails describes a range for the audit log.
+func protectedDetails(p *ProtectedRange) string {
+	d := p.Range
+	if p.Name != "" {
+		d = p.Name + " (" + p.Range + ")"
+	}
+	if len(p.Editors) > 0 {
+		d += ", editors: " + strings.Join(p.Editors, ", ")
+	}
+	if p.WarnOnly {
+		d += ", warn only"
+	}
+	return d
+}
+
+// protectedDenial is the EDIT_DENIED payload for an edit p blocks.
+func protectedDenial(typ string, p *ProtectedRange) json.RawMessage {
+	payload, _ := json.Marshal(map[string]string{
+		"reason": "protected",
+		"type":   typ,
+		"range":  p.Range,
+		"name":   p.Name,
+	})
+	return payload
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// ────────────────────────────────────────────────
+// Python worker pool
+// ────────────────────────────────────────────────
+//
+// Instead of starting an interpreter only when a script cell runs, up to a
+// fixed number of Python processes are started ahead of time. Each worker
+// reads one JSON request line on stdin ({"id":1,"code":"...","limits":{...}}),
+// answers with one JSON line on stdout
+// ({"id":1,"ok":true,"limit":"","stdout":"...","stderr":"..."}) and is then
+// discarded. A worker never runs a second script, so nothing a script does to
+// its interpreter (builtins, sys.modules, signal handlers, child processes)
+// can reach a later script from the same or another project; the pool only
+// hides the interpreter start-up time.
+
+// pythonWorkerBootstrap is the program each worker runs. The limits are not
+// enforced here, where the script could undo them: CPU and memory are
+// rlimits set before the interpreter starts (see pythonCmd), network access
+// is removed with a network namespace, and the Go side kills the worker on
+// the wall clock and caps the answer it reads. The bootstrap only turns
+// SIGXCPU and MemoryError into limit reports, caps the captured output and,
+// as a fallback when -script-netns is off, replaces socket.socket.
+const pythonWorkerBootstrap = `
+import builtins, io, json, os, signal, socket, sys, traceback
+_proto_in, _proto_out = sys.stdin, sys.stdout
+_cwd = os.getcwd()
+_real_socket = socket.socket
+
+class _Limit(BaseException):
+    def __init__(self, kind):
+        self.kind = kind
+
+class _CappedIO(io.StringIO):
+    def __init__(self, cap):
+        super().__init__()
+        self.cap = cap
+    def write(self, s):
+        if self.cap > 0 and self.tell() + len(s) > self.cap:
+            raise _Limit("output")
+        return super().write(s)
+
+class _NoNetSocket(_real_socket):
+    def __init__(self, family=-1, type=-1, proto=-1, fileno=None):
+        if family in (-1, socket.AF_INET, socket.AF_INET6):
+            raise PermissionError("network access is disabled for cell scripts")
+        super().__init__(family, type, proto, fileno)
+
+def _on_cpu_limit(signum, frame):
+    raise _Limit("cpu")
+
+if hasattr(signal, "SIGXCPU"):
+    signal.signal(signal.SIGXCPU, _on_cpu_limit)
+
+_line = _proto_in.readline()
+try:
+    _req = json.loads(_line)
+except Exception:
+    sys.exit(0)
+_lim = _req.get("limits") or {}
+_out, _err = _CappedIO(_lim.get("max_output", 0)), _CappedIO(_lim.get("max_output", 0))
+_ok, _kind = True, ""
+sys.stdout, sys.stderr, sys.stdin = _out, _err, io.StringIO("")
+if not _lim.get("network", True):
+    socket.socket = _NoNetSocket
+try:
+    os.chdir(_cwd)
+    _code = compile(_req.get("code", ""), "<string>", "exec")
+    exec(_code, {"__name__": "__main__", "__builtins__": dict(vars(builtins))})
+except _Limit as _e:
+    _ok, _kind = False, _e.kind
+except MemoryError:
+    _ok, _kind = False, "memory"
+except SystemExit as _e:
+    if _e.code not in (None, 0):
+        _ok = False
+        if not isinstance(_e.code, int):
+            _err.cap = 0
+            _err.write(str(_e.code))
+except BaseException as _e:
+    _ok = False
+    _err.cap = 0
+    _err.write("".join(traceback.format_exception(type(_e), _e, _e.__traceback__.tb_next)))
+finally:
+    socket.socket = _real_socket
+    sys.stdout, sys.stderr, sys.stdin = _proto_out, sys.__stderr__, _proto_in
+_stdout = "" if _kind == "output" else _out.getvalue()
+_proto_out.write(json.dumps({"id": _req.get("id"), "ok": _ok, "limit": _kind, "stdout": _stdout, "stderr": _err.getvalue()[:65536]}) + "\n")
+_proto_out.flush()
+`
+
+type pythonWorkerRequest struct {
+	ID     int64              `json:"id"`
+	Code   string             `json:"code"`
+	Limits pythonWorkerLimits `json:"limits"`
+}
+
+// pythonWorkerLimits is the part of ScriptLimits the worker itself applies.
+type pythonWorkerLimits struct {
+	MaxOutput int  `json:"max_output,omitempty"`
+	Network   bool `json:"network"`
+}
+
+type pythonWorkerResponse struct {
+	ID     int64  `json:"id"`
+	OK     bool   `json:"ok"`
+	Limit  string `json:"limit"` // "", "timeout", "cpu", "memory" or "output"
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+}
+
+type pythonWorker struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.Reader
+}
+
+// pythonWorkerPool keeps up to size started workers waiting in warm, grouped
+// by the limits they were started with (ScriptLimits.workerKey), and lets at
+// most size scripts run at once through slots. A worker taken from warm is
+// replaced in the background right away.
+type pythonWorkerPool struct {
+	slots     chan struct{}
+	size      int
+	mu        sync.Mutex
+	warm      map[string][]*pythonWorker
+	warmCount int
+}
+
+var (
+	globalPythonPool   *pythonWorkerPool
+	globalPythonPoolMu sync.Mutex
+)
+
+// initPythonPool configures the worker pool and starts workers for the
+// server's default limits. A size of 0 disables the pool and every script
+// starts its interpreter when it runs.
+func initPythonPool(size int) {
+	globalPythonPoolMu.Lock()
+	defer globalPythonPoolMu.Unlock()
+	if size <= 0 {
+		globalPythonPool = nil
+		log.Printf("Python worker pool disabled; one interpreter per script execution")
+		return
+	}
+	p := &pythonWorkerPool{slots: make(chan struct{}, size), size: size, warm: make(map[string][]*pythonWorker)}
+	for i := 0; i < size; i++ {
+		go p.refill(serverScriptLimits)
+	}
+	globalPythonPool = p
+	log.Printf("Python worker pool size: %d", size)
+}
+
+// startPythonWorker launches one worker process for limits via pythonCmd, so
+// the rlimits, network namespace, sudo -u run-as mode and working directory
+// apply to workers as well. The worker gets its own process group so a kill
+// also reaches children.
+func startPythonWorker(limits ScriptLimits) (*pythonWorker, error) {
+	cmd, err := pythonCmd(limits, "-u", "-c", pythonWorkerBootstrap)
+	if err != nil {
+		return nil, err
+	}
+	setProcessGroup(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &pythonWorker{cmd: cmd, stdin: stdin, stdout: stdout}, nil
+}
+
+// kill terminates the worker process group and reaps it.
+func (w *pythonWorker) kill() {
+	w.stdin.Close()
+	killProcessGroup(w.cmd, pythonRunAsUser)
+	w.cmd.Wait()
+}
+
+// scriptMaxAnswerBytes bounds the answer line read from a worker when the
+// project sets no output limit.
+const scriptMaxAnswerBytes = 64 << 20
+
+// run sends the script to the worker and waits for its answer, at most for
+// the wall-clock limit. An answer longer than the output limit allows is
+// not read; errWorkerOutput is returned instead.
+func (w *pythonWorker) run(code string, limits ScriptLimits) (pythonWorkerResponse, error) {
+	req, err := json.Marshal(pythonWorkerRequest{ID: 1, Code: code, Limits: limits.wire()})
+	if err != nil {
+		return pythonWorkerResponse{}, err
+	}
+	if _, err := w.stdin.Write(append(req, '\n')); err != nil {
+		return pythonWorkerResponse{}, err
+	}
+
+	// stdout and stderr are each capped by the worker and JSON escaping can
+	// grow them up to six times.
+	maxAnswer := int64(scriptMaxAnswerBytes)
+	if limits.MaxOutputKB > 0 {
+		maxAnswer = int64(limits.MaxOutputKB)*1024*6 + 65536*6 + 4096
+	}
+	type readResult struct {
+		line []byte
+		err  error
+	}
+	done := make(chan readResult, 1)
+	go func() {
+		line, err := bufio.NewReader(io.LimitReader(w.stdout, maxAnswer)).ReadBytes('\n')
+		if err == io.EOF && int64(len(line)) == maxAnswer {
+			err = errWorkerOutput
+		}
+		done <- readResult{line, err}
+	}()
+
+	timeout := limits.TimeoutSeconds
+	if timeout <= 0 {
+		timeout = defaultScriptTimeoutSeconds
+	}
+	timer := time.NewTimer(time.Duration(timeout) * time.Second)
+	defer timer.Stop()
+	var res readResult
+	select {
+	case res = <-done:
+	case <-timer.C:
+		return pythonWorkerResponse{}, errWorkerTimeout
+	}
+	if res.err != nil {
+		return pythonWorkerResponse{}, res.err
+	}
+	var resp pythonWorkerResponse
+	if err := json.Unmarshal(res.line, &resp); err != nil {
+		return pythonWorkerResponse{}, err
+	}
+	if resp.ID != 1 {
+		return pythonWorkerResponse{}, fmt.Errorf("unexpected response id %d", resp.ID)
+	}
+	return resp, nil
+}
+
+var (
+	errWorkerTimeout = errors.New("python worker did not answer within the time limit")
+	errWorkerOutput  = errors.New("python worker answer exceeds the output limit")
+)
+
+// runOnWorker executes code on w, kills w and converts the answer into the
+// (stdout, stderr, error) triple returned by runPythonScript. A worker that
+// died after using up its CPU time was killed by the hard RLIMIT_CPU.
+func runOnWorker(w *pythonWorker, code string, limits ScriptLimits) (stdout, stderr string, err error) {
+	resp, err := w.run(code, limits)
+	w.kill()
+	switch {
+	case err == errWorkerTimeout:
+		return "", "", limits.limitError("timeout")
+	case err == errWorkerOutput:
+		return "", "", limits.limitError("output")
+	case err != nil:
+		if st := w.cmd.ProcessState; st != nil && limits.CPUSeconds > 0 &&
+			st.UserTime()+st.SystemTime() >= time.Duration(limits.CPUSeconds)*time.Second {
+			return "", "", limits.limitError("cpu")
+		}
+		log.Printf("Python worker exited while running a script: %v", err)
+		return "", "", fmt.Errorf("python worker crashed while running the script")
+	}
+	if resp.Limit != "" {
+		return resp.Stdout, resp.Stderr, limits.limitError(resp.Limit)
+	}
+	if !resp.OK {
+		return resp.Stdout, resp.Stderr, fmt.Errorf("script failed")
+	}
+	return resp.Stdout, resp.Stderr, nil
+}
+
+// refill starts one worker for limits and adds it to warm. When warm is full
+// a worker started for other limits makes room; if there is none the new
+// worker is dropped.
+func (p *pythonWorkerPool) refill(limits ScriptLimits) {
+	w, err := startPythonWorker(limits)
+	if err != nil {
+		log.Printf("Failed to start Python worker: %v", err)
+		return
+	}
+	key := limits.workerKey()
+	var evicted *pythonWorker
+	p.mu.Lock()
+	if p.warmCount >= p.size {
+		for k, ws := range p.warm {
+			if k != key {
+				evicted = ws[0]
+				p.removeWarm(k)
+				break
+			}
+		}
+	}
+	if p.warmCount < p.size {
+		p.warm[key] = append(p.warm[key], w)
+		p.warmCount++
+		w = nil
+	}
+	p.mu.Unlock()
+	if evicted != nil {
+		evicted.kill()
+	}
+	if w != nil {
+		w.kill()
+	}
+}
+
+// takeWarm removes and returns a waiting worker started for key, or nil.
+func (p *pythonWorkerPool) takeWarm(key string) *pythonWorker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ws := p.warm[key]
+	if len(ws) == 0 {
+		return nil
+	}
+	w := ws[0]
+	p.removeWarm(key)
+	return w
+}
+
+// removeWarm drops the oldest waiting worker for key. p.mu must be held.
+func (p *pythonWorkerPool) removeWarm(key string) {
+	if ws := p.warm[key][1:]; len(ws) > 0 {
+		p.warm[key] = ws
+	} else {
+		delete(p.warm, key)
+	}
+	p.warmCount--
+}
+
+// execute runs code on a warm worker started for the same limits, or on a
+// newly started one when none is waiting.
+func (p *pythonWorkerPool) execute(code string, limits ScriptLimits) (string, string, error) {
+	p.slots <- struct{}{}
+	defer func() { <-p.slots }()
+	w := p.takeWarm(limits.workerKey())
+	go p.refill(limits)
+	if w == nil {
+		var err error
+		if w, err = startPythonWorker(limits); err != nil {
+			return "", "", err
+		}
+	}
+	return runOnWorker(w, code, limits)
+}
+
+// runPythonScript executes a resolved script under the given limits and
+// returns its stdout and stderr. A non-nil error means the script failed;
+// stderr then holds the traceback when there is one. Limit violations are
+// reported as *ScriptLimitError.
+func runPythonScript(script string, limits ScriptLimits) (string, string, error) {
+	globalPythonPoolMu.Lock()
+	p := globalPythonPool
+	globalPythonPoolMu.Unlock()
+	if p != nil {
+		return p.execute(script, limits)
+	}
+
+	// Without a pool, start a one-shot worker so the same limits apply.
+	w, err := startPythonWorker(limits)
+	if err != nil {
+		return "", "", err
+	}
+	return runOnWorker(w, script, limits)
+}
@@ -0,0 +1,618 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ────────────────────────────────────────────────
+// Recalculation scheduler
+// ────────────────────────────────────────────────
+//
+// When cells change, the flusher hands them to Recalculate. The scheduler
+// builds a DAG of every script, formula, AI and options cell downstream of
+// the change (edges come from scriptDeps and OptionsRangeDeps), runs the
+// nodes in topological order and runs independent nodes of the same wave in
+// parallel. Each node runs at most once per recalculation. Nodes that sit on
+// a reference loop are not run; their value becomes a #CYCLE error naming
+// the cells in the loop.
+
+// recalcErrCycle prefixes the value written into cells that are part of a
+// reference cycle.
+const recalcErrCycle = "#CYCLE"
+
+// recalcParallelism caps how many nodes of one wave run at the same time.
+const recalcParallelism = 8
+
+// Node kinds in the recalculation graph.
+const (
+	recalcScript  = "script"
+	recalcFormula = "formula"
+	recalcAI      = "ai"
+	recalcOptions = "options"
+)
+
+// recalcNode is a cell whose value is computed from other cells.
+type recalcNode struct {
+	Cell CellIdentifier
+	Kind string
+}
+
+func cellKey(c CellIdentifier) string {
+	return c.ProjectName + "/" + c.sheetName + "/" + c.col + c.row
+}
+
+func (n *recalcNode) key() string {
+	return cellKey(n.Cell)
+}
+
+// recalcGraph holds the nodes reached from a set of changed cells.
+// deps maps a node key to the keys of the nodes that read its output.
+type recalcGraph struct {
+	nodes map[string]*recalcNode
+	deps  map[string][]string
+}
+
+func newRecalcGraph() *recalcGraph {
+	return &recalcGraph{
+		nodes: make(map[string]*recalcNode),
+		deps:  make(map[string][]string),
+	}
+}
+
+// addNode adds n to the graph and reports whether it was not there yet.
+func (g *recalcGraph) addNode(n *recalcNode) bool {
+	k := n.key()
+	if _, ok := g.nodes[k]; ok {
+		return false
+	}
+	g.nodes[k] = n
+	return true
+}
+
+func (g *recalcGraph) addEdge(from, to string) {
+	for _, k := range g.deps[from] {
+		if k == to {
+			return
+		}
+	}
+	g.deps[from] = append(g.deps[from], to)
+}
+
+// sortedKeys returns the node keys in a stable order.
+func (g *recalcGraph) sortedKeys() []string {
+	keys := make([]string, 0, len(g.nodes))
+	for k := range g.nodes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parseCellLabel splits "AB12" into ("AB", "12").
+func parseCellLabel(label string) (col, row string) {
+	for i, ch := range label {
+		if ch >= '0' && ch <= '9' {
+			return label[:i], label[i:]
+		}
+	}
+	return label, ""
+}
+
+// rangeContainsCell reports whether refRange ("A2" or "A2:B3") covers the cell.
+func rangeContainsCell(refRange, row, col string) bool {
+	if !strings.Contains(refRange, ":") {
+		return refRange == col+row
+	}
+	rangeParts := strings.Split(refRange, ":")
+	if len(rangeParts) != 2 {
+		return false
+	}
+	startCol, startRow := parseCellLabel(rangeParts[0])
+	endCol, endRow := parseCellLabel(rangeParts[1])
+	cellRow := atoiSafe(row)
+	cellColIdx := colLabelToIndex(col)
+	return cellRow >= atoiSafe(startRow) && cellRow <= atoiSafe(endRow) &&
+		cellColIdx >= colLabelToIndex(startCol) && cellColIdx <= colLabelToIndex(endCol)
+}
+
+// findCellByID returns the coordinates of the cell with the given CellID.
+func findCellByID(s *Sheet, cellID string) (row, col string, cell Cell, found bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for r, rowMap := range s.Data {
+		for c, cl := range rowMap {
+			if cl.CellID == cellID {
+				return r, c, cl, true
+			}
+		}
+	}
+	return "", "", Cell{}, false
+}
+
+// dependentNodes returns the computed cells that read the given cell, either
+// through a script/formula/AI reference or through an OptionsRange.
+func (sm *SheetManager) dependentNodes(cell CellIdentifier) []*recalcNode {
+	var result []*recalcNode
+
+	for _, si := range sm.GetDependentScripts(cell.ProjectName, cell.sheetName, cell.row, cell.col) {
+		s := sm.GetSheetBy(si.ScriptSheetName, si.ScriptProjectName)
+		if s == nil {
+			continue
+		}
+		row, col, c, found := findCellByID(s, si.ScriptCellID)
+		if !found {
+			continue
+		}
+		kind := recalcScript
+		if c.CellType == AIGeneratedCell {
+			kind = recalcAI
+		} else if c.CellType == FormulaCell {
+			kind = recalcFormula
+		}
+		result = append(result, &recalcNode{
+			Cell: CellIdentifier{si.ScriptProjectName, si.ScriptSheetName, row, col},
+			Kind: kind,
+		})
+	}
+
+	sm.OptionsRangeDepsMu.RLock()
+	optionCells := append([]CellIdentifier(nil), sm.OptionsRangeDeps[cell.ProjectName+"/"+cell.sheetName]...)
+	sm.OptionsRangeDepsMu.RUnlock()
+	for _, oc := range optionCells {
+		s := sm.GetSheetBy(oc.sheetName, oc.ProjectName)
+		if s == nil {
+			continue
+		}
+		s.mu.RLock()
+		c, ok := s.Data[oc.row][oc.col]
+		s.mu.RUnlock()
+		if !ok || (c.CellType != ComboBoxCell && c.CellType != MultipleSelectionCell) {
+			continue
+		}
+		for _, dep := range parseOptionsRangeDependency(c.OptionsRange, oc.ProjectName, oc.sheetName) {
+			if dep.Project == cell.ProjectName && dep.Sheet == cell.sheetName && rangeContainsCell(dep.Range, cell.row, cell.col) {
+				result = append(result, &recalcNode{Cell: oc, Kind: recalcOptions})
+				break
+			}
+		}
+	}
+	return result
+}
+
+// outputCells returns the cells whose value is written when n runs.
+func (sm *SheetManager) outputCells(n *recalcNode) []CellIdentifier {
+	out := []CellIdentifier{n.Cell}
+	s := sm.GetSheetBy(n.Cell.sheetName, n.Cell.ProjectName)
+	if s == nil {
+		return out
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	switch n.Kind {
+	case recalcScript:
+		c := s.Data[n.Cell.row][n.Cell.col]
+		rSpan, cSpan := c.ScriptOutput_RowSpan, c.ScriptOutput_ColSpan
+		baseRow := atoiSafe(n.Cell.row)
+		baseIdx := colLabelToIndex(n.Cell.col)
+		for dr := 0; dr < rSpan; dr++ {
+			for dc := 0; dc < cSpan; dc++ {
+				if dr == 0 && dc == 0 {
+					continue
+				}
+				out = append(out, CellIdentifier{n.Cell.ProjectName, n.Cell.sheetName, itoa(baseRow + dr), indexToColLabel(baseIdx + dc)})
+			}
+		}
+	case recalcOptions:
+		// Document sheets copy the options of row 2 to every row of the column.
+		if s.SheetType == "document" && n.Cell.row == "2" {
+			for r := range s.Data {
+				if r != "1" && r != "2" {
+					out = append(out, CellIdentifier{n.Cell.ProjectName, n.Cell.sheetName, r, n.Cell.col})
+				}
+			}
+		}
+	}
+	return out
+}
+
+// expandRecalcGraph follows the outputs of the pending nodes to the nodes that
+// read them until no new nodes are found. A node reading its own output
+// (a self-referencing script) is not treated as an edge.
+func (sm *SheetManager) expandRecalcGraph(g *recalcGraph, pending []*recalcNode) {
+	for len(pending) > 0 {
+		n := pending[0]
+		pending = pending[1:]
+		for _, out := range sm.outputCells(n) {
+			for _, dep := range sm.dependentNodes(out) {
+				if dep.key() == n.key() {
+					continue
+				}
+				if g.addNode(dep) {
+					pending = append(pending, dep)
+				}
+				g.addEdge(n.key(), dep.key())
+			}
+		}
+	}
+}
+
+// buildRecalcGraph returns the graph of all nodes downstream of the changed cells.
+func (sm *SheetManager) buildRecalcGraph(changed []CellIdentifier) *recalcGraph {
+	g := newRecalcGraph()
+	var pending []*recalcNode
+	seen := make(map[string]bool)
+	for _, c := range changed {
+		if seen[cellKey(c)] {
+			continue
+		}
+		seen[cellKey(c)] = true
+		for _, n := range sm.dependentNodes(c) {
+			if g.addNode(n) {
+				pending = append(pending, n)
+			}
+		}
+	}
+	sm.expandRecalcGraph(g, pending)
+	return g
+}
+
+// cycles returns the strongly connected components of the graph that contain
+// more than one node, each ordered as a walk around the loop.
+func (g *recalcGraph) cycles() [][]string {
+	index := make(map[string]int)
+	low := make(map[string]int)
+	onStack := make(map[string]bool)
+	var stack []string
+	var result [][]string
+	next := 0
+
+	var strongConnect func(v string)
+	strongConnect = func(v string) {
+		index[v] = next
+		low[v] = next
+		next++
+		stack = append(stack, v)
+		onStack[v] = true
+		for _, w := range g.deps[v] {
+			if _, visited := index[w]; !visited {
+				strongConnect(w)
+				low[v] = min(low[v], low[w])
+			} else if onStack[w] {
+				low[v] = min(low[v], index[w])
+			}
+		}
+		if low[v] != index[v] {
+			return
+		}
+		var scc []string
+		for {
+			w := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[w] = false
+			scc = append(scc, w)
+			if w == v {
+				break
+			}
+		}
+		if len(scc) > 1 {
+			result = append(result, g.loopPath(scc))
+		}
+	}
+
+	for _, k := range g.sortedKeys() {
+		if _, visited := index[k]; !visited {
+			strongConnect(k)
+		}
+	}
+	return result
+}
+
+// loopPath orders the members of a strongly connected component as a walk
+// that starts at the smallest key and returns to it. Members not on that
+// walk are appended so every cell in the component is named.
+func (g *recalcGraph) loopPath(scc []string) []string {
+	sort.Strings(scc)
+	inSCC := make(map[string]bool, len(scc))
+	for _, k := range scc {
+		inSCC[k] = true
+	}
+	start := scc[0]
+	visited := map[string]bool{start: true}
+	var path []string
+	var walk func(v string) bool
+	walk = func(v string) bool {
+		path = append(path, v)
+		for _, w := range g.deps[v] {
+			if w == start {
+				return true
+			}
+			if inSCC[w] && !visited[w] {
+				visited[w] = true
+				if walk(w) {
+					return true
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	walk(start)
+	onPath := make(map[string]bool, len(path))
+	for _, k := range path {
+		onPath[k] = true
+	}
+	for _, k := range scc {
+		if !onPath[k] {
+			path = append(path, k)
+		}
+	}
+	return path
+}
+
+// waves groups the nodes that are not in skip into topological levels: every
+// node comes after all nodes it reads from. Edges from skipped nodes are
+// ignored, so cells downstream of a cycle still recalculate.
+func (g *recalcGraph) waves(skip map[string]bool) [][]string {
+	indegree := make(map[string]int)
+	for k := range g.nodes {
+		if !skip[k] {
+			indegree[k] = 0
+		}
+	}
+	for from, tos := range g.deps {
+		if skip[from] {
+			continue
+		}
+		for _, to := range tos {
+			if !skip[to] {
+				indegree[to]++
+			}
+		}
+	}
+
+	var result [][]string
+	var wave []string
+	for k, d := range indegree {
+		if d == 0 {
+			wave = append(wave, k)
+		}
+	}
+	for len(wave) > 0 {
+		sort.Strings(wave)
+		result = append(result, wave)
+		var nextWave []string
+		for _, from := range wave {
+			for _, to := range g.deps[from] {
+				if skip[to] {
+					continue
+				}
+				indegree[to]--
+				if indegree[to] == 0 {
+					nextWave = append(nextWave, to)
+				}
+			}
+		}
+		wave = nextWave
+	}
+	return result
+}
+
+// cycleLabel names cell c as seen from a cell on sheet (project, sheet):
+// "A1" on the same sheet, "project/sheet/A1" otherwise.
+func cycleLabel(c CellIdentifier, project, sheet string) string {
+	if c.ProjectName == project && c.sheetName == sheet {
+		return c.col + c.row
+	}
+	return c.ProjectName + "/" + c.sheetName + "/" + c.col + c.row
+}
+
+// cycleMessage is the #CYCLE error shown in a cell of the given loop.
+func (g *recalcGraph) cycleMessage(loop []string, at CellIdentifier) string {
+	labels := make([]string, 0, len(loop)+1)
+	for _, k := range loop {
+		labels = append(labels, cycleLabel(g.nodes[k].Cell, at.ProjectName, at.sheetName))
+	}
+	labels = append(labels, labels[0])
+	return recalcErrCycle + ": " + strings.Join(labels, " -> ")
+}
+
+// markCycleCell writes a #CYCLE error into a cell that was not run because it
+// is part of a reference loop.
+func markCycleCell(n *recalcNode, msg string) {
+	s := globalSheetManager.GetSheetBy(n.Cell.sheetName, n.Cell.ProjectName)
+	if s == nil {
+		return
+	}
+	row, col := n.Cell.row, n.Cell.col
+	s.mu.Lock()
+	c, ok := s.Data[row][col]
+	if !ok || c.Value == msg {
+		s.mu.Unlock()
+		return
+	}
+	oldVal := c.Value
+	c.Value = msg
+	if n.Kind != recalcOptions {
+		c.ScriptOutput = msg
+	}
+	s.Data[row][col] = c
+	cellChanges := make(map[string]cellChangesstruct)
+	cellChanges[row+"-"+col] = cellChangesstruct{
+		rowNum: atoiSafe(row),
+		colStr: col,
+		oldVal: oldVal,
+		newVal: msg,
+		action: "EDIT_CELL",
+		user:   "system",
+	}
+	addMergedAuditEntries(s, cellChanges)
+	s.mu.Unlock()
+
+	globalSheetManager.SaveCells(s, cellRef{row, col})
+	globalSheetManager.QueueRowColUpdate(s.ProjectName, s.Name)
+}
+
+// runRecalcNode recomputes a single node. The executors do not queue their
+// dependents here; the scheduler already knows them.
+func runRecalcNode(n *recalcNode) {
+	p, sh, row, col := n.Cell.ProjectName, n.Cell.sheetName, n.Cell.row, n.Cell.col
+	switch n.Kind {
+	case recalcAI:
+		ExecuteAICell(p, sh, row, col)
+	case recalcFormula:
+		ExecuteFormulaCell(p, sh, row, col)
+	case recalcOptions:
+		s := globalSheetManager.GetSheetBy(sh, p)
+		if s == nil {
+			return
+		}
+		if cells := refreshOptionsCell(s, n.Cell); len(cells) > 0 {
+			globalSheetManager.SaveCells(s, cells...)
+			globalSheetManager.QueueRowColUpdate(s.ProjectName, s.Name)
+		}
+	default:
+		ExecuteCellScript(p, sh, row, col)
+	}
+}
+
+// Recalculate recomputes every cell downstream of the changed cells in
+// dependency order. Cells on a reference loop get a #CYCLE error instead.
+func (sm *SheetManager) Recalculate(changed []CellIdentifier) {
+	if len(changed) == 0 {
+		return
+	}
+	g := sm.buildRecalcGraph(changed)
+	if len(g.nodes) == 0 {
+		return
+	}
+
+	inCycle := make(map[string]bool)
+	for _, loop := range g.cycles() {
+		for _, k := range loop {
+			inCycle[k] = true
+		}
+		for _, k := range loop {
+			n := g.nodes[k]
+			msg := g.cycleMessage(loop, n.Cell)
+			log.Printf("Recalculation: %s/%s/%s%s %s", n.Cell.ProjectName, n.Cell.sheetName, n.Cell.col, n.Cell.row, msg)
+			markCycleCell(n, msg)
+		}
+	}
+
+	sem := make(chan struct{}, recalcParallelism)
+	for _, wave := range g.waves(inCycle) {
+		var wg sync.WaitGroup
+		for _, k := range wave {
+			n := g.nodes[k]
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				runRecalcNode(n)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// DependencyGraphNode is a computed cell in an exported dependency graph.
+// References lists the cells and ranges it reads as "project/sheet/range".
+type DependencyGraphNode struct {
+	ID         string   `json:"id"`
+	Project    string   `json:"project"`
+	Sheet      string   `json:"sheet"`
+	Cell       string   `json:"cell"`
+	Kind       string   `json:"kind"`
+	References []string `json:"references,omitempty"`
+}
+
+// DependencyGraphEdge says that To reads a value written by From.
+type DependencyGraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// DependencyGraph is the recalculation graph as returned by the API.
+type DependencyGraph struct {
+	Nodes  []DependencyGraphNode `json:"nodes"`
+	Edges  []DependencyGraphEdge `json:"edges"`
+	Cycles [][]string            `json:"cycles"`
+}
+
+// exportRecalcGraph converts the graph to its API form.
+func (sm *SheetManager) exportRecalcGraph(g *recalcGraph) DependencyGraph {
+	out := DependencyGraph{
+		Nodes:  []DependencyGraphNode{},
+		Edges:  []DependencyGraphEdge{},
+		Cycles: [][]string{},
+	}
+	for _, k := range g.sortedKeys() {
+		n := g.nodes[k]
+		var refs []string
+		for _, ref := range sm.precedentRefs(n) {
+			refs = append(refs, ref.Project+"/"+ref.Sheet+"/"+ref.Range)
+		}
+		out.Nodes = append(out.Nodes, DependencyGraphNode{
+			ID:         k,
+			Project:    n.Cell.ProjectName,
+			Sheet:      n.Cell.sheetName,
+			Cell:       n.Cell.col + n.Cell.row,
+			Kind:       n.Kind,
+			References: refs,
+		})
+		tos := append([]string(nil), g.deps[k]...)
+		sort.Strings(tos)
+		for _, to := range tos {
+			out.Edges = append(out.Edges, DependencyGraphEdge{From: k, To: to})
+		}
+	}
+	out.Cycles = append(out.Cycles, g.cycles()...)
+	return out
+}
+
+// recalcKind returns the node kind of a computed cell, or "" for a plain value.
+func recalcKind(cell Cell) string {
+	switch {
+	case cell.CellType == AIGeneratedCell && strings.TrimSpace(cell.AIPrompt) != "":
+		return recalcAI
+	case cell.CellType == FormulaCell:
+		return recalcFormula
+	case (cell.CellType == ComboBoxCell || cell.CellType == MultipleSelectionCell) && strings.TrimSpace(cell.OptionsRange) != "":
+		return recalcOptions
+	case strings.TrimSpace(cell.Script) != "":
+		return recalcScript
+	}
+	return ""
+}
+
+// computedNodes returns a node for every computed cell of the sheet.
+func computedNodes(s *Sheet) []*recalcNode {
+	var nodes []*recalcNode
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for r, rowMap := range s.Data {
+		for c, cell := range rowMap {
+			if kind := recalcKind(cell); kind != "" {
+				nodes = append(nodes, &recalcNode{Cell: CellIdentifier{s.ProjectName, s.Name, r, c}, Kind: kind})
+			}
+		}
+	}
+	return nodes
+}
+
+// SheetDependencyGraph returns the recalculation graph that starts at the
+// computed cells of one sheet and follows their dependents across sheets.
+func (sm *SheetManager) SheetDependencyGraph(s *Sheet) DependencyGraph {
+	roots := computedNodes(s)
+	g := newRecalcGraph()
+	for _, n := range roots {
+		g.addNode(n)
+	}
+	sm.expandRecalcGraph(g, roots)
+	return sm.exportRecalcGraph(g)
+}
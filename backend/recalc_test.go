@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// recalcTestGraph builds a graph of P/S cells from "A1>B1" edges, meaning B1
+// reads the output of A1, and lone "E1" nodes.
+func recalcTestGraph(edges ...string) *recalcGraph {
+	g := newRecalcGraph()
+	key := func(label string) string {
+		col, row := parseCellLabel(label)
+		n := &recalcNode{Cell: CellIdentifier{"P", "S", row, col}, Kind: recalcFormula}
+		g.addNode(n)
+		return n.key()
+	}
+	for _, e := range edges {
+		from, to, ok := strings.Cut(e, ">")
+		if !ok {
+			key(from)
+			continue
+		}
+		g.addEdge(key(from), key(to))
+	}
+	return g
+}
+
+func TestRecalcCycles(t *testing.T) {
+	tests := []struct {
+		name  string
+		edges []string
+		want  [][]string
+	}{
+		{"no cycle", []string{"A1>B1", "B1>C1", "A1>C1"}, nil},
+		{"two cells", []string{"B1>A1", "A1>B1", "A1>C1"}, [][]string{{"P/S/A1", "P/S/B1"}}},
+		{"walk starts at smallest key", []string{"C1>A1", "A1>B1", "B1>C1"}, [][]string{{"P/S/A1", "P/S/B1", "P/S/C1"}}},
+		{"two loops", []string{"A1>B1", "B1>A1", "D1>E1", "E1>D1", "B1>D1"}, [][]string{{"P/S/D1", "P/S/E1"}, {"P/S/A1", "P/S/B1"}}},
+	}
+	for _, tt := range tests {
+		if got := recalcTestGraph(tt.edges...).cycles(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: cycles() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRecalcWaves(t *testing.T) {
+	// A1 feeds B1 and C1; D1 reads both; E1 is independent.
+	g := recalcTestGraph("A1>B1", "A1>C1", "B1>D1", "C1>D1", "E1")
+	want := [][]string{{"P/S/A1", "P/S/E1"}, {"P/S/B1", "P/S/C1"}, {"P/S/D1"}}
+	if got := g.waves(nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("waves() = %v, want %v", got, want)
+	}
+}
+
+func TestRecalcWavesSkipCycle(t *testing.T) {
+	// A1 and B1 form a loop; C1 reads B1 and must still recalculate.
+	g := recalcTestGraph("A1>B1", "B1>A1", "B1>C1", "C1>D1")
+	skip := make(map[string]bool)
+	for _, loop := range g.cycles() {
+		for _, k := range loop {
+			skip[k] = true
+		}
+	}
+	want := [][]string{{"P/S/C1"}, {"P/S/D1"}}
+	if got := g.waves(skip); !reflect.DeepEqual(got, want) {
+		t.Errorf("waves(skip) = %v, want %v", got, want)
+	}
+}
+
+func TestRecalcCycleMessage(t *testing.T) {
+	g := recalcTestGraph("A1>B1", "B1>A1")
+	other := &recalcNode{Cell: CellIdentifier{"P", "T", "1", "C"}}
+	g.addNode(other)
+	g.addEdge("P/S/B1", other.key())
+	g.addEdge(other.key(), "P/S/A1")
+
+	loops := g.cycles()
+	if len(loops) != 1 {
+		t.Fatalf("cycles() = %v, want one loop", loops)
+	}
+	if got, want := g.cycleMessage(loops[0], CellIdentifier{"P", "S", "1", "A"}), "#CYCLE: A1 -> B1 -> P/T/C1 -> A1"; got != want {
+		t.Errorf("cycleMessage on S = %q, want %q", got, want)
+	}
+	if got, want := g.cycleMessage(loops[0], other.Cell), "#CYCLE: P/S/A1 -> P/S/B1 -> C1 -> P/S/A1"; got != want {
+		t.Errorf("cycleMessage on T = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ────────────────────────────────────────────────
+// References into deleted cells
+// ────────────────────────────────────────────────
+//
+// Before a sheet, project, row or column is deleted, the delete paths look
+// up scriptDeps and OptionsRangeDeps for cells elsewhere that still point
+// into it. The caller then aborts (default), forces the delete, or rewrites
+// those references to the literal values they currently resolve to.
+
+// Delete modes accepted by the sheet, project, row and column delete paths.
+const (
+	DeleteModeAbort   = "abort"
+	DeleteModeForce   = "force"
+	DeleteModeRewrite = "rewrite"
+)
+
+// ExternalReference is a cell outside the deleted area that reads a cell
+// inside it. Reference is the target as "project/sheet/range".
+type ExternalReference struct {
+	Project   string `json:"project"`
+	Sheet     string `json:"sheet"`
+	Cell      string `json:"cell"`
+	Kind      string `json:"kind"`
+	Reference string `json:"reference"`
+}
+
+// deleteScope describes the cells about to be deleted. contains reports
+// whether a referenced range lies entirely inside them; inside reports
+// whether a referencing cell on that sheet is itself going away (or is
+// adjusted by the row/column shift logic) and so does not count. shrink,
+// set for row and column deletes only, returns a range that only partly
+// overlaps the deleted cells with them cut out.
+type deleteScope struct {
+	contains func(project, sheet, rangeStr string) bool
+	inside   func(project, sheet string) bool
+	shrink   func(project, sheet, rangeStr string) (string, bool)
+}
+
+func sheetDeleteScope(project, sheet string) deleteScope {
+	same := func(p, s string) bool { return p == project && s == sheet }
+	return deleteScope{
+		contains: func(p, s, _ string) bool { return same(p, s) },
+		inside:   same,
+	}
+}
+
+func projectDeleteScope(project string) deleteScope {
+	return deleteScope{
+		contains: func(p, _, _ string) bool { return inProject(p, project) },
+		inside:   func(p, _ string) bool { return inProject(p, project) },
+	}
+}
+
+// rangeBounds returns the column indexes and row numbers spanned by "A2" or "A2:B3".
+func rangeBounds(rangeStr string) (c1, r1, c2, r2 int) {
+	parts := strings.SplitN(rangeStr, ":", 2)
+	col, row := parseCellLabel(parts[0])
+	c1, r1 = colLabelToIndex(col), atoiSafe(row)
+	c2, r2 = c1, r1
+	if len(parts) == 2 {
+		col, row = parseCellLabel(parts[1])
+		c2, r2 = colLabelToIndex(col), atoiSafe(row)
+	}
+	if r1 > r2 {
+		r1, r2 = r2, r1
+	}
+	if c1 > c2 {
+		c1, c2 = c2, c1
+	}
+	return
+}
+
+// rangeLabel formats bounds as "A2" or "A2:B3".
+func rangeLabel(c1, r1, c2, r2 int) string {
+	label := indexToColLabel(c1) + strconv.Itoa(r1)
+	if c1 != c2 || r1 != r2 {
+		label += ":" + indexToColLabel(c2) + strconv.Itoa(r2)
+	}
+	return label
+}
+
+// cutSpan removes [first, last] from [lo, hi]. partial is true when the two
+// overlap without [lo, hi] lying entirely inside the removed span.
+func cutSpan(lo, hi, first, last int) (newLo, newHi int, partial bool) {
+	if hi < first || lo > last || (lo >= first && hi <= last) {
+		return lo, hi, false
+	}
+	// Every removed line at or above hi moves hi up by one.
+	return min(lo, first), hi - (min(hi, last) - first + 1), true
+}
+
+func rowsDeleteScope(project, sheet string, firstRow, lastRow int) deleteScope {
+	same := func(p, s string) bool { return p == project && s == sheet }
+	return deleteScope{
+		contains: func(p, s, rangeStr string) bool {
+			if !same(p, s) {
+				return false
+			}
+			_, r1, _, r2 := rangeBounds(rangeStr)
+			return r1 >= firstRow && r2 <= lastRow
+		},
+		inside: same,
+		shrink: func(p, s, rangeStr string) (string, bool) {
+			if !same(p, s) {
+				return rangeStr, false
+			}
+			c1, r1, c2, r2 := rangeBounds(rangeStr)
+			r1, r2, partial := cutSpan(r1, r2, firstRow, lastRow)
+			if !partial {
+				return rangeStr, false
+			}
+			return rangeLabel(c1, r1, c2, r2), true
+		},
+	}
+}
+
+func columnDeleteScope(project, sheet string, colIdx int) deleteScope {
+	same := func(p, s string) bool { return p == project && s == sheet }
+	return deleteScope{
+		contains: func(p, s, rangeStr string) bool {
+			if !same(p, s) {
+				return false
+			}
+			c1, _, c2, _ := rangeBounds(rangeStr)
+			return c1 == colIdx && c2 == colIdx
+		},
+		inside: same,
+		shrink: func(p, s, rangeStr string) (string, bool) {
+			if !same(p, s) {
+				return rangeStr, false
+			}
+			c1, r1, c2, r2 := rangeBounds(rangeStr)
+			c1, c2, partial := cutSpan(c1, c2, colIdx, colIdx)
+			if !partial {
+				return rangeStr, false
+			}
+			return rangeLabel(c1, r1, c2, r2), true
+		},
+	}
+}
+
+// splitSheetKey splits a "project/sheet" dependency key. The project may
+// itself contain slashes (subfolders).
+func splitSheetKey(key string) (project, sheet string) {
+	i := strings.LastIndex(key, "/")
+	if i < 0 {
+		return "", key
+	}
+	return key[:i], key[i+1:]
+}
+
+// findExternalReferences lists the cells outside the scope that reference a
+// range lying entirely inside it.
+func (sm *SheetManager) findExternalReferences(scope deleteScope) []ExternalReference {
+	return sm.findReferences(scope, scope.contains)
+}
+
+// findPartialReferences lists the cells outside the scope that reference a
+// range only partly inside it.
+func (sm *SheetManager) findPartialReferences(scope deleteScope) []ExternalReference {
+	if scope.shrink == nil {
+		return nil
+	}
+	return sm.findReferences(scope, func(project, sheet, rangeStr string) bool {
+		_, partial := scope.shrink(project, sheet, rangeStr)
+		return partial
+	})
+}
+
+// findReferences lists the cells outside the scope that reference a range
+// matching match.
+func (sm *SheetManager) findReferences(scope deleteScope, match func(project, sheet, rangeStr string) bool) []ExternalReference {
+	var result []ExternalReference
+	seen := make(map[string]bool)
+	add := func(ref ExternalReference) {
+		k := ref.Project + "/" + ref.Sheet + "/" + ref.Cell + "->" + ref.Reference
+		if !seen[k] {
+			seen[k] = true
+			result = append(result, ref)
+		}
+	}
+
+	sm.scriptDepsMu.RLock()
+	scriptDeps := make(map[string][]ScriptIdentifier, len(sm.scriptDeps))
+	for k, v := range sm.scriptDeps {
+		scriptDeps[k] = append([]ScriptIdentifier(nil), v...)
+	}
+	sm.scriptDepsMu.RUnlock()
+	for key, scripts := range scriptDeps {
+		project, sheet := splitSheetKey(key)
+		for _, si := range scripts {
+			if scope.inside(si.ScriptProjectName, si.ScriptSheetName) || !match(project, sheet, si.ReferencedRange) {
+				continue
+			}
+			s := sm.GetSheetBy(si.ScriptSheetName, si.ScriptProjectName)
+			if s == nil {
+				continue
+			}
+			row, col, cell, found := findCellByID(s, si.ScriptCellID)
+			if !found {
+				continue
+			}
+			add(ExternalReference{si.ScriptProjectName, si.ScriptSheetName, col + row, recalcKind(cell), key + "/" + si.ReferencedRange})
+		}
+	}
+
+	sm.OptionsRangeDepsMu.RLock()
+	optionDeps := make(map[string][]CellIdentifier, len(sm.OptionsRangeDeps))
+	for k, v := range sm.OptionsRangeDeps {
+		optionDeps[k] = append([]CellIdentifier(nil), v...)
+	}
+	sm.OptionsRangeDepsMu.RUnlock()
+	for _, cells := range optionDeps {
+		for _, oc := range cells {
+			if scope.inside(oc.ProjectName, oc.sheetName) {
+				continue
+			}
+			s := sm.GetSheetBy(oc.sheetName, oc.ProjectName)
+			if s == nil {
+				continue
+			}
+			s.mu.RLock()
+			optionsRange := s.Data[oc.row][oc.col].OptionsRange
+			s.mu.RUnlock()
+			for _, dep := range parseOptionsRangeDependency(optionsRange, oc.ProjectName, oc.sheetName) {
+				if match(dep.Project, dep.Sheet, dep.Range) {
+					add(ExternalReference{oc.ProjectName, oc.sheetName, oc.col + oc.row, recalcOptions, dep.Project + "/" + dep.Sheet + "/" + dep.Range})
+				}
+			}
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Project+"/"+a.Sheet != b.Project+"/"+b.Sheet {
+			return a.Project+"/"+a.Sheet < b.Project+"/"+b.Sheet
+		}
+		if a.Cell != b.Cell {
+			return a.Cell < b.Cell
+		}
+		return a.Reference < b.Reference
+	})
+	return result
+}
+
+// rowDeleteScope returns the scope of DeleteRowAt(rowStr): the row and its
+// descendants, which form one contiguous block.
+func (s *Sheet) rowDeleteScope(rowStr string) (deleteScope, bool) {
+	row := atoiSafe(rowStr)
+	if row <= 0 {
+		return deleteScope{}, false
+	}
+	s.mu.RLock()
+	blockSize := 1 + len(s.getDescendants(row))
+	project, name := s.ProjectName, s.Name
+	s.mu.RUnlock()
+	return rowsDeleteScope(project, name, row, row+blockSize-1), true
+}
+
+// refTagPattern matches any {{...}} reference tag; coordRangePattern a
+// coordinate cell or range inside one.
+var (
+	refTagPattern     = regexp.MustCompile(`\{\{([^{}]+)\}\}`)
+	coordRangePattern = regexp.MustCompile(`^[A-Z]+\d+(?::[A-Z]+\d+)?$`)
+)
+
+// parseRefTag resolves the inside of a {{...}} tag to the sheet and
+// coordinate range it points at. Cell names are resolved to coordinates.
+func parseRefTag(inner, curProject, curSheet string) (DependencyInfo, bool) {
+	parts := strings.Split(strings.TrimSpace(inner), "/")
+	ref := DependencyInfo{Project: curProject, Sheet: curSheet, Range: parts[len(parts)-1]}
+	if len(parts) >= 3 {
+		ref.Project = strings.Join(parts[:len(parts)-2], "/")
+		ref.Sheet = parts[len(parts)-2]
+	} else if len(parts) != 1 {
+		return ref, false
+	}
+	if coordRangePattern.MatchString(ref.Range) {
+		return ref, true
+	}
+	s := globalSheetManager.GetSheetBy(ref.Sheet, ref.Project)
+	if s == nil {
+		return ref, false
+	}
+	row, col, found := s.FindCellByName(ref.Range)
+	if !found {
+		return ref, false
+	}
+	ref.Range = col + row
+	return ref, true
+}
+
+// formulaLiteral returns a value as a formula constant.
+func formulaLiteral(val string) string {
+	if _, err := strconv.ParseFloat(val, 64); err == nil {
+		return val
+	}
+	return `"` + strings.ReplaceAll(val, `"`, `""`) + `"`
+}
+
+// rewriteReferencesToValues replaces every reference from the given cells
+// into the scope with the value it currently resolves to. Script tags become
+// the literal the script would have received, AI prompt tags become the
+// text, formula cell references become constants and options cells keep
+// their current options as a fixed list. A formula that reads a whole range
+// from the scope is frozen to its current value.
+func (sm *SheetManager) rewriteReferencesToValues(refs []ExternalReference, scope deleteScope, user string) {
+	type cellKeyT struct{ project, sheet, cell string }
+	done := make(map[cellKeyT]bool)
+	for _, ref := range refs {
+		k := cellKeyT{ref.Project, ref.Sheet, ref.Cell}
+		if done[k] {
+			continue
+		}
+		done[k] = true
+		s := sm.GetSheetBy(ref.Sheet, ref.Project)
+		if s == nil {
+			continue
+		}
+		col, row := parseCellLabel(ref.Cell)
+
+		s.mu.RLock()
+		cell, ok := s.Data[row][col]
+		s.mu.RUnlock()
+		if !ok {
+			continue
+		}
+
+		if ref.Kind == recalcOptions {
+			s.mu.Lock()
+			c := s.Data[row][col]
+			c.OptionsRange = ""
+			s.Data[row][col] = c
+			s.mu.Unlock()
+			sm.UpdateOptionsRangeDependencies(ref.Project, ref.Sheet, row, col, "")
+			sm.SaveSheet(s)
+			log.Printf("Reference rewrite: %s/%s/%s options fixed to current list by %s", ref.Project, ref.Sheet, ref.Cell, user)
+			continue
+		}
+
+		text := cellDepText(cell)
+		freeze := false
+		newText := refTagPattern.ReplaceAllStringFunc(text, func(tag string) string {
+			inner := refTagPattern.FindStringSubmatch(tag)[1]
+			target, ok := parseRefTag(inner, ref.Project, ref.Sheet)
+			if !ok || !scope.contains(target.Project, target.Sheet, target.Range) {
+				return tag
+			}
+			switch ref.Kind {
+			case recalcAI:
+				return ResolveAIPrompt(tag, ref.Project, ref.Sheet)
+			case recalcFormula:
+				if strings.Contains(target.Range, ":") {
+					freeze = true
+					return tag
+				}
+				return formulaLiteral(ResolveScriptRefs(tag, s, ref.Project, ref.Sheet, cell.CellID))
+			default:
+				return ResolveScriptRefs(tag, s, ref.Project, ref.Sheet, cell.CellID)
+			}
+		})
+		if newText == text && !freeze {
+			continue
+		}
+
+		action := "EDIT_SCRIPT"
+		s.mu.Lock()
+		c := s.Data[row][col]
+		switch {
+		case freeze:
+			action = "EDIT_CELL"
+			newText = c.Value
+			c.CellType = ValueCell
+			c.Script = ""
+			c.ScriptOutput = ""
+		case ref.Kind == recalcAI:
+			action = "EDIT_AI_PROMPT"
+			c.AIPrompt = newText
+		case ref.Kind == recalcFormula:
+			action = "EDIT_FORMULA"
+			c.Script = newText
+		default:
+			c.Script = newText
+		}
+		s.Data[row][col] = c
+		cellChanges := make(map[string]cellChangesstruct)
+		cellChanges[row+"-"+col] = cellChangesstruct{
+			rowNum: atoiSafe(row),
+			colStr: col,
+			oldVal: text,
+			newVal: newText,
+			action: action,
+			user:   user,
+		}
+		addMergedAuditEntries(s, cellChanges)
+		cellID := c.CellID
+		depText := cellDepText(c)
+		s.mu.Unlock()
+
+		sm.UpdateScriptDependencies(ref.Project, ref.Sheet, cellID, depText, row, col)
+		sm.SaveSheet(s)
+		sm.QueueRowColUpdate(ref.Project, ref.Sheet)
+		log.Printf("Reference rewrite: %s/%s/%s references into deleted cells replaced by values (%s)", ref.Project, ref.Sheet, ref.Cell, user)
+	}
+}
+
+// shrinkPartialReferences rewrites references that only partly overlap the
+// deleted rows or columns so they cover what is left of their range, e.g.
+// {{P/S/A1:A10}} becomes {{P/S/A1:A9}} when row 5 is deleted.
+func (sm *SheetManager) shrinkPartialReferences(scope deleteScope, user string) {
+	type cellKeyT struct{ project, sheet, cell string }
+	done := make(map[cellKeyT]bool)
+	for _, ref := range sm.findPartialReferences(scope) {
+		k := cellKeyT{ref.Project, ref.Sheet, ref.Cell}
+		if done[k] {
+			continue
+		}
+		done[k] = true
+		s := sm.GetSheetBy(ref.Sheet, ref.Project)
+		if s == nil {
+			continue
+		}
+		col, row := parseCellLabel(ref.Cell)
+
+		if ref.Kind == recalcOptions {
+			s.mu.Lock()
+			c := s.Data[row][col]
+			deps := parseOptionsRangeDependency(c.OptionsRange, ref.Project, ref.Sheet)
+			if len(deps) == 0 {
+				s.mu.Unlock()
+				continue
+			}
+			newRange, ok := scope.shrink(deps[0].Project, deps[0].Sheet, deps[0].Range)
+			if !ok {
+				s.mu.Unlock()
+				continue
+			}
+			prefix := c.OptionsRange[:strings.LastIndex(c.OptionsRange, "/")+1]
+			c.OptionsRange = prefix + newRange
+			s.Data[row][col] = c
+			optionsRange := c.OptionsRange
+			s.mu.Unlock()
+			sm.UpdateOptionsRangeDependencies(ref.Project, ref.Sheet, row, col, optionsRange)
+			sm.SaveSheet(s)
+			log.Printf("Reference shrink: %s/%s/%s options range now %s (%s)", ref.Project, ref.Sheet, ref.Cell, optionsRange, user)
+			continue
+		}
+
+		s.mu.RLock()
+		cell, ok := s.Data[row][col]
+		s.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		text := cellDepText(cell)
+		newText := refTagPattern.ReplaceAllStringFunc(text, func(tag string) string {
+			inner := refTagPattern.FindStringSubmatch(tag)[1]
+			target, ok := parseRefTag(inner, ref.Project, ref.Sheet)
+			if !ok {
+				return tag
+			}
+			newRange, ok := scope.shrink(target.Project, target.Sheet, target.Range)
+			if !ok {
+				return tag
+			}
+			inner = strings.TrimSpace(inner)
+			return "{{" + inner[:strings.LastIndex(inner, "/")+1] + newRange + "}}"
+		})
+		if newText == text {
+			continue
+		}
+
+		action := "EDIT_SCRIPT"
+		s.mu.Lock()
+		c := s.Data[row][col]
+		switch ref.Kind {
+		case recalcAI:
+			action = "EDIT_AI_PROMPT"
+			c.AIPrompt = newText
+		case recalcFormula:
+			action = "EDIT_FORMULA"
+			c.Script = newText
+		default:
+			c.Script = newText
+		}
+		s.Data[row][col] = c
+		cellChanges := make(map[string]cellChangesstruct)
+		cellChanges[row+"-"+col] = cellChangesstruct{
+			rowNum: atoiSafe(row),
+			colStr: col,
+			oldVal: text,
+			newVal: newText,
+			action: action,
+			user:   user,
+		}
+		addMergedAuditEntries(s, cellChanges)
+		cellID := c.CellID
+		depText := cellDepText(c)
+		s.mu.Unlock()
+
+		sm.UpdateScriptDependencies(ref.Project, ref.Sheet, cellID, depText, row, col)
+		sm.SaveSheet(s)
+		sm.QueueRowColUpdate(ref.Project, ref.Sheet)
+		log.Printf("Reference shrink: %s/%s/%s references into deleted cells shrunk (%s)", ref.Project, ref.Sheet, ref.Cell, user)
+	}
+}
+
+// resolveDeleteReferences applies the delete mode to the references found for
+// a pending delete. It returns false when the delete must not go ahead.
+func (sm *SheetManager) resolveDeleteReferences(refs []ExternalReference, scope deleteScope, mode, user string) bool {
+	if len(refs) == 0 {
+		return true
+	}
+	switch mode {
+	case DeleteModeForce:
+		log.Printf("Delete forced by %s with %d dangling references", user, len(refs))
+		return true
+	case DeleteModeRewrite:
+		sm.rewriteReferencesToValues(refs, scope, user)
+		return true
+	default:
+		return false
+	}
+}
+
+// CheckSheetDelete looks up references into a sheet before it is deleted and
+// applies mode to them. It returns the references and whether the delete may
+// proceed.
+func (sm *SheetManager) CheckSheetDelete(name, project, mode, user string) ([]ExternalReference, bool) {
+	scope := sheetDeleteScope(project, name)
+	refs := sm.findExternalReferences(scope)
+	return refs, sm.resolveDeleteReferences(refs, scope, mode, user)
+}
+
+// CheckProjectDelete is CheckSheetDelete for a whole project and its subfolders.
+func (sm *SheetManager) CheckProjectDelete(project, mode, user string) ([]ExternalReference, bool) {
+	scope := projectDeleteScope(project)
+	refs := sm.findExternalReferences(scope)
+	return refs, sm.resolveDeleteReferences(refs, scope, mode, user)
+}
+
+// CheckRowDelete is CheckSheetDelete for DeleteRowAt(rowStr). Only
+// references to ranges entirely inside the deleted rows count; once the
+// delete may proceed, ranges that partly overlap them are shrunk.
+func (s *Sheet) CheckRowDelete(rowStr, mode, user string) ([]ExternalReference, bool) {
+	scope, ok := s.rowDeleteScope(rowStr)
+	if !ok {
+		return nil, true
+	}
+	refs := globalSheetManager.findExternalReferences(scope)
+	if !globalSheetManager.resolveDeleteReferences(refs, scope, mode, user) {
+		return refs, false
+	}
+	globalSheetManager.shrinkPartialReferences(scope, user)
+	return refs, true
+}
+
+// CheckColumnDelete is CheckRowDelete for DeleteColumnAt(colStr).
+func (s *Sheet) CheckColumnDelete(colStr, mode, user string) ([]ExternalReference, bool) {
+	idx := colLabelToIndex(colStr)
+	if idx <= 0 {
+		return nil, true
+	}
+	s.mu.RLock()
+	project, name := s.ProjectName, s.Name
+	s.mu.RUnlock()
+	scope := columnDeleteScope(project, name, idx)
+	refs := globalSheetManager.findExternalReferences(scope)
+	if !globalSheetManager.resolveDeleteReferences(refs, scope, mode, user) {
+		return refs, false
+	}
+	globalSheetManager.shrinkPartialReferences(scope, user)
+	return refs, true
+}
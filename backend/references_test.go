@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestRowsDeleteScope(t *testing.T) {
+	scope := rowsDeleteScope("P", "S", 5, 6)
+	tests := []struct {
+		sheet, rangeStr string
+		contains        bool
+		shrunk          string
+	}{
+		{"S", "A5", true, ""},
+		{"S", "A5:C6", true, ""},
+		{"S", "A1:A10", false, "A1:A8"},
+		{"S", "A4:B5", false, "A4:B4"},
+		{"S", "A6:A9", false, "A5:A7"},
+		{"S", "A1:A4", false, ""},
+		{"S", "A7:A9", false, ""},
+		{"T", "A5", false, ""},
+	}
+	for _, tt := range tests {
+		if got := scope.contains("P", tt.sheet, tt.rangeStr); got != tt.contains {
+			t.Errorf("contains(%s!%s) = %v, want %v", tt.sheet, tt.rangeStr, got, tt.contains)
+		}
+		got, ok := scope.shrink("P", tt.sheet, tt.rangeStr)
+		if ok != (tt.shrunk != "") || (ok && got != tt.shrunk) {
+			t.Errorf("shrink(%s!%s) = %q, %v, want %q", tt.sheet, tt.rangeStr, got, ok, tt.shrunk)
+		}
+	}
+}
+
+func TestColumnDeleteScope(t *testing.T) {
+	scope := columnDeleteScope("P", "S", colLabelToIndex("B"))
+	tests := []struct {
+		rangeStr string
+		contains bool
+		shrunk   string
+	}{
+		{"B3", true, ""},
+		{"B1:B9", true, ""},
+		{"A1:C2", false, "A1:B2"},
+		{"B1:C1", false, "B1"},
+		{"A1:B1", false, "A1"},
+		{"C1:D4", false, ""},
+	}
+	for _, tt := range tests {
+		if got := scope.contains("P", "S", tt.rangeStr); got != tt.contains {
+			t.Errorf("contains(%s) = %v, want %v", tt.rangeStr, got, tt.contains)
+		}
+		got, ok := scope.shrink("P", "S", tt.rangeStr)
+		if ok != (tt.shrunk != "") || (ok && got != tt.shrunk) {
+			t.Errorf("shrink(%s) = %q, %v, want %q", tt.rangeStr, got, ok, tt.shrunk)
+		}
+	}
+}
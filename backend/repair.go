@@ -0,0 +1,566 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ────────────────────────────────────────────────
+// Repair of flagged sheets
+// ────────────────────────────────────────────────
+//
+// A sheet whose checksum fails loads read-only, and one that cannot be
+// decoded does not load at all. /api/admin/repair lists those sheets, diffs
+// the file on disk against a snapshot (a stored backup whose checksum holds,
+// or the current content plus the write-ahead log records held back for the
+// sheet) and applies one of three actions:
+//
+//	accept     keep the current content and re-sign its checksum
+//	rollback   replace the content with a snapshot
+//	quarantine copy the current content into a new, editable sheet
+//
+// accept and rollback take a safety backup first. Every action is recorded
+// in the project audit log.
+
+// Snapshot sources a flagged sheet can be compared with or rolled back to.
+const (
+	RepairSourceBackup = "backup"
+	RepairSourceWAL    = "wal"
+)
+
+// Repair actions accepted by POST /api/admin/repair.
+const (
+	RepairActionAccept     = "accept"
+	RepairActionRollback   = "rollback"
+	RepairActionQuarantine = "quarantine"
+)
+
+// FlaggedSheet is a sheet file that failed its integrity check or is marked
+// read-only. Loaded is false when the file could not be decoded.
+type FlaggedSheet struct {
+	Project     string `json:"project"`
+	Sheet       string `json:"sheet"`
+	Reason      string `json:"reason"`
+	Loaded      bool   `json:"loaded"`
+	HeldRecords int    `json:"held_wal_records,omitempty"`
+}
+
+// RepairSnapshot is a state a flagged sheet can be rolled back to. Intact
+// is false for a backup copy whose own checksum does not hold.
+type RepairSnapshot struct {
+	Source    string    `json:"source"`
+	Backup    string    `json:"backup,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Intact    bool      `json:"intact"`
+	Records   int       `json:"records,omitempty"`
+}
+
+// RepairCellDiff is one cell that differs between the current file and the
+// compared snapshot. Change describes what a rollback would do to it.
+type RepairCellDiff struct {
+	Cell     string `json:"cell"`
+	Change   string `json:"change"` // "added", "removed" or "changed"
+	Current  *Cell  `json:"current,omitempty"`
+	Snapshot *Cell  `json:"snapshot,omitempty"`
+}
+
+// RepairReport is the GET /api/admin/repair answer for one sheet.
+type RepairReport struct {
+	FlaggedSheet
+	CurrentError    string           `json:"current_error,omitempty"`
+	Snapshots       []RepairSnapshot `json:"snapshots"`
+	Compared        *RepairSnapshot  `json:"compared,omitempty"`
+	Cells           []RepairCellDiff `json:"cells"`
+	SettingsChanged bool             `json:"settings_changed"`
+}
+
+// RepairRequest is the body of POST /api/admin/repair. Source and Backup
+// pick the rollback snapshot (default: the one the report compares with);
+// Name is the quarantine copy's name (default "<sheet>_quarantine").
+type RepairRequest struct {
+	Project string `json:"project"`
+	Sheet   string `json:"sheet_name"`
+	Action  string `json:"action"`
+	Source  string `json:"source,omitempty"`
+	Backup  string `json:"backup,omitempty"`
+	Name    string `json:"name,omitempty"`
+}
+
+// RepairResult summarises a completed repair action.
+type RepairResult struct {
+	Action       string `json:"action"`
+	Project      string `json:"project"`
+	Sheet        string `json:"sheet"`
+	SafetyBackup string `json:"safety_backup,omitempty"`
+	Quarantine   string `json:"quarantine,omitempty"`
+}
+
+// sheetArchivePath is the forward-slash path of a sheet file inside DATA and
+// inside backup archives.
+func sheetArchivePath(project, name string) string {
+	if project == "" {
+		return name + ".json"
+	}
+	return project + "/" + name + ".json"
+}
+
+func sheetAbsPath(project, name string) string {
+	p, _ := filepath.Abs(filepath.Join(dataDir, filepath.FromSlash(sheetArchivePath(project, name))))
+	return p
+}
+
+// FlaggedSheets lists the sheets that need repair, sorted by project and name.
+func FlaggedSheets() []FlaggedSheet {
+	absData, _ := filepath.Abs(dataDir)
+	seen := make(map[string]bool)
+	list := make([]FlaggedSheet, 0)
+	for absPath, fi := range globalIntegrity.CorruptFiles() {
+		rel, err := filepath.Rel(absData, absPath)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		if !strings.Contains(rel, "/") || !checksummedEntry(rel) {
+			continue
+		}
+		project, name := path.Dir(rel), strings.TrimSuffix(path.Base(rel), ".json")
+		reason := fi.Err
+		if reason == "" {
+			reason = "checksum mismatch"
+		}
+		seen[sheetKey(project, name)] = true
+		list = append(list, FlaggedSheet{
+			Project:     project,
+			Sheet:       name,
+			Reason:      reason,
+			Loaded:      globalSheetManager.GetSheetBy(name, project) != nil,
+			HeldRecords: len(globalWAL.HeldRecords(project, name)),
+		})
+	}
+	// A read-only flag saved into the file by older versions survives a
+	// passing checksum
+	for _, s := range globalSheetManager.ListSheets() {
+		s.mu.RLock()
+		project, name, readOnly := s.ProjectName, s.Name, s.ReadOnly
+		s.mu.RUnlock()
+		if !readOnly || seen[sheetKey(project, name)] {
+			continue
+		}
+		list = append(list, FlaggedSheet{
+			Project:     project,
+			Sheet:       name,
+			Reason:      "marked read-only in file",
+			Loaded:      true,
+			HeldRecords: len(globalWAL.HeldRecords(project, name)),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Project != list[j].Project {
+			return list[i].Project < list[j].Project
+		}
+		return list[i].Sheet < list[j].Sheet
+	})
+	return list
+}
+
+var errNotFlagged = errors.New("sheet is not flagged for repair")
+
+// errRepairNeedsJSON is returned with the sqlite store, whose integrity is
+// checked for the whole database rather than per sheet file.
+var errRepairNeedsJSON = errors.New("sheet repair needs the json store; with the sqlite store restore " + sqliteStoreFile + " from a backup")
+
+// findFlagged returns the FlaggedSheets entry for a sheet.
+func findFlagged(project, name string) (FlaggedSheet, error) {
+	for _, f := range FlaggedSheets() {
+		if f.Project == project && f.Sheet == name {
+			return f, nil
+		}
+	}
+	return FlaggedSheet{}, errNotFlagged
+}
+
+// decodeSheetFile decodes sheet JSON the way Load does.
+func decodeSheetFile(data []byte, project, name string) (*Sheet, error) {
+	var s Sheet
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	var persisted struct {
+		WALSeq   int64        `json:"wal_seq"`
+		AuditLog []AuditEntry `json:"audit_log"`
+	}
+	json.Unmarshal(data, &persisted)
+	s.walSeq.Store(persisted.WALSeq)
+	s.legacyAudit = persisted.AuditLog
+	s.ProjectName, s.Name = project, name
+	if s.Data == nil {
+		s.Data = make(map[string]map[string]Cell)
+	}
+	return &s, nil
+}
+
+// readCurrentSheet decodes the sheet file as it is on disk.
+func readCurrentSheet(project, name string) (*Sheet, error) {
+	data, err := os.ReadFile(sheetAbsPath(project, name))
+	if err != nil {
+		return nil, err
+	}
+	return decodeSheetFile(data, project, name)
+}
+
+// backupSnapshots lists the stored backups that contain the sheet, newest
+// first, with whether each copy passes its checksum.
+func backupSnapshots(project, name string) []RepairSnapshot {
+	entry := sheetArchivePath(project, name)
+	list := make([]RepairSnapshot, 0)
+	for _, b := range ListBackups() {
+		zr, err := zip.OpenReader(filepath.Join(backupDir, b.Name))
+		if err != nil {
+			continue
+		}
+		entries := make(map[string]*zip.File)
+		for _, f := range zr.File {
+			if f.Name == entry || f.Name == shasumPath(entry) {
+				entries[f.Name] = f
+			}
+		}
+		if entries[entry] != nil {
+			list = append(list, RepairSnapshot{
+				Source:    RepairSourceBackup,
+				Backup:    b.Name,
+				CreatedAt: b.CreatedAt,
+				Intact:    verifyEntries(entries) == nil,
+			})
+		}
+		zr.Close()
+	}
+	return list
+}
+
+// loadBackupSheet reads the sheet from a stored backup, refusing a copy
+// whose checksum does not hold.
+func loadBackupSheet(backup, project, name string) (*Sheet, error) {
+	p, err := backupPath(backup)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.OpenReader(p)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	entries, err := selectEntries(&zr.Reader, RestoreRequest{Scope: RestoreScopeSheet, Project: project, Sheet: name})
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyEntries(entries); err != nil {
+		return nil, err
+	}
+	data, err := readZipFile(entries[sheetArchivePath(project, name)])
+	if err != nil {
+		return nil, err
+	}
+	return decodeSheetFile(data, project, name)
+}
+
+// walSnapshotSheet applies the records held for the sheet to its current
+// file content.
+func walSnapshotSheet(project, name string) (*Sheet, int, error) {
+	held := globalWAL.HeldRecords(project, name)
+	if len(held) == 0 {
+		return nil, 0, errors.New("no write-ahead log records are held for this sheet")
+	}
+	s, err := readCurrentSheet(project, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range held {
+		held[i].applyTo(s)
+	}
+	return s, len(held), nil
+}
+
+// defaultSnapshot picks the snapshot to compare with: the held log records
+// when there are any, else the newest intact backup.
+func defaultSnapshot(flagged FlaggedSheet, backups []RepairSnapshot) (source, backup string) {
+	if flagged.HeldRecords > 0 {
+		return RepairSourceWAL, ""
+	}
+	for _, b := range backups {
+		if b.Intact {
+			return RepairSourceBackup, b.Backup
+		}
+	}
+	return "", ""
+}
+
+// loadSnapshot returns the sheet state of a snapshot.
+func loadSnapshot(project, name, source, backup string) (*Sheet, error) {
+	switch source {
+	case RepairSourceWAL:
+		s, _, err := walSnapshotSheet(project, name)
+		return s, err
+	case RepairSourceBackup:
+		if backup == "" {
+			return nil, errors.New("backup is required")
+		}
+		return loadBackupSheet(backup, project, name)
+	case "":
+		return nil, errors.New("no snapshot available: no held log records and no intact backup contains this sheet")
+	}
+	return nil, errors.New("source must be backup or wal")
+}
+
+// diffSheets compares cur (nil when the file does not decode) with snap.
+func diffSheets(cur, snap *Sheet) (cells []RepairCellDiff, settingsChanged bool) {
+	curData := map[string]map[string]Cell{}
+	var curMeta []byte
+	if cur != nil {
+		curData = cur.Data
+		cur.mu.RLock()
+		curMeta = sheetMetaLocked(cur)
+		cur.mu.RUnlock()
+	}
+	snap.mu.RLock()
+	snapMeta := sheetMetaLocked(snap)
+	snap.mu.RUnlock()
+
+	cells = make([]RepairCellDiff, 0)
+	add := func(row, col string) {
+		c, inCur := curData[row][col]
+		sc, inSnap := snap.Data[row][col]
+		d := RepairCellDiff{Cell: col + row}
+		switch {
+		case inCur && inSnap:
+			if reflect.DeepEqual(c, sc) {
+				return
+			}
+			d.Change, d.Current, d.Snapshot = "changed", &c, &sc
+		case inSnap:
+			d.Change, d.Snapshot = "added", &sc
+		default:
+			d.Change, d.Current = "removed", &c
+		}
+		cells = append(cells, d)
+	}
+	for row, cols := range snap.Data {
+		for col := range cols {
+			add(row, col)
+		}
+	}
+	for row, cols := range curData {
+		for col := range cols {
+			if _, ok := snap.Data[row][col]; !ok {
+				add(row, col)
+			}
+		}
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		ci, ri := parseCellLabel(cells[i].Cell)
+		cj, rj := parseCellLabel(cells[j].Cell)
+		if atoiSafe(ri) != atoiSafe(rj) {
+			return atoiSafe(ri) < atoiSafe(rj)
+		}
+		return colLabelToIndex(ci) < colLabelToIndex(cj)
+	})
+	return cells, string(curMeta) != string(snapMeta)
+}
+
+// RepairReportFor builds the report for a flagged sheet, comparing with the
+// given snapshot or, when source is empty, the default one.
+func RepairReportFor(project, name, source, backup string) (*RepairReport, error) {
+	if _, ok := globalStore.Backend().(*JSONStore); !ok {
+		return nil, errRepairNeedsJSON
+	}
+	flagged, err := findFlagged(project, name)
+	if err != nil {
+		return nil, err
+	}
+	report := &RepairReport{FlaggedSheet: flagged, Cells: make([]RepairCellDiff, 0)}
+	backups := backupSnapshots(project, name)
+	if flagged.HeldRecords > 0 {
+		held := globalWAL.HeldRecords(project, name)
+		report.Snapshots = append(report.Snapshots, RepairSnapshot{
+			Source:    RepairSourceWAL,
+			CreatedAt: held[len(held)-1].Time,
+			Intact:    true,
+			Records:   len(held),
+		})
+	}
+	report.Snapshots = append(report.Snapshots, backups...)
+
+	cur, err := readCurrentSheet(project, name)
+	if err != nil {
+		report.CurrentError = err.Error()
+	}
+	if source == "" {
+		source, backup = defaultSnapshot(flagged, backups)
+		if source == "" {
+			return report, nil
+		}
+	}
+	snap, err := loadSnapshot(project, name, source, backup)
+	if err != nil {
+		return nil, err
+	}
+	for i := range report.Snapshots {
+		if report.Snapshots[i].Source == source && report.Snapshots[i].Backup == backup {
+			report.Compared = &report.Snapshots[i]
+		}
+	}
+	report.Cells, report.SettingsChanged = diffSheets(cur, snap)
+	return report, nil
+}
+
+// RepairSheet applies a repair action to a flagged sheet as user.
+func RepairSheet(req RepairRequest, user string) (RepairResult, error) {
+	result := RepairResult{Action: req.Action, Project: req.Project, Sheet: req.Sheet}
+	if _, ok := globalStore.Backend().(*JSONStore); !ok {
+		return result, errRepairNeedsJSON
+	}
+	flagged, err := findFlagged(req.Project, req.Sheet)
+	if err != nil {
+		return result, err
+	}
+	sheet := globalSheetManager.GetSheetBy(req.Sheet, req.Project)
+	if sheet == nil && req.Action != RepairActionRollback {
+		return result, errors.New("the sheet file cannot be decoded; roll back to a snapshot instead")
+	}
+
+	var details string
+	switch req.Action {
+	case RepairActionAccept:
+		restoreMu.Lock()
+		defer restoreMu.Unlock()
+		safety, err := CreateLocalBackup("pre-repair")
+		if err != nil {
+			return result, fmt.Errorf("safety backup failed: %v", err)
+		}
+		result.SafetyBackup = safety.Name
+		if err := writeRepairedSheet(sheet, nil); err != nil {
+			return result, err
+		}
+		details = fmt.Sprintf("Accepted current content of sheet '%s' and re-signed its checksum (safety backup %s)", req.Sheet, safety.Name)
+
+	case RepairActionRollback:
+		source, backup := req.Source, req.Backup
+		if source == "" {
+			source, backup = defaultSnapshot(flagged, backupSnapshots(req.Project, req.Sheet))
+		}
+		snap, err := loadSnapshot(req.Project, req.Sheet, source, backup)
+		if err != nil {
+			return result, err
+		}
+		restoreMu.Lock()
+		defer restoreMu.Unlock()
+		safety, err := CreateLocalBackup("pre-repair")
+		if err != nil {
+			return result, fmt.Errorf("safety backup failed: %v", err)
+		}
+		result.SafetyBackup = safety.Name
+		if sheet == nil {
+			// Not loaded: the snapshot becomes the sheet
+			globalSheetManager.mu.Lock()
+			globalSheetManager.sheets[sheetKey(req.Project, req.Sheet)] = snap
+			globalSheetManager.mu.Unlock()
+			sheet = snap
+		}
+		if err := writeRepairedSheet(sheet, snap); err != nil {
+			return result, err
+		}
+		globalSheetManager.rebuildScriptDependencies()
+		globalSheetManager.rebuildOptionsRangeDependencies()
+		if source == RepairSourceWAL {
+			details = fmt.Sprintf("Rolled back sheet '%s' to its write-ahead log state (%d records, safety backup %s)", req.Sheet, flagged.HeldRecords, safety.Name)
+		} else {
+			details = fmt.Sprintf("Rolled back sheet '%s' to backup %s (safety backup %s)", req.Sheet, backup, safety.Name)
+		}
+
+	case RepairActionQuarantine:
+		name := req.Name
+		if name == "" {
+			name = req.Sheet + "_quarantine"
+			for i := 2; globalSheetManager.GetSheetBy(name, req.Project) != nil; i++ {
+				name = fmt.Sprintf("%s_quarantine_%d", req.Sheet, i)
+			}
+		} else if strings.Contains(name, "/") || strings.Contains(name, "..") {
+			return result, errors.New("invalid quarantine name")
+		} else if globalSheetManager.GetSheetBy(name, req.Project) != nil {
+			return result, fmt.Errorf("sheet %s already exists", name)
+		}
+		sheet.mu.RLock()
+		owner, sheetType := sheet.Owner, sheet.SheetType
+		sheet.mu.RUnlock()
+		copySheet := globalSheetManager.CopySheetToProject(req.Sheet, req.Project, req.Project, name, owner)
+		if copySheet == nil {
+			return result, errors.New("could not create the quarantine copy")
+		}
+		copySheet.mu.Lock()
+		copySheet.SheetType = sheetType
+		copySheet.mu.Unlock()
+		globalSheetManager.SaveSheet(copySheet)
+		result.Quarantine = name
+		details = fmt.Sprintf("Opened read-only sheet '%s' as quarantined copy '%s'", req.Sheet, name)
+
+	default:
+		return result, errors.New("action must be accept, rollback or quarantine")
+	}
+
+	globalSheetManager.QueueRowColUpdate(req.Project, req.Sheet)
+	globalProjectAuditManager.Append(strings.SplitN(req.Project, "/", 2)[0], user, "REPAIR_"+strings.ToUpper(req.Action), details)
+	log.Printf("repair: %s by %s: %s", req.Action, user, details)
+	return result, nil
+}
+
+// writeRepairedSheet replaces the content of sheet with snap (when not nil),
+// clears its read-only flag and writes it with a fresh checksum. The write
+// is synchronous so the log records it supersedes can never be replayed
+// over it.
+func writeRepairedSheet(sheet, snap *Sheet) error {
+	sheet.mu.Lock()
+	if snap != nil && snap != sheet {
+		snap.mu.RLock()
+		sheet.Owner = snap.Owner
+		sheet.SheetType = snap.SheetType
+		sheet.Data = snap.Data
+		if sheet.legacyAudit == nil {
+			sheet.legacyAudit = snap.legacyAudit
+		}
+		sheet.Permissions = snap.Permissions
+		sheet.ColWidths = snap.ColWidths
+		sheet.RowHeights = snap.RowHeights
+		sheet.RowParents = snap.RowParents
+		sheet.SectionScheme = snap.SectionScheme
+		sheet.Protected = snap.Protected
+		sheet.Comments = snap.Comments
+		snap.mu.RUnlock()
+		globalRevisions.Reset(sheet.ProjectName, sheet.Name)
+	}
+	sheet.ReadOnly = false
+	sheet.mu.Unlock()
+	// The audit log is kept apart from the sheet file and is not rolled
+	// back; entries a pre-split file still carries are moved into it
+	importLegacyAudit(sheet)
+
+	globalWAL.Rebase(sheet)
+	globalSheetManager.mu.RLock()
+	ok := globalSheetManager.saveSheetLocked(sheet)
+	globalSheetManager.mu.RUnlock()
+	if !ok {
+		sheet.mu.Lock()
+		sheet.ReadOnly = true
+		sheet.mu.Unlock()
+		return errors.New("writing the repaired sheet failed")
+	}
+	return nil
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sheet revisions. Every broadcast of a sheet carries its revision, and
+// clients send the revision their edit was based on. When other edits
+// inserted, deleted or moved rows or columns in between, the hub moves the
+// stale edit's rows and columns past them; when that is not possible (a row
+// it targets was deleted, or the revision is too old) the edit is refused
+// and the sender gets the sheet again. Revisions are kept in memory only;
+// after a restart they start above any from before.
+//
+// A new revision is sent as a SheetPatch against the one before, rather
+// than the whole sheet. The log keeps the sheet as last published and the
+// latest patches, so a client that reconnects can catch up from the
+// revision it had.
+
+// revisionEpoch is where the revisions of every sheet start: the server's
+// start time in microseconds, so revisions from before a restart are never
+// taken for current ones.
+var revisionEpoch = time.Now().UnixMicro()
+
+// maxRevisionShifts is how many row and column shifts are kept per sheet to
+// transform stale edits against.
+const maxRevisionShifts = 1000
+
+// maxRevisionPatches is how many patches are kept per sheet for clients
+// that reconnect.
+const maxRevisionPatches = 200
+
+// revisionRowKeys and revisionColKeys are the payload fields of hub messages
+// that hold a row number or a column label.
+var (
+	revisionRowKeys = []string{"row", "fromRow", "targetRow", "parentRow"}
+	revisionColKeys = []string{"col", "fromCol", "targetCol"}
+)
+
+// revisionShift is a row or column shift and the revision that first
+// includes it.
+type revisionShift struct {
+	rev   int64
+	shift AuditShift
+}
+
+type sheetRevisions struct {
+	project, name string
+	rev           int64
+	// floor is the oldest revision stale edits can be transformed from.
+	floor  int64
+	shifts []revisionShift
+	// view is the sheet as of rev, as clients have it; nil until first
+	// published and after a reset.
+	view    *Sheet
+	patches []*SheetPatch // the patches up to rev, oldest first
+}
+
+// SheetPatch turns a sheet at revision Base into the sheet at Revision:
+// apply Shifts in order, like the row and column edits they come from, then
+// set Cells (null removes a cell), the column widths, row heights and row
+// parents listed (0 removes one) and the other fields that are set.
+type SheetPatch struct {
+	Base          int64                       `json:"base"`
+	Revision      int64                       `json:"revision"`
+	Shifts        []AuditShift                `json:"shifts,omitempty"`
+	Cells         map[string]map[string]*Cell `json:"cells,omitempty"`
+	ColWidths     map[string]int              `json:"col_widths,omitempty"`
+	RowHeights    map[string]int              `json:"row_heights,omitempty"`
+	RowParents    map[string]int              `json:"row_parents,omitempty"`
+	SectionScheme *string                     `json:"section_scheme,omitempty"`
+	Owner         *string                     `json:"owner,omitempty"`
+	Permissions   *Permissions                `json:"permissions,omitempty"`
+	Protected     *[]ProtectedRange           `json:"protected_ranges,omitempty"`
+}
+
+// cellRef is a cell by row and column label.
+type cellRef struct{ row, col string }
+
+// RevisionLog numbers the states of the sheets clients see.
+type RevisionLog struct {
+	mu     sync.Mutex
+	sheets map[string]*sheetRevisions
+}
+
+var globalRevisions = &RevisionLog{sheets: make(map[string]*sheetRevisions)}
+
+func (rl *RevisionLog) sheetLocked(project, name string) *sheetRevisions {
+	key := sheetKey(project, name)
+	sr := rl.sheets[key]
+	if sr == nil {
+		sr = &sheetRevisions{project: project, name: name, rev: revisionEpoch, floor: revisionEpoch}
+		rl.sheets[key] = sr
+	}
+	return sr
+}
+
+// Current returns the revision of the sheet as last broadcast.
+func (rl *RevisionLog) Current(project, name string) int64 {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.sheetLocked(project, name).rev
+}
+
+// Publish brings the published view of s up to date and returns the patch
+// from the previous revision with the sheet as now published. The patch is
+// nil when there is no previous view to patch, so clients need all of the
+// sheet; it is empty, at the current revision, when nothing changed. The
+// touched cells are sent even when unchanged, to undo what a client
+// showed before the server refused or ignored its edit.
+func (rl *RevisionLog) Publish(s *Sheet, touched ...cellRef) (*SheetPatch, *Sheet) {
+	snap := s.SnapshotForClient()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	sr := rl.sheetLocked(snap.ProjectName, snap.Name)
+	var shifts []AuditShift
+	for _, rs := range sr.shifts {
+		if rs.rev > sr.rev {
+			shifts = append(shifts, rs.shift)
+		}
+	}
+	if sr.view == nil {
+		sr.rev++
+		sr.view, sr.patches = snap, nil
+		return nil, snap
+	}
+	patch := diffSheetView(sr.view, snap, shifts, touched)
+	if patch == nil {
+		return &SheetPatch{Base: sr.rev, Revision: sr.rev}, sr.view
+	}
+	patch.Base = sr.rev
+	sr.rev++
+	patch.Revision = sr.rev
+	sr.view = snap
+	sr.patches = append(sr.patches, patch)
+	if len(sr.patches) > maxRevisionPatches {
+		sr.patches = append([]*SheetPatch(nil), sr.patches[len(sr.patches)-maxRevisionPatches:]...)
+	}
+	return patch, snap
+}
+
+// Since returns the patches that bring a client from revision base to the
+// current one. Reports false when they are not all kept, so the client
+// needs the whole sheet.
+func (rl *RevisionLog) Since(project, name string, base int64) ([]*SheetPatch, bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	sr := rl.sheetLocked(project, name)
+	if sr.view == nil || base > sr.rev {
+		return nil, false
+	}
+	if base == sr.rev {
+		return nil, true
+	}
+	for i, p := range sr.patches {
+		if p.Base == base {
+			return append([]*SheetPatch(nil), sr.patches[i:]...), true
+		}
+	}
+	return nil, false
+}
+
+// diffSheetView returns what changed from view, once shifted, to snap, or
+// nil when nothing did.
+func diffSheetView(view, snap *Sheet, shifts []AuditShift, touched []cellRef) *SheetPatch {
+	st := &historyState{Data: make(map[string]map[string]Cell, len(view.Data)),
+		ColWidths: view.ColWidths, RowHeights: view.RowHeights, RowParents: view.RowParents}
+	for row, cols := range view.Data {
+		st.Data[row] = cols
+	}
+	// applyShift builds new maps, leaving the published view as it is
+	for i := range shifts {
+		st.applyShift(&shifts[i])
+	}
+	p := &SheetPatch{Shifts: shifts}
+	setCell := func(row, col string, c *Cell) {
+		if p.Cells == nil {
+			p.Cells = make(map[string]map[string]*Cell)
+		}
+		if p.Cells[row] == nil {
+			p.Cells[row] = make(map[string]*Cell)
+		}
+		p.Cells[row][col] = c
+	}
+	for row, cols := range snap.Data {
+		for col, c := range cols {
+			if old, ok := st.Data[row][col]; !ok || !reflect.DeepEqual(old, c) {
+				c := c
+				setCell(row, col, &c)
+			}
+		}
+	}
+	for row, cols := range st.Data {
+		for col := range cols {
+			if _, ok := snap.Data[row][col]; !ok {
+				setCell(row, col, nil)
+			}
+		}
+	}
+	for _, t := range touched {
+		if _, ok := p.Cells[t.row][t.col]; ok {
+			continue
+		}
+		if c, ok := snap.Data[t.row][t.col]; ok {
+			setCell(t.row, t.col, &c)
+		} else {
+			setCell(t.row, t.col, nil)
+		}
+	}
+	diffInts := func(old, cur map[string]int) map[string]int {
+		var out map[string]int
+		for k, v := range cur {
+			if old[k] != v {
+				if out == nil {
+					out = make(map[string]int)
+				}
+				out[k] = v
+			}
+		}
+		for k := range old {
+			if _, ok := cur[k]; !ok {
+				if out == nil {
+					out = make(map[string]int)
+				}
+				out[k] = 0
+			}
+		}
+		return out
+	}
+	p.ColWidths = diffInts(st.ColWidths, snap.ColWidths)
+	p.RowHeights = diffInts(st.RowHeights, snap.RowHeights)
+	p.RowParents = diffInts(st.RowParents, snap.RowParents)
+	if view.SectionScheme != snap.SectionScheme {
+		p.SectionScheme = &snap.SectionScheme
+	}
+	if view.Owner != snap.Owner {
+		p.Owner = &snap.Owner
+	}
+	if !reflect.DeepEqual(view.Permissions, snap.Permissions) {
+		p.Permissions = &snap.Permissions
+	}
+	if !reflect.DeepEqual(view.Protected, snap.Protected) {
+		p.Protected = &snap.Protected
+	}
+	if len(p.Shifts) == 0 && p.Cells == nil && p.ColWidths == nil && p.RowHeights == nil && p.RowParents == nil &&
+		p.SectionScheme == nil && p.Owner == nil && p.Permissions == nil && p.Protected == nil {
+		return nil
+	}
+	return p
+}
+
+// sheetFields is Sheet without its methods, to embed in SheetPage.
+type sheetFields Sheet
+
+// SheetPage is a snapshot of a sheet holding only rows FromRow to ToRow;
+// RowCount is the last row with content. Clients load the other rows with
+// LOAD_ROWS.
+type SheetPage struct {
+	*sheetFields
+	FromRow  int `json:"from_row"`
+	ToRow    int `json:"to_row"`
+	RowCount int `json:"row_count"`
+}
+
+// SheetRows answers LOAD_ROWS with rows FromRow to ToRow of a sheet.
+type SheetRows struct {
+	FromRow  int                        `json:"from_row"`
+	ToRow    int                        `json:"to_row"`
+	RowCount int                        `json:"row_count"`
+	Data     map[string]map[string]Cell `json:"data"`
+}
+
+// sheetRowCount returns the last row of snap with content.
+func sheetRowCount(snap *Sheet) int {
+	n := 0
+	for row := range snap.Data {
+		if r := atoiSafe(row); r > n {
+			n = r
+		}
+	}
+	return n
+}
+
+// sheetRowsOf returns rows from to to of snap; to 0 means to the last row.
+func sheetRowsOf(snap *Sheet, from, to int) *SheetRows {
+	count := sheetRowCount(snap)
+	if from < 1 {
+		from = 1
+	}
+	if to <= 0 || to > count {
+		to = count
+	}
+	out := &SheetRows{FromRow: from, ToRow: to, RowCount: count, Data: make(map[string]map[string]Cell)}
+	for row, cols := range snap.Data {
+		if r := atoiSafe(row); r >= from && r <= to {
+			out.Data[row] = cols
+		}
+	}
+	return out
+}
+
+// pageOf returns snap for clients, paged to its first rows when it has more
+// than pageRows of them.
+func pageOf(snap *Sheet, pageRows int) interface{} {
+	if pageRows <= 0 || sheetRowCount(snap) <= pageRows {
+		return snap
+	}
+	return sheetPageOf(snap, 1, pageRows)
+}
+
+// sheetPageOf returns snap with rows from to to only; to 0 means to the
+// last row.
+func sheetPageOf(snap *Sheet, from, to int) *SheetPage {
+	rows := sheetRowsOf(snap, from, to)
+	page := &Sheet{
+		Name:          snap.Name,
+		Owner:         snap.Owner,
+		ProjectName:   snap.ProjectName,
+		Data:          rows.Data,
+		Permissions:   snap.Permissions,
+		ColWidths:     snap.ColWidths,
+		RowHeights:    snap.RowHeights,
+		RowParents:    snap.RowParents,
+		SectionScheme: snap.SectionScheme,
+		Protected:     snap.Protected,
+	}
+	return &SheetPage{sheetFields: (*sheetFields)(page), FromRow: rows.FromRow, ToRow: rows.ToRow, RowCount: rows.RowCount}
+}
+
+// observeShift notes a row or column shift of a sheet as part of its next
+// revision. Called with the sheet's lock held, from logAuditShift.
+func (rl *RevisionLog) observeShift(project, name string, sh *AuditShift) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	sr := rl.sheetLocked(project, name)
+	sr.shifts = append(sr.shifts, revisionShift{rev: sr.rev + 1, shift: *sh})
+	if len(sr.shifts) > maxRevisionShifts {
+		drop := len(sr.shifts) - maxRevisionShifts
+		sr.floor = sr.shifts[drop-1].rev
+		sr.shifts = append([]revisionShift(nil), sr.shifts[drop:]...)
+	}
+}
+
+// Reset makes the next revision one that stale edits cannot be transformed
+// into and that clients get whole, for changes that replace the sheet's rows
+// and columns as a whole.
+func (rl *RevisionLog) Reset(project, name string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	sr := rl.sheetLocked(project, name)
+	sr.floor = sr.rev + 1
+	sr.shifts = nil
+	sr.view, sr.patches = nil, nil
+}
+
+// shiftsSince returns the shifts of the sheet made after revision base,
+// oldest first. Reports false when base is too old or not known.
+func (rl *RevisionLog) shiftsSince(project, name string, base int64) ([]AuditShift, bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	sr := rl.sheetLocked(project, name)
+	if base < sr.floor || base > sr.rev {
+		return nil, false
+	}
+	var out []AuditShift
+	for _, rs := range sr.shifts {
+		if rs.rev > base {
+			out = append(out, rs.shift)
+		}
+	}
+	return out, true
+}
+
+// RenameSheet moves the revisions of a renamed sheet.
+func (rl *RevisionLog) RenameSheet(project, oldName, newName string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if sr := rl.sheets[sheetKey(project, oldName)]; sr != nil {
+		delete(rl.sheets, sheetKey(project, oldName))
+		sr.name = newName
+		rl.sheets[sheetKey(project, newName)] = sr
+	}
+}
+
+// RenameProject moves the revisions of the sheets of a renamed project or folder.
+func (rl *RevisionLog) RenameProject(oldPath, newPath string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for key, sr := range rl.sheets {
+		if sr.project == oldPath || strings.HasPrefix(sr.project, oldPath+"/") {
+			delete(rl.sheets, key)
+			sr.project = newPath + sr.project[len(oldPath):]
+			rl.sheets[sheetKey(sr.project, sr.name)] = sr
+		}
+	}
+}
+
+// Drop forgets the revisions of a deleted sheet.
+func (rl *RevisionLog) Drop(project, name string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	delete(rl.sheets, sheetKey(project, name))
+}
+
+// DropProject forgets the revisions of the sheets of a deleted project.
+func (rl *RevisionLog) DropProject(project string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for key, sr := range rl.sheets {
+		if sr.project == project || strings.HasPrefix(sr.project, project+"/") {
+			delete(rl.sheets, key)
+		}
+	}
+}
+
+// rebaseMessage moves the rows and columns message refers to past the
+// shifts made since its base revision, rewriting its payload. Messages
+// without a base revision are taken as they are. Reports false when the
+// message cannot be applied: its base is too old or not known, or a row or
+// column it refers to was deleted since.
+func rebaseMessage(message *Message) bool {
+	if message.BaseRevision == 0 {
+		return true
+	}
+	shifts, ok := globalRevisions.shiftsSince(message.Project, message.SheetName, message.BaseRevision)
+	if !ok {
+		return false
+	}
+	if len(shifts) == 0 || len(message.Payload) == 0 {
+		return true
+	}
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(message.Payload, &payload); err != nil {
+		// Not an object; there is nothing to move
+		return true
+	}
+	changed := false
+	follow := func(key, axis string) bool {
+		raw, ok := payload[key]
+		if !ok {
+			return true
+		}
+		// Rows are sent as strings or numbers, columns as labels
+		var text string
+		quoted := json.Unmarshal(raw, &text) == nil
+		if !quoted {
+			text = string(raw)
+		}
+		var v int
+		if axis == "col" {
+			v = colLabelToIndex(strings.TrimSpace(text))
+		} else {
+			v, _ = strconv.Atoi(strings.TrimSpace(text))
+		}
+		if v <= 0 {
+			return true
+		}
+		moved := v
+		for i := range shifts {
+			if shifts[i].Axis != axis {
+				continue
+			}
+			var ok bool
+			if moved, ok = shiftIndex(&shifts[i], moved); !ok {
+				return false
+			}
+		}
+		if moved == v {
+			return true
+		}
+		if axis == "col" {
+			text = indexToColLabel(moved)
+		} else {
+			text = itoa(moved)
+		}
+		if quoted {
+			payload[key], _ = json.Marshal(text)
+		} else {
+			payload[key] = json.RawMessage(text)
+		}
+		changed = true
+		return true
+	}
+	for _, key := range revisionRowKeys {
+		if !follow(key, "row") {
+			return false
+		}
+	}
+	for _, key := range revisionColKeys {
+		if !follow(key, "col") {
+			return false
+		}
+	}
+	if changed {
+		message.Payload, _ = json.Marshal(payload)
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// scriptRlimitsSupported reports whether runScriptExec can enforce CPU and
+// memory limits on this platform.
+const scriptRlimitsSupported = true
+
+// runScriptExec implements "shared-spreadsheet script-exec -cpu N
+// -memory-mb M -- command...". It sets RLIMIT_CPU and RLIMIT_AS on itself and
+// then replaces itself with command, so the limits are in place before any
+// script code runs and the script cannot raise them again. The soft CPU limit
+// sends SIGXCPU, which the worker reports; one second later the hard limit
+// kills it.
+func runScriptExec(args []string) error {
+	fs := flag.NewFlagSet("script-exec", flag.ContinueOnError)
+	cpu := fs.Int("cpu", 0, "CPU time limit in seconds (0 = unlimited)")
+	memoryMB := fs.Int("memory-mb", 0, "address-space limit in MB (0 = unlimited)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	argv := fs.Args()
+	if len(argv) == 0 {
+		return errors.New("no command given")
+	}
+	// Resolve everything before lowering RLIMIT_AS so the Go runtime does
+	// not have to grow its heap afterwards.
+	path, err := exec.LookPath(argv[0])
+	if err != nil {
+		return err
+	}
+	env := os.Environ()
+	if *cpu > 0 {
+		if err := syscall.Setrlimit(syscall.RLIMIT_CPU, &syscall.Rlimit{Cur: uint64(*cpu), Max: uint64(*cpu) + 1}); err != nil {
+			return err
+		}
+	}
+	if *memoryMB > 0 {
+		limit := uint64(*memoryMB) << 20
+		if err := syscall.Setrlimit(syscall.RLIMIT_AS, &syscall.Rlimit{Cur: limit, Max: limit}); err != nil {
+			return err
+		}
+	}
+	return syscall.Exec(path, argv, env)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// scriptRlimitsSupported reports whether runScriptExec can enforce CPU and
+// memory limits on this platform.
+const scriptRlimitsSupported = false
+
+// runScriptExec is only available on Linux.
+func runScriptExec(args []string) error {
+	return errors.New("script-exec is only supported on Linux")
+}
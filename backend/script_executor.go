@@ -1,13 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
 	"regexp"
-	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -208,6 +205,7 @@ func (sm *SheetManager) UpdateScriptDependencies(scriptProjectName, scriptSheetN
 		s := globalSheetManager.GetSheetBy(scriptSheetName, scriptProjectName)
 		if s != nil {
 			lockedbyScriptAt := "script-span " + scriptCellID
+			var cleared []cellRef
 			s.mu.Lock()
 			for rKey, rowMap := range s.Data {
 				for cKey, cell := range rowMap {
@@ -217,11 +215,12 @@ func (sm *SheetManager) UpdateScriptDependencies(scriptProjectName, scriptSheetN
 						cell.Locked = false
 						cell.LockedBy = ""
 						s.Data[rKey][cKey] = cell
+						cleared = append(cleared, cellRef{rKey, cKey})
 					}
 				}
 			}
 			s.mu.Unlock()
-			globalSheetManager.SaveSheet(s)
+			globalSheetManager.SaveCells(s, cleared...)
 		}
 
 		// Now remove the dependencies under the lock
@@ -312,10 +311,6 @@ func (sm *SheetManager) GetDependentScripts(projectName, sheetName, row, col str
 	// Construct cellID from row and col (e.g., "A2")
 	cellID := col + row
 
-	// Parse the changed cell
-	cellRow := atoiSafe(row)
-	cellColIdx := colLabelToIndex(col)
-
 	// Check each script's referenced range
 	for _, si := range scripts {
 		scriptKey := si.ScriptProjectName + "/" + si.ScriptSheetName + "/" + si.ScriptCellID
@@ -323,56 +318,7 @@ func (sm *SheetManager) GetDependentScripts(projectName, sheetName, row, col str
 			continue
 		}
 		//fmt.Println("Checking script at ", si.ScriptProjectName, "/", si.ScriptSheetName, " cell ", si.ScriptCellID, " with reference ", si.ReferencedRange, " against changed cell ", projectName, "/", sheetName, " cell ", col+row)
-		refRange := si.ReferencedRange
-		matches := false
-
-		// Check if it's a range reference (contains ":")
-		if strings.Contains(refRange, ":") {
-			// Parse range (e.g., "A2:B3")
-			rangeParts := strings.Split(refRange, ":")
-			if len(rangeParts) == 2 {
-				startCell := rangeParts[0]
-				endCell := rangeParts[1]
-
-				// Parse start cell
-				var startCol string
-				var startRow int
-				for i, ch := range startCell {
-					if ch >= '0' && ch <= '9' {
-						startCol = startCell[:i]
-						startRow = atoiSafe(startCell[i:])
-						break
-					}
-				}
-
-				// Parse end cell
-				var endCol string
-				var endRow int
-				for i, ch := range endCell {
-					if ch >= '0' && ch <= '9' {
-						endCol = endCell[:i]
-						endRow = atoiSafe(endCell[i:])
-						break
-					}
-				}
-
-				startColIdx := colLabelToIndex(startCol)
-				endColIdx := colLabelToIndex(endCol)
-
-				// Check if cell is within range
-				if cellRow >= startRow && cellRow <= endRow &&
-					cellColIdx >= startColIdx && cellColIdx <= endColIdx {
-					matches = true
-				}
-			}
-		} else {
-			// Single cell reference - exact match
-			if refRange == cellID {
-				matches = true
-			}
-		}
-
-		if matches {
+		if rangeContainsCell(si.ReferencedRange, row, col) {
 			// Check if this script is in the same cell
 			if si.ScriptProjectName == projectName && si.ScriptSheetName == sheetName && si.ScriptCellID == cellID {
 				// Store the same-cell script to add it first
@@ -1004,25 +950,7 @@ func ExecuteCellScript(projectName, sheetName, row, col string) {
 		cSpan = 1
 	}
 
-	// if globalSheetManager.scriptExecuted contains current script then return else add current script to globalSheetManager.scriptExecuted
-	// Build the string identifier for the current script cell: "project/sheet/cellID"
-	ident := projectName + "/" + sheetName + "/" + cellID
-	//fmt.Println("script for cell", cellID, "with content:", script)
-	// Check if already executed to prevent cycles
-	// Release sheet read lock before acquiring global scripts-executed lock to avoid nested locks
 	s.mu.RUnlock()
-	globalSheetManager.ScriptsExecutedMu.Lock()
-	indx := slices.Index(globalSheetManager.ScriptsExecuted, ident)
-
-	if indx > -1 {
-		//fmt.Println("Script already executed:", ident)
-		globalSheetManager.ScriptsExecutedMu.Unlock()
-		return
-	}
-	// Mark as executed for the duration of this call
-	globalSheetManager.ScriptsExecuted = append(globalSheetManager.ScriptsExecuted, ident)
-	globalSheetManager.ScriptsExecutedMu.Unlock()
-	//fmt.Println("executing cell script:", ident)
 
 	if strings.TrimSpace(script) == "" {
 		s.mu.Lock()
@@ -1032,8 +960,8 @@ func ExecuteCellScript(projectName, sheetName, row, col string) {
 		cur.ScriptOutput_ColSpan = 1
 		s.Data[row][col] = cur
 		s.mu.Unlock()
-		globalSheetManager.SaveSheet(s)
-		WriteScriptOutputToCells(projectName, sheetName, row, col, true, false)
+		globalSheetManager.SaveCells(s, cellRef{row, col})
+		WriteScriptOutputToCells(projectName, sheetName, row, col, false, false)
 		return
 	}
 	// Execute the script and update the cell value.
@@ -1049,52 +977,45 @@ func ExecuteCellScript(projectName, sheetName, row, col string) {
 		cur.Value_FromNonSelfScript = script
 		s.Data[row][col] = cur
 		s.mu.Unlock()
-		globalSheetManager.SaveSheet(s)
-		WriteScriptOutputToCells(projectName, sheetName, row, col, true, false)
-		return
-	}
-	cmd, err := pythonCmd("-c", script)
-	//fmt.Println("Executing script ", script)
-	if err != nil {
-		s.mu.Lock()
-		cur := s.Data[row][col]
-		cur.ScriptOutput = "Error: " + err.Error()
-		cur.ScriptOutput_RowSpan = 1
-		cur.ScriptOutput_ColSpan = 1
-		s.Data[row][col] = cur
-		s.mu.Unlock()
-		globalSheetManager.SaveSheet(s)
-		WriteScriptOutputToCells(projectName, sheetName, row, col, true, true)
+		globalSheetManager.SaveCells(s, cellRef{row, col})
+		WriteScriptOutputToCells(projectName, sheetName, row, col, false, false)
 		return
 	}
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	runErr := cmd.Run()
+	stdoutText, stderrText, runErr := runPythonScript(script, EffectiveScriptLimits(projectName))
 	var newVal string
-	if runErr != nil {
-		errOut := strings.TrimRight(stderr.String(), "\r\n")
+	var limitErr *ScriptLimitError
+	if errors.As(runErr, &limitErr) {
+		// Timeouts and kills get their own prefix instead of "Error: "
+		newVal = limitErr.Error()
+	} else if runErr != nil {
+		errOut := strings.TrimRight(stderrText, "\r\n")
 		if errOut == "" {
 			errOut = runErr.Error()
 		}
 		newVal = "Error: " + errOut
 	} else {
-		newVal = strings.TrimRight(stdout.String(), "\r\n")
+		newVal = strings.TrimRight(stdoutText, "\r\n")
 	}
 	// Write ScriptOutput back and save
 	s.mu.Lock()
 	cur = s.Data[row][col] // Re-read to get latest state
+	// Tell the owner when a script starts failing or fails differently
+	failedAnew := runErr != nil && cur.ScriptOutput != newVal
 	cur.ScriptOutput = newVal
 	//fmt.Println("Script output for cell", cellID, ":", newVal)
 	s.Data[row][col] = cur
 	s.mu.Unlock()
-	globalSheetManager.SaveSheet(s)
+	globalSheetManager.SaveCells(s, cellRef{row, col})
+	if failedAnew {
+		globalNotifications.ScriptFailed(projectName, sheetName, row, col, newVal)
+	}
 
 	// Check if script references its own cell
 	isSelfReferencing := CheckIfScriptReferencesSelf(script, projectName, sheetName, cellID)
 
-	// Call second function to write output to cell values
-	WriteScriptOutputToCells(projectName, sheetName, row, col, true, isSelfReferencing)
+	// Call second function to write output to cell values. Dependents are
+	// scheduled by Recalculate, so nothing is queued from here.
+	WriteScriptOutputToCells(projectName, sheetName, row, col, false, isSelfReferencing)
 }
 
 // lastTimelineEventTime returns the timestamp of the last event in the project's timeline.json,
@@ -1103,8 +1024,7 @@ func lastTimelineEventTime(projectName string) time.Time {
 	type timelineEntry struct {
 		Timestamp time.Time `json:"timestamp"`
 	}
-	path := filepath.Join(dataDir, projectName, "timeline.json")
-	data, err := os.ReadFile(path)
+	data, err := globalStore.ReadDocument(timelineDocument(projectName))
 	if err != nil {
 		return time.Time{}
 	}
@@ -1121,44 +1041,60 @@ func lastTimelineEventTime(projectName string) time.Time {
 	return last
 }
 
+var errTimelineEventNotFound = errors.New("timeline event not found")
+
+// timelineEventTime returns the timestamp of a timeline event of a top-level
+// project. A missing timeline is reported as os.ErrNotExist.
+func timelineEventTime(project, id string) (time.Time, error) {
+	data, err := globalStore.ReadDocument(timelineDocument(project))
+	if err != nil {
+		return time.Time{}, err
+	}
+	var entries []struct {
+		ID        string    `json:"id"`
+		Timestamp time.Time `json:"timestamp"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return time.Time{}, fmt.Errorf("parse timeline: %w", err)
+	}
+	for _, e := range entries {
+		if e.ID == id {
+			return e.Timestamp, nil
+		}
+	}
+	return time.Time{}, errTimelineEventNotFound
+}
+
 // addMergedAuditEntries adds audit entries for cell changes, merging with existing entries if the previous log is after the last timeline event
 func addMergedAuditEntries(s *Sheet, cellChanges map[string]cellChangesstruct) {
 	now := time.Now()
 	lastTimelineEvent := lastTimelineEventTime(s.ProjectName)
 	for _, change := range cellChanges {
-		// Find the latest matching edit for this cell by user "system"
-		prevIdx := -1
-		for i := len(s.AuditLog) - 1; i >= 0; i-- {
-			entry := s.AuditLog[i]
-			if entry.Action == change.action && entry.Row1 == change.rowNum && entry.Col1 == change.colStr {
-				if entry.User == change.user && !entry.ChangeReversed {
-					prevIdx = i
-				}
-				break
-			}
-		}
-
+		// The latest entry for this cell is merged into when it is an
+		// unreverted change by the same user
 		oldValForNew := change.oldVal
-		if prevIdx >= 0 {
-			prevTimestamp := s.AuditLog[prevIdx].Timestamp
+		var replaces int64
+		if prev, ok := globalAuditLog.Latest(s.ProjectName, s.Name, change.action, change.rowNum, change.colStr); ok && prev.User == change.user && !prev.ChangeReversed {
 			// Merge if previous log is after the last timeline event.
 			// Also merge when there is no timeline entry (zero time).
-			prevIsAfterLastTimelineEvent := lastTimelineEvent.IsZero() || prevTimestamp.After(lastTimelineEvent)
-			if prevIsAfterLastTimelineEvent {
-				oldValForNew = s.AuditLog[prevIdx].OldValue
-				s.AuditLog = append(s.AuditLog[:prevIdx], s.AuditLog[prevIdx+1:]...)
+			if lastTimelineEvent.IsZero() || prev.Timestamp.After(lastTimelineEvent) {
+				oldValForNew = prev.OldValue
+				replaces = prev.Seq
 			}
 		}
 
-		s.AuditLog = append(s.AuditLog, AuditEntry{
-			Timestamp:      now,
-			User:           change.user,
-			Action:         change.action,
-			Row1:           change.rowNum,
-			Col1:           change.colStr,
-			OldValue:       oldValForNew,
-			NewValue:       change.newVal,
-			ChangeReversed: false,
+		globalAuditLog.Append(s.ProjectName, s.Name, AuditRecord{
+			AuditEntry: AuditEntry{
+				Timestamp:      now,
+				User:           change.user,
+				Action:         change.action,
+				Row1:           change.rowNum,
+				Col1:           change.colStr,
+				OldValue:       oldValForNew,
+				NewValue:       change.newVal,
+				ChangeReversed: false,
+			},
+			Replaces: replaces,
 		})
 	}
 }
@@ -1209,6 +1145,8 @@ func WriteScriptOutputToCells(projectName, sheetName, row, col string, triggerne
 	// Capture all previous values before clearing (map key: "row-col")
 	previousValues := make(map[string]string)
 	previousValues[row+"-"+col] = cur.Value
+	// Cells written here, logged to the write-ahead log on save
+	touched := []cellRef{{row, col}}
 
 	// Resetting value and unlock previously locked cells belonging to this script-span
 	cur.Value = ""
@@ -1224,6 +1162,7 @@ func WriteScriptOutputToCells(projectName, sheetName, row, col string, triggerne
 				cell.Locked = false
 				cell.LockedBy = ""
 				s.Data[rKey][cKey] = cell
+				touched = append(touched, cellRef{rKey, cKey})
 			}
 		}
 	}
@@ -1276,6 +1215,7 @@ func WriteScriptOutputToCells(projectName, sheetName, row, col string, triggerne
 				c.Locked = true
 				c.LockedBy = lockedbyScriptAt
 				s.Data[rKey][cLabel] = c
+				touched = append(touched, cellRef{rKey, cLabel})
 			}
 		}
 	} else {
@@ -1325,7 +1265,7 @@ func WriteScriptOutputToCells(projectName, sheetName, row, col string, triggerne
 
 		// Add merged audit entries before save
 		addMergedAuditEntries(s, cellChanges)
-		globalSheetManager.SaveSheet(s)
+		globalSheetManager.SaveCells(s, touched...)
 		//broadcastRowColUpdated(s, projectName, sheetName)
 		globalSheetManager.QueueRowColUpdate(s.ProjectName, s.Name)
 		return
@@ -1352,7 +1292,7 @@ func WriteScriptOutputToCells(projectName, sheetName, row, col string, triggerne
 			recordChange(row, col, oldVal, cur.Value)
 			s.mu.Unlock()
 			addMergedAuditEntries(s, cellChanges)
-			globalSheetManager.SaveSheet(s)
+			globalSheetManager.SaveCells(s, touched...)
 			//broadcastRowColUpdated(s, projectName, sheetName)
 			globalSheetManager.QueueRowColUpdate(s.ProjectName, s.Name)
 			return
@@ -1382,7 +1322,7 @@ func WriteScriptOutputToCells(projectName, sheetName, row, col string, triggerne
 		}
 
 		addMergedAuditEntries(s, cellChanges)
-		globalSheetManager.SaveSheet(s)
+		globalSheetManager.SaveCells(s, touched...)
 		//broadcastRowColUpdated(s, projectName, sheetName)
 		globalSheetManager.QueueRowColUpdate(s.ProjectName, s.Name)
 		return
@@ -1434,7 +1374,7 @@ func WriteScriptOutputToCells(projectName, sheetName, row, col string, triggerne
 			recordChange(row, col, oldVal, cur.Value)
 			s.mu.Unlock()
 			addMergedAuditEntries(s, cellChanges)
-			globalSheetManager.SaveSheet(s)
+			globalSheetManager.SaveCells(s, touched...)
 			//broadcastRowColUpdated(s, projectName, sheetName)
 			globalSheetManager.QueueRowColUpdate(s.ProjectName, s.Name)
 			return
@@ -1476,7 +1416,7 @@ func WriteScriptOutputToCells(projectName, sheetName, row, col string, triggerne
 		globalSheetManager.CellsModifiedByScriptQueue = append(globalSheetManager.CellsModifiedByScriptQueue, CellsModified...)
 		globalSheetManager.CellsModifiedByScriptQueueMu.Unlock()
 		addMergedAuditEntries(s, cellChanges)
-		globalSheetManager.SaveSheet(s)
+		globalSheetManager.SaveCells(s, touched...)
 		//broadcastRowColUpdated(s, projectName, sheetName)
 		globalSheetManager.QueueRowColUpdate(s.ProjectName, s.Name)
 		return
@@ -1542,71 +1482,17 @@ func WriteScriptOutputToCells(projectName, sheetName, row, col string, triggerne
 	globalSheetManager.CellsModifiedByScriptQueue = append(globalSheetManager.CellsModifiedByScriptQueue, CellsModified...)
 	globalSheetManager.CellsModifiedByScriptQueueMu.Unlock()
 	addMergedAuditEntries(s, cellChanges)
-	globalSheetManager.SaveSheet(s)
+	globalSheetManager.SaveCells(s, touched...)
 
 	//broadcastRowColUpdated(s, projectName, sheetName)
 	globalSheetManager.QueueRowColUpdate(s.ProjectName, s.Name)
 }
 
-// ExecuteDependentScripts executes all scripts that depend on the given cell
-// This should be called when a cell value is modified to trigger cascading updates
-// skipSelf prevent execution of the script in the same cell
+// ExecuteDependentScripts recalculates everything that depends on the given cell.
+// This should be called when a cell value is modified to trigger cascading updates.
+// The cascade runs in dependency order through SheetManager.Recalculate.
 func ExecuteDependentScripts(projectName, sheetName, row, col string) {
-	// Get the cell ID for the modified cell
-	s := globalSheetManager.GetSheetBy(sheetName, projectName)
-	if s == nil {
-		return
-	}
-	//fmt.Println("Checking dependents for cell ", projectName, "/", sheetName, " cell ", row+col)
-	// Get all dependent scripts
-	dependents := globalSheetManager.GetDependentScripts(projectName, sheetName, row, col)
-
-	// Execute each dependent script
-	for _, dep := range dependents {
-		//fmt.Println("Executing dependent script at ", dep.ScriptProjectName, "/", dep.ScriptSheetName, " cell ", dep.ScriptCellID, " which depends on ", projectName, "/", sheetName, " cell ", row+col)
-		ExecuteCellScriptWithIdentifier(dep)
-	}
-}
-
-func ExecuteCellScriptWithIdentifier(dep ScriptIdentifier) {
-
-	// Find the cell with this script
-	depSheet := globalSheetManager.GetSheetBy(dep.ScriptSheetName, dep.ScriptProjectName)
-	if depSheet == nil {
-		return
-	}
-
-	// Find the cell by CellID
-	depSheet.mu.RLock()
-	var depRow, depCol string
-	var cellType int
-	found := false
-	for r, rowMap := range depSheet.Data {
-		for c, cell := range rowMap {
-			if cell.CellID == dep.ScriptCellID {
-				depRow = r
-				depCol = c
-				cellType = cell.CellType
-				found = true
-				break
-			}
-		}
-		if found {
-			break
-		}
-	}
-	depSheet.mu.RUnlock()
-
-	if found {
-		if cellType == AIGeneratedCell {
-			// Execute the dependent AI cell
-			ExecuteAICell(dep.ScriptProjectName, dep.ScriptSheetName, depRow, depCol)
-		} else {
-			// Execute the dependent script
-			ExecuteCellScript(dep.ScriptProjectName, dep.ScriptSheetName, depRow, depCol)
-		}
-	}
-
+	globalSheetManager.Recalculate([]CellIdentifier{{projectName, sheetName, row, col}})
 }
 
 // Removes zombie script locks
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ScriptLimits bounds what a single script cell execution may use. Zero
+// values mean "no limit", except for the wall clock, which always applies
+// (see defaultScriptTimeoutSeconds). The server-wide defaults come from command-line
+// flags; a project admin may override any field per project (stored in
+// projects.json), and unset override fields fall back to the server value.
+type ScriptLimits struct {
+	TimeoutSeconds int   `json:"timeout_seconds,omitempty"` // wall clock
+	CPUSeconds     int   `json:"cpu_seconds,omitempty"`
+	MemoryMB       int   `json:"memory_mb,omitempty"`
+	MaxOutputKB    int   `json:"max_output_kb,omitempty"`
+	AllowNetwork   *bool `json:"allow_network,omitempty"`
+}
+
+// serverScriptLimits holds the server-wide defaults set by initScriptLimits.
+var serverScriptLimits ScriptLimits
+
+// Prefixes used in ScriptOutput so timeouts and kills can be told apart from
+// ordinary "Error: " script failures.
+const (
+	scriptTimeoutPrefix = "Timeout: "
+	scriptKilledPrefix  = "Killed: "
+)
+
+// defaultScriptTimeoutSeconds replaces a server wall-clock limit of 0, so a
+// script can never hold a worker forever.
+const defaultScriptTimeoutSeconds = 30
+
+// scriptMinMemoryMB is the smallest address-space limit a worker is started
+// with; below it the interpreter cannot start at all.
+const scriptMinMemoryMB = 64
+
+// initScriptLimits sets the server-wide script limits.
+func initScriptLimits(limits ScriptLimits) {
+	if limits.TimeoutSeconds <= 0 {
+		limits.TimeoutSeconds = defaultScriptTimeoutSeconds
+	}
+	serverScriptLimits = limits
+	network := "blocked"
+	if limits.networkAllowed() {
+		network = "allowed"
+	}
+	log.Printf("Script limits: timeout=%ds cpu=%ds memory=%dMB output=%dKB network=%s", limits.TimeoutSeconds, limits.CPUSeconds, limits.MemoryMB, limits.MaxOutputKB, network)
+}
+
+func (l ScriptLimits) networkAllowed() bool {
+	return l.AllowNetwork != nil && *l.AllowNetwork
+}
+
+// merge returns l with every field set in override replaced.
+func (l ScriptLimits) merge(override *ScriptLimits) ScriptLimits {
+	if override == nil {
+		return l
+	}
+	if override.TimeoutSeconds > 0 {
+		l.TimeoutSeconds = override.TimeoutSeconds
+	}
+	if override.CPUSeconds > 0 {
+		l.CPUSeconds = override.CPUSeconds
+	}
+	if override.MemoryMB > 0 {
+		l.MemoryMB = override.MemoryMB
+	}
+	if override.MaxOutputKB > 0 {
+		l.MaxOutputKB = override.MaxOutputKB
+	}
+	if override.AllowNetwork != nil {
+		allow := *override.AllowNetwork
+		l.AllowNetwork = &allow
+	}
+	return l
+}
+
+// EffectiveScriptLimits returns the limits for scripts in a project: the
+// server defaults with the project's override applied.
+func EffectiveScriptLimits(projectName string) ScriptLimits {
+	topProject := strings.SplitN(projectName, "/", 2)[0]
+	return serverScriptLimits.merge(globalProjectMeta.GetScriptLimits(topProject))
+}
+
+// wire converts the limits to the form understood by the Python worker.
+func (l ScriptLimits) wire() pythonWorkerLimits {
+	return pythonWorkerLimits{
+		MaxOutput: l.MaxOutputKB * 1024,
+		Network:   l.networkAllowed(),
+	}
+}
+
+// workerKey identifies the limits a worker process is started with; only a
+// worker started with the same key may run a script under l.
+func (l ScriptLimits) workerKey() string {
+	return fmt.Sprintf("cpu=%d memory=%d network=%t", l.CPUSeconds, l.rlimitMemoryMB(), l.networkAllowed())
+}
+
+// rlimitMemoryMB is the address-space limit a worker is started with.
+func (l ScriptLimits) rlimitMemoryMB() int {
+	if l.MemoryMB > 0 && l.MemoryMB < scriptMinMemoryMB {
+		return scriptMinMemoryMB
+	}
+	return l.MemoryMB
+}
+
+// ScriptLimitError reports that a script was stopped for exceeding a limit.
+// Its message is written to ScriptOutput as-is.
+type ScriptLimitError struct {
+	Kind string // "timeout", "cpu", "memory" or "output"
+	msg  string
+}
+
+func (e *ScriptLimitError) Error() string { return e.msg }
+
+// limitError builds the ScriptOutput message for a limit violation.
+func (l ScriptLimits) limitError(kind string) *ScriptLimitError {
+	var msg string
+	switch kind {
+	case "timeout":
+		msg = fmt.Sprintf("%sscript exceeded the %ds wall-clock limit", scriptTimeoutPrefix, l.TimeoutSeconds)
+	case "cpu":
+		msg = fmt.Sprintf("%sscript exceeded the %ds CPU time limit", scriptKilledPrefix, l.CPUSeconds)
+	case "memory":
+		msg = fmt.Sprintf("%sscript exceeded the %d MB memory limit", scriptKilledPrefix, l.MemoryMB)
+	case "output":
+		msg = fmt.Sprintf("%sscript output exceeded %d KB", scriptKilledPrefix, l.MaxOutputKB)
+	default:
+		msg = scriptKilledPrefix + kind
+	}
+	return &ScriptLimitError{Kind: kind, msg: msg}
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -16,6 +17,8 @@ var (
 	pythonPathSet   bool
 	pythonRunAsUser string // OS user to run scripts as; empty = current process user
 	pythonWorkDir   string // working directory for all python executions
+	pythonNetNS     bool   // run python without network access inside a new network namespace (unshare -rn)
+	scriptExecPath  string // this executable, used as the "script-exec" rlimit helper
 )
 
 // initPython sets the Python executable path and optional run-as OS user.
@@ -27,6 +30,11 @@ func initPython(path, runAsUser string) {
 	pythonPathSet = true
 	pythonRunAsUser = runAsUser
 	pythonWorkDir = filepath.Join(dataDir, "pythonDirectory")
+	if exe, err := os.Executable(); err == nil {
+		scriptExecPath = exe
+	} else if scriptRlimitsSupported {
+		log.Printf("Warning: cannot locate own executable (%v); script CPU and memory limits are not enforced", err)
+	}
 	if runAsUser != "" {
 		log.Printf("Python executable: %s (running as OS user: %s)", pythonPath, pythonRunAsUser)
 	} else {
@@ -34,25 +42,51 @@ func initPython(path, runAsUser string) {
 	}
 }
 
-// pythonCmd returns an *exec.Cmd ready to run the given Python arguments.
-// When pythonRunAsUser is configured the command is wrapped with "sudo -u <user>".
+// pythonCmd returns an *exec.Cmd ready to run the given Python arguments
+// under limits. When pythonRunAsUser is configured the command is wrapped
+// with "sudo -u <user>". When pythonNetNS is set and limits do not allow
+// network access, python is started through "unshare -rn" so it has no
+// network interfaces except loopback. CPU and memory limits are set as
+// rlimits by the "script-exec" helper (see runScriptExec) before sudo and
+// python are executed.
 // The working directory is always set to pythonWorkDir (dataDir/pythonDirectory).
-func pythonCmd(args ...string) (*exec.Cmd, error) {
+func pythonCmd(limits ScriptLimits, args ...string) (*exec.Cmd, error) {
 	if !pythonPathSet || pythonPath == "" {
 		return nil, fmt.Errorf("Python executable not configured (use -python flag)")
 	}
-	var cmd *exec.Cmd
+	argv := append([]string{pythonPath}, args...)
+	if pythonNetNS && !limits.networkAllowed() {
+		argv = append([]string{"unshare", "-rn"}, argv...)
+	}
 	if pythonRunAsUser != "" {
-		// Build: sudo -u <pythonRunAsUser> <pythonPath> <args...>
-		sudoArgs := append([]string{"-u", pythonRunAsUser, pythonPath}, args...)
-		cmd = exec.Command("sudo", sudoArgs...)
-	} else {
-		cmd = exec.Command(pythonPath, args...)
+		// Build: sudo -u <pythonRunAsUser> [unshare -rn] <pythonPath> <args...>
+		argv = append([]string{"sudo", "-u", pythonRunAsUser}, argv...)
 	}
+	if scriptRlimitsSupported && scriptExecPath != "" && (limits.CPUSeconds > 0 || limits.MemoryMB > 0) {
+		argv = append([]string{scriptExecPath, "script-exec",
+			"-cpu", strconv.Itoa(limits.CPUSeconds),
+			"-memory-mb", strconv.Itoa(limits.rlimitMemoryMB()),
+			"--"}, argv...)
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
 	cmd.Dir = pythonWorkDir
 	return cmd, nil
 }
 
+// checkPythonNetNS verifies that network namespaces can be created the way
+// pythonCmd creates them, so scripts never silently run with network access
+// they should not have.
+func checkPythonNetNS() error {
+	argv := []string{"unshare", "-rn", "true"}
+	if pythonRunAsUser != "" {
+		argv = append([]string{"sudo", "-n", "-u", pythonRunAsUser}, argv...)
+	}
+	if out, err := exec.Command(argv[0], argv[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
 func (sm *SheetManager) initAsyncSaver() {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
@@ -74,46 +108,24 @@ func (sm *SheetManager) flusher() {
 		case <-ticker.C:
 			now := time.Now()
 
+			// Drain both change queues and recalculate everything downstream
+			// of them in one pass, in dependency order.
+			sm.CellsModifiedManuallyQueueMu.Lock()
+			changed := sm.CellsModifiedManuallyQueue
+			sm.CellsModifiedManuallyQueue = nil
+			sm.CellsModifiedManuallyQueueMu.Unlock()
 			sm.CellsModifiedByScriptQueueMu.Lock()
-
-			if len(sm.CellsModifiedByScriptQueue) == 0 {
-				sm.CellsModifiedByScriptQueueMu.Unlock()
-
-				// Process script execution queue
-				sm.CellsModifiedManuallyQueueMu.Lock()
-				if len(sm.CellsModifiedManuallyQueue) > 0 {
-					//clearing ScriptsExecuted list
-					sm.ScriptsExecutedMu.Lock()
-					//fmt.Println("scripts executed(flusher)", sm.ScriptsExecuted)
-					clear(sm.ScriptsExecuted)
-					//fmt.Println("scripts executed after clear(flusher)", sm.ScriptsExecuted)
-					sm.ScriptsExecutedMu.Unlock()
-					toExec := sm.CellsModifiedManuallyQueue[0]
-					//pop from queue
-					sm.CellsModifiedManuallyQueue = sm.CellsModifiedManuallyQueue[1:]
-					sm.CellsModifiedManuallyQueueMu.Unlock()
-					//fmt.Println("Executing scripts for manually modified cell:", toExec)
-					ExecuteDependentScripts(toExec.ProjectName, toExec.sheetName, toExec.row, toExec.col)
-					// Update options for cells which have options depending on range in the sheet of modified cell
-					updateOptionsForDependentCells(toExec.ProjectName, toExec.sheetName, toExec.row, toExec.col)
-
-					continue
-				} else {
-					sm.CellsModifiedManuallyQueueMu.Unlock()
-				}
-			} else {
-				toExec := sm.CellsModifiedByScriptQueue[0]
-				//pop from queue
-				sm.CellsModifiedByScriptQueue = sm.CellsModifiedByScriptQueue[1:]
-				sm.CellsModifiedByScriptQueueMu.Unlock()
-				//fmt.Println("Executing scripts for script modified cell:", toExec)
-				ExecuteDependentScripts(toExec.ProjectName, toExec.sheetName, toExec.row, toExec.col)
-				// Update options for cells which have options depending on range in the sheet of modified cell
-				updateOptionsForDependentCells(toExec.ProjectName, toExec.sheetName, toExec.row, toExec.col)
-
+			changed = append(changed, sm.CellsModifiedByScriptQueue...)
+			sm.CellsModifiedByScriptQueue = nil
+			sm.CellsModifiedByScriptQueueMu.Unlock()
+			if len(changed) > 0 {
+				sm.Recalculate(changed)
 				continue
 			}
 
+			// Audit records not written with a save yet
+			globalAuditLog.FlushAll()
+
 			// collect due items without holding lock during disk IO
 			var toFlush []*Sheet
 			sm.mu.Lock()
@@ -126,11 +138,20 @@ func (sm *SheetManager) flusher() {
 			sm.mu.Unlock()
 			// flush outside of lock
 			if len(toFlush) > 0 {
+				var failed []*Sheet
 				sm.mu.RLock()
 				for _, s := range toFlush {
-					sm.saveSheetLocked(s)
+					if !sm.saveSheetLocked(s) {
+						failed = append(failed, s)
+					}
 				}
 				sm.mu.RUnlock()
+				// Retry failed writes later; their edits stay in the log meanwhile
+				for _, s := range failed {
+					sm.markPending(s)
+				}
+				// Every logged edit is now in a sheet file once nothing is pending
+				globalWAL.Checkpoint(sm)
 			}
 
 			// Process ROW_COL_UPDATE broadcast queue
@@ -155,14 +176,12 @@ func (sm *SheetManager) flusher() {
 				// Send ROW_COL_UPDATED messages for each unique sheet
 				if globalHub != nil {
 					for _, item := range uniqueUpdates {
-						sheet := sm.GetSheetBy(item.SheetName, item.ProjectName)
-						if sheet != nil {
-							payload, _ := json.Marshal(sheet.SnapshotForClient())
+						// The hub sends what changed since the last revision
+						if sm.GetSheetBy(item.SheetName, item.ProjectName) != nil {
 							globalHub.broadcast <- &Message{
 								Type:      "ROW_COL_UPDATED",
 								SheetName: item.SheetName,
 								Project:   item.ProjectName,
-								Payload:   payload,
 								User:      "system",
 							}
 						}
@@ -212,13 +231,6 @@ func (sm *SheetManager) flusher() {
 					log.Printf("[MUTEX DEBUG] SheetManager.CellsModifiedByScriptQueueMu is currently locked at %v", currentTime)
 				}
 
-				// Check SheetManager.ScriptsExecutedMu
-				if sm.ScriptsExecutedMu.TryLock() {
-					sm.ScriptsExecutedMu.Unlock()
-				} else {
-					log.Printf("[MUTEX DEBUG] SheetManager.ScriptsExecutedMu is currently locked at %v", currentTime)
-				}
-
 				// Check SheetManager.RowColUpdateQueueMu
 				if sm.RowColUpdateQueueMu.TryLock() {
 					sm.RowColUpdateQueueMu.Unlock()
@@ -264,10 +276,16 @@ func (sm *SheetManager) QueueRowColUpdate(projectName, sheetName string) {
 
 func (s *Sheet) SetCellScript(row, col, script, user string, reverted bool, rowSpan int, colSpan int, showAsOutput bool) {
 	s.mu.Lock()
+	done := s.setCellScriptLocked(row, col, script, user, reverted, rowSpan, colSpan, showAsOutput)
+	s.mu.Unlock()
+	done()
+}
+
+// setCellScriptLocked is SetCellScript with s.mu held.
+func (s *Sheet) setCellScriptLocked(row, col, script, user string, reverted bool, rowSpan int, colSpan int, showAsOutput bool) editDone {
 	// Only sheet owner may modify scripts
 	if user != s.Owner {
-		s.mu.Unlock()
-		return
+		return editNothing
 	}
 
 	// ensure row map
@@ -275,22 +293,13 @@ func (s *Sheet) SetCellScript(row, col, script, user string, reverted bool, rowS
 		s.Data[row] = make(map[string]Cell)
 	}
 	currentVal, exists := s.Data[row][col]
-	// Prevent edits to locked cells
-	if exists && currentVal.Locked {
-		s.mu.Unlock()
-		return
+	// Prevent edits to locked cells and protected ranges
+	if (exists && currentVal.Locked) || s.protectedCellLocked(row, col, user) != nil {
+		return editNothing
 	}
 	// Audit only script change
 	if reverted {
-		prevNew := currentVal.Script
-		r1 := atoiSafe(row)
-		for i := len(s.AuditLog) - 1; i >= 0; i-- {
-			e := &s.AuditLog[i]
-			if e.Action == "EDIT_SCRIPT" && e.Row1 == r1 && e.Col1 == col && e.NewValue == prevNew && !e.ChangeReversed {
-				e.ChangeReversed = true
-				break
-			}
-		}
+		globalAuditLog.Revert(s.ProjectName, s.Name, "EDIT_SCRIPT", atoiSafe(row), col, currentVal.Script)
 	} else {
 		var oldScript string
 		if exists {
@@ -341,15 +350,15 @@ func (s *Sheet) SetCellScript(row, col, script, user string, reverted bool, rowS
 
 	// Update script dependencies
 	cellID := updated.CellID
-	s.mu.Unlock()
-
-	// Update dependency map for this script
-	globalSheetManager.UpdateScriptDependencies(s.ProjectName, s.Name, cellID, script, row, col)
+	return func() {
+		// Update dependency map for this script
+		globalSheetManager.UpdateScriptDependencies(s.ProjectName, s.Name, cellID, script, row, col)
 
-	// Done updating script; save and execute
-	globalSheetManager.SaveSheet(s)
-	ExecuteCellScriptonChange(s.ProjectName, s.Name, row, col)
-	//s.FillValueFromScriptOutput(row, col)
+		// Done updating script; save and execute
+		globalSheetManager.SaveSheet(s)
+		ExecuteCellScriptonChange(s.ProjectName, s.Name, row, col)
+		//s.FillValueFromScriptOutput(row, col)
+	}
 }
 
 // cellDepText returns the text that should be used for dependency tracking for a cell.
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// ────────────────────────────────────────────────
+// Sessions
+// ────────────────────────────────────────────────
+//
+// Sessions are persisted next to users.json so restarts do not log anyone
+// out. Only SHA-256 hashes of the access and refresh tokens are stored.
+// Access tokens expire after sessionTimeout without use; the refresh token
+// issues a new pair and lives for refreshTimeout, or rememberTimeout when
+// "remember me" was ticked at login.
+
+const sessionsDocument = "sessions.json"
+
+const (
+	sessionTimeout  = 1 * time.Hour
+	refreshTimeout  = 12 * time.Hour
+	rememberTimeout = 30 * 24 * time.Hour
+	// Sliding expiry is only written back when it moved by at least this much,
+	// so validating a token does not rewrite sessions.json on every request.
+	sessionTouchInterval = 5 * time.Minute
+)
+
+type Session struct {
+	ID               string    `json:"id"`
+	TokenHash        string    `json:"token_hash"`
+	RefreshHash      string    `json:"refresh_hash"`
+	Username         string    `json:"username"`
+	Remember         bool      `json:"remember,omitempty"`
+	UserAgent        string    `json:"user_agent,omitempty"`
+	RemoteAddr       string    `json:"remote_addr,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+	LastSeen         time.Time `json:"last_seen"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+// SessionTokens is what a login or refresh hands back to the client.
+type SessionTokens struct {
+	Token            string    `json:"token"`
+	RefreshToken     string    `json:"refresh_token"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+// SessionInfo is a session as shown to its owner or an admin.
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	Username   string    `json:"username"`
+	Remember   bool      `json:"remember"`
+	UserAgent  string    `json:"user_agent"`
+	RemoteAddr string    `json:"remote_addr"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeen   time.Time `json:"last_seen"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+// hashToken returns the stored form of an access or refresh token.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokensLocked gives the session a fresh token pair and expiry.
+// Must be called with the lock held.
+func (um *UserManager) issueTokensLocked(session *Session) (SessionTokens, error) {
+	token, err := generateToken()
+	if err != nil {
+		return SessionTokens{}, errors.New("failed to generate session token")
+	}
+	refresh, err := generateToken()
+	if err != nil {
+		return SessionTokens{}, errors.New("failed to generate refresh token")
+	}
+	now := time.Now()
+	if session.TokenHash != "" {
+		delete(um.sessions, session.TokenHash)
+	}
+	session.TokenHash = hashToken(token)
+	session.RefreshHash = hashToken(refresh)
+	session.LastSeen = now
+	session.ExpiresAt = now.Add(sessionTimeout)
+	if session.Remember {
+		session.RefreshExpiresAt = now.Add(rememberTimeout)
+	} else {
+		session.RefreshExpiresAt = now.Add(refreshTimeout)
+	}
+	um.sessions[session.TokenHash] = session
+	return SessionTokens{
+		Token:            token,
+		RefreshToken:     refresh,
+		ExpiresAt:        session.ExpiresAt,
+		RefreshExpiresAt: session.RefreshExpiresAt,
+	}, nil
+}
+
+// startSession creates and persists a session for an authenticated user.
+func (um *UserManager) startSession(username string, remember bool, userAgent, remoteAddr string) (SessionTokens, error) {
+	id, err := generateToken()
+	if err != nil {
+		return SessionTokens{}, errors.New("failed to generate session id")
+	}
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.removeExpiredSessionsLocked()
+	session := &Session{
+		ID:         id[:16],
+		Username:   username,
+		Remember:   remember,
+		UserAgent:  userAgent,
+		RemoteAddr: remoteAddr,
+		CreatedAt:  time.Now(),
+	}
+	tokens, err := um.issueTokensLocked(session)
+	if err != nil {
+		return SessionTokens{}, err
+	}
+	um.saveSessionsLocked()
+	return tokens, nil
+}
+
+// Refresh exchanges a refresh token for a new token pair. The old pair stops
+// working, so a leaked refresh token can be used at most once.
+func (um *UserManager) Refresh(refreshToken string) (string, SessionTokens, error) {
+	if refreshToken == "" {
+		return "", SessionTokens{}, errors.New("refresh token required")
+	}
+	hash := hashToken(refreshToken)
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	for _, session := range um.sessions {
+		if session.RefreshHash != hash {
+			continue
+		}
+		if time.Now().After(session.RefreshExpiresAt) {
+			delete(um.sessions, session.TokenHash)
+			um.saveSessionsLocked()
+			return "", SessionTokens{}, errors.New("session expired")
+		}
+		if _, ok := um.users[session.Username]; !ok {
+			delete(um.sessions, session.TokenHash)
+			um.saveSessionsLocked()
+			return "", SessionTokens{}, errors.New("user not found")
+		}
+		tokens, err := um.issueTokensLocked(session)
+		if err != nil {
+			return "", SessionTokens{}, err
+		}
+		um.saveSessionsLocked()
+		return session.Username, tokens, nil
+	}
+	return "", SessionTokens{}, errors.New("invalid refresh token")
+}
+
+// ValidateToken checks if a token is valid and not expired, and slides its
+// expiry forward. Personal access tokens are accepted too; their scopes are
+// checked by apiTokenMiddleware. It runs on every request, so it only takes
+// the read lock; the time of use goes to um.seen and the write lock is only
+// taken when the expiry moves by sessionTouchInterval or the session is gone.
+func (um *UserManager) ValidateToken(token string) (string, error) {
+	token = bearerToken(token)
+	if token == "" {
+		return "", errors.New("invalid token")
+	}
+	if isAPIToken(token) {
+		return globalAPITokens.Validate(token)
+	}
+	hash := hashToken(token)
+	um.mu.RLock()
+	session, exists := um.sessions[hash]
+	var username string
+	var expiresAt, refreshExpiresAt time.Time
+	if exists {
+		username, expiresAt, refreshExpiresAt = session.Username, session.ExpiresAt, session.RefreshExpiresAt
+	}
+	um.mu.RUnlock()
+	if !exists {
+		return "", errors.New("invalid token")
+	}
+
+	now := time.Now()
+	if now.After(expiresAt) {
+		// Keep the session while its refresh token is still good
+		if now.After(refreshExpiresAt) {
+			um.mu.Lock()
+			if s, ok := um.sessions[hash]; ok && now.After(s.RefreshExpiresAt) {
+				delete(um.sessions, hash)
+				um.saveSessionsLocked()
+			}
+			um.mu.Unlock()
+		}
+		return "", errors.New("session expired")
+	}
+	um.seenMu.Lock()
+	um.seen[hash] = now
+	um.seenMu.Unlock()
+	if now.Add(sessionTimeout).Sub(expiresAt) >= sessionTouchInterval {
+		um.mu.Lock()
+		if s, ok := um.sessions[hash]; ok {
+			s.ExpiresAt = now.Add(sessionTimeout)
+			um.saveSessionsLocked()
+		}
+		um.mu.Unlock()
+	}
+	return username, nil
+}
+
+// SessionID returns the id of the session a browser token belongs to, or ""
+// for an unknown token. The id stays the same when the token is refreshed.
+func (um *UserManager) SessionID(token string) string {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+	if s, ok := um.sessions[hashToken(bearerToken(token))]; ok {
+		return s.ID
+	}
+	return ""
+}
+
+// SessionActive reports whether the session with the given id still exists.
+func (um *UserManager) SessionActive(id string) bool {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+	for _, s := range um.sessions {
+		if s.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// lastSeenLocked returns when the session stored under hash was last used.
+// Must be called with the lock held.
+func (um *UserManager) lastSeenLocked(hash string, s *Session) time.Time {
+	um.seenMu.Lock()
+	defer um.seenMu.Unlock()
+	if t, ok := um.seen[hash]; ok && t.After(s.LastSeen) {
+		return t
+	}
+	return s.LastSeen
+}
+
+// notifySessionsRevoked has the hub disconnect the clients of user whose
+// session no longer exists. Not for use from the hub goroutine.
+func notifySessionsRevoked(user string) {
+	if globalHub == nil {
+		return
+	}
+	globalHub.broadcast <- &Message{Type: "SESSIONS_REVOKED", User: user}
+}
+
+// Logout removes a session token and disconnects the websocket clients
+// it opened.
+func (um *UserManager) Logout(token string) {
+	hash := hashToken(bearerToken(token))
+	um.mu.Lock()
+	s, ok := um.sessions[hash]
+	if ok {
+		delete(um.sessions, hash)
+		um.saveSessionsLocked()
+	}
+	um.mu.Unlock()
+	if ok {
+		notifySessionsRevoked(s.Username)
+	}
+}
+
+// ListSessions returns the active sessions of a user, newest first. The
+// session belonging to currentToken is flagged as current.
+func (um *UserManager) ListSessions(username, currentToken string) []SessionInfo {
+	current := hashToken(bearerToken(currentToken))
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+	now := time.Now()
+	list := make([]SessionInfo, 0)
+	for hash, s := range um.sessions {
+		if s.Username != username || now.After(s.RefreshExpiresAt) {
+			continue
+		}
+		list = append(list, SessionInfo{
+			ID:         s.ID,
+			Username:   s.Username,
+			Remember:   s.Remember,
+			UserAgent:  s.UserAgent,
+			RemoteAddr: s.RemoteAddr,
+			CreatedAt:  s.CreatedAt,
+			LastSeen:   um.lastSeenLocked(hash, s),
+			ExpiresAt:  s.RefreshExpiresAt,
+			Current:    hash == current,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// RevokeSession ends one of the user's sessions by id and disconnects its
+// websocket clients.
+func (um *UserManager) RevokeSession(username, id string) error {
+	um.mu.Lock()
+	for hash, s := range um.sessions {
+		if s.Username == username && s.ID == id {
+			delete(um.sessions, hash)
+			um.saveSessionsLocked()
+			um.mu.Unlock()
+			notifySessionsRevoked(username)
+			return nil
+		}
+	}
+	um.mu.Unlock()
+	return errors.New("session not found")
+}
+
+// RevokeUserSessions ends every session of a user except the one keepToken
+// belongs to ("" ends them all, as a force logout does), disconnects their
+// websocket clients and returns how many were ended.
+func (um *UserManager) RevokeUserSessions(username, keepToken string) int {
+	keep := ""
+	if keepToken != "" {
+		keep = hashToken(bearerToken(keepToken))
+	}
+	um.mu.Lock()
+	n := 0
+	for hash, s := range um.sessions {
+		if s.Username == username && hash != keep {
+			delete(um.sessions, hash)
+			n++
+		}
+	}
+	if n > 0 {
+		um.saveSessionsLocked()
+	}
+	um.mu.Unlock()
+	if n > 0 {
+		notifySessionsRevoked(username)
+	}
+	return n
+}
+
+// removeExpiredSessionsLocked drops sessions whose refresh token has expired.
+// Must be called with the lock held.
+func (um *UserManager) removeExpiredSessionsLocked() {
+	now := time.Now()
+	for hash, s := range um.sessions {
+		if now.After(s.RefreshExpiresAt) {
+			delete(um.sessions, hash)
+		}
+	}
+}
+
+// loadSessionsLocked reads persisted sessions. A missing or unreadable file just
+// means nobody is logged in. Must be called with the lock held.
+func (um *UserManager) loadSessionsLocked() {
+	data, err := globalStore.ReadDocument(sessionsDocument)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error reading sessions file: %v", err)
+		}
+		return
+	}
+	var list []*Session
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Printf("Error decoding sessions: %v", err)
+		return
+	}
+	for _, s := range list {
+		if s.TokenHash != "" {
+			um.sessions[s.TokenHash] = s
+		}
+	}
+	um.removeExpiredSessionsLocked()
+	log.Printf("Loaded %d sessions from disk", len(um.sessions))
+}
+
+// saveSessionsLocked persists all sessions, first copying recorded token
+// uses into LastSeen. Must be called with the lock held.
+func (um *UserManager) saveSessionsLocked() {
+	um.seenMu.Lock()
+	for hash, t := range um.seen {
+		if s, ok := um.sessions[hash]; ok && t.After(s.LastSeen) {
+			s.LastSeen = t
+		}
+		delete(um.seen, hash)
+	}
+	um.seenMu.Unlock()
+	list := make([]*Session, 0, len(um.sessions))
+	for _, s := range um.sessions {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	data, err := json.Marshal(list)
+	if err != nil {
+		log.Printf("Error encoding sessions: %v", err)
+		return
+	}
+	if err := globalStore.WriteDocument(sessionsDocument, append(data, '\n')); err != nil {
+		log.Printf("Error saving sessions: %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLogoutDisconnectsClients(t *testing.T) {
+	walTestDir(t)
+	hub := &Hub{broadcast: make(chan *Message, 1)}
+	prev := globalHub
+	globalHub = hub
+	t.Cleanup(func() { globalHub = prev })
+
+	um := &UserManager{
+		users: make(map[string]*User),
+		sessions: map[string]*Session{
+			hashToken("tok"): {Username: "alice", RefreshExpiresAt: time.Now().Add(time.Hour)},
+		},
+		seen: make(map[string]time.Time),
+	}
+
+	um.Logout("Bearer unknown")
+	select {
+	case msg := <-hub.broadcast:
+		t.Fatalf("logout of an unknown token sent %+v", msg)
+	default:
+	}
+
+	um.Logout("Bearer tok")
+	if len(um.sessions) != 0 {
+		t.Errorf("%d sessions left after logout, want none", len(um.sessions))
+	}
+	select {
+	case msg := <-hub.broadcast:
+		if msg.Type != "SESSIONS_REVOKED" || msg.User != "alice" {
+			t.Errorf("hub got %+v, want SESSIONS_REVOKED for alice", msg)
+		}
+	default:
+		t.Error("logout did not tell the hub to disconnect the session's clients")
+	}
+}
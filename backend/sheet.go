@@ -10,6 +10,7 @@ import (
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -37,6 +38,7 @@ const (
 	ComboBoxCell
 	MultipleSelectionCell
 	AIGeneratedCell
+	FormulaCell
 )
 
 type Cell struct {
@@ -51,13 +53,13 @@ type Cell struct {
 	Bold       bool   `json:"bold,omitempty"`
 	Italic     bool   `json:"italic,omitempty"`
 
-	CellType int `json:"cell_type,omitempty"` // 0 = value, 1 = script, 2 = combo box, 3 = multiple selection, 4 = AI generated. If not set, default to value cell
+	CellType int `json:"cell_type,omitempty"` // 0 = value, 1 = script, 2 = combo box, 3 = multiple selection, 4 = AI generated, 5 = formula. If not set, default to value cell
 
 	/* AI Generated cell fields */
 	AIPrompt string `json:"ai_prompt,omitempty"` // prompt template with {{A1}} style references, processed by LLM
 
 	/* Script associated elements*/
-	Script             string `json:"script,omitempty"`                //python script
+	Script             string `json:"script,omitempty"`                //python script, or the "=" formula text for formula cells
 	ScriptOutput       string `json:"script_output,omitempty"`         //raw output of the script is stored
 	ShowScriptAsOutput bool   `json:"show_script_as_output,omitempty"` //when script will not be executed, instead script is self will be copied to value (after replacing references)
 
@@ -99,8 +101,45 @@ type AuditEntry struct {
 	ChangeReversed bool      `json:"change_reversed"` // true if a revert operation logged
 }
 
+// Permissions lists the users and "@groups" given a role on the sheet. A
+// user listed by name has that role; otherwise the first role of a group
+// they are in applies.
 type Permissions struct {
-	Editors []string `json:"editors"`
+	Editors    []string `json:"editors"`
+	Commenters []string `json:"commenters,omitempty"`
+	Viewers    []string `json:"viewers,omitempty"`
+	NoAccess   []string `json:"no_access,omitempty"`
+}
+
+// roleOf returns the role p lists user with, or "".
+func (p Permissions) roleOf(user string) Role {
+	lists := []struct {
+		users []string
+		role  Role
+	}{{p.Editors, RoleEditor}, {p.Commenters, RoleCommenter}, {p.Viewers, RoleViewer}, {p.NoAccess, RoleNone}}
+	for _, l := range lists {
+		for _, u := range l.users {
+			if u == user {
+				return l.role
+			}
+		}
+	}
+	for _, l := range lists {
+		if listedUser(l.users, user) {
+			return l.role
+		}
+	}
+	return ""
+}
+
+// clone returns a copy of p that shares no slices with it.
+func (p Permissions) clone() Permissions {
+	return Permissions{
+		Editors:    append([]string(nil), p.Editors...),
+		Commenters: append([]string(nil), p.Commenters...),
+		Viewers:    append([]string(nil), p.Viewers...),
+		NoAccess:   append([]string(nil), p.NoAccess...),
+	}
 }
 
 type Sheet struct {
@@ -109,14 +148,19 @@ type Sheet struct {
 	ProjectName   string                     `json:"project_name,omitempty"`
 	SheetType     string                     `json:"sheet_type,omitempty"` // "datasheet" or "document". Default is "datasheet".
 	Data          map[string]map[string]Cell `json:"data"`                 // Row -> Col -> Cell
-	AuditLog      []AuditEntry               `json:"audit_log"`
 	Permissions   Permissions                `json:"permissions"`
 	ColWidths     map[string]int             `json:"col_widths,omitempty"`
 	RowHeights    map[string]int             `json:"row_heights,omitempty"`
-	RowParents    map[string]int             `json:"row_parents,omitempty"`    // row (string) -> parent row number (int). 0 means root.
-	SectionScheme string                     `json:"section_scheme,omitempty"` // e.g. "1.1.1", "I.A.1", "A.1.a" or empty for none
-	ReadOnly      bool                       `json:"read_only,omitempty"`      // true when file integrity check failed
+	RowParents    map[string]int             `json:"row_parents,omitempty"`      // row (string) -> parent row number (int). 0 means root.
+	SectionScheme string                     `json:"section_scheme,omitempty"`   // e.g. "1.1.1", "I.A.1", "A.1.a" or empty for none
+	ReadOnly      bool                       `json:"read_only,omitempty"`        // true when file integrity check failed
+	Versions      []SheetVersion             `json:"versions,omitempty"`         // named versions, oldest first (versions.go)
+	Branch        *SheetBranch               `json:"branch,omitempty"`           // set when the sheet is a branch of another
+	Protected     []ProtectedRange           `json:"protected_ranges,omitempty"` // protected.go
+	Comments      []CommentThread            `json:"comments,omitempty"`         // comment threads on cells (comments.go)
 	mu            sync.RWMutex
+	walSeq        atomic.Int64 // last write-ahead log record included in Data, persisted as wal_seq
+	legacyAudit   []AuditEntry // audit_log of a sheet file from before audit logs were stored separately
 }
 
 // TransferOwnership updates the owner of the sheet and ensures
@@ -147,26 +191,9 @@ func (s *Sheet) TransferOwnershipbyAdmin(newOwner string) {
 	s.Permissions = perms
 }
 
+// IsEditor reports whether user may edit the sheet.
 func (s *Sheet) IsEditor(user string) bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	if user == "" {
-		return false
-	}
-	if user == s.Owner {
-		return true
-	}
-	// Project admins are treated as editors/owners
-	topProject := strings.SplitN(s.ProjectName, "/", 2)[0]
-	if topProject != "" && globalProjectMeta.IsProjectAdmin(topProject, user) {
-		return true
-	}
-	for _, e := range s.Permissions.Editors {
-		if e == user {
-			return true
-		}
-	}
-	return false
+	return s.RoleOf(user).AtLeast(RoleEditor)
 }
 
 type SheetManager struct {
@@ -190,9 +217,6 @@ type SheetManager struct {
 	CellsModifiedByScriptQueue   []CellIdentifier // Queue of scripts to execute, protected by CellsModifiedByScriptQueueMu
 	CellsModifiedByScriptQueueMu sync.Mutex
 
-	ScriptsExecuted   []string
-	ScriptsExecutedMu sync.Mutex
-
 	// ROW_COL_UPDATE broadcast queue
 	RowColUpdateQueue   []RowColUpdateItem // Queue of sheets to broadcast ROW_COL_UPDATED messages
 	RowColUpdateQueueMu sync.Mutex
@@ -218,41 +242,19 @@ type pendingSave struct {
 	lastModified time.Time
 }
 
-// Helper to save a single sheet without locking the manager (caller must hold lock)
-func (sm *SheetManager) saveSheetLocked(sheet *Sheet) {
-	if err := ensureDataDir(); err != nil {
-		log.Printf("Error creating data directory: %v", err)
-		return
-	}
-
-	// Determine path based on project folder if present
-	var dir string
-	if sheet.ProjectName != "" {
-		dir = filepath.Join(dataDir, sheet.ProjectName)
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			log.Printf("Error creating project directory %s: %v", dir, err)
-			return
-		}
-	} else {
-		dir = dataDir
-	}
-	filePath := filepath.Join(dir, sheet.Name+".json")
-
-	data, err := json.MarshalIndent(sheet, "", "  ")
-	if err != nil {
-		log.Printf("Error encoding sheet %s: %v", sheet.Name, err)
-		return
-	}
-	// Append newline to match previous encoder behaviour
-	data = append(data, '\n')
-	absPath, _ := filepath.Abs(filePath)
-	if err := WriteFileWithChecksum(absPath, data); err != nil {
+// Helper to save a single sheet without locking the manager (caller must hold lock).
+// Reports whether the sheet was written.
+func (sm *SheetManager) saveSheetLocked(sheet *Sheet) bool {
+	sheet.mu.RLock()
+	project, name := sheet.ProjectName, sheet.Name
+	sheet.mu.RUnlock()
+	globalAuditLog.Flush(project, name)
+	if err := globalStore.SaveSheet(sheet); err != nil {
 		log.Printf("Error saving sheet %s: %v", sheet.Name, err)
-		return
+		return false
 	}
-	// Mark as intact in the registry after a successful save
-	globalIntegrity.Record(absPath, true, false, "")
-	fmt.Printf("Sheet %s saved successfully at %s\n", sheet.Name, filePath)
+	fmt.Printf("Sheet %s saved successfully in project %s\n", sheet.Name, sheet.ProjectName)
+	return true
 }
 
 // MarshalJSON implementation for Sheet to ensure thread-safe encoding
@@ -263,8 +265,10 @@ func (s *Sheet) MarshalJSON() ([]byte, error) {
 	type Alias Sheet
 	return json.Marshal(&struct {
 		*Alias
+		WALSeq int64 `json:"wal_seq,omitempty"`
 	}{
-		Alias: (*Alias)(s),
+		Alias:  (*Alias)(s),
+		WALSeq: s.walSeq.Load(),
 	})
 }
 
@@ -277,7 +281,6 @@ var globalSheetManager = &SheetManager{
 	scriptDeps:                 make(map[string][]ScriptIdentifier),
 	lastExecutedTime:           time.Time{},
 	executeInterval:            2 * time.Second, // default execute interval
-	ScriptsExecuted:            []string{},
 	CellsModifiedManuallyQueue: []CellIdentifier{},
 	CellsModifiedByScriptQueue: []CellIdentifier{},
 	RowColUpdateQueue:          []RowColUpdateItem{},
@@ -312,7 +315,6 @@ func (sm *SheetManager) CreateSheet(name, owner, projectName, sheetType string)
 		Permissions: Permissions{
 			Editors: []string{owner},
 		},
-		AuditLog: []AuditEntry{},
 	}
 
 	// For documents, pre-fill row 1 with default column headings
@@ -325,7 +327,7 @@ func (sm *SheetManager) CreateSheet(name, owner, projectName, sheetType string)
 	}
 
 	// Initial Audit (details left empty for persistence)
-	sheet.AuditLog = append(sheet.AuditLog, AuditEntry{
+	sheet.logAudit(AuditEntry{
 		Timestamp: time.Now(),
 		User:      owner,
 		Action:    "CREATE_SHEET",
@@ -376,7 +378,6 @@ func (sm *SheetManager) CopySheetToProject(sourceID, sourceProject, targetProjec
 		RowHeights:  make(map[string]int),
 		RowParents:  make(map[string]int),
 		Permissions: Permissions{Editors: []string{owner}},
-		AuditLog:    append([]AuditEntry{}, src.AuditLog...),
 	}
 	// Deep copy data
 	src.mu.RLock()
@@ -396,8 +397,10 @@ func (sm *SheetManager) CopySheetToProject(sourceID, sourceProject, targetProjec
 		copySheet.RowParents[k] = v
 	}
 	copySheet.SectionScheme = src.SectionScheme
+	copySheet.Protected = cloneProtected(src.Protected)
 	src.mu.RUnlock()
 	// Register and persist
+	globalAuditLog.Copy(sourceProject, sourceID, targetProject, newName)
 	sm.sheets[sheetKey(targetProject, newName)] = copySheet
 	sm.saveSheetLocked(copySheet)
 	return copySheet
@@ -410,27 +413,40 @@ func generateID() string {
 
 func (s *Sheet) SetCell(row, col, value, user string, reverted bool) {
 	s.mu.Lock()
-	// defer s.mu.Unlock() // MOVED to explicit unlock before Save()
+	done := s.setCellLocked(row, col, value, user, reverted)
+	s.mu.Unlock()
+	done()
+}
 
+// editDone is what an edit made under the sheet lock does once the lock is
+// released: saving, dependency updates and recalculation.
+type editDone func()
+
+func editNothing() {}
+
+// setCellLocked is SetCell with s.mu held.
+func (s *Sheet) setCellLocked(row, col, value, user string, reverted bool) editDone {
 	// Prevent all writes to read-only (corrupt) sheets
 	if s.ReadOnly {
-		s.mu.Unlock()
-		return
+		return editNothing
 	}
 
 	if s.Data[row] == nil {
 		s.Data[row] = make(map[string]Cell)
 	}
 	currentVal, exists := s.Data[row][col]
-	// Prevent edits to locked cells
-	if exists && currentVal.Locked {
-		s.mu.Unlock()
-		return
+	// Prevent edits to locked cells and protected ranges
+	if (exists && currentVal.Locked) || s.protectedCellLocked(row, col, user) != nil {
+		return editNothing
+	}
+	// A value starting with "=" on a plain or formula cell is a formula
+	if isFormulaText(value) && (currentVal.CellType == ValueCell || currentVal.CellType == FormulaCell) {
+		return s.setCellFormulaLocked(row, col, value, user, reverted)
 	}
-	if exists && currentVal.Value == value {
+	wasFormula := exists && currentVal.CellType == FormulaCell
+	if exists && currentVal.Value == value && !wasFormula {
 		// No change
-		s.mu.Unlock()
-		return
+		return editNothing
 	}
 	// Enqueue for script execution if value is changed manually
 	globalSheetManager.CellsModifiedManuallyQueueMu.Lock()
@@ -446,20 +462,18 @@ func (s *Sheet) SetCell(row, col, value, user string, reverted bool) {
 	updated := currentVal
 	updated.User = user
 	updated.Value = value
+	if wasFormula {
+		// Typing a plain value over a formula turns the cell back into a value cell
+		updated.CellType = ValueCell
+		updated.Script = ""
+		updated.ScriptOutput = ""
+	}
 	s.Data[row][col] = updated
 
 	if reverted {
 		// Mark the original EDIT_CELL entry as reverted instead of appending a new one
 		// Find the latest matching edit for this cell where NewValue equals the current cell value prior to revert
-		prevNew := currentVal.Value
-		r1 := atoiSafe(row)
-		for i := len(s.AuditLog) - 1; i >= 0; i-- {
-			e := &s.AuditLog[i]
-			if e.Action == "EDIT_CELL" && e.Row1 == r1 && e.Col1 == col && e.NewValue == prevNew && !e.ChangeReversed {
-				e.ChangeReversed = true
-				break
-			}
-		}
+		globalAuditLog.Revert(s.ProjectName, s.Name, "EDIT_CELL", atoiSafe(row), col, currentVal.Value)
 		// Do not append a new audit entry for revert
 	} else {
 		var oldVal string
@@ -484,24 +498,35 @@ func (s *Sheet) SetCell(row, col, value, user string, reverted bool) {
 
 	}
 
-	s.mu.Unlock() // Unlock BEFORE saving to avoid deadlock (Save -> MarshalJSON -> tries RLock)
+	// Saved once unlocked to avoid deadlock (Save -> MarshalJSON -> tries RLock)
+	return func() {
+		if wasFormula {
+			globalSheetManager.UpdateScriptDependencies(s.ProjectName, s.Name, currentVal.CellID, "", row, col)
+		}
 
-	// Persist changes
-	// Optimally we shouldn't save on every cell edit for performance, but for this task it ensures safety.
-	globalSheetManager.SaveSheet(s)
+		// Persist changes
+		// Optimally we shouldn't save on every cell edit for performance, but for this task it ensures safety.
+		globalSheetManager.SaveCells(s, cellRef{row, col})
+	}
 }
 
 // SetCellStyle updates only the script attribute for a cell, preserving value and other metadata.
 func (s *Sheet) SetCellStyle(row, col, background string, bold, italic bool, user string) {
 	s.mu.Lock()
+	done := s.setCellStyleLocked(row, col, background, bold, italic, user)
+	s.mu.Unlock()
+	done()
+}
+
+// setCellStyleLocked is SetCellStyle with s.mu held.
+func (s *Sheet) setCellStyleLocked(row, col, background string, bold, italic bool, user string) editDone {
 	if s.Data[row] == nil {
 		s.Data[row] = make(map[string]Cell)
 	}
 	current, exists := s.Data[row][col]
 	// Prevent edits to locked cells' style if locked
-	if exists && current.Locked {
-		s.mu.Unlock()
-		return
+	if (exists && current.Locked) || s.protectedCellLocked(row, col, user) != nil {
+		return editNothing
 	}
 	// Apply style while preserving existing value and lock info
 	updated := current
@@ -512,7 +537,7 @@ func (s *Sheet) SetCellStyle(row, col, background string, bold, italic bool, use
 	s.Data[row][col] = updated
 
 	if exists {
-		s.AuditLog = append(s.AuditLog, AuditEntry{
+		s.logAudit(AuditEntry{
 			Timestamp:      time.Now(),
 			User:           user,
 			Action:         "STYLE_CELL",
@@ -521,7 +546,7 @@ func (s *Sheet) SetCellStyle(row, col, background string, bold, italic bool, use
 			ChangeReversed: false,
 		})
 	} else {
-		s.AuditLog = append(s.AuditLog, AuditEntry{
+		s.logAudit(AuditEntry{
 			Timestamp:      time.Now(),
 			User:           user,
 			Action:         "STYLE_CELL",
@@ -530,21 +555,27 @@ func (s *Sheet) SetCellStyle(row, col, background string, bold, italic bool, use
 			ChangeReversed: false,
 		})
 	}
-	s.mu.Unlock()
-	globalSheetManager.SaveSheet(s)
+	return func() { globalSheetManager.SaveCells(s, cellRef{row, col}) }
 }
 
 // SetCellName sets the human-friendly name of a cell.
 // Returns an error string if the name is already in use by another cell, or empty string on success.
 func (s *Sheet) SetCellName(row, col, cellName, user string) string {
 	s.mu.Lock()
+	msg, done := s.setCellNameLocked(row, col, cellName, user)
+	s.mu.Unlock()
+	done()
+	return msg
+}
 
+// setCellNameLocked is SetCellName with s.mu held.
+func (s *Sheet) setCellNameLocked(row, col, cellName, user string) (string, editDone) {
 	// Check for duplicate name (ignore the cell being renamed itself)
 	if cellName != "" {
 		for r, cols := range s.Data {
 			for c, cell := range cols {
 				if cell.CellName == cellName && !(r == row && c == col) {
-					return fmt.Sprintf("name '%s' is already used by cell %s%s", cellName, c, r)
+					return fmt.Sprintf("name '%s' is already used by cell %s%s", cellName, c, r), editNothing
 				}
 			}
 		}
@@ -559,7 +590,7 @@ func (s *Sheet) SetCellName(row, col, cellName, user string) string {
 	current.User = user
 	s.Data[row][col] = current
 
-	s.AuditLog = append(s.AuditLog, AuditEntry{
+	s.logAudit(AuditEntry{
 		Timestamp: time.Now(),
 		User:      user,
 		Action:    "RENAME_CELL",
@@ -569,9 +600,7 @@ func (s *Sheet) SetCellName(row, col, cellName, user string) string {
 		OldValue:  prevName,
 		NewValue:  cellName,
 	})
-	s.mu.Unlock()
-	globalSheetManager.SaveSheet(s)
-	return ""
+	return "", func() { globalSheetManager.SaveCells(s, cellRef{row, col}) }
 }
 
 // FindCellByName returns the row and column of the cell with the given CellName.
@@ -609,24 +638,29 @@ func (s *Sheet) IsCellLocked(row, col string) bool {
 // LockCell locks a cell. Only the sheet owner or project admin may lock.
 func (s *Sheet) LockCell(row, col, user string) bool {
 	s.mu.Lock()
-	//defer s.mu.Unlock()
+	ok, done := s.lockCellLocked(row, col, user)
+	s.mu.Unlock()
+	done()
+	return ok
+}
+
+// lockCellLocked is LockCell with s.mu held.
+func (s *Sheet) lockCellLocked(row, col, user string) (bool, editDone) {
 	topProject := strings.SplitN(s.ProjectName, "/", 2)[0]
 	if user != s.Owner && !(topProject != "" && globalProjectMeta.IsProjectAdmin(topProject, user)) {
-		s.mu.Unlock()
-		return false
+		return false, editNothing
 	}
 	if s.Data[row] == nil {
 		s.Data[row] = make(map[string]Cell)
 	}
 	cell := s.Data[row][col]
 	if cell.Locked {
-		s.mu.Unlock()
-		return true // already locked
+		return true, editNothing // already locked
 	}
 	cell.Locked = true
 	cell.LockedBy = user
 	s.Data[row][col] = cell
-	s.AuditLog = append(s.AuditLog, AuditEntry{
+	s.logAudit(AuditEntry{
 		Timestamp:      time.Now(),
 		User:           user,
 		Action:         "LOCK_CELL",
@@ -634,34 +668,36 @@ func (s *Sheet) LockCell(row, col, user string) bool {
 		Col1:           col,
 		ChangeReversed: false,
 	})
-	s.mu.Unlock()
 	// Save after unlock via manager
-	go globalSheetManager.SaveSheet(s)
-	return true
+	return true, func() { go globalSheetManager.SaveCells(s, cellRef{row, col}) }
 }
 
 // UnlockCell unlocks a cell. Only the sheet owner or project admin may unlock.
 func (s *Sheet) UnlockCell(row, col, user string) bool {
 	s.mu.Lock()
-	//defer s.mu.Unlock()
+	ok, done := s.unlockCellLocked(row, col, user)
+	s.mu.Unlock()
+	done()
+	return ok
+}
+
+// unlockCellLocked is UnlockCell with s.mu held.
+func (s *Sheet) unlockCellLocked(row, col, user string) (bool, editDone) {
 	topProject := strings.SplitN(s.ProjectName, "/", 2)[0]
 	if user != s.Owner && !(topProject != "" && globalProjectMeta.IsProjectAdmin(topProject, user)) {
-		s.mu.Unlock()
-		return false
+		return false, editNothing
 	}
 	cell, ok := s.Data[row][col]
 	if !ok {
-		s.mu.Unlock()
-		return false
+		return false, editNothing
 	}
 	if !cell.Locked {
-		s.mu.Unlock()
-		return true // already unlocked
+		return true, editNothing // already unlocked
 	}
 	cell.Locked = false
 	cell.LockedBy = ""
 	s.Data[row][col] = cell
-	s.AuditLog = append(s.AuditLog, AuditEntry{
+	s.logAudit(AuditEntry{
 		Timestamp:      time.Now(),
 		User:           user,
 		Action:         "UNLOCK_CELL",
@@ -669,86 +705,104 @@ func (s *Sheet) UnlockCell(row, col, user string) bool {
 		Col1:           col,
 		ChangeReversed: false,
 	})
-	s.mu.Unlock()
 	// Save after unlock via manager
-	go globalSheetManager.SaveSheet(s)
-	return true
+	return true, func() { go globalSheetManager.SaveCells(s, cellRef{row, col}) }
 }
 
 func (s *Sheet) SetColWidth(col string, width int, user string) {
 	s.mu.Lock()
+	done := s.setColWidthLocked(col, width, user)
+	s.mu.Unlock()
+	done()
+}
+
+func (s *Sheet) setColWidthLocked(col string, width int, user string) editDone {
 	// ensure map
 	if s.ColWidths == nil {
 		s.ColWidths = make(map[string]int)
 	}
 	s.ColWidths[col] = width
-
-	s.mu.Unlock()
-
-	globalSheetManager.SaveSheet(s)
+	return func() { globalSheetManager.SaveCells(s) }
 }
 
 func (s *Sheet) SetRowHeight(row string, height int, user string) {
 	s.mu.Lock()
+	done := s.setRowHeightLocked(row, height, user)
+	s.mu.Unlock()
+	done()
+}
+
+func (s *Sheet) setRowHeightLocked(row string, height int, user string) editDone {
 	if s.RowHeights == nil {
 		s.RowHeights = make(map[string]int)
 	}
 	s.RowHeights[row] = height
-
-	s.mu.Unlock()
-
-	globalSheetManager.SaveSheet(s)
+	return func() { globalSheetManager.SaveCells(s) }
 }
 
 func (s *Sheet) SetSectionScheme(scheme string) {
 	s.mu.Lock()
-	s.SectionScheme = scheme
+	done := s.setSectionSchemeLocked(scheme)
 	s.mu.Unlock()
-	globalSheetManager.SaveSheet(s)
+	done()
 }
 
-// UpdatePermissions sets editors list; owner or admin may change settings.
-// Ensures owner is always in editors.
-func (s *Sheet) UpdatePermissions(editors []string, performedBy string, isAdmin bool) bool {
+func (s *Sheet) setSectionSchemeLocked(scheme string) editDone {
+	s.SectionScheme = scheme
+	return func() { globalSheetManager.SaveCells(s) }
+}
+
+// UpdatePermissions replaces the role lists of the sheet; a nil list keeps
+// the current one. Owner or admin may change settings. Ensures owner is
+// always in editors and each user is in one list only.
+func (s *Sheet) UpdatePermissions(perms Permissions, performedBy string, isAdmin bool) bool {
 	s.mu.Lock()
 	//defer s.mu.Unlock()
 	if !isAdmin && performedBy != s.Owner {
 		s.mu.Unlock()
 		return false
 	}
-	// dedupe helpers
+	keep := func(list, cur []string) []string {
+		if list == nil {
+			return cur
+		}
+		return list
+	}
+	perms.Editors = keep(perms.Editors, s.Permissions.Editors)
+	perms.Commenters = keep(perms.Commenters, s.Permissions.Commenters)
+	perms.Viewers = keep(perms.Viewers, s.Permissions.Viewers)
+	perms.NoAccess = keep(perms.NoAccess, s.Permissions.NoAccess)
+	// dedupe across the lists, the first list a user is in wins
+	seen := make(map[string]struct{})
 	uniq := func(in []string) []string {
-		m := make(map[string]struct{})
 		out := make([]string, 0, len(in))
 		for _, v := range in {
 			if v == "" {
 				continue
 			}
-			if _, ok := m[v]; !ok {
-				m[v] = struct{}{}
+			if _, ok := seen[v]; !ok {
+				seen[v] = struct{}{}
 				out = append(out, v)
 			}
 		}
 		return out
 	}
-	editors = uniq(editors)
+	perms.Editors = uniq(perms.Editors)
 	// Ensure owner in editors
-	hasOwner := false
-	for _, e := range editors {
-		if e == s.Owner {
-			hasOwner = true
-			break
-		}
-	}
-	if !hasOwner {
-		editors = append(editors, s.Owner)
+	if _, ok := seen[s.Owner]; !ok {
+		seen[s.Owner] = struct{}{}
+		perms.Editors = append(perms.Editors, s.Owner)
 	}
+	perms.Commenters = uniq(perms.Commenters)
+	perms.Viewers = uniq(perms.Viewers)
+	perms.NoAccess = uniq(perms.NoAccess)
 
-	s.Permissions.Editors = editors
+	s.Permissions = perms
 	s.mu.Unlock()
-	go globalSheetManager.SaveSheet(s)
+	go globalSheetManager.SaveCells(s)
 	// Log only in project audit
-	globalProjectAuditManager.Append(s.ProjectName, performedBy, "UPDATE_SHEET_PERMISSIONS", fmt.Sprintf("For Sheet %s Editors: %v", s.Name, editors))
+	globalProjectAuditManager.Append(s.ProjectName, performedBy, "UPDATE_SHEET_PERMISSIONS", fmt.Sprintf("For Sheet %s Editors: %v Commenters: %v Viewers: %v No access: %v",
+		s.Name, perms.Editors, perms.Commenters, perms.Viewers, perms.NoAccess))
 	return true
 }
 
@@ -779,7 +833,7 @@ func (s *Sheet) TransferOwnership(newOwner, performedBy string, isAdmin bool) bo
 		s.Permissions.Editors = append(s.Permissions.Editors, newOwner)
 	}
 	s.mu.Unlock()
-	go globalSheetManager.SaveSheet(s)
+	go globalSheetManager.SaveCells(s)
 	// Log only in project audit
 	globalProjectAuditManager.Append(s.ProjectName, performedBy, "TRANSFER_SHEET_OWNERSHIP", fmt.Sprintf("For Sheet %s Owner changed from %s to %s", s.Name, old, newOwner))
 	return true
@@ -939,6 +993,13 @@ func (s *Sheet) adjustRowParentsOnMove(fromRow, destIndex int) {
 // SetRowParent sets the parent of a row. parentRow=0 means root (no parent).
 func (s *Sheet) SetRowParent(rowStr string, parentRow int, user string) {
 	s.mu.Lock()
+	done := s.setRowParentLocked(rowStr, parentRow, user)
+	s.mu.Unlock()
+	done()
+}
+
+// setRowParentLocked is SetRowParent with s.mu held.
+func (s *Sheet) setRowParentLocked(rowStr string, parentRow int, user string) editDone {
 	if s.RowParents == nil {
 		s.RowParents = make(map[string]int)
 	}
@@ -947,8 +1008,7 @@ func (s *Sheet) SetRowParent(rowStr string, parentRow int, user string) {
 	} else {
 		s.RowParents[rowStr] = parentRow
 	}
-	s.mu.Unlock()
-	globalSheetManager.SaveSheet(s)
+	return func() { globalSheetManager.SaveCells(s) }
 }
 
 // InsertChildRow inserts a new child row below all descendants of targetRowStr.
@@ -1025,16 +1085,14 @@ func (s *Sheet) InsertChildRow(targetRowStr, user string) int {
 	}
 	s.RowParents[newKey] = targetRow
 
-	// Adjust audit log row references
-	s.adjustAuditRowsOnInsert(insertRow)
-
-	s.AuditLog = append(s.AuditLog, AuditEntry{
+	// Rows at or below the inserted one move down in earlier audit entries
+	s.logAuditShift(AuditEntry{
 		Timestamp: time.Now(),
 		User:      user,
 		Action:    "INSERT_CHILD_ROW",
 		Row1:      insertRow,
 		Row2:      targetRow,
-	})
+	}, &AuditShift{Axis: "row", Op: "insert", At: insertRow})
 	s.mu.Unlock()
 
 	// Adjust script tags
@@ -1125,15 +1183,13 @@ func (s *Sheet) InsertRowBelow(targetRowStr, user string) bool {
 	if parentVal, ok := s.RowParents[itoa(targetRow)]; ok && parentVal > 0 {
 		s.RowParents[newKey] = parentVal
 	}
-	// Adjust audit log row references for rows at or below the inserted position
-	s.adjustAuditRowsOnInsert(insertRow)
-
-	s.AuditLog = append(s.AuditLog, AuditEntry{
+	// Rows at or below the inserted one move down in earlier audit entries
+	s.logAuditShift(AuditEntry{
 		Timestamp: time.Now(),
 		User:      user,
 		Action:    "INSERT_ROW",
 		Row1:      insertRow,
-	})
+	}, &AuditShift{Axis: "row", Op: "insert", At: insertRow})
 	s.mu.Unlock()
 	// Adjust script tags in cells for row insertion
 	s.adjustScriptTagsOnInsertRow(insertRow)
@@ -1272,15 +1328,13 @@ func (s *Sheet) InsertRowAbove(targetRowStr, user string) bool {
 		s.RowParents[newKey] = parentOfTarget
 	}
 
-	// Adjust audit log row references for rows at or below the inserted position
-	s.adjustAuditRowsOnInsert(insertRow)
-
-	s.AuditLog = append(s.AuditLog, AuditEntry{
+	// Rows at or below the inserted one move down in earlier audit entries
+	s.logAuditShift(AuditEntry{
 		Timestamp: time.Now(),
 		User:      user,
 		Action:    "INSERT_ROW_ABOVE",
 		Row1:      insertRow,
-	})
+	}, &AuditShift{Axis: "row", Op: "insert", At: insertRow})
 	s.mu.Unlock()
 
 	// Adjust script tags in cells for row insertion
@@ -1299,6 +1353,10 @@ func (s *Sheet) DeleteRowAt(rowStr, user string) bool {
 		return false
 	}
 	s.mu.Lock()
+	if s.protectedRowBlockLocked(row, user) != nil {
+		s.mu.Unlock()
+		return false
+	}
 
 	// Find all descendants of this row
 	descendants := s.getDescendants(row)
@@ -1365,7 +1423,7 @@ func (s *Sheet) DeleteRowAt(rowStr, user string) bool {
 	// Adjust audit logs for the block deletion (all rows deleted at once)
 	s.adjustAuditRowsOnDeleteBlock(row, blockSize, user)
 
-	s.AuditLog = append(s.AuditLog, AuditEntry{
+	s.logAudit(AuditEntry{
 		Timestamp: time.Now(),
 		User:      user,
 		Action:    "DELETE_ROW",
@@ -1397,6 +1455,10 @@ func (s *Sheet) MoveRowBelow(fromRowStr, targetRowStr, user string) bool {
 
 	s.mu.Lock()
 	fmt.Println("MoveRowBelow2")
+	if s.protectedRowBlockLocked(fromRow, user) != nil {
+		s.mu.Unlock()
+		return false
+	}
 	// Get all descendants of fromRow
 	descendants := s.getDescendants(fromRow)
 	// The block of rows to move: fromRow + descendants (should be contiguous)
@@ -1636,7 +1698,7 @@ func (s *Sheet) MoveRowBelow(fromRowStr, targetRowStr, user string) bool {
 	// Adjust audit row references for the block move
 	s.adjustAuditRowsOnMoveBlock(fromRow, blockSize, insertStart, user)
 	// Audit entry
-	s.AuditLog = append(s.AuditLog, AuditEntry{
+	s.logAudit(AuditEntry{
 		Timestamp: time.Now(),
 		User:      user,
 		Action:    "MOVE_ROW",
@@ -1669,6 +1731,10 @@ func (s *Sheet) MoveRowAsChild(fromRowStr, targetRowStr, user string) bool {
 	}
 
 	s.mu.Lock()
+	if s.protectedRowBlockLocked(fromRow, user) != nil {
+		s.mu.Unlock()
+		return false
+	}
 
 	// Get all descendants of fromRow
 	descendants := s.getDescendants(fromRow)
@@ -1889,7 +1955,7 @@ func (s *Sheet) MoveRowAsChild(fromRowStr, targetRowStr, user string) bool {
 	// Adjust audit row references for the block move
 	s.adjustAuditRowsOnMoveBlock(fromRow, blockSize, insertStart, user)
 	// Audit entry
-	s.AuditLog = append(s.AuditLog, AuditEntry{
+	s.logAudit(AuditEntry{
 		Timestamp: time.Now(),
 		User:      user,
 		Action:    "MOVE_ROW_AS_CHILD",
@@ -1944,6 +2010,10 @@ func (s *Sheet) MoveColumnRight(fromColStr, targetColStr, user string) bool {
 	}
 
 	s.mu.Lock()
+	if s.protectedLinesLocked("col", fromIdx, 1, user) != nil {
+		s.mu.Unlock()
+		return false
+	}
 	// Prevent cutting a column containing any locked cell
 	for _, rowMap := range s.Data {
 		if cell, ok := rowMap[fromColStr]; ok {
@@ -2047,16 +2117,14 @@ func (s *Sheet) MoveColumnRight(fromColStr, targetColStr, user string) bool {
 		newWidths[toColLabel(destIdx)] = s.ColWidths[toColLabel(fromIdx)]
 	}
 	s.ColWidths = newWidths
-	// Adjust audit log columns according to move mapping
-	s.adjustAuditColsOnMove(fromIdx, destIdx)
-	// Audit entry
-	s.AuditLog = append(s.AuditLog, AuditEntry{
+	// Audit entry; earlier entries follow the column move
+	s.logAuditShift(AuditEntry{
 		Timestamp: time.Now(),
 		User:      user,
 		Action:    "MOVE_COL",
 		Col1:      fromColStr,
 		Col2:      toColLabel(destIdx),
-	})
+	}, &AuditShift{Axis: "col", Op: "move", At: fromIdx, To: destIdx})
 
 	s.mu.Unlock()
 	// Adjust script tags in cells for column move
@@ -2169,16 +2237,14 @@ func (s *Sheet) InsertColumnRight(targetColStr, user string) bool {
 	if w, ok := s.ColWidths[targetColStr]; ok {
 		s.ColWidths[newLabel] = w
 	}
-	// Adjust audit log column references for columns at or beyond the inserted position
-	s.adjustAuditColsOnInsert(insertIdx)
-
-	s.AuditLog = append(s.AuditLog, AuditEntry{
+	// Columns at or beyond the inserted one move right in earlier audit entries
+	s.logAuditShift(AuditEntry{
 		Timestamp:      time.Now(),
 		User:           user,
 		Action:         "INSERT_COL",
 		Col1:           newLabel,
 		ChangeReversed: false,
-	})
+	}, &AuditShift{Axis: "col", Op: "insert", At: insertIdx})
 	s.mu.Unlock()
 	// Adjust script tags in cells for column insertion
 	s.adjustScriptTagsOnInsertCol(insertIdx)
@@ -2238,6 +2304,10 @@ func (s *Sheet) DeleteColumnAt(colStr, user string) bool {
 		return false
 	}
 	s.mu.Lock()
+	if s.protectedLinesLocked("col", insertIdx, 1, user) != nil {
+		s.mu.Unlock()
+		return false
+	}
 	// Determine max column index
 	maxIdx := 0
 	for _, rowMap := range s.Data {
@@ -2288,16 +2358,14 @@ func (s *Sheet) DeleteColumnAt(colStr, user string) bool {
 			delete(s.ColWidths, toLabel)
 		}
 	}
-	// Adjust audit logs for deletion
-	s.adjustAuditColsOnDelete(insertIdx)
-
-	s.AuditLog = append(s.AuditLog, AuditEntry{
+	// Columns right of the deleted one move left in earlier audit entries
+	s.logAuditShift(AuditEntry{
 		Timestamp:      time.Now(),
 		User:           user,
 		Action:         "DELETE_COL",
 		Col1:           colStr,
 		ChangeReversed: false,
-	})
+	}, &AuditShift{Axis: "col", Op: "delete", At: insertIdx})
 
 	s.mu.Unlock()
 	// Adjust script tags in cells for column deletion
@@ -2439,6 +2507,11 @@ func computeAuditDetails(s *Sheet, e AuditEntry) string {
 			return fmt.Sprintf("Set script for cell %d,%s to %s", r, c, firstNChar(e.NewValue, 10))
 		}
 		return fmt.Sprintf("Changed script for cell %d,%s", r, c)
+	case "EDIT_FORMULA":
+		if e.OldValue == "" {
+			return fmt.Sprintf("Set formula for cell %d,%s to %s", e.Row1, e.Col1, firstNChar(e.NewValue, 10))
+		}
+		return fmt.Sprintf("Changed cell %d,%s from %s to formula %s", e.Row1, e.Col1, firstNChar(e.OldValue, 10), firstNChar(e.NewValue, 10))
 	case "STYLE_CELL":
 		return fmt.Sprintf("Updated style for cell %d,%s", e.Row1, e.Col1)
 	case "LOCK_CELL":
@@ -2469,13 +2542,45 @@ func computeAuditDetails(s *Sheet, e AuditEntry) string {
 		return "Updated permissions"
 	case "TRANSFER_OWNERSHIP":
 		return "Transferred ownership"
+	case "RESTORE_HISTORY":
+		if e.OldValue == "" {
+			return "Restored sheet as of " + e.NewValue
+		}
+		return fmt.Sprintf("Restored %s as of %s", e.OldValue, e.NewValue)
+	case "TAG_VERSION":
+		return "Tagged version " + e.NewValue
+	case "DELETE_VERSION":
+		return "Deleted version " + e.OldValue
+	case "CREATE_BRANCH":
+		return fmt.Sprintf("Branched %s as %s", e.OldValue, e.NewValue)
+	case "MERGE_BRANCH":
+		return fmt.Sprintf("Merged branch %s (%s cells)", e.OldValue, e.NewValue)
+	case "PROTECT_RANGE":
+		return "Protected " + e.NewValue
+	case "UPDATE_PROTECTED_RANGE":
+		return "Changed protected range " + e.NewValue
+	case "UNPROTECT_RANGE":
+		return "Removed protection of " + e.OldValue
+	case "COMMENT":
+		return fmt.Sprintf("Commented on cell %d,%s: %s", e.Row1, e.Col1, firstNChar(e.NewValue, 20))
+	case "RESOLVE_COMMENT":
+		return fmt.Sprintf("Resolved comments on cell %d,%s", e.Row1, e.Col1)
+	case "REOPEN_COMMENT":
+		return fmt.Sprintf("Reopened comments on cell %d,%s", e.Row1, e.Col1)
+	case "DELETE_COMMENT":
+		return fmt.Sprintf("Deleted comment on cell %d,%s", e.Row1, e.Col1)
+	case "UNDO":
+		return "Undid " + e.NewValue
+	case "REDO":
+		return "Redid " + e.NewValue
 	default:
 		return e.Action
 	}
 }
 
-// SnapshotForClient builds a copy of the sheet with audit Details filled for response
-// without mutating or leaking internal state. This snapshot is safe to marshal/send.
+// SnapshotForClient builds a copy of the sheet for a response without mutating
+// or leaking internal state. This snapshot is safe to marshal/send. The audit
+// log is fetched separately from /api/sheet/audit.
 func (s *Sheet) SnapshotForClient() *Sheet {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -2501,200 +2606,48 @@ func (s *Sheet) SnapshotForClient() *Sheet {
 	for k, v := range s.RowParents {
 		rowParentsCopy[k] = v
 	}
-	auditCopy := make([]AuditEntry, 0, len(s.AuditLog))
-	for _, e := range s.AuditLog {
-		e2 := e
-		e2.Details = computeAuditDetails(s, e)
-		auditCopy = append(auditCopy, e2)
-	}
-
 	snap := &Sheet{
 		Name:          s.Name,
 		Owner:         s.Owner,
 		ProjectName:   s.ProjectName,
 		Data:          dataCopy,
-		AuditLog:      auditCopy,
-		Permissions:   Permissions{Editors: append([]string(nil), s.Permissions.Editors...)},
+		Permissions:   s.Permissions.clone(),
 		ColWidths:     colWidthsCopy,
 		RowHeights:    rowHeightsCopy,
 		RowParents:    rowParentsCopy,
 		SectionScheme: s.SectionScheme,
+		Protected:     cloneProtected(s.Protected),
 	}
 	return snap
 }
 
-// adjustAuditRowsOnInsert increments row references for entries at or below insertRow
-func (s *Sheet) adjustAuditRowsOnInsert(insertRow int) {
-	for i := range s.AuditLog {
-		e := &s.AuditLog[i]
-		oldRow := e.Row1
-		ensureEntryCoords(e)
-		if e.Row1 >= insertRow && e.Row1 > 0 {
-			e.Row1 = e.Row1 + 1
-		}
-		_ = oldRow // details left empty; no string rewrite
-	}
-}
-
-// adjustAuditRowsOnMove adjusts row references for a row move from fromRow to destIndex
-func (s *Sheet) adjustAuditRowsOnMove(fromRow, destIndex int) {
-	for i := range s.AuditLog {
-		e := &s.AuditLog[i]
-		ensureEntryCoords(e)
-		if e.Row1 == 0 {
-			continue
-		}
-		old := e.Row1
-		if fromRow < destIndex {
-			if e.Row1 == fromRow {
-				e.Row1 = destIndex
-			} else if e.Row1 > fromRow && e.Row1 <= destIndex {
-				e.Row1 = e.Row1 - 1
-			}
-		} else if fromRow > destIndex {
-			if e.Row1 == fromRow {
-				e.Row1 = destIndex
-			} else if e.Row1 >= destIndex && e.Row1 < fromRow {
-				e.Row1 = e.Row1 + 1
-			}
-		}
-		_ = old // details left empty; no string rewrite
-	}
-}
-
-// adjustAuditColsOnInsert increments column references for entries at or beyond insertIdx
-func (s *Sheet) adjustAuditColsOnInsert(insertIdx int) {
-	for i := range s.AuditLog {
-		e := &s.AuditLog[i]
-		oldCol := e.Col1
-		ensureEntryCoords(e)
-		idx := colLabelToIndex(e.Col1)
-		if idx >= insertIdx && idx > 0 {
-			idx = idx + 1
-			e.Col1 = indexToColLabel(idx)
-		}
-		_ = oldCol // details left empty; no string rewrite
-	}
-}
-
-// adjustAuditColsOnMove adjusts column references for a column move from fromIdx to destIdx
-func (s *Sheet) adjustAuditColsOnMove(fromIdx, destIdx int) {
-	for i := range s.AuditLog {
-		e := &s.AuditLog[i]
-		ensureEntryCoords(e)
-		idx := colLabelToIndex(e.Col1)
-		if idx == 0 {
-			continue
-		}
-		oldIdx := idx
-		if fromIdx < destIdx {
-			if idx == fromIdx {
-				idx = destIdx
-			} else if idx > fromIdx && idx <= destIdx {
-				idx = idx - 1
-			}
-		} else if fromIdx > destIdx {
-			if idx == fromIdx {
-				idx = destIdx
-			} else if idx >= destIdx && idx < fromIdx {
-				idx = idx + 1
-			}
-		}
-		if idx != oldIdx {
-			e.Col1 = indexToColLabel(idx)
-		}
-	}
-}
-
-// adjustAuditRowsOnDelete decrements row references for entries strictly above deleted row
-func (s *Sheet) adjustAuditRowsOnDelete(deleteRow int) {
-	for i := range s.AuditLog {
-		e := &s.AuditLog[i]
-		oldRow := e.Row1
-		ensureEntryCoords(e)
-		if e.Row1 > deleteRow {
-			e.Row1 = e.Row1 - 1
-		}
-		_ = oldRow // details left empty; no string rewrite
-	}
-}
-
-// adjustAuditRowsOnMoveBlock adjusts row references in audit entries for a block move.
-// blockStart is the original first row of the block, blockSize is the number of rows,
-// and insertStart is the first row position where the block was inserted.
-// A new audit entry is appended to record the block move.
+// adjustAuditRowsOnMoveBlock records a block move in the audit log. Earlier
+// entries on the moved rows follow the block; rows between its old and new
+// place shift by blockSize. insertStart is where the block's first row ends up.
 func (s *Sheet) adjustAuditRowsOnMoveBlock(blockStart, blockSize, insertStart int, user string) {
 	blockEnd := blockStart + blockSize - 1
-	for i := range s.AuditLog {
-		e := &s.AuditLog[i]
-		ensureEntryCoords(e)
-		if e.Row1 == 0 {
-			continue
-		}
-		if e.Row1 >= blockStart && e.Row1 <= blockEnd {
-			e.Row1 = insertStart + (e.Row1 - blockStart)
-		} else if blockStart < insertStart {
-			if e.Row1 > blockEnd && e.Row1 < insertStart+blockSize {
-				e.Row1 -= blockSize
-			}
-		} else if blockStart > insertStart {
-			if e.Row1 >= insertStart && e.Row1 < blockStart {
-				e.Row1 += blockSize
-			}
-		}
-	}
-	s.AuditLog = append(s.AuditLog, AuditEntry{
+	s.logAuditShift(AuditEntry{
 		Timestamp: time.Now(),
 		User:      user,
 		Action:    "AUDIT_ADJUST_MOVE_BLOCK",
 		Details:   fmt.Sprintf("Adjusted audit rows for block move: rows %d-%d moved to %d-%d", blockStart, blockEnd, insertStart, insertStart+blockSize-1),
 		Row1:      blockStart,
 		Row2:      insertStart,
-	})
+	}, &AuditShift{Axis: "row", Op: "move", At: blockStart, Count: blockSize, To: insertStart})
 }
 
-// adjustAuditRowsOnDeleteBlock adjusts row references in audit entries for a block delete.
-// blockStart is the first row deleted and blockSize is the number of contiguous rows deleted.
-// Entries referencing deleted rows are left with their row unchanged; entries above the block shift down by blockSize.
-// A new audit entry is appended to record the block deletion adjustment.
+// adjustAuditRowsOnDeleteBlock records a block delete in the audit log.
+// Earlier entries on the deleted rows keep their row; entries below the block
+// shift up by blockSize.
 func (s *Sheet) adjustAuditRowsOnDeleteBlock(blockStart, blockSize int, user string) {
 	blockEnd := blockStart + blockSize - 1
-	for i := range s.AuditLog {
-		e := &s.AuditLog[i]
-		ensureEntryCoords(e)
-		if e.Row1 == 0 {
-			continue
-		}
-		if e.Row1 >= blockStart && e.Row1 <= blockEnd {
-			// Row was deleted - leave as is (references a now-deleted row)
-			continue
-		}
-		if e.Row1 > blockEnd {
-			e.Row1 -= blockSize
-		}
-	}
-	s.AuditLog = append(s.AuditLog, AuditEntry{
+	s.logAuditShift(AuditEntry{
 		Timestamp: time.Now(),
 		User:      user,
 		Action:    "AUDIT_ADJUST_DELETE_BLOCK",
 		Details:   fmt.Sprintf("Adjusted audit rows for block delete: rows %d-%d deleted", blockStart, blockEnd),
 		Row1:      blockStart,
-	})
-}
-
-// adjustAuditColsOnDelete decrements column references for entries strictly right of deleted column
-func (s *Sheet) adjustAuditColsOnDelete(deleteIdx int) {
-	for i := range s.AuditLog {
-		e := &s.AuditLog[i]
-		oldCol := e.Col1
-		ensureEntryCoords(e)
-		idx := colLabelToIndex(e.Col1)
-		if idx > deleteIdx {
-			idx = idx - 1
-			e.Col1 = indexToColLabel(idx)
-		}
-		_ = oldCol // details left empty; no string rewrite
-	}
+	}, &AuditShift{Axis: "row", Op: "delete", At: blockStart, Count: blockSize})
 }
 
 func (sm *SheetManager) ListSheets() []*Sheet {
@@ -2765,7 +2718,7 @@ func (sm *SheetManager) RenameSheet(id, newName, user string) bool {
 }
 */
 // RenameSheetBy renames a sheet identified by name and project.
-// This renames the actual file on disk and updates all dependency references.
+// This renames the sheet in the store and updates all dependency references.
 func (sm *SheetManager) RenameSheetBy(name, project, newName, user string) bool {
 	// Phase 1: locate sheet and remember old key under manager lock
 	sm.mu.Lock()
@@ -2789,22 +2742,19 @@ func (sm *SheetManager) RenameSheetBy(name, project, newName, user string) bool
 		return false
 	}
 
-	// Phase 2: rename file + update sheet fields under sheet lock
+	// Phase 2: rename in the store + update sheet fields under sheet lock
 	sheet.mu.Lock()
 	oldName := sheet.Name
-	var dir string
-	if sheet.ProjectName != "" {
-		dir = filepath.Join(dataDir, sheet.ProjectName)
-	} else {
-		dir = dataDir
-	}
-	oldPath := filepath.Join(dir, oldName+".json")
-	newPath := filepath.Join(dir, newName+".json")
-	if err := os.Rename(oldPath, newPath); err != nil {
-		log.Printf("Error renaming sheet file from %s to %s: %v", oldPath, newPath, err)
+	globalAuditLog.Flush(project, oldName)
+	if err := globalStore.RenameSheet(project, oldName, newName); err != nil {
+		log.Printf("Error renaming sheet %s to %s in project %s: %v", oldName, newName, project, err)
 		sheet.mu.Unlock()
 		return false
 	}
+	globalAuditLog.RenameSheet(project, oldName, newName)
+	globalUndo.RenameSheet(project, oldName, newName)
+	globalRevisions.RenameSheet(project, oldName, newName)
+	globalNotifications.RenameSheet(project, oldName, newName)
 	sheet.Name = newName
 	sheet.mu.Unlock()
 
@@ -2820,6 +2770,7 @@ func (sm *SheetManager) RenameSheetBy(name, project, newName, user string) bool
 	// Update dependencies (no manager lock required)
 	sm.RenameSheetInDependencies(project, oldName, newName)
 	sm.RenameSheetInOptionsRangeDependencies(project, oldName, newName)
+	sm.renameBranchParent(project, oldName, newName)
 
 	// Persist with new key without holding manager lock
 	sm.saveSheetLocked(sheet)
@@ -2861,7 +2812,7 @@ func (sm *SheetManager) DeleteSheet(id string) bool {
 }
 
 */
-// DeleteSheetBy deletes a sheet with id and project from memory and disk.
+// DeleteSheetBy deletes a sheet with id and project from memory and the store.
 func (sm *SheetManager) DeleteSheetBy(name, project string) bool {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
@@ -2883,15 +2834,13 @@ func (sm *SheetManager) DeleteSheetBy(name, project string) bool {
 
 	delete(sm.sheets, sheetKey(project, name))
 
-	// Remove the sheet file
-	var filePath string
-	if sheet.ProjectName != "" {
-		filePath = filepath.Join(dataDir, sheet.ProjectName, name+".json")
-	} else {
-		filePath = getSheetFilePath(name)
-	}
-	if err := os.Remove(filePath); err != nil {
-		log.Printf("Error deleting sheet file %s: %v", filePath, err)
+	// Remove the stored sheet and its audit log
+	globalAuditLog.Drop(project, name)
+	globalUndo.Drop(project, name)
+	globalRevisions.Drop(project, name)
+	globalNotifications.Drop(project, name)
+	if err := globalStore.DeleteSheet(project, name); err != nil {
+		log.Printf("Error deleting sheet %s from project %s: %v", name, project, err)
 	}
 
 	return true
@@ -2913,11 +2862,35 @@ func (sm *SheetManager) DeleteSheetsByProject(projectName string) {
 	}
 }
 
+// SaveSheet writes the sheet's new audit records, logs the whole sheet in
+// the write-ahead log and schedules a debounced write of the sheet file.
+// Operations that know which cells they changed use SaveCells instead.
 func (sm *SheetManager) SaveSheet(sheet *Sheet) {
-	// Schedule a debounced save instead of writing immediately
 	if sheet == nil {
 		return
 	}
+	sheet.mu.RLock()
+	project, name := sheet.ProjectName, sheet.Name
+	sheet.mu.RUnlock()
+	globalAuditLog.Flush(project, name)
+	globalWAL.LogSheet(sm, sheet)
+}
+
+// SaveCells is SaveSheet for an operation that changed only the given cells
+// and possibly the sheet settings; only those are logged.
+func (sm *SheetManager) SaveCells(sheet *Sheet, cells ...cellRef) {
+	if sheet == nil {
+		return
+	}
+	sheet.mu.RLock()
+	project, name := sheet.ProjectName, sheet.Name
+	sheet.mu.RUnlock()
+	globalAuditLog.Flush(project, name)
+	globalWAL.LogCells(sm, sheet, cells)
+}
+
+// markPending schedules a debounced save of the sheet file.
+func (sm *SheetManager) markPending(sheet *Sheet) {
 	// Build key from sheet fields safely
 	sheet.mu.RLock()
 	proj := sheet.ProjectName
@@ -2937,126 +2910,120 @@ func (sm *SheetManager) SaveSheet(sheet *Sheet) {
 }
 
 func (sm *SheetManager) Save() {
+	globalAuditLog.FlushAll()
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
-	// Save all sheets
+	// Save all sheets. Read-only sheets are left as found on disk so the
+	// repair flow sees the flagged file, not a re-signed copy of it.
 	for _, sheet := range sm.sheets {
+		if sheet.ReadOnly {
+			continue
+		}
 		sm.saveSheetLocked(sheet)
 	}
 }
 
-func (sm *SheetManager) Load() {
+// Reload drops every in-memory sheet, pending save and queued recalculation
+// and loads the sheets from disk again. Callers flush with Save first if
+// unsaved changes matter.
+func (sm *SheetManager) Reload() {
+	globalWAL.Reset()
 	sm.mu.Lock()
-	//defer sm.mu.Unlock()
-
-	// Check if DATA directory exists
-	if _, err := os.Stat(dataDir); os.IsNotExist(err) {
-		log.Println("DATA directory does not exist, starting fresh")
-		return
+	sm.sheets = make(map[string]*Sheet)
+	sm.pending = make(map[string]*pendingSave)
+	sm.mu.Unlock()
+	sm.CellsModifiedManuallyQueueMu.Lock()
+	sm.CellsModifiedManuallyQueue = nil
+	sm.CellsModifiedManuallyQueueMu.Unlock()
+	sm.CellsModifiedByScriptQueueMu.Lock()
+	sm.CellsModifiedByScriptQueue = nil
+	sm.CellsModifiedByScriptQueueMu.Unlock()
+	sm.Load()
+}
+
+// ReloadSheets replaces the in-memory sheets covers selects with their
+// stored copies, after a project or sheet restore. Other sheets keep their
+// pending saves, queued recalculation and write-ahead log records. The
+// reloaded sheets are rebased past the log and written back, so edits
+// logged for the sheets they replace are never replayed onto them.
+func (sm *SheetManager) ReloadSheets(covers func(project, name string) bool) {
+	stored, err := globalStore.LoadSheets()
+	if err != nil {
+		log.Printf("Error loading sheets: %v", err)
 	}
+	coveredCell := func(c CellIdentifier) bool { return covers(c.ProjectName, c.sheetName) }
 
-	loadedCount := 0
-
-	// Load sheets from root (backward compatibility)
-	/*
-		rootFiles, err := filepath.Glob(filepath.Join(dataDir, "*.json"))
-		if err == nil {
-			for _, filePath := range rootFiles {
-				base := filepath.Base(filePath)
-				// Skip non-sheet files like chat.json, projects.json, users.json
-				if base == "chat.json" || base == "projects.json" || base == "users.json" || base == "project_audit.log" {
-					continue
-				}
-				file, err := os.Open(filePath)
-				if err != nil {
-					log.Printf("Error opening sheet file %s: %v", filePath, err)
-					continue
-				}
-				var sheet Sheet
-				if err := json.NewDecoder(file).Decode(&sheet); err != nil {
-					log.Printf("Error decoding sheet file %s: %v", filePath, err)
-					file.Close()
-					continue
-				}
-				file.Close()
-				sm.sheets[sheetKey(sheet.ProjectName, sheet.ID)] = &sheet
-				loadedCount++
-			}
+	var dropped, loaded []*Sheet
+	sm.mu.Lock()
+	for key, s := range sm.sheets {
+		s.mu.RLock()
+		hit := covers(s.ProjectName, s.Name)
+		s.mu.RUnlock()
+		if hit {
+			delete(sm.sheets, key)
+			delete(sm.pending, key)
+			dropped = append(dropped, s)
 		}
-	*/
-	// Load sheets from project subdirectories (recursive)
-	entries, err := os.ReadDir(dataDir)
-	if err != nil {
-		log.Printf("Error reading DATA directory: %v", err)
-	} else {
-		for _, entry := range entries {
-			if !entry.IsDir() {
-				continue
-			}
-			topProject := entry.Name()
-			baseDir := filepath.Join(dataDir, topProject)
-			// Walk recursively and read any *.json sheet file
-			filepath.WalkDir(baseDir, func(path string, d os.DirEntry, err error) error {
-				if err != nil {
-					return nil
-				}
-				if d.IsDir() {
-					return nil
-				}
-				if filepath.Ext(path) != ".json" {
-					return nil
-				}
-				// Skip non-sheet meta files
-				base := filepath.Base(path)
-				if base == "chat.json" || base == "projects.json" || base == "users.json" || base == "project_audit.log" || base == "timeline.json" {
-					return nil
-				}
+	}
+	for _, s := range stored {
+		if covers(s.ProjectName, s.Name) {
+			sm.sheets[sheetKey(s.ProjectName, s.Name)] = s
+			loaded = append(loaded, s)
+		}
+	}
+	sm.mu.Unlock()
+	sm.CellsModifiedManuallyQueueMu.Lock()
+	sm.CellsModifiedManuallyQueue = slices.DeleteFunc(sm.CellsModifiedManuallyQueue, coveredCell)
+	sm.CellsModifiedManuallyQueueMu.Unlock()
+	sm.CellsModifiedByScriptQueueMu.Lock()
+	sm.CellsModifiedByScriptQueue = slices.DeleteFunc(sm.CellsModifiedByScriptQueue, coveredCell)
+	sm.CellsModifiedByScriptQueueMu.Unlock()
+	log.Printf("Reloaded %d restored sheets from the store", len(loaded))
+
+	for _, s := range dropped {
+		globalWAL.Forget(s)
+	}
+	for _, s := range loaded {
+		globalWAL.Rebase(s)
+		if s.ReadOnly {
+			continue
+		}
+		importLegacyAudit(s)
+		sm.mu.RLock()
+		sm.saveSheetLocked(s)
+		sm.mu.RUnlock()
+	}
 
-				absPath, _ := filepath.Abs(path)
-				data, readErr := os.ReadFile(path)
-				if readErr != nil {
-					log.Printf("Error reading sheet file %s: %v", path, readErr)
-					return nil
-				}
+	sm.rebuildScriptDependencies()
+	sm.rebuildOptionsRangeDependencies()
+}
 
-				// Verify integrity before decoding
-				intact := CheckAndRecord(absPath, data)
+func (sm *SheetManager) Load() {
+	sheets, err := globalStore.LoadSheets()
+	if err != nil {
+		log.Printf("Error loading sheets: %v", err)
+	}
 
-				var sheet Sheet
-				if err := json.Unmarshal(data, &sheet); err != nil {
-					log.Printf("Error decoding sheet file %s: %v", path, err)
-					// Record as corrupt and unreachable
-					globalIntegrity.Record(absPath, false, false, "json decode error: "+err.Error())
-					return nil
-				}
+	sm.mu.Lock()
+	loadedCount := 0
+	for _, sheet := range sheets {
+		sm.sheets[sheetKey(sheet.ProjectName, sheet.Name)] = sheet
+		loadedCount++
+	}
+	sm.mu.Unlock()
+	log.Printf("Loaded %d sheets from the store", loadedCount)
 
-				// If checksum check failed (mismatch OR missing), mark sheet as read-only
-				if !intact {
-					sheet.ReadOnly = true
-					log.Printf("integrity: sheet %s marked read-only (checksum failed or missing)", path)
-				}
+	// Re-apply edits that were logged but not yet written to the store
+	globalWAL.Recover(sm)
 
-				//  infer relative project path from DATA dir
-				//if sheet.ProjectName == "" {
-				rel, relErr := filepath.Rel(dataDir, filepath.Dir(path))
-				if relErr == nil {
-					sheet.ProjectName = rel
-				} else {
-					sheet.ProjectName = topProject
-				}
-				//}
-				//  use file name without extension
-				//if sheet.Name == "" {
-				sheet.Name = strings.TrimSuffix(d.Name(), filepath.Ext(d.Name()))
-				//}
-				sm.sheets[sheetKey(sheet.ProjectName, sheet.Name)] = &sheet
-				loadedCount++
-				return nil
-			})
+	// Move the audit entries of sheet files written before audit logs were
+	// stored separately, then rewrite those files without them. Flagged
+	// sheets are left to the repair flow.
+	for _, sheet := range sheets {
+		if !sheet.ReadOnly && importLegacyAudit(sheet) {
+			sm.markPending(sheet)
 		}
 	}
-	sm.mu.Unlock()
-	log.Printf("Loaded %d sheets from disk", loadedCount)
 
 	// Rebuild script dependency map from loaded sheets
 	sm.rebuildScriptDependencies()
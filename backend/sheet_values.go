@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ────────────────────────────────────────────────
+// JSON read API
+// ────────────────────────────────────────────────
+//
+// GET /api/sheet/values returns the cells of a range with their computed
+// value and typed metadata, for dashboards that need more than the flattened
+// CSV export. Large ranges are paged by row.
+
+const (
+	defaultValuesPageRows = 100
+	maxValuesPageRows     = 1000
+)
+
+var cellTypeNames = map[int]string{
+	ValueCell:             "value",
+	ScriptCell:            "script",
+	ComboBoxCell:          "combo_box",
+	MultipleSelectionCell: "multiple_selection",
+	AIGeneratedCell:       "ai_generated",
+	FormulaCell:           "formula",
+}
+
+// CellValue is one cell as returned by the read API.
+type CellValue struct {
+	Cell            string   `json:"cell"`
+	Row             int      `json:"row"`
+	Column          string   `json:"column"`
+	Name            string   `json:"name,omitempty"`
+	Value           string   `json:"value"`
+	Type            string   `json:"type"`
+	ScriptOutput    string   `json:"script_output,omitempty"`
+	Options         []string `json:"options,omitempty"`
+	OptionsSelected []int    `json:"options_selected,omitempty"`
+	Locked          bool     `json:"locked,omitempty"`
+	User            string   `json:"user,omitempty"`
+}
+
+// SheetValues is one page of a range read. NextOffset is set when more rows
+// of the range remain.
+type SheetValues struct {
+	Project    string      `json:"project"`
+	Sheet      string      `json:"sheet"`
+	Range      string      `json:"range"`
+	Offset     int         `json:"offset"`
+	Limit      int         `json:"limit"`
+	TotalRows  int         `json:"total_rows"`
+	NextOffset *int        `json:"next_offset,omitempty"`
+	Cells      []CellValue `json:"cells"`
+}
+
+// resolveValuesRange turns "A1:D20", "B4" or a cell name into bounds. An empty
+// range covers every populated cell of the sheet.
+func (s *Sheet) resolveValuesRange(rangeStr string) (c1, r1, c2, r2 int, err error) {
+	rangeStr = strings.TrimSpace(rangeStr)
+	if rangeStr == "" {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		for rowKey, cols := range s.Data {
+			row := atoiSafe(rowKey)
+			for colKey := range cols {
+				col := colLabelToIndex(colKey)
+				if row <= 0 || col <= 0 {
+					continue
+				}
+				if r1 == 0 || row < r1 {
+					r1 = row
+				}
+				if row > r2 {
+					r2 = row
+				}
+				if c1 == 0 || col < c1 {
+					c1 = col
+				}
+				if col > c2 {
+					c2 = col
+				}
+			}
+		}
+		return c1, r1, c2, r2, nil
+	}
+
+	parts := strings.SplitN(strings.ToUpper(rangeStr), ":", 2)
+	for _, p := range parts {
+		if !cellLabelPattern.MatchString(p) {
+			if len(parts) == 1 {
+				if row, col, found := s.FindCellByName(rangeStr); found {
+					c, r := colLabelToIndex(col), atoiSafe(row)
+					return c, r, c, r, nil
+				}
+				return 0, 0, 0, 0, fmt.Errorf("unknown cell or range %q", rangeStr)
+			}
+			return 0, 0, 0, 0, fmt.Errorf("invalid range %q", rangeStr)
+		}
+	}
+	c1, r1, c2, r2 = rangeBounds(strings.Join(parts, ":"))
+	return c1, r1, c2, r2, nil
+}
+
+// ReadValues returns the populated cells of rangeStr, skipping offset rows of
+// the range and returning at most limit rows.
+func (s *Sheet) ReadValues(rangeStr string, offset, limit int) (*SheetValues, error) {
+	c1, r1, c2, r2, err := s.resolveValuesRange(rangeStr)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 {
+		limit = defaultValuesPageRows
+	}
+	if limit > maxValuesPageRows {
+		limit = maxValuesPageRows
+	}
+
+	result := &SheetValues{
+		Project: s.ProjectName,
+		Sheet:   s.Name,
+		Offset:  offset,
+		Limit:   limit,
+		Cells:   make([]CellValue, 0),
+	}
+	if r1 == 0 {
+		return result, nil
+	}
+	result.Range = indexToColLabel(c1) + itoa(r1) + ":" + indexToColLabel(c2) + itoa(r2)
+	result.TotalRows = r2 - r1 + 1
+
+	first := r1 + offset
+	last := first + limit - 1
+	if last > r2 {
+		last = r2
+	}
+	if last < r2 {
+		next := offset + limit
+		result.NextOffset = &next
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for row := first; row <= last; row++ {
+		cols := s.Data[itoa(row)]
+		if len(cols) == 0 {
+			continue
+		}
+		keys := make([]string, 0, len(cols))
+		for colKey := range cols {
+			if idx := colLabelToIndex(colKey); idx >= c1 && idx <= c2 {
+				keys = append(keys, colKey)
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool { return colLabelToIndex(keys[i]) < colLabelToIndex(keys[j]) })
+		for _, colKey := range keys {
+			cell := cols[colKey]
+			typeName, ok := cellTypeNames[cell.CellType]
+			if !ok {
+				typeName = "value"
+			}
+			result.Cells = append(result.Cells, CellValue{
+				Cell:            colKey + itoa(row),
+				Row:             row,
+				Column:          colKey,
+				Name:            cell.CellName,
+				Value:           cell.Value,
+				Type:            typeName,
+				ScriptOutput:    cell.ScriptOutput,
+				Options:         cell.Options,
+				OptionsSelected: cell.OptionsSelected,
+				Locked:          cell.Locked,
+				User:            cell.User,
+			})
+		}
+	}
+	return result, nil
+}
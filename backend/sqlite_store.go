@@ -0,0 +1,666 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteStoreFile is the database file under DATA used by -store sqlite.
+const sqliteStoreFile = "store.db"
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS sheets (
+	project TEXT NOT NULL,
+	name    TEXT NOT NULL,
+	meta    TEXT NOT NULL,
+	wal_seq INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (project, name)
+);
+CREATE TABLE IF NOT EXISTS cells (
+	project TEXT NOT NULL,
+	name    TEXT NOT NULL,
+	row     TEXT NOT NULL,
+	col     TEXT NOT NULL,
+	cell    TEXT NOT NULL,
+	PRIMARY KEY (project, name, row, col)
+);
+CREATE TABLE IF NOT EXISTS audit_log (
+	project TEXT NOT NULL,
+	name    TEXT NOT NULL,
+	seq     INTEGER NOT NULL,
+	record  TEXT NOT NULL,
+	PRIMARY KEY (project, name, seq)
+);
+CREATE TABLE IF NOT EXISTS sheet_history (
+	project TEXT NOT NULL,
+	name    TEXT NOT NULL,
+	at      INTEGER NOT NULL,
+	data    BLOB NOT NULL,
+	PRIMARY KEY (project, name, at)
+);
+CREATE TABLE IF NOT EXISTS sheet_versions (
+	project TEXT NOT NULL,
+	name    TEXT NOT NULL,
+	id      TEXT NOT NULL,
+	data    BLOB NOT NULL,
+	PRIMARY KEY (project, name, id)
+);
+CREATE TABLE IF NOT EXISTS documents (
+	name TEXT PRIMARY KEY,
+	data BLOB NOT NULL
+);
+`
+
+// SQLiteStore keeps all data in one SQLite database. Each sheet is a row of
+// settings plus one row per cell, one row per record of its audit log, one
+// per history snapshot and one per named version. The store remembers what it last wrote for every
+// sheet and diffs against it, so a save upserts only the changed cells.
+type SQLiteStore struct {
+	mu      sync.Mutex
+	db      *sql.DB
+	path    string
+	corrupt bool                  // PRAGMA quick_check failed at open
+	saved   map[string]*walShadow // sheetKey -> state of the sheet in the database
+}
+
+// sqliteSheetTables hold the rows of a sheet, keyed by project and name.
+var sqliteSheetTables = []string{"sheets", "cells", "audit_log", "sheet_history", "sheet_versions"}
+
+// OpenSQLiteStore opens or creates the database at path and checks it.
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=synchronous(FULL)")
+	if err != nil {
+		return nil, err
+	}
+	// One connection: writes are serialised by st.mu anyway
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	os.Chmod(path, 0600)
+	st := &SQLiteStore{db: db, path: path, saved: make(map[string]*walShadow)}
+
+	var result string
+	if err := db.QueryRow("PRAGMA quick_check").Scan(&result); err != nil {
+		result = err.Error()
+	}
+	absPath, _ := filepath.Abs(path)
+	if result != "ok" {
+		st.corrupt = true
+		globalIntegrity.Record(absPath, false, false, "quick_check: "+result)
+		log.Printf("integrity: %s FAILED quick_check: %s — all sheets are read-only", path, result)
+	} else {
+		globalIntegrity.Record(absPath, true, false, "")
+		if err := st.importLegacyAudit(); err != nil {
+			log.Printf("sqlite store: move audit entries to audit_log: %v", err)
+		}
+	}
+	return st, nil
+}
+
+// importLegacyAudit moves the audit table of databases written before audit
+// logs were stored separately into audit_log, then drops it.
+func (st *SQLiteStore) importLegacyAudit() error {
+	var n int
+	if err := st.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'audit'").Scan(&n); err != nil || n == 0 {
+		return err
+	}
+	rows, err := st.db.Query("SELECT project, name, entry FROM audit ORDER BY project, name, seq")
+	if err != nil {
+		return err
+	}
+	type sheetRef struct{ project, name string }
+	var order []sheetRef
+	entries := make(map[sheetRef][]AuditEntry)
+	for rows.Next() {
+		var ref sheetRef
+		var data string
+		if err := rows.Scan(&ref.project, &ref.name, &data); err != nil {
+			rows.Close()
+			return err
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			log.Printf("sqlite store: decode audit entry of %s/%s: %v", ref.project, ref.name, err)
+			continue
+		}
+		if _, ok := entries[ref]; !ok {
+			order = append(order, ref)
+		}
+		entries[ref] = append(entries[ref], entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, ref := range order {
+		var existing int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM audit_log WHERE project = ? AND name = ?", ref.project, ref.name).Scan(&existing); err != nil {
+			return err
+		}
+		if existing > 0 {
+			continue
+		}
+		if err := insertAuditRecords(tx, ref.project, ref.name, legacyAuditRecords(entries[ref])); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DROP TABLE audit"); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("sqlite store: moved the audit entries of %d sheets to audit_log", len(order))
+	return nil
+}
+
+func (st *SQLiteStore) Close() error {
+	return st.db.Close()
+}
+
+// recordSheet notes the integrity of a loaded sheet under the path its file
+// would have, so project-level checks work as with the json store.
+func (st *SQLiteStore) recordSheet(project, name string) {
+	if st.corrupt {
+		globalIntegrity.Record(sheetAbsPath(project, name), false, false, "database failed quick_check")
+	} else {
+		globalIntegrity.Record(sheetAbsPath(project, name), true, false, "")
+	}
+}
+
+func (st *SQLiteStore) LoadSheets() ([]*Sheet, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.saved = make(map[string]*walShadow)
+
+	byKey := make(map[string]*Sheet)
+	var sheets []*Sheet
+	rows, err := st.db.Query("SELECT project, name, meta, wal_seq FROM sheets")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var project, name, meta string
+		var walSeq int64
+		if err := rows.Scan(&project, &name, &meta, &walSeq); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		s := &Sheet{Name: name, ProjectName: project, Data: make(map[string]map[string]Cell)}
+		var m walMeta
+		if err := json.Unmarshal([]byte(meta), &m); err != nil {
+			log.Printf("sqlite store: decode settings of %s/%s: %v", project, name, err)
+		}
+		s.Owner, s.SheetType, s.Permissions = m.Owner, m.SheetType, m.Permissions
+		s.ColWidths, s.RowHeights, s.RowParents, s.SectionScheme = m.ColWidths, m.RowHeights, m.RowParents, m.SectionScheme
+		s.Versions, s.Branch, s.Protected, s.Comments = m.Versions, m.Branch, m.Protected, m.Comments
+		s.walSeq.Store(walSeq)
+		s.ReadOnly = st.corrupt
+		byKey[sheetKey(project, name)] = s
+		sheets = append(sheets, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = st.db.Query("SELECT project, name, row, col, cell FROM cells")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var project, name, row, col, data string
+		if err := rows.Scan(&project, &name, &row, &col, &data); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		s := byKey[sheetKey(project, name)]
+		if s == nil {
+			continue
+		}
+		var cell Cell
+		if err := json.Unmarshal([]byte(data), &cell); err != nil {
+			log.Printf("sqlite store: decode cell %s%s of %s/%s: %v", col, row, project, name, err)
+			continue
+		}
+		if s.Data[row] == nil {
+			s.Data[row] = make(map[string]Cell)
+		}
+		s.Data[row][col] = cell
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for key, s := range byKey {
+		st.saved[key] = newShadowLocked(s)
+		st.recordSheet(s.ProjectName, s.Name)
+	}
+	return sheets, nil
+}
+
+// SaveSheet writes what changed since the previous save in one transaction,
+// or the whole sheet the first time it is saved.
+func (st *SQLiteStore) SaveSheet(s *Sheet) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	s.mu.RLock()
+	project, name := s.ProjectName, s.Name
+	key := sheetKey(project, name)
+	sh, ok := st.saved[key]
+	var rec *walRecord
+	if ok {
+		rec = sh.diffLocked(s)
+	} else {
+		sh = newShadowLocked(s)
+		rec = fullRecordLocked(s, sh)
+	}
+	walSeq := s.walSeq.Load()
+	s.mu.RUnlock()
+
+	err := st.writeRecord(project, name, rec, sh.meta, walSeq)
+	if err != nil {
+		// The shadow is ahead of the database now; rewrite it all next time
+		delete(st.saved, key)
+		return err
+	}
+	st.saved[key] = sh
+	st.recordSheet(project, name)
+	return nil
+}
+
+// writeRecord applies a diff (nil when only wal_seq may have moved) to the
+// rows of one sheet.
+func (st *SQLiteStore) writeRecord(project, name string, rec *walRecord, meta []byte, walSeq int64) error {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO sheets (project, name, meta, wal_seq) VALUES (?, ?, ?, ?)
+		ON CONFLICT (project, name) DO UPDATE SET meta = excluded.meta, wal_seq = excluded.wal_seq`,
+		project, name, string(meta), walSeq); err != nil {
+		return err
+	}
+	if rec == nil {
+		return tx.Commit()
+	}
+	if rec.Full {
+		if _, err := tx.Exec("DELETE FROM cells WHERE project = ? AND name = ?", project, name); err != nil {
+			return err
+		}
+	}
+	for row, cols := range rec.Cells {
+		for col, cell := range cols {
+			data, err := json.Marshal(cell)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`INSERT INTO cells (project, name, row, col, cell) VALUES (?, ?, ?, ?, ?)
+				ON CONFLICT (project, name, row, col) DO UPDATE SET cell = excluded.cell`,
+				project, name, row, col, string(data)); err != nil {
+				return err
+			}
+		}
+	}
+	for row, cols := range rec.Deleted {
+		for _, col := range cols {
+			if _, err := tx.Exec("DELETE FROM cells WHERE project = ? AND name = ? AND row = ? AND col = ?", project, name, row, col); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (st *SQLiteStore) DeleteSheet(project, name string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.saved, sheetKey(project, name))
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range sqliteSheetTables {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE project = ? AND name = ?", project, name); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (st *SQLiteStore) RenameSheet(project, oldName, newName string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var exists int
+	st.db.QueryRow("SELECT COUNT(*) FROM sheets WHERE project = ? AND name = ?", project, oldName).Scan(&exists)
+	if exists == 0 {
+		return os.ErrNotExist
+	}
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range sqliteSheetTables {
+		if _, err := tx.Exec("UPDATE "+table+" SET name = ? WHERE project = ? AND name = ?", newName, project, oldName); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if sh, ok := st.saved[sheetKey(project, oldName)]; ok {
+		delete(st.saved, sheetKey(project, oldName))
+		st.saved[sheetKey(project, newName)] = sh
+	}
+	return nil
+}
+
+// RenameProject moves the sheets of a project or folder and everything
+// below it, and the documents stored under it such as its timeline.
+func (st *SQLiteStore) RenameProject(oldPath, newPath string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	prefix := oldPath + "/"
+	for _, table := range sqliteSheetTables {
+		if _, err := tx.Exec("UPDATE "+table+" SET project = ? || substr(project, ?) WHERE project = ? OR substr(project, 1, ?) = ?",
+			newPath, len(oldPath)+1, oldPath, len(prefix), prefix); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE documents SET name = ? || substr(name, ?) WHERE substr(name, 1, ?) = ?",
+		newPath+"/", len(prefix)+1, len(prefix), prefix); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for key, sh := range st.saved {
+		project, name, found := strings.Cut(key, "::")
+		if !found {
+			continue
+		}
+		if project == oldPath || strings.HasPrefix(project, prefix) {
+			delete(st.saved, key)
+			st.saved[sheetKey(newPath+project[len(oldPath):], name)] = sh
+		}
+	}
+	return nil
+}
+
+func (st *SQLiteStore) DeleteProject(project string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	prefix := project + "/"
+	for _, table := range sqliteSheetTables {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE project = ? OR substr(project, 1, ?) = ?", project, len(prefix), prefix); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM documents WHERE substr(name, 1, ?) = ?", len(prefix), prefix); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for key := range st.saved {
+		if p, _, found := strings.Cut(key, "::"); found && (p == project || strings.HasPrefix(p, prefix)) {
+			delete(st.saved, key)
+		}
+	}
+	return nil
+}
+
+func (st *SQLiteStore) LoadAudit(project, name string) ([]AuditRecord, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	rows, err := st.db.Query("SELECT record FROM audit_log WHERE project = ? AND name = ? ORDER BY seq", project, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var recs []AuditRecord
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var rec AuditRecord
+		if err := json.Unmarshal([]byte(data), &rec); err != nil {
+			log.Printf("sqlite store: decode audit record of %s/%s: %v", project, name, err)
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	return recs, rows.Err()
+}
+
+func insertAuditRecords(tx *sql.Tx, project, name string, recs []AuditRecord) error {
+	for _, rec := range recs {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO audit_log (project, name, seq, record) VALUES (?, ?, ?, ?)",
+			project, name, rec.Seq, string(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *SQLiteStore) AppendAudit(project, name string, recs []AuditRecord) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := insertAuditRecords(tx, project, name, recs); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (st *SQLiteStore) RewriteAudit(project, name string, recs []AuditRecord) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM audit_log WHERE project = ? AND name = ?", project, name); err != nil {
+		return err
+	}
+	if err := insertAuditRecords(tx, project, name, recs); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (st *SQLiteStore) SaveSnapshot(project, name string, at time.Time, data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	_, err := st.db.Exec("INSERT OR REPLACE INTO sheet_history (project, name, at, data) VALUES (?, ?, ?, ?)",
+		project, name, at.UnixNano(), data)
+	return err
+}
+
+func (st *SQLiteStore) Snapshots(project, name string) ([]time.Time, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	rows, err := st.db.Query("SELECT at FROM sheet_history WHERE project = ? AND name = ? ORDER BY at", project, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var times []time.Time
+	for rows.Next() {
+		var n int64
+		if err := rows.Scan(&n); err != nil {
+			return nil, err
+		}
+		times = append(times, time.Unix(0, n))
+	}
+	return times, rows.Err()
+}
+
+func (st *SQLiteStore) LoadSnapshot(project, name string, at time.Time) ([]byte, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var data []byte
+	err := st.db.QueryRow("SELECT data FROM sheet_history WHERE project = ? AND name = ? AND at = ?", project, name, at.UnixNano()).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, os.ErrNotExist
+	}
+	return data, err
+}
+
+func (st *SQLiteStore) DeleteSnapshot(project, name string, at time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	_, err := st.db.Exec("DELETE FROM sheet_history WHERE project = ? AND name = ? AND at = ?", project, name, at.UnixNano())
+	return err
+}
+
+func (st *SQLiteStore) SaveVersion(project, name, id string, data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	_, err := st.db.Exec("INSERT OR REPLACE INTO sheet_versions (project, name, id, data) VALUES (?, ?, ?, ?)",
+		project, name, id, data)
+	return err
+}
+
+func (st *SQLiteStore) LoadVersion(project, name, id string) ([]byte, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var data []byte
+	err := st.db.QueryRow("SELECT data FROM sheet_versions WHERE project = ? AND name = ? AND id = ?", project, name, id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, os.ErrNotExist
+	}
+	return data, err
+}
+
+func (st *SQLiteStore) DeleteVersion(project, name, id string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	_, err := st.db.Exec("DELETE FROM sheet_versions WHERE project = ? AND name = ? AND id = ?", project, name, id)
+	return err
+}
+
+func (st *SQLiteStore) ReadDocument(name string) ([]byte, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var data []byte
+	err := st.db.QueryRow("SELECT data FROM documents WHERE name = ?", name).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	if checksummedEntry(name) {
+		if st.corrupt {
+			globalIntegrity.Record(documentPath(name), false, false, "database failed quick_check")
+		} else {
+			globalIntegrity.Record(documentPath(name), true, false, "")
+		}
+	}
+	return data, nil
+}
+
+func (st *SQLiteStore) WriteDocument(name string, data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	_, err := st.db.Exec(`INSERT INTO documents (name, data) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET data = excluded.data`, name, data)
+	if err == nil && checksummedEntry(name) && !st.corrupt {
+		globalIntegrity.Record(documentPath(name), true, false, "")
+	}
+	return err
+}
+
+func (st *SQLiteStore) Documents() ([]string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	rows, err := st.db.Query("SELECT name FROM documents ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// WriteSnapshot writes a consistent copy of the database to w, for backups:
+// the live file cannot be copied while it may be written.
+func (st *SQLiteStore) WriteSnapshot(w io.Writer) error {
+	tmp, err := os.CreateTemp(filepath.Dir(st.path), "store-snapshot-*.db")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+	defer os.Remove(tmp.Name())
+
+	st.mu.Lock()
+	_, err = st.db.Exec("VACUUM INTO ?", tmp.Name())
+	st.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,780 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ────────────────────────────────────────────────
+// Storage backends
+// ────────────────────────────────────────────────
+//
+// Every manager persists through globalStore. Sheets are stored as sheets,
+// each with its append-only audit log (audit_log.go), history snapshots
+// (history.go) and named versions (versions.go); everything else (users, projects, project audit, chat,
+// sessions, API tokens, LLM settings, project timelines) is a JSON document
+// addressed by its path under DATA, e.g. "users.json" or
+// "<project>/timeline.json". Project folders, assets and pythonDirectory
+// stay on the file system with either backend.
+//
+//	json    one file per sheet and document under DATA (the original layout),
+//	        plus <sheet>.audit.jsonl beside each sheet and its snapshots and
+//	        versions in .history/<sheet>/
+//	sqlite  DATA/store.db, sheets stored per cell and per audit record so a
+//	        save only writes what changed
+//
+// `shared-spreadsheet migrate -from json -to sqlite` copies all data from one
+// backend to the other.
+
+const (
+	StoreJSON   = "json"
+	StoreSQLite = "sqlite"
+)
+
+// Store is a storage backend.
+type Store interface {
+	// LoadSheets returns every stored sheet with ProjectName, Name and its
+	// wal_seq set. A sheet that fails its integrity check is ReadOnly.
+	LoadSheets() ([]*Sheet, error)
+	// SaveSheet writes the sheet. The caller must not hold s.mu for writing.
+	SaveSheet(s *Sheet) error
+	// DeleteSheet and RenameSheet cover the sheet's audit log and history
+	// snapshots too.
+	DeleteSheet(project, name string) error
+	RenameSheet(project, oldName, newName string) error
+	// LoadAudit returns the records of a sheet's audit log, oldest first.
+	LoadAudit(project, name string) ([]AuditRecord, error)
+	AppendAudit(project, name string, recs []AuditRecord) error
+	// RewriteAudit replaces a sheet's audit log, for compaction.
+	RewriteAudit(project, name string, recs []AuditRecord) error
+	// SaveSnapshot stores a compressed copy of a sheet taken at a time.
+	SaveSnapshot(project, name string, at time.Time, data []byte) error
+	// Snapshots lists the times of a sheet's snapshots, oldest first.
+	Snapshots(project, name string) ([]time.Time, error)
+	LoadSnapshot(project, name string, at time.Time) ([]byte, error)
+	DeleteSnapshot(project, name string, at time.Time) error
+	// SaveVersion stores the compressed content of a named version of a
+	// sheet (versions.go). Unlike snapshots, versions are never thinned.
+	SaveVersion(project, name, id string, data []byte) error
+	LoadVersion(project, name, id string) ([]byte, error)
+	DeleteVersion(project, name, id string) error
+	// RenameProject moves the sheets and documents of a project or folder.
+	// The caller renames the directory itself.
+	RenameProject(oldPath, newPath string) error
+	// DeleteProject removes the sheets and documents of a project and its
+	// folders. The caller removes the directory itself.
+	DeleteProject(project string) error
+	// ReadDocument returns an error satisfying errors.Is(err, os.ErrNotExist)
+	// for a document that was never written.
+	ReadDocument(name string) ([]byte, error)
+	WriteDocument(name string, data []byte) error
+	// Documents lists the names of all stored documents.
+	Documents() ([]string, error)
+	Close() error
+}
+
+var globalStore = &storeSwitch{st: &JSONStore{}}
+
+// privateDocuments hold credentials and are only readable by the server.
+var privateDocuments = map[string]bool{
+	"sessions.json":   true,
+	"api_tokens.json": true,
+}
+
+// documentPath is the file a document is, or would be, stored in with the
+// json backend. It also keys the document in the integrity registry.
+func documentPath(name string) string {
+	p, _ := filepath.Abs(filepath.Join(dataDir, filepath.FromSlash(name)))
+	return p
+}
+
+// timelineDocument names the timeline document of a project.
+func timelineDocument(project string) string {
+	return path.Join(project, "timeline.json")
+}
+
+// openStore opens the backend of the given kind.
+func openStore(kind string) (Store, error) {
+	switch kind {
+	case StoreJSON, "":
+		return &JSONStore{}, nil
+	case StoreSQLite:
+		return OpenSQLiteStore(filepath.Join(dataDir, sqliteStoreFile))
+	}
+	return nil, fmt.Errorf("unknown store %q (want json or sqlite)", kind)
+}
+
+// ── Switching backends ───────────────────────────
+
+// storeSwitch is globalStore: it passes every call on to the backend in use,
+// which a full restore may replace (backup.go). Calls hold a read lock, so
+// none runs on a backend while it is being closed.
+type storeSwitch struct {
+	mu sync.RWMutex
+	st Store
+}
+
+// Backend returns the backend in use, e.g. to check its kind.
+func (s *storeSwitch) Backend() Store {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.st
+}
+
+// Set switches to st at startup.
+func (s *storeSwitch) Set(st Store) {
+	s.mu.Lock()
+	s.st = st
+	s.mu.Unlock()
+}
+
+// Use calls fn with the backend in use, which stays open until fn returns.
+func (s *storeSwitch) Use(fn func(Store) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return fn(s.st)
+}
+
+// Replace calls fn with the backend in use while no other call runs and
+// switches to the backend fn returns, if any, even when it fails.
+func (s *storeSwitch) Replace(fn func(Store) (Store, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, err := fn(s.st)
+	if st != nil {
+		s.st = st
+	}
+	return err
+}
+
+func (s *storeSwitch) LoadSheets() ([]*Sheet, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.st.LoadSheets()
+}
+
+func (s *storeSwitch) SaveSheet(sheet *Sheet) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.st.SaveSheet(sheet)
+}
+
+func (s *storeSwitch) DeleteSheet(project, name string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.st.DeleteSheet(project, name)
+}
+
+func (s *storeSwitch) RenameSheet(project, oldName, newName string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.st.RenameSheet(project, oldName, newName)
+}
+
+func (s *storeSwitch) LoadAudit(project, name string) ([]AuditRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.st.LoadAudit(project, name)
+}
+
+func (s *storeSwitch) AppendAudit(project, name string, recs []AuditRecord) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.st.AppendAudit(project, name, recs)
+}
+
+func (s *storeSwitch) RewriteAudit(project, name string, recs []AuditRecord) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.st.RewriteAudit(project, name, recs)
+}
+
+func (s *storeSwitch) SaveSnapshot(project, name string, at time.Time, data []byte) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.st.SaveSnapshot(project, name, at, data)
+}
+
+func (s *storeSwitch) Snapshots(project, name string) ([]time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.st.Snapshots(project, name)
+}
+
+func (s *storeSwitch) LoadSnapshot(project, name string, at time.Time) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.st.LoadSnapshot(project, name, at)
+}
+
+func (s *storeSwitch) DeleteSnapshot(project, name string, at time.Time) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.st.DeleteSnapshot(project, name, at)
+}
+
+func (s *storeSwitch) SaveVersion(project, name, id string, data []byte) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.st.SaveVersion(project, name, id, data)
+}
+
+func (s *storeSwitch) LoadVersion(project, name, id string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.st.LoadVersion(project, name, id)
+}
+
+func (s *storeSwitch) DeleteVersion(project, name, id string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.st.DeleteVersion(project, name, id)
+}
+
+func (s *storeSwitch) RenameProject(oldPath, newPath string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.st.RenameProject(oldPath, newPath)
+}
+
+func (s *storeSwitch) DeleteProject(project string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.st.DeleteProject(project)
+}
+
+func (s *storeSwitch) ReadDocument(name string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.st.ReadDocument(name)
+}
+
+func (s *storeSwitch) WriteDocument(name string, data []byte) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.st.WriteDocument(name, data)
+}
+
+func (s *storeSwitch) Documents() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.st.Documents()
+}
+
+func (s *storeSwitch) Close() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.st.Close()
+}
+
+// ── JSON files ───────────────────────────────────
+
+// JSONStore keeps every sheet and document in its own file under DATA.
+// Sheets and the common documents are written with a .shasum companion.
+type JSONStore struct{}
+
+func (JSONStore) Close() error { return nil }
+
+// isSheetFile reports whether a .json file found under a project directory
+// is a sheet rather than a document.
+func isSheetFile(base string) bool {
+	switch base {
+	case "chat.json", "projects.json", "users.json", "project_audit.log", "timeline.json":
+		return false
+	}
+	return true
+}
+
+func (JSONStore) LoadSheets() ([]*Sheet, error) {
+	if _, err := os.Stat(dataDir); os.IsNotExist(err) {
+		log.Println("DATA directory does not exist, starting fresh")
+		return nil, nil
+	}
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	var sheets []*Sheet
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		topProject := entry.Name()
+		baseDir := filepath.Join(dataDir, topProject)
+		// Walk recursively and read any *.json sheet file
+		filepath.WalkDir(baseDir, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() || filepath.Ext(path) != ".json" || !isSheetFile(filepath.Base(path)) {
+				return nil
+			}
+
+			absPath, _ := filepath.Abs(path)
+			data, readErr := os.ReadFile(path)
+			if readErr != nil {
+				log.Printf("Error reading sheet file %s: %v", path, readErr)
+				return nil
+			}
+
+			// Verify integrity before decoding
+			intact := CheckAndRecord(absPath, data)
+
+			//  infer relative project path from DATA dir
+			project := topProject
+			if rel, relErr := filepath.Rel(dataDir, filepath.Dir(path)); relErr == nil {
+				project = filepath.ToSlash(rel)
+			}
+			sheet, err := decodeSheetFile(data, project, strings.TrimSuffix(d.Name(), filepath.Ext(d.Name())))
+			if err != nil {
+				log.Printf("Error decoding sheet file %s: %v", path, err)
+				// Record as corrupt and unreachable
+				globalIntegrity.Record(absPath, false, false, "json decode error: "+err.Error())
+				return nil
+			}
+
+			// If checksum check failed (mismatch OR missing), mark sheet as read-only
+			if !intact {
+				sheet.ReadOnly = true
+				log.Printf("integrity: sheet %s marked read-only (checksum failed or missing)", path)
+			}
+			sheets = append(sheets, sheet)
+			return nil
+		})
+	}
+	return sheets, nil
+}
+
+func (JSONStore) SaveSheet(s *Sheet) error {
+	if err := ensureDataDir(); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	project, name := s.ProjectName, s.Name
+	s.mu.RUnlock()
+	absPath := sheetAbsPath(project, name)
+	if err := os.MkdirAll(filepath.Dir(absPath), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Append newline to match previous encoder behaviour
+	data = append(data, '\n')
+	if err := WriteFileWithChecksum(absPath, data); err != nil {
+		return err
+	}
+	// Mark as intact in the registry after a successful save
+	globalIntegrity.Record(absPath, true, false, "")
+	return nil
+}
+
+func (JSONStore) DeleteSheet(project, name string) error {
+	absPath := sheetAbsPath(project, name)
+	os.Remove(shasumPath(absPath))
+	os.Remove(auditLogPath(project, name))
+	os.RemoveAll(snapshotDir(project, name))
+	return os.Remove(absPath)
+}
+
+func (JSONStore) RenameSheet(project, oldName, newName string) error {
+	oldPath, newPath := sheetAbsPath(project, oldName), sheetAbsPath(project, newName)
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	os.Rename(shasumPath(oldPath), shasumPath(newPath))
+	os.Rename(auditLogPath(project, oldName), auditLogPath(project, newName))
+	os.Rename(snapshotDir(project, oldName), snapshotDir(project, newName))
+	return nil
+}
+
+// auditLogSuffix replaces .json in a sheet's file name for its audit log.
+const auditLogSuffix = ".audit.jsonl"
+
+// auditLogPath is the JSON-lines file holding a sheet's audit log.
+func auditLogPath(project, name string) string {
+	return strings.TrimSuffix(sheetAbsPath(project, name), ".json") + auditLogSuffix
+}
+
+// LoadAudit reads the log line by line. A torn last line, left by a crash
+// during an append, is cut off so later appends start on a fresh line.
+func (JSONStore) LoadAudit(project, name string) ([]AuditRecord, error) {
+	p := auditLogPath(project, name)
+	data, err := os.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var recs []AuditRecord
+	valid := 0
+	for valid < len(data) {
+		end := bytes.IndexByte(data[valid:], '\n')
+		if end < 0 {
+			break
+		}
+		var rec AuditRecord
+		if err := json.Unmarshal(data[valid:valid+end], &rec); err != nil {
+			break
+		}
+		recs = append(recs, rec)
+		valid += end + 1
+	}
+	if valid < len(data) {
+		log.Printf("audit: dropping unreadable tail of %s at offset %d", p, valid)
+		if err := os.Truncate(p, int64(valid)); err != nil {
+			return recs, err
+		}
+	}
+	return recs, nil
+}
+
+func encodeAuditRecords(recs []AuditRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (JSONStore) AppendAudit(project, name string, recs []AuditRecord) error {
+	data, err := encodeAuditRecords(recs)
+	if err != nil {
+		return err
+	}
+	p := auditLogPath(project, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	end, _ := f.Seek(0, io.SeekEnd)
+	if _, err := f.Write(data); err != nil {
+		// Drop a partial line so later records stay readable
+		f.Truncate(end)
+		return err
+	}
+	return f.Sync()
+}
+
+func (JSONStore) RewriteAudit(project, name string, recs []AuditRecord) error {
+	data, err := encodeAuditRecords(recs)
+	if err != nil {
+		return err
+	}
+	p := auditLogPath(project, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(p, data, 0644)
+}
+
+// historyDirName is the directory in each folder that holds the history
+// snapshots of its sheets, one directory per sheet.
+const historyDirName = ".history"
+
+// snapshotDir holds a sheet's snapshots as <unix nanoseconds>.json.gz.
+func snapshotDir(project, name string) string {
+	return filepath.Join(filepath.Dir(sheetAbsPath(project, name)), historyDirName, name)
+}
+
+func snapshotPath(project, name string, at time.Time) string {
+	return filepath.Join(snapshotDir(project, name), strconv.FormatInt(at.UnixNano(), 10)+".json.gz")
+}
+
+func (JSONStore) SaveSnapshot(project, name string, at time.Time, data []byte) error {
+	if err := os.MkdirAll(snapshotDir(project, name), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(snapshotPath(project, name, at), data, 0644)
+}
+
+func (JSONStore) Snapshots(project, name string) ([]time.Time, error) {
+	entries, err := os.ReadDir(snapshotDir(project, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var times []time.Time
+	for _, e := range entries {
+		n, err := strconv.ParseInt(strings.TrimSuffix(e.Name(), ".json.gz"), 10, 64)
+		if err != nil || e.IsDir() {
+			continue
+		}
+		times = append(times, time.Unix(0, n))
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return times, nil
+}
+
+func (JSONStore) LoadSnapshot(project, name string, at time.Time) ([]byte, error) {
+	return os.ReadFile(snapshotPath(project, name, at))
+}
+
+func (JSONStore) DeleteSnapshot(project, name string, at time.Time) error {
+	return os.Remove(snapshotPath(project, name, at))
+}
+
+// versionPath is <snapshotDir>/versions/<id>.json.gz.
+func versionPath(project, name, id string) string {
+	return filepath.Join(snapshotDir(project, name), "versions", id+".json.gz")
+}
+
+func (JSONStore) SaveVersion(project, name, id string, data []byte) error {
+	p := versionPath(project, name, id)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(p, data, 0644)
+}
+
+func (JSONStore) LoadVersion(project, name, id string) ([]byte, error) {
+	return os.ReadFile(versionPath(project, name, id))
+}
+
+func (JSONStore) DeleteVersion(project, name, id string) error {
+	return os.Remove(versionPath(project, name, id))
+}
+
+// RenameProject has nothing to do: the sheet files and timeline move with
+// the directory.
+func (JSONStore) RenameProject(oldPath, newPath string) error { return nil }
+
+// DeleteProject has nothing to do either: the files go with the directory.
+func (JSONStore) DeleteProject(project string) error { return nil }
+
+func (JSONStore) ReadDocument(name string) ([]byte, error) {
+	absPath := documentPath(name)
+	data, err := os.ReadFile(absPath)
+	if err != nil {
+		return nil, err
+	}
+	if checksummedEntry(name) {
+		CheckAndRecord(absPath, data)
+	}
+	return data, nil
+}
+
+func (JSONStore) WriteDocument(name string, data []byte) error {
+	absPath := documentPath(name)
+	if err := os.MkdirAll(filepath.Dir(absPath), 0755); err != nil {
+		return err
+	}
+	if !checksummedEntry(name) {
+		perm := os.FileMode(0644)
+		if privateDocuments[name] {
+			perm = 0600
+		}
+		return writeFileAtomic(absPath, data, perm)
+	}
+	if err := WriteFileWithChecksum(absPath, data); err != nil {
+		return err
+	}
+	globalIntegrity.Record(absPath, true, false, "")
+	return nil
+}
+
+// Documents lists the JSON files at the top of DATA and the project
+// timelines.
+func (JSONStore) Documents() ([]string, error) {
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			if filepath.Ext(e.Name()) == ".json" {
+				names = append(names, e.Name())
+			}
+			continue
+		}
+		if e.Name() == "pythonDirectory" {
+			continue
+		}
+		filepath.WalkDir(filepath.Join(dataDir, e.Name()), func(p string, d os.DirEntry, err error) error {
+			if err == nil && !d.IsDir() && d.Name() == "timeline.json" {
+				if rel, relErr := filepath.Rel(dataDir, p); relErr == nil {
+					names = append(names, filepath.ToSlash(rel))
+				}
+			}
+			return nil
+		})
+	}
+	return names, nil
+}
+
+// ── Migration ────────────────────────────────────
+
+// migrateStore copies every document and sheet, with its audit log,
+// history and versions, from src to dst and deletes sheets dst has that src does not,
+// e.g. left over from an earlier migration. Edits still only in the
+// write-ahead log are applied to the copied sheets.
+func migrateStore(src, dst Store) (documents, sheets int, err error) {
+	loaded, err := src.LoadSheets()
+	if err != nil {
+		return 0, 0, err
+	}
+	byKey := make(map[string]*Sheet, len(loaded))
+	for _, s := range loaded {
+		byKey[sheetKey(s.ProjectName, s.Name)] = s
+	}
+	globalWAL.mu.Lock()
+	globalWAL.replayLocked(byKey)
+	globalWAL.mu.Unlock()
+	// A flagged sheet would load writable from the new store; have it
+	// repaired first
+	var flagged []string
+	for _, s := range loaded {
+		if s.ReadOnly {
+			flagged = append(flagged, sheetArchivePath(s.ProjectName, s.Name))
+		}
+	}
+	if len(flagged) > 0 {
+		return 0, 0, fmt.Errorf("sheets failed their integrity check, repair them first: %s", strings.Join(flagged, ", "))
+	}
+
+	names, err := src.Documents()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, name := range names {
+		data, err := src.ReadDocument(name)
+		if err != nil {
+			return documents, sheets, fmt.Errorf("read %s: %w", name, err)
+		}
+		if err := dst.WriteDocument(name, data); err != nil {
+			return documents, sheets, fmt.Errorf("write %s: %w", name, err)
+		}
+		documents++
+	}
+	for _, s := range loaded {
+		if err := copySheet(src, dst, s); err != nil {
+			return documents, sheets, err
+		}
+		sheets++
+	}
+	stale, err := dst.LoadSheets()
+	if err != nil {
+		return documents, sheets, err
+	}
+	for _, s := range stale {
+		if byKey[sheetKey(s.ProjectName, s.Name)] != nil {
+			continue
+		}
+		if err := dst.DeleteSheet(s.ProjectName, s.Name); err != nil {
+			return documents, sheets, fmt.Errorf("delete stale sheet %s/%s: %w", s.ProjectName, s.Name, err)
+		}
+		log.Printf("migrate: deleted %s/%s, which is not in the source store", s.ProjectName, s.Name)
+	}
+	return documents, sheets, nil
+}
+
+// copySheet writes s, loaded from src, to dst with its audit log, history
+// and versions.
+func copySheet(src, dst Store, s *Sheet) error {
+	if err := dst.SaveSheet(s); err != nil {
+		return fmt.Errorf("write sheet %s/%s: %w", s.ProjectName, s.Name, err)
+	}
+	recs, err := src.LoadAudit(s.ProjectName, s.Name)
+	if err != nil {
+		return fmt.Errorf("read audit log of %s/%s: %w", s.ProjectName, s.Name, err)
+	}
+	if len(recs) == 0 && len(s.legacyAudit) > 0 {
+		recs = legacyAuditRecords(s.legacyAudit)
+	}
+	if err := dst.RewriteAudit(s.ProjectName, s.Name, recs); err != nil {
+		return fmt.Errorf("write audit log of %s/%s: %w", s.ProjectName, s.Name, err)
+	}
+	if err := copySnapshots(src, dst, s.ProjectName, s.Name); err != nil {
+		return fmt.Errorf("copy history of %s/%s: %w", s.ProjectName, s.Name, err)
+	}
+	for _, id := range sheetVersionIDs(s) {
+		data, err := src.LoadVersion(s.ProjectName, s.Name, id)
+		if err == nil {
+			err = dst.SaveVersion(s.ProjectName, s.Name, id, data)
+		}
+		if err != nil {
+			return fmt.Errorf("copy version %s of %s/%s: %w", id, s.ProjectName, s.Name, err)
+		}
+	}
+	return nil
+}
+
+// copySnapshots makes dst hold the same history snapshots of a sheet as src.
+func copySnapshots(src, dst Store, project, name string) error {
+	old, err := dst.Snapshots(project, name)
+	if err != nil {
+		return err
+	}
+	for _, at := range old {
+		if err := dst.DeleteSnapshot(project, name, at); err != nil {
+			return err
+		}
+	}
+	times, err := src.Snapshots(project, name)
+	if err != nil {
+		return err
+	}
+	for _, at := range times {
+		data, err := src.LoadSnapshot(project, name, at)
+		if err != nil {
+			return err
+		}
+		if err := dst.SaveSnapshot(project, name, at, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runMigrate implements `shared-spreadsheet migrate -from <store> -to <store>`.
+// The server must not be running.
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := fs.String("from", StoreJSON, "store to copy from (json or sqlite)")
+	to := fs.String("to", StoreSQLite, "store to copy to (json or sqlite)")
+	fs.Parse(args)
+	if *from == *to {
+		return errors.New("-from and -to must differ")
+	}
+	src, err := openStore(*from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := openStore(*to)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	documents, sheets, err := migrateStore(src, dst)
+	if err != nil {
+		return err
+	}
+	log.Printf("migrate: copied %d documents and %d sheets from %s to %s", documents, sheets, *from, *to)
+	return nil
+}
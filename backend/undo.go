@@ -0,0 +1,1270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server-side undo and redo. Each edit a user makes over the websocket, or
+// in a batch over HTTP, is recorded on that user's stack for the sheet; UNDO applies its inverse and
+// REDO applies it again. Recorded edits follow later row and column inserts,
+// deletes and moves of the sheet, whoever makes them. Stacks are kept in
+// memory only.
+
+// maxUndoOps is how many edits a user can undo per sheet.
+const maxUndoOps = 100
+
+var (
+	// undoCellTypes are the hub messages that edit one cell.
+	undoCellTypes = map[string]bool{
+		"UPDATE_CELL": true, "UPDATE_CELL_STYLE": true, "UPDATE_CELL_TYPE": true, "UPDATE_CELL_OPTIONS": true,
+		"UPDATE_CELL_SCRIPT": true, "UPDATE_AI_PROMPT": true, "UPDATE_CELL_NAME": true, "LOCK_CELL": true, "UNLOCK_CELL": true,
+	}
+	// undoLayoutTypes are the hub messages that change the sheet layout.
+	undoLayoutTypes = map[string]bool{
+		"RESIZE_COL": true, "RESIZE_ROW": true, "SET_ROW_PARENT": true, "UPDATE_SECTION_SCHEME": true,
+	}
+	// undoShiftTypes are the hub messages that insert, delete or move rows and columns.
+	undoShiftTypes = map[string]bool{
+		"INSERT_ROW": true, "INSERT_ROW_ABOVE": true, "INSERT_CHILD_ROW": true, "DELETE_ROW": true, "MOVE_ROW": true,
+		"MOVE_ROW_AS_CHILD": true, "INSERT_COL": true, "DELETE_COL": true, "MOVE_COL": true,
+	}
+	// undoOwnerTypes may only be undone by the sheet owner, like the edits themselves.
+	undoOwnerTypes = map[string]bool{"UPDATE_CELL_TYPE": true, "UPDATE_CELL_SCRIPT": true, "UPDATE_AI_PROMPT": true}
+)
+
+// undoBlock is the content of a block of rows or columns, by offset from
+// its first one.
+type undoBlock struct {
+	Cells   []map[string]Cell // per row its cells by column, per column its cells by row
+	Sizes   []int             // row heights or column widths, 0 for the default
+	Parents []int             // rows: offset+1 of the parent row inside the block, 0 for none
+	Top     int               // rows: parent of the first row, outside the block
+}
+
+// undoOp is one recorded edit. Coordinates are kept current as the sheet
+// changes.
+type undoOp struct {
+	Type  string // hub message type of the edit
+	Group string // edits of one paste or autofill share a group and undo together
+	Time  time.Time
+
+	applied bool // on the undo stack rather than the redo stack
+	gone    bool // a later edit removed what this one touched
+
+	// Cell edits and layout changes
+	Row, Col      int
+	Before, After Cell
+	// Layout changes: size, parent row or section scheme
+	BeforeInt, AfterInt int
+	BeforeStr, AfterStr string
+
+	// Row and column inserts, deletes and moves
+	Shift                     AuditShift
+	Block                     *undoBlock // inserted or deleted content
+	ParentBefore, ParentAfter int        // moves: parent of the block's first row
+
+	// Where the sheet's other recorded edits were before this structural op
+	// last ran, to put them back when it is reversed with no shift between.
+	seq   int
+	saved map[*undoOp]undoPos
+}
+
+// undoPos is the part of an undoOp that shifts change.
+type undoPos struct {
+	Row, Col                  int
+	BeforeInt, AfterInt       int
+	Shift                     AuditShift
+	ParentBefore, ParentAfter int
+	Top                       int
+	gone                      bool
+}
+
+func (op *undoOp) pos() undoPos {
+	p := undoPos{Row: op.Row, Col: op.Col, BeforeInt: op.BeforeInt, AfterInt: op.AfterInt, Shift: op.Shift,
+		ParentBefore: op.ParentBefore, ParentAfter: op.ParentAfter, gone: op.gone}
+	if op.Block != nil {
+		p.Top = op.Block.Top
+	}
+	return p
+}
+
+func (op *undoOp) setPos(p undoPos) {
+	op.Row, op.Col, op.BeforeInt, op.AfterInt, op.Shift = p.Row, p.Col, p.BeforeInt, p.AfterInt, p.Shift
+	op.ParentBefore, op.ParentAfter, op.gone = p.ParentBefore, p.ParentAfter, p.gone
+	if op.Block != nil {
+		op.Block.Top = p.Top
+	}
+}
+
+// UndoConflict is why an UNDO or REDO was refused.
+type UndoConflict struct {
+	Reason  string   `json:"reason"` // "changed", "locked", "protected", "owner-only", "name-taken" or "gone"
+	Label   string   `json:"label"`
+	Cells   []string `json:"cells,omitempty"`
+	Dropped bool     `json:"dropped"` // the edit can no longer be undone and was removed
+}
+
+// UndoState is what a user can undo and redo on a sheet.
+type UndoState struct {
+	CanUndo bool   `json:"can_undo"`
+	CanRedo bool   `json:"can_redo"`
+	Undo    string `json:"undo,omitempty"`
+	Redo    string `json:"redo,omitempty"`
+}
+
+type undoStacks struct {
+	undo, redo []*undoOp
+}
+
+type sheetUndo struct {
+	project, name string
+	users         map[string]*undoStacks
+	seq           int // shifts seen
+}
+
+// undoRecording is the state an edit starts from, captured by the hub before
+// it runs the edit.
+type undoRecording struct {
+	sheet               *Sheet
+	project, name, user string
+	typ, group          string
+	row, col            int
+	before              Cell
+	beforeInt           int
+	beforeStr           string
+	state               *historyState // structural edits
+	saved               map[*undoOp]undoPos
+	shifts              []AuditShift
+}
+
+// UndoManager holds the undo and redo stacks of every user and sheet.
+type UndoManager struct {
+	mu        sync.Mutex
+	sheets    map[string]*sheetUndo
+	recording *undoRecording
+}
+
+var globalUndo = &UndoManager{sheets: make(map[string]*sheetUndo)}
+
+func cellLabel(row, col int) string {
+	return indexToColLabel(col) + itoa(row)
+}
+
+// shiftIndex maps v through sh. Reports false when sh deletes it.
+func shiftIndex(sh *AuditShift, v int) (int, bool) {
+	count := sh.Count
+	if count < 1 {
+		count = 1
+	}
+	if sh.Op == "delete" && v >= sh.At && v < sh.At+count {
+		return v, false
+	}
+	return sh.apply(v), true
+}
+
+// undoCellView keeps the fields of c that an edit of type typ sets.
+func undoCellView(typ string, c Cell) Cell {
+	var v Cell
+	switch typ {
+	case "UPDATE_CELL":
+		v.Value = formulaText(c)
+		if c.CellType == FormulaCell {
+			v.CellType = FormulaCell
+		}
+	case "UPDATE_CELL_STYLE":
+		v.Background, v.Bold, v.Italic = c.Background, c.Bold, c.Italic
+	case "UPDATE_CELL_TYPE":
+		v.CellType, v.Options, v.OptionsRange = c.CellType, c.Options, c.OptionsRange
+	case "UPDATE_CELL_OPTIONS":
+		v.Value, v.OptionsSelected = c.Value, c.OptionsSelected
+	case "UPDATE_CELL_SCRIPT":
+		v.Script, v.ShowScriptAsOutput = c.Script, c.ShowScriptAsOutput
+		v.ScriptOutput_RowSpan, v.ScriptOutput_ColSpan = c.ScriptOutput_RowSpan, c.ScriptOutput_ColSpan
+	case "UPDATE_AI_PROMPT":
+		v.AIPrompt = c.AIPrompt
+	case "UPDATE_CELL_NAME":
+		v.CellName = c.CellName
+	case "LOCK_CELL", "UNLOCK_CELL":
+		v.Locked = c.Locked
+	}
+	if len(v.Options) == 0 {
+		v.Options = nil
+	}
+	if len(v.OptionsSelected) == 0 {
+		v.OptionsSelected = nil
+	}
+	return v
+}
+
+// newUndoBlock copies count rows or columns of st from at.
+func newUndoBlock(st *historyState, axis string, at, count int) *undoBlock {
+	b := &undoBlock{Cells: make([]map[string]Cell, count), Sizes: make([]int, count), Parents: make([]int, count)}
+	for i := 0; i < count; i++ {
+		cells := make(map[string]Cell)
+		if axis == "col" {
+			col := indexToColLabel(at + i)
+			for row, cols := range st.Data {
+				if c, ok := cols[col]; ok {
+					cells[row] = c
+				}
+			}
+			b.Sizes[i] = st.ColWidths[col]
+		} else {
+			row := itoa(at + i)
+			for col, c := range st.Data[row] {
+				cells[col] = c
+			}
+			b.Sizes[i] = st.RowHeights[row]
+			if p := st.RowParents[row]; p >= at && p < at+count {
+				b.Parents[i] = p - at + 1
+			} else if i == 0 {
+				b.Top = p
+			}
+		}
+		b.Cells[i] = cells
+	}
+	return b
+}
+
+// changedCells lists the cells whose content differs between b and o, for
+// blocks starting at at. Cells without content count as missing.
+func (b *undoBlock) changedCells(o *undoBlock, axis string, at int) []string {
+	var diff []string
+	content := func(cells map[string]Cell, k string) Cell {
+		return historyContent(cells[k])
+	}
+	for i := range b.Cells {
+		keys := make(map[string]bool)
+		for k := range b.Cells[i] {
+			keys[k] = true
+		}
+		if i < len(o.Cells) {
+			for k := range o.Cells[i] {
+				keys[k] = true
+			}
+		}
+		for k := range keys {
+			var oc Cell
+			if i < len(o.Cells) {
+				oc = content(o.Cells[i], k)
+			}
+			if !reflect.DeepEqual(content(b.Cells[i], k), oc) {
+				if axis == "col" {
+					diff = append(diff, indexToColLabel(at+i)+k)
+				} else {
+					diff = append(diff, k+itoa(at+i))
+				}
+			}
+		}
+	}
+	return diff
+}
+
+// followCross moves the cells of b along a shift of the other axis.
+func (b *undoBlock) followCross(sh *AuditShift) {
+	index, label := colLabelToIndex, indexToColLabel
+	if sh.Axis == "row" {
+		index, label = atoiSafe, itoa
+	}
+	for i, cells := range b.Cells {
+		moved := make(map[string]Cell, len(cells))
+		for k, c := range cells {
+			if v, ok := shiftIndex(sh, index(k)); ok {
+				moved[label(v)] = c
+			}
+		}
+		b.Cells[i] = moved
+	}
+}
+
+// exists reports whether the rows or columns of a structural op are in the
+// sheet now: inserted ones while applied, deleted ones while undone, and
+// moved ones always.
+func (op *undoOp) exists() bool {
+	switch op.Shift.Op {
+	case "insert":
+		return op.applied
+	case "delete":
+		return !op.applied
+	}
+	return true
+}
+
+func (op *undoOp) count() int {
+	if op.Shift.Count < 1 {
+		return 1
+	}
+	return op.Shift.Count
+}
+
+// span is the range of rows or columns a structural op occupies now. Where
+// its rows do not exist, the range is empty and starts where they would go
+// back in.
+func (op *undoOp) span() (lo, hi int) {
+	n := op.count()
+	if op.Shift.Op == "move" {
+		lo, hi = op.Shift.At, op.Shift.To
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		return lo, hi + n - 1
+	}
+	if op.exists() {
+		return op.Shift.At, op.Shift.At + n - 1
+	}
+	return op.Shift.At, op.Shift.At - 1
+}
+
+// followParent maps a parent row through sh; a deleted parent becomes none.
+func followParent(sh *AuditShift, p int) int {
+	if p <= 0 {
+		return p
+	}
+	if v, ok := shiftIndex(sh, p); ok {
+		return v
+	}
+	return 0
+}
+
+// follow updates op for a later row or column shift of the sheet.
+func (op *undoOp) follow(sh *AuditShift) {
+	if op.gone {
+		return
+	}
+	var ok bool
+	switch {
+	case undoCellTypes[op.Type]:
+		if sh.Axis == "row" {
+			op.Row, ok = shiftIndex(sh, op.Row)
+		} else {
+			op.Col, ok = shiftIndex(sh, op.Col)
+		}
+		op.gone = !ok
+	case op.Type == "RESIZE_COL":
+		if sh.Axis == "col" {
+			op.Col, ok = shiftIndex(sh, op.Col)
+			op.gone = !ok
+		}
+	case op.Type == "RESIZE_ROW" || op.Type == "SET_ROW_PARENT":
+		if sh.Axis != "row" {
+			return
+		}
+		op.Row, ok = shiftIndex(sh, op.Row)
+		op.gone = !ok
+		if op.Type == "SET_ROW_PARENT" {
+			op.BeforeInt, op.AfterInt = followParent(sh, op.BeforeInt), followParent(sh, op.AfterInt)
+		}
+	case undoShiftTypes[op.Type]:
+		if sh.Axis != op.Shift.Axis {
+			if op.Block != nil {
+				op.Block.followCross(sh)
+			}
+			return
+		}
+		op.followSpan(sh)
+	}
+}
+
+// followSpan moves a structural op along a shift of the same axis. Shifts
+// wholly before its span move it, shifts wholly after leave it; a shift
+// cutting into it makes it impossible to undo.
+func (op *undoOp) followSpan(sh *AuditShift) {
+	lo, hi := op.span()
+	c := sh.Count
+	if c < 1 {
+		c = 1
+	}
+	delta := 0
+	switch sh.Op {
+	case "insert":
+		switch {
+		case sh.At <= lo:
+			delta = c
+		case sh.At > hi:
+		default:
+			op.gone = true
+			return
+		}
+	case "delete":
+		end := sh.At + c - 1
+		switch {
+		case end < lo:
+			delta = -c
+		case sh.At > hi:
+		case hi < lo && sh.At < lo:
+			// The place the rows go back in was deleted around
+			delta = sh.At - lo
+		default:
+			op.gone = true
+			return
+		}
+	case "move":
+		mlo, mhi := sh.At, sh.To
+		if mlo > mhi {
+			mlo, mhi = mhi, mlo
+		}
+		mhi += c - 1
+		if mhi >= lo && mlo <= hi {
+			op.gone = true
+			return
+		}
+	}
+	op.Shift.At += delta
+	if op.Shift.Op == "move" {
+		op.Shift.To += delta
+	}
+	if sh.Axis == "row" {
+		op.ParentBefore, op.ParentAfter = followParent(sh, op.ParentBefore), followParent(sh, op.ParentAfter)
+		if op.Block != nil {
+			op.Block.Top = followParent(sh, op.Block.Top)
+		}
+	}
+}
+
+// label names op for the undo and redo buttons.
+func (op *undoOp) label() string {
+	switch op.Type {
+	case "UPDATE_CELL":
+		return "Edit " + cellLabel(op.Row, op.Col)
+	case "UPDATE_CELL_STYLE":
+		return "Style " + cellLabel(op.Row, op.Col)
+	case "UPDATE_CELL_TYPE":
+		return "Cell type " + cellLabel(op.Row, op.Col)
+	case "UPDATE_CELL_OPTIONS":
+		return "Option " + cellLabel(op.Row, op.Col)
+	case "UPDATE_CELL_SCRIPT":
+		return "Script " + cellLabel(op.Row, op.Col)
+	case "UPDATE_AI_PROMPT":
+		return "AI prompt " + cellLabel(op.Row, op.Col)
+	case "UPDATE_CELL_NAME":
+		return "Name " + cellLabel(op.Row, op.Col)
+	case "LOCK_CELL":
+		return "Lock " + cellLabel(op.Row, op.Col)
+	case "UNLOCK_CELL":
+		return "Unlock " + cellLabel(op.Row, op.Col)
+	case "RESIZE_COL":
+		return "Resize column " + indexToColLabel(op.Col)
+	case "RESIZE_ROW":
+		return "Resize row " + itoa(op.Row)
+	case "SET_ROW_PARENT":
+		return "Row parent " + itoa(op.Row)
+	case "UPDATE_SECTION_SCHEME":
+		return "Section scheme"
+	}
+	at := op.Shift.At
+	if op.Shift.Op == "move" && op.applied {
+		at = op.Shift.To
+	}
+	var what string
+	if op.Shift.Axis == "col" {
+		what = "column " + indexToColLabel(at)
+	} else if op.count() > 1 {
+		what = fmt.Sprintf("rows %d-%d", at, at+op.count()-1)
+	} else {
+		what = "row " + itoa(at)
+	}
+	switch op.Shift.Op {
+	case "insert":
+		return "Insert " + what
+	case "delete":
+		return "Delete " + what
+	}
+	return "Move " + what
+}
+
+func groupLabel(ops []*undoOp) string {
+	if len(ops) == 1 {
+		return ops[0].label()
+	}
+	return fmt.Sprintf("%s and %d more", ops[0].label(), len(ops)-1)
+}
+
+// ── Recording ────────────────────────────────────
+
+func (um *UndoManager) sheetLocked(project, name string) *sheetUndo {
+	key := sheetKey(project, name)
+	su := um.sheets[key]
+	if su == nil {
+		su = &sheetUndo{project: project, name: name, users: make(map[string]*undoStacks)}
+		um.sheets[key] = su
+	}
+	return su
+}
+
+func (um *UndoManager) stacksLocked(project, name, user string) *undoStacks {
+	su := um.sheetLocked(project, name)
+	st := su.users[user]
+	if st == nil {
+		st = &undoStacks{}
+		su.users[user] = st
+	}
+	return st
+}
+
+// Begin captures what message is about to change, or returns nil for
+// messages that are not undoable. Commit records the edit once it ran.
+func (um *UndoManager) Begin(message *Message) *undoRecording {
+	um.mu.Lock()
+	um.recording = nil
+	um.mu.Unlock()
+	typ := message.Type
+	if !undoCellTypes[typ] && !undoLayoutTypes[typ] && !undoShiftTypes[typ] {
+		return nil
+	}
+	var p struct {
+		Row   string `json:"row"`
+		Col   string `json:"col"`
+		Group string `json:"undo_group"`
+	}
+	if err := json.Unmarshal(message.Payload, &p); err != nil {
+		return nil
+	}
+	sheet := globalSheetManager.GetSheetBy(message.SheetName, message.Project)
+	if sheet == nil {
+		return nil
+	}
+	rec := &undoRecording{sheet: sheet, user: message.User, typ: typ, group: p.Group,
+		row: atoiSafe(p.Row), col: colLabelToIndex(p.Col)}
+	sheet.mu.RLock()
+	rec.project, rec.name = sheet.ProjectName, sheet.Name
+	switch typ {
+	case "RESIZE_COL":
+		rec.beforeInt = sheet.ColWidths[p.Col]
+	case "RESIZE_ROW":
+		rec.beforeInt = sheet.RowHeights[p.Row]
+	case "SET_ROW_PARENT":
+		rec.beforeInt = sheet.RowParents[p.Row]
+	case "UPDATE_SECTION_SCHEME":
+		rec.beforeStr = sheet.SectionScheme
+	default:
+		if undoShiftTypes[typ] {
+			rec.state = historyStateLocked(sheet)
+		} else {
+			rec.before = sheet.Data[p.Row][p.Col]
+		}
+	}
+	sheet.mu.RUnlock()
+	if undoCellTypes[typ] && (rec.row <= 0 || rec.col <= 0) {
+		return nil
+	}
+	um.mu.Lock()
+	if undoShiftTypes[typ] {
+		rec.saved = um.savePosLocked(rec.project, rec.name)
+	}
+	um.recording = rec
+	um.mu.Unlock()
+	return rec
+}
+
+// BeginCell captures a cell that an edit made outside the hub, by a batch
+// over HTTP, is about to change. Edits sharing group undo together.
+func (um *UndoManager) BeginCell(s *Sheet, user, typ, group, row, col string) *undoRecording {
+	rec := &undoRecording{sheet: s, user: user, typ: typ, group: group, row: atoiSafe(row), col: colLabelToIndex(col)}
+	s.mu.RLock()
+	rec.project, rec.name = s.ProjectName, s.Name
+	rec.before = s.Data[row][col]
+	s.mu.RUnlock()
+	return rec
+}
+
+// Commit records the edit rec captured the start of, if it changed the
+// sheet, and clears the user's redo stack.
+func (um *UndoManager) Commit(rec *undoRecording) bool {
+	if rec == nil {
+		return false
+	}
+	um.mu.Lock()
+	if um.recording == rec {
+		um.recording = nil
+	}
+	shifts := rec.shifts
+	um.mu.Unlock()
+
+	s := rec.sheet
+	op := &undoOp{Type: rec.typ, Group: rec.group, Time: time.Now(), applied: true, Row: rec.row, Col: rec.col}
+	s.mu.RLock()
+	switch {
+	case undoCellTypes[rec.typ]:
+		op.Before, op.After = rec.before, s.Data[itoa(rec.row)][indexToColLabel(rec.col)]
+		if reflect.DeepEqual(undoCellView(rec.typ, op.Before), undoCellView(rec.typ, op.After)) {
+			op = nil
+		}
+	case undoLayoutTypes[rec.typ]:
+		op.BeforeInt, op.BeforeStr = rec.beforeInt, rec.beforeStr
+		switch rec.typ {
+		case "RESIZE_COL":
+			op.AfterInt = s.ColWidths[indexToColLabel(rec.col)]
+		case "RESIZE_ROW":
+			op.AfterInt = s.RowHeights[itoa(rec.row)]
+		case "SET_ROW_PARENT":
+			op.AfterInt = s.RowParents[itoa(rec.row)]
+		case "UPDATE_SECTION_SCHEME":
+			op.AfterStr = s.SectionScheme
+		}
+		if op.BeforeInt == op.AfterInt && op.BeforeStr == op.AfterStr {
+			op = nil
+		}
+	default:
+		if len(shifts) != 1 {
+			op = nil
+			break
+		}
+		op.Shift = shifts[0]
+		n := op.count()
+		switch op.Shift.Op {
+		case "insert":
+			cur := &historyState{Data: s.Data, ColWidths: s.ColWidths, RowHeights: s.RowHeights, RowParents: s.RowParents}
+			op.Block = newUndoBlock(cur, op.Shift.Axis, op.Shift.At, n)
+		case "delete":
+			op.Block = newUndoBlock(rec.state, op.Shift.Axis, op.Shift.At, n)
+		case "move":
+			op.ParentBefore = rec.state.RowParents[itoa(op.Shift.At)]
+			op.ParentAfter = s.RowParents[itoa(op.Shift.To)]
+		}
+	}
+	s.mu.RUnlock()
+	if op == nil {
+		return false
+	}
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if undoShiftTypes[rec.typ] {
+		op.seq, op.saved = um.sheetLocked(rec.project, rec.name).seq, rec.saved
+	}
+	st := um.stacksLocked(rec.project, rec.name, rec.user)
+	st.undo = append(st.undo, op)
+	if len(st.undo) > maxUndoOps {
+		st.undo = st.undo[len(st.undo)-maxUndoOps:]
+	}
+	st.redo = nil
+	return true
+}
+
+// savePosLocked notes where every recorded edit on the sheet is now.
+func (um *UndoManager) savePosLocked(project, name string) map[*undoOp]undoPos {
+	saved := make(map[*undoOp]undoPos)
+	for _, st := range um.sheetLocked(project, name).users {
+		for _, op := range st.undo {
+			saved[op] = op.pos()
+		}
+		for _, op := range st.redo {
+			saved[op] = op.pos()
+		}
+	}
+	return saved
+}
+
+// observeShift follows a row or column shift of a sheet in every recorded
+// edit on it, and notes it for the edit being recorded. Called with the
+// sheet's lock held, from logAuditShift.
+func (um *UndoManager) observeShift(project, name, user string, sh *AuditShift) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if rec := um.recording; rec != nil && rec.project == project && rec.name == name && rec.user == user {
+		rec.shifts = append(rec.shifts, *sh)
+	}
+	su := um.sheetLocked(project, name)
+	su.seq++
+	for _, st := range su.users {
+		for _, op := range st.undo {
+			op.follow(sh)
+		}
+		for _, op := range st.redo {
+			op.follow(sh)
+		}
+	}
+}
+
+// State reports what user can undo and redo on the sheet.
+func (um *UndoManager) State(project, name, user string) UndoState {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	var state UndoState
+	su := um.sheets[sheetKey(project, name)]
+	if su == nil || su.users[user] == nil {
+		return state
+	}
+	st := su.users[user]
+	if ops := topGroup(st.undo); len(ops) > 0 {
+		state.CanUndo, state.Undo = true, groupLabel(ops)
+	}
+	if ops := topGroup(st.redo); len(ops) > 0 {
+		state.CanRedo, state.Redo = true, groupLabel(ops)
+	}
+	return state
+}
+
+// topGroup is the last op of stack and the ops of its group below it,
+// topmost first.
+func topGroup(stack []*undoOp) []*undoOp {
+	if len(stack) == 0 {
+		return nil
+	}
+	top := stack[len(stack)-1]
+	ops := []*undoOp{top}
+	if top.Group == "" {
+		return ops
+	}
+	for i := len(stack) - 2; i >= 0 && stack[i].Group == top.Group; i-- {
+		ops = append(ops, stack[i])
+	}
+	return ops
+}
+
+// RenameSheet moves the stacks of a renamed sheet.
+func (um *UndoManager) RenameSheet(project, oldName, newName string) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if su := um.sheets[sheetKey(project, oldName)]; su != nil {
+		delete(um.sheets, sheetKey(project, oldName))
+		su.name = newName
+		um.sheets[sheetKey(project, newName)] = su
+	}
+}
+
+// RenameProject moves the stacks of the sheets of a renamed project or folder.
+func (um *UndoManager) RenameProject(oldPath, newPath string) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	for key, su := range um.sheets {
+		if su.project == oldPath || strings.HasPrefix(su.project, oldPath+"/") {
+			delete(um.sheets, key)
+			su.project = newPath + su.project[len(oldPath):]
+			um.sheets[sheetKey(su.project, su.name)] = su
+		}
+	}
+}
+
+// Drop forgets the stacks of a deleted sheet.
+func (um *UndoManager) Drop(project, name string) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	delete(um.sheets, sheetKey(project, name))
+}
+
+// DropProject forgets the stacks of the sheets of a deleted project.
+func (um *UndoManager) DropProject(project string) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	for key, su := range um.sheets {
+		if su.project == project || strings.HasPrefix(su.project, project+"/") {
+			delete(um.sheets, key)
+		}
+	}
+}
+
+// ── Undo and redo ────────────────────────────────
+
+// Apply undoes, or with redo set redoes, user's last edit on s together with
+// the rest of its group. Reports whether the sheet changed, and why not when
+// the edit conflicts with what is in the sheet now. With force set, edits
+// other users changed since are overwritten; other conflicts cannot be
+// forced and drop the edit from the stack. The group is checked and its cell
+// and layout edits applied under the sheet's lock, so no other edit lands in
+// between.
+func (um *UndoManager) Apply(s *Sheet, user string, redo, force bool) (bool, *UndoConflict) {
+	s.mu.Lock()
+	locked := true
+	var dones []editDone
+	unlock := func() {
+		if locked {
+			s.mu.Unlock()
+			locked = false
+		}
+		for _, done := range dones {
+			done()
+		}
+		dones = nil
+	}
+	defer unlock()
+	project, name := s.ProjectName, s.Name
+
+	um.mu.Lock()
+	st := um.stacksLocked(project, name, user)
+	from := &st.undo
+	if redo {
+		from = &st.redo
+	}
+	ops := topGroup(*from)
+	um.mu.Unlock()
+	if len(ops) == 0 {
+		return false, nil
+	}
+
+	// ops holds the group newest first: undo takes it back in that order,
+	// redo replays it from the oldest edit
+	order := ops
+	if redo {
+		order = make([]*undoOp, len(ops))
+		for i, op := range ops {
+			order[len(ops)-1-i] = op
+		}
+	}
+	conflict := &UndoConflict{Label: groupLabel(ops)}
+	checked := make(map[string]bool)
+	for _, op := range order {
+		// A later edit of the group to the same cell finds what the earlier
+		// one leaves there
+		if !undoShiftTypes[op.Type] {
+			key := fmt.Sprintf("%s %d %d", op.Type, op.Row, op.Col)
+			if checked[key] {
+				continue
+			}
+			checked[key] = true
+		}
+		reason, cells := op.checkLocked(s, user)
+		if reason == "" {
+			continue
+		}
+		if conflict.Reason == "" || conflict.Reason == "changed" {
+			conflict.Reason = reason
+		}
+		conflict.Cells = append(conflict.Cells, cells...)
+	}
+	pop := func() {
+		um.mu.Lock()
+		if n := len(*from) - len(ops); n >= 0 && len(*from) > 0 && (*from)[len(*from)-1] == ops[0] {
+			*from = (*from)[:n]
+		}
+		um.mu.Unlock()
+	}
+	switch {
+	case conflict.Reason == "changed" && !force:
+		return false, conflict
+	case conflict.Reason != "" && conflict.Reason != "changed":
+		conflict.Dropped = true
+		pop()
+		return false, conflict
+	}
+
+	pop()
+	action := "UNDO"
+	if redo {
+		action = "REDO"
+	}
+	var cellOps []*undoOp
+	for _, op := range order {
+		if !undoShiftTypes[op.Type] {
+			dones = append(dones, op.applyLocked(s, user))
+			cellOps = append(cellOps, op)
+			continue
+		}
+		// Rows and columns are shifted by setters that lock the sheet
+		// themselves
+		unlock()
+		um.mu.Lock()
+		su := um.sheetLocked(project, name)
+		reverses, saved := su.seq == op.seq, um.savePosLocked(project, name)
+		um.mu.Unlock()
+		op.applyShift(s, user, action)
+		um.mu.Lock()
+		if reverses {
+			// Nothing shifted since op ran: the others go back where they were
+			for o, p := range op.saved {
+				o.setPos(p)
+			}
+		}
+		op.seq, op.saved = su.seq, saved
+		um.mu.Unlock()
+		s.mu.Lock()
+		locked = true
+	}
+	if len(cellOps) > 0 {
+		first := cellOps[0]
+		s.logAudit(AuditEntry{
+			Timestamp: time.Now(),
+			User:      user,
+			Action:    action,
+			Row1:      first.Row,
+			Col1:      indexToColLabel(first.Col),
+			NewValue:  groupLabel(cellOps),
+		})
+	}
+
+	um.mu.Lock()
+	st = um.stacksLocked(project, name, user)
+	to := &st.redo
+	if redo {
+		to = &st.undo
+	}
+	// Pushed oldest first, so the newest is on top again
+	for i := len(ops) - 1; i >= 0; i-- {
+		ops[i].applied = redo
+		*to = append(*to, ops[i])
+	}
+	um.mu.Unlock()
+	unlock()
+	if len(cellOps) > 0 {
+		globalAuditLog.Flush(project, name)
+	}
+	return true, nil
+}
+
+// checkLocked reports why op cannot be undone or redone now, with the cells
+// in the way: "changed" when someone else edited what op would overwrite.
+// Caller holds s.mu.
+func (op *undoOp) checkLocked(s *Sheet, user string) (string, []string) {
+	if op.gone {
+		return "gone", nil
+	}
+	expect, target := op.After, op.Before
+	if !op.applied {
+		expect, target = op.Before, op.After
+	}
+	switch {
+	case undoCellTypes[op.Type]:
+		label := cellLabel(op.Row, op.Col)
+		row, col := itoa(op.Row), indexToColLabel(op.Col)
+		cur := s.Data[row][col]
+		if op.Type == "LOCK_CELL" || op.Type == "UNLOCK_CELL" {
+			topProject := strings.SplitN(s.ProjectName, "/", 2)[0]
+			if user != s.Owner && !(topProject != "" && globalProjectMeta.IsProjectAdmin(topProject, user)) {
+				return "owner-only", []string{label}
+			}
+		} else if cur.Locked {
+			return "locked", []string{label}
+		}
+		if s.protectedCellLocked(row, col, user) != nil {
+			return "protected", []string{label}
+		}
+		if undoOwnerTypes[op.Type] && user != s.Owner {
+			return "owner-only", []string{label}
+		}
+		if op.Type == "UPDATE_CELL_NAME" && target.CellName != "" {
+			for r, cols := range s.Data {
+				for c, cell := range cols {
+					if cell.CellName == target.CellName && !(r == row && c == col) {
+						return "name-taken", []string{label}
+					}
+				}
+			}
+		}
+		if !reflect.DeepEqual(undoCellView(op.Type, cur), undoCellView(op.Type, expect)) {
+			return "changed", []string{label}
+		}
+	case undoLayoutTypes[op.Type]:
+		var cur int
+		switch op.Type {
+		case "RESIZE_COL":
+			cur = s.ColWidths[indexToColLabel(op.Col)]
+		case "RESIZE_ROW":
+			cur = s.RowHeights[itoa(op.Row)]
+		case "SET_ROW_PARENT":
+			cur = s.RowParents[itoa(op.Row)]
+		case "UPDATE_SECTION_SCHEME":
+			want := op.AfterStr
+			if !op.applied {
+				want = op.BeforeStr
+			}
+			if s.SectionScheme != want {
+				return "changed", nil
+			}
+			return "", nil
+		}
+		want := op.AfterInt
+		if !op.applied {
+			want = op.BeforeInt
+		}
+		if cur != want {
+			return "changed", nil
+		}
+	default:
+		return op.checkShiftLocked(s, user)
+	}
+	return "", nil
+}
+
+// checkShiftLocked checks a structural op. Rows or columns that go away
+// must hold what op left in them; moved rows must still have their parent.
+// Nor may they be protected from user. Caller holds s.mu.
+func (op *undoOp) checkShiftLocked(s *Sheet, user string) (string, []string) {
+	axis, n := op.Shift.Axis, op.count()
+	lo, hi := op.span()
+	// Removed rows and columns, and moved columns, must not hold locked cells
+	from, to := 0, -1
+	switch {
+	case op.Shift.Op == "move" && axis == "col" && op.applied:
+		from, to = op.Shift.To, op.Shift.To
+	case op.Shift.Op == "move" && axis == "col":
+		from, to = op.Shift.At, op.Shift.At
+	case op.Shift.Op != "move" && op.exists():
+		from, to = lo, hi
+	}
+	var locked []string
+	for r, cols := range s.Data {
+		for c, cell := range cols {
+			v := atoiSafe(r)
+			if axis == "col" {
+				v = colLabelToIndex(c)
+			}
+			if cell.Locked && v >= from && v <= to {
+				locked = append(locked, c+r)
+			}
+		}
+	}
+	if len(locked) > 0 {
+		sort.Slice(locked, func(i, j int) bool { return cellLabelLess(locked[i], locked[j]) })
+		return "locked", locked
+	}
+	if op.Shift.Op == "move" && axis == "row" {
+		from = op.Shift.At
+		if op.applied {
+			from = op.Shift.To
+		}
+		to = from + n - 1
+	}
+	if to >= from {
+		if p := s.protectedLinesLocked(axis, from, to-from+1, user); p != nil {
+			return "protected", []string{p.Range}
+		}
+	}
+	switch {
+	case op.Shift.Op == "move":
+		at, want := op.Shift.To, op.ParentAfter
+		if !op.applied {
+			at, want = op.Shift.At, op.ParentBefore
+		}
+		if axis == "row" && s.RowParents[itoa(at)] != want {
+			return "changed", nil
+		}
+	case op.exists():
+		st := &historyState{Data: s.Data, ColWidths: s.ColWidths, RowHeights: s.RowHeights, RowParents: s.RowParents}
+		cur := newUndoBlock(st, axis, op.Shift.At, n)
+		if cells := cur.changedCells(op.Block, axis, op.Shift.At); len(cells) > 0 {
+			sort.Slice(cells, func(i, j int) bool { return cellLabelLess(cells[i], cells[j]) })
+			return "changed", cells
+		}
+		if cur.Top != op.Block.Top || !reflect.DeepEqual(cur.Sizes, op.Block.Sizes) || !reflect.DeepEqual(cur.Parents, op.Block.Parents) {
+			return "changed", nil
+		}
+		if axis == "row" {
+			for r, p := range s.RowParents {
+				if v := atoiSafe(r); (v < lo || v > hi) && p >= lo && p <= hi {
+					return "changed", nil
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+// applyLocked sets the cell or layout op changed back to what it was
+// before, or when undone to what op made it, through the setter of its
+// message type. Caller holds s.mu.
+func (op *undoOp) applyLocked(s *Sheet, user string) editDone {
+	undo := op.applied
+	t := op.After
+	size, scheme := op.AfterInt, op.AfterStr
+	if undo {
+		t = op.Before
+		size, scheme = op.BeforeInt, op.BeforeStr
+	}
+	row, col := itoa(op.Row), indexToColLabel(op.Col)
+	switch op.Type {
+	case "UPDATE_CELL":
+		return s.setCellLocked(row, col, formulaText(t), user, undo)
+	case "UPDATE_CELL_STYLE":
+		return s.setCellStyleLocked(row, col, t.Background, t.Bold, t.Italic, user)
+	case "UPDATE_CELL_TYPE":
+		_, done := s.setCellTypeLocked(row, col, t.CellType, t.Options, t.OptionsRange, user)
+		return done
+	case "UPDATE_CELL_OPTIONS":
+		value := s.setCellLocked(row, col, t.Value, user, undo)
+		selected := s.setCellOptionSelectedLocked(row, col, t.OptionsSelected)
+		return func() {
+			value()
+			selected()
+		}
+	case "UPDATE_CELL_SCRIPT":
+		return s.setCellScriptLocked(row, col, t.Script, user, undo, t.ScriptOutput_RowSpan, t.ScriptOutput_ColSpan, t.ShowScriptAsOutput)
+	case "UPDATE_AI_PROMPT":
+		return s.setCellAIPromptLocked(row, col, t.AIPrompt, user)
+	case "UPDATE_CELL_NAME":
+		_, done := s.setCellNameLocked(row, col, t.CellName, user)
+		return done
+	case "LOCK_CELL", "UNLOCK_CELL":
+		var done editDone
+		if t.Locked {
+			_, done = s.lockCellLocked(row, col, user)
+		} else {
+			_, done = s.unlockCellLocked(row, col, user)
+		}
+		return done
+	case "RESIZE_COL":
+		return s.setColWidthLocked(col, size, user)
+	case "RESIZE_ROW":
+		return s.setRowHeightLocked(row, size, user)
+	case "SET_ROW_PARENT":
+		return s.setRowParentLocked(row, size, user)
+	case "UPDATE_SECTION_SCHEME":
+		return s.setSectionSchemeLocked(scheme)
+	}
+	return editNothing
+}
+
+// applyShift inserts, deletes or moves back the rows or columns of a
+// structural op, logging the shift as action.
+func (op *undoOp) applyShift(s *Sheet, user, action string) {
+	e := AuditEntry{Timestamp: time.Now(), User: user, Action: action, NewValue: op.label()}
+	axis, n := op.Shift.Axis, op.count()
+	if axis == "col" {
+		e.Col1 = indexToColLabel(op.Shift.At)
+	} else {
+		e.Row1 = op.Shift.At
+	}
+	switch {
+	case op.Shift.Op == "move" && op.applied:
+		s.moveUndoBlock(axis, op.Shift.To, n, op.Shift.At, op.ParentBefore, e)
+	case op.Shift.Op == "move":
+		s.moveUndoBlock(axis, op.Shift.At, n, op.Shift.To, op.ParentAfter, e)
+	case op.exists():
+		s.removeUndoBlock(axis, op.Shift.At, n, op.Block.Top, e)
+	default:
+		s.insertUndoBlock(axis, op.Shift.At, op.Block, e)
+	}
+	globalSheetManager.rebuildScriptDependencies()
+	globalSheetManager.rebuildOptionsRangeDependencies()
+	globalSheetManager.SaveSheet(s)
+}
+
+// shiftLocked moves the rows or columns of s like sh. Caller holds s.mu.
+func (s *Sheet) shiftLocked(sh *AuditShift) {
+	st := &historyState{Data: s.Data, ColWidths: s.ColWidths, RowHeights: s.RowHeights, RowParents: s.RowParents}
+	st.applyShift(sh)
+	s.Data, s.ColWidths, s.RowHeights, s.RowParents = st.Data, st.ColWidths, st.RowHeights, st.RowParents
+}
+
+// removeUndoBlock deletes count rows or columns from at. Rows left outside
+// the block whose parent was in it move under top.
+func (s *Sheet) removeUndoBlock(axis string, at, count, top int, e AuditEntry) {
+	sh := &AuditShift{Axis: axis, Op: "delete", At: at, Count: count}
+	s.mu.Lock()
+	if axis == "row" {
+		end := at + count - 1
+		for r, p := range s.RowParents {
+			if v := atoiSafe(r); (v < at || v > end) && p >= at && p <= end {
+				if top > 0 {
+					s.RowParents[r] = top
+				} else {
+					delete(s.RowParents, r)
+				}
+			}
+		}
+	}
+	s.shiftLocked(sh)
+	s.logAuditShift(e, sh)
+	s.mu.Unlock()
+	if axis == "col" {
+		s.adjustScriptTagsOnDeleteCol(at)
+		s.adjustOptionsRangeOnDeleteCol(at)
+		return
+	}
+	s.adjustScriptTagsOnDeleteRowBlock(at, count)
+	s.adjustOptionsRangeOnDeleteRowBlock(at, count)
+}
+
+// insertUndoBlock inserts the rows or columns of b at at. References in
+// other cells are shifted before b's cells go in, so that theirs are kept.
+func (s *Sheet) insertUndoBlock(axis string, at int, b *undoBlock, e AuditEntry) {
+	count := len(b.Cells)
+	sh := &AuditShift{Axis: axis, Op: "insert", At: at, Count: count}
+	s.mu.Lock()
+	s.shiftLocked(sh)
+	s.logAuditShift(e, sh)
+	s.mu.Unlock()
+	for i := 0; i < count; i++ {
+		if axis == "col" {
+			s.adjustScriptTagsOnInsertCol(at)
+			s.adjustOptionsRangeOnInsertCol(at)
+		} else {
+			s.adjustScriptTagsOnInsertRow(at)
+			s.adjustOptionsRangeOnInsertRow(at)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Data == nil {
+		s.Data = make(map[string]map[string]Cell)
+	}
+	nameTaken := func(name string) bool {
+		for _, cols := range s.Data {
+			for _, cell := range cols {
+				if cell.CellName == name {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for i, cells := range b.Cells {
+		for k, c := range cells {
+			row, col := itoa(at+i), k
+			if axis == "col" {
+				row, col = k, indexToColLabel(at+i)
+			}
+			if c.CellName != "" && nameTaken(c.CellName) {
+				c.CellName = ""
+			}
+			if s.Data[row] == nil {
+				s.Data[row] = make(map[string]Cell)
+			}
+			s.Data[row][col] = c
+			for _, ae := range cellEditAuditEntries(atoiSafe(row), col, Cell{}, c, e.User, true) {
+				s.logAudit(ae)
+			}
+			globalSheetManager.CellsModifiedManuallyQueueMu.Lock()
+			globalSheetManager.CellsModifiedManuallyQueue = append(globalSheetManager.CellsModifiedManuallyQueue, CellIdentifier{
+				ProjectName: s.ProjectName,
+				sheetName:   s.Name,
+				row:         row,
+				col:         col,
+			})
+			globalSheetManager.CellsModifiedManuallyQueueMu.Unlock()
+		}
+		if b.Sizes[i] > 0 {
+			if axis == "col" {
+				s.ColWidths[indexToColLabel(at+i)] = b.Sizes[i]
+			} else {
+				s.RowHeights[itoa(at+i)] = b.Sizes[i]
+			}
+		}
+		if axis == "row" && b.Parents[i] > 0 {
+			s.RowParents[itoa(at+i)] = at + b.Parents[i] - 1
+		}
+	}
+	if axis == "row" && b.Top > 0 {
+		s.RowParents[itoa(at)] = b.Top
+	}
+}
+
+// moveUndoBlock moves count rows or columns from from so that the first one
+// ends up at to. A moved row block's first row gets parent.
+func (s *Sheet) moveUndoBlock(axis string, from, count, to, parent int, e AuditEntry) {
+	sh := &AuditShift{Axis: axis, Op: "move", At: from, Count: count, To: to}
+	s.mu.Lock()
+	s.shiftLocked(sh)
+	if axis == "row" {
+		if parent > 0 {
+			s.RowParents[itoa(to)] = parent
+		} else {
+			delete(s.RowParents, itoa(to))
+		}
+	}
+	s.logAuditShift(e, sh)
+	s.mu.Unlock()
+	if axis == "col" {
+		s.adjustScriptTagsOnMoveCol(from, to)
+		s.adjustOptionsRangeOnMoveCol(from, to)
+		return
+	}
+	s.adjustScriptTagsOnMoveRowBlock(from, count, to)
+	s.adjustOptionsRangeOnMoveRowBlock(from, count, to)
+}
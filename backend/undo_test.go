@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// undoTestSheet registers an empty sheet P/S with the global manager, whose
+// saves go to a scratch data directory.
+func undoTestSheet(t *testing.T) *Sheet {
+	t.Helper()
+	walTestDir(t)
+	s := &Sheet{ProjectName: "P", Name: "S", Owner: "alice", Data: make(map[string]map[string]Cell)}
+	key := sheetKey("P", "S")
+	globalSheetManager.mu.Lock()
+	globalSheetManager.sheets[key] = s
+	globalSheetManager.mu.Unlock()
+	t.Cleanup(func() {
+		globalSheetManager.mu.Lock()
+		delete(globalSheetManager.sheets, key)
+		delete(globalSheetManager.pending, key)
+		globalSheetManager.mu.Unlock()
+		globalWAL.Reset()
+	})
+	return s
+}
+
+// undoTestEdit sets a cell of s as user, recording the edit in um.
+func undoTestEdit(um *UndoManager, s *Sheet, user, row, col, value string) {
+	payload, _ := json.Marshal(map[string]string{"row": row, "col": col, "value": value})
+	rec := um.Begin(&Message{Type: "UPDATE_CELL", Project: s.ProjectName, SheetName: s.Name, User: user, Payload: payload})
+	s.SetCell(row, col, value, user, false)
+	um.Commit(rec)
+}
+
+func TestUndoConflictAfterOtherUserEdit(t *testing.T) {
+	s := undoTestSheet(t)
+	um := &UndoManager{sheets: make(map[string]*sheetUndo)}
+
+	undoTestEdit(um, s, "alice", "1", "A", "mine")
+	undoTestEdit(um, s, "bob", "1", "A", "theirs")
+
+	ok, conflict := um.Apply(s, "alice", false, false)
+	if ok || conflict == nil {
+		t.Fatalf("Apply = %v, %+v; want a conflict", ok, conflict)
+	}
+	if conflict.Reason != "changed" || !reflect.DeepEqual(conflict.Cells, []string{"A1"}) || conflict.Dropped {
+		t.Errorf("conflict = %+v, want changed on A1, kept", conflict)
+	}
+	if got := s.Data["1"]["A"].Value; got != "theirs" {
+		t.Errorf("A1 = %q after refused undo, want the other user's value", got)
+	}
+	if st := um.State("P", "S", "alice"); !st.CanUndo || st.CanRedo {
+		t.Errorf("state = %+v, want the edit still on the undo stack", st)
+	}
+
+	// Forcing overwrites the other user's edit and moves it to redo.
+	if ok, conflict := um.Apply(s, "alice", false, true); !ok || conflict != nil {
+		t.Fatalf("forced Apply = %v, %+v; want applied", ok, conflict)
+	}
+	if got := s.Data["1"]["A"].Value; got != "" {
+		t.Errorf("A1 = %q after forced undo, want empty", got)
+	}
+	if st := um.State("P", "S", "alice"); st.CanUndo || !st.CanRedo {
+		t.Errorf("state = %+v, want the edit on the redo stack", st)
+	}
+}
+
+func TestUndoNoConflictOnOtherCell(t *testing.T) {
+	s := undoTestSheet(t)
+	um := &UndoManager{sheets: make(map[string]*sheetUndo)}
+
+	undoTestEdit(um, s, "alice", "1", "A", "mine")
+	undoTestEdit(um, s, "bob", "1", "B", "theirs")
+
+	if ok, conflict := um.Apply(s, "alice", false, false); !ok || conflict != nil {
+		t.Fatalf("Apply = %v, %+v; want applied", ok, conflict)
+	}
+	if got := s.Data["1"]["A"].Value; got != "" {
+		t.Errorf("A1 = %q after undo, want empty", got)
+	}
+	if got := s.Data["1"]["B"].Value; got != "theirs" {
+		t.Errorf("B1 = %q after undo, want the other user's value", got)
+	}
+}
+
+func TestUndoCellEditBatch(t *testing.T) {
+	s := undoTestSheet(t)
+	t.Cleanup(func() { globalUndo.Drop("P", "S") })
+	s.Data["1"] = map[string]Cell{"A": {Value: "old"}}
+
+	x, y, z, bold := "x", "y", "z", true
+	results, err := s.ApplyCellEdits([]CellEdit{
+		{Cell: "A1", Value: &x},
+		{Cell: "B1", Value: &y},
+		{Cell: "A1", Value: &z, Style: &CellEditStyle{Bold: &bold}},
+	}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Status != "applied" {
+			t.Fatalf("result %+v, want applied", r)
+		}
+	}
+
+	// One undo takes the whole batch back.
+	if ok, conflict := globalUndo.Apply(s, "alice", false, false); !ok || conflict != nil {
+		t.Fatalf("Apply = %v, %+v; want applied", ok, conflict)
+	}
+	if a1 := s.Data["1"]["A"]; a1.Value != "old" || a1.Bold {
+		t.Errorf("A1 = %+v after undo, want the value and style before the batch", a1)
+	}
+	if got := s.Data["1"]["B"].Value; got != "" {
+		t.Errorf("B1 = %q after undo, want empty", got)
+	}
+	if st := globalUndo.State("P", "S", "alice"); st.CanUndo || !st.CanRedo {
+		t.Errorf("state = %+v, want the batch on the redo stack", st)
+	}
+
+	if ok, conflict := globalUndo.Apply(s, "alice", true, false); !ok || conflict != nil {
+		t.Fatalf("redo Apply = %v, %+v; want applied", ok, conflict)
+	}
+	if a1 := s.Data["1"]["A"]; a1.Value != "z" || !a1.Bold {
+		t.Errorf("A1 = %+v after redo, want z in bold", a1)
+	}
+}
+
+func TestUndoRedoGroupOrder(t *testing.T) {
+	s := undoTestSheet(t)
+	um := &UndoManager{sheets: make(map[string]*sheetUndo)}
+
+	for _, v := range []string{"x", "y", "z"} {
+		rec := um.BeginCell(s, "alice", "UPDATE_CELL", "g1", "1", "A")
+		s.SetCell("1", "A", v, "alice", false)
+		um.Commit(rec)
+	}
+
+	if ok, conflict := um.Apply(s, "alice", false, false); !ok || conflict != nil {
+		t.Fatalf("Apply = %v, %+v; want applied", ok, conflict)
+	}
+	if got := s.Data["1"]["A"].Value; got != "" {
+		t.Errorf("A1 = %q after undo, want empty", got)
+	}
+
+	// Redo replays the group from its first edit, ending on the last value.
+	if ok, conflict := um.Apply(s, "alice", true, false); !ok || conflict != nil {
+		t.Fatalf("redo Apply = %v, %+v; want applied", ok, conflict)
+	}
+	if got := s.Data["1"]["A"].Value; got != "z" {
+		t.Errorf("A1 = %q after redo, want z", got)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"errors"
 	"log"
 	"os"
-	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -15,9 +14,7 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-var userPersistenceFile = filepath.Join(dataDir, "users.json")
-
-const sessionTimeout = 1 * time.Hour
+const usersDocument = "users.json"
 
 type User struct {
 	Username         string      `json:"username"`
@@ -27,27 +24,28 @@ type User struct {
 	CanCreateProject bool        `json:"can_create_project,omitempty"`
 }
 
-type Session struct {
-	Token     string
-	Username  string
-	ExpiresAt time.Time
-}
-
 // Preferences holds user-level settings common across sheets/projects
 type Preferences struct {
-	VisibleRows int `json:"visible_rows,omitempty"`
-	VisibleCols int `json:"visible_cols,omitempty"`
+	VisibleRows   int               `json:"visible_rows,omitempty"`
+	VisibleCols   int               `json:"visible_cols,omitempty"`
+	Notifications NotificationPrefs `json:"notifications"`
 }
 
 type UserManager struct {
 	users    map[string]*User
-	sessions map[string]*Session // token -> Session
+	sessions map[string]*Session // token hash -> Session
 	mu       sync.RWMutex
+
+	// seen holds token uses not yet copied into Session.LastSeen, so
+	// ValidateToken only needs the read lock.
+	seen   map[string]time.Time // token hash -> last use
+	seenMu sync.Mutex
 }
 
 var globalUserManager = &UserManager{
 	users:    make(map[string]*User),
 	sessions: make(map[string]*Session),
+	seen:     make(map[string]time.Time),
 }
 
 func (um *UserManager) Register(username, password string) error {
@@ -59,6 +57,10 @@ func (um *UserManager) Register(username, password string) error {
 	if strings.EqualFold(trimmed, "system") || strings.EqualFold(trimmed, "admin") {
 		return errors.New("reserved username")
 	}
+	// "@name" refers to a group in permission lists
+	if strings.HasPrefix(trimmed, groupPrefix) {
+		return errors.New("usernames may not start with " + groupPrefix)
+	}
 
 	if _, exists := um.users[username]; exists {
 		return errors.New("user already exists")
@@ -81,40 +83,23 @@ func (um *UserManager) Register(username, password string) error {
 	return nil
 }
 
-func (um *UserManager) Login(username, password string) (string, error) {
+// Login checks the credentials and starts a session. remember extends the
+// refresh token lifetime from hours to weeks.
+func (um *UserManager) Login(username, password string, remember bool, userAgent, remoteAddr string) (SessionTokens, error) {
 	um.mu.RLock()
 	user, exists := um.users[username]
 	um.mu.RUnlock()
 
 	if !exists {
-		return "", errors.New("invalid credentials")
+		return SessionTokens{}, errors.New("invalid credentials")
 	}
 
 	err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
 	if err != nil {
-		return "", errors.New("invalid credentials")
-	}
-
-	// Generate session token
-	token, err := generateToken()
-	if err != nil {
-		return "", errors.New("failed to generate session token")
-	}
-
-	session := &Session{
-		Token:     token,
-		Username:  username,
-		ExpiresAt: time.Now().Add(sessionTimeout),
+		return SessionTokens{}, errors.New("invalid credentials")
 	}
 
-	um.mu.Lock()
-	um.sessions[token] = session
-	um.mu.Unlock()
-
-	// Start cleanup goroutine for expired sessions
-	go um.cleanupExpiredSessions()
-
-	return token, nil
+	return um.startSession(username, remember, userAgent, remoteAddr)
 }
 
 // generateToken creates a secure random token
@@ -126,46 +111,6 @@ func generateToken() (string, error) {
 	return base64.URLEncoding.EncodeToString(b), nil
 }
 
-// ValidateToken checks if a token is valid and not expired
-func (um *UserManager) ValidateToken(token string) (string, error) {
-	um.mu.RLock()
-	session, exists := um.sessions[token]
-	um.mu.RUnlock()
-
-	if !exists {
-		return "", errors.New("invalid token")
-	}
-
-	if time.Now().After(session.ExpiresAt) {
-		um.mu.Lock()
-		delete(um.sessions, token)
-		um.mu.Unlock()
-		return "", errors.New("session expired")
-	}
-
-	return session.Username, nil
-}
-
-// Logout removes a session token
-func (um *UserManager) Logout(token string) {
-	um.mu.Lock()
-	defer um.mu.Unlock()
-	delete(um.sessions, token)
-}
-
-// cleanupExpiredSessions removes expired sessions periodically
-func (um *UserManager) cleanupExpiredSessions() {
-	um.mu.Lock()
-	defer um.mu.Unlock()
-
-	now := time.Now()
-	for token, session := range um.sessions {
-		if now.After(session.ExpiresAt) {
-			delete(um.sessions, token)
-		}
-	}
-}
-
 // Exists returns true if a user with the given username exists
 func (um *UserManager) Exists(username string) bool {
 	um.mu.RLock()
@@ -259,24 +204,21 @@ func (um *UserManager) Load() {
 	um.mu.Lock()
 	defer um.mu.Unlock()
 
-	absPath, _ := filepath.Abs(userPersistenceFile)
-	data, err := os.ReadFile(userPersistenceFile)
+	data, err := globalStore.ReadDocument(usersDocument)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, os.ErrNotExist) {
 			um.ensureAdminLocked()
+			um.loadSessionsLocked()
 			return
 		}
 		log.Printf("Error reading users file: %v", err)
 		return
 	}
 
-	// Integrity check
-	CheckAndRecord(absPath, data)
-
 	var loadedUsers map[string]*User
 	if err := json.Unmarshal(data, &loadedUsers); err != nil {
 		log.Printf("Error decoding users: %v", err)
-		globalIntegrity.Record(absPath, false, false, "json decode error: "+err.Error())
+		globalIntegrity.Record(documentPath(usersDocument), false, false, "json decode error: "+err.Error())
 		return
 	}
 
@@ -285,6 +227,7 @@ func (um *UserManager) Load() {
 
 	// Ensure default admin exists
 	um.ensureAdminLocked()
+	um.loadSessionsLocked()
 }
 
 // ensureAdminLocked creates the default admin user if no admin exists.
@@ -320,12 +263,9 @@ func (um *UserManager) saveUsersLocked() {
 		return
 	}
 	data = append(data, '\n')
-	absPath, _ := filepath.Abs(userPersistenceFile)
-	if err := WriteFileWithChecksum(absPath, data); err != nil {
+	if err := globalStore.WriteDocument(usersDocument, data); err != nil {
 		log.Printf("Error saving users: %v", err)
-		return
 	}
-	globalIntegrity.Record(absPath, true, false, "")
 }
 
 // GetPreferences returns the stored preferences for a user
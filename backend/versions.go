@@ -0,0 +1,687 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ────────────────────────────────────────────────
+// Named versions and branches
+// ────────────────────────────────────────────────
+//
+// A named version (a tag) freezes the content of a sheet under a name; it is
+// stored like a history snapshot (globalStore.SaveVersion) but never thinned
+// or trimmed, and can be opened, compared and restored through the history
+// endpoints.
+//
+// A branch is a copy of a sheet in the same project that is edited on its
+// own. It remembers its parent and the content both started from (its base,
+// a version stored on the branch but not listed). Merging compares base,
+// parent and branch cell by cell: cells only the branch changed are copied
+// into the parent, cells both changed differently are conflicts to be
+// resolved by picking a side. Cells are matched by CellID, which every cell
+// of a new branch gets and which moves with the cell when rows or columns are
+// inserted or deleted; cells without one are matched by position, lined up
+// through the cells around them.
+
+var (
+	errVersionNotFound = errors.New("version not found")
+	errNotBranch       = errors.New("sheet is not a branch")
+	errMergeConflicts  = errors.New("merge has unresolved conflicts")
+)
+
+// SheetVersion is a named version of a sheet.
+type SheetVersion struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Note    string    `json:"note,omitempty"`
+	User    string    `json:"user"`
+	Created time.Time `json:"created"`
+}
+
+// SheetBranch links a branch to the sheet it was created from.
+type SheetBranch struct {
+	Parent  string    `json:"parent"` // sheet in the same project
+	Base    string    `json:"base"`   // version id of the content last shared with the parent
+	User    string    `json:"user"`
+	Created time.Time `json:"created"`
+}
+
+// MergeConflict is a cell the branch and its parent both changed since the
+// base, differently.
+type MergeConflict struct {
+	Cell   string `json:"cell"`
+	Base   *Cell  `json:"base,omitempty"`
+	Main   *Cell  `json:"main,omitempty"`
+	Branch *Cell  `json:"branch,omitempty"`
+}
+
+// MergeResult is the outcome, or with a dry run the plan, of a merge.
+type MergeResult struct {
+	Branch    string            `json:"branch"`
+	Into      string            `json:"into"`
+	Changes   []HistoryCellDiff `json:"changes"` // parent cell -> branch cell
+	Conflicts []MergeConflict   `json:"conflicts"`
+	Results   []CellEditResult  `json:"results,omitempty"`
+	Applied   int               `json:"applied"`
+}
+
+// newVersionID returns an id no other version of the sheet has.
+func newVersionID() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// saveVersionContent stores the content of s as version id.
+func saveVersionContent(project, name, id string, st *historyState) error {
+	data, err := encodeHistoryState(st)
+	if err != nil {
+		return err
+	}
+	return globalStore.SaveVersion(project, name, id, data)
+}
+
+func loadVersionContent(project, name, id string) (*historyState, error) {
+	data, err := globalStore.LoadVersion(project, name, id)
+	if err != nil {
+		return nil, fmt.Errorf("load version %s: %w", id, err)
+	}
+	return decodeHistoryState(data)
+}
+
+// findVersion returns the version of s with the given id or name.
+func (s *Sheet) findVersion(idOrName string) (SheetVersion, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, v := range s.Versions {
+		if v.ID == idOrName || v.Name == idOrName {
+			return v, true
+		}
+	}
+	return SheetVersion{}, false
+}
+
+// CreateVersion tags the current content of s as name.
+func CreateVersion(s *Sheet, name, note, user string) (SheetVersion, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return SheetVersion{}, errors.New("version name is required")
+	}
+	if _, ok := s.findVersion(name); ok {
+		return SheetVersion{}, fmt.Errorf("a version named %q already exists", name)
+	}
+	s.mu.RLock()
+	project, sheetName := s.ProjectName, s.Name
+	st := historyStateLocked(s)
+	s.mu.RUnlock()
+
+	v := SheetVersion{ID: newVersionID(), Name: name, Note: strings.TrimSpace(note), User: user, Created: time.Now()}
+	if err := saveVersionContent(project, sheetName, v.ID, st); err != nil {
+		return SheetVersion{}, err
+	}
+	s.mu.Lock()
+	s.Versions = append(s.Versions, v)
+	s.logAudit(AuditEntry{Timestamp: v.Created, User: user, Action: "TAG_VERSION", NewValue: v.Name})
+	s.mu.Unlock()
+	globalSheetManager.SaveCells(s)
+	return v, nil
+}
+
+// DeleteVersion removes the version of s with the given id or name.
+func DeleteVersion(s *Sheet, idOrName, user string) (SheetVersion, error) {
+	v, ok := s.findVersion(idOrName)
+	if !ok {
+		return SheetVersion{}, errVersionNotFound
+	}
+	s.mu.Lock()
+	for i := range s.Versions {
+		if s.Versions[i].ID == v.ID {
+			s.Versions = append(s.Versions[:i], s.Versions[i+1:]...)
+			break
+		}
+	}
+	project, name := s.ProjectName, s.Name
+	s.logAudit(AuditEntry{Timestamp: time.Now(), User: user, Action: "DELETE_VERSION", OldValue: v.Name})
+	s.mu.Unlock()
+	globalSheetManager.SaveCells(s)
+	if err := globalStore.DeleteVersion(project, name, v.ID); err != nil {
+		log.Printf("versions: delete %s of %s: %v", v.ID, sheetArchivePath(project, name), err)
+	}
+	return v, nil
+}
+
+// sheetVersionIDs lists the stored versions of s, the branch base included.
+// Caller holds s.mu or owns s.
+func sheetVersionIDs(s *Sheet) []string {
+	ids := make([]string, 0, len(s.Versions)+1)
+	for _, v := range s.Versions {
+		ids = append(ids, v.ID)
+	}
+	if s.Branch != nil && s.Branch.Base != "" {
+		ids = append(ids, s.Branch.Base)
+	}
+	return ids
+}
+
+// ── Branches ─────────────────────────────────────
+
+// CreateBranch copies src into a new sheet named name in the same project,
+// owned by user and shared with the same people as src.
+func CreateBranch(src *Sheet, name, user string) (*Sheet, error) {
+	name = strings.TrimSpace(name)
+	src.mu.RLock()
+	project, parent, sheetType := src.ProjectName, src.Name, src.SheetType
+	perms := src.Permissions.clone()
+	src.mu.RUnlock()
+	switch {
+	case name == "" || strings.ContainsAny(name, `/\`) || strings.Contains(name, ".."):
+		return nil, fmt.Errorf("%q is not a valid sheet name", name)
+	case strings.EqualFold(name, "timeline"):
+		return nil, errors.New("the name 'timeline' is reserved and cannot be used for a sheet")
+	case globalSheetManager.GetSheetBy(name, project) != nil:
+		return nil, errors.New("a sheet with that name already exists")
+	}
+
+	// Give every cell an identity to be matched by when merging
+	src.mu.Lock()
+	assigned := assignCellIDsLocked(src)
+	src.mu.Unlock()
+	if assigned {
+		globalSheetManager.SaveSheet(src)
+	}
+
+	branch := globalSheetManager.CopySheetToProject(parent, project, project, name, user)
+	if branch == nil {
+		return nil, errors.New("source sheet not found")
+	}
+	now := time.Now()
+	branch.mu.Lock()
+	branch.SheetType = sheetType
+	branch.Permissions = Permissions{
+		Editors:    append(without(perms.Editors, user), user),
+		Commenters: without(perms.Commenters, user),
+		Viewers:    without(perms.Viewers, user),
+		NoAccess:   without(perms.NoAccess, user),
+	}
+	branch.Branch = &SheetBranch{Parent: parent, Base: newVersionID(), User: user, Created: now}
+	base := historyStateLocked(branch)
+	branch.logAudit(AuditEntry{Timestamp: now, User: user, Action: "CREATE_BRANCH", OldValue: parent, NewValue: name})
+	branch.mu.Unlock()
+	if err := saveVersionContent(project, name, branch.Branch.Base, base); err != nil {
+		globalSheetManager.DeleteSheetBy(name, project)
+		return nil, err
+	}
+	globalSheetManager.SaveSheet(branch)
+	if _, err := snapshotSheet(branch); err != nil {
+		log.Printf("history: snapshot %s: %v", sheetArchivePath(project, name), err)
+	}
+
+	src.mu.Lock()
+	src.logAudit(AuditEntry{Timestamp: now, User: user, Action: "CREATE_BRANCH", OldValue: parent, NewValue: name})
+	src.mu.Unlock()
+	return branch, nil
+}
+
+// mergeContent is what a merge compares of a cell: its content without what
+// scripts, formulas and prompts compute, which the parent computes again.
+// Cells filled by a script's output span count as empty.
+func mergeContent(c Cell) Cell {
+	if c.Locked && strings.HasPrefix(c.LockedBy, "script-span ") {
+		return Cell{}
+	}
+	c = historyContent(c)
+	switch c.CellType {
+	case ScriptCell, FormulaCell, AIGeneratedCell:
+		c.Value, c.ScriptOutput, c.Value_FromNonSelfScript = "", "", ""
+		c.ScriptOutput_RowSpan, c.ScriptOutput_ColSpan = 0, 0
+	}
+	return c
+}
+
+// mergeCell returns the cell of data at row and col as mergeContent compares
+// it, and the cell itself when there is one to copy.
+func mergeCell(data map[string]map[string]Cell, row, col string) (Cell, *Cell) {
+	c, ok := data[row][col]
+	if !ok {
+		return Cell{}, nil
+	}
+	mc := mergeContent(c)
+	if reflect.DeepEqual(mc, Cell{}) {
+		return mc, nil
+	}
+	return mc, &c
+}
+
+// assignCellIDsLocked gives a CellID to the cells of s that have none and
+// reports whether there were any. Caller holds s.mu.
+func assignCellIDsLocked(s *Sheet) bool {
+	if s.ReadOnly {
+		return false
+	}
+	used := make(map[string]bool)
+	for _, cols := range s.Data {
+		for _, cell := range cols {
+			used[cell.CellID] = true
+		}
+	}
+	base, n, assigned := generateID(), 0, false
+	for _, cols := range s.Data {
+		for c, cell := range cols {
+			if cell.CellID != "" {
+				continue
+			}
+			for used[cell.CellID] {
+				n++
+				cell.CellID = base + "-" + strconv.Itoa(n)
+			}
+			used[cell.CellID] = true
+			cols[c] = cell
+			assigned = true
+		}
+	}
+	return assigned
+}
+
+// freshCellIDLocked returns id unless another cell of s uses it, else a new
+// unused one. Caller holds s.mu.
+func freshCellIDLocked(s *Sheet, id, row, col string) string {
+	used := func(id string) bool {
+		for r, cols := range s.Data {
+			for c, cell := range cols {
+				if cell.CellID == id && (r != row || c != col) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if id == "" || !used(id) {
+		return id
+	}
+	base := generateID()
+	id = base
+	for n := 1; used(id); n++ {
+		id = base + "-" + strconv.Itoa(n)
+	}
+	return id
+}
+
+// mergeAxis maps the row or column numbers of one side of a merge to those
+// of the parent.
+type mergeAxis struct {
+	to   map[int]int
+	keys []int // sorted
+}
+
+// newMergeAxis picks for each number the one votes most often map it to.
+func newMergeAxis(votes map[int]map[int]int) *mergeAxis {
+	a := &mergeAxis{to: make(map[int]int, len(votes))}
+	for from, tos := range votes {
+		best, n := 0, 0
+		for to, c := range tos {
+			if c > n || c == n && to < best {
+				best, n = to, c
+			}
+		}
+		a.to[from] = best
+		a.keys = append(a.keys, from)
+	}
+	sort.Ints(a.keys)
+	return a
+}
+
+// at maps i, shifting numbers with no anchor of their own like the nearest
+// one before them, or else after them.
+func (a *mergeAxis) at(i int) int {
+	if to, ok := a.to[i]; ok {
+		return to
+	}
+	n := sort.SearchInts(a.keys, i)
+	switch {
+	case n > 0:
+		k := a.keys[n-1]
+		return i + a.to[k] - k
+	case n < len(a.keys):
+		k := a.keys[n]
+		return i + a.to[k] - k
+	}
+	return i
+}
+
+// mergeAligner returns where a cell of data at row and col sits in parent,
+// lining rows and columns up by the cells both have (same CellID), so rows or
+// columns inserted or deleted on one side do not shift the comparison.
+func mergeAligner(data, parent map[string]map[string]Cell) func(row, col string) (string, string) {
+	at := make(map[string][2]string)
+	for r, cols := range parent {
+		for c, cell := range cols {
+			if cell.CellID != "" {
+				at[cell.CellID] = [2]string{r, c}
+			}
+		}
+	}
+	rowVotes, colVotes := make(map[int]map[int]int), make(map[int]map[int]int)
+	vote := func(votes map[int]map[int]int, from, to int) {
+		if votes[from] == nil {
+			votes[from] = make(map[int]int)
+		}
+		votes[from][to]++
+	}
+	for r, cols := range data {
+		for c, cell := range cols {
+			if p, ok := at[cell.CellID]; ok && cell.CellID != "" {
+				vote(rowVotes, atoiSafe(r), atoiSafe(p[0]))
+				vote(colVotes, colLabelToIndex(c), colLabelToIndex(p[1]))
+			}
+		}
+	}
+	rows, cols := newMergeAxis(rowVotes), newMergeAxis(colVotes)
+	return func(row, col string) (string, string) {
+		if r := atoiSafe(row); r > 0 {
+			if to := rows.at(r); to > 0 {
+				row = itoa(to)
+			}
+		}
+		if c := colLabelToIndex(col); c > 0 {
+			if to := cols.at(c); to > 0 {
+				col = indexToColLabel(to)
+			}
+		}
+		return row, col
+	}
+}
+
+// mergeChange is a planned change of a merge, with where its cell is on the
+// branch and in the base, to put the base content back if it is skipped.
+type mergeChange struct {
+	diff   HistoryCellDiff
+	mainID string     // CellID of the parent cell replaced or removed
+	branch *[2]string // row and column on the branch
+	baseAt *[2]string // row and column in the base
+	base   *Cell
+}
+
+// planMergeLocked compares base, parent and branch cell by cell and fills in
+// the changes and conflicts of res. Cells are matched by CellID, or by where
+// they sit in the parent when they have none. Caller holds parent.mu.
+func planMergeLocked(parent *Sheet, base, theirs *historyState, resolutions map[string]string, res *MergeResult) []mergeChange {
+	type mergeEntry struct {
+		at    [3]*[2]string // row and column in base, parent and branch
+		label string        // where the cell goes in the parent
+	}
+	same := func(row, col string) (string, string) { return row, col }
+	sides := []struct {
+		data  map[string]map[string]Cell
+		align func(row, col string) (string, string)
+	}{
+		{base.Data, mergeAligner(base.Data, parent.Data)},
+		{parent.Data, same},
+		{theirs.Data, mergeAligner(theirs.Data, parent.Data)},
+	}
+	entries := make(map[string]*mergeEntry)
+	for i, side := range sides {
+		for row, cols := range side.data {
+			for col, c := range cols {
+				prow, pcol := side.align(row, col)
+				key := "at:" + pcol + prow
+				if c.CellID != "" {
+					key = "id:" + c.CellID
+				}
+				e := entries[key]
+				if e == nil {
+					e = &mergeEntry{label: pcol + prow}
+					entries[key] = e
+				}
+				e.at[i] = &[2]string{row, col}
+				if i == 1 || i == 2 && e.at[1] == nil {
+					e.label = pcol + prow
+				}
+			}
+		}
+	}
+	cell := func(e *mergeEntry, i int) (Cell, *Cell) {
+		if e.at[i] == nil {
+			return Cell{}, nil
+		}
+		return mergeCell(sides[i].data, e.at[i][0], e.at[i][1])
+	}
+	// Parent cells that stay where they are, unless the branch alone removed them
+	occupant := make(map[string]*Cell)
+	for _, e := range entries {
+		if e.at[1] == nil {
+			continue
+		}
+		b, _ := cell(e, 0)
+		m, mainCell := cell(e, 1)
+		_, branchCell := cell(e, 2)
+		if mainCell != nil && (branchCell != nil || !reflect.DeepEqual(m, b)) {
+			occupant[e.label] = mainCell
+		}
+	}
+
+	var plan []mergeChange
+	for _, e := range entries {
+		b, baseCell := cell(e, 0)
+		m, mainCell := cell(e, 1)
+		t, branchCell := cell(e, 2)
+		if reflect.DeepEqual(t, b) || reflect.DeepEqual(t, m) {
+			continue
+		}
+		conflict := !reflect.DeepEqual(m, b)
+		if mainCell == nil && occupant[e.label] != nil {
+			// The branch adds a cell where the parent has another one
+			mainCell, conflict = occupant[e.label], true
+		}
+		d := HistoryCellDiff{Cell: e.label, Change: "changed", From: mainCell, To: branchCell}
+		switch {
+		case mainCell == nil:
+			d.Change = "added"
+		case branchCell == nil:
+			d.Change = "removed"
+		}
+		if conflict {
+			res.Conflicts = append(res.Conflicts, MergeConflict{Cell: e.label, Base: baseCell, Main: mainCell, Branch: branchCell})
+			if resolutions[e.label] != "branch" {
+				continue
+			}
+		}
+		mc := mergeChange{diff: d, branch: e.at[2], baseAt: e.at[0], base: baseCell}
+		if mainCell != nil {
+			mc.mainID = mainCell.CellID
+		}
+		plan = append(plan, mc)
+	}
+	sort.Slice(plan, func(i, j int) bool { return cellLabelLess(plan[i].diff.Cell, plan[j].diff.Cell) })
+	for _, mc := range plan {
+		res.Changes = append(res.Changes, mc.diff)
+	}
+	sortMergeConflicts(res.Conflicts)
+	return plan
+}
+
+// MergeBranch merges branch into its parent as user. Conflicts are settled
+// by resolutions (cell -> "main" or "branch"); any left unresolved fail the
+// merge with errMergeConflicts. A dry run only plans the merge.
+func MergeBranch(branch *Sheet, resolutions map[string]string, user string, dryRun bool) (*MergeResult, error) {
+	branch.mu.RLock()
+	project, name := branch.ProjectName, branch.Name
+	var info SheetBranch
+	if branch.Branch != nil {
+		info = *branch.Branch
+	}
+	theirs := historyStateLocked(branch)
+	branch.mu.RUnlock()
+	if info.Parent == "" {
+		return nil, errNotBranch
+	}
+	parent := globalSheetManager.GetSheetBy(info.Parent, project)
+	if parent == nil {
+		return nil, fmt.Errorf("parent sheet %q not found", info.Parent)
+	}
+	base, err := loadVersionContent(project, name, info.Base)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the state being merged into as a snapshot of its own. The merge is
+	// then planned and applied under one lock, so no edit falls in between.
+	if !dryRun {
+		if _, err := snapshotSheet(parent); err != nil {
+			log.Printf("history: snapshot %s: %v", sheetArchivePath(project, info.Parent), err)
+		}
+	}
+	parent.mu.Lock()
+	if parent.ReadOnly {
+		parent.mu.Unlock()
+		return nil, errors.New("parent sheet is read-only (integrity check failed)")
+	}
+	res := &MergeResult{Branch: name, Into: info.Parent, Changes: make([]HistoryCellDiff, 0), Conflicts: make([]MergeConflict, 0)}
+	plan := planMergeLocked(parent, base, theirs, resolutions, res)
+	unresolved := 0
+	for _, c := range res.Conflicts {
+		if r := resolutions[c.Cell]; r != "main" && r != "branch" {
+			unresolved++
+		}
+	}
+	if dryRun {
+		parent.mu.Unlock()
+		return res, nil
+	}
+	if unresolved > 0 {
+		parent.mu.Unlock()
+		return res, errMergeConflicts
+	}
+
+	res.Results = make([]CellEditResult, 0, len(plan))
+	var skipped []mergeChange
+	for _, mc := range plan {
+		d := mc.diff
+		col, row := parseCellLabel(d.Cell)
+		cur, exists := parent.Data[row][col]
+		if d.To == nil && exists && cur.CellID != mc.mainID {
+			// Another cell took the place of the removed one
+			cur, exists = Cell{}, false
+		}
+		var target Cell
+		if d.To != nil {
+			target = *d.To
+		}
+		result := CellEditResult{Cell: d.Cell, Status: "applied"}
+		switch {
+		case exists && cur.Locked:
+			result.Status, result.Reason = "skipped", "locked"
+		case parent.protectedCellLocked(row, col, user) != nil:
+			result.Status, result.Reason = "skipped", "protected"
+		case (cur.Script != target.Script || cur.AIPrompt != target.AIPrompt) && user != parent.Owner:
+			result.Status, result.Reason = "skipped", "owner-only"
+		}
+		res.Results = append(res.Results, result)
+		if result.Status != "applied" {
+			skipped = append(skipped, mc)
+			continue
+		}
+		res.Applied++
+		if d.To == nil && !exists {
+			continue
+		}
+
+		for _, e := range cellEditAuditEntries(atoiSafe(row), col, cur, target, user, false) {
+			parent.logAudit(e)
+		}
+		if d.To == nil {
+			delete(parent.Data[row], col)
+			if len(parent.Data[row]) == 0 {
+				delete(parent.Data, row)
+			}
+		} else {
+			// The cell keeps the identity it has on the branch
+			target.CellID = freshCellIDLocked(parent, target.CellID, row, col)
+			target.User, target.Locked, target.LockedBy = user, false, ""
+			if parent.Data[row] == nil {
+				parent.Data[row] = make(map[string]Cell)
+			}
+			parent.Data[row][col] = target
+		}
+		globalSheetManager.CellsModifiedManuallyQueueMu.Lock()
+		globalSheetManager.CellsModifiedManuallyQueue = append(globalSheetManager.CellsModifiedManuallyQueue, CellIdentifier{
+			ProjectName: project,
+			sheetName:   info.Parent,
+			row:         row,
+			col:         col,
+		})
+		globalSheetManager.CellsModifiedManuallyQueueMu.Unlock()
+	}
+	parent.logAudit(AuditEntry{
+		Timestamp: time.Now(),
+		User:      user,
+		Action:    "MERGE_BRANCH",
+		OldValue:  name,
+		NewValue:  strconv.Itoa(res.Applied),
+	})
+	parent.mu.Unlock()
+
+	// The branch now shares with its parent what it has, except the cells
+	// that could not be merged
+	for _, mc := range skipped {
+		at := mc.branch
+		if at == nil {
+			at = mc.baseAt
+		}
+		if at == nil {
+			continue
+		}
+		row, col := at[0], at[1]
+		delete(theirs.Data[row], col)
+		if mc.base != nil {
+			if theirs.Data[row] == nil {
+				theirs.Data[row] = make(map[string]Cell)
+			}
+			theirs.Data[row][col] = *mc.base
+		}
+	}
+	newBase := newVersionID()
+	if err := saveVersionContent(project, name, newBase, theirs); err != nil {
+		log.Printf("versions: save merge base of %s: %v", sheetArchivePath(project, name), err)
+	} else {
+		branch.mu.Lock()
+		if branch.Branch != nil {
+			branch.Branch.Base = newBase
+		}
+		branch.logAudit(AuditEntry{Timestamp: time.Now(), User: user, Action: "MERGE_BRANCH", OldValue: name, NewValue: strconv.Itoa(res.Applied)})
+		branch.mu.Unlock()
+		globalSheetManager.SaveSheet(branch)
+		if err := globalStore.DeleteVersion(project, name, info.Base); err != nil {
+			log.Printf("versions: delete old merge base of %s: %v", sheetArchivePath(project, name), err)
+		}
+	}
+
+	globalSheetManager.rebuildScriptDependencies()
+	globalSheetManager.rebuildOptionsRangeDependencies()
+	globalSheetManager.SaveSheet(parent)
+	globalSheetManager.QueueRowColUpdate(project, info.Parent)
+	return res, nil
+}
+
+// renameBranchParent points the branches of a renamed sheet at its new name.
+func (sm *SheetManager) renameBranchParent(project, oldName, newName string) {
+	for _, s := range sm.ListSheets() {
+		s.mu.Lock()
+		changed := s.ProjectName == project && s.Branch != nil && s.Branch.Parent == oldName
+		if changed {
+			s.Branch.Parent = newName
+		}
+		s.mu.Unlock()
+		if changed {
+			sm.SaveCells(s)
+		}
+	}
+}
+
+func sortMergeConflicts(conflicts []MergeConflict) {
+	sort.Slice(conflicts, func(i, j int) bool { return cellLabelLess(conflicts[i].Cell, conflicts[j].Cell) })
+}
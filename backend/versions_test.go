@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestMergeBranchAfterRowInsert(t *testing.T) {
+	s := undoTestSheet(t)
+	s.Data = map[string]map[string]Cell{
+		"1": {"A": {Value: "a"}},
+		"2": {"A": {Value: "b"}},
+		"3": {"A": {Value: "c"}},
+	}
+	branch, err := CreateBranch(s, "S2", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		globalSheetManager.mu.Lock()
+		delete(globalSheetManager.sheets, sheetKey("P", "S2"))
+		delete(globalSheetManager.pending, sheetKey("P", "S2"))
+		globalSheetManager.mu.Unlock()
+	})
+
+	// The branch edits A2 while the parent inserts a row above it and fills
+	// the new row.
+	branch.SetCell("2", "A", "b2", "alice", false)
+	s.InsertRowBelow("1", "alice")
+	s.SetCell("2", "A", "new", "alice", false)
+
+	res, err := MergeBranch(branch, nil, "alice", false)
+	if err != nil {
+		t.Fatalf("MergeBranch: %v (conflicts %+v)", err, res.Conflicts)
+	}
+	if len(res.Conflicts) != 0 || len(res.Changes) != 1 || res.Changes[0].Cell != "A3" {
+		t.Fatalf("merge = %+v, want only A3 changed", res)
+	}
+	for label, want := range map[string]string{"A1": "a", "A2": "new", "A3": "b2", "A4": "c"} {
+		col, row := parseCellLabel(label)
+		if got := s.Data[row][col].Value; got != want {
+			t.Errorf("%s = %q after merge, want %q", label, got, want)
+		}
+	}
+	if got, want := s.Data["3"]["A"].CellID, branch.Data["2"]["A"].CellID; got == "" || got != want {
+		t.Errorf("merged cell id = %q, want the branch cell's %q", got, want)
+	}
+
+	// Merging again finds nothing left to do.
+	res, err = MergeBranch(branch, nil, "alice", true)
+	if err != nil || len(res.Changes) != 0 || len(res.Conflicts) != 0 {
+		t.Errorf("second merge = %+v, %v; want nothing", res, err)
+	}
+}
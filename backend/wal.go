@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ────────────────────────────────────────────────
+// Write-ahead log
+// ────────────────────────────────────────────────
+//
+// Sheet files are written by the debounced flusher, so without a log a crash
+// inside saveInterval would lose edits that clients already saw. Every save
+// therefore appends a record to DATA/wal.log and fsyncs before returning:
+// SaveCells logs the cells an operation changed, as they are now, and the
+// sheet settings when they changed; SaveSheet, for operations that move
+// cells around, logs the whole sheet. Each record carries a sequence number; a sheet file stores the
+// last sequence it includes as wal_seq, and Load replays only newer records.
+// Once every pending save has been flushed the log is truncated.
+//
+// Records for read-only (corrupt) sheets are not replayed. They are held in
+// memory and written back after each truncation so the repair flow can still
+// offer them until an admin resolves the sheet.
+
+func walFilePath() string {
+	return filepath.Join(dataDir, "wal.log")
+}
+
+// walMeta is the part of a sheet other than its cells.
+type walMeta struct {
+	Owner         string           `json:"owner"`
+	SheetType     string           `json:"sheet_type,omitempty"`
+	Permissions   Permissions      `json:"permissions"`
+	ColWidths     map[string]int   `json:"col_widths,omitempty"`
+	RowHeights    map[string]int   `json:"row_heights,omitempty"`
+	RowParents    map[string]int   `json:"row_parents,omitempty"`
+	SectionScheme string           `json:"section_scheme,omitempty"`
+	Versions      []SheetVersion   `json:"versions,omitempty"`
+	Branch        *SheetBranch     `json:"branch,omitempty"`
+	Protected     []ProtectedRange `json:"protected_ranges,omitempty"`
+	Comments      []CommentThread  `json:"comments,omitempty"`
+}
+
+// walRecord is one logged change to a sheet. A Full record replaces the
+// cells; otherwise Cells are set and Deleted are removed. Records written
+// before audit logs were stored separately also carry the sheet's audit_log
+// changes: it is cut to AuditKeep entries before Audit is appended.
+type walRecord struct {
+	Seq       int64                      `json:"seq"`
+	Time      time.Time                  `json:"time"`
+	Project   string                     `json:"project,omitempty"`
+	Sheet     string                     `json:"sheet"`
+	Full      bool                       `json:"full,omitempty"`
+	Cells     map[string]map[string]Cell `json:"cells,omitempty"`
+	Deleted   map[string][]string        `json:"deleted,omitempty"`
+	AuditKeep *int                       `json:"audit_keep,omitempty"`
+	Audit     []AuditEntry               `json:"audit,omitempty"`
+	Meta      json.RawMessage            `json:"meta,omitempty"`
+}
+
+// walShadow is the state of a sheet as the sqlite store last wrote it, to
+// diff against.
+type walShadow struct {
+	cells map[string]map[string]Cell
+	meta  []byte
+}
+
+type WriteAheadLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	seq     int64
+	records int
+	meta    map[*Sheet][]byte      // settings of each sheet as last logged
+	held    map[string][]walRecord // sheetKey -> records skipped for a read-only sheet
+}
+
+var globalWAL = &WriteAheadLog{
+	meta: make(map[*Sheet][]byte),
+	held: make(map[string][]walRecord),
+}
+
+// sheetMetaLocked encodes the sheet settings. Caller holds s.mu.
+func sheetMetaLocked(s *Sheet) []byte {
+	data, _ := json.Marshal(walMeta{
+		Owner:         s.Owner,
+		SheetType:     s.SheetType,
+		Permissions:   s.Permissions,
+		ColWidths:     s.ColWidths,
+		RowHeights:    s.RowHeights,
+		RowParents:    s.RowParents,
+		SectionScheme: s.SectionScheme,
+		Versions:      s.Versions,
+		Branch:        s.Branch,
+		Protected:     s.Protected,
+		Comments:      s.Comments,
+	})
+	return data
+}
+
+// newShadowLocked captures the current state of s. Caller holds s.mu.
+func newShadowLocked(s *Sheet) *walShadow {
+	cells := make(map[string]map[string]Cell, len(s.Data))
+	for r, cols := range s.Data {
+		inner := make(map[string]Cell, len(cols))
+		for c, cell := range cols {
+			inner[c] = cell
+		}
+		cells[r] = inner
+	}
+	return &walShadow{
+		cells: cells,
+		meta:  sheetMetaLocked(s),
+	}
+}
+
+// diffLocked builds the record that turns sh into the current state of s and
+// advances sh. Returns nil when nothing changed. Caller holds s.mu.
+func (sh *walShadow) diffLocked(s *Sheet) *walRecord {
+	rec := &walRecord{Project: s.ProjectName, Sheet: s.Name}
+	changed := false
+
+	for r, cols := range s.Data {
+		old := sh.cells[r]
+		for c, cell := range cols {
+			if prev, ok := old[c]; ok && reflect.DeepEqual(prev, cell) {
+				continue
+			}
+			if rec.Cells == nil {
+				rec.Cells = make(map[string]map[string]Cell)
+			}
+			if rec.Cells[r] == nil {
+				rec.Cells[r] = make(map[string]Cell)
+			}
+			rec.Cells[r][c] = cell
+			if sh.cells[r] == nil {
+				sh.cells[r] = make(map[string]Cell)
+			}
+			sh.cells[r][c] = cell
+			changed = true
+		}
+	}
+	for r, cols := range sh.cells {
+		for c := range cols {
+			if _, ok := s.Data[r][c]; ok {
+				continue
+			}
+			if rec.Deleted == nil {
+				rec.Deleted = make(map[string][]string)
+			}
+			rec.Deleted[r] = append(rec.Deleted[r], c)
+			delete(cols, c)
+			changed = true
+		}
+		if len(cols) == 0 {
+			delete(sh.cells, r)
+		}
+	}
+
+	if meta := sheetMetaLocked(s); !bytes.Equal(meta, sh.meta) {
+		rec.Meta = meta
+		sh.meta = meta
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return rec
+}
+
+// cellsRecordLocked logs the given cells of s as they are now, and its
+// settings when they differ from meta. Returns nil when there is nothing to
+// log. Caller holds s.mu.
+func cellsRecordLocked(s *Sheet, cells []cellRef, meta []byte) *walRecord {
+	rec := &walRecord{Project: s.ProjectName, Sheet: s.Name}
+	for _, ref := range cells {
+		if cell, ok := s.Data[ref.row][ref.col]; ok {
+			if rec.Cells == nil {
+				rec.Cells = make(map[string]map[string]Cell)
+			}
+			if rec.Cells[ref.row] == nil {
+				rec.Cells[ref.row] = make(map[string]Cell)
+			}
+			rec.Cells[ref.row][ref.col] = cell
+			continue
+		}
+		if rec.Deleted == nil {
+			rec.Deleted = make(map[string][]string)
+		}
+		rec.Deleted[ref.row] = append(rec.Deleted[ref.row], ref.col)
+	}
+	if current := sheetMetaLocked(s); !bytes.Equal(current, meta) {
+		rec.Meta = current
+	}
+	if rec.Cells == nil && rec.Deleted == nil && rec.Meta == nil {
+		return nil
+	}
+	return rec
+}
+
+// wholeRecordLocked logs the whole sheet. The record shares s.Data, so it
+// must be encoded before s.mu is released. Caller holds s.mu.
+func wholeRecordLocked(s *Sheet) *walRecord {
+	return &walRecord{
+		Project: s.ProjectName,
+		Sheet:   s.Name,
+		Full:    true,
+		Cells:   s.Data,
+		Meta:    sheetMetaLocked(s),
+	}
+}
+
+// fullRecordLocked is wholeRecordLocked with the cells of a fresh shadow,
+// for the sqlite store. Caller holds s.mu.
+func fullRecordLocked(s *Sheet, sh *walShadow) *walRecord {
+	return &walRecord{
+		Project: s.ProjectName,
+		Sheet:   s.Name,
+		Full:    true,
+		Cells:   sh.cells,
+		Meta:    sh.meta,
+	}
+}
+
+// openLocked opens the log for appending. Caller holds w.mu.
+func (w *WriteAheadLog) openLocked() error {
+	if w.file != nil {
+		return nil
+	}
+	if err := ensureDataDir(); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(walFilePath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = f
+	return nil
+}
+
+// LogSheet appends the whole of s to the log, fsyncs, and schedules the
+// sheet for flushing. The new sequence number is stored on the sheet for
+// that flush. Marking it pending under w.mu keeps Checkpoint from
+// truncating a record whose sheet has not been written yet.
+func (w *WriteAheadLog) LogSheet(sm *SheetManager, s *Sheet) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	defer sm.markPending(s)
+
+	s.mu.RLock()
+	w.appendLocked(s, wholeRecordLocked(s))
+}
+
+// LogCells is LogSheet for an operation that changed only the given cells,
+// and possibly the sheet settings. The first record of a sheet is logged
+// whole.
+func (w *WriteAheadLog) LogCells(sm *SheetManager, s *Sheet, cells []cellRef) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	defer sm.markPending(s)
+
+	s.mu.RLock()
+	meta, ok := w.meta[s]
+	if !ok {
+		w.appendLocked(s, wholeRecordLocked(s))
+		return
+	}
+	w.appendLocked(s, cellsRecordLocked(s, cells, meta))
+}
+
+// appendLocked writes rec, which may be nil, and fsyncs. Caller holds w.mu
+// and s.mu for reading; appendLocked releases s.mu once rec is encoded.
+func (w *WriteAheadLog) appendLocked(s *Sheet, rec *walRecord) {
+	var line []byte
+	if rec != nil {
+		rec.Seq = w.seq + 1
+		rec.Time = time.Now()
+		line, _ = json.Marshal(rec)
+	}
+	s.mu.RUnlock()
+	if rec == nil {
+		return
+	}
+
+	if err := w.openLocked(); err != nil {
+		log.Printf("wal: open: %v", err)
+		return
+	}
+	end, _ := w.file.Seek(0, io.SeekEnd)
+	if _, err := w.file.Write(append(line, '\n')); err != nil {
+		// Drop a partial line so later records stay readable
+		w.file.Truncate(end)
+		log.Printf("wal: append: %v", err)
+		return
+	}
+	if err := w.file.Sync(); err != nil {
+		log.Printf("wal: sync: %v", err)
+		return
+	}
+	w.seq = rec.Seq
+	w.records++
+	if rec.Meta != nil {
+		w.meta[s] = rec.Meta
+	}
+	s.walSeq.Store(rec.Seq)
+}
+
+// Checkpoint truncates the log when no sheet has unflushed changes, and
+// forgets the settings of sheets that have been deleted.
+func (w *WriteAheadLog) Checkpoint(sm *SheetManager) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.records == 0 {
+		return
+	}
+	sm.mu.RLock()
+	idle := len(sm.pending) == 0
+	live := make(map[*Sheet]bool, len(sm.sheets))
+	for _, s := range sm.sheets {
+		live[s] = true
+	}
+	sm.mu.RUnlock()
+	for s := range w.meta {
+		if !live[s] {
+			delete(w.meta, s)
+		}
+	}
+	if idle {
+		w.truncateLocked()
+	}
+}
+
+// truncateLocked empties the log down to the held records. Caller holds w.mu.
+func (w *WriteAheadLog) truncateLocked() {
+	if err := w.openLocked(); err != nil {
+		log.Printf("wal: open: %v", err)
+		return
+	}
+	if err := w.file.Truncate(0); err != nil {
+		log.Printf("wal: truncate: %v", err)
+		return
+	}
+	var held []walRecord
+	for _, recs := range w.held {
+		held = append(held, recs...)
+	}
+	sort.Slice(held, func(i, j int) bool { return held[i].Seq < held[j].Seq })
+	for _, rec := range held {
+		line, _ := json.Marshal(rec)
+		if _, err := w.file.Write(append(line, '\n')); err != nil {
+			log.Printf("wal: rewrite held record: %v", err)
+			break
+		}
+	}
+	if err := w.file.Sync(); err != nil {
+		log.Printf("wal: sync: %v", err)
+	}
+	w.records = 0
+}
+
+// Reset closes and empties the log and forgets the logged settings, for when the
+// sheets are about to be reloaded from files that replace the logged ones.
+func (w *WriteAheadLog) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	if err := os.Truncate(walFilePath(), 0); err != nil && !os.IsNotExist(err) {
+		log.Printf("wal: truncate: %v", err)
+	}
+	w.records = 0
+	w.meta = make(map[*Sheet][]byte)
+	w.held = make(map[string][]walRecord)
+}
+
+// HeldRecords returns the records held back for a read-only sheet, oldest
+// first.
+func (w *WriteAheadLog) HeldRecords(project, name string) []walRecord {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]walRecord(nil), w.held[sheetKey(project, name)]...)
+}
+
+// Forget drops the logged settings and held records of a sheet that a
+// restore replaced or removed. Its records stay in the file until the next
+// truncation; a sheet loaded in its place is rebased past them.
+func (w *WriteAheadLog) Forget(s *Sheet) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s.mu.RLock()
+	key := sheetKey(s.ProjectName, s.Name)
+	s.mu.RUnlock()
+	delete(w.meta, s)
+	delete(w.held, key)
+}
+
+// Rebase is called before a repaired sheet is written. The repaired content
+// is authoritative, so wal_seq moves past every record logged so far, the
+// records held for s are dropped and its current settings are taken as
+// logged.
+func (w *WriteAheadLog) Rebase(s *Sheet) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s.mu.RLock()
+	key := sheetKey(s.ProjectName, s.Name)
+	w.meta[s] = sheetMetaLocked(s)
+	s.mu.RUnlock()
+	if w.seq > s.walSeq.Load() {
+		s.walSeq.Store(w.seq)
+	}
+	// The dropped records are still in the file until the next truncation
+	w.records += len(w.held[key])
+	delete(w.held, key)
+}
+
+// Recover replays the logged records newer than each sheet's wal_seq onto
+// the freshly loaded sheets, schedules the changed ones for flushing and
+// takes their settings as logged.
+func (w *WriteAheadLog) Recover(sm *SheetManager) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	sm.mu.RLock()
+	sheets := make(map[string]*Sheet, len(sm.sheets))
+	for k, s := range sm.sheets {
+		sheets[k] = s
+	}
+	sm.mu.RUnlock()
+
+	for _, s := range sheets {
+		if seq := s.walSeq.Load(); seq > w.seq {
+			w.seq = seq
+		}
+	}
+	touched, changed := w.replayLocked(sheets)
+	for _, s := range sheets {
+		s.mu.RLock()
+		w.meta[s] = sheetMetaLocked(s)
+		s.mu.RUnlock()
+	}
+	for _, s := range touched {
+		sm.markPending(s)
+	}
+	// Recalculation queued before the crash was lost; redo it for every
+	// replayed cell so dependents catch up.
+	if len(changed) > 0 {
+		sm.CellsModifiedManuallyQueueMu.Lock()
+		sm.CellsModifiedManuallyQueue = append(sm.CellsModifiedManuallyQueue, changed...)
+		sm.CellsModifiedManuallyQueueMu.Unlock()
+	}
+}
+
+// replayLocked applies the log to sheets and returns the sheets and cells it
+// changed. Caller holds w.mu.
+func (w *WriteAheadLog) replayLocked(sheets map[string]*Sheet) ([]*Sheet, []CellIdentifier) {
+	f, err := os.Open(walFilePath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("wal: open: %v", err)
+		}
+		return nil, nil
+	}
+	defer f.Close()
+
+	touched := make(map[*Sheet]bool)
+	var order []*Sheet
+	var changed []CellIdentifier
+	applied, skipped := 0, 0
+	var valid int64
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 1024*1024), 1<<30)
+	for scanner.Scan() {
+		var rec walRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// A torn final line is a write that was never acknowledged; cut
+			// it off so records appended from now on are not hidden behind it.
+			log.Printf("wal: dropping unreadable record at offset %d: %v", valid, err)
+			if err := os.Truncate(walFilePath(), valid); err != nil {
+				log.Printf("wal: truncate: %v", err)
+			}
+			break
+		}
+		valid += int64(len(scanner.Bytes())) + 1
+		if rec.Seq > w.seq {
+			w.seq = rec.Seq
+		}
+		w.records++
+		s := sheets[sheetKey(rec.Project, rec.Sheet)]
+		if s == nil || rec.Seq <= s.walSeq.Load() {
+			continue
+		}
+		if s.ReadOnly {
+			key := sheetKey(s.ProjectName, s.Name)
+			w.held[key] = append(w.held[key], rec)
+			skipped++
+			continue
+		}
+		rec.applyTo(s)
+		s.walSeq.Store(rec.Seq)
+		for r, cols := range rec.Cells {
+			for c := range cols {
+				changed = append(changed, CellIdentifier{ProjectName: s.ProjectName, sheetName: s.Name, row: r, col: c})
+			}
+		}
+		applied++
+		if !touched[s] {
+			touched[s] = true
+			order = append(order, s)
+		}
+	}
+	if applied > 0 || skipped > 0 {
+		log.Printf("wal: replayed %d records into %d sheets (%d held for read-only sheets)", applied, len(order), skipped)
+	}
+	return order, changed
+}
+
+// applyTo replays the record onto s.
+func (rec *walRecord) applyTo(s *Sheet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec.Full {
+		s.Data = make(map[string]map[string]Cell)
+	}
+	if s.Data == nil {
+		s.Data = make(map[string]map[string]Cell)
+	}
+	for r, cols := range rec.Cells {
+		if s.Data[r] == nil {
+			s.Data[r] = make(map[string]Cell)
+		}
+		for c, cell := range cols {
+			s.Data[r][c] = cell
+		}
+	}
+	for r, cols := range rec.Deleted {
+		for _, c := range cols {
+			delete(s.Data[r], c)
+		}
+		if len(s.Data[r]) == 0 {
+			delete(s.Data, r)
+		}
+	}
+	if rec.AuditKeep != nil {
+		if *rec.AuditKeep < len(s.legacyAudit) {
+			s.legacyAudit = s.legacyAudit[:*rec.AuditKeep]
+		}
+		s.legacyAudit = append(s.legacyAudit, rec.Audit...)
+	}
+	if len(rec.Meta) > 0 {
+		var meta walMeta
+		if err := json.Unmarshal(rec.Meta, &meta); err == nil {
+			s.Owner = meta.Owner
+			s.SheetType = meta.SheetType
+			s.Permissions = meta.Permissions
+			s.ColWidths = meta.ColWidths
+			s.RowHeights = meta.RowHeights
+			s.RowParents = meta.RowParents
+			s.SectionScheme = meta.SectionScheme
+			s.Versions = meta.Versions
+			s.Branch = meta.Branch
+			s.Protected = meta.Protected
+			s.Comments = meta.Comments
+		}
+	}
+}
@@ -11,6 +11,8 @@ import ChangePassword from './components/ChangePassword';
 import Admin from './components/Admin';
 import Timeline from './components/Timeline';
 import Help from './components/Help';
+import Groups from './components/Groups';
+import Notifications from './components/Notifications';
 
 function App() {
   return (
@@ -26,6 +28,8 @@ function App() {
         <Route path="/admin" element={<Admin />} />
         <Route path="/timeline/:project" element={<Timeline />} />
         <Route path="/help" element={<Help />} />
+        <Route path="/groups" element={<Groups />} />
+        <Route path="/notifications" element={<Notifications />} />
       </Routes>
     </Router>
   );
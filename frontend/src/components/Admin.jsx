@@ -1,7 +1,7 @@
 import React, { useEffect, useState } from 'react';
 import { useNavigate, Link } from 'react-router-dom';
 import { authenticatedFetch, isSessionValid, clearAuth, getUsername, isAdmin, apiUrl } from '../utils/auth';
-import { ShieldCheck, KeyRound, ToggleLeft, ToggleRight, LogOut, ArrowLeft, RefreshCw, Download, AlertTriangle, CheckCircle } from 'lucide-react';
+import { ShieldCheck, KeyRound, ToggleLeft, ToggleRight, LogOut, ArrowLeft, RefreshCw, Download, AlertTriangle, CheckCircle, Archive, Upload, Wrench } from 'lucide-react';
 
 export default function Admin() {
   const navigate = useNavigate();
@@ -30,11 +30,33 @@ export default function Admin() {
   const [integrityReport, setIntegrityReport] = useState(null);
   const [integrityLoading, setIntegrityLoading] = useState(false);
 
+  // Backups & restore state
+  const [backups, setBackups] = useState([]);
+  const [restoreScope, setRestoreScope] = useState('all');
+  const [restoreProject, setRestoreProject] = useState('');
+  const [restoreSheet, setRestoreSheet] = useState('');
+  const [restoreFile, setRestoreFile] = useState(null);
+  const [restoreMsg, setRestoreMsg] = useState('');
+  const [restoring, setRestoring] = useState(false);
+
+  // Sheet repair state
+  const [flaggedSheets, setFlaggedSheets] = useState([]);
+  const [repairTarget, setRepairTarget] = useState(null);   // flagged sheet being inspected
+  const [repairReport, setRepairReport] = useState(null);
+  const [repairSnapshot, setRepairSnapshot] = useState(''); // "wal" or "backup:<name>"
+  const [repairMsg, setRepairMsg] = useState('');
+  const [repairing, setRepairing] = useState(false);
+
   // LLM settings state
   const [llmUrl, setLlmUrl] = useState('');
   const [llmUrlSaved, setLlmUrlSaved] = useState('');
   const [llmMsg, setLlmMsg] = useState('');
 
+  // Notification delivery settings state; the SMTP password is write-only
+  const [notify, setNotify] = useState({ smtp_host: '', smtp_port: '', smtp_username: '', smtp_password: '', smtp_from: '', allow_webhooks: false });
+  const [smtpPasswordSet, setSmtpPasswordSet] = useState(false);
+  const [notifyMsg, setNotifyMsg] = useState('');
+
   useEffect(() => {
     if (!username || !isSessionValid()) {
       clearAuth();
@@ -48,6 +70,9 @@ export default function Admin() {
     fetchUsers();
     fetchIntegrityReport();
     fetchLLMSettings();
+    fetchNotificationSettings();
+    fetchBackups();
+    fetchFlaggedSheets();
 
     const interval = setInterval(() => {
       if (!isSessionValid()) {
@@ -145,6 +170,48 @@ export default function Admin() {
     }
   };
 
+  const applyNotificationSettings = (data) => {
+    setNotify({
+      smtp_host: data.smtp_host || '',
+      smtp_port: data.smtp_port ? String(data.smtp_port) : '',
+      smtp_username: data.smtp_username || '',
+      smtp_password: '',
+      smtp_from: data.smtp_from || '',
+      allow_webhooks: !!data.allow_webhooks,
+    });
+    setSmtpPasswordSet(!!data.smtp_password_set);
+  };
+
+  const fetchNotificationSettings = async () => {
+    try {
+      const res = await authenticatedFetch(apiUrl('/api/admin/notifications'));
+      if (res.ok) applyNotificationSettings(await res.json());
+    } catch (e) {
+      console.error('Notification settings fetch failed', e);
+    }
+  };
+
+  const saveNotificationSettings = async () => {
+    setNotifyMsg('');
+    try {
+      const res = await authenticatedFetch(apiUrl('/api/admin/notifications'), {
+        method: 'PUT',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ ...notify, smtp_port: parseInt(notify.smtp_port, 10) || 0 }),
+      });
+      if (res.ok) {
+        applyNotificationSettings(await res.json());
+        setNotifyMsg('Notification settings saved successfully');
+        setTimeout(() => setNotifyMsg(''), 3000);
+      } else {
+        const text = await res.text();
+        setNotifyMsg(text || 'Failed to save notification settings');
+      }
+    } catch (e) {
+      setNotifyMsg('Network error');
+    }
+  };
+
   const togglePermission = async (user) => {
     if (user.is_admin) return; // cannot change admin's own permission
     const newVal = !user.can_create_project;
@@ -167,6 +234,26 @@ export default function Admin() {
     }
   };
 
+  const forceLogout = async (uname) => {
+    if (!window.confirm(`Log out ${uname} on all devices?`)) return;
+    try {
+      const res = await authenticatedFetch(apiUrl('/api/admin/user/logout'), {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ username: uname }),
+      });
+      if (res.ok) {
+        const data = await res.json();
+        alert(`${uname} logged out (${data.sessions} session(s) ended)`);
+      } else {
+        const text = await res.text();
+        alert(text || 'Failed to log out user');
+      }
+    } catch (e) {
+      alert('Network error');
+    }
+  };
+
   const startResetPassword = (uname) => {
     setPwTarget(uname);
     setNewPw('');
@@ -229,6 +316,191 @@ export default function Admin() {
     }
   };
 
+  const fetchBackups = async () => {
+    try {
+      const res = await authenticatedFetch(apiUrl('/api/admin/backups'));
+      if (res.ok) setBackups(await res.json());
+    } catch (e) {
+      console.error('backups fetch failed', e);
+    }
+  };
+
+  const createBackup = async () => {
+    setRestoreMsg('');
+    try {
+      const res = await authenticatedFetch(apiUrl('/api/admin/backups'), { method: 'POST' });
+      if (res.ok) {
+        const data = await res.json();
+        setRestoreMsg(`Backup ${data.name} created successfully`);
+        fetchBackups();
+      } else {
+        const text = await res.text();
+        setRestoreMsg(text || 'Failed to create backup');
+      }
+    } catch (e) {
+      setRestoreMsg('Network error');
+    }
+  };
+
+  const downloadStoredBackup = async (name) => {
+    try {
+      const res = await authenticatedFetch(apiUrl(`/api/admin/backups?name=${encodeURIComponent(name)}`));
+      if (!res.ok) {
+        const text = await res.text();
+        alert(text || 'Failed to download backup');
+        return;
+      }
+      const url = URL.createObjectURL(await res.blob());
+      const a = document.createElement('a');
+      a.href = url;
+      a.download = name;
+      document.body.appendChild(a);
+      a.click();
+      a.remove();
+      URL.revokeObjectURL(url);
+    } catch (e) {
+      alert('Network error while downloading backup');
+    }
+  };
+
+  // Restore from a stored backup (name) or the selected upload (no name)
+  const runRestore = async (name) => {
+    setRestoreMsg('');
+    const params = new URLSearchParams({ scope: restoreScope });
+    if (restoreScope !== 'all') {
+      if (restoreScope === 'project' && !restoreProject.trim()) {
+        setRestoreMsg('Project is required');
+        return;
+      }
+      if (restoreScope === 'sheet' && !restoreSheet.trim()) {
+        setRestoreMsg('Sheet name is required');
+        return;
+      }
+      if (restoreProject.trim()) params.set('project', restoreProject.trim());
+      if (restoreScope === 'sheet') params.set('sheet_name', restoreSheet.trim());
+    }
+    const target = restoreScope === 'all' ? 'ALL data' : restoreScope === 'project' ? `project '${restoreProject.trim()}'` : `sheet '${restoreSheet.trim()}'`;
+    if (!window.confirm(`Replace ${target} with the contents of ${name || restoreFile?.name}? A safety backup is taken first.`)) return;
+
+    const options = { method: 'POST' };
+    if (name) {
+      params.set('backup', name);
+    } else {
+      if (!restoreFile) {
+        setRestoreMsg('Choose a backup file first');
+        return;
+      }
+      const form = new FormData();
+      form.append('file', restoreFile);
+      options.body = form;
+    }
+    setRestoring(true);
+    try {
+      const res = await authenticatedFetch(apiUrl(`/api/admin/restore?${params}`), options);
+      if (res.ok) {
+        const data = await res.json();
+        setRestoreMsg(`Restored successfully (${data.files} files, ${data.sheets} sheets loaded). Safety backup: ${data.safety_backup}`);
+        fetchBackups();
+        fetchIntegrityReport();
+        fetchFlaggedSheets();
+        fetchUsers();
+      } else if (res.status === 422) {
+        const data = await res.json();
+        setRestoreMsg(`Backup rejected, integrity check failed: ${(data.files || []).join(', ')}`);
+      } else {
+        const text = await res.text();
+        setRestoreMsg(text || 'Restore failed');
+      }
+    } catch (e) {
+      setRestoreMsg('Network error');
+    } finally {
+      setRestoring(false);
+    }
+  };
+
+  const fetchFlaggedSheets = async () => {
+    try {
+      const res = await authenticatedFetch(apiUrl('/api/admin/repair'));
+      if (res.ok) setFlaggedSheets(await res.json());
+    } catch (e) {
+      console.error('flagged sheets fetch failed', e);
+    }
+  };
+
+  const snapshotParams = (snapshot) => {
+    if (snapshot === 'wal') return { source: 'wal' };
+    if (snapshot.startsWith('backup:')) return { source: 'backup', backup: snapshot.slice(7) };
+    return {};
+  };
+
+  // Load the diff of a flagged sheet against a snapshot (default snapshot when empty)
+  const openRepair = async (f, snapshot = '') => {
+    setRepairTarget(f);
+    setRepairMsg('');
+    const params = new URLSearchParams({ project: f.project, sheet_name: f.sheet, ...snapshotParams(snapshot) });
+    try {
+      const res = await authenticatedFetch(apiUrl(`/api/admin/repair?${params}`));
+      if (res.ok) {
+        const data = await res.json();
+        setRepairReport(data);
+        setRepairSnapshot(data.compared ? (data.compared.source === 'wal' ? 'wal' : `backup:${data.compared.backup}`) : '');
+      } else {
+        setRepairReport(null);
+        setRepairMsg(await res.text() || 'Failed to load repair report');
+      }
+    } catch (e) {
+      setRepairMsg('Network error');
+    }
+  };
+
+  const runRepair = async (action) => {
+    if (!repairTarget) return;
+    const prompts = {
+      accept: `Accept the current content of '${repairTarget.sheet}' as correct and re-sign its checksum?`,
+      rollback: `Replace '${repairTarget.sheet}' with the selected snapshot? A safety backup is taken first.`,
+      quarantine: `Copy the current content of '${repairTarget.sheet}' into a new editable sheet?`,
+    };
+    if (!window.confirm(prompts[action])) return;
+    setRepairing(true);
+    setRepairMsg('');
+    try {
+      const body = { project: repairTarget.project, sheet_name: repairTarget.sheet, action };
+      if (action === 'rollback') Object.assign(body, snapshotParams(repairSnapshot));
+      const res = await authenticatedFetch(apiUrl('/api/admin/repair'), {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(body),
+      });
+      if (res.ok) {
+        const data = await res.json();
+        if (action === 'quarantine') {
+          setRepairMsg(`Quarantined copy '${data.quarantine}' created successfully in project '${data.project}'`);
+        } else {
+          setRepairMsg(`Sheet '${data.sheet}' repaired successfully. Safety backup: ${data.safety_backup}`);
+          setRepairTarget(null);
+          setRepairReport(null);
+        }
+        fetchFlaggedSheets();
+        fetchIntegrityReport();
+        fetchBackups();
+      } else if (res.status === 422) {
+        const data = await res.json();
+        setRepairMsg(`Snapshot rejected, integrity check failed: ${(data.files || []).join(', ')}`);
+      } else {
+        setRepairMsg(await res.text() || 'Repair failed');
+      }
+    } catch (e) {
+      setRepairMsg('Network error');
+    } finally {
+      setRepairing(false);
+    }
+  };
+
+  const formatRepairCell = (c) => {
+    if (!c) return '—';
+    return c.script ? `${c.value || ''} [${c.script}]` : (c.value || '');
+  };
+
   const handleLogout = async () => {
     try {
       await authenticatedFetch(apiUrl('/api/logout'), { method: 'POST' });
@@ -381,6 +653,14 @@ export default function Admin() {
                             <KeyRound size={14} className="me-1" /> Reset Password
                           </button>
                         )}
+                        {user.username !== username && (
+                          <button
+                            className="btn btn-sm btn-outline-danger ms-2"
+                            onClick={() => forceLogout(user.username)}
+                          >
+                            <LogOut size={14} className="me-1" /> Log Out
+                          </button>
+                        )}
                       </td>
                     </tr>
 
@@ -466,6 +746,106 @@ export default function Admin() {
           
         </div>
 
+        {/* Backups & Restore */}
+        <div className="mt-4 card shadow-sm border-0">
+          <div className="card-header d-flex align-items-center justify-content-between bg-white">
+            <h5 className="mb-0 fw-bold d-flex align-items-center gap-2">
+              <Archive size={18} /> Backups &amp; Restore
+            </h5>
+            <div className="d-flex gap-2">
+              <button className="btn btn-sm btn-outline-primary" onClick={createBackup} disabled={restoring}>
+                Back Up Now
+              </button>
+              <button className="btn btn-sm btn-outline-secondary" onClick={fetchBackups}>
+                <RefreshCw size={14} className="me-1" /> Refresh
+              </button>
+            </div>
+          </div>
+          <div className="card-body">
+            <div className="d-flex align-items-center gap-2 flex-wrap mb-3">
+              <select
+                className="form-select form-select-sm"
+                style={{ maxWidth: 160 }}
+                value={restoreScope}
+                onChange={e => setRestoreScope(e.target.value)}
+              >
+                <option value="all">Everything</option>
+                <option value="project">One project</option>
+                <option value="sheet">One sheet</option>
+              </select>
+              {restoreScope !== 'all' && (
+                <input
+                  type="text"
+                  className="form-control form-control-sm"
+                  style={{ maxWidth: 200 }}
+                  placeholder={restoreScope === 'project' ? 'Project (folder in DATA)' : 'Project (optional)'}
+                  value={restoreProject}
+                  onChange={e => setRestoreProject(e.target.value)}
+                />
+              )}
+              {restoreScope === 'sheet' && (
+                <input
+                  type="text"
+                  className="form-control form-control-sm"
+                  style={{ maxWidth: 200 }}
+                  placeholder="Sheet name"
+                  value={restoreSheet}
+                  onChange={e => setRestoreSheet(e.target.value)}
+                />
+              )}
+            </div>
+            <div className="d-flex align-items-center gap-2 flex-wrap mb-2">
+              <input
+                type="file"
+                accept=".zip"
+                className="form-control form-control-sm"
+                style={{ maxWidth: 320 }}
+                onChange={e => setRestoreFile(e.target.files[0] || null)}
+              />
+              <button className="btn btn-sm btn-danger" disabled={!restoreFile || restoring} onClick={() => runRestore(null)}>
+                <Upload size={14} className="me-1" /> Restore Upload
+              </button>
+            </div>
+            {restoreMsg && (
+              <div className={`small mb-2 ${restoreMsg.includes('successfully') ? 'text-success' : 'text-danger'}`}>
+                {restoreMsg}
+              </div>
+            )}
+          </div>
+          <table className="table table-sm mb-0 align-middle">
+            <thead className="table-light">
+              <tr>
+                <th>Stored Backup</th>
+                <th>Created</th>
+                <th className="text-end">Size</th>
+                <th className="text-end">Actions</th>
+              </tr>
+            </thead>
+            <tbody>
+              {backups.map(b => (
+                <tr key={b.name}>
+                  <td className="small font-monospace">{b.name}</td>
+                  <td className="small text-muted">{new Date(b.created_at).toLocaleString()}</td>
+                  <td className="small text-end">{(b.size / 1024).toFixed(1)} KB</td>
+                  <td className="text-end">
+                    <button className="btn btn-sm btn-outline-info" onClick={() => downloadStoredBackup(b.name)}>
+                      <Download size={14} />
+                    </button>
+                    <button className="btn btn-sm btn-outline-danger ms-2" disabled={restoring} onClick={() => runRestore(b.name)}>
+                      Restore
+                    </button>
+                  </td>
+                </tr>
+              ))}
+              {backups.length === 0 && (
+                <tr>
+                  <td colSpan={4} className="text-center text-muted small py-3">No stored backups yet.</td>
+                </tr>
+              )}
+            </tbody>
+          </table>
+        </div>
+
         {/* Integrity Report */}
         <div className="mt-4 card shadow-sm border-0">
           <div className="card-header d-flex align-items-center justify-content-between bg-white">
@@ -525,6 +905,129 @@ export default function Admin() {
           </div>
         </div>
 
+        {/* Sheet Repair */}
+        <div className="mt-4 card shadow-sm border-0">
+          <div className="card-header d-flex align-items-center justify-content-between bg-white">
+            <h5 className="mb-0 fw-bold d-flex align-items-center gap-2">
+              <Wrench size={18} /> Sheet Repair
+            </h5>
+            <button className="btn btn-sm btn-outline-secondary" onClick={fetchFlaggedSheets}>
+              <RefreshCw size={14} className="me-1" /> Refresh
+            </button>
+          </div>
+          <table className="table table-sm mb-0 align-middle">
+            <thead className="table-light">
+              <tr>
+                <th>Sheet</th>
+                <th>Reason</th>
+                <th className="text-end">Actions</th>
+              </tr>
+            </thead>
+            <tbody>
+              {flaggedSheets.map(f => (
+                <tr key={`${f.project}/${f.sheet}`} className={repairTarget?.project === f.project && repairTarget?.sheet === f.sheet ? 'table-warning' : ''}>
+                  <td className="small font-monospace">{f.project}/{f.sheet}</td>
+                  <td className="small text-muted">
+                    {f.reason}
+                    {!f.loaded && <span className="badge bg-danger ms-2">Not loaded</span>}
+                    {f.held_wal_records > 0 && <span className="badge bg-info text-dark ms-2">{f.held_wal_records} unapplied log records</span>}
+                  </td>
+                  <td className="text-end">
+                    <button className="btn btn-sm btn-outline-primary" onClick={() => openRepair(f)}>
+                      Inspect
+                    </button>
+                  </td>
+                </tr>
+              ))}
+              {flaggedSheets.length === 0 && (
+                <tr>
+                  <td colSpan={3} className="text-center text-muted small py-3">No sheets need repair.</td>
+                </tr>
+              )}
+            </tbody>
+          </table>
+          {(repairTarget || repairMsg) && (
+            <div className="card-body border-top">
+              {repairTarget && repairReport && (
+                <>
+                  <div className="d-flex align-items-center gap-2 flex-wrap mb-2">
+                    <span className="small">Compare <strong>{repairTarget.project}/{repairTarget.sheet}</strong> with</span>
+                    <select
+                      className="form-select form-select-sm"
+                      style={{ maxWidth: 360 }}
+                      value={repairSnapshot}
+                      onChange={e => openRepair(repairTarget, e.target.value)}
+                    >
+                      {!repairSnapshot && <option value="">No snapshot available</option>}
+                      {(repairReport.snapshots || []).map(sn => (
+                        <option
+                          key={sn.source === 'wal' ? 'wal' : sn.backup}
+                          value={sn.source === 'wal' ? 'wal' : `backup:${sn.backup}`}
+                          disabled={!sn.intact}
+                        >
+                          {sn.source === 'wal'
+                            ? `Write-ahead log (${sn.records} records)`
+                            : `${sn.backup}${sn.intact ? '' : ' (corrupt)'}`}
+                        </option>
+                      ))}
+                    </select>
+                  </div>
+                  {repairReport.current_error && (
+                    <div className="small text-danger mb-2">Current file cannot be read: {repairReport.current_error}</div>
+                  )}
+                  {repairReport.compared && (
+                    <div className="small text-muted mb-2">
+                      {repairReport.cells.length} cell(s) differ
+                      {repairReport.settings_changed && ', sheet settings differ'}
+                    </div>
+                  )}
+                  {repairReport.cells.length > 0 && (
+                    <div style={{ maxHeight: 260, overflowY: 'auto' }} className="mb-3">
+                      <table className="table table-sm table-bordered mb-0">
+                        <thead className="table-light">
+                          <tr>
+                            <th>Cell</th>
+                            <th>Current</th>
+                            <th>Snapshot</th>
+                          </tr>
+                        </thead>
+                        <tbody>
+                          {repairReport.cells.map(d => (
+                            <tr key={d.cell}>
+                              <td className="small font-monospace">{d.cell}</td>
+                              <td className={`small ${d.change === 'removed' || d.change === 'changed' ? 'table-danger' : ''}`}>{formatRepairCell(d.current)}</td>
+                              <td className={`small ${d.change === 'added' || d.change === 'changed' ? 'table-success' : ''}`}>{formatRepairCell(d.snapshot)}</td>
+                            </tr>
+                          ))}
+                        </tbody>
+                      </table>
+                    </div>
+                  )}
+                  <div className="d-flex gap-2 flex-wrap mb-2">
+                    <button className="btn btn-sm btn-success" disabled={repairing || !repairTarget.loaded} onClick={() => runRepair('accept')}
+                      title="Keep the current content and re-sign its checksum">
+                      Accept Current
+                    </button>
+                    <button className="btn btn-sm btn-danger" disabled={repairing || !repairSnapshot} onClick={() => runRepair('rollback')}
+                      title="Replace the sheet with the selected snapshot">
+                      Roll Back to Snapshot
+                    </button>
+                    <button className="btn btn-sm btn-outline-secondary" disabled={repairing || !repairTarget.loaded} onClick={() => runRepair('quarantine')}
+                      title="Copy the current content into a new editable sheet">
+                      Open Quarantined Copy
+                    </button>
+                  </div>
+                </>
+              )}
+              {repairMsg && (
+                <div className={`small ${repairMsg.includes('successfully') ? 'text-success' : 'text-danger'}`}>
+                  {repairMsg}
+                </div>
+              )}
+            </div>
+          )}
+        </div>
+
         {/* LLM Settings */}
         <div className="card mt-4 shadow-sm">
           <div className="card-header bg-white d-flex align-items-center gap-2 py-2 px-3">
@@ -555,6 +1058,41 @@ export default function Admin() {
           </div>
         </div>
 
+        {/* Notification delivery */}
+        <div className="card mt-4 shadow-sm">
+          <div className="card-header bg-white d-flex align-items-center gap-2 py-2 px-3">
+            <strong className="small">Notification Delivery</strong>
+          </div>
+          <div className="card-body px-3 py-3">
+            <div className="mb-2 small text-muted">
+              The SMTP server that emails notifications to users who ask for them. Leave the host empty to disable email. Port 465 uses TLS from the start; other ports upgrade with STARTTLS when the server offers it.
+            </div>
+            <div className="row g-2" style={{ maxWidth: 640 }}>
+              <div className="col-8">
+                <input type="text" className="form-control form-control-sm" placeholder="SMTP host, e.g. smtp.example.com" value={notify.smtp_host} onChange={e => setNotify(prev => ({ ...prev, smtp_host: e.target.value }))} />
+              </div>
+              <div className="col-4">
+                <input type="number" className="form-control form-control-sm" placeholder="Port (25)" value={notify.smtp_port} onChange={e => setNotify(prev => ({ ...prev, smtp_port: e.target.value }))} />
+              </div>
+              <div className="col-6">
+                <input type="text" className="form-control form-control-sm" placeholder="Username (optional)" value={notify.smtp_username} onChange={e => setNotify(prev => ({ ...prev, smtp_username: e.target.value }))} />
+              </div>
+              <div className="col-6">
+                <input type="password" className="form-control form-control-sm" placeholder={smtpPasswordSet ? 'Password (unchanged)' : 'Password (optional)'} value={notify.smtp_password} onChange={e => setNotify(prev => ({ ...prev, smtp_password: e.target.value }))} />
+              </div>
+              <div className="col-12">
+                <input type="text" className="form-control form-control-sm" placeholder="Sender address, e.g. sheets@example.com" value={notify.smtp_from} onChange={e => setNotify(prev => ({ ...prev, smtp_from: e.target.value }))} />
+              </div>
+              <div className="col-12 form-check ms-1">
+                <input className="form-check-input" type="checkbox" id="allowWebhooks" checked={notify.allow_webhooks} onChange={e => setNotify(prev => ({ ...prev, allow_webhooks: e.target.checked }))} />
+                <label className="form-check-label small" htmlFor="allowWebhooks">Allow users to post notifications to their own webhook URLs</label>
+              </div>
+            </div>
+            <button className="btn btn-sm btn-primary mt-2" onClick={saveNotificationSettings}>Save</button>
+            {notifyMsg && <div className="mt-2 small text-success">{notifyMsg}</div>}
+          </div>
+        </div>
+
         <div className="mt-4 p-3 bg-white border rounded small text-muted">
           <strong>Notes:</strong>
           <ul className="mb-0 mt-1">
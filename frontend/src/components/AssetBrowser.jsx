@@ -416,7 +416,7 @@ function AssetThumbnail({ asset, project }) {
     const [src, setSrc] = useState(null);
     useEffect(() => {
         let revoked = false;
-        fetch(apiUrl(`/api/assets/serve?project=${encodeURIComponent(project)}&name=${encodeURIComponent(asset.name)}`))
+        authenticatedFetch(apiUrl(`/api/assets/serve?project=${encodeURIComponent(project)}&name=${encodeURIComponent(asset.name)}`))
             .then(r => r.blob())
             .then(blob => {
                 if (!revoked) setSrc(URL.createObjectURL(blob));
@@ -1,7 +1,7 @@
 import React, { useEffect, useState } from 'react';
 import { useNavigate } from 'react-router-dom';
 import { authenticatedFetch, isSessionValid, clearAuth, getUsername, apiUrl } from '../utils/auth';
-import { ArrowLeft, Lock, Save, User } from 'lucide-react';
+import { ArrowLeft, Lock, Save, User, LogOut, KeyRound, Plus, Trash2 } from 'lucide-react';
 
 export default function ChangePassword() {
   const navigate = useNavigate();
@@ -11,6 +11,37 @@ export default function ChangePassword() {
   const [newPwd, setNewPwd] = useState('');
   const [confirmPwd, setConfirmPwd] = useState('');
   const [busy, setBusy] = useState(false);
+  const [sessions, setSessions] = useState([]);
+  const [apiTokens, setApiTokens] = useState([]);
+  const [tokenName, setTokenName] = useState('');
+  const [tokenAccess, setTokenAccess] = useState('read');
+  const [tokenProjects, setTokenProjects] = useState('');
+  const [tokenDays, setTokenDays] = useState(90);
+  const [newToken, setNewToken] = useState('');
+
+  const fetchSessions = async () => {
+    try {
+      const res = await authenticatedFetch(apiUrl('/api/sessions'));
+      if (res.ok) {
+        const list = await res.json();
+        setSessions(Array.isArray(list) ? list : []);
+      }
+    } catch (err) {
+      console.error('Sessions fetch error', err);
+    }
+  };
+
+  const fetchApiTokens = async () => {
+    try {
+      const res = await authenticatedFetch(apiUrl('/api/tokens'));
+      if (res.ok) {
+        const list = await res.json();
+        setApiTokens(Array.isArray(list) ? list : []);
+      }
+    } catch (err) {
+      console.error('API tokens fetch error', err);
+    }
+  };
 
   useEffect(() => {
     if (!username || !isSessionValid()) {
@@ -18,8 +49,70 @@ export default function ChangePassword() {
       navigate('/');
       return;
     }
+    fetchSessions();
+    fetchApiTokens();
   }, [username, navigate]);
 
+  const createApiToken = async (e) => {
+    e.preventDefault();
+    if (!tokenName.trim()) return;
+    try {
+      const projects = tokenProjects.split(',').map(p => p.trim()).filter(Boolean);
+      const res = await authenticatedFetch(apiUrl('/api/tokens'), {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ name: tokenName.trim(), access: tokenAccess, projects, expires_in_days: Number(tokenDays) || 90 }),
+      });
+      if (!res.ok) {
+        const text = await res.text();
+        alert(text || 'Failed to create token');
+        return;
+      }
+      const data = await res.json();
+      setNewToken(data.token);
+      setTokenName('');
+      setTokenProjects('');
+      fetchApiTokens();
+    } catch (err) {
+      console.error('Create token error', err);
+    }
+  };
+
+  const revokeApiToken = async (t) => {
+    if (!window.confirm(`Revoke token "${t.name}"? Scripts using it will stop working.`)) return;
+    try {
+      const res = await authenticatedFetch(apiUrl(`/api/tokens?id=${encodeURIComponent(t.id)}`), { method: 'DELETE' });
+      if (!res.ok) {
+        const text = await res.text();
+        alert(text || 'Failed to revoke token');
+        return;
+      }
+      fetchApiTokens();
+    } catch (err) {
+      console.error('Revoke token error', err);
+    }
+  };
+
+  const revokeSession = async (s) => {
+    if (s.current && !window.confirm('This is the session you are using now. Log out?')) return;
+    try {
+      const res = await authenticatedFetch(apiUrl(`/api/sessions?id=${encodeURIComponent(s.id)}`), { method: 'DELETE' });
+      if (!res.ok) {
+        const text = await res.text();
+        alert(text || 'Failed to revoke session');
+        return;
+      }
+      if (s.current) {
+        clearAuth();
+        navigate('/');
+        return;
+      }
+      fetchSessions();
+    } catch (err) {
+      console.error('Revoke session error', err);
+    }
+  };
+
   const submit = async (e) => {
     e.preventDefault();
     if (!oldPwd || !newPwd || !confirmPwd) {
@@ -98,6 +191,86 @@ export default function ChangePassword() {
             <p className="text-muted mt-2">Password must be at least 6 characters.</p>
           </form>
         </div>
+
+        <div className="bg-white border border-gray-200 rounded-2xl shadow-sm p-4 mt-4">
+          <h5 className="mb-3">Active Sessions</h5>
+          {sessions.length === 0 && <p className="text-muted mb-0">No active sessions.</p>}
+          {sessions.map(s => (
+            <div key={s.id} className="d-flex align-items-center justify-content-between border-bottom py-2">
+              <div className="small">
+                <div className="fw-semibold">
+                  {s.user_agent || 'Unknown client'}
+                  {s.current && <span className="badge bg-success ms-2">This session</span>}
+                  {s.remember && <span className="badge bg-secondary ms-2">Remembered</span>}
+                </div>
+                <div className="text-muted">
+                  {s.remote_addr} · signed in {new Date(s.created_at).toLocaleString()} · last active {new Date(s.last_seen).toLocaleString()}
+                </div>
+              </div>
+              <button className="btn btn-sm btn-outline-danger d-flex align-items-center" onClick={() => revokeSession(s)}>
+                <LogOut size={14} className="me-1"/> Revoke
+              </button>
+            </div>
+          ))}
+        </div>
+
+        <div className="bg-white border border-gray-200 rounded-2xl shadow-sm p-4 mt-4">
+          <h5 className="mb-3 d-flex align-items-center"><KeyRound size={18} className="me-2"/> API Tokens</h5>
+          <p className="text-muted small">Tokens let scripts call the API as you. Send them as <code>Authorization: Bearer &lt;token&gt;</code>.</p>
+          {newToken && (
+            <div className="alert alert-success small">
+              Copy this token now, it will not be shown again:
+              <div className="d-flex gap-2 mt-1">
+                <input className="form-control form-control-sm font-monospace" readOnly value={newToken} onFocus={(e) => e.target.select()} />
+                <button className="btn btn-sm btn-outline-secondary" onClick={() => setNewToken('')}>Done</button>
+              </div>
+            </div>
+          )}
+          <form onSubmit={createApiToken} className="row g-2 align-items-end mb-3">
+            <div className="col-12 col-md-4">
+              <label className="form-label small mb-0">Name</label>
+              <input className="form-control form-control-sm" value={tokenName} onChange={(e)=>setTokenName(e.target.value)} placeholder="e.g. nightly export" />
+            </div>
+            <div className="col-6 col-md-2">
+              <label className="form-label small mb-0">Access</label>
+              <select className="form-select form-select-sm" value={tokenAccess} onChange={(e)=>setTokenAccess(e.target.value)}>
+                <option value="read">Read</option>
+                <option value="write">Read &amp; write</option>
+              </select>
+            </div>
+            <div className="col-6 col-md-2">
+              <label className="form-label small mb-0">Days</label>
+              <input type="number" min={1} max={365} className="form-control form-control-sm" value={tokenDays} onChange={(e)=>setTokenDays(e.target.value)} />
+            </div>
+            <div className="col-12 col-md-4">
+              <label className="form-label small mb-0">Projects (comma separated, empty = all)</label>
+              <input className="form-control form-control-sm" value={tokenProjects} onChange={(e)=>setTokenProjects(e.target.value)} />
+            </div>
+            <div className="col-12 d-flex justify-content-end">
+              <button type="submit" className="btn btn-sm btn-outline-primary d-flex align-items-center" disabled={!tokenName.trim()}>
+                <Plus size={14} className="me-1"/> Create Token
+              </button>
+            </div>
+          </form>
+          {apiTokens.length === 0 && <p className="text-muted mb-0">No API tokens.</p>}
+          {apiTokens.map(t => (
+            <div key={t.id} className="d-flex align-items-center justify-content-between border-bottom py-2">
+              <div className="small">
+                <div className="fw-semibold">
+                  {t.name}
+                  <span className={`badge ms-2 ${t.access === 'write' ? 'bg-warning text-dark' : 'bg-info text-dark'}`}>{t.access}</span>
+                  {new Date(t.expires_at) < new Date() && <span className="badge bg-danger ms-2">Expired</span>}
+                </div>
+                <div className="text-muted">
+                  {t.projects.length ? t.projects.join(', ') : 'All projects'} · expires {new Date(t.expires_at).toLocaleDateString()} · {t.last_used_at ? `last used ${new Date(t.last_used_at).toLocaleString()} from ${t.last_used_ip}` : 'never used'}
+                </div>
+              </div>
+              <button className="btn btn-sm btn-outline-danger d-flex align-items-center" onClick={() => revokeApiToken(t)}>
+                <Trash2 size={14} className="me-1"/> Revoke
+              </button>
+            </div>
+          ))}
+        </div>
       </main>
     </div>
   );
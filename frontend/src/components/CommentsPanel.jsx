@@ -0,0 +1,175 @@
+import React, { useEffect, useState } from 'react';
+import { X, MessageSquare, Trash2, Check, RotateCcw } from 'lucide-react';
+import { authenticatedFetch, apiUrl } from '../utils/auth';
+import { keyLabel } from '../utils/comments';
+
+// Bold the @mentions the server recognised
+const renderText = (comment) => {
+    const mentions = new Set((comment.mentions || []).map(m => m.replace(/^@/, '')));
+    return comment.text.split(/(@[\w.-]+)/).map((part, i) => (
+        part.startsWith('@') && mentions.has(part.slice(1).replace(/[.-]+$/, ''))
+            ? <strong key={i} className="text-primary">{part}</strong>
+            : <React.Fragment key={i}>{part}</React.Fragment>
+    ));
+};
+
+/**
+ * CommentsPanel — a floating panel listing the comment threads of a sheet.
+ * Commenters and editors start threads on cells, reply, and resolve or
+ * reopen them; authors, the sheet owner and project admins delete comments.
+ *
+ * Props:
+ *  - projectName, sheetName: the sheet
+ *  - threads: the sheet's comment threads, kept current over the WebSocket
+ *  - cellKeys: thread id -> "row-col" key of its cell
+ *  - focusCell: { row, col } | null — show this cell's threads and offer a new one
+ *  - username: string
+ *  - connected: boolean — whether the WebSocket is open
+ *  - onSend: (type, payload) => void — sends ADD_COMMENT, RESOLVE_COMMENT or DELETE_COMMENT
+ *  - onJump: (row, col) => void — select a thread's cell
+ *  - onClearFocus, onClose: () => void
+ */
+export default function CommentsPanel({ projectName, sheetName, threads, cellKeys, focusCell, username, connected, onSend, onJump, onClearFocus, onClose }) {
+    const [filter, setFilter] = useState('open');
+    const [access, setAccess] = useState({ can_comment: false, can_manage: false });
+    const [draft, setDraft] = useState('');
+    // thread id -> reply being written
+    const [replies, setReplies] = useState({});
+
+    useEffect(() => {
+        const params = new URLSearchParams({ sheet_name: sheetName, project: projectName || '' });
+        authenticatedFetch(apiUrl(`/api/sheet/comments?${params.toString()}`))
+            .then(res => (res.ok ? res.json() : null))
+            .then(body => { if (body) setAccess({ can_comment: !!body.can_comment, can_manage: !!body.can_manage }); })
+            .catch(() => {});
+    }, [projectName, sheetName]);
+
+    const focusKey = focusCell ? `${focusCell.row}-${focusCell.col}` : '';
+    const shown = (threads || []).filter(t => {
+        if (focusKey) return cellKeys[t.id] === focusKey;
+        if (filter === 'open') return !t.resolved;
+        if (filter === 'resolved') return t.resolved;
+        return true;
+    });
+    const canComment = access.can_comment && connected;
+
+    const handleStart = () => {
+        if (!draft.trim() || !focusCell) return;
+        onSend('ADD_COMMENT', { row: String(focusCell.row), col: focusCell.col, text: draft });
+        setDraft('');
+    };
+
+    const handleReply = (t) => {
+        const text = replies[t.id] || '';
+        if (!text.trim()) return;
+        onSend('ADD_COMMENT', { thread_id: t.id, text });
+        setReplies(prev => ({ ...prev, [t.id]: '' }));
+    };
+
+    const handleDelete = (t, c) => {
+        if (!window.confirm('Delete this comment?')) return;
+        onSend('DELETE_COMMENT', { thread_id: t.id, comment_id: c.id });
+    };
+
+    const jump = (t) => {
+        const key = cellKeys[t.id];
+        if (!key) return;
+        const i = key.indexOf('-');
+        onJump(key.slice(0, i), key.slice(i + 1));
+    };
+
+    return (
+        <div style={{ position: 'fixed', right: 392, top: 70, width: 380, maxHeight: 'calc(100% - 100px)', zIndex: 1100 }} className="card shadow-sm d-flex flex-column">
+            <div className="card-header py-2 d-flex align-items-center justify-content-between">
+                <span className="fw-semibold small d-flex align-items-center gap-1">
+                    <MessageSquare size={13} /> {focusCell ? `Comments on ${focusCell.col}${focusCell.row}` : 'Comments'}
+                </span>
+                <div className="d-flex align-items-center gap-1">
+                    {focusCell
+                        ? <button className="btn btn-sm btn-link p-0" onClick={onClearFocus}>All comments</button>
+                        : (
+                            <select className="form-select form-select-sm" style={{ fontSize: '0.75rem', width: 'auto' }} value={filter} onChange={(e) => setFilter(e.target.value)}>
+                                <option value="open">Open</option>
+                                <option value="resolved">Resolved</option>
+                                <option value="all">All</option>
+                            </select>
+                        )}
+                    <button className="btn btn-sm btn-light" onClick={onClose} aria-label="Close comments"><X size={14} /></button>
+                </div>
+            </div>
+            <div className="overflow-auto p-2 d-flex flex-column gap-2" style={{ flex: 1, fontSize: '0.8rem' }}>
+                {shown.length === 0 && <div className="text-muted">{focusCell ? 'No comments on this cell.' : 'No comments.'}</div>}
+                {shown.map(t => (
+                    <div key={t.id} className={`border rounded p-2 ${t.resolved ? 'bg-light' : ''}`}>
+                        <div className="d-flex align-items-center justify-content-between mb-1">
+                            <button className="btn btn-sm btn-link p-0 fw-semibold" disabled={!cellKeys[t.id]} onClick={() => jump(t)}>
+                                {keyLabel(cellKeys[t.id]) || 'deleted cell'}
+                            </button>
+                            {t.resolved && <span className="badge bg-success">resolved by {t.resolved_by}</span>}
+                            {canComment && (
+                                <button
+                                    className="btn btn-sm btn-link p-0 d-flex align-items-center"
+                                    onClick={() => onSend('RESOLVE_COMMENT', { thread_id: t.id, resolved: !t.resolved })}
+                                >
+                                    {t.resolved ? <><RotateCcw size={12} className="me-1" /> Reopen</> : <><Check size={12} className="me-1" /> Resolve</>}
+                                </button>
+                            )}
+                        </div>
+                        <ul className="list-unstyled mb-1">
+                            {(t.comments || []).map(c => (
+                                <li key={c.id} className="py-1 border-bottom">
+                                    <div className="d-flex align-items-center justify-content-between">
+                                        <span className="fw-semibold">{c.user}</span>
+                                        <span className="d-flex align-items-center gap-1 text-muted" style={{ fontSize: '0.7rem' }}>
+                                            {new Date(c.timestamp).toLocaleString()}
+                                            {connected && (c.user === username || access.can_manage) && (
+                                                <button className="btn btn-sm btn-link text-danger p-0" title="Delete comment" onClick={() => handleDelete(t, c)}>
+                                                    <Trash2 size={12} />
+                                                </button>
+                                            )}
+                                        </span>
+                                    </div>
+                                    <div style={{ whiteSpace: 'pre-wrap' }}>{renderText(c)}</div>
+                                </li>
+                            ))}
+                        </ul>
+                        {canComment && (
+                            <div className="d-flex gap-1">
+                                <input
+                                    type="text"
+                                    className="form-control form-control-sm"
+                                    style={{ fontSize: '0.78rem' }}
+                                    placeholder={t.resolved ? 'Reply to reopen…' : 'Reply, @name to mention'}
+                                    value={replies[t.id] || ''}
+                                    onChange={(e) => setReplies(prev => ({ ...prev, [t.id]: e.target.value }))}
+                                    onKeyDown={(e) => { if (e.key === 'Enter') handleReply(t); }}
+                                />
+                                <button className="btn btn-sm btn-outline-primary" disabled={!(replies[t.id] || '').trim()} onClick={() => handleReply(t)}>Reply</button>
+                            </div>
+                        )}
+                    </div>
+                ))}
+
+                {focusCell && canComment && (
+                    <section>
+                        <div className="fw-semibold mb-1">New thread on {focusCell.col}{focusCell.row}</div>
+                        <textarea
+                            className="form-control form-control-sm"
+                            style={{ fontSize: '0.78rem' }}
+                            rows={3}
+                            placeholder="Comment, @name to mention a user or group"
+                            value={draft}
+                            onChange={(e) => setDraft(e.target.value)}
+                        />
+                        <div className="d-flex justify-content-end mt-1">
+                            <button className="btn btn-sm btn-outline-primary" disabled={!draft.trim()} onClick={handleStart}>Comment</button>
+                        </div>
+                    </section>
+                )}
+                {!access.can_comment && (
+                    <span className="text-muted" style={{ fontSize: '0.72rem' }}>You can read comments on this sheet but not add them.</span>
+                )}
+            </div>
+        </div>
+    );
+}
@@ -19,6 +19,9 @@ import {
     CheckCircle
 } from 'lucide-react';
 import { isSessionValid, clearAuth, authenticatedFetch, getUsername } from '../utils/auth';
+import { chooseDeleteMode } from '../utils/references';
+import { MEMBER_ROLES, ROLE_LABELS } from '../utils/roles';
+import { fetchGroups, groupsOf, isListed } from '../utils/groups';
 
 // Shared clipboard helpers using localStorage
 function getClipboard() {
@@ -56,9 +59,19 @@ export default function Dashboard() {
     const [projectOwner, setProjectOwner] = useState('');
     // Project admins (additional users with owner-like privileges)
     const [projectAdmins, setProjectAdmins] = useState([]);
+    const [publicEndpoints, setPublicEndpoints] = useState(false);
+    // Sheet audit log retention: days ('' or 0 = keep forever) and archiving
+    const [auditRetention, setAuditRetention] = useState({ days: '', archive: false });
+    // Project member roles (user -> editor/commenter/viewer/none) and the role of everyone else
+    const [members, setMembers] = useState({});
+    // Names of the groups the user is in
+    const [myGroups, setMyGroups] = useState([]);
+    const [defaultRole, setDefaultRole] = useState('viewer');
     // Admin management UI state
     const [showAdminManager, setShowAdminManager] = useState(false);
     const [newAdminName, setNewAdminName] = useState('');
+    const [newMemberName, setNewMemberName] = useState('');
+    const [newMemberRole, setNewMemberRole] = useState('viewer');
 
     // Audit sidebar state
     const [auditLog, setAuditLog] = useState([]);
@@ -98,6 +111,10 @@ export default function Dashboard() {
         return () => clearInterval(sessionCheckInterval);
     }, [project, username, navigate]);
 
+    useEffect(() => {
+        fetchGroups().then(groups => setMyGroups(groupsOf(groups, username)));
+    }, [username]);
+
     // Sync clipboard from localStorage (cross-tab and same-tab navigation)
     useEffect(() => {
         const syncClipboard = () => setClipboard(getClipboard());
@@ -189,6 +206,18 @@ export default function Dashboard() {
                 const found = Array.isArray(list) ? list.find(p => p.name === topProject) : null;
                 setProjectOwner(found?.owner || '');
                 setProjectAdmins(Array.isArray(found?.admins) ? found.admins : []);
+                setPublicEndpoints(!!found?.public_endpoints);
+            }
+            const retRes = await authenticatedFetch(`http://${host}/api/projects/audit-retention?project=${encodeURIComponent(topProject)}`);
+            if (retRes.ok) {
+                const ret = await retRes.json();
+                setAuditRetention({ days: ret.days ? String(ret.days) : '', archive: !!ret.archive });
+            }
+            const memRes = await authenticatedFetch(`http://${host}/api/projects/members?project=${encodeURIComponent(topProject)}`);
+            if (memRes.ok) {
+                const mem = await memRes.json();
+                setMembers(mem.members || {});
+                setDefaultRole(mem.default_role || 'viewer');
             }
         } catch (e) { /* ignore */ }
     };
@@ -558,20 +587,27 @@ export default function Dashboard() {
         }
     }, [isAuditOpen]);
 
-    const deleteSheet = async (sheetId) => {
-        if (!window.confirm('Are you sure you want to delete this sheet?')) {
+    const deleteSheet = async (sheetId, mode) => {
+        if (!mode && !window.confirm('Are you sure you want to delete this sheet?')) {
             return;
         }
 
         try {
             const host = import.meta.env.VITE_BACKEND_HOST || 'localhost';
-            const res = await authenticatedFetch(`http://${host}/api/sheets?id=${sheetId}${project ? `&project=${encodeURIComponent(project)}` : ''}` , {
+            const res = await authenticatedFetch(`http://${host}/api/sheets?id=${sheetId}${project ? `&project=${encodeURIComponent(project)}` : ''}${mode ? `&mode=${mode}` : ''}` , {
                 method: 'DELETE',
             });
             if (res.status === 403) {
                 alert('Only the sheet owner can delete this sheet.');
                 return;
             }
+            if (res.status === 409) {
+                // Other sheets reference this one: rewrite them to values, force, or abort
+                const body = await res.json().catch(() => ({}));
+                const next = chooseDeleteMode(`Sheet '${sheetId}'`, body.references);
+                if (next) deleteSheet(sheetId, next);
+                return;
+            }
             if (res.ok) {
                 fetchSheets();
             } else if (res.status === 401) {
@@ -645,7 +681,7 @@ export default function Dashboard() {
     }, [sheets, searchQuery]);
 
     // Only the project owner or project admins may create/paste sheets and subfolders
-    const isOwner = !projectOwner || projectOwner === username || projectAdmins.includes(username);
+    const isOwner = !projectOwner || projectOwner === username || isListed(projectAdmins, username, myGroups);
     // Only the original project owner can manage admins
     const isOriginalOwner = !projectOwner || projectOwner === username;
 
@@ -673,6 +709,74 @@ export default function Dashboard() {
         }
     };
 
+    const togglePublicEndpoints = async () => {
+        try {
+            const host = import.meta.env.VITE_BACKEND_HOST || 'localhost';
+            const topProject = (project || '').split('/')[0];
+            const res = await authenticatedFetch(`http://${host}/api/projects/public`, {
+                method: 'PUT',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ project: topProject, enabled: !publicEndpoints }),
+            });
+            if (res.ok) {
+                setPublicEndpoints(!publicEndpoints);
+            } else {
+                const msg = await res.text();
+                alert(msg || 'Failed to change public access');
+            }
+        } catch (e) {
+            alert('Error changing public access');
+        }
+    };
+
+    const saveAuditRetention = async () => {
+        const days = parseInt(auditRetention.days || '0', 10);
+        if (isNaN(days) || days < 0) {
+            alert('Retention must be a number of days (0 keeps everything)');
+            return;
+        }
+        try {
+            const host = import.meta.env.VITE_BACKEND_HOST || 'localhost';
+            const topProject = (project || '').split('/')[0];
+            const res = await authenticatedFetch(`http://${host}/api/projects/audit-retention`, {
+                method: 'PUT',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ project: topProject, days, archive: auditRetention.archive }),
+            });
+            if (res.ok) {
+                alert(days > 0 ? `Audit log entries older than ${days} days will be removed` : 'Audit log entries are kept forever');
+            } else {
+                const msg = await res.text();
+                alert(msg || 'Failed to change audit retention');
+            }
+        } catch (e) {
+            alert('Error changing audit retention');
+        }
+    };
+
+    // Set a member's role, or remove them with role ''; without a user, set the default role
+    const changeMemberRole = async (member, role) => {
+        try {
+            const host = import.meta.env.VITE_BACKEND_HOST || 'localhost';
+            const topProject = (project || '').split('/')[0];
+            const body = member ? { project: topProject, user: member, role } : { project: topProject, default_role: role };
+            const res = await authenticatedFetch(`http://${host}/api/projects/members`, {
+                method: 'PUT',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify(body),
+            });
+            if (res.ok) {
+                if (member === newMemberName.trim()) setNewMemberName('');
+                fetchProjectOwner(project);
+            } else {
+                const msg = await res.text();
+                alert(msg || 'Failed to change member role');
+            }
+        } catch (e) {
+            alert('Error changing member role');
+        }
+    };
+
     const handleRemoveAdmin = async (admin) => {
         if (!window.confirm(`Remove "${admin}" as project admin?`)) return;
         try {
@@ -820,7 +924,7 @@ export default function Dashboard() {
                             <input
                                 type="text"
                                 className="form-control form-control-sm"
-                                placeholder="Enter username to add as admin..."
+                                placeholder="Enter username or @group to add as admin..."
                                 value={newAdminName}
                                 onChange={(e) => setNewAdminName(e.target.value)}
                                 onKeyDown={(e) => e.key === 'Enter' && handleAddAdmin()}
@@ -833,6 +937,105 @@ export default function Dashboard() {
                                 <Plus size={14} className="me-1" /> Add
                             </button>
                         </div>
+                        <h6 className="mt-3 mb-2 d-flex align-items-center">
+                            <Users className="me-2" size={16} /> Members
+                        </h6>
+                        <div className="d-flex align-items-center gap-2 mb-2 small">
+                            <label className="mb-0" htmlFor="defaultRole">Everyone else</label>
+                            <select
+                                id="defaultRole"
+                                className="form-select form-select-sm"
+                                style={{ width: 140 }}
+                                value={defaultRole}
+                                onChange={(e) => changeMemberRole('', e.target.value)}
+                            >
+                                {MEMBER_ROLES.map(r => <option key={r} value={r}>{ROLE_LABELS[r]}</option>)}
+                            </select>
+                        </div>
+                        <div className="d-flex flex-wrap gap-2 align-items-center mb-2">
+                            {Object.keys(members).sort().map(member => (
+                                <span key={member} className="badge bg-light text-dark border d-flex align-items-center gap-1">
+                                    <User size={12} />
+                                    {member}
+                                    <select
+                                        className="form-select form-select-sm py-0 ms-1"
+                                        style={{ width: 'auto', fontSize: '0.75rem' }}
+                                        value={members[member]}
+                                        onChange={(e) => changeMemberRole(member, e.target.value)}
+                                    >
+                                        {MEMBER_ROLES.map(r => <option key={r} value={r}>{ROLE_LABELS[r]}</option>)}
+                                    </select>
+                                    <button
+                                        className="btn-close btn-close-sm ms-1"
+                                        style={{ fontSize: '0.5rem' }}
+                                        onClick={() => changeMemberRole(member, '')}
+                                        title={`Remove ${member}`}
+                                    />
+                                </span>
+                            ))}
+                        </div>
+                        <div className="d-flex gap-2" style={{ maxWidth: 400 }}>
+                            <input
+                                type="text"
+                                className="form-control form-control-sm"
+                                placeholder="Enter username or @group to add as member..."
+                                value={newMemberName}
+                                onChange={(e) => setNewMemberName(e.target.value)}
+                                onKeyDown={(e) => e.key === 'Enter' && newMemberName.trim() && changeMemberRole(newMemberName.trim(), newMemberRole)}
+                            />
+                            <select
+                                className="form-select form-select-sm"
+                                style={{ width: 140 }}
+                                value={newMemberRole}
+                                onChange={(e) => setNewMemberRole(e.target.value)}
+                            >
+                                {MEMBER_ROLES.map(r => <option key={r} value={r}>{ROLE_LABELS[r]}</option>)}
+                            </select>
+                            <button
+                                className="btn btn-warning btn-sm d-flex align-items-center"
+                                onClick={() => changeMemberRole(newMemberName.trim(), newMemberRole)}
+                                disabled={!newMemberName.trim()}
+                            >
+                                <Plus size={14} className="me-1" /> Add
+                            </button>
+                        </div>
+                        <div className="form-check form-switch mt-3">
+                            <input
+                                className="form-check-input"
+                                type="checkbox"
+                                id="publicEndpoints"
+                                checked={publicEndpoints}
+                                onChange={togglePublicEndpoints}
+                            />
+                            <label className="form-check-label small" htmlFor="publicEndpoints">
+                                Public endpoints: allow CSV, activity log and markdown downloads of this project's sheets without a token
+                            </label>
+                        </div>
+                        <div className="d-flex align-items-center gap-2 mt-3 small">
+                            <label className="mb-0" htmlFor="auditRetentionDays">Keep sheet activity logs for</label>
+                            <input
+                                id="auditRetentionDays"
+                                type="number"
+                                min="0"
+                                className="form-control form-control-sm"
+                                style={{ width: 80 }}
+                                placeholder="∞"
+                                value={auditRetention.days}
+                                onChange={(e) => setAuditRetention(r => ({ ...r, days: e.target.value }))}
+                            />
+                            <span>days</span>
+                            <div className="form-check mb-0 ms-2">
+                                <input
+                                    className="form-check-input"
+                                    type="checkbox"
+                                    id="auditRetentionArchive"
+                                    checked={auditRetention.archive}
+                                    onChange={(e) => setAuditRetention(r => ({ ...r, archive: e.target.checked }))}
+                                />
+                                <label className="form-check-label" htmlFor="auditRetentionArchive">Archive removed entries</label>
+                            </div>
+                            <button className="btn btn-outline-warning btn-sm" onClick={saveAuditRetention}>Save</button>
+                        </div>
                     </div>
                 </div>
             )}
@@ -19,12 +19,22 @@ import {
     Undo2,
     Redo2
 } from 'lucide-react';
-import { Lock, Code, ChevronDown, ListOrdered, Trash2, Plus, Scissors, ClipboardPaste, MoreVertical, CornerDownRight, AlertTriangle, BrainCircuit } from 'lucide-react';
-import { isSessionValid, clearAuth, getUsername, authenticatedFetch, apiUrl } from '../utils/auth';
+import { Lock, Code, ChevronDown, ListOrdered, Trash2, Plus, Scissors, ClipboardPaste, MoreVertical, CornerDownRight, AlertTriangle, BrainCircuit, Shield, MessageSquare, Bell, Eye } from 'lucide-react';
+import { isSessionValid, clearAuth, getUsername, getAuthToken, refreshSession, authenticatedFetch, apiUrl } from '../utils/auth';
+import { chooseDeleteMode } from '../utils/references';
+import { applySheetPatch, flattenRows, PAGE_ROWS } from '../utils/sheetPatch';
+import { fetchGroups, groupsOf, isListed, GROUP_PREFIX } from '../utils/groups';
+import { protectionAt, rangeTitle, rangeOfCells } from '../utils/protected';
+import { threadCellKeys, threadsByCell, upsertThread } from '../utils/comments';
+import { fetchUnreadCount, addWatch } from '../utils/notifications';
 import JSZip from 'jszip';
 import MarkdownEditorPanel from './MarkdownEditorPanel';
 import ScriptEditorPanel from './ScriptEditorPanel';
 import AIPromptEditorPanel from './AIPromptEditorPanel';
+import SheetHistoryPanel from './SheetHistoryPanel';
+import SheetVersionsPanel from './SheetVersionsPanel';
+import ProtectedRangesPanel from './ProtectedRangesPanel';
+import CommentsPanel from './CommentsPanel';
 export default function Document() {
     const navigate = useNavigate();
     const location = useLocation();
@@ -74,8 +84,22 @@ export default function Document() {
     }, []);
     const COLS = COL_HEADERS.length;
 
-    const isOwner = username && owner && (username === owner || projectAdmins.includes(username));
-    const canEdit = !!username && (isOwner || (Array.isArray(editors) && editors.includes(username)));
+    // All groups, and the names of those the user is in
+    const [allGroups, setAllGroups] = useState([]);
+    const myGroups = useMemo(() => groupsOf(allGroups, username), [allGroups, username]);
+    const isOwner = username && owner && (username === owner || isListed(projectAdmins, username, myGroups));
+    const canEdit = !!username && (isOwner || isListed(editors, username, myGroups));
+    // How protected ranges limit our edits of a cell: level "blocked", "warn" or ""
+    const protectionOf = (row, col) => protectionAt(protectedRanges, row, col, username, myGroups, isOwner);
+    // Ask before the first edit of a warn-only range; false when the cell may not be edited
+    const confirmProtected = (row, col) => {
+        const { level, range } = protectionOf(row, col);
+        if (level === 'blocked') return false;
+        if (level !== 'warn' || warnedRangesRef.current.has(range.id)) return true;
+        if (!window.confirm(`${rangeTitle(range)} is protected. Edit it anyway?`)) return false;
+        warnedRangesRef.current.add(range.id);
+        return true;
+    };
 
     const handleUnauthorized = () => {
         clearAuth();
@@ -148,14 +172,33 @@ export default function Document() {
     // Timeline filter: show logs after a selected timeline event
     const [timelineEntries, setTimelineEntries] = useState([]);
     const [filterAfterEventId, setFilterAfterEventId] = useState('');
-    // Undo/Redo stacks for committed cell value edits
-    const [undoStack, setUndoStack] = useState([]); // [{type:'cell_edit', row, col, oldValue, newValue}]
-    const [redoStack, setRedoStack] = useState([]);
+    // Server-side audit filters, paging cursor and a counter that triggers a reload
+    const [auditFilters, setAuditFilters] = useState({ user: '', action: '', cell: '', q: '' });
+    const [auditNextBefore, setAuditNextBefore] = useState(0);
+    const [auditTotal, setAuditTotal] = useState(0);
+    const [auditRefreshKey, setAuditRefreshKey] = useState(0);
+    const [isLoadingAudit, setIsLoadingAudit] = useState(false);
+    // What the server can undo/redo for this user, from UNDO_STATE
+    const [undoState, setUndoState] = useState({ can_undo: false, can_redo: false });
     // Preserve audit log scroll position across open/close
     const auditLogRef = useRef(null);
     const auditLogScrollTopRef = useRef(0);
     // Tracks whether a delete-before-event audit purge is in progress
     const [isDeletingAuditLogs, setIsDeletingAuditLogs] = useState(false);
+    // Point-in-time history panel
+    const [isHistoryOpen, setIsHistoryOpen] = useState(false);
+    const [isVersionsOpen, setIsVersionsOpen] = useState(false);
+    const [isProtectedOpen, setIsProtectedOpen] = useState(false);
+    // Protected ranges of the sheet, and the warn-only ones we were already warned about
+    const [protectedRanges, setProtectedRanges] = useState([]);
+    const warnedRangesRef = useRef(new Set());
+    // Comment threads of the sheet, and the cell the comments panel shows
+    const [isCommentsOpen, setIsCommentsOpen] = useState(false);
+    const [commentThreads, setCommentThreads] = useState([]);
+    const [commentCell, setCommentCell] = useState(null);
+    const commentCellKeys = useMemo(() => threadCellKeys(commentThreads, data), [commentThreads, data]);
+    const commentsByCell = useMemo(() => threadsByCell(commentThreads, commentCellKeys), [commentThreads, commentCellKeys]);
+    const [unreadNotifications, setUnreadNotifications] = useState(0);
     const editingOriginalValueRef = useRef(null);
     const editingOriginalScriptRef = useRef(null);
 
@@ -352,6 +395,28 @@ export default function Document() {
 
     const closeContextMenu = () => setContextMenu({ visible: false, x: 0, y: 0, cell: null });
 
+    // Comments change over the WebSocket; the server sends the thread back to everyone
+    const sendComment = (type, payload) => {
+        if (ws.current && ws.current.readyState === WebSocket.OPEN) {
+            ws.current.send(JSON.stringify({ type, sheet_name: id, payload }));
+        }
+    };
+    const openComments = (cell) => {
+        closeDiffPanel();
+        setIsHistoryOpen(false);
+        setIsVersionsOpen(false);
+        setIsProtectedOpen(false);
+        setCommentCell(cell);
+        setIsCommentsOpen(true);
+    };
+    // Watch the selection if cell is in it, else cell; the whole sheet without a cell
+    const watchCells = async (cell) => {
+        let range = '';
+        if (cell) range = isCellSelected(cell.row, cell.col) ? rangeOfCells(selectedRange) : `${cell.col}${cell.row}`;
+        const err = await addWatch(projectName, id, range);
+        alert(err || `Watching ${range ? `${range} of ` : ''}${id}. You will be notified when someone else changes it.`);
+    };
+
     const showContextMenu = (e, rowLabel, colLabel) => {
         e.preventDefault();
         // Close other popups first
@@ -504,14 +569,10 @@ export default function Document() {
             return next;
         });
 
-        // Record paste operation for undo/redo as a single batch
-        if (changes.length > 0) {
-            setUndoStack(prev => [...prev, { type: 'paste', changes }]);
-            setRedoStack([]);
-        }
-
         // Broadcast each cell update to server
         if (ws.current && ws.current.readyState === WebSocket.OPEN) {
+            // One undo step for the whole paste
+            const undo_group = `paste-${Date.now()}`;
             // Send cell type updates first
             Object.entries(cellTypeUpdates).forEach(([key, cell]) => {
                 const [rowStr, colLabel] = key.split('-');
@@ -521,21 +582,22 @@ export default function Document() {
                     cell_type: cell.cellType, 
                     options: cell.options,
                     options_range: cell.optionsRange,
-                    user: username 
+                    user: username,
+                    undo_group
                 };
                 ws.current.send(JSON.stringify({ type: 'UPDATE_CELL_TYPE', sheet_name: id, payload }));
             });
             // Send script updates after cell type; backend will execute and broadcast updated values
             Object.entries(scriptUpdates).forEach(([key, cell]) => {
                 const [rowStr, colLabel] = key.split('-');
-                const payload = { row: rowStr, col: colLabel, script: cell.script, user: username };
+                const payload = { row: rowStr, col: colLabel, script: cell.script, user: username, undo_group };
                 ws.current.send(JSON.stringify({ type: 'UPDATE_CELL_SCRIPT', sheet_name: id, payload }));
             });
             // Send value updates for cells without scripts in source
             Object.entries(updates).forEach(([key, cell]) => {
                 if (scriptUpdates[key]) return; // skip value update if a script will define the value
                 const [rowStr, colLabel] = key.split('-');
-                const payload = { row: rowStr, col: colLabel, value: cell.value, user: username };
+                const payload = { row: rowStr, col: colLabel, value: cell.value, user: username, undo_group };
                 ws.current.send(JSON.stringify({ type: 'UPDATE_CELL', sheet_name: id, payload }));
             });
             // Send AI prompt updates for cells that have a prompt in the copied block
@@ -544,7 +606,7 @@ export default function Document() {
                     ws.current.send(JSON.stringify({
                         type: 'UPDATE_AI_PROMPT',
                         sheet_name: id,
-                        payload: { row: String(ch.row), col: String(ch.col), prompt: ch.newAiPrompt, user: username }
+                        payload: { row: String(ch.row), col: String(ch.col), prompt: ch.newAiPrompt, user: username, undo_group }
                     }));
                 }
             });
@@ -554,6 +616,11 @@ export default function Document() {
     };
 
     const ws = useRef(null);
+    // Sheet revision of the last update received; sent with each edit so the
+    // server can move it past rows and columns others shifted meanwhile
+    const revisionRef = useRef(0);
+    // Last DELETE_ROW/DELETE_COL payload, retried with a mode if refused as referenced
+    const pendingDeleteRef = useRef(null);
 
     // Viewport state for virtualized grid
     const [cellModified, setCellModified] = useState(0);
@@ -743,14 +810,13 @@ export default function Document() {
     const saveAIPrompt = () => {
         if (!aiPromptDialogCell || !ws.current || ws.current.readyState !== WebSocket.OPEN) return;
         const { row, col } = aiPromptDialogCell;
-        const oldPrompt = aiPromptOriginalRef.current;
         const newPrompt = aiPromptText;
         ws.current.send(JSON.stringify({
             type: 'UPDATE_AI_PROMPT',
             sheet_name: id,
             payload: { row: String(row), col: String(col), prompt: newPrompt, user: username }
         }));
-        // Update local data state so undo/redo can restore without a round-trip
+        // Update local data state without waiting for the round-trip
         setData(prev => ({
             ...prev,
             [`${row}-${col}`]: {
@@ -759,11 +825,6 @@ export default function Document() {
                 user: username,
             }
         }));
-        // Push to undo stack (only when the prompt actually changed)
-        if (oldPrompt !== newPrompt) {
-            setUndoStack(prev => [...prev, { type: 'ai_prompt', row, col, oldValue: oldPrompt, newValue: newPrompt }]);
-            setRedoStack([]);
-        }
         setShowAIPromptDialog(false);
         setAIPromptDialogCell(null);
     };
@@ -1254,18 +1315,6 @@ export default function Document() {
             return;
         }
         
-        // Add to undo stack
-        setUndoStack(prev => [...prev, {
-            type: 'option_selection',
-            row: String(row),
-            col: String(col),
-            oldValue,
-            newValue,
-            oldSelected,
-            newSelected: selectedOptions
-        }]);
-        setRedoStack([]);
-        
         // Update local state
         setData(prev => ({
             ...prev,
@@ -1376,7 +1425,15 @@ export default function Document() {
             const wsBase = httpBase
                 ? httpBase.replace(/^http/, 'ws')
                 : `${window.location.protocol === 'https:' ? 'wss' : 'ws'}://${window.location.host}`;
-            const socket = new WebSocket(`${wsBase}/ws?user=${encodeURIComponent(username)}&id=${id}${projQS}`);
+            // Large sheets arrive PAGE_ROWS rows at a time; on reconnect only
+            // the changes since the last revision seen are sent
+            const sinceQS = revisionRef.current ? `&since=${revisionRef.current}` : '';
+            const socket = new WebSocket(`${wsBase}/ws?token=${encodeURIComponent(getAuthToken() || '')}&id=${id}${projQS}&page_rows=${PAGE_ROWS}${sinceQS}`);
+            const sendRaw = socket.send.bind(socket);
+            socket.send = (data) => {
+                const out = JSON.parse(data);
+                sendRaw(JSON.stringify(revisionRef.current ? { ...out, base_revision: revisionRef.current } : out));
+            };
 
             socket.onopen = () => {
                 console.log('Connected to WS');
@@ -1442,8 +1499,14 @@ export default function Document() {
                     const parsedMessages = messages.length > 0 ? messages.map(m => JSON.parse(m)) : [JSON.parse(raw)];
 
                     parsedMessages.forEach((msg) => {
+                    if (msg.revision) {
+                        revisionRef.current = msg.revision;
+                    }
                     if (msg.type === 'INIT') {
                         setInitialState(msg.payload);
+                        if (msg.payload?.row_count > msg.payload?.to_row) {
+                            socket.send(JSON.stringify({ type: 'LOAD_ROWS', sheet_name: id, payload: { from: msg.payload.to_row + 1 } }));
+                        }
                     } else if (msg.type === 'UPDATE_CELL') {
                         const { row, col, value, user } = msg.payload;
                         updateCellState(row, col, value, user);
@@ -1463,6 +1526,12 @@ export default function Document() {
                         setInitialState(msg.payload);
                     } else if (msg.type === 'ROW_COL_UPDATED') {
                         setInitialState(msg.payload);
+                    } else if (msg.type === 'SHEET_PATCH') {
+                        applyPatch(msg.payload);
+                        pendingCellNameRef.current = null;
+                    } else if (msg.type === 'SHEET_ROWS') {
+                        const rows = flattenRows(msg.payload?.data);
+                        setData(prev => ({ ...prev, ...rows }));
                     } else if (msg.type === 'CHAT_HISTORY') {
                         const list = Array.isArray(msg.payload) ? msg.payload : [];
                         //console.log("Chat history:", list);
@@ -1496,13 +1565,40 @@ export default function Document() {
                                 rangeText,
                             }); 
                         }
+                    } else if (msg.type === 'COMMENT_THREADS') {
+                        setCommentThreads(Array.isArray(msg.payload) ? msg.payload : []);
+                    } else if (msg.type === 'COMMENT_THREAD') {
+                        if (msg.payload?.id) setCommentThreads(prev => upsertThread(prev, msg.payload));
+                    } else if (msg.type === 'COMMENT_THREAD_REMOVED') {
+                        setCommentThreads(prev => prev.filter(t => t.id !== msg.payload?.id));
+                    } else if (msg.type === 'NOTIFICATION') {
+                        setUnreadNotifications(msg.payload?.unread || 0);
+                    } else if (msg.type === 'GROUPS_CHANGED') {
+                        fetchGroups().then(setAllGroups);
+                    } else if (msg.type === 'UNDO_STATE') {
+                        setUndoState(msg.payload || { can_undo: false, can_redo: false });
+                    } else if (msg.type === 'UNDO_CONFLICT') {
+                        handleUndoConflict(msg.payload || {});
                     } else if (msg.type === 'PONG') {
                         console.log("Received PONG from server");
                         setConnected(true);setIsEditing(true);
                     } else if (msg.type === 'EDIT_DENIED') {
                         // Optional UX: show a brief warning when non-editor attempts edit
-                        if (!canEdit) {
+                        if (msg.payload?.reason === 'stale') {
+                            // The rows or columns of the edit were deleted meanwhile; INIT follows
+                            console.warn('Edit refused as stale:', msg.payload.type);
+                        } else if (msg.payload?.reason === 'restoring') {
+                            alert('A backup is being restored; your change was not saved. The sheet reloads when the restore is done.');
+                        } else if (msg.payload?.reason === 'not-commenter') {
+                            alert('You are not allowed to comment on this sheet.');
+                        } else if (msg.payload?.reason === 'comment') {
+                            alert(`Comment error: ${msg.payload.error}`);
+                        } else if (!canEdit) {
                             alert('You are not allowed to edit this sheet.');
+                        } else if (msg.payload?.reason === 'protected') {
+                            alert(`${msg.payload.name ? `${msg.payload.name} (${msg.payload.range})` : msg.payload.range} is protected; only its editors may change it.`);
+                        } else if (msg.payload?.reason === 'referenced') {
+                            retryReferencedDelete(msg.payload);
                         }
                     }
                     });
@@ -1512,9 +1608,27 @@ export default function Document() {
                 }
             };
 
-            socket.onclose = () => {
+            socket.onclose = (event) => {
                 setConnected(false); setIsEditing(false); setIsDoubleClicked(false);
                 console.log('Disconnected from WS');
+                if (event.code === 4403) {
+                    // The sheet is no longer shared with us
+                    shouldReconnect = false;
+                    alert('You no longer have access to this sheet.');
+                    navigate('/projects');
+                    return;
+                }
+                if (event.code === 4401 && shouldReconnect) {
+                    // Session token expired: renew it before reconnecting
+                    refreshSession().then(ok => {
+                        if (!ok) {
+                            handleUnauthorized();
+                        } else if (shouldReconnect) {
+                            connectWS();
+                        }
+                    });
+                    return;
+                }
                 if (shouldReconnect) {
                     // Try to reconnect after 2 seconds
                     reconnectTimeout = setTimeout(() => {
@@ -1533,6 +1647,8 @@ export default function Document() {
             ws.current = socket;
         }
 
+        // Revisions are per sheet; start this one from a full snapshot
+        revisionRef.current = 0;
         connectWS();
 
         // Fetch users for chat recipient dropdown
@@ -1550,6 +1666,8 @@ export default function Document() {
             } catch (e) {
                 // ignore fetch errors in chat recipients
             }
+            setAllGroups(await fetchGroups());
+            setUnreadNotifications(await fetchUnreadCount());
         })();
 
         return () => {
@@ -1572,9 +1690,7 @@ export default function Document() {
             });
         }
         setData(newData);
-        if (sheet.audit_log) {
-            setAuditLog(sheet.audit_log);
-        }
+        setAuditRefreshKey(k => k + 1);
         setSheetName(id);
         if (sheet.project_name) {
             setProjectName(sheet.project_name);
@@ -1583,6 +1699,7 @@ export default function Document() {
             setOwner(sheet.owner);
         }
         setIsCorrupt(!!sheet.read_only);
+        setProtectedRanges(sheet.protected_ranges || []);
         if (sheet.permissions && Array.isArray(sheet.permissions.editors)) {
             setEditors(sheet.permissions.editors);
         }
@@ -1604,6 +1721,27 @@ export default function Document() {
         setSectionScheme(sheet.section_scheme || '');
     };
 
+    // Apply a SHEET_PATCH, the changes between two revisions of the sheet
+    const applyPatch = (patch) => {
+        setData(prev => applySheetPatch({ data: prev }, patch).data);
+        setColWidths(prev => applySheetPatch({ colWidths: prev }, patch).colWidths);
+        setRowHeights(prev => applySheetPatch({ rowHeights: prev }, patch).rowHeights);
+        setRowParents(prev => applySheetPatch({ rowParents: prev }, patch).rowParents);
+        setAuditRefreshKey(k => k + 1);
+        if (patch.owner) {
+            setOwner(patch.owner);
+        }
+        if (patch.permissions && Array.isArray(patch.permissions.editors)) {
+            setEditors(patch.permissions.editors);
+        }
+        if ('protected_ranges' in patch) {
+            setProtectedRanges(patch.protected_ranges || []);
+        }
+        if (patch.section_scheme !== undefined) {
+            setSectionScheme(patch.section_scheme);
+        }
+    };
+
     const updateCellState = (row, col, value, user) => {
         setData(prev => ({
             ...prev,
@@ -1648,13 +1786,6 @@ export default function Document() {
         //updateCellState(String(r), String(c), value, username);
         //send update to server only if changed
         if (cellModified === 0) { return; }
-        // Capture undo action if the value changed
-        const oldValue = (editingOriginalValueRef.current ?? '').toString();
-        const newValue = (value ?? '').toString();
-        if (oldValue !== newValue) {
-            setUndoStack(prev => [...prev, { type: 'cell_edit', row: String(r), col: String(c), oldValue, newValue }]);
-            setRedoStack([]);
-        }
         // Send to WB
         if (canEdit && ws.current && ws.current.readyState === WebSocket.OPEN) {
             const msg = {
@@ -1670,13 +1801,6 @@ export default function Document() {
 
     const handleScriptChange = (r, c, script, rowSpan = 1, colSpan = 1, showAsOutput = false) => {
         //if (scriptModified === 0) { return; } //non-blocking for scripts
-        const key = `${r}-${c}`;
-        const oldScript = (editingOriginalScriptRef.current ?? (data[key]?.script ?? '')).toString();
-        const newScript = (script ?? '').toString();
-        if (oldScript !== newScript) {
-            setUndoStack(prev => [...prev, { type: 'cell_script', row: String(r), col: String(c), oldValue: oldScript, newValue: newScript }]);
-            setRedoStack([]);
-        }
         console.log('Submitting script change:', { r, c, script });
         if (canEdit && ws.current && ws.current.readyState === WebSocket.OPEN) {
             console.log('WS sending script update');
@@ -1691,266 +1815,44 @@ export default function Document() {
         editingOriginalScriptRef.current = null;
     };
 
-    // Returns a human-readable label for a stack entry (used in button tooltips/labels)
-    const stackEntryLabel = (entry) => {
-        if (!entry) return '';
-        switch (entry.type) {
-            case 'cell_edit': return `Edit ${entry.col}${entry.row}`;
-            case 'cell_script': return `Script ${entry.col}${entry.row}`;
-            case 'paste': return 'Paste';
-            case 'option_selection': return `Option ${entry.col}${entry.row}`;
-            case 'ai_prompt': return `AI Prompt ${entry.col}${entry.row}`;
-            default: return entry.type;
-        }
+    // Undo/redo run on the server, which keeps a stack per user and sheet and
+    // reverts the user's own edits even after others changed the sheet.
+    const sendUndo = (type, force = false) => {
+        if (!ws.current || ws.current.readyState !== WebSocket.OPEN) return;
+        closeAllPopups();
+        ws.current.send(JSON.stringify({ type, sheet_name: id, payload: force ? { force: true } : {}, user: username }));
     };
 
     const doUndo = () => {
-        if (undoStack.length === 0 || !canEdit) return;
-        closeAllPopups();
-        const last = undoStack[undoStack.length - 1];
-        if (last.type === 'cell_edit') {
-            const { row, col, oldValue, newValue } = last;
-            // Apply local state
-            updateCellState(row, col, oldValue, username);
-            // Send to server
-            if (ws.current && ws.current.readyState === WebSocket.OPEN) {
-                ws.current.send(JSON.stringify({ type: 'UPDATE_CELL', sheet_name: id, payload: { row, col, value: oldValue, user: username } }));
-            }
-            // Move to redo stack
-            setRedoStack(prev => [...prev, last]);
-            setUndoStack(prev => prev.slice(0, -1));
-        } else if (last.type === 'paste') {
-            const { changes } = last;
-            // Apply local state for all changes (restore old values and metadata)
-            setData(prev => {
-                const next = { ...prev };
-                for (const ch of changes) {
-                    const key = `${ch.row}-${ch.col}`;
-                    next[key] = { 
-                        ...(next[key] || {}), 
-                        value: ch.oldValue, 
-                        cell_type: ch.oldCellType ?? 0,
-                        options: ch.oldOptions ?? [],
-                        options_range: ch.oldOptionsRange ?? '',
-                        option_selected: ch.oldOptionSelected ?? [],
-                        ai_prompt: ch.oldAiPrompt ?? '',
-                        user: username 
-                    };
-                }
-                return next;
-            });
-            // Send revert updates to server for all changes
-            if (ws.current && ws.current.readyState === WebSocket.OPEN) {
-                for (const ch of changes) {
-                    // Send cell type update if it changed
-                    const hasCellTypeChange = (ch.newCellType ?? 0) !== (ch.oldCellType ?? 0) || 
-                        JSON.stringify(ch.newOptions ?? []) !== JSON.stringify(ch.oldOptions ?? []) || 
-                        (ch.newOptionsRange ?? '') !== (ch.oldOptionsRange ?? '');
-                    if (hasCellTypeChange) {
-                        ws.current.send(JSON.stringify({ 
-                            type: 'UPDATE_CELL_TYPE', 
-                            sheet_name: id, 
-                            payload: { 
-                                row: String(ch.row), 
-                                col: String(ch.col), 
-                                cell_type: ch.oldCellType ?? 0,
-                                options: ch.oldOptions ?? [],
-                                options_range: ch.oldOptionsRange ?? '',
-                                user: username 
-                            } 
-                        }));
-                    }
-                    // Send value update
-                    ws.current.send(JSON.stringify({ type: 'UPDATE_CELL', sheet_name: id, payload: { row: String(ch.row), col: String(ch.col), value: ch.oldValue, user: username } }));
-                    // Restore AI prompt
-                    if (ch.oldAiPrompt !== undefined) {
-                        ws.current.send(JSON.stringify({
-                            type: 'UPDATE_AI_PROMPT',
-                            sheet_name: id,
-                            payload: { row: String(ch.row), col: String(ch.col), prompt: ch.oldAiPrompt, user: username }
-                        }));
-                    }
-                }
-            }
-            setRedoStack(prev => [...prev, last]);
-            setUndoStack(prev => prev.slice(0, -1));
-        } else if (last.type === 'cell_script') {
-            const { row, col, oldValue } = last;
-            // Apply local state
-            updateCellScriptState(row, col, oldValue, username);
-            // Send to server
-            if (ws.current && ws.current.readyState === WebSocket.OPEN) {
-                ws.current.send(JSON.stringify({ type: 'UPDATE_CELL_SCRIPT', sheet_name: id, payload: { row, col, script: oldValue, user: username} }));
-            }
-            setRedoStack(prev => [...prev, last]);
-            setUndoStack(prev => prev.slice(0, -1));
-        } else if (last.type === 'option_selection') {
-            const { row, col, oldValue, oldSelected } = last;
-            const key = `${row}-${col}`;
-            // Apply local state
-            setData(prev => ({
-                ...prev,
-                [key]: {
-                    ...(prev[key] || {}),
-                    value: oldValue,
-                    option_selected: oldSelected,
-                    user: username
-                }
-            }));
-            // Send to server
-            if (ws.current && ws.current.readyState === WebSocket.OPEN) {
-                ws.current.send(JSON.stringify({
-                    type: 'UPDATE_CELL_OPTIONS',
-                    sheet_name: id,
-                    payload: { row, col, value: oldValue, option_selected: oldSelected, user: username }
-                }));
-            }
-            setRedoStack(prev => [...prev, last]);
-            setUndoStack(prev => prev.slice(0, -1));
-        } else if (last.type === 'ai_prompt') {
-            const { row, col, oldValue } = last;
-            // Restore old prompt in local data state
-            setData(prev => ({
-                ...prev,
-                [`${row}-${col}`]: {
-                    ...(prev[`${row}-${col}`] || {}),
-                    ai_prompt: oldValue,
-                    user: username,
-                }
-            }));
-            // Send to server
-            if (ws.current && ws.current.readyState === WebSocket.OPEN) {
-                ws.current.send(JSON.stringify({
-                    type: 'UPDATE_AI_PROMPT',
-                    sheet_name: id,
-                    payload: { row: String(row), col: String(col), prompt: oldValue, user: username }
-                }));
-            }
-            setRedoStack(prev => [...prev, last]);
-            setUndoStack(prev => prev.slice(0, -1));
-        }
+        if (!undoState.can_undo || !canEdit) return;
+        sendUndo('UNDO');
     };
 
     const doRedo = () => {
-        if (redoStack.length === 0 || !canEdit) return;
-        closeAllPopups();
-        const last = redoStack[redoStack.length - 1];
-        if (last.type === 'cell_edit') {
-            const { row, col, oldValue, newValue } = last;
-            updateCellState(row, col, newValue, username);
-            if (ws.current && ws.current.readyState === WebSocket.OPEN) {
-                ws.current.send(JSON.stringify({ type: 'UPDATE_CELL', sheet_name: id, payload: { row, col, value: newValue, user: username } }));
-            }
-            setUndoStack(prev => [...prev, last]);
-            setRedoStack(prev => prev.slice(0, -1));
-        } else if (last.type === 'paste') {
-            const { changes } = last;
-            // Apply local state for all changes (reapply new values and metadata)
-            setData(prev => {
-                const next = { ...prev };
-                for (const ch of changes) {
-                    const key = `${ch.row}-${ch.col}`;
-                    next[key] = { 
-                        ...(next[key] || {}), 
-                        value: ch.newValue, 
-                        cell_type: ch.newCellType ?? 0,
-                        options: ch.newOptions ?? [],
-                        options_range: ch.newOptionsRange ?? '',
-                        option_selected: ch.newOptionSelected ?? [],
-                        ai_prompt: ch.newAiPrompt ?? '',
-                        user: username 
-                    };
-                }
-                return next;
-            });
-            // Send updates to server for all changes
-            if (ws.current && ws.current.readyState === WebSocket.OPEN) {
-                for (const ch of changes) {
-                    // Send cell type update if it changed
-                    const hasCellTypeChange = (ch.newCellType ?? 0) !== (ch.oldCellType ?? 0) || 
-                        JSON.stringify(ch.newOptions ?? []) !== JSON.stringify(ch.oldOptions ?? []) || 
-                        (ch.newOptionsRange ?? '') !== (ch.oldOptionsRange ?? '');
-                    if (hasCellTypeChange) {
-                        ws.current.send(JSON.stringify({ 
-                            type: 'UPDATE_CELL_TYPE', 
-                            sheet_name: id, 
-                            payload: { 
-                                row: String(ch.row), 
-                                col: String(ch.col), 
-                                cell_type: ch.newCellType ?? 0,
-                                options: ch.newOptions ?? [],
-                                options_range: ch.newOptionsRange ?? '',
-                                user: username 
-                            } 
-                        }));
-                    }
-                    // Send value update
-                    ws.current.send(JSON.stringify({ type: 'UPDATE_CELL', sheet_name: id, payload: { row: String(ch.row), col: String(ch.col), value: ch.newValue, user: username } }));
-                    // Reapply AI prompt
-                    if (ch.newAiPrompt !== undefined) {
-                        ws.current.send(JSON.stringify({
-                            type: 'UPDATE_AI_PROMPT',
-                            sheet_name: id,
-                            payload: { row: String(ch.row), col: String(ch.col), prompt: ch.newAiPrompt, user: username }
-                        }));
-                    }
-                }
-            }
-            setUndoStack(prev => [...prev, last]);
-            setRedoStack(prev => prev.slice(0, -1));
-        } else if (last.type === 'cell_script') {
-            const { row, col, oldValue, newValue } = last;
-            updateCellScriptState(row, col, newValue, username);
-            if (ws.current && ws.current.readyState === WebSocket.OPEN) {
-                ws.current.send(JSON.stringify({ type: 'UPDATE_CELL_SCRIPT', sheet_name: id, payload: { row, col, script: newValue, user: username } }));
-            }
-            setUndoStack(prev => [...prev, last]);
-            setRedoStack(prev => prev.slice(0, -1));
-        } else if (last.type === 'option_selection') {
-            const { row, col, newValue, newSelected } = last;
-            const key = `${row}-${col}`;
-            // Apply local state
-            setData(prev => ({
-                ...prev,
-                [key]: {
-                    ...(prev[key] || {}),
-                    value: newValue,
-                    option_selected: newSelected,
-                    user: username
-                }
-            }));
-            // Send to server
-            if (ws.current && ws.current.readyState === WebSocket.OPEN) {
-                ws.current.send(JSON.stringify({
-                    type: 'UPDATE_CELL_OPTIONS',
-                    sheet_name: id,
-                    payload: { row, col, value: newValue, option_selected: newSelected, user: username }
-                }));
-            }
-            setUndoStack(prev => [...prev, last]);
-            setRedoStack(prev => prev.slice(0, -1));
-        } else if (last.type === 'ai_prompt') {
-            const { row, col, newValue } = last;
-            // Reapply new prompt in local data state
-            setData(prev => ({
-                ...prev,
-                [`${row}-${col}`]: {
-                    ...(prev[`${row}-${col}`] || {}),
-                    ai_prompt: newValue,
-                    user: username,
-                }
-            }));
-            // Send to server
-            if (ws.current && ws.current.readyState === WebSocket.OPEN) {
-                ws.current.send(JSON.stringify({
-                    type: 'UPDATE_AI_PROMPT',
-                    sheet_name: id,
-                    payload: { row: String(row), col: String(col), prompt: newValue, user: username }
-                }));
+        if (!undoState.can_redo || !canEdit) return;
+        sendUndo('REDO');
+    };
+
+    const undoConflictReasons = {
+        locked: 'a cell it touches is locked',
+        protected: 'it touches a range protected from you',
+        'owner-only': 'only the cell owner may change it now',
+        'name-taken': 'its cell name is now used by another cell',
+        gone: 'the cells it changed were deleted',
+    };
+
+    // Asks before overwriting cells others changed since; other conflicts drop the edit
+    const handleUndoConflict = ({ type, conflict }) => {
+        if (!conflict) return;
+        const verb = type === 'REDO' ? 'redo' : 'undo';
+        if (conflict.reason === 'changed' && !conflict.dropped) {
+            const where = conflict.cells?.length ? ` (${conflict.cells.join(', ')})` : '';
+            if (window.confirm(`"${conflict.label}" was changed by someone else since${where}. ${verb[0].toUpperCase() + verb.slice(1)} anyway and overwrite their changes?`)) {
+                sendUndo(type, true);
             }
-            setUndoStack(prev => [...prev, last]);
-            setRedoStack(prev => prev.slice(0, -1));
+            return;
         }
+        alert(`Cannot ${verb} "${conflict.label}": ${undoConflictReasons[conflict.reason] || conflict.reason}.` + (conflict.dropped ? ' It was removed from your history.' : ''));
     };
 
     // Global keyboard shortcuts for undo/redo (when not editing within a cell)
@@ -1969,7 +1871,7 @@ export default function Document() {
         };
         window.addEventListener('keydown', onKeyDown);
         return () => window.removeEventListener('keydown', onKeyDown);
-    }, [isEditing, undoStack, redoStack, canEdit]);
+    }, [isEditing, undoState, canEdit]);
 
     const onGlobalMouseMove = (e) => {
         const { type, label, startPos, startSize } = dragRef.current || {};
@@ -2102,6 +2004,39 @@ export default function Document() {
         };
     }, [isSelecting]);
 
+    // Fetch one page of the audit log (newest first) with the sidebar filters;
+    // before=0 starts over, otherwise the page is appended.
+    const fetchAuditPage = async (before = 0) => {
+        const params = new URLSearchParams({ sheet_name: id, project: projectName || '', limit: '100' });
+        if (!showSystemLogs) params.set('exclude_user', 'system');
+        const filterEvent = filterAfterEventId ? timelineEntries.find(e => e.id === filterAfterEventId) : null;
+        if (filterEvent?.timestamp) params.set('from', new Date(filterEvent.timestamp).toISOString());
+        Object.entries(auditFilters).forEach(([k, v]) => { if (v.trim()) params.set(k, v.trim()); });
+        if (before) params.set('before', String(before));
+        setIsLoadingAudit(true);
+        try {
+            const res = await authenticatedFetch(apiUrl(`/api/sheet/audit?${params.toString()}`));
+            if (!res.ok) return;
+            const page = await res.json();
+            const entries = Array.isArray(page.entries) ? page.entries : [];
+            setAuditLog(prev => before ? [...prev, ...entries] : entries);
+            setAuditNextBefore(page.next_before || 0);
+            setAuditTotal(page.total || 0);
+        } catch (e) {
+            console.error('Failed to load audit log', e);
+        } finally {
+            setIsLoadingAudit(false);
+        }
+    };
+
+    // Reload the first page while the sidebar is open and the sheet or the
+    // filters change (typing is debounced)
+    useEffect(() => {
+        if (!isSidebarOpen || !id) return;
+        const t = setTimeout(() => fetchAuditPage(0), 300);
+        return () => clearTimeout(t);
+    }, [isSidebarOpen, id, projectName, showSystemLogs, filterAfterEventId, timelineEntries, auditFilters, auditRefreshKey]);
+
     // When sidebar opens, restore previous scroll position
     useEffect(() => {
         if (isSidebarOpen && auditLogRef.current) {
@@ -2529,6 +2464,7 @@ export default function Document() {
         }
         if (canEdit && ws.current && ws.current.readyState === WebSocket.OPEN) {
             const payload = { row: String(rowLabel), user: username };
+            pendingDeleteRef.current = payload;
             ws.current.send(JSON.stringify({ type: 'DELETE_ROW', sheet_name: id, payload }));
         }
     };
@@ -2540,10 +2476,22 @@ export default function Document() {
         }
         if (canEdit && ws.current && ws.current.readyState === WebSocket.OPEN) {
             const payload = { col: String(colLabel), user: username };
+            pendingDeleteRef.current = payload;
             ws.current.send(JSON.stringify({ type: 'DELETE_COL', sheet_name: id, payload }));
         }
     };
 
+    // A row/column delete was refused because other sheets reference it;
+    // let the user rewrite those references to values or force the delete.
+    const retryReferencedDelete = (denied) => {
+        const isRow = denied.type === 'DELETE_ROW';
+        const label = isRow ? pendingDeleteRef.current?.row : pendingDeleteRef.current?.col;
+        const mode = chooseDeleteMode(`${isRow ? 'Row' : 'Column'} ${label || ''}`.trim(), denied.references);
+        if (!mode || !label || !ws.current || ws.current.readyState !== WebSocket.OPEN) return;
+        const payload = isRow ? { row: label, user: username, mode } : { col: label, user: username, mode };
+        ws.current.send(JSON.stringify({ type: denied.type, sheet_name: id, payload }));
+    };
+
     // Delete all audit log entries before the selected timeline event (owner/admin only)
     const handleDeleteAuditBefore = async () => {
         if (!filterAfterEventId) return;
@@ -2566,10 +2514,7 @@ export default function Document() {
                 return;
             }
             const result = await res.json();
-            // Refetch the full sheet to get the updated audit log
-            authenticatedFetch(apiUrl(`/api/sheet?id=${encodeURIComponent(id)}&project=${encodeURIComponent(projectName)}`))
-                .then(r => r.ok ? r.json() : null)
-                .then(sheet => { if (sheet?.audit_log) setAuditLog(sheet.audit_log); });
+            setAuditRefreshKey(k => k + 1);
             alert(result.message || 'Audit logs deleted successfully.');
         } catch (e) {
             alert('Error deleting audit logs: ' + e.message);
@@ -2821,6 +2766,14 @@ export default function Document() {
                         >
                             <MessageSquare className="me-1" />Chat
                         </button>
+                        <button
+                            onClick={() => navigate('/notifications')}
+                            className="btn btn-outline-primary btn-sm d-flex align-items-center"
+                            title="Notifications"
+                        >
+                            <Bell size={14} className="me-1" />Notifications
+                            {unreadNotifications > 0 && <span className="badge bg-danger ms-1">{unreadNotifications}</span>}
+                        </button>
 
                     </span>
                     <div className="d-flex align-items-center ms-auto">
@@ -2855,20 +2808,20 @@ export default function Document() {
                         <button
                             className="px-2 py-1.5 text-sm rounded border border-gray-300 bg-white hover:bg-indigo-100 hover:shadow-md active:bg-indigo-200 active:scale-95 transition-all duration-100 flex items-center gap-1"
                             onClick={doUndo}
-                            disabled={!canEdit || undoStack.length === 0}
-                            title={undoStack.length > 0 ? `Undo: ${stackEntryLabel(undoStack[undoStack.length - 1])} (Ctrl+Z)` : 'Nothing to undo'}
+                            disabled={!canEdit || !undoState.can_undo}
+                            title={undoState.can_undo ? `Undo: ${undoState.undo} (Ctrl+Z)` : 'Nothing to undo'}
                         >
                             <Undo2 size={16} />
-                            <span>Undo{undoStack.length > 0 ? `: ${stackEntryLabel(undoStack[undoStack.length - 1])}` : ''}</span>
+                            <span>Undo{undoState.can_undo ? `: ${undoState.undo}` : ''}</span>
                         </button>
                         <button
                             className="px-2 py-1.5 text-sm rounded border border-gray-300 bg-white hover:bg-gray-100 flex items-center gap-1"
                             onClick={doRedo}
-                            disabled={!canEdit || redoStack.length === 0}
-                            title={redoStack.length > 0 ? `Redo: ${stackEntryLabel(redoStack[redoStack.length - 1])} (Ctrl+Y)` : 'Nothing to redo'}
+                            disabled={!canEdit || !undoState.can_redo}
+                            title={undoState.can_redo ? `Redo: ${undoState.redo} (Ctrl+Y)` : 'Nothing to redo'}
                         >
                             <Redo2 size={16} />
-                            <span>Redo{redoStack.length > 0 ? `: ${stackEntryLabel(redoStack[redoStack.length - 1])}` : ''}</span>
+                            <span>Redo{undoState.can_redo ? `: ${undoState.redo}` : ''}</span>
                         </button>
                         
 
@@ -2997,6 +2950,41 @@ export default function Document() {
                             <h5 className="mb-0 d-flex align-items-center">
                                 <History className="me-2" size={18} /> Activity Log
                             </h5>
+                            <button
+                                onClick={() => { closeDiffPanel(); setIsVersionsOpen(false); setIsProtectedOpen(false); setIsCommentsOpen(false); setIsHistoryOpen(open => !open); }}
+                                className={`btn btn-sm ms-auto me-1 ${isHistoryOpen ? 'btn-secondary' : 'btn-outline-secondary'}`}
+                                title="View, compare and restore the sheet as of an earlier time"
+                            >
+                                History
+                            </button>
+                            <button
+                                onClick={() => { closeDiffPanel(); setIsHistoryOpen(false); setIsProtectedOpen(false); setIsCommentsOpen(false); setIsVersionsOpen(open => !open); }}
+                                className={`btn btn-sm me-1 ${isVersionsOpen ? 'btn-secondary' : 'btn-outline-secondary'}`}
+                                title="Tag named versions, branch the sheet and merge branches"
+                            >
+                                Versions
+                            </button>
+                            <button
+                                onClick={() => { closeDiffPanel(); setIsHistoryOpen(false); setIsVersionsOpen(false); setIsCommentsOpen(false); setIsProtectedOpen(open => !open); }}
+                                className={`btn btn-sm me-1 ${isProtectedOpen ? 'btn-secondary' : 'btn-outline-secondary'}`}
+                                title="Limit who may edit ranges of the sheet"
+                            >
+                                <Shield size={14} />
+                            </button>
+                            <button
+                                onClick={() => (isCommentsOpen ? setIsCommentsOpen(false) : openComments(null))}
+                                className={`btn btn-sm me-1 ${isCommentsOpen ? 'btn-secondary' : 'btn-outline-secondary'}`}
+                                title="Comments on the sheet's cells"
+                            >
+                                <MessageSquare size={14} />
+                            </button>
+                            <button
+                                onClick={() => watchCells(null)}
+                                className="btn btn-sm btn-outline-secondary me-1"
+                                title="Watch the sheet: be notified when someone else changes it"
+                            >
+                                <Eye size={14} />
+                            </button>
                             <button
                                 onClick={closeSidebar}
                                 className="btn btn-sm btn-light"
@@ -3016,6 +3004,27 @@ export default function Document() {
                                 />
                                 Show system logs
                             </label>
+                            <div className="d-flex gap-1" style={{ fontSize: '0.78rem' }}>
+                                {[['user', 'User'], ['action', 'Action'], ['cell', 'Cell']].map(([key, label]) => (
+                                    <input
+                                        key={key}
+                                        type="text"
+                                        className="form-control form-control-sm"
+                                        placeholder={label}
+                                        value={auditFilters[key]}
+                                        onChange={(e) => setAuditFilters(f => ({ ...f, [key]: e.target.value }))}
+                                        style={{ fontSize: '0.78rem' }}
+                                    />
+                                ))}
+                            </div>
+                            <input
+                                type="search"
+                                className="form-control form-control-sm"
+                                placeholder="Search details and values"
+                                value={auditFilters.q}
+                                onChange={(e) => setAuditFilters(f => ({ ...f, q: e.target.value }))}
+                                style={{ fontSize: '0.78rem' }}
+                            />
                             {timelineEntries.length > 0 && (
                                 <div className="d-flex flex-column gap-1">
                                     <div className="d-flex align-items-center gap-1" style={{ fontSize: '0.8rem' }}>
@@ -3047,22 +3056,16 @@ export default function Document() {
                                     )}
                                 </div>
                             )}
-                            <div className="d-flex justify-content-end">
+                            <div className="d-flex justify-content-between align-items-center">
+                                <span className="text-muted" style={{ fontSize: '0.75rem' }}>
+                                    {isLoadingAudit ? 'Loading…' : `${auditLog.length} of ${auditTotal} entries`}
+                                </span>
                                 <button
                                     className="btn btn-outline-secondary btn-sm d-flex align-items-center gap-1"
                                     style={{ fontSize: '0.78rem' }}
                                     title="Download displayed logs as CSV"
                                     onClick={() => {
-                                        const filterEvent = filterAfterEventId ? timelineEntries.find(e => e.id === filterAfterEventId) : null;
-                                        const cutoff = filterEvent?.timestamp ? new Date(filterEvent.timestamp) : null;
-                                        const rows = auditLog.slice().reverse().filter(entry => {
-                                            if (!showSystemLogs && entry.user === 'system') return false;
-                                            if (cutoff) {
-                                                const ts = entry.timestamp ? new Date(entry.timestamp) : null;
-                                                if (!ts || ts < cutoff) return false;
-                                            }
-                                            return true;
-                                        });
+                                        const rows = auditLog;
                                         const header = ['Timestamp', 'User', 'Action', 'Details', 'Row', 'Col', 'Old Value', 'New Value'];
                                         const escape = v => '"' + String(v ?? '').replace(/"/g, '""') + '"';
                                         const csvContent = [header.map(escape).join(','), ...rows.map(e => [
@@ -3088,18 +3091,15 @@ export default function Document() {
                             {(() => {
                                 const filterEvent = filterAfterEventId ? timelineEntries.find(e => e.id === filterAfterEventId) : null;
                                 const cutoff = filterEvent?.timestamp ? new Date(filterEvent.timestamp) : null;
-                                const filteredLogs = auditLog.slice().reverse().filter(entry => {
-                                    if (!showSystemLogs && entry.user === 'system') return false;
-                                    if (cutoff) {
-                                        const ts = entry.timestamp ? new Date(entry.timestamp) : null;
-                                        if (!ts || ts < cutoff) return false;
-                                    }
-                                    return true;
-                                });
+                                // Entries arrive newest-first and already filtered by the server
+                                const filteredLogs = auditLog;
+                                // Markers older than the last loaded entry wait for the next page
+                                const oldest = auditNextBefore && auditLog.length ? new Date(auditLog[auditLog.length - 1].timestamp) : null;
                                 // Build combined list of audit entries + timeline event markers, sorted newest-first
                                 const sortedTimeline = [...timelineEntries]
                                     .filter(ev => ev.timestamp)
                                     .filter(ev => !cutoff || new Date(ev.timestamp) >= cutoff)
+                                    .filter(ev => !oldest || new Date(ev.timestamp) >= oldest)
                                     .sort((a, b) => new Date(b.timestamp) - new Date(a.timestamp));
                                 const combined = [];
                                 let tlIdx = 0;
@@ -3137,7 +3137,7 @@ export default function Document() {
                                 }
                                 const entry = item.entry;
                                 const ts = entry.timestamp ? new Date(entry.timestamp).toLocaleString() : '';
-                                const entryId = `${entry.timestamp || i}|${entry.user || ''}|${entry.action || ''}|${entry.details || ''}`;
+                                const entryId = String(entry.seq ?? i);
                                 const isSelected = selectedAuditId === entryId;
                                 const canRevert = (
                                     isOwner && 
@@ -3195,7 +3195,18 @@ export default function Document() {
                                     </div>
                                 );
                             })}
-                            {auditLog.length === 0 && (
+                            {auditNextBefore > 0 && (
+                                <div className="text-center">
+                                    <button
+                                        className="btn btn-sm btn-outline-secondary"
+                                        disabled={isLoadingAudit}
+                                        onClick={() => fetchAuditPage(auditNextBefore)}
+                                    >
+                                        {isLoadingAudit ? 'Loading…' : 'Load more'}
+                                    </button>
+                                </div>
+                            )}
+                            {auditLog.length === 0 && !isLoadingAudit && (
                                 <div className="text-center text-muted py-5">
                                     <History className="mb-2" size={48} opacity={1} />
                                     <p className="mb-0">No activity yet.</p>
@@ -3204,6 +3215,54 @@ export default function Document() {
                         </div>
                     </div>
                 )}
+                {isHistoryOpen && (
+                    <SheetHistoryPanel
+                        projectName={projectName}
+                        sheetName={id}
+                        timelineEntries={timelineEntries}
+                        canRestore={canEdit}
+                        onRestored={() => setAuditRefreshKey(k => k + 1)}
+                        onClose={() => setIsHistoryOpen(false)}
+                    />
+                )}
+                {isVersionsOpen && (
+                    <SheetVersionsPanel
+                        projectName={projectName}
+                        sheetName={id}
+                        canEdit={canEdit}
+                        onOpenSheet={(name) => {
+                            setIsVersionsOpen(false);
+                            navigate(`/document/${encodeURIComponent(name)}${projectName ? `?project=${encodeURIComponent(projectName)}` : ''}`);
+                        }}
+                        onChanged={() => setAuditRefreshKey(k => k + 1)}
+                        onClose={() => setIsVersionsOpen(false)}
+                    />
+                )}
+                {isProtectedOpen && (
+                    <ProtectedRangesPanel
+                        projectName={projectName}
+                        sheetName={id}
+                        ranges={protectedRanges}
+                        canManage={!!isOwner}
+                        initialRange={rangeOfCells(selectedRange)}
+                        onClose={() => setIsProtectedOpen(false)}
+                    />
+                )}
+                {isCommentsOpen && (
+                    <CommentsPanel
+                        projectName={projectName}
+                        sheetName={id}
+                        threads={commentThreads}
+                        cellKeys={commentCellKeys}
+                        focusCell={commentCell}
+                        username={username}
+                        connected={connected}
+                        onSend={sendComment}
+                        onJump={(row, col) => navigateToCell(Number(row), col)}
+                        onClearFocus={() => setCommentCell(null)}
+                        onClose={() => { setIsCommentsOpen(false); setCommentCell(null); }}
+                    />
+                )}
                 {diffPanel.visible && (
                     <div style={{ position: 'fixed', right: 392, top: 70, width: 700, zIndex: 1100 }}>
                         <div className="card shadow-sm">
@@ -3896,7 +3955,7 @@ export default function Document() {
 
                                                         data-row={rowLabel}
                                                         data-col={colLabel}
-                                                        readOnly={showScripts || !!cell.locked || !!cell.script || !canEdit || (!!parseSchemeParts(sectionScheme) && colLabel === COL_HEADERS[0] && rowLabel >= 2)}
+                                                        readOnly={showScripts || !!cell.locked || !!cell.script || !canEdit || protectionOf(rowLabel, colLabel).level === 'blocked' || (!!parseSchemeParts(sectionScheme) && colLabel === COL_HEADERS[0] && rowLabel >= 2)}
                                                         onFocus={() => {
                                                             setFocusedCell({ row: rowLabel, col: colLabel });
                                                             setIsEditing(false);
@@ -3907,7 +3966,7 @@ export default function Document() {
                                                         onDoubleClick={(e) => {
                                                             if (showScripts) return;
                                                             if (isEditing) return;
-                                                            if (cell.locked || !canEdit) return;
+                                                            if (cell.locked || !canEdit || !confirmProtected(rowLabel, colLabel)) return;
                                                             // If cell at second row is ComboBox or MultipleSelection, open option dialog of 2nd row
                                                             const row2Cell = data[`2-${colLabel}`] || {};
                                                             if (row2Cell.cell_type === 2 || row2Cell.cell_type === 3) {
@@ -3996,7 +4055,7 @@ export default function Document() {
                                                             const keys = ['ArrowUp','ArrowDown','ArrowLeft','ArrowRight','Enter'];
                                                             // Enter edit mode when typing any non-arrow key (including Enter)
                                                             if (!keys.includes(e.key)) {
-                                                                if (cell.locked) return;
+                                                                if (cell.locked || !confirmProtected(rowLabel, colLabel)) return;
                                                                 // If cell has a script, do not enter value edit mode
                                                                 if ((cell.script ?? '').toString().length > 0) return;
                                                                 if (connected) { closeAllPopups(); setIsEditing(true); 
@@ -4078,7 +4137,7 @@ export default function Document() {
                                                         onChange={(e) => {
                                                             if (showScripts) return;
                                                             // Update local state for textarea value
-                                                            if (cell.locked || cell.cell_type > 0 || !canEdit) return;
+                                                            if (cell.locked || cell.cell_type > 0 || !canEdit || protectionOf(rowLabel, colLabel).level === 'blocked') return;
                                                             if (connected)
                                                             updateCellState(rowLabel, colLabel, e.target.value);
                                                             setIsSelecting(false);
@@ -4090,7 +4149,7 @@ export default function Document() {
                                                             setIsEditing(false);
                                                             setIsDoubleClicked(false);
                                                             // Commit value to backend only on blur
-                                                            if (!cell.locked && (cell.script ?? '').toString().length === 0 && canEdit) handleCellChange(rowLabel, colLabel, e.target.value);
+                                                            if (!cell.locked && (cell.script ?? '').toString().length === 0 && canEdit && protectionOf(rowLabel, colLabel).level !== 'blocked') handleCellChange(rowLabel, colLabel, e.target.value);
                                                         }}
                                                     />
                                                     
@@ -4178,6 +4237,41 @@ export default function Document() {
                                                             <Lock size={12} color="#4b5563" />
                                                         </span>
                                                     )}
+                                                    {!cell.locked && protectionOf(rowLabel, colLabel).level && (
+                                                        <span
+                                                            title={`Protected: ${rangeTitle(protectionOf(rowLabel, colLabel).range)}`}
+                                                            style={{
+                                                                position: 'absolute',
+                                                                top: 2,
+                                                                right: 2,
+                                                                zIndex: 60,
+                                                                display: 'inline-flex',
+                                                                alignItems: 'center',
+                                                                lineHeight: 1,
+                                                                pointerEvents: 'none'
+                                                            }}
+                                                        >
+                                                            <Shield size={11} color={protectionOf(rowLabel, colLabel).level === 'blocked' ? '#4b5563' : '#d97706'} />
+                                                        </span>
+                                                    )}
+                                                    {commentsByCell[`${rowLabel}-${colLabel}`] && (
+                                                        <span
+                                                            title={`${commentsByCell[`${rowLabel}-${colLabel}`].length} comment thread(s)`}
+                                                            onClick={(e) => { e.stopPropagation(); openComments({ row: rowLabel, col: colLabel }); }}
+                                                            style={{
+                                                                position: 'absolute',
+                                                                bottom: 2,
+                                                                right: 2,
+                                                                zIndex: 60,
+                                                                display: 'inline-flex',
+                                                                alignItems: 'center',
+                                                                lineHeight: 1,
+                                                                cursor: 'pointer'
+                                                            }}
+                                                        >
+                                                            <MessageSquare size={11} color={commentsByCell[`${rowLabel}-${colLabel}`].some(t => !t.resolved) ? '#2563eb' : '#9ca3af'} />
+                                                        </span>
+                                                    )}
 
                                                         {/* Context Menu */}
                                                         {contextMenu.visible && (
@@ -4209,6 +4303,20 @@ export default function Document() {
                                                                         })()}
                                                                         </>
                                                                 )}
+                                                                        <button
+                                                                            className="block w-full text-left px-2 py-1 hover:bg-gray-100 rounded"
+                                                                            disabled={!contextMenu.cell}
+                                                                            onClick={() => { openComments(contextMenu.cell); closeContextMenu(); }}
+                                                                        >
+                                                                            Comment
+                                                                        </button>
+                                                                        <button
+                                                                            className="block w-full text-left px-2 py-1 hover:bg-gray-100 rounded"
+                                                                            disabled={!contextMenu.cell}
+                                                                            onClick={() => { watchCells(contextMenu.cell); closeContextMenu(); }}
+                                                                        >
+                                                                            Watch
+                                                                        </button>
                                                                         <button
                                                                             className="block w-full text-left px-2 py-1 hover:bg-gray-100 rounded"
                                                                             disabled={!copiedBlock || !contextMenu.cell}
@@ -4386,7 +4494,7 @@ export default function Document() {
                                 cellRow={mdPanelCell.row}
                                 cellCol={mdPanelCell.col}
                                 value={(data[`${mdPanelCell.row}-${mdPanelCell.col}`] || {}).value || ''}
-                                readOnly={mdPanelReadOnly || !canEdit || !!(data[`${mdPanelCell.row}-${mdPanelCell.col}`] || {}).locked}
+                                readOnly={mdPanelReadOnly || !canEdit || !!(data[`${mdPanelCell.row}-${mdPanelCell.col}`] || {}).locked || protectionOf(mdPanelCell.row, mdPanelCell.col).level === 'blocked'}
                                 project={projectName}
                                 onSave={(newValue) => {
                                     if (canEdit && ws.current && ws.current.readyState === WebSocket.OPEN) {
@@ -4707,6 +4815,9 @@ export default function Document() {
                                             {allUsers.map(u => (
                                                 <option key={u} value={u}>{u}</option>
                                             ))}
+                                            {allGroups.map(g => (
+                                                <option key={`group-${g.name}`} value={`${GROUP_PREFIX}${g.name}`}>{GROUP_PREFIX}{g.name}</option>
+                                            ))}
                                         </select>
                                         <input
                                             type="text"
@@ -0,0 +1,174 @@
+import React, { useEffect, useState } from 'react';
+import { useNavigate } from 'react-router-dom';
+import { authenticatedFetch, isSessionValid, clearAuth, getUsername, apiUrl, isAdmin } from '../utils/auth';
+import { fetchGroups, GROUP_PREFIX } from '../utils/groups';
+import { ArrowLeft, Users, User, Plus, Save, Trash2 } from 'lucide-react';
+
+const splitNames = (text) => text.split(',').map(n => n.trim()).filter(Boolean);
+
+export default function Groups() {
+  const navigate = useNavigate();
+  const username = getUsername();
+  const admin = isAdmin();
+
+  const [groups, setGroups] = useState([]);
+  const [newName, setNewName] = useState('');
+  const [newMembers, setNewMembers] = useState('');
+  // group name -> { owners, members } being edited, as comma separated text
+  const [drafts, setDrafts] = useState({});
+
+  const loadGroups = async () => {
+    const list = await fetchGroups();
+    setGroups(list);
+    setDrafts(Object.fromEntries(list.map(g => [g.name, { owners: g.owners.join(', '), members: g.members.join(', ') }])));
+  };
+
+  useEffect(() => {
+    if (!username || !isSessionValid()) {
+      clearAuth();
+      navigate('/');
+      return;
+    }
+    loadGroups();
+  }, [username, navigate]);
+
+  const canManage = (g) => admin || g.owners.includes(username);
+
+  const createGroup = async (e) => {
+    e.preventDefault();
+    if (!newName.trim()) return;
+    try {
+      const res = await authenticatedFetch(apiUrl('/api/groups'), {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ name: newName.trim(), members: splitNames(newMembers) }),
+      });
+      if (!res.ok) {
+        alert((await res.text()) || 'Failed to create group');
+        return;
+      }
+      setNewName('');
+      setNewMembers('');
+      loadGroups();
+    } catch (err) {
+      console.error('Create group error', err);
+    }
+  };
+
+  const saveGroup = async (g) => {
+    const draft = drafts[g.name];
+    try {
+      const res = await authenticatedFetch(apiUrl('/api/groups'), {
+        method: 'PUT',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ name: g.name, owners: splitNames(draft.owners), members: splitNames(draft.members) }),
+      });
+      if (!res.ok) {
+        alert((await res.text()) || 'Failed to update group');
+        return;
+      }
+      loadGroups();
+    } catch (err) {
+      console.error('Update group error', err);
+    }
+  };
+
+  const deleteGroup = async (g) => {
+    if (!window.confirm(`Delete group "${g.name}"? Sheets and projects that name ${GROUP_PREFIX}${g.name} will no longer give its members access.`)) return;
+    try {
+      const res = await authenticatedFetch(apiUrl(`/api/groups?name=${encodeURIComponent(g.name)}`), { method: 'DELETE' });
+      if (!res.ok) {
+        alert((await res.text()) || 'Failed to delete group');
+        return;
+      }
+      loadGroups();
+    } catch (err) {
+      console.error('Delete group error', err);
+    }
+  };
+
+  const setDraft = (name, field, value) => {
+    setDrafts(prev => ({ ...prev, [name]: { ...prev[name], [field]: value } }));
+  };
+
+  return (
+    <div className="min-h-screen bg-gray-50 flex flex-col font-sans text-gray-900">
+      <nav className="navbar navbar-expand-lg navbar-light" style={{ backgroundColor: 'skyblue' }}>
+        <div className="container-fluid">
+          <button onClick={() => navigate('/projects')} className="btn btn-outline-primary btn-sm d-flex align-items-center">
+            <ArrowLeft className="me-1" />
+          </button>
+          <span className="navbar-text ms-2 d-flex align-items-center fw-bold">
+            <Users className="me-2" /> Groups
+          </span>
+          <div className="ms-auto d-flex align-items-center">
+            <span className="navbar-text me-3 d-flex align-items-center">
+              <User className="me-1" /> {username}
+            </span>
+          </div>
+        </div>
+      </nav>
+
+      <main className="flex-1 max-w-4xl w-full mx-auto px-4 py-8">
+        <div className="bg-white border border-gray-200 rounded-2xl shadow-sm p-4">
+          <h5 className="mb-3">New Group</h5>
+          <p className="text-muted small">Use <code>{GROUP_PREFIX}name</code> wherever a username is asked for: sheet access, project admins and members, chat recipients.</p>
+          <form onSubmit={createGroup} className="row g-2 align-items-end">
+            <div className="col-12 col-md-4">
+              <label className="form-label small mb-0">Name</label>
+              <input className="form-control form-control-sm" value={newName} onChange={(e) => setNewName(e.target.value)} placeholder="e.g. engineering" />
+            </div>
+            <div className="col-12 col-md-6">
+              <label className="form-label small mb-0">Members (comma separated)</label>
+              <input className="form-control form-control-sm" value={newMembers} onChange={(e) => setNewMembers(e.target.value)} />
+            </div>
+            <div className="col-12 col-md-2 d-flex justify-content-end">
+              <button type="submit" className="btn btn-sm btn-outline-primary d-flex align-items-center" disabled={!newName.trim()}>
+                <Plus size={14} className="me-1" /> Create
+              </button>
+            </div>
+          </form>
+        </div>
+
+        {groups.length === 0 && <p className="text-muted mt-4">No groups yet.</p>}
+        {groups.map(g => (
+          <div key={g.name} className="bg-white border border-gray-200 rounded-2xl shadow-sm p-4 mt-4">
+            <div className="d-flex justify-content-between align-items-center mb-2">
+              <h5 className="mb-0">{GROUP_PREFIX}{g.name}</h5>
+              {canManage(g) && (
+                <button className="btn btn-sm btn-outline-danger d-flex align-items-center" onClick={() => deleteGroup(g)}>
+                  <Trash2 size={14} className="me-1" /> Delete
+                </button>
+              )}
+            </div>
+            <div className="mb-2">
+              <label className="form-label small mb-0">Owners</label>
+              <input
+                className="form-control form-control-sm"
+                value={drafts[g.name]?.owners || ''}
+                onChange={(e) => setDraft(g.name, 'owners', e.target.value)}
+                disabled={!canManage(g)}
+              />
+            </div>
+            <div className="mb-2">
+              <label className="form-label small mb-0">Members</label>
+              <input
+                className="form-control form-control-sm"
+                value={drafts[g.name]?.members || ''}
+                onChange={(e) => setDraft(g.name, 'members', e.target.value)}
+                disabled={!canManage(g)}
+              />
+            </div>
+            {canManage(g) && (
+              <div className="d-flex justify-content-end">
+                <button className="btn btn-sm btn-outline-primary d-flex align-items-center" onClick={() => saveGroup(g)}>
+                  <Save size={14} className="me-1" /> Save
+                </button>
+              </div>
+            )}
+          </div>
+        ))}
+      </main>
+    </div>
+  );
+}
@@ -1,12 +1,13 @@
 import React, { useState, useEffect } from 'react';
 import { useNavigate } from 'react-router-dom';
-import { apiUrl } from '../utils/auth';
+import { apiUrl, storeSession } from '../utils/auth';
 
 export default function Login() {
   const [username, setUsername] = useState('');
   const [password, setPassword] = useState('');
   const [isRegistering, setIsRegistering] = useState(false);
   const [showPassword, setShowPassword] = useState(false);
+  const [remember, setRemember] = useState(false);
   const [error, setError] = useState('');
   const [loading, setLoading] = useState(false);
   const [systemCorrupt, setSystemCorrupt] = useState(false);
@@ -44,7 +45,7 @@ export default function Login() {
       const res = await fetch(apiUrl(endpoint), {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
-        body: JSON.stringify({ username, password }),
+        body: JSON.stringify(isRegistering ? { username, password } : { username, password, remember }),
       });
 
       if (res.ok) {
@@ -55,10 +56,9 @@ export default function Login() {
           setPassword('');
         } else {
           const data = await res.json();
-          // Store token and login timestamp
-          localStorage.setItem('auth_token', data.token);
+          // Store tokens and session expiry
+          storeSession(data);
           localStorage.setItem('chat_username', data.username);
-          localStorage.setItem('login_time', new Date().getTime().toString());
           localStorage.setItem('is_admin', data.is_admin ? 'true' : 'false');
           localStorage.setItem('can_create_project', data.can_create_project ? 'true' : 'false');
           navigate('/projects');
@@ -159,6 +159,19 @@ export default function Login() {
 
         {/* Terms & Privacy Policy checkbox removed */}
 
+        {!isRegistering && (
+          <div className="form-check mb-3" style={{ maxWidth: '400px', margin: '0 auto' }}>
+            <input
+              type="checkbox"
+              id="remember"
+              className="form-check-input"
+              checked={remember}
+              onChange={(e) => setRemember(e.target.checked)}
+            />
+            <label htmlFor="remember" className="form-check-label">Remember me for 30 days</label>
+          </div>
+        )}
+
         
 
         <button
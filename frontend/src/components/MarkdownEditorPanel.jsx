@@ -3,6 +3,7 @@ import { marked } from 'marked';
 import { X, Eye, Edit3, Bold, Italic, Heading1, Heading2, Heading3, List, ListOrdered, Code, Link, Image, Quote, Minus, CheckSquare, Maximize2, Minimize2, Sigma, Table, FolderOpen, FileCode } from 'lucide-react';
 import AssetBrowser from './AssetBrowser';
 import PythonFileBrowser from './PythonFileBrowser';
+import { withAuthToken } from '../utils/auth';
 
 // Configure marked for safe rendering
 marked.setOptions({
@@ -506,7 +507,12 @@ export default function MarkdownEditorPanel({ cellRow, cellCol, value, onSave, o
 
     const getHtml = () => {
         try {
-            return { __html: marked.parse(content || '') };
+            // Uploaded files need the session token to load in <img> tags
+            const html = marked.parse(content || '').replace(
+                /(src=")([^"]*\/api\/(?:assets|python-files)\/serve\?[^"]*)"/g,
+                (_, attr, url) => `${attr}${withAuthToken(url)}"`
+            );
+            return { __html: html };
         } catch {
             return { __html: '<p class="text-danger">Error rendering markdown</p>' };
         }
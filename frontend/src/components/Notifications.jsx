@@ -0,0 +1,263 @@
+import React, { useEffect, useState } from 'react';
+import { useNavigate } from 'react-router-dom';
+import { authenticatedFetch, isSessionValid, clearAuth, getUsername, apiUrl } from '../utils/auth';
+import { notificationRoute } from '../utils/notifications';
+import { ArrowLeft, Bell, User, Eye, Trash2, Check, CheckCheck, Save, Send } from 'lucide-react';
+
+const KINDS = [
+  { key: 'mentions', label: 'Mentions', hint: '@name in chat or a comment' },
+  { key: 'watches', label: 'Watched cells and sheets', hint: 'someone else changes what you watch' },
+  { key: 'script_errors', label: 'Script errors', hint: 'a script fails in a sheet you own' },
+];
+
+const emptyPrefs = { email: '', webhook_url: '', mentions: {}, watches: {}, script_errors: {} };
+
+export default function Notifications() {
+  const navigate = useNavigate();
+  const username = getUsername();
+
+  const [notifications, setNotifications] = useState([]);
+  const [unread, setUnread] = useState(0);
+  const [unreadOnly, setUnreadOnly] = useState(false);
+  const [watches, setWatches] = useState([]);
+  const [prefs, setPrefs] = useState(emptyPrefs);
+  const [testResult, setTestResult] = useState(null);
+
+  const loadInbox = async () => {
+    try {
+      const res = await authenticatedFetch(apiUrl(`/api/notifications${unreadOnly ? '?unread=1' : ''}`));
+      if (!res.ok) return;
+      const body = await res.json();
+      setNotifications(body.notifications || []);
+      setUnread(body.unread || 0);
+    } catch (err) {
+      console.error('Load notifications error', err);
+    }
+  };
+
+  const loadWatches = async () => {
+    try {
+      const res = await authenticatedFetch(apiUrl('/api/notifications/watches'));
+      if (res.ok) setWatches((await res.json()).watches || []);
+    } catch (err) {
+      console.error('Load watches error', err);
+    }
+  };
+
+  const loadPrefs = async () => {
+    try {
+      const res = await authenticatedFetch(apiUrl('/api/user/preferences'));
+      if (res.ok) setPrefs({ ...emptyPrefs, ...((await res.json()).notifications || {}) });
+    } catch (err) {
+      console.error('Load preferences error', err);
+    }
+  };
+
+  useEffect(() => {
+    if (!username || !isSessionValid()) {
+      clearAuth();
+      navigate('/');
+      return;
+    }
+    loadWatches();
+    loadPrefs();
+  }, [username, navigate]);
+
+  useEffect(() => {
+    if (username) loadInbox();
+  }, [username, unreadOnly]);
+
+  const markRead = async (body) => {
+    try {
+      await authenticatedFetch(apiUrl('/api/notifications/read'), {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(body),
+      });
+      loadInbox();
+    } catch (err) {
+      console.error('Mark read error', err);
+    }
+  };
+
+  const removeNotification = async (query) => {
+    try {
+      await authenticatedFetch(apiUrl(`/api/notifications?${query}`), { method: 'DELETE' });
+      loadInbox();
+    } catch (err) {
+      console.error('Delete notification error', err);
+    }
+  };
+
+  const openNotification = (n) => {
+    if (!n.read) markRead({ ids: [n.id] });
+    const route = notificationRoute(n);
+    if (route) navigate(route);
+  };
+
+  const removeWatch = async (w) => {
+    try {
+      await authenticatedFetch(apiUrl(`/api/notifications/watches?id=${encodeURIComponent(w.id)}`), { method: 'DELETE' });
+      loadWatches();
+    } catch (err) {
+      console.error('Remove watch error', err);
+    }
+  };
+
+  const setChannel = (kind, field, value) => {
+    setPrefs(prev => ({ ...prev, [kind]: { ...prev[kind], [field]: value } }));
+  };
+
+  const savePrefs = async () => {
+    try {
+      const res = await authenticatedFetch(apiUrl('/api/user/preferences'), {
+        method: 'PUT',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ notifications: prefs }),
+      });
+      if (!res.ok) {
+        alert((await res.text()) || 'Failed to save preferences');
+        return;
+      }
+      loadPrefs();
+    } catch (err) {
+      console.error('Save preferences error', err);
+    }
+  };
+
+  const sendTest = async () => {
+    setTestResult(null);
+    try {
+      const res = await authenticatedFetch(apiUrl('/api/notifications/test'), { method: 'POST' });
+      if (res.ok) setTestResult(await res.json());
+    } catch (err) {
+      console.error('Test notification error', err);
+    }
+  };
+
+  return (
+    <div className="min-h-screen bg-gray-50 flex flex-col font-sans text-gray-900">
+      <nav className="navbar navbar-expand-lg navbar-light" style={{ backgroundColor: 'skyblue' }}>
+        <div className="container-fluid">
+          <button onClick={() => navigate('/projects')} className="btn btn-outline-primary btn-sm d-flex align-items-center">
+            <ArrowLeft className="me-1" />
+          </button>
+          <span className="navbar-text ms-2 d-flex align-items-center fw-bold">
+            <Bell className="me-2" /> Notifications
+          </span>
+          <div className="ms-auto d-flex align-items-center">
+            <span className="navbar-text me-3 d-flex align-items-center">
+              <User className="me-1" /> {username}
+            </span>
+          </div>
+        </div>
+      </nav>
+
+      <main className="flex-1 max-w-4xl w-full mx-auto px-4 py-8">
+        <div className="bg-white border border-gray-200 rounded-2xl shadow-sm p-4">
+          <div className="d-flex justify-content-between align-items-center mb-3">
+            <h5 className="mb-0">Inbox {unread > 0 && <span className="badge bg-danger ms-1">{unread}</span>}</h5>
+            <div className="d-flex align-items-center gap-2">
+              <div className="form-check form-switch mb-0 small">
+                <input className="form-check-input" type="checkbox" id="unreadOnly" checked={unreadOnly} onChange={(e) => setUnreadOnly(e.target.checked)} />
+                <label className="form-check-label" htmlFor="unreadOnly">Unread only</label>
+              </div>
+              <button className="btn btn-sm btn-outline-primary d-flex align-items-center" disabled={unread === 0} onClick={() => markRead({ all: true })}>
+                <CheckCheck size={14} className="me-1" /> Mark all read
+              </button>
+              <button className="btn btn-sm btn-outline-danger d-flex align-items-center" onClick={() => removeNotification('all=1')} title="Delete read notifications">
+                <Trash2 size={14} className="me-1" /> Clear read
+              </button>
+            </div>
+          </div>
+          {notifications.length === 0 && <p className="text-muted small mb-0">No notifications.</p>}
+          <ul className="list-group">
+            {notifications.map(n => (
+              <li key={n.id} className={`list-group-item d-flex justify-content-between align-items-start ${n.read ? '' : 'list-group-item-info'}`}>
+                <button className="btn btn-link text-start text-decoration-none text-reset p-0 small" onClick={() => openNotification(n)}>
+                  <div style={{ whiteSpace: 'pre-wrap' }}>
+                    {n.text}
+                    {n.count > 1 && <span className="badge bg-secondary ms-1">×{n.count}</span>}
+                  </div>
+                  <div className="text-muted" style={{ fontSize: '0.72rem' }}>
+                    {new Date(n.timestamp).toLocaleString()}
+                    {n.project && ` · ${n.project}`}
+                  </div>
+                </button>
+                <div className="d-flex gap-1 ms-2">
+                  {!n.read && (
+                    <button className="btn btn-sm btn-link p-0" title="Mark read" onClick={() => markRead({ ids: [n.id] })}>
+                      <Check size={14} />
+                    </button>
+                  )}
+                  <button className="btn btn-sm btn-link text-danger p-0" title="Delete" onClick={() => removeNotification(`id=${encodeURIComponent(n.id)}`)}>
+                    <Trash2 size={14} />
+                  </button>
+                </div>
+              </li>
+            ))}
+          </ul>
+        </div>
+
+        <div className="bg-white border border-gray-200 rounded-2xl shadow-sm p-4 mt-4">
+          <h5 className="mb-2 d-flex align-items-center"><Eye size={16} className="me-2" /> Watching</h5>
+          <p className="text-muted small">Watch a sheet from its toolbar, or cells from their right-click menu.</p>
+          {watches.length === 0 && <p className="text-muted small mb-0">You are not watching anything.</p>}
+          <ul className="list-group">
+            {watches.map(w => (
+              <li key={w.id} className="list-group-item d-flex justify-content-between align-items-center small">
+                <button className="btn btn-link p-0 small" onClick={() => navigate(notificationRoute({ sheet: w.sheet, project: w.project }))}>
+                  {w.range ? `${w.range} of ` : ''}{w.sheet}{w.project && <span className="text-muted"> · {w.project}</span>}
+                </button>
+                <button className="btn btn-sm btn-link text-danger p-0" title="Stop watching" onClick={() => removeWatch(w)}>
+                  <Trash2 size={14} />
+                </button>
+              </li>
+            ))}
+          </ul>
+        </div>
+
+        <div className="bg-white border border-gray-200 rounded-2xl shadow-sm p-4 mt-4">
+          <h5 className="mb-3">Delivery</h5>
+          <div className="row g-2 mb-3">
+            <div className="col-12 col-md-6">
+              <label className="form-label small mb-0">Email address</label>
+              <input className="form-control form-control-sm" value={prefs.email || ''} onChange={(e) => setPrefs(prev => ({ ...prev, email: e.target.value }))} placeholder="you@example.com" />
+            </div>
+            <div className="col-12 col-md-6">
+              <label className="form-label small mb-0">Webhook URL</label>
+              <input className="form-control form-control-sm" value={prefs.webhook_url || ''} onChange={(e) => setPrefs(prev => ({ ...prev, webhook_url: e.target.value }))} placeholder="https://…" />
+            </div>
+          </div>
+          <table className="table table-sm small align-middle">
+            <thead>
+              <tr><th>Notify me of</th><th className="text-center">Inbox</th><th className="text-center">Email</th><th className="text-center">Webhook</th></tr>
+            </thead>
+            <tbody>
+              {KINDS.map(k => {
+                const ch = prefs[k.key] || {};
+                return (
+                  <tr key={k.key}>
+                    <td>{k.label}<div className="text-muted" style={{ fontSize: '0.72rem' }}>{k.hint}</div></td>
+                    <td className="text-center"><input type="checkbox" className="form-check-input" checked={!ch.off} onChange={(e) => setChannel(k.key, 'off', !e.target.checked)} /></td>
+                    <td className="text-center"><input type="checkbox" className="form-check-input" checked={!!ch.email} disabled={!!ch.off} onChange={(e) => setChannel(k.key, 'email', e.target.checked)} /></td>
+                    <td className="text-center"><input type="checkbox" className="form-check-input" checked={!!ch.webhook} disabled={!!ch.off} onChange={(e) => setChannel(k.key, 'webhook', e.target.checked)} /></td>
+                  </tr>
+                );
+              })}
+            </tbody>
+          </table>
+          <div className="d-flex justify-content-end align-items-center gap-2">
+            {testResult && <span className="small text-muted">Email: {testResult.email} · Webhook: {testResult.webhook}</span>}
+            <button className="btn btn-sm btn-outline-secondary d-flex align-items-center" onClick={sendTest} title="Send a test to the saved address and webhook">
+              <Send size={14} className="me-1" /> Send test
+            </button>
+            <button className="btn btn-sm btn-outline-primary d-flex align-items-center" onClick={savePrefs}>
+              <Save size={14} className="me-1" /> Save
+            </button>
+          </div>
+        </div>
+      </main>
+    </div>
+  );
+}
@@ -1,7 +1,9 @@
 import React, { useEffect, useMemo, useState } from 'react';
 import { useNavigate } from 'react-router-dom';
 import { authenticatedFetch, isSessionValid, clearAuth, getUsername, apiUrl, isAdmin, canCreateProject } from '../utils/auth';
-import { Copy, ClipboardPaste, Edit2, Trash2, Search, User, LogOut, Folder, Lock, X, ShieldCheck, AlertTriangle, CheckCircle, HelpCircle } from 'lucide-react';
+import { chooseDeleteMode } from '../utils/references';
+import { fetchUnreadCount } from '../utils/notifications';
+import { Copy, ClipboardPaste, Edit2, Trash2, Search, User, LogOut, Folder, Lock, X, ShieldCheck, AlertTriangle, CheckCircle, HelpCircle, Users, Bell } from 'lucide-react';
 
 // Shared clipboard helpers using localStorage
 function getClipboard() {
@@ -27,6 +29,7 @@ export default function Projects() {
   const [pastingTarget, setPastingTarget] = useState(null); // project name or '__project_root__'
   const [pasteName, setPasteName] = useState('');
   const [systemCorrupt, setSystemCorrupt] = useState(false);
+  const [unreadNotifications, setUnreadNotifications] = useState(0);
   // ...existing code...
   const navigate = useNavigate();
   const username = getUsername();
@@ -45,6 +48,7 @@ export default function Projects() {
       }
     }, 60000);
     fetchProjects();
+    fetchUnreadCount().then(setUnreadNotifications);
     return () => clearInterval(interval);
   }, [username, navigate]);
 
@@ -253,18 +257,25 @@ export default function Projects() {
 
   // ...existing code...
 
-  const confirmDelete = async () => {
+  const confirmDelete = async (mode) => {
     const name = deleteProject;
     if (!name) return;
     if (deleteConfirm.trim() !== name) return; // require exact match
     try {
-      const res = await authenticatedFetch(apiUrl(`/api/projects?name=${encodeURIComponent(name)}`), {
+      const res = await authenticatedFetch(apiUrl(`/api/projects?name=${encodeURIComponent(name)}${mode ? `&mode=${mode}` : ''}`), {
         method: 'DELETE',
       });
       if (res.status === 403) {
         alert('Only the project owner can delete this project.');
         return;
       }
+      if (res.status === 409) {
+        // Other projects reference this one: rewrite them to values, force, or abort
+        const body = await res.json().catch(() => ({}));
+        const next = chooseDeleteMode(`Project '${name}'`, body.references);
+        if (next) confirmDelete(next);
+        return;
+      }
       if (res.ok) {
         cancelDelete();
         fetchProjects();
@@ -311,6 +322,13 @@ export default function Projects() {
                 <ShieldCheck size={14} className="me-1" /> Admin
               </button>
             )}
+            <button onClick={() => navigate('/notifications')} className="btn btn-outline-primary btn-sm d-flex align-items-center me-2" title="Notifications">
+              <Bell size={14} className="me-1" /> Notifications
+              {unreadNotifications > 0 && <span className="badge bg-danger ms-1">{unreadNotifications}</span>}
+            </button>
+            <button onClick={() => navigate('/groups')} className="btn btn-outline-primary btn-sm d-flex align-items-center me-2" title="User Groups">
+              <Users size={14} className="me-1" /> Groups
+            </button>
             <button onClick={() => navigate('/change-password')} className="btn btn-outline-primary btn-sm d-flex align-items-center me-2" title="Change Password">
               <Lock className="me-1" /> Change Password
             </button>
@@ -0,0 +1,166 @@
+import React, { useEffect, useState } from 'react';
+import { X, Shield, Plus, Save, Trash2 } from 'lucide-react';
+import { authenticatedFetch, apiUrl } from '../utils/auth';
+import { GROUP_PREFIX } from '../utils/groups';
+
+const splitNames = (text) => text.split(',').map(n => n.trim()).filter(Boolean);
+
+const emptyDraft = { name: '', range: '', editors: '', warn_only: false };
+
+/**
+ * ProtectedRangesPanel — a floating panel listing the protected ranges of a
+ * sheet. The sheet owner and project admins add, change and remove them.
+ *
+ * Props:
+ *  - projectName, sheetName: the sheet
+ *  - ranges: the sheet's protected_ranges, kept current by SHEET_PATCH
+ *  - canManage: boolean — the user owns the sheet or administers its project
+ *  - initialRange: string — prefilled range for a new protection, e.g. the selection
+ *  - onClose: () => void
+ */
+export default function ProtectedRangesPanel({ projectName, sheetName, ranges, canManage, initialRange, onClose }) {
+    const [draft, setDraft] = useState({ ...emptyDraft, range: initialRange || '' });
+    // range id -> draft being edited
+    const [edits, setEdits] = useState({});
+    const [error, setError] = useState('');
+    const [isBusy, setIsBusy] = useState(false);
+
+    useEffect(() => {
+        setDraft(d => ({ ...d, range: initialRange || d.range }));
+    }, [initialRange]);
+
+    const send = async (method, body) => {
+        setIsBusy(true);
+        setError('');
+        try {
+            const res = await authenticatedFetch(apiUrl('/api/sheet/protected'), {
+                method,
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ project: projectName, sheet_name: sheetName, ...body }),
+            });
+            if (!res.ok) throw new Error(await res.text());
+            return true;
+        } catch (e) {
+            setError(e.message);
+            return false;
+        } finally {
+            setIsBusy(false);
+        }
+    };
+
+    const handleAdd = async () => {
+        const ok = await send('POST', { ...draft, range: draft.range.trim(), editors: splitNames(draft.editors) });
+        if (ok) setDraft(emptyDraft);
+    };
+
+    const handleSave = async (p) => {
+        const e = edits[p.id];
+        const ok = await send('PUT', { id: p.id, name: e.name, range: e.range.trim(), editors: splitNames(e.editors), warn_only: e.warn_only });
+        if (ok) setEdits(prev => { const next = { ...prev }; delete next[p.id]; return next; });
+    };
+
+    const handleRemove = async (p) => {
+        if (!window.confirm(`Remove the protection of ${p.name || p.range}?`)) return;
+        setIsBusy(true);
+        setError('');
+        try {
+            const params = new URLSearchParams({ sheet_name: sheetName, project: projectName || '', id: p.id });
+            const res = await authenticatedFetch(apiUrl(`/api/sheet/protected?${params.toString()}`), { method: 'DELETE' });
+            if (!res.ok) throw new Error(await res.text());
+        } catch (e) {
+            setError(e.message);
+        } finally {
+            setIsBusy(false);
+        }
+    };
+
+    const startEdit = (p) => {
+        setEdits(prev => ({ ...prev, [p.id]: { name: p.name || '', range: p.range, editors: (p.editors || []).join(', '), warn_only: !!p.warn_only } }));
+    };
+
+    const setEdit = (id, field, value) => {
+        setEdits(prev => ({ ...prev, [id]: { ...prev[id], [field]: value } }));
+    };
+
+    const fields = (value, onChange) => (
+        <div className="d-flex flex-column gap-1">
+            <div className="d-flex gap-1">
+                <input type="text" className="form-control form-control-sm" style={{ fontSize: '0.78rem' }} placeholder="Range, e.g. A1:D10, A:C or 3:5" value={value.range} onChange={(e) => onChange('range', e.target.value)} />
+                <input type="text" className="form-control form-control-sm" style={{ fontSize: '0.78rem' }} placeholder="Name (optional)" value={value.name} onChange={(e) => onChange('name', e.target.value)} />
+            </div>
+            <input type="text" className="form-control form-control-sm" style={{ fontSize: '0.78rem' }} placeholder={`Who may edit it: users or ${GROUP_PREFIX}groups, comma separated`} value={value.editors} onChange={(e) => onChange('editors', e.target.value)} />
+            <label className="d-flex align-items-center gap-1">
+                <input type="checkbox" checked={value.warn_only} onChange={(e) => onChange('warn_only', e.target.checked)} />
+                Only warn before editing
+            </label>
+        </div>
+    );
+
+    return (
+        <div style={{ position: 'fixed', right: 392, top: 70, width: 420, maxHeight: 'calc(100% - 100px)', zIndex: 1100 }} className="card shadow-sm d-flex flex-column">
+            <div className="card-header py-2 d-flex align-items-center justify-content-between">
+                <span className="fw-semibold small d-flex align-items-center gap-1"><Shield size={13} /> Protected Ranges</span>
+                <button className="btn btn-sm btn-light" onClick={onClose} aria-label="Close protected ranges"><X size={14} /></button>
+            </div>
+            <div className="overflow-auto p-2 d-flex flex-column gap-3" style={{ flex: 1, fontSize: '0.8rem' }}>
+                {error && <div className="text-danger">{error}</div>}
+                <span className="text-muted" style={{ fontSize: '0.72rem' }}>
+                    Only the sheet owner, project admins and the editors listed may change a protected range or delete and move its rows and columns.
+                </span>
+
+                {(ranges || []).length === 0
+                    ? <div className="text-muted">No protected ranges.</div>
+                    : (
+                        <ul className="list-unstyled mb-0">
+                            {ranges.map(p => (
+                                <li key={p.id} className="py-1 border-bottom">
+                                    {edits[p.id] ? (
+                                        <>
+                                            {fields(edits[p.id], (field, value) => setEdit(p.id, field, value))}
+                                            <div className="d-flex justify-content-end gap-1 mt-1">
+                                                <button className="btn btn-sm btn-light" disabled={isBusy} onClick={() => setEdits(prev => { const next = { ...prev }; delete next[p.id]; return next; })}>Cancel</button>
+                                                <button className="btn btn-sm btn-outline-primary d-flex align-items-center" disabled={isBusy || !edits[p.id].range.trim()} onClick={() => handleSave(p)}>
+                                                    <Save size={13} className="me-1" /> Save
+                                                </button>
+                                            </div>
+                                        </>
+                                    ) : (
+                                        <div className="d-flex align-items-start gap-2">
+                                            <div style={{ flex: 1 }}>
+                                                <span className="fw-semibold">{p.range}</span>
+                                                {p.name && <span className="ms-2">{p.name}</span>}
+                                                {p.warn_only && <span className="badge bg-warning text-dark ms-2">warn only</span>}
+                                                <div className="text-muted" style={{ fontSize: '0.75rem' }}>
+                                                    {(p.editors || []).length > 0 ? `Editors: ${p.editors.join(', ')}` : 'Owner and project admins only'}
+                                                </div>
+                                            </div>
+                                            {canManage && (
+                                                <>
+                                                    <button className="btn btn-sm btn-link p-0" disabled={isBusy} onClick={() => startEdit(p)}>Edit</button>
+                                                    <button className="btn btn-sm btn-link text-danger p-0" title="Remove protection" disabled={isBusy} onClick={() => handleRemove(p)}>
+                                                        <Trash2 size={13} />
+                                                    </button>
+                                                </>
+                                            )}
+                                        </div>
+                                    )}
+                                </li>
+                            ))}
+                        </ul>
+                    )}
+
+                {canManage && (
+                    <section>
+                        <div className="fw-semibold mb-1">Protect a range</div>
+                        {fields(draft, (field, value) => setDraft(d => ({ ...d, [field]: value })))}
+                        <div className="d-flex justify-content-end mt-1">
+                            <button className="btn btn-sm btn-outline-primary d-flex align-items-center" disabled={isBusy || !draft.range.trim()} onClick={handleAdd}>
+                                <Plus size={13} className="me-1" /> Protect
+                            </button>
+                        </div>
+                    </section>
+                )}
+            </div>
+        </div>
+    );
+}
@@ -1,6 +1,6 @@
 import React, { useState, useEffect, useRef, useCallback } from 'react';
 import { X, Upload, Trash2, RefreshCw, Copy, Check, FolderOpen, FileCode, Link, Image } from 'lucide-react';
-import { authenticatedFetch, apiUrl } from '../utils/auth';
+import { authenticatedFetch, apiUrl, withAuthToken } from '../utils/auth';
 
 /**
  * PythonFileBrowser – modal that lets users browse / upload / delete files
@@ -385,10 +385,10 @@ export default function PythonFileBrowser({ onInsert, onClose }) {
 }
 
 /** Thumbnail for image files stored in pythonDirectory.
- *  The /api/python-files/serve endpoint is public (no auth needed),
- *  so we can use a plain <img> tag with the direct URL. */
+ *  A plain <img> tag cannot send the Authorization header, so the
+ *  session token goes in the URL. */
 function PythonFileThumbnail({ name }) {
-    const src = apiUrl(`/api/python-files/serve?name=${encodeURIComponent(name)}`);
+    const src = withAuthToken(apiUrl(`/api/python-files/serve?name=${encodeURIComponent(name)}`));
     const [ok, setOk] = React.useState(true);
     if (!ok) return <Image size={24} color="#d1d5db" />;
     return (
@@ -2,6 +2,11 @@ import React, { useEffect, useState } from 'react';
 import { useNavigate, useParams, useLocation } from 'react-router-dom';
 import { isSessionValid, clearAuth, getUsername, authenticatedFetch, apiUrl, isAdmin } from '../utils/auth';
 import { ArrowLeft, Settings as SettingsIcon, User, Save, Lock } from 'lucide-react';
+import { MEMBER_ROLES, ROLE_LABELS } from '../utils/roles';
+import { fetchGroups, groupsOf, isListed, GROUP_PREFIX } from '../utils/groups';
+
+// Permission list of the sheet for each role a user can be given on it
+const ROLE_LISTS = { editor: 'editors', commenter: 'commenters', viewer: 'viewers', none: 'no_access' };
 
 
 export default function Settings() {
@@ -21,12 +26,14 @@ export default function Settings() {
 
   const [sheet, setSheet] = useState(null);
   const [users, setUsers] = useState([]);
-  const [editors, setEditors] = useState([]);
+  // user -> role given on this sheet; users left out get their project role
+  const [sheetRoles, setSheetRoles] = useState({});
   const [newOwner, setNewOwner] = useState('');
   const [projectAdmins, setProjectAdmins] = useState([]);
   const [projectOwner, setProjectOwner] = useState('');
+  const [groups, setGroups] = useState([]);
   const isOwner = sheet && sheet.owner === username;
-  const isProjectAdmin = projectOwner === username || projectAdmins.includes(username);
+  const isProjectAdmin = projectOwner === username || isListed(projectAdmins, username, groupsOf(groups, username));
   const canManage = admin || isOwner || isProjectAdmin;
 
   useEffect(() => {
@@ -52,7 +59,11 @@ export default function Settings() {
         }
         const s = await sheetRes.json();
         setSheet(s);
-        setEditors((s.permissions?.editors) || []);
+        const roles = {};
+        MEMBER_ROLES.slice().reverse().forEach(role => {
+          (s.permissions?.[ROLE_LISTS[role]] || []).forEach(u => { roles[u] = role; });
+        });
+        setSheetRoles(roles);
         setNewOwner(s.owner || '');
 
         const usersRes = await authenticatedFetch(apiUrl('/api/users'));
@@ -60,6 +71,7 @@ export default function Settings() {
           const list = await usersRes.json();
           setUsers(Array.isArray(list) ? list : []);
         }
+        setGroups(await fetchGroups());
 
         // Fetch project admins
         if (project) {
@@ -79,9 +91,13 @@ export default function Settings() {
     fetchData();
   }, [id, username, navigate]);
 
-  const toggleItem = (list, item) => {
-    const exists = list.includes(item);
-    return exists ? list.filter(x => x !== item) : [...list, item];
+  const setSheetRole = (user, role) => {
+    setSheetRoles(prev => {
+      const next = { ...prev };
+      if (role) next[user] = role;
+      else delete next[user];
+      return next;
+    });
   };
 
   const savePermissions = async () => {
@@ -90,7 +106,10 @@ export default function Settings() {
       const res = await authenticatedFetch(apiUrl(`/api/sheet/permissions?sheet_name=${encodeURIComponent(id)}${project ? `&project=${encodeURIComponent(project)}` : ''}`), {
         method: 'PUT',
         headers: { 'Content-Type': 'application/json' },
-        body: JSON.stringify({ editors }),
+        body: JSON.stringify(Object.fromEntries(MEMBER_ROLES.map(role => [
+          ROLE_LISTS[role],
+          Object.keys(sheetRoles).filter(u => sheetRoles[u] === role),
+        ]))),
       });
       if (!res.ok) {
         const text = await res.text();
@@ -200,18 +219,23 @@ export default function Settings() {
           <h5 className="mb-3">Permissions</h5>
           <div className="row">
             <div className="col-md-12 mb-3">
-              <label className="form-label">Editors</label>
-              <div className="d-flex flex-wrap gap-2">
-                {users.map(u => (
-                  <button
-                    key={`editor-${u}`}
-                    type="button"
-                    className={`btn btn-sm ${editors.includes(u) ? 'btn-success' : 'btn-outline-secondary'}`}
-        onClick={() => canManage && setEditors(prev => toggleItem(prev, u))}
-        disabled={!canManage}
-                  >
-                    {u}
-                  </button>
+              <label className="form-label">Access</label>
+              <p className="text-muted small mb-2">Users left on "Project role" get their role in the project. A role given to a user by name wins over one given to their group.</p>
+              <div className="d-flex flex-column gap-1">
+                {[...users.filter(u => u !== sheet.owner), ...groups.map(g => `${GROUP_PREFIX}${g.name}`)].map(u => (
+                  <div key={`role-${u}`} className="d-flex align-items-center gap-2">
+                    <span style={{ minWidth: 160 }}>{u}</span>
+                    <select
+                      className="form-select form-select-sm"
+                      style={{ width: 160 }}
+                      value={sheetRoles[u] || ''}
+                      onChange={(e) => canManage && setSheetRole(u, e.target.value)}
+                      disabled={!canManage}
+                    >
+                      <option value="">Project role</option>
+                      {MEMBER_ROLES.map(r => <option key={r} value={r}>{ROLE_LABELS[r]}</option>)}
+                    </select>
+                  </div>
                 ))}
               </div>
             </div>
@@ -0,0 +1,287 @@
+import React, { useEffect, useMemo, useState } from 'react';
+import { X, RotateCcw, Eye, GitCompare } from 'lucide-react';
+import { authenticatedFetch, apiUrl } from '../utils/auth';
+
+const colLabelToIndex = (label) => {
+    let idx = 0;
+    for (const ch of label) idx = idx * 26 + (ch.charCodeAt(0) - 64);
+    return idx;
+};
+
+const indexToColLabel = (idx) => {
+    let label = '';
+    while (idx > 0) {
+        idx--;
+        label = String.fromCharCode(65 + (idx % 26)) + label;
+        idx = Math.floor(idx / 26);
+    }
+    return label;
+};
+
+const formatTime = (ts) => ts
+    ? new Date(ts).toLocaleString(undefined, { year: 'numeric', month: 'short', day: '2-digit', hour: '2-digit', minute: '2-digit', second: '2-digit' })
+    : 'now';
+
+// A point in time is a named version, a timeline event id or a
+// datetime-local value, sent as <prefix>version, <prefix>event_id or <atKey>
+const pointParams = (point, atKey, prefix = '') => {
+    if (point.version) return { [`${prefix}version`]: point.version };
+    if (point.eventId) return { [`${prefix}event_id`]: point.eventId };
+    if (point.at) return { [atKey]: new Date(point.at).toISOString() };
+    return {};
+};
+
+/**
+ * SheetHistoryPanel — a floating panel to open a sheet as it was at a point
+ * in time (a timestamp, a timeline event or a named version), compare two
+ * points and restore the sheet, a range or a cell.
+ *
+ * Props:
+ *  - projectName, sheetName: the sheet
+ *  - timelineEntries: the project timeline, offered as points in time
+ *  - canRestore: boolean — the user may edit the sheet
+ *  - onRestored: () => void — called after a restore
+ *  - onClose: () => void
+ */
+export default function SheetHistoryPanel({ projectName, sheetName, timelineEntries = [], canRestore, onRestored, onClose }) {
+    const [earliest, setEarliest] = useState(null);
+    const [versions, setVersions] = useState([]);
+    const [point, setPoint] = useState({ eventId: '', at: '', version: '' });
+    const [compareTo, setCompareTo] = useState({ eventId: '', at: '', version: '' });
+    const [tab, setTab] = useState('changes'); // 'changes' | 'sheet'
+    const [view, setView] = useState(null);
+    const [diff, setDiff] = useState(null);
+    const [error, setError] = useState('');
+    const [isLoading, setIsLoading] = useState(false);
+    const [restoreRange, setRestoreRange] = useState('');
+    const [isRestoring, setIsRestoring] = useState(false);
+
+    const sortedEvents = useMemo(
+        () => [...timelineEntries].sort((a, b) => new Date(a.timestamp) - new Date(b.timestamp)),
+        [timelineEntries]
+    );
+    const hasPoint = !!(point.version || point.eventId || point.at);
+
+    useEffect(() => {
+        const params = new URLSearchParams({ sheet_name: sheetName, project: projectName || '' });
+        authenticatedFetch(apiUrl(`/api/sheet/history?${params.toString()}`))
+            .then(r => r.ok ? r.json() : null)
+            .then(d => setEarliest(d?.earliest || null))
+            .catch(() => {});
+        authenticatedFetch(apiUrl(`/api/sheet/versions?${params.toString()}`))
+            .then(r => r.ok ? r.json() : null)
+            .then(d => setVersions(d?.versions || []))
+            .catch(() => {});
+    }, [projectName, sheetName]);
+
+    // Load the historical sheet and its changes up to the comparison point
+    useEffect(() => {
+        if (!hasPoint) {
+            setView(null);
+            setDiff(null);
+            return;
+        }
+        const base = { sheet_name: sheetName, project: projectName || '' };
+        let cancelled = false;
+        setIsLoading(true);
+        setError('');
+        Promise.all([
+            authenticatedFetch(apiUrl(`/api/sheet/history?${new URLSearchParams({ ...base, ...pointParams(point, 'at') })}`)),
+            authenticatedFetch(apiUrl(`/api/sheet/history/diff?${new URLSearchParams({ ...base, ...pointParams(point, 'from', 'from_'), ...pointParams(compareTo, 'to', 'to_') })}`)),
+        ])
+            .then(async ([viewRes, diffRes]) => {
+                if (!viewRes.ok) throw new Error(await viewRes.text());
+                if (!diffRes.ok) throw new Error(await diffRes.text());
+                const [v, d] = await Promise.all([viewRes.json(), diffRes.json()]);
+                if (!cancelled) {
+                    setView(v);
+                    setDiff(d);
+                }
+            })
+            .catch(e => {
+                if (!cancelled) {
+                    setView(null);
+                    setDiff(null);
+                    setError(e.message);
+                }
+            })
+            .finally(() => { if (!cancelled) setIsLoading(false); });
+        return () => { cancelled = true; };
+    }, [projectName, sheetName, point, compareTo, hasPoint]);
+
+    const handleRestore = async () => {
+        const scope = restoreRange.trim() ? `range ${restoreRange.trim()}` : 'the whole sheet';
+        const when = view?.version ? `version "${view.version}"` : formatTime(view?.at);
+        if (!window.confirm(`Restore ${scope} to how it was at ${when}?\n\nThe restored cells are recorded in the activity log.`)) return;
+        setIsRestoring(true);
+        try {
+            const body = { project: projectName, sheet_name: sheetName, range: restoreRange.trim() };
+            if (point.version) body.version = point.version;
+            else if (point.eventId) body.event_id = point.eventId;
+            else body.at = new Date(point.at).toISOString();
+            const res = await authenticatedFetch(apiUrl('/api/sheet/history/restore'), {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify(body),
+            });
+            if (!res.ok) {
+                alert('Restore failed: ' + await res.text());
+                return;
+            }
+            const result = await res.json();
+            const skipped = (result.results || []).filter(r => r.status === 'skipped');
+            alert(`Restored ${result.applied} cell(s).` + (skipped.length
+                ? `\nSkipped ${skipped.length}: ${skipped.slice(0, 10).map(r => `${r.cell} (${r.reason})`).join(', ')}`
+                : ''));
+            setCompareTo(c => ({ ...c }));
+            onRestored?.();
+        } catch (e) {
+            alert('Restore failed: ' + e.message);
+        } finally {
+            setIsRestoring(false);
+        }
+    };
+
+    // Bounds of the populated cells of the historical sheet
+    const grid = useMemo(() => {
+        if (!view?.data) return null;
+        let maxRow = 0, maxCol = 0;
+        Object.entries(view.data).forEach(([row, cols]) => {
+            Object.keys(cols || {}).forEach(col => {
+                maxRow = Math.max(maxRow, parseInt(row, 10) || 0);
+                maxCol = Math.max(maxCol, colLabelToIndex(col));
+            });
+        });
+        return { rows: Math.min(maxRow, 200), cols: Math.min(maxCol, 52) };
+    }, [view]);
+
+    const pointPicker = (value, onChange, emptyLabel) => (
+        <div className="d-flex gap-1">
+            <select
+                className="form-select form-select-sm"
+                style={{ fontSize: '0.78rem' }}
+                value={value.version ? `__version:${value.version}` : value.eventId ? value.eventId : value.at ? '__time' : ''}
+                onChange={(e) => {
+                    const v = e.target.value;
+                    if (v === '__time') onChange({ eventId: '', version: '', at: value.at || new Date(Date.now() - new Date().getTimezoneOffset() * 60000).toISOString().slice(0, 16) });
+                    else if (v.startsWith('__version:')) onChange({ eventId: '', at: '', version: v.slice('__version:'.length) });
+                    else onChange({ eventId: v, at: '', version: '' });
+                }}
+            >
+                <option value="">{emptyLabel}</option>
+                <option value="__time">Date and time…</option>
+                {versions.map(v => (
+                    <option key={v.id} value={`__version:${v.id}`}>Version: {v.name}</option>
+                ))}
+                {sortedEvents.map(ev => (
+                    <option key={ev.id} value={ev.id}>
+                        {formatTime(ev.timestamp)} — {ev.description.length > 30 ? ev.description.slice(0, 30) + '…' : ev.description}
+                    </option>
+                ))}
+            </select>
+            {!value.version && !value.eventId && value.at && (
+                <input
+                    type="datetime-local"
+                    step="1"
+                    className="form-control form-control-sm"
+                    style={{ fontSize: '0.78rem' }}
+                    value={value.at}
+                    onChange={(e) => onChange({ eventId: '', version: '', at: e.target.value })}
+                />
+            )}
+        </div>
+    );
+
+    return (
+        <div style={{ position: 'fixed', right: 392, top: 70, width: 520, maxHeight: 'calc(100% - 100px)', zIndex: 1100 }} className="card shadow-sm d-flex flex-column">
+            <div className="card-header py-2 d-flex align-items-center justify-content-between">
+                <span className="fw-semibold small">Sheet History</span>
+                <button className="btn btn-sm btn-light" onClick={onClose} aria-label="Close history"><X size={14} /></button>
+            </div>
+            <div className="p-2 border-bottom d-flex flex-column gap-1" style={{ fontSize: '0.8rem' }}>
+                <label className="mb-0 text-muted">Sheet as of</label>
+                {pointPicker(point, setPoint, '— Pick a point in time —')}
+                <label className="mb-0 text-muted">Compared with</label>
+                {pointPicker(compareTo, setCompareTo, 'Now')}
+                <span className="text-muted" style={{ fontSize: '0.72rem' }}>
+                    {earliest ? `History is available from ${formatTime(earliest)}.` : 'No history has been recorded for this sheet yet.'}
+                </span>
+            </div>
+            <div className="d-flex gap-1 p-2 border-bottom">
+                <button className={`btn btn-sm ${tab === 'changes' ? 'btn-primary' : 'btn-outline-secondary'} d-flex align-items-center gap-1`} onClick={() => setTab('changes')}>
+                    <GitCompare size={13} /> Changes{diff ? ` (${diff.cells.length})` : ''}
+                </button>
+                <button className={`btn btn-sm ${tab === 'sheet' ? 'btn-primary' : 'btn-outline-secondary'} d-flex align-items-center gap-1`} onClick={() => setTab('sheet')}>
+                    <Eye size={13} /> Sheet
+                </button>
+            </div>
+            <div className="overflow-auto p-2" style={{ flex: 1, minHeight: 120, fontSize: '0.8rem' }}>
+                {!hasPoint && <div className="text-muted text-center py-4">Pick a timestamp, a timeline event or a version.</div>}
+                {isLoading && <div className="text-muted text-center py-4">Loading…</div>}
+                {error && !isLoading && <div className="text-danger">{error}</div>}
+                {!isLoading && !error && tab === 'changes' && diff && (
+                    diff.cells.length === 0
+                        ? <div className="text-muted text-center py-4">No cell changed between these points.</div>
+                        : (
+                            <table className="table table-sm mb-0">
+                                <thead>
+                                    <tr><th>Cell</th><th>{formatTime(diff.from)}</th><th>{formatTime(diff.to)}</th></tr>
+                                </thead>
+                                <tbody>
+                                    {diff.cells.map(c => (
+                                        <tr key={c.cell}>
+                                            <td className="fw-semibold">
+                                                <button className="btn btn-link btn-sm p-0" title="Restore this cell" onClick={() => setRestoreRange(c.cell)}>{c.cell}</button>
+                                            </td>
+                                            <td className="text-danger" style={{ wordBreak: 'break-word' }}>{c.from ? (c.from.cell_type === 5 ? c.from.script : c.from.value) : <em>empty</em>}</td>
+                                            <td className="text-success" style={{ wordBreak: 'break-word' }}>{c.to ? (c.to.cell_type === 5 ? c.to.script : c.to.value) : <em>empty</em>}</td>
+                                        </tr>
+                                    ))}
+                                </tbody>
+                            </table>
+                        )
+                )}
+                {!isLoading && !error && tab === 'sheet' && view && grid && (
+                    <table className="table table-sm table-bordered mb-0" style={{ fontSize: '0.75rem' }}>
+                        <thead>
+                            <tr>
+                                <th></th>
+                                {Array.from({ length: grid.cols }, (_, i) => <th key={i} className="text-center">{indexToColLabel(i + 1)}</th>)}
+                            </tr>
+                        </thead>
+                        <tbody>
+                            {Array.from({ length: grid.rows }, (_, r) => (
+                                <tr key={r}>
+                                    <th className="text-muted">{r + 1}</th>
+                                    {Array.from({ length: grid.cols }, (_, c) => {
+                                        const cell = view.data[String(r + 1)]?.[indexToColLabel(c + 1)];
+                                        return (
+                                            <td key={c} style={{ background: cell?.background || undefined, fontWeight: cell?.bold ? 'bold' : undefined, fontStyle: cell?.italic ? 'italic' : undefined, whiteSpace: 'nowrap', maxWidth: 160, overflow: 'hidden', textOverflow: 'ellipsis' }}>
+                                                {cell?.value}
+                                            </td>
+                                        );
+                                    })}
+                                </tr>
+                            ))}
+                        </tbody>
+                    </table>
+                )}
+            </div>
+            {canRestore && hasPoint && view && (
+                <div className="p-2 border-top d-flex gap-1 align-items-center">
+                    <input
+                        type="text"
+                        className="form-control form-control-sm"
+                        style={{ fontSize: '0.78rem' }}
+                        placeholder="Range (A1:C5, B4 or a cell name), empty for the whole sheet"
+                        value={restoreRange}
+                        onChange={(e) => setRestoreRange(e.target.value)}
+                    />
+                    <button className="btn btn-sm btn-outline-danger d-flex align-items-center gap-1" style={{ whiteSpace: 'nowrap' }} disabled={isRestoring} onClick={handleRestore}>
+                        <RotateCcw size={13} /> {isRestoring ? 'Restoring…' : 'Restore'}
+                    </button>
+                </div>
+            )}
+        </div>
+    );
+}
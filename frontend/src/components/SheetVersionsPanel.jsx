@@ -0,0 +1,254 @@
+import React, { useCallback, useEffect, useState } from 'react';
+import { X, Tag, GitBranch, GitMerge, Trash2 } from 'lucide-react';
+import { authenticatedFetch, apiUrl } from '../utils/auth';
+
+const formatTime = (ts) => ts
+    ? new Date(ts).toLocaleString(undefined, { year: 'numeric', month: 'short', day: '2-digit', hour: '2-digit', minute: '2-digit' })
+    : '';
+
+const cellText = (cell) => {
+    if (!cell) return <em>empty</em>;
+    if (cell.cell_type === 5 || (cell.cell_type === 1 && !cell.value)) return cell.script;
+    return cell.value;
+};
+
+/**
+ * SheetVersionsPanel — a floating panel to tag named versions of a sheet,
+ * branch it, and merge a branch back into the sheet it came from, settling
+ * cells changed on both sides.
+ *
+ * Props:
+ *  - projectName, sheetName: the sheet
+ *  - canEdit: boolean — the user may edit the sheet
+ *  - onOpenSheet: (name) => void — open another sheet of the project
+ *  - onChanged: () => void — called after a version is tagged or a merge
+ *  - onClose: () => void
+ */
+export default function SheetVersionsPanel({ projectName, sheetName, canEdit, onOpenSheet, onChanged, onClose }) {
+    const [versions, setVersions] = useState([]);
+    const [branch, setBranch] = useState(null);
+    const [versionName, setVersionName] = useState('');
+    const [versionNote, setVersionNote] = useState('');
+    const [branchName, setBranchName] = useState('');
+    const [plan, setPlan] = useState(null);
+    const [resolutions, setResolutions] = useState({});
+    const [error, setError] = useState('');
+    const [isBusy, setIsBusy] = useState(false);
+
+    const load = useCallback(() => {
+        const params = new URLSearchParams({ sheet_name: sheetName, project: projectName || '' });
+        authenticatedFetch(apiUrl(`/api/sheet/versions?${params.toString()}`))
+            .then(r => r.ok ? r.json() : null)
+            .then(d => {
+                setVersions(d?.versions || []);
+                setBranch(d?.branch || null);
+            })
+            .catch(() => {});
+    }, [projectName, sheetName]);
+
+    useEffect(() => {
+        load();
+        setPlan(null);
+        setResolutions({});
+    }, [load]);
+
+    const run = async (fn) => {
+        setIsBusy(true);
+        setError('');
+        try {
+            await fn();
+        } catch (e) {
+            setError(e.message);
+        } finally {
+            setIsBusy(false);
+        }
+    };
+
+    const handleTag = () => run(async () => {
+        const res = await authenticatedFetch(apiUrl('/api/sheet/versions'), {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ project: projectName, sheet_name: sheetName, name: versionName.trim(), note: versionNote.trim() }),
+        });
+        if (!res.ok) throw new Error(await res.text());
+        setVersionName('');
+        setVersionNote('');
+        load();
+        onChanged?.();
+    });
+
+    const handleDeleteVersion = (v) => {
+        if (!window.confirm(`Delete version "${v.name}"?`)) return;
+        run(async () => {
+            const params = new URLSearchParams({ sheet_name: sheetName, project: projectName || '', version: v.id });
+            const res = await authenticatedFetch(apiUrl(`/api/sheet/versions?${params.toString()}`), { method: 'DELETE' });
+            if (!res.ok) throw new Error(await res.text());
+            load();
+        });
+    };
+
+    const handleBranch = () => run(async () => {
+        const res = await authenticatedFetch(apiUrl('/api/sheet/branches'), {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ project: projectName, sheet_name: sheetName, name: branchName.trim() }),
+        });
+        if (!res.ok) throw new Error(await res.text());
+        const created = await res.json();
+        setBranchName('');
+        if (window.confirm(`Branch "${created.name}" created. Open it now?`)) onOpenSheet?.(created.name);
+    });
+
+    const handlePreview = () => run(async () => {
+        const params = new URLSearchParams({ sheet_name: sheetName, project: projectName || '' });
+        const res = await authenticatedFetch(apiUrl(`/api/sheet/merge?${params.toString()}`));
+        if (!res.ok) throw new Error(await res.text());
+        setPlan(await res.json());
+        setResolutions({});
+    });
+
+    const handleMerge = () => run(async () => {
+        const res = await authenticatedFetch(apiUrl('/api/sheet/merge'), {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ project: projectName, sheet_name: sheetName, resolutions }),
+        });
+        if (res.status === 409) {
+            const d = await res.json().catch(() => null);
+            if (d) setPlan(d);
+            throw new Error('Pick a side for every conflicting cell first.');
+        }
+        if (!res.ok) throw new Error(await res.text());
+        const result = await res.json();
+        const skipped = (result.results || []).filter(r => r.status === 'skipped');
+        alert(`Merged ${result.applied} cell(s) into "${result.into}".` + (skipped.length
+            ? `\nSkipped ${skipped.length}: ${skipped.slice(0, 10).map(r => `${r.cell} (${r.reason})`).join(', ')}`
+            : ''));
+        setPlan(null);
+        setResolutions({});
+        onChanged?.();
+    });
+
+    const unresolved = plan ? plan.conflicts.filter(c => !resolutions[c.cell]).length : 0;
+
+    return (
+        <div style={{ position: 'fixed', right: 392, top: 70, width: 460, maxHeight: 'calc(100% - 100px)', zIndex: 1100 }} className="card shadow-sm d-flex flex-column">
+            <div className="card-header py-2 d-flex align-items-center justify-content-between">
+                <span className="fw-semibold small">Versions &amp; Branches</span>
+                <button className="btn btn-sm btn-light" onClick={onClose} aria-label="Close versions"><X size={14} /></button>
+            </div>
+            <div className="overflow-auto p-2 d-flex flex-column gap-3" style={{ flex: 1, fontSize: '0.8rem' }}>
+                {error && <div className="text-danger">{error}</div>}
+
+                <section>
+                    <div className="fw-semibold mb-1 d-flex align-items-center gap-1"><Tag size={13} /> Versions</div>
+                    {versions.length === 0
+                        ? <div className="text-muted">No named versions yet.</div>
+                        : (
+                            <ul className="list-unstyled mb-1">
+                                {[...versions].reverse().map(v => (
+                                    <li key={v.id} className="d-flex align-items-start gap-2 py-1 border-bottom">
+                                        <div style={{ flex: 1 }}>
+                                            <span className="fw-semibold">{v.name}</span>
+                                            <span className="text-muted ms-2" style={{ fontSize: '0.72rem' }}>{formatTime(v.created)} · {v.user}</span>
+                                            {v.note && <div className="text-muted" style={{ fontSize: '0.75rem' }}>{v.note}</div>}
+                                        </div>
+                                        {canEdit && (
+                                            <button className="btn btn-sm btn-link text-danger p-0" title="Delete version" disabled={isBusy} onClick={() => handleDeleteVersion(v)}>
+                                                <Trash2 size={13} />
+                                            </button>
+                                        )}
+                                    </li>
+                                ))}
+                            </ul>
+                        )}
+                    {canEdit && (
+                        <div className="d-flex flex-column gap-1">
+                            <input type="text" className="form-control form-control-sm" style={{ fontSize: '0.78rem' }} placeholder="Version name, e.g. Q3 submitted" value={versionName} onChange={(e) => setVersionName(e.target.value)} />
+                            <div className="d-flex gap-1">
+                                <input type="text" className="form-control form-control-sm" style={{ fontSize: '0.78rem' }} placeholder="Note (optional)" value={versionNote} onChange={(e) => setVersionNote(e.target.value)} />
+                                <button className="btn btn-sm btn-outline-primary" style={{ whiteSpace: 'nowrap' }} disabled={isBusy || !versionName.trim()} onClick={handleTag}>Tag version</button>
+                            </div>
+                            <span className="text-muted" style={{ fontSize: '0.72rem' }}>Open, compare or restore versions from the History panel.</span>
+                        </div>
+                    )}
+                </section>
+
+                {canEdit && (
+                    <section>
+                        <div className="fw-semibold mb-1 d-flex align-items-center gap-1"><GitBranch size={13} /> New branch</div>
+                        <div className="d-flex gap-1">
+                            <input type="text" className="form-control form-control-sm" style={{ fontSize: '0.78rem' }} placeholder={`Branch name, e.g. ${sheetName}-draft`} value={branchName} onChange={(e) => setBranchName(e.target.value)} />
+                            <button className="btn btn-sm btn-outline-primary" style={{ whiteSpace: 'nowrap' }} disabled={isBusy || !branchName.trim()} onClick={handleBranch}>Create branch</button>
+                        </div>
+                    </section>
+                )}
+
+                {branch && (
+                    <section>
+                        <div className="fw-semibold mb-1 d-flex align-items-center gap-1"><GitMerge size={13} /> Merge</div>
+                        <div className="mb-1">
+                            Branch of{' '}
+                            <button className="btn btn-link btn-sm p-0 align-baseline" onClick={() => onOpenSheet?.(branch.parent)}>{branch.parent}</button>
+                            <span className="text-muted"> since {formatTime(branch.created)}</span>
+                        </div>
+                        <div className="d-flex gap-1 mb-2">
+                            <button className="btn btn-sm btn-outline-secondary" disabled={isBusy} onClick={handlePreview}>Preview merge</button>
+                            {plan && (
+                                <button className="btn btn-sm btn-primary" disabled={isBusy || unresolved > 0 || (plan.changes.length === 0 && plan.conflicts.length === 0)} onClick={handleMerge}>
+                                    Merge into {branch.parent}
+                                </button>
+                            )}
+                        </div>
+                        {plan && plan.changes.length === 0 && plan.conflicts.length === 0 && (
+                            <div className="text-muted">Nothing to merge: {branch.parent} already has every change of this branch.</div>
+                        )}
+                        {plan && plan.changes.length > 0 && (
+                            <table className="table table-sm mb-2">
+                                <thead><tr><th>Cell</th><th>{branch.parent}</th><th>Branch</th></tr></thead>
+                                <tbody>
+                                    {plan.changes.map(c => (
+                                        <tr key={c.cell}>
+                                            <td className="fw-semibold">{c.cell}</td>
+                                            <td className="text-danger" style={{ wordBreak: 'break-word' }}>{cellText(c.from)}</td>
+                                            <td className="text-success" style={{ wordBreak: 'break-word' }}>{cellText(c.to)}</td>
+                                        </tr>
+                                    ))}
+                                </tbody>
+                            </table>
+                        )}
+                        {plan && plan.conflicts.length > 0 && (
+                            <>
+                                <div className="text-warning fw-semibold mb-1">{plan.conflicts.length} conflict(s) — changed on both sides</div>
+                                <table className="table table-sm mb-0">
+                                    <thead><tr><th>Cell</th><th>Base</th><th>Keep {branch.parent}</th><th>Take branch</th></tr></thead>
+                                    <tbody>
+                                        {plan.conflicts.map(c => (
+                                            <tr key={c.cell}>
+                                                <td className="fw-semibold">{c.cell}</td>
+                                                <td className="text-muted" style={{ wordBreak: 'break-word' }}>{cellText(c.base)}</td>
+                                                {['main', 'branch'].map(side => (
+                                                    <td key={side} style={{ wordBreak: 'break-word' }}>
+                                                        <label className="d-flex gap-1 align-items-start" style={{ cursor: 'pointer' }}>
+                                                            <input
+                                                                type="radio"
+                                                                name={`resolve-${c.cell}`}
+                                                                checked={resolutions[c.cell] === side}
+                                                                onChange={() => setResolutions(r => ({ ...r, [c.cell]: side }))}
+                                                            />
+                                                            <span>{cellText(side === 'main' ? c.main : c.branch)}</span>
+                                                        </label>
+                                                    </td>
+                                                ))}
+                                            </tr>
+                                        ))}
+                                    </tbody>
+                                </table>
+                            </>
+                        )}
+                    </section>
+                )}
+            </div>
+        </div>
+    );
+}
@@ -2,6 +2,7 @@ import React, { useEffect, useState, useCallback } from 'react';
 import { useNavigate, useParams, useSearchParams } from 'react-router-dom';
 import { ArrowLeft, Plus, Save, X, Edit2, Trash2, Clock, User, LogOut, Calendar } from 'lucide-react';
 import { isSessionValid, clearAuth, authenticatedFetch, getUsername, apiUrl } from '../utils/auth';
+import { fetchGroups, groupsOf, isListed } from '../utils/groups';
 
 export default function Timeline() {
     const { project } = useParams();
@@ -12,7 +13,12 @@ export default function Timeline() {
     const [loading, setLoading] = useState(true);
     const [projectOwner, setProjectOwner] = useState('');
     const [projectAdmins, setProjectAdmins] = useState([]);
-    const isOwner = !projectOwner || projectOwner === username || projectAdmins.includes(username);
+    const [myGroups, setMyGroups] = useState([]);
+    const isOwner = !projectOwner || projectOwner === username || isListed(projectAdmins, username, myGroups);
+
+    useEffect(() => {
+        fetchGroups().then(groups => setMyGroups(groupsOf(groups, username)));
+    }, [username]);
 
     // For new entry
     const [adding, setAdding] = useState(false);
@@ -1,23 +1,33 @@
 // Authentication utility functions
 
-const SESSION_TIMEOUT = 60 * 60 * 1000; // 1 hour in milliseconds
+const SESSION_TIMEOUT = 60 * 60 * 1000; // 1 hour in milliseconds (fallback when no refresh expiry is stored)
 
 /**
- * Check if the current session is still valid (within 1 hour timeout)
+ * Check if the current session is still valid. A session lasts as long as
+ * its refresh token; expired access tokens are renewed by authenticatedFetch.
  * @returns {boolean} true if session is valid, false otherwise
  */
 export function isSessionValid() {
   const token = localStorage.getItem('auth_token');
-  const loginTime = localStorage.getItem('login_time');
-  
-  if (!token || !loginTime) {
+  if (!token) {
     return false;
   }
-  
-  const currentTime = new Date().getTime();
-  const elapsedTime = currentTime - parseInt(loginTime);
-  
-  return elapsedTime < SESSION_TIMEOUT;
+  return getRemainingSessionTime() > 0;
+}
+
+/**
+ * Store the tokens returned by /api/login or /api/refresh
+ * @param {object} data - { token, refresh_token, refresh_expires_at }
+ */
+export function storeSession(data) {
+  localStorage.setItem('auth_token', data.token);
+  if (data.refresh_token) {
+    localStorage.setItem('refresh_token', data.refresh_token);
+  }
+  if (data.refresh_expires_at) {
+    localStorage.setItem('session_expires', String(new Date(data.refresh_expires_at).getTime()));
+  }
+  localStorage.setItem('login_time', new Date().getTime().toString());
 }
 
 /**
@@ -41,6 +51,8 @@ export function getUsername() {
  */
 export function clearAuth() {
   localStorage.removeItem('auth_token');
+  localStorage.removeItem('refresh_token');
+  localStorage.removeItem('session_expires');
   localStorage.removeItem('chat_username');
   localStorage.removeItem('login_time');
   localStorage.removeItem('is_admin');
@@ -52,19 +64,50 @@ export function clearAuth() {
  * @returns {number} remaining time in milliseconds, or 0 if expired
  */
 export function getRemainingSessionTime() {
+  const currentTime = new Date().getTime();
+  const expires = localStorage.getItem('session_expires');
+  if (expires) {
+    const remaining = parseInt(expires) - currentTime;
+    return remaining > 0 ? remaining : 0;
+  }
+
   const loginTime = localStorage.getItem('login_time');
-  
   if (!loginTime) {
     return 0;
   }
-  
-  const currentTime = new Date().getTime();
-  const elapsedTime = currentTime - parseInt(loginTime);
-  const remaining = SESSION_TIMEOUT - elapsedTime;
-  
+  const remaining = SESSION_TIMEOUT - (currentTime - parseInt(loginTime));
   return remaining > 0 ? remaining : 0;
 }
 
+// Shared in-flight refresh so parallel 401s only rotate the tokens once
+let refreshPromise = null;
+
+/**
+ * Exchange the stored refresh token for a new token pair
+ * @returns {Promise<boolean>} true if the session was renewed
+ */
+export function refreshSession() {
+  const refreshToken = localStorage.getItem('refresh_token');
+  if (!refreshToken) {
+    return Promise.resolve(false);
+  }
+  if (!refreshPromise) {
+    refreshPromise = fetch(apiUrl('/api/refresh'), {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ refresh_token: refreshToken }),
+    })
+      .then(async (res) => {
+        if (!res.ok) return false;
+        storeSession(await res.json());
+        return true;
+      })
+      .catch(() => false)
+      .finally(() => { refreshPromise = null; });
+  }
+  return refreshPromise;
+}
+
 /**
  * Make an authenticated API request
  * @param {string} url - The API endpoint URL
@@ -83,10 +126,18 @@ export async function authenticatedFetch(url, options = {}) {
     'Authorization': token,
   };
   
-  return fetch(url, {
+  const res = await fetch(url, {
     ...options,
     headers,
   });
+  // Access token expired: renew it with the refresh token and retry once
+  if (res.status === 401 && await refreshSession()) {
+    return fetch(url, {
+      ...options,
+      headers: { ...options.headers, 'Authorization': getAuthToken() },
+    });
+  }
+  return res;
 }
 
 /**
@@ -119,6 +170,18 @@ export function apiUrl(path) {
   return `${base}${p}`;
 }
 
+/**
+ * Adds the session token to a URL the browser loads by itself (an <img> src),
+ * which cannot carry the Authorization header.
+ * @param {string} url
+ * @returns {string} url with a token query parameter
+ */
+export function withAuthToken(url) {
+  const token = getAuthToken();
+  if (!token) return url;
+  return `${url}${url.includes('?') ? '&' : '?'}token=${encodeURIComponent(token)}`;
+}
+
 /**
  * Returns true if the current logged-in user is an admin.
  */
@@ -0,0 +1,57 @@
+// Helpers for comment threads, which are anchored to cells by cell_id
+
+/**
+ * Map each thread id to the "row-col" key of its cell, found by cell_id in
+ * the loaded cells and otherwise by the label the server last sent
+ * @param {Array} threads - comment threads
+ * @param {Object} data - cells by "row-col" key
+ */
+export function threadCellKeys(threads, data) {
+  const byCellID = {};
+  Object.keys(data || {}).forEach(key => {
+    const id = data[key]?.cell_id;
+    if (id) byCellID[id] = key;
+  });
+  const out = {};
+  (threads || []).forEach(t => {
+    if (byCellID[t.cell_id]) {
+      out[t.id] = byCellID[t.cell_id];
+      return;
+    }
+    const m = /^([A-Z]+)(\d+)$/.exec(t.cell || '');
+    if (m) out[t.id] = `${m[2]}-${m[1]}`;
+  });
+  return out;
+}
+
+/**
+ * Group threads by the "row-col" key of their cell
+ */
+export function threadsByCell(threads, keys) {
+  const out = {};
+  (threads || []).forEach(t => {
+    const key = keys[t.id];
+    if (!key) return;
+    (out[key] = out[key] || []).push(t);
+  });
+  return out;
+}
+
+/**
+ * The A1 label of a "row-col" key, or '' once the cell is gone
+ */
+export function keyLabel(key) {
+  if (!key) return '';
+  const i = key.indexOf('-');
+  return key.slice(i + 1) + key.slice(0, i);
+}
+
+/**
+ * Replace the thread with thread's id, or append it
+ */
+export function upsertThread(threads, thread) {
+  const list = threads || [];
+  return list.some(t => t.id === thread.id)
+    ? list.map(t => (t.id === thread.id ? thread : t))
+    : [...list, thread];
+}
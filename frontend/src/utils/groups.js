@@ -0,0 +1,37 @@
+// Helpers for user groups; "@name" in a user list stands for group name
+import { authenticatedFetch, apiUrl } from './auth';
+
+export const GROUP_PREFIX = '@';
+
+/**
+ * Fetch all groups
+ * @returns {Promise<Array>} groups with name, owners and members
+ */
+export async function fetchGroups() {
+  try {
+    const res = await authenticatedFetch(apiUrl('/api/groups'));
+    if (!res.ok) return [];
+    const list = await res.json();
+    return Array.isArray(list) ? list : [];
+  } catch {
+    return [];
+  }
+}
+
+/**
+ * Names of the groups username is a member of
+ */
+export function groupsOf(groups, username) {
+  return groups.filter(g => (g.members || []).includes(username)).map(g => g.name);
+}
+
+/**
+ * Whether a list of users and "@groups" includes username
+ * @param {string[]} list
+ * @param {string} username
+ * @param {string[]} myGroups - names of the groups username is in
+ */
+export function isListed(list, username, myGroups = []) {
+  if (!Array.isArray(list) || !username) return false;
+  return list.some(n => n === username || (n.startsWith(GROUP_PREFIX) && myGroups.includes(n.slice(GROUP_PREFIX.length))));
+}
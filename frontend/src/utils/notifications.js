@@ -0,0 +1,43 @@
+// Helpers for the notification inbox and watches
+import { authenticatedFetch, apiUrl } from './auth';
+
+/**
+ * The route of the sheet a notification is about, or '' when it has none
+ * @param {Object} n - notification
+ */
+export function notificationRoute(n) {
+  if (!n?.sheet) return '';
+  const base = n.sheet_type === 'document' ? '/document/' : '/sheet/';
+  return `${base}${encodeURIComponent(n.sheet)}${n.project ? `?project=${encodeURIComponent(n.project)}` : ''}`;
+}
+
+/**
+ * How many notifications are unread
+ */
+export async function fetchUnreadCount() {
+  try {
+    const res = await authenticatedFetch(apiUrl('/api/notifications?unread=1'));
+    if (!res.ok) return 0;
+    const body = await res.json();
+    return body.unread || 0;
+  } catch {
+    return 0;
+  }
+}
+
+/**
+ * Watch a range of a sheet, or the whole sheet when range is empty.
+ * Returns the error text, or '' on success.
+ */
+export async function addWatch(projectName, sheetName, range) {
+  try {
+    const res = await authenticatedFetch(apiUrl('/api/notifications/watches'), {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ project: projectName || '', sheet_name: sheetName, range: range || '' }),
+    });
+    return res.ok ? '' : ((await res.text()) || 'Failed to add watch');
+  } catch (err) {
+    return String(err);
+  }
+}
@@ -0,0 +1,66 @@
+// Helpers for protected ranges; a bound of 0 leaves that axis open
+import { isListed } from './groups';
+
+const colIndex = (label) => {
+  let n = 0;
+  for (const ch of label || '') {
+    n = n * 26 + (ch.charCodeAt(0) - 64);
+  }
+  return n;
+};
+
+const colLabel = (n) => {
+  let label = '';
+  while (n > 0) {
+    n--;
+    label = String.fromCharCode(65 + (n % 26)) + label;
+    n = Math.floor(n / 26);
+  }
+  return label;
+};
+
+const spans = (lo, hi, v) => !lo || (v >= lo && v <= hi);
+
+/**
+ * The protected ranges that cover a cell
+ * @param {Array} ranges - the sheet's protected_ranges
+ * @param {string|number} row
+ * @param {string} col - column label
+ */
+export function rangesAt(ranges, row, col) {
+  const r = Number(row);
+  const c = colIndex(col);
+  return (ranges || []).filter(p => spans(p.row1, p.row2, r) && spans(p.col1, p.col2, c));
+}
+
+/**
+ * How a range limits username's edits of a cell: "blocked", "warn" or "" for none.
+ * @param {boolean} bypass - username owns the sheet or administers its project
+ */
+export function protectionAt(ranges, row, col, username, myGroups, bypass) {
+  if (bypass) return { level: '', range: null };
+  const limiting = rangesAt(ranges, row, col).filter(p => !isListed(p.editors, username, myGroups));
+  const blocked = limiting.find(p => !p.warn_only);
+  if (blocked) return { level: 'blocked', range: blocked };
+  if (limiting.length > 0) return { level: 'warn', range: limiting[0] };
+  return { level: '', range: null };
+}
+
+/**
+ * A range's name and A1 label for messages
+ */
+export function rangeTitle(p) {
+  return p.name ? `${p.name} (${p.range})` : p.range;
+}
+
+/**
+ * The A1 range spanning a selection of { row, col } cells, or ''
+ */
+export function rangeOfCells(cells) {
+  if (!cells || cells.length === 0) return '';
+  const rows = cells.map(c => Number(c.row));
+  const cols = cells.map(c => colIndex(c.col));
+  const from = colLabel(Math.min(...cols)) + Math.min(...rows);
+  const to = colLabel(Math.max(...cols)) + Math.max(...rows);
+  return from === to ? from : `${from}:${to}`;
+}
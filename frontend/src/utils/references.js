@@ -0,0 +1,21 @@
+// Helpers for deletes blocked by references from other sheets/projects
+
+/**
+ * Ask the user how to handle references into something being deleted.
+ * @param {string} what - description of the deleted item, e.g. "Sheet 'Budget'"
+ * @param {Array} references - [{ project, sheet, cell, kind, reference }]
+ * @returns {'rewrite'|'force'|null} delete mode, or null to abort
+ */
+export function chooseDeleteMode(what, references) {
+  const refs = Array.isArray(references) ? references : [];
+  const shown = refs.slice(0, 10).map(r => `  ${r.project}/${r.sheet}/${r.cell} (${r.kind}) -> ${r.reference}`);
+  if (refs.length > shown.length) shown.push(`  ...and ${refs.length - shown.length} more`);
+  const list = shown.join('\n');
+  if (window.confirm(`${what} is referenced by ${refs.length} cell(s):\n${list}\n\nReplace these references with their current values and delete?`)) {
+    return 'rewrite';
+  }
+  if (window.confirm(`Delete anyway and leave the references dangling?`)) {
+    return 'force';
+  }
+  return null;
+}
@@ -0,0 +1,11 @@
+// Roles a project member or sheet user can be given, most access first
+export const MEMBER_ROLES = ['editor', 'commenter', 'viewer', 'none'];
+
+export const ROLE_LABELS = {
+  owner: 'Owner',
+  admin: 'Admin',
+  editor: 'Editor',
+  commenter: 'Commenter',
+  viewer: 'Viewer',
+  none: 'No access',
+};
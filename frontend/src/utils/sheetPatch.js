@@ -0,0 +1,140 @@
+// Helpers for SHEET_PATCH and SHEET_ROWS messages
+
+// Rows per page when a sheet is first sent; the rest follow with LOAD_ROWS
+export const PAGE_ROWS = 500;
+
+const colIndex = (label) => {
+  let n = 0;
+  for (const ch of label) {
+    const c = ch.charCodeAt(0);
+    if (c < 65 || c > 90) return 0;
+    n = n * 26 + (c - 64);
+  }
+  return n;
+};
+
+const colLabel = (n) => {
+  let label = '';
+  while (n > 0) {
+    n--;
+    label = String.fromCharCode(65 + (n % 26)) + label;
+    n = Math.floor(n / 26);
+  }
+  return label;
+};
+
+/**
+ * Map a 1-based row or column index through a shift, as the server does.
+ * @returns {number|null} the new index, or null when the shift deleted it
+ */
+export function shiftIndex(sh, v) {
+  if (v <= 0) return v;
+  const count = Math.max(sh.count || 1, 1);
+  const end = sh.at + count - 1;
+  if (sh.op === 'insert') {
+    return v >= sh.at ? v + count : v;
+  }
+  if (sh.op === 'delete') {
+    if (v >= sh.at && v <= end) return null;
+    return v > end ? v - count : v;
+  }
+  if (sh.op === 'move') {
+    if (v >= sh.at && v <= end) return sh.to + (v - sh.at);
+    if (sh.at < sh.to && v > end && v < sh.to + count) return v - count;
+    if (sh.at > sh.to && v >= sh.to && v < sh.at) return v + count;
+  }
+  return v;
+}
+
+const remapKeys = (map, sh, index, label) => {
+  const out = {};
+  Object.keys(map || {}).forEach(k => {
+    const idx = index(k);
+    if (idx <= 0) {
+      out[k] = map[k];
+      return;
+    }
+    const moved = shiftIndex(sh, idx);
+    if (moved !== null) out[label(moved)] = map[k];
+  });
+  return out;
+};
+
+const mergeInts = (map, changes) => {
+  const out = { ...map };
+  Object.keys(changes || {}).forEach(k => {
+    if (changes[k]) out[k] = changes[k];
+    else delete out[k];
+  });
+  return out;
+};
+
+/**
+ * Apply a SHEET_PATCH to the client's sheet state.
+ * @param {object} state - { data, colWidths, rowHeights, rowParents } with
+ *   data keyed "row-col"; missing fields count as empty
+ * @param {object} patch - the SHEET_PATCH payload
+ * @returns {object} the new state; the input is left as it is
+ */
+export function applySheetPatch(state, patch) {
+  let { data = {}, colWidths = {}, rowHeights = {}, rowParents = {} } = state;
+  (patch.shifts || []).forEach(sh => {
+    const moved = {};
+    Object.keys(data).forEach(key => {
+      const dash = key.indexOf('-');
+      let row = parseInt(key.slice(0, dash), 10);
+      let col = key.slice(dash + 1);
+      if (sh.axis === 'col') {
+        const idx = colIndex(col);
+        if (idx > 0) {
+          const next = shiftIndex(sh, idx);
+          if (next === null) return;
+          col = colLabel(next);
+        }
+      } else if (row > 0) {
+        row = shiftIndex(sh, row);
+        if (row === null) return;
+      }
+      moved[`${row}-${col}`] = data[key];
+    });
+    data = moved;
+    if (sh.axis === 'col') {
+      colWidths = remapKeys(colWidths, sh, colIndex, colLabel);
+      return;
+    }
+    rowHeights = remapKeys(rowHeights, sh, Number, String);
+    rowParents = remapKeys(rowParents, sh, Number, String);
+    Object.keys(rowParents).forEach(r => {
+      rowParents[r] = shiftIndex(sh, rowParents[r]) ?? rowParents[r];
+    });
+  });
+  if (patch.cells) {
+    data = { ...data };
+    Object.keys(patch.cells).forEach(r => {
+      Object.keys(patch.cells[r]).forEach(c => {
+        const cell = patch.cells[r][c];
+        if (cell) data[`${r}-${c}`] = cell;
+        else delete data[`${r}-${c}`];
+      });
+    });
+  }
+  return {
+    data,
+    colWidths: mergeInts(colWidths, patch.col_widths),
+    rowHeights: mergeInts(rowHeights, patch.row_heights),
+    rowParents: mergeInts(rowParents, patch.row_parents),
+  };
+}
+
+/**
+ * Flatten the rows of a SHEET_ROWS payload into "row-col" keys.
+ */
+export function flattenRows(rows) {
+  const out = {};
+  Object.keys(rows || {}).forEach(r => {
+    Object.keys(rows[r]).forEach(c => {
+      out[`${r}-${c}`] = rows[r][c];
+    });
+  });
+  return out;
+}